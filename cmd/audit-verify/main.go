@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Pelfox/codecell-runner/internal/audit"
+)
+
+// audit-verify checks the hash chain of the audit log files given in the
+// chronological order, i.e. the rotated files first and the current one last.
+// The chain is anchored at the first line of the first file.
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: audit-verify <file>...")
+		os.Exit(2)
+	}
+
+	var prevHash *string
+	for _, path := range os.Args[1:] {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			os.Exit(1)
+		}
+		hash, err := audit.Verify(file, prevHash)
+		_ = file.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			os.Exit(1)
+		}
+		if hash != "" {
+			prevHash = &hash
+		}
+	}
+	fmt.Println("audit log chain is intact")
+}
@@ -0,0 +1,576 @@
+// Command codecell runs local files against a runner, for debugging, demos
+// and end-to-end smoke tests of the server:
+//
+//	codecell run --server host:50051 --lang dotnet --stdin-file input.txt --timeout 30 Program.cs
+//	codecell stop --server host:50051 [--force] REQUEST_ID
+//	codecell languages --server host:50051
+//	codecell assets --server host:50051
+//	codecell status --server host:50051
+//	codecell info --server host:50051
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	v1 "github.com/Pelfox/codecell-runner/generated"
+	"github.com/Pelfox/codecell-runner/pkg/client"
+	"github.com/fatih/color"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// exitFailure is the exit code of the failed commands, and of the runs
+	// which have ended without the program exiting.
+	exitFailure = 1
+	// exitUsage is the exit code of the invalid invocations.
+	exitUsage = 2
+	// exitInterrupted is the exit code of the runs interrupted with Ctrl+C.
+	exitInterrupted = 130
+)
+
+var (
+	stderrColor  = color.New(color.FgRed)
+	infoColor    = color.New(color.FgCyan)
+	warningColor = color.New(color.FgYellow)
+	errorColor   = color.New(color.FgRed, color.Bold)
+	statsColor   = color.New(color.Faint)
+)
+
+// connection are the flags of every command, to reach the runner by.
+type connection struct {
+	server  string
+	tls     bool
+	apiKey  string
+	token   string
+	json    bool
+	noColor bool
+}
+
+// register registers the connection flags in the set.
+func (c *connection) register(flags *flag.FlagSet) {
+	flags.StringVar(&c.server, "server", "localhost:50051", "address of the runner")
+	flags.BoolVar(&c.tls, "tls", false, "connect over TLS, verified with the system roots")
+	flags.StringVar(&c.apiKey, "api-key", os.Getenv("CODECELL_API_KEY"), "API key of the caller (CODECELL_API_KEY)")
+	flags.StringVar(&c.token, "token", os.Getenv("CODECELL_TOKEN"), "bearer token of the caller (CODECELL_TOKEN)")
+	flags.BoolVar(&c.json, "json", false, "print the messages as JSON, one per line")
+	flags.BoolVar(&c.noColor, "no-color", false, "disable the colors")
+}
+
+// dial connects to the runner, returning the context carrying the credentials.
+func (c *connection) dial(ctx context.Context) (*client.Client, context.Context, error) {
+	if c.noColor || c.json {
+		color.NoColor = true
+	}
+	var options client.Options
+	if c.tls {
+		options.DialOptions = append(options.DialOptions,
+			grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})))
+	}
+	runner, err := client.New(c.server, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.apiKey != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-api-key", c.apiKey)
+	}
+	if c.token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+c.token)
+	}
+	return runner, ctx, nil
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: codecell <run|stop|languages|assets|status|info> [flags] [arguments]")
+	fmt.Fprintln(os.Stderr, "run 'codecell <command> -h' for the flags of a command")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	// Ctrl+C cancels the run stream, which stops the run on the runner
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var code int
+	switch command, args := os.Args[1], os.Args[2:]; command {
+	case "run":
+		code = runCommand(ctx, args)
+	case "stop":
+		code = stopCommand(ctx, args)
+	case "languages":
+		code = languagesCommand(ctx, args)
+	case "assets":
+		code = assetsCommand(ctx, args)
+	case "status":
+		code = statusCommand(ctx, args)
+	case "info":
+		code = infoCommand(ctx, args)
+	case "-h", "-help", "--help", "help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", command)
+		usage()
+		code = exitUsage
+	}
+	stop()
+	os.Exit(code)
+}
+
+// fail prints the error, with the gRPC status message if it has one.
+func fail(format string, err error) int {
+	if st, ok := status.FromError(err); ok {
+		err = fmt.Errorf("%s: %s", st.Code(), st.Message())
+	}
+	_, _ = errorColor.Fprintf(os.Stderr, format+": %v\n", err)
+	return exitFailure
+}
+
+// printJSON prints the message as a line of JSON.
+func printJSON(message proto.Message) {
+	data, err := protojson.Marshal(message)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to encode the message: %v\n", err)
+		return
+	}
+	fmt.Println(string(data))
+}
+
+// parseInterspersed parses the flags wherever they are among the arguments,
+// returning the positional arguments.
+func parseInterspersed(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		_ = flags.Parse(args) // exits on errors
+		if flags.NArg() == 0 {
+			return positional
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+// readLines reads the lines of the stdin file, "-" being the standard input.
+func readLines(path string) ([]string, error) {
+	var contents []byte
+	var err error
+	if path == "-" {
+		contents, err = io.ReadAll(os.Stdin)
+	} else {
+		contents, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// runCommand runs the source file, relaying its output, and returns the exit
+// code of the program.
+func runCommand(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	var conn connection
+	conn.register(flags)
+	language := flags.String("lang", "", "language of the source file")
+	image := flags.String("image", "", "custom image to run the command in, instead of a language")
+	stdinFile := flags.String("stdin-file", "", "file of the standard input lines, - for the standard input")
+	timeout := flags.Int("timeout", 0, "timeout of the run in seconds, the runner default if 0")
+	quiet := flags.Bool("quiet", false, "suppress the informational messages and the statistics")
+	skipDedup := flags.Bool("skip-dedup", false, "run even if an identical run is in flight")
+	var labels labelsFlag
+	flags.Var(&labels, "label", "key=value label of the run, repeatable")
+	var assets listFlag
+	flags.Var(&assets, "asset", "name of an asset of the runner mounted into the workspace, repeatable")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: codecell run [flags] FILE [-- COMMAND...]")
+		flags.PrintDefaults()
+	}
+	var command []string
+	if separator := slices.Index(args, "--"); separator >= 0 {
+		args, command = args[:separator], args[separator+1:]
+	}
+	files := parseInterspersed(flags, args)
+	if len(files) != 1 || (*language == "") == (*image == "") {
+		flags.Usage()
+		return exitUsage
+	}
+
+	source, err := os.ReadFile(files[0])
+	if err != nil {
+		return fail("failed to read the source file", err)
+	}
+	spec := client.RunSpec{
+		Language:   *language,
+		SourceCode: string(source),
+		Image:      *image,
+		Command:    command,
+		Timeout:    time.Duration(*timeout) * time.Second,
+		Labels:     labels,
+		SkipDedup:  *skipDedup,
+		Assets:     assets,
+	}
+	if *stdinFile != "" {
+		if spec.Stdin, err = readLines(*stdinFile); err != nil {
+			return fail("failed to read the stdin file", err)
+		}
+	}
+
+	runner, ctx, err := conn.dial(ctx)
+	if err != nil {
+		return fail("failed to connect to the runner", err)
+	}
+	defer runner.Close()
+	execution, err := runner.Run(ctx, spec)
+	if err != nil {
+		if ctx.Err() != nil {
+			return exitInterrupted
+		}
+		return fail("failed to start the run", err)
+	}
+	if !conn.json && !*quiet {
+		_, _ = infoColor.Fprintf(os.Stderr, "request ID: %s\n", execution.RequestID)
+	}
+
+	stdout, stderr, stats, events := execution.Stdout, execution.Stderr, execution.Stats, execution.Events
+	for stdout != nil || stderr != nil || stats != nil || events != nil {
+		select {
+		case line, ok := <-stdout:
+			if !ok {
+				stdout = nil
+				continue
+			}
+			if conn.json {
+				printJSON(&v1.RunResponseMessage{RequestId: execution.RequestID, Level: v1.MessageLevel_STDOUT,
+					Payload: &v1.RunResponseMessage_Message{Message: line}})
+				continue
+			}
+			fmt.Println(line)
+		case line, ok := <-stderr:
+			if !ok {
+				stderr = nil
+				continue
+			}
+			if conn.json {
+				printJSON(&v1.RunResponseMessage{RequestId: execution.RequestID, Level: v1.MessageLevel_STDERR,
+					Payload: &v1.RunResponseMessage_Message{Message: line}})
+				continue
+			}
+			_, _ = stderrColor.Fprintln(os.Stderr, line)
+		case statistics, ok := <-stats:
+			if !ok {
+				stats = nil
+				continue
+			}
+			if conn.json {
+				printJSON(&v1.RunResponseMessage{RequestId: execution.RequestID, Level: v1.MessageLevel_STATISTICS,
+					Payload: &v1.RunResponseMessage_Statistics{Statistics: statistics}})
+				continue
+			}
+			if !*quiet {
+				_, _ = statsColor.Fprintf(os.Stderr, "memory %d B, CPU %.1f%%\n",
+					statistics.GetMemoryUsed(), statistics.GetCpuPercent())
+			}
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if conn.json {
+				printJSON(event)
+				continue
+			}
+			printEvent(event, *quiet)
+		}
+	}
+
+	result, err := execution.Wait()
+	if err != nil {
+		if ctx.Err() != nil {
+			return exitInterrupted
+		}
+		return fail("run failed", err)
+	}
+	if !result.Exited {
+		return exitFailure
+	}
+	return int(result.ExitCode)
+}
+
+// printEvent prints the runner message, the informational ones unless quiet.
+func printEvent(event *v1.RunResponseMessage, quiet bool) {
+	switch event.GetLevel() {
+	case v1.MessageLevel_WARNING:
+		_, _ = warningColor.Fprintln(os.Stderr, event.GetMessage())
+	case v1.MessageLevel_ERROR, v1.MessageLevel_PREEMPTED, v1.MessageLevel_CANCELLED:
+		_, _ = errorColor.Fprintln(os.Stderr, event.GetMessage())
+	case v1.MessageLevel_QUEUED:
+		if !quiet {
+			queue := event.GetQueueStatus()
+			_, _ = infoColor.Fprintf(os.Stderr, "queued at position %d, about %ds to wait\n",
+				queue.GetPosition(), queue.GetEstimatedWaitSeconds())
+		}
+	case v1.MessageLevel_COALESCED:
+		if !quiet {
+			_, _ = infoColor.Fprintln(os.Stderr, event.GetMessage())
+		}
+	case v1.MessageLevel_STARTED:
+		if !quiet {
+			environment := event.GetEnvironment()
+			network := "offline"
+			if environment.GetNetworkEnabled() {
+				network = "with network"
+			}
+			_, _ = infoColor.Fprintf(os.Stderr, "running %s %s on %s (%s, %s)\n",
+				environment.GetLanguage(), environment.GetLanguageVersion(), environment.GetImage(),
+				environment.GetRuntime(), network)
+		}
+	case v1.MessageLevel_RUNNING:
+		if !quiet {
+			timings := event.GetTimings()
+			_, _ = infoColor.Fprintf(os.Stderr, "program started after %s queued and %s of setup\n",
+				time.Duration(timings.GetQueueWaitMillis())*time.Millisecond,
+				time.Duration(timings.GetSetupMillis())*time.Millisecond)
+		}
+	case v1.MessageLevel_EXIT_CODE:
+		if !quiet {
+			_, _ = infoColor.Fprintf(os.Stderr, "exit code: %d\n", event.GetExitCode())
+		}
+	default:
+		if !quiet {
+			_, _ = infoColor.Fprintln(os.Stderr, event.GetMessage())
+		}
+	}
+}
+
+// stopCommand stops the run with the given request ID.
+func stopCommand(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("stop", flag.ExitOnError)
+	var conn connection
+	conn.register(flags)
+	force := flags.Bool("force", false, "kill the container instead of stopping it gracefully")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: codecell stop [flags] REQUEST_ID")
+		flags.PrintDefaults()
+	}
+	requestIDs := parseInterspersed(flags, args)
+	if len(requestIDs) != 1 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	runner, ctx, err := conn.dial(ctx)
+	if err != nil {
+		return fail("failed to connect to the runner", err)
+	}
+	defer runner.Close()
+	if err := runner.Stop(ctx, requestIDs[0], *force); err != nil {
+		return fail("failed to stop the run", err)
+	}
+	return 0
+}
+
+// languagesCommand lists the languages of the runner.
+func languagesCommand(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("languages", flag.ExitOnError)
+	var conn connection
+	conn.register(flags)
+	_ = flags.Parse(args)
+
+	runner, ctx, err := conn.dial(ctx)
+	if err != nil {
+		return fail("failed to connect to the runner", err)
+	}
+	defer runner.Close()
+	languages, err := runner.ListLanguages(ctx)
+	if err != nil {
+		return fail("failed to list the languages", err)
+	}
+	if conn.json {
+		printJSON(&v1.ListLanguagesResponse{Languages: languages})
+		return 0
+	}
+
+	for _, language := range languages {
+		if language.GetAvailable() {
+			fmt.Printf("%-12s %s\n", language.GetName(), language.GetImage())
+		} else {
+			fmt.Printf("%-12s %s %s\n", language.GetName(), language.GetImage(),
+				errorColor.Sprintf("(unavailable: %s)", language.GetUnavailableReason()))
+		}
+		if limits := language.GetLimits(); limits != nil {
+			timeout := fmt.Sprintf("%d s", limits.GetDefaultTimeoutSeconds())
+			if limits.GetMaxTimeoutSeconds() > 0 {
+				timeout += fmt.Sprintf(" (up to %d s)", limits.GetMaxTimeoutSeconds())
+			}
+			fmt.Printf("  limits: %d B of memory, %d nano-CPUs, %d processes, timeout of %s\n",
+				limits.GetMemoryLimitBytes(), limits.GetCpuLimitNanos(), limits.GetPidsLimit(), timeout)
+		}
+	}
+	return 0
+}
+
+// assetsCommand lists the assets staged on the runner.
+func assetsCommand(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("assets", flag.ExitOnError)
+	var conn connection
+	conn.register(flags)
+	_ = flags.Parse(args)
+
+	runner, ctx, err := conn.dial(ctx)
+	if err != nil {
+		return fail("failed to connect to the runner", err)
+	}
+	defer runner.Close()
+	assets, err := runner.ListAssets(ctx)
+	if err != nil {
+		return fail("failed to list the assets", err)
+	}
+	if conn.json {
+		printJSON(&v1.ListAssetsResponse{Assets: assets})
+		return 0
+	}
+
+	for _, asset := range assets {
+		fmt.Printf("%-32s %d B\n", asset.GetName(), asset.GetSizeBytes())
+	}
+	return 0
+}
+
+// statusCommand prints the capacity and the load of the runner.
+func statusCommand(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	var conn connection
+	conn.register(flags)
+	_ = flags.Parse(args)
+
+	runner, ctx, err := conn.dial(ctx)
+	if err != nil {
+		return fail("failed to connect to the runner", err)
+	}
+	defer runner.Close()
+	capacity, err := runner.GetCapacity(ctx)
+	if err != nil {
+		return fail("failed to get the capacity", err)
+	}
+	if conn.json {
+		printJSON(capacity)
+		return 0
+	}
+
+	state := color.GreenString("serving")
+	if capacity.GetDraining() {
+		state = warningColor.Sprint("draining")
+	}
+	fmt.Printf("state:    %s\n", state)
+	fmt.Printf("runs:     %d/%d active, %d queued\n",
+		capacity.GetActiveRuns(), capacity.GetMaxConcurrentRuns(), capacity.GetQueueDepth())
+	fmt.Printf("headroom: %d B of memory, %d nano-CPUs\n",
+		capacity.GetMemoryHeadroomBytes(), capacity.GetCpuHeadroomNanos())
+	for _, language := range capacity.GetLanguages() {
+		fmt.Printf("  %-12s %d/%d active, available: %t\n", language.GetName(),
+			language.GetActiveRuns(), language.GetMaxConcurrentRuns(), language.GetAvailable())
+		if reason := language.GetUnavailableReason(); reason != "" {
+			fmt.Printf("  %-12s %s\n", "", errorColor.Sprint(reason))
+		}
+	}
+	return 0
+}
+
+// infoCommand prints the build of the runner and the environment it runs in.
+func infoCommand(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("info", flag.ExitOnError)
+	var conn connection
+	conn.register(flags)
+	_ = flags.Parse(args)
+
+	runner, ctx, err := conn.dial(ctx)
+	if err != nil {
+		return fail("failed to connect to the runner", err)
+	}
+	defer runner.Close()
+	info, err := runner.GetServerInfo(ctx)
+	if err != nil {
+		return fail("failed to get the server info", err)
+	}
+	if conn.json {
+		printJSON(info)
+		return 0
+	}
+
+	fmt.Printf("version: %s (%s), %s\n", info.GetVersion(), info.GetCommit(), info.GetGoVersion())
+	if info.GetDockerVersion() != "" {
+		fmt.Printf("docker:  %s, %s storage, %s runtime\n", info.GetDockerVersion(), info.GetStorageDriver(), info.GetRuntime())
+	} else {
+		fmt.Printf("docker:  %s, %s runtime\n", warningColor.Sprint("unreachable"), info.GetRuntime())
+	}
+	for _, image := range info.GetImages() {
+		digest := image.GetDigest()
+		if digest == "" {
+			digest = warningColor.Sprint("no digest")
+		}
+		fmt.Printf("  %-12s %s %s\n", image.GetLanguage(), image.GetImage(), digest)
+	}
+	return 0
+}
+
+// labelsFlag collects the repeated key=value labels.
+type labelsFlag map[string]string
+
+func (l *labelsFlag) String() string {
+	pairs := make([]string, 0, len(*l))
+	for key, value := range *l {
+		pairs = append(pairs, key+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (l *labelsFlag) Set(value string) error {
+	key, labelValue, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return errors.New("expected key=value")
+	}
+	if *l == nil {
+		*l = make(labelsFlag)
+	}
+	(*l)[key] = labelValue
+	return nil
+}
+
+// listFlag collects the repeated values.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/rs/zerolog/log"
+)
+
+// watchConfig reloads the dynamic settings on SIGHUP, and whenever the
+// configuration file changes if interval is positive. An invalid configuration
+// is rejected, the current one staying active.
+func watchConfig(store *pkg.ConfigStore, path string, interval time.Duration) {
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+
+	var changes <-chan time.Time
+	var modTime time.Time
+	if path != "" && interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		changes = ticker.C
+		if info, err := os.Stat(path); err == nil {
+			modTime = info.ModTime()
+		}
+	}
+
+	reload := func(trigger string) {
+		warnings, err := store.Reload()
+		for _, warning := range warnings {
+			log.Warn().Str("path", path).Msg(warning)
+		}
+		if err != nil {
+			log.Error().Err(err).Str("trigger", trigger).
+				Msg("rejected the reloaded configuration, keeping the current one")
+			return
+		}
+		log.Info().Str("trigger", trigger).Msg("reloaded the dynamic configuration")
+	}
+	for {
+		select {
+		case <-reloads:
+			reload("signal")
+		case <-changes:
+			info, err := os.Stat(path)
+			if err != nil {
+				log.Error().Err(err).Str("path", path).Msg("failed to check the configuration file")
+				continue
+			}
+			if info.ModTime().Equal(modTime) {
+				continue
+			}
+			modTime = info.ModTime()
+			reload("file")
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/tls"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/improbable-eng/grpc-web/go/grpcweb"
+	"google.golang.org/grpc"
+)
+
+// grpcWebHeaders are the request headers of the grpc-web clients themselves,
+// always allowed on top of the configured ones.
+var grpcWebHeaders = []string{"content-type", "x-grpc-web", "x-user-agent", "grpc-timeout"}
+
+// allowedOrigin returns whether the browser origin may call the server, "*"
+// allowing every origin.
+func allowedOrigin(origins []string) func(string) bool {
+	return func(origin string) bool {
+		return slices.ContainsFunc(origins, func(allowed string) bool {
+			return allowed == "*" || strings.EqualFold(allowed, origin)
+		})
+	}
+}
+
+// grpcWebServer returns the HTTP server of the listener when grpc-web is
+// enabled: the grpc-web requests and their CORS preflights are translated for
+// the browser clients, while the native gRPC ones go to the server as is. The
+// keepalive and stream limits carry over to HTTP/2, the connection ages don't.
+func grpcWebServer(config *pkg.AppConfig, grpcServer *grpc.Server, tlsConfig *tls.Config) *http.Server {
+	wrapped := grpcweb.WrapServer(grpcServer,
+		grpcweb.WithOriginFunc(allowedOrigin(config.GRPCWebAllowedOrigins)),
+		grpcweb.WithAllowedRequestHeaders(append(slices.Clone(grpcWebHeaders), config.GRPCWebAllowedHeaders...)),
+	)
+
+	maxStreams := int(config.GRPCMaxConcurrentStreams)
+	if maxStreams == 0 {
+		maxStreams = math.MaxInt32 // HTTP/2 would otherwise default to 250
+	}
+	protocols := &http.Protocols{}
+	protocols.SetHTTP1(true) // grpc-web doesn't require HTTP/2
+	if tlsConfig != nil {
+		protocols.SetHTTP2(true)
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	return &http.Server{
+		Handler:     wrapped,
+		TLSConfig:   tlsConfig,
+		Protocols:   protocols,
+		IdleTimeout: config.GRPCMaxConnectionIdle,
+		HTTP2: &http.HTTP2Config{
+			MaxConcurrentStreams: maxStreams,
+			SendPingTimeout:      config.GRPCKeepaliveTime,
+			PingTimeout:          config.GRPCKeepaliveTimeout,
+		},
+	}
+}
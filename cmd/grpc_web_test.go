@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// serveGRPCWeb serves the health checks over grpc-web and native gRPC on the
+// same listener, for the browsers of the origin, returning the base URL of the
+// server.
+func serveGRPCWeb(t *testing.T, origin string) string {
+	t.Helper()
+	config := loadTestConfig(t, "grpc_web_enabled: true\ngrpc_web_allowed_origins: [\""+origin+"\"]\n")
+	grpcServer := grpc.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, health.NewServer())
+	webServer := grpcWebServer(config, grpcServer, nil)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = webServer.Serve(listener) }()
+	t.Cleanup(func() {
+		_ = webServer.Close()
+		grpcServer.Stop()
+	})
+	return "http://" + listener.Addr().String()
+}
+
+// grpcWebFrames splits the body of a grpc-web response into its messages and
+// its trailers.
+func grpcWebFrames(t *testing.T, body []byte) ([][]byte, string) {
+	t.Helper()
+	var messages [][]byte
+	var trailers string
+	for len(body) > 0 {
+		if len(body) < 5 || len(body) < 5+int(binary.BigEndian.Uint32(body[1:5])) {
+			t.Fatalf("truncated grpc-web frame %q", body)
+		}
+		flags, frame := body[0], body[5:5+binary.BigEndian.Uint32(body[1:5])]
+		if flags&0x80 != 0 {
+			trailers += string(frame)
+		} else {
+			messages = append(messages, frame)
+		}
+		body = body[5+len(frame):]
+	}
+	return messages, trailers
+}
+
+func TestGRPCWebServesAUnaryCall(t *testing.T) {
+	base := serveGRPCWeb(t, "https://app.example.com")
+
+	request, err := proto.Marshal(&healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(request)))
+	httpRequest, err := http.NewRequest(http.MethodPost, base+"/grpc.health.v1.Health/Check",
+		bytes.NewReader(append(frame, request...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpRequest.Header.Set("Content-Type", "application/grpc-web+proto")
+	httpRequest.Header.Set("X-Grpc-Web", "1")
+	httpRequest.Header.Set("Origin", "https://app.example.com")
+	response, err := http.DefaultClient.Do(httpRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK || !strings.HasPrefix(response.Header.Get("Content-Type"), "application/grpc-web") {
+		t.Fatalf("POST Check = %d %q, want a grpc-web response", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+	if origin := response.Header.Get("Access-Control-Allow-Origin"); origin != "https://app.example.com" {
+		t.Errorf("the response allows the origin %q, want the one of the browser", origin)
+	}
+	messages, trailers := grpcWebFrames(t, body)
+	if !strings.Contains(trailers, "grpc-status: 0") && !strings.Contains(trailers, "grpc-status:0") {
+		t.Errorf("the trailers %q of the call don't tell its success", trailers)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("the call has answered %d messages, want 1", len(messages))
+	}
+	var check healthpb.HealthCheckResponse
+	if err := proto.Unmarshal(messages[0], &check); err != nil || check.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Check() over grpc-web = %v, %v, want SERVING", check.Status, err)
+	}
+}
+
+func TestGRPCWebChecksTheOriginOfThePreflight(t *testing.T) {
+	base := serveGRPCWeb(t, "https://app.example.com")
+	for _, test := range []struct {
+		origin  string
+		allowed bool
+	}{
+		{origin: "https://app.example.com", allowed: true},
+		{origin: "https://evil.example.com", allowed: false},
+	} {
+		request, err := http.NewRequest(http.MethodOptions, base+"/grpc.health.v1.Health/Check", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Origin", test.origin)
+		request.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		request.Header.Set("Access-Control-Request-Headers", "content-type,x-grpc-web")
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = response.Body.Close()
+		if allowed := response.Header.Get("Access-Control-Allow-Origin") == test.origin; allowed != test.allowed {
+			t.Errorf("the preflight of %s is allowed %t, want %t", test.origin, allowed, test.allowed)
+		}
+	}
+}
+
+func TestGRPCWebKeepsServingNativeGRPC(t *testing.T) {
+	base := serveGRPCWeb(t, "*")
+	conn, err := grpc.NewClient(strings.TrimPrefix(base, "http://"),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Errorf("Check() over native gRPC = %v", err)
+	}
+}
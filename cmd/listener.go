@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Pelfox/codecell-runner/internal/systemd"
+	"github.com/Pelfox/codecell-runner/pkg"
+)
+
+// unixScheme is the prefix of the addresses of Unix domain sockets.
+const unixScheme = "unix://"
+
+// listen opens the gRPC listener: the socket passed by systemd if the runner
+// is socket-activated, a Unix domain socket for "unix://" addresses and a TCP
+// one otherwise.
+func listen(config *pkg.AppConfig) (net.Listener, error) {
+	activated, err := systemd.Listener(config.SystemdSocketName)
+	if err != nil || activated != nil {
+		return activated, err
+	}
+
+	path, ok := strings.CutPrefix(config.Addr, unixScheme)
+	if !ok {
+		return net.Listen("tcp", config.Addr)
+	}
+	if path == "" {
+		return nil, fmt.Errorf("invalid unix socket address %q", config.Addr)
+	}
+
+	// a socket left behind by a crashed runner, but never any other file
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and isn't a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove the stale socket %s: %w", path, err)
+		}
+	}
+
+	mode, err := strconv.ParseUint(config.UnixSocketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid unix socket mode %q: %w", config.UnixSocketMode, err)
+	}
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// the socket file is removed once the listener is closed on shutdown
+	listener.SetUnlinkOnClose(true)
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("failed to set the mode of the socket %s: %w", path, err)
+	}
+	if config.UnixSocketUID >= 0 || config.UnixSocketGID >= 0 {
+		if err := os.Chown(path, config.UnixSocketUID, config.UnixSocketGID); err != nil {
+			_ = listener.Close()
+			return nil, fmt.Errorf("failed to set the owner of the socket %s: %w", path, err)
+		}
+	}
+	return listener, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// socketPath returns a path for a Unix domain socket, short enough for the
+// limit of the socket addresses.
+func socketPath(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "codecell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return filepath.Join(dir, "runner.sock")
+}
+
+func TestListenServesTheHealthChecksOnTheUnixSocket(t *testing.T) {
+	path := socketPath(t)
+	// the socket of a crashed runner
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	config := loadTestConfig(t, "addr: unix://"+path+"\nunix_socket_mode: \"0600\"\n")
+	listener, err := listen(config)
+	if err != nil {
+		t.Fatalf("listen() over the stale socket = %v", err)
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0o600 {
+		t.Errorf("the socket has the mode %v, want 0600", info.Mode().Perm())
+	}
+	server := grpc.NewServer()
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	done := make(chan struct{})
+	go func() {
+		_ = server.Serve(listener)
+		close(done)
+	}()
+
+	conn, err := grpc.NewClient("unix://"+path, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	response, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil || response.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("Check() over the socket = %v, %v", response, err)
+	}
+
+	// the socket is removed on shutdown
+	server.Stop()
+	<-done
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("the socket is left behind on shutdown: %v", err)
+	}
+}
+
+func TestListenKeepsTheFilesOtherThanSockets(t *testing.T) {
+	path := socketPath(t)
+	if err := os.WriteFile(path, []byte("data"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if listener, err := listen(loadTestConfig(t, "addr: unix://"+path+"\n")); err == nil {
+		_ = listener.Close()
+		t.Fatal("listen() over a regular file has replaced it")
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "data" {
+		t.Errorf("the regular file = %q, %v, want it untouched", data, err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"os"
+	"time"
+
+	v1 "github.com/Pelfox/codecell-runner/generated"
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/mattn/go-isatty"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// setupLogging points the global logger at the configured destination and
+// format, and sets the level. It returns the log file to close, if any.
+func setupLogging(config *pkg.AppConfig) (*pkg.RotatingFile, error) {
+	level, err := zerolog.ParseLevel(config.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	var output io.Writer = os.Stderr
+	var logFile *pkg.RotatingFile
+	terminal := isatty.IsTerminal(os.Stderr.Fd())
+	if config.LogFile != "" {
+		logFile, err = pkg.NewRotatingFile(config.LogFile, config.LogFileMaxSize, config.LogFileMaxFiles)
+		if err != nil {
+			return nil, err
+		}
+		output, terminal = logFile, false
+	}
+
+	if config.LogFormat == "console" || (config.LogFormat == "" && terminal) {
+		output = zerolog.ConsoleWriter{Out: output, TimeFormat: time.RFC3339, NoColor: !terminal}
+	}
+	log.Logger = zerolog.New(output).With().Timestamp().Logger()
+	zerolog.SetGlobalLevel(level)
+	return logFile, nil
+}
+
+// logBanner logs the build of the runner and the environment it runs in, so
+// that the logs tell exactly what is deployed.
+func logBanner(info *v1.GetServerInfoResponse) {
+	images := zerolog.Dict()
+	for _, image := range info.GetImages() {
+		reference := image.GetImage()
+		if image.GetDigest() != "" {
+			reference = image.GetDigest()
+		}
+		images.Str(image.GetLanguage(), reference)
+	}
+	log.Info().
+		Str("version", info.GetVersion()).
+		Str("commit", info.GetCommit()).
+		Str("goVersion", info.GetGoVersion()).
+		Str("dockerVersion", info.GetDockerVersion()).
+		Str("storageDriver", info.GetStorageDriver()).
+		Str("runtime", info.GetRuntime()).
+		Dict("images", images).
+		Msg("codecell runner starting")
+}
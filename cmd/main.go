@@ -1,22 +1,80 @@
 package main
 
 import (
-	"net"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	v1 "github.com/Pelfox/codecell-runner/generated"
 	"github.com/Pelfox/codecell-runner/internal"
+	"github.com/Pelfox/codecell-runner/internal/admission"
+	"github.com/Pelfox/codecell-runner/internal/archive"
+	"github.com/Pelfox/codecell-runner/internal/audit"
+	"github.com/Pelfox/codecell-runner/internal/auth"
+	"github.com/Pelfox/codecell-runner/internal/discovery"
+	"github.com/Pelfox/codecell-runner/internal/lifecycle"
+	"github.com/Pelfox/codecell-runner/internal/middleware"
+	"github.com/Pelfox/codecell-runner/internal/registry"
 	"github.com/Pelfox/codecell-runner/internal/services"
+	"github.com/Pelfox/codecell-runner/internal/systemd"
+	"github.com/Pelfox/codecell-runner/internal/tracing"
 	"github.com/Pelfox/codecell-runner/pkg"
 	"github.com/moby/moby/client"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/protobuf/proto"
 )
 
 func main() {
-	config, err := pkg.LoadConfig()
+	configPath := flag.String("config", os.Getenv("CODECELL_CONFIG"), "path of the YAML, TOML or JSON configuration file")
+	flag.Parse()
+
+	// the environment variables override the file, which overrides the defaults
+	config, warnings, err := pkg.LoadConfig(*configPath)
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to load configuration")
 	}
+	// set up before anything else logs
+	logFile, err := setupLogging(config)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to set up logging")
+	}
+	if logFile != nil {
+		defer logFile.Close()
+	}
+	for _, warning := range warnings {
+		log.Warn().Str("path", *configPath).Msg(warning)
+	}
+	if err := config.Validate(); err != nil {
+		log.Fatal().Err(err).Msg("invalid configuration")
+	}
+	// the entries logged through zerolog.Ctx outside of the RPCs stay visible
+	zerolog.DefaultContextLogger = &log.Logger
+
+	shutdownTracing, err := tracing.Setup(context.Background(), config)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to set up tracing")
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			log.Error().Err(err).Msg("failed to flush the pending spans")
+		}
+	}()
 
 	dockerClient, err := client.New(client.FromEnv)
 	if err != nil {
@@ -24,21 +82,550 @@ func main() {
 	}
 	defer dockerClient.Close()
 
-	containerService := services.NewContainersService(dockerClient, config)
+	systemService := services.NewSystemService(dockerClient)
+	// the runner may start before the daemon, on boot or during its restart
+	if err := systemService.WaitForDaemon(context.Background(), config.DockerConnectTimeout); err != nil {
+		log.Fatal().Err(err).Dur("timeout", config.DockerConnectTimeout).Msg("docker daemon didn't respond in time")
+	}
+	isolationMode, err := systemService.DetectIsolationMode(context.Background())
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to detect docker daemon isolation mode")
+	}
+	if config.RequireUserNamespace && !isolationMode.IsRemapped() {
+		log.Fatal().Str("isolationMode", string(isolationMode)).
+			Msg("user namespace or rootless daemon is required, refusing to start on a root daemon")
+	}
+	log.Info().Str("isolationMode", string(isolationMode)).Msg("detected docker daemon isolation mode")
+
+	if config.CgroupParent != "" {
+		if err := systemService.EnsureCgroupParent(context.Background(), config.CgroupParent); err != nil {
+			log.Fatal().Err(err).Msg("failed to validate the cgroup parent")
+		}
+	}
+
+	cpusets, err := pkg.ParseCPUSetOverrides(config.CPUSetOverrides)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to parse cpuset overrides")
+	}
+	if config.CPUSetCPUs != "" {
+		cpusets[""] = config.CPUSetCPUs // validating the global set alongside the overrides
+	}
+	for language, cpus := range cpusets {
+		if err := systemService.ValidateCPUSet(context.Background(), cpus, config.CPULimit); err != nil {
+			log.Fatal().Err(err).Str("language", language).Msg("invalid cpuset configuration")
+		}
+	}
+
+	if config.NetworkEnabled {
+		networkService := services.NewNetworkService(dockerClient, config)
+		if err := networkService.EnsureNetwork(context.Background()); err != nil {
+			log.Fatal().Err(err).Msg("failed to set up the managed egress network")
+		}
+		// the allowlisted hosts may move to other addresses while the runner is up
+		go networkService.Watch(context.Background(), config.NetworkAllowlistRefreshInterval)
+	}
+
+	languagesService := services.NewLanguagesService(dockerClient, config, services.NewSignatureVerifier(config))
+	for language := range config.Languages {
+		if _, ok := languagesService.Technology(language); !ok {
+			log.Fatal().Str("language", language).Msg("unknown language in the configuration")
+		}
+	}
+	if unverified := languagesService.VerifyImages(context.Background()); unverified > 0 && config.CosignStrict {
+		log.Fatal().Int("unverified", unverified).Msg("runtime images failed signature verification, refusing to start")
+	}
+	// the languages become available or unavailable live, as the images are pulled or removed
+	go languagesService.Watch(context.Background(), config.ImageCheckInterval)
+
+	containerService, err := services.NewContainersService(dockerClient, config, languagesService, isolationMode)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to create containers service")
+	}
+	if err := containerService.ValidateBlkioDevice(context.Background()); err != nil {
+		log.Fatal().Err(err).Msg("invalid block I/O throttling configuration")
+	}
+	hostResources, err := systemService.HostResources(context.Background())
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to get the host resources")
+	}
+	runRegistry := registry.New(config.MemoryCapacity(hostResources.Memory), config.CompletedRunsRetention,
+		config.AbsoluteMaxRunDuration())
+
+	diskCheckPath := config.DiskCheckPath
+	if diskCheckPath == "" {
+		if diskCheckPath, err = systemService.DockerRootDir(context.Background()); err != nil {
+			log.Fatal().Err(err).Msg("failed to get the docker root dir")
+		}
+	}
+	diskMonitor := services.NewDiskMonitor(dockerClient, config, services.StatfsUsageSource{Path: diskCheckPath})
+	go diskMonitor.Run(context.Background())
+
+	eventsService := services.NewEventsService(dockerClient)
+	go eventsService.Listen(context.Background(), runRegistry.Notify)
+
+	watchdog := internal.NewWatchdog(config, runRegistry, containerService)
+	go watchdog.Run(context.Background())
+
 	logsService := services.NewLogsService(dockerClient)
-	server := internal.NewRunnerServer(containerService, logsService)
+	// the languages limited on their own are queued separately under the global limit
+	var preemptAfter time.Duration
+	if config.PreemptionEnabled {
+		preemptAfter = config.PreemptionWaitThreshold
+	}
+	limiter := admission.NewLimiter(admission.GlobalScope, config.MaxConcurrentRuns, config.QueueMaxDepth, config.QueueMaxWait, preemptAfter)
+	languageLimiters := internal.NewLanguageLimiters(languagesService, config, preemptAfter)
+	quotaOverrides, err := pkg.ParseQuotaOverrides(config.QuotaOverrides)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to parse quota overrides")
+	}
+	quotaTracker := admission.NewQuotaTracker(pkg.Quota{
+		MaxConcurrent: config.QuotaMaxConcurrent,
+		RunsPerMinute: config.QuotaRunsPerMinute,
+	}, quotaOverrides, config.QuotaMaxIdentities)
+
+	// the runs read the dynamic settings when they arrive, the limiters and
+	// the quotas holding them on their own are updated on reload
+	configStore := pkg.NewConfigStore(*configPath, config)
+	configStore.OnReload(func(dynamic *pkg.DynamicConfig) {
+		level, _ := zerolog.ParseLevel(dynamic.LogLevel) // validated already
+		zerolog.SetGlobalLevel(level)
+		limiter.SetLimits(dynamic.MaxConcurrentRuns, dynamic.QueueMaxDepth, dynamic.QueueMaxWait)
+		internal.SetLanguageLimits(languageLimiters, languagesService, dynamic)
+		overrides, _ := pkg.ParseQuotaOverrides(dynamic.QuotaOverrides) // validated already
+		quotaTracker.SetQuotas(pkg.Quota{
+			MaxConcurrent: dynamic.QuotaMaxConcurrent,
+			RunsPerMinute: dynamic.QuotaRunsPerMinute,
+		}, overrides)
+	})
+	go watchConfig(configStore, *configPath, config.ConfigWatchInterval)
+
+	priorityPolicy, err := admission.NewPriorityPolicy(config.MaxPriority, config.MaxPriorityOverrides)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to parse the priority policy")
+	}
+
+	capacityReporter := internal.NewCapacityReporter(config, runRegistry, limiter, languageLimiters, languagesService, hostResources)
+	poolSizes, err := pkg.ParsePoolSizes(config.WarmPoolSizes)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to parse warm pool sizes")
+	}
+	var warmPool *services.WarmPool
+	if len(poolSizes) > 0 {
+		// when autoscaling, the configured sizes are the maximums and the pools start at the minimums
+		var bounds map[string]internal.PoolBounds
+		if config.WarmPoolAutoscale {
+			minSizes, err := pkg.ParsePoolSizes(config.WarmPoolMinSizes)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to parse warm pool minimum sizes")
+			}
+			bounds = make(map[string]internal.PoolBounds)
+			for language, size := range poolSizes {
+				bounds[language] = internal.PoolBounds{Min: min(minSizes[language], size), Max: size}
+				poolSizes[language] = bounds[language].Min
+			}
+		}
 
-	grpcServer := grpc.NewServer()
+		warmPool = services.NewWarmPool(containerService, poolSizes, config.WarmPoolTTL)
+		go warmPool.Run(context.Background())
+		if config.WarmPoolAutoscale {
+			autoscaler := internal.NewPoolAutoscaler(config, runRegistry, warmPool, bounds)
+			go autoscaler.Run(context.Background())
+		}
+	}
+
+	// plaintext stays the default for the local development
+	var tlsConfig *tls.Config
+	peerCredentials := insecure.NewCredentials()
+	if config.TLSCertFile != "" || config.TLSKeyFile != "" {
+		if config.TLSCertFile == "" || config.TLSKeyFile == "" {
+			log.Fatal().Msg("both tls_cert_file and tls_key_file are required to serve TLS")
+		}
+		certificates, err := auth.NewCertificateReloader(config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to load the TLS certificate")
+		}
+		if config.TLSReloadInterval > 0 {
+			go certificates.Watch(context.Background(), config.TLSReloadInterval)
+		}
+		go func() {
+			reloads := make(chan os.Signal, 1)
+			signal.Notify(reloads, syscall.SIGHUP)
+			for range reloads {
+				if err := certificates.Reload(); err != nil {
+					log.Error().Err(err).Msg("failed to reload the TLS certificate")
+					continue
+				}
+				log.Info().Msg("reloaded the TLS certificate on SIGHUP")
+			}
+		}()
+		// with mutual TLS, the unverified clients are rejected during the handshake
+		var clientCAs *x509.CertPool
+		if config.TLSClientCAFile != "" {
+			if clientCAs, err = auth.LoadClientCAs(config.TLSClientCAFile); err != nil {
+				log.Fatal().Err(err).Msg("failed to load the client CAs")
+			}
+		}
+		tlsConfig = auth.ServerTLSConfig(certificates, clientCAs, config.TLSClientAllowedIdentities)
+		// the Stop calls proxied to the other instances go over TLS too
+		peerTLSConfig, err := auth.NewPeerTLSConfig(certificates, config.SharedRegistryCAFile, config.TLSClientCAFile != "")
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to set up the TLS of the other instances")
+		}
+		peerCredentials = credentials.NewTLS(peerTLSConfig)
+	} else if config.TLSClientCAFile != "" {
+		log.Fatal().Msg("mutual TLS requires tls_cert_file and tls_key_file")
+	}
+
+	var sharedBackend registry.SharedBackend
+	switch config.SharedRegistry {
+	case "":
+	case "redis":
+		if config.InstanceAddr == "" {
+			log.Fatal().Msg("instance address is required with the shared registry")
+		}
+		redisBackend, err := registry.NewRedisBackend(context.Background(), config.RedisAddr, config.RedisPassword, config.RedisDB)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to connect to the shared registry")
+		}
+		defer redisBackend.Close()
+		sharedBackend = redisBackend
+	default:
+		log.Fatal().Str("sharedRegistry", config.SharedRegistry).Msg("unsupported shared registry backend")
+	}
+
+	var lifecycleEvents *lifecycle.Dispatcher
+	var publisher lifecycle.Publisher
+	switch config.EventsBackend {
+	case "":
+	case "nats":
+		if publisher, err = lifecycle.NewNATSPublisher(config.EventsNATSURL, config.EventsNATSSubject); err != nil {
+			log.Fatal().Err(err).Msg("failed to connect to the events broker")
+		}
+	case "kafka":
+		publisher = lifecycle.NewKafkaPublisher(config.EventsKafkaBrokers, config.EventsKafkaTopic)
+	default:
+		log.Fatal().Str("eventsBackend", config.EventsBackend).Msg("unsupported events backend")
+	}
+	if publisher != nil {
+		lifecycleEvents = lifecycle.NewDispatcher(publisher, config.EventsBufferSize)
+		go lifecycleEvents.Run(context.Background())
+	}
+
+	var runStore registry.RunStore
+	switch config.RunStore {
+	case "":
+	case "bolt":
+		boltStore, err := registry.NewBoltStore(config.RunStorePath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to open the run store")
+		}
+		defer boltStore.Close()
+		runStore = boltStore
+		go internal.NewStorePruner(config, runStore).Run(context.Background())
+	default:
+		log.Fatal().Str("runStore", config.RunStore).Msg("unsupported run store")
+	}
+
+	var archiver *archive.Archiver
+	if config.ArchiveEndpoint != "" {
+		if archiver, err = archive.NewArchiver(config); err != nil {
+			log.Fatal().Err(err).Msg("failed to create the output archiver")
+		}
+	}
+
+	var auditLogger *audit.Logger
+	if config.AuditLogPath != "" {
+		if auditLogger, err = audit.NewLogger(config.AuditLogPath, config.AuditLogMaxSize, config.AuditLogMaxFiles); err != nil {
+			log.Fatal().Err(err).Msg("failed to open the audit log")
+		}
+		defer auditLogger.Close()
+	}
+
+	var coalescer *internal.Coalescer
+	if config.DedupEnabled {
+		coalescer = internal.NewCoalescer()
+	}
+
+	var assetsService *services.AssetsService
+	if config.AssetsDir != "" {
+		assetsService = services.NewAssetsService(config)
+	}
+
+	var buildCache *services.BuildCache
+	if config.BuildCacheEnabled {
+		if buildCache, err = services.NewBuildCache(dockerClient, containerService, config); err != nil {
+			log.Fatal().Err(err).Msg("failed to open the build cache")
+		}
+	}
+
+	server := internal.NewRunnerServer(
+		config,
+		configStore,
+		runRegistry,
+		limiter,
+		languageLimiters,
+		quotaTracker,
+		priorityPolicy,
+		capacityReporter,
+		warmPool,
+		sharedBackend,
+		peerCredentials,
+		lifecycleEvents,
+		lifecycle.NewWebhookNotifier(config),
+		runStore,
+		archiver,
+		auditLogger,
+		coalescer,
+		buildCache,
+		assetsService,
+		diskMonitor,
+		systemService,
+		languagesService,
+		containerService,
+		logsService,
+	)
+	logBanner(server.ServerInfo(context.Background()))
+
+	if config.MetricsAddr != "" {
+		go func() {
+			log.Info().Str("addr", config.MetricsAddr).Msg("metrics server listening")
+			if err := http.ListenAndServe(config.MetricsAddr, promhttp.Handler()); err != nil {
+				log.Error().Err(err).Msg("failed to serve metrics")
+			}
+		}()
+	}
+
+	if config.DebugEnabled {
+		if config.DebugAddr == "" || config.DebugAddr == config.Addr || config.DebugAddr == config.MetricsAddr {
+			log.Fatal().Str("debugAddr", config.DebugAddr).Msg("debug server requires an address of its own")
+		}
+	}
+	go internal.NewDebugServer(config, runRegistry, coalescer).Run(context.Background())
+
+	// the peer allowlist and the rate limits come first, they are the cheapest protection
+	var peerResolver *admission.PeerResolver
+	if config.TrustProxy {
+		peerResolver, err = admission.NewPeerResolver(config.TrustedProxyHeader, config.TrustedProxies)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to parse the trusted proxies")
+		}
+	}
+	peerRateLimiter := admission.NewPeerRateLimiter(
+		admission.RateLimit{Rate: config.RunRateLimit, Burst: config.RunRateBurst},
+		admission.RateLimit{Rate: config.ControlRateLimit, Burst: config.ControlRateBurst},
+		config.RateLimitTTL,
+		peerResolver,
+	)
+	go peerRateLimiter.Run(context.Background())
+
+	// the guards admit and authenticate the callers, of the gateway too
+	var unaryGuards []grpc.UnaryServerInterceptor
+	var streamGuards []grpc.StreamServerInterceptor
+	if len(config.AllowedCIDRs) > 0 {
+		peerAllowlist, err := admission.NewPeerAllowlist(config.AllowedCIDRs, peerResolver)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to parse the allowed CIDRs")
+		}
+		unaryGuards = append(unaryGuards, peerAllowlist.UnaryInterceptor())
+		streamGuards = append(streamGuards, peerAllowlist.StreamInterceptor())
+	}
+	unaryGuards = append(unaryGuards,
+		peerRateLimiter.UnaryInterceptor(),
+		auth.ClientCertificateUnaryInterceptor(),
+	)
+	streamGuards = append(streamGuards,
+		peerRateLimiter.StreamInterceptor(),
+		auth.ClientCertificateStreamInterceptor(),
+	)
+	if len(config.APIKeys) > 0 || config.APIKeysFile != "" {
+		apiKeys, err := auth.NewAPIKeyStore(config.APIKeys, config.APIKeysFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to load the API keys")
+		}
+		go apiKeys.Watch(context.Background(), config.APIKeysReloadInterval)
+		unaryGuards = append(unaryGuards, apiKeys.UnaryInterceptor())
+		streamGuards = append(streamGuards, apiKeys.StreamInterceptor())
+	}
+	if config.JWTJWKSURL != "" {
+		jwtAuthenticator, err := auth.NewJWTAuthenticator(context.Background(), config)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to set up the JWT authentication")
+		}
+		unaryGuards = append(unaryGuards, jwtAuthenticator.UnaryInterceptor())
+		streamGuards = append(streamGuards, jwtAuthenticator.StreamInterceptor())
+	}
+	unaryGuards = append(unaryGuards, auth.MetadataIdentityUnaryInterceptor(config.IdentityMetadataKey))
+	streamGuards = append(streamGuards, auth.MetadataIdentityStreamInterceptor(config.IdentityMetadataKey))
+
+	serverOptions := transportOptions(config)
+	// the requests other than the submissions are small, the oversized ones are
+	// rejected before being decoded
+	requestSizeGuard := middleware.NewRequestSizeGuard(config.MaxRequestSize, map[string]int{
+		string(proto.MessageName(&v1.RunRequest{})):       config.MaxRecvMsgSize,
+		string(proto.MessageName(&v1.SubmitRunRequest{})): config.MaxRecvMsgSize,
+	})
+	serverOptions = append(serverOptions, grpc.ForceServerCodecV2(requestSizeGuard.Codec()))
+	// every RPC is logged with its correlation ID, and a panicking handler
+	// fails its own RPC only, the others keep being served
+	unaryInterceptors := append([]grpc.UnaryServerInterceptor{
+		middleware.AccessLogUnaryInterceptor(),
+		middleware.RecoveryUnaryInterceptor(),
+		requestSizeGuard.UnaryInterceptor(),
+	}, unaryGuards...)
+	streamInterceptors := append([]grpc.StreamServerInterceptor{
+		middleware.AccessLogStreamInterceptor(),
+		middleware.RecoveryStreamInterceptor(),
+		requestSizeGuard.StreamInterceptor(),
+	}, streamGuards...)
+	// the root span of every RPC continues the trace of the caller, if any
+	serverOptions = append(serverOptions,
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),
+		grpc.ChainStreamInterceptor(streamInterceptors...),
+	)
+
+	// with grpc-web, the HTTP server terminates TLS for both protocols
+	if tlsConfig != nil && !config.GRPCWebEnabled {
+		serverOptions = append(serverOptions, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	grpcServer := grpc.NewServer(serverOptions...)
 	v1.RegisterRunnerServiceServer(grpcServer, server)
+	healthMonitor := internal.NewHealthMonitor(config, systemService, languagesService, capacityReporter)
+	healthpb.RegisterHealthServer(grpcServer, healthMonitor.Server())
+	go healthMonitor.Run(context.Background())
+	// the canary runs along the serving, the health service keeps the traffic away until it passes
+	if config.CanaryEnabled {
+		go func() {
+			canary := internal.NewCanary(config, server)
+			err := canary.Run(context.Background())
+			var canaryErr *internal.CanaryError
+			switch {
+			case err == nil:
+				log.Info().Msg("startup canary passed")
+			case errors.As(err, &canaryErr) && config.CanaryExitOnFailure:
+				log.Fatal().Err(canaryErr.Err).Str("stage", canaryErr.Stage).Str("requestID", canaryErr.RequestID).
+					Msg("startup canary failed")
+			case errors.As(err, &canaryErr):
+				log.Error().Err(canaryErr.Err).Str("stage", canaryErr.Stage).Str("requestID", canaryErr.RequestID).
+					Msg("startup canary failed, the runner is not serving")
+			}
+			languagesService.SetCanaryResult(config.CanaryLanguage, err)
+			healthMonitor.SetCanaryResult(err)
+			if err != nil || !config.CanaryConformance {
+				return
+			}
+			for language, err := range canary.Conformance(context.Background()) {
+				if errors.As(err, &canaryErr) {
+					log.Error().Err(canaryErr.Err).Str("language", language).Str("stage", canaryErr.Stage).
+						Str("requestID", canaryErr.RequestID).Msg("technology probe failed, the language is unavailable")
+				}
+				languagesService.SetCanaryResult(language, err)
+			}
+			log.Info().Msg("technology probes finished")
+		}()
+	}
+	registerDebugServices(grpcServer, config)
 
-	listener, err := net.Listen("tcp", config.Addr)
+	var webServer *http.Server
+	if config.GRPCWebEnabled {
+		webServer = grpcWebServer(config, grpcServer, tlsConfig)
+	}
+
+	listener, err := listen(config)
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to listen")
 	}
 	defer listener.Close()
 
-	log.Info().Str("addr", config.Addr).Msg("gRPC server listening")
-	if err := grpcServer.Serve(listener); err != nil {
+	// shutting down gracefully on signals and idleness: new runs are rejected,
+	// the active ones are let finish
+	shutdownCtx, shutdown := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer shutdown()
+	if config.IdleShutdownAfter > 0 {
+		idleMonitor := internal.NewIdleMonitor(config, capacityReporter)
+		go func() {
+			if idleMonitor.Run(shutdownCtx) {
+				shutdown()
+			}
+		}()
+	}
+
+	if config.GatewayAddr != "" {
+		if config.GatewayAddr == config.Addr || config.GatewayAddr == config.MetricsAddr ||
+			(config.DebugEnabled && config.GatewayAddr == config.DebugAddr) {
+			log.Fatal().Str("gatewayAddr", config.GatewayAddr).Msg("HTTP gateway requires an address of its own")
+		}
+		go internal.NewGateway(config, server, unaryGuards, tlsConfig).Run(shutdownCtx)
+	}
+
+	// the dispatcher stops routing here as soon as the runner drains
+	var announcer *internal.Announcer
+	var registrar discovery.Registrar
+	switch config.DiscoveryBackend {
+	case "":
+	case "consul":
+		if registrar, err = discovery.NewConsulRegistrar(config.ConsulAddr, config.ConsulToken, config.DiscoveryServiceName, config.InstanceAddr); err != nil {
+			log.Fatal().Err(err).Msg("failed to create the consul registrar")
+		}
+	case "etcd":
+		if registrar, err = discovery.NewEtcdRegistrar(config.EtcdEndpoints, config.EtcdPrefix, config.InstanceAddr); err != nil {
+			log.Fatal().Err(err).Msg("failed to create the etcd registrar")
+		}
+	default:
+		log.Fatal().Str("discoveryBackend", config.DiscoveryBackend).Msg("unsupported discovery backend")
+	}
+	if registrar != nil {
+		if config.InstanceAddr == "" {
+			log.Fatal().Msg("instance address is required with the service discovery")
+		}
+		defer registrar.Close()
+		announcer = internal.NewAnnouncer(config, registrar, capacityReporter)
+		go announcer.Run(shutdownCtx)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-shutdownCtx.Done()
+		log.Info().Msg("draining the runner and shutting down")
+		if err := systemd.Notify("STOPPING=1"); err != nil {
+			log.Warn().Err(err).Msg("failed to notify systemd of the shutdown")
+		}
+		capacityReporter.SetDraining(true)
+		healthMonitor.Shutdown()
+		if announcer != nil {
+			announcer.Stop()
+		}
+		// the handler transports of grpc-web can't be drained by gRPC, the
+		// HTTP server waits for their streams instead
+		if webServer != nil {
+			if err := webServer.Shutdown(context.Background()); err != nil {
+				log.Warn().Err(err).Msg("failed to shut down the HTTP server")
+			}
+			grpcServer.Stop()
+			return
+		}
+		grpcServer.GracefulStop()
+	}()
+
+	log.Info().Str("addr", listener.Addr().String()).Bool("tls", config.TLSCertFile != "").
+		Bool("grpcWeb", config.GRPCWebEnabled).Msg("gRPC server listening")
+	// the listener is bound already, so the connections queue until Serve accepts them
+	if err := systemd.Notify("READY=1"); err != nil {
+		log.Warn().Err(err).Msg("failed to notify systemd of the readiness")
+	}
+	if webServer != nil {
+		if tlsConfig != nil {
+			err = webServer.ServeTLS(listener, "", "")
+		} else {
+			err = webServer.Serve(listener)
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal().Err(err).Msg("failed to serve gRPC and grpc-web")
+		}
+		<-stopped // Serve returns as soon as the shutdown starts
+	} else if err := grpcServer.Serve(listener); err != nil {
 		log.Fatal().Err(err).Msg("failed to serve gRPC")
 	}
+	log.Info().Msg("runner stopped")
 }
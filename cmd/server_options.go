@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/Pelfox/codecell-runner/pkg"
+	"google.golang.org/grpc"
+	channelzservice "google.golang.org/grpc/channelz/service"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/reflection"
+)
+
+// transportOptions builds the keepalive, connection age, stream and message
+// size limits of the gRPC server from the validated configuration.
+func transportOptions(config *pkg.AppConfig) []grpc.ServerOption {
+	options := []grpc.ServerOption{
+		grpc.KeepaliveParams(keepaliveParameters(config)),
+		grpc.KeepaliveEnforcementPolicy(keepalivePolicy(config)),
+		grpc.MaxRecvMsgSize(config.MaxRecvMsgSize),
+		grpc.MaxSendMsgSize(config.MaxSendMsgSize),
+	}
+	if config.GRPCMaxConcurrentStreams > 0 {
+		options = append(options, grpc.MaxConcurrentStreams(config.GRPCMaxConcurrentStreams))
+	}
+	return options
+}
+
+// keepaliveParameters returns the keepalive pings and the connection ages of
+// the server; zero durations mean no limit to gRPC, just as they do here.
+func keepaliveParameters(config *pkg.AppConfig) keepalive.ServerParameters {
+	return keepalive.ServerParameters{
+		Time:                  config.GRPCKeepaliveTime,
+		Timeout:               config.GRPCKeepaliveTimeout,
+		MaxConnectionIdle:     config.GRPCMaxConnectionIdle,
+		MaxConnectionAge:      config.GRPCMaxConnectionAge,
+		MaxConnectionAgeGrace: config.GRPCMaxConnectionAgeGrace,
+	}
+}
+
+// keepalivePolicy returns how often the clients may ping the server.
+func keepalivePolicy(config *pkg.AppConfig) keepalive.EnforcementPolicy {
+	return keepalive.EnforcementPolicy{
+		MinTime:             config.GRPCKeepaliveMinTime,
+		PermitWithoutStream: config.GRPCKeepalivePermitWithoutStream,
+	}
+}
+
+// registerDebugServices registers the reflection and channelz services the
+// configuration enables; both expose the internals of the server, they are for
+// the debugging only.
+func registerDebugServices(server *grpc.Server, config *pkg.AppConfig) {
+	if config.EnableReflection {
+		reflection.Register(server)
+	}
+	if config.EnableChannelz {
+		channelzservice.RegisterChannelzServiceToServer(server)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/pkg"
+	"google.golang.org/grpc"
+	channelzpb "google.golang.org/grpc/channelz/grpc_channelz_v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+)
+
+// loadTestConfig loads the configuration file of the contents.
+func loadTestConfig(t *testing.T, contents string) *pkg.AppConfig {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config, _, err := pkg.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// serveHealth serves the health checks with the transport options of the
+// configuration, returning the client of the server.
+func serveHealth(t *testing.T, config *pkg.AppConfig) healthpb.HealthClient {
+	t.Helper()
+	server := grpc.NewServer(transportOptions(config)...)
+	t.Cleanup(server.Stop)
+	return healthpb.NewHealthClient(serve(t, server))
+}
+
+// serve serves the health checks on the server, returning the connection to
+// the server.
+func serve(t *testing.T, server *grpc.Server) *grpc.ClientConn {
+	t.Helper()
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.Serve(listener) }()
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func TestKeepaliveIsBuiltFromTheConfig(t *testing.T) {
+	config := loadTestConfig(t, `grpc_keepalive_time: 45s
+grpc_keepalive_timeout: 5s
+grpc_keepalive_min_time: 20s
+grpc_keepalive_permit_without_stream: false
+grpc_max_connection_idle: 10m
+grpc_max_connection_age: 1h
+grpc_max_connection_age_grace: 2m
+`)
+	wantParameters := keepalive.ServerParameters{
+		Time:                  45 * time.Second,
+		Timeout:               5 * time.Second,
+		MaxConnectionIdle:     10 * time.Minute,
+		MaxConnectionAge:      time.Hour,
+		MaxConnectionAgeGrace: 2 * time.Minute,
+	}
+	if parameters := keepaliveParameters(config); parameters != wantParameters {
+		t.Errorf("keepaliveParameters() = %+v, want %+v", parameters, wantParameters)
+	}
+	if policy := keepalivePolicy(config); policy != (keepalive.EnforcementPolicy{MinTime: 20 * time.Second}) {
+		t.Errorf("keepalivePolicy() = %+v, want the pings every 20s at most, with streams only", policy)
+	}
+
+	// the connection ages are left unlimited by default
+	defaults := keepaliveParameters(loadTestConfig(t, ""))
+	if defaults.MaxConnectionIdle != 0 || defaults.MaxConnectionAge != 0 || defaults.MaxConnectionAgeGrace != 0 {
+		t.Errorf("keepaliveParameters() of the defaults = %+v, want unlimited connection ages", defaults)
+	}
+}
+
+func TestTransportOptionsLimitTheMessages(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := serveHealth(t, loadTestConfig(t, "max_recv_msg_size: 1024\n"))
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatalf("Check() within the limits = %v", err)
+	}
+	_, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: strings.Repeat("x", 2048)})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Check() over the received size limit = %v, want RESOURCE_EXHAUSTED", err)
+	}
+
+	// the response of the health check takes 2 bytes
+	client = serveHealth(t, loadTestConfig(t, "max_send_msg_size: 1\n"))
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Check() over the sent size limit = %v, want RESOURCE_EXHAUSTED", err)
+	}
+}
+
+func TestTransportOptionsTakeMessagesAboveTheGRPCDefault(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// above the 4MiB default of gRPC, below the default of the configuration
+	request := &healthpb.HealthCheckRequest{Service: strings.Repeat("x", 5<<20)}
+
+	client := serveHealth(t, loadTestConfig(t, ""))
+	if _, err := client.Check(ctx, request); status.Code(err) != codes.NotFound {
+		t.Errorf("Check() between the limits = %v, want the unknown service reaching the handler", err)
+	}
+	server := grpc.NewServer()
+	t.Cleanup(server.Stop)
+	if _, err := healthpb.NewHealthClient(serve(t, server)).Check(ctx, request); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Check() without the transport options = %v, want RESOURCE_EXHAUSTED", err)
+	}
+}
+
+func TestTransportOptionsLimitTheConcurrentStreams(t *testing.T) {
+	client := serveHealth(t, loadTestConfig(t, "grpc_max_concurrent_streams: 1\n"))
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	watch, err := client.Watch(watchCtx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := watch.Recv(); err != nil {
+		t.Fatalf("Watch() = %v", err)
+	}
+
+	// the next stream waits for the one open
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("Check() over the stream limit = %v, want it waiting past its deadline", err)
+	}
+	stopWatching()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Errorf("Check() once the stream is closed = %v", err)
+	}
+}
+
+// listServices returns the services the reflection of the server lists.
+func listServices(ctx context.Context, conn *grpc.ClientConn) ([]string, error) {
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = stream.CloseSend() }()
+	err = stream.Send(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+	})
+	if err != nil {
+		return nil, err
+	}
+	response, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	var services []string
+	for _, service := range response.GetListServicesResponse().GetService() {
+		services = append(services, service.Name)
+	}
+	return services, nil
+}
+
+func TestDebugServicesAreRegisteredOnlyWhenEnabled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, enabled := range []bool{false, true} {
+		config := loadTestConfig(t, "")
+		config.EnableReflection = enabled
+		config.EnableChannelz = enabled
+		server := grpc.NewServer()
+		registerDebugServices(server, config)
+		t.Cleanup(server.Stop)
+		conn := serve(t, server)
+
+		services, err := listServices(ctx, conn)
+		switch {
+		case !enabled && status.Code(err) != codes.Unimplemented:
+			t.Errorf("ListServices() of the disabled reflection = %q, %v, want UNIMPLEMENTED", services, err)
+		case enabled && (err != nil || !slices.Contains(services, healthpb.Health_ServiceDesc.ServiceName)):
+			t.Errorf("ListServices() of the enabled reflection = %q, %v, want the health service", services, err)
+		}
+
+		_, err = channelzpb.NewChannelzClient(conn).GetServers(ctx, &channelzpb.GetServersRequest{})
+		if want := map[bool]codes.Code{false: codes.Unimplemented, true: codes.OK}[enabled]; status.Code(err) != want {
+			t.Errorf("GetServers() of the channelz enabled %t = %v, want %s", enabled, err, want)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package admission
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/clock"
+	"github.com/Pelfox/codecell-runner/internal/metrics"
+)
+
+// GlobalScope is the scope of the limiter shared by all runs.
+const GlobalScope = "global"
+
+// queueUpdateInterval is how often the waiting runs are told their position.
+const queueUpdateInterval = 2 * time.Second
+
+var (
+	// ErrLimitReached is returned when all slots are taken and queueing is disabled.
+	ErrLimitReached = errors.New("concurrency limit reached")
+	// ErrQueueFull is returned when the admission queue is at its maximum depth.
+	ErrQueueFull = errors.New("admission queue is full")
+	// ErrQueueTimeout is returned when a run has waited in the queue for too long.
+	ErrQueueTimeout = errors.New("timed out waiting in the admission queue")
+)
+
+// Slot is a concurrency slot taken by a run.
+type Slot struct {
+	limiter    *Limiter
+	priority   Priority
+	acquiredAt time.Time
+	once       sync.Once
+
+	onPreempt func() // guarded by the limiter mutex
+	preempted bool
+}
+
+// Release returns the slot to the limiter, handing it to the first waiting run.
+// It's safe to call more than once.
+func (s *Slot) Release() {
+	if s == nil || s.limiter == nil {
+		return
+	}
+	s.once.Do(func() { s.limiter.release(s) })
+}
+
+// OnPreempt makes the slot preemptible by waiting runs of a higher priority,
+// calling fn when it's preempted. The run must then stop and release the slot.
+func (s *Slot) OnPreempt(fn func()) {
+	if s == nil || s.limiter == nil {
+		return
+	}
+	s.limiter.mutex.Lock()
+	defer s.limiter.mutex.Unlock()
+	s.onPreempt = fn
+}
+
+// waiter is a run waiting in the admission queue.
+type waiter struct {
+	priority Priority
+	ready    chan struct{} // closed once the slot has been handed over
+	granted  bool
+}
+
+// Limiter caps the number of runs executing at the same time, optionally
+// keeping the runs over the limit in a queue until a slot frees up. The queue
+// is ordered by priority, and FIFO within the same priority.
+type Limiter struct {
+	scope        string // "global" or the language name, used in the metrics
+	limit        int    // 0 means the runs aren't limited
+	maxDepth     int    // 0 disables queueing
+	maxWait      time.Duration
+	preemptAfter time.Duration // 0 disables preemption
+	clock        clock.Clock
+
+	mutex    sync.Mutex
+	held     map[*Slot]struct{}
+	reserved int           // slots handed over to waiters not yet woken up
+	waiters  *list.List    // of *waiter, first in line at the front
+	avgHold  time.Duration // moving average of how long the slots are held
+}
+
+// NewLimiter creates a new instance of Limiter for the given scope, allowing up
+// to limit concurrent runs (0 disables the limit) and queueing up to maxDepth
+// runs for at most maxWait each (0 depth disables queueing). Runs waiting for
+// longer than preemptAfter preempt the lowest priority run below their own
+// (0 disables preemption).
+func NewLimiter(scope string, limit int, maxDepth int, maxWait time.Duration, preemptAfter time.Duration) *Limiter {
+	return &Limiter{
+		scope:        scope,
+		limit:        limit,
+		maxDepth:     maxDepth,
+		maxWait:      maxWait,
+		preemptAfter: preemptAfter,
+		clock:        clock.Real,
+		held:         make(map[*Slot]struct{}),
+		waiters:      list.New(),
+	}
+}
+
+// Acquire takes a slot for a run of the given priority, waiting in the queue
+// if all of them are taken. While waiting, notify is periodically called with
+// the 1-based queue position and the estimated wait. The caller must release
+// the returned slot.
+func (l *Limiter) Acquire(
+	ctx context.Context,
+	priority Priority,
+	notify func(position int, estimatedWait time.Duration),
+) (*Slot, error) {
+	l.mutex.Lock()
+	if l.limit <= 0 {
+		l.mutex.Unlock()
+		return &Slot{}, nil
+	}
+	if len(l.held)+l.reserved < l.limit {
+		slot := l.hold(priority)
+		l.mutex.Unlock()
+		metrics.RunSlotsInUse.WithLabelValues(l.scope).Inc()
+		return slot, nil
+	}
+	if l.maxDepth <= 0 {
+		l.mutex.Unlock()
+		return nil, ErrLimitReached
+	}
+	if l.waiters.Len() >= l.maxDepth {
+		l.mutex.Unlock()
+		return nil, ErrQueueFull
+	}
+	w := &waiter{priority: priority, ready: make(chan struct{})}
+	element := l.enqueue(w)
+	maxWait := l.maxWait
+	l.mutex.Unlock()
+	metrics.AdmissionQueueDepth.WithLabelValues(l.scope).Inc()
+
+	timeout := l.clock.NewTimer(maxWait)
+	defer timeout.Stop()
+	ticker := l.clock.NewTicker(queueUpdateInterval)
+	defer ticker.Stop()
+	var preemptTimer <-chan time.Time
+	if l.preemptAfter > 0 {
+		preemptTimer = l.clock.After(l.preemptAfter)
+	}
+
+	l.notify(element, notify)
+	for {
+		select {
+		case <-w.ready:
+			return l.grantedSlot(w), nil
+		case <-ticker.C():
+			l.notify(element, notify)
+		case <-preemptTimer:
+			l.preempt(priority)
+		case <-timeout.C():
+			return l.leave(element, w, ErrQueueTimeout)
+		case <-ctx.Done():
+			return l.leave(element, w, ctx.Err())
+		}
+	}
+}
+
+// Limit returns the maximum number of concurrent runs, 0 if unlimited.
+func (l *Limiter) Limit() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.limit
+}
+
+// SetLimits changes the limits for the runs to come. The held slots are kept
+// over a lowered limit until released, while a raised one admits the waiting
+// runs right away.
+func (l *Limiter) SetLimits(limit int, maxDepth int, maxWait time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.limit, l.maxDepth, l.maxWait = limit, maxDepth, maxWait
+	for l.waiters.Len() > 0 && (l.limit <= 0 || len(l.held)+l.reserved < l.limit) {
+		l.grant()
+		metrics.RunSlotsInUse.WithLabelValues(l.scope).Inc()
+	}
+}
+
+// QueueDepth returns the number of runs waiting for a slot.
+func (l *Limiter) QueueDepth() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.waiters.Len()
+}
+
+// Scope returns the scope of the limiter.
+func (l *Limiter) Scope() string {
+	return l.scope
+}
+
+// hold creates a slot held since now; the caller must hold the mutex.
+func (l *Limiter) hold(priority Priority) *Slot {
+	slot := &Slot{limiter: l, priority: priority, acquiredAt: l.clock.Now()}
+	l.held[slot] = struct{}{}
+	return slot
+}
+
+// grantedSlot returns the slot handed over to the waiter.
+func (l *Limiter) grantedSlot(w *waiter) *Slot {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.reserved--
+	return l.hold(w.priority)
+}
+
+// enqueue inserts the waiter behind all waiters of the same or higher
+// priority; the caller must hold the mutex.
+func (l *Limiter) enqueue(w *waiter) *list.Element {
+	for e := l.waiters.Back(); e != nil; e = e.Prev() {
+		if e.Value.(*waiter).priority >= w.priority {
+			return l.waiters.InsertAfter(w, e)
+		}
+	}
+	return l.waiters.PushFront(w)
+}
+
+// notify reports the current queue position of the waiting run.
+func (l *Limiter) notify(element *list.Element, notify func(int, time.Duration)) {
+	if notify == nil {
+		return
+	}
+
+	l.mutex.Lock()
+	position := 1
+	for e := l.waiters.Front(); e != nil && e != element; e = e.Next() {
+		position++
+	}
+	// every full round of the limit has to wait for the slots to be freed once
+	var estimatedWait time.Duration
+	if l.limit > 0 {
+		rounds := (position + l.limit - 1) / l.limit
+		estimatedWait = time.Duration(rounds) * l.avgHold
+	}
+	l.mutex.Unlock()
+
+	notify(position, estimatedWait)
+}
+
+// preempt asks the lowest priority preemptible run below the given priority
+// to stop. Runs of equal or higher priority are never preempted.
+func (l *Limiter) preempt(priority Priority) {
+	l.mutex.Lock()
+	var victim *Slot
+	for slot := range l.held {
+		if slot.onPreempt == nil || slot.preempted || slot.priority >= priority {
+			continue
+		}
+		// among the lowest priority runs, the youngest one loses the least work
+		if victim == nil || slot.priority < victim.priority ||
+			(slot.priority == victim.priority && slot.acquiredAt.After(victim.acquiredAt)) {
+			victim = slot
+		}
+	}
+	if victim == nil {
+		l.mutex.Unlock()
+		return
+	}
+	victim.preempted = true
+	onPreempt := victim.onPreempt
+	l.mutex.Unlock()
+
+	metrics.Preemptions.WithLabelValues(l.scope).Inc()
+	onPreempt()
+}
+
+// leave takes the waiting run out of the queue. If the slot has been handed
+// over in the meantime, it's passed on instead of being leaked.
+func (l *Limiter) leave(element *list.Element, w *waiter, err error) (*Slot, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if w.granted {
+		l.reserved--
+		l.handOver()
+	} else {
+		l.waiters.Remove(element)
+		metrics.AdmissionQueueDepth.WithLabelValues(l.scope).Dec()
+	}
+	return nil, err
+}
+
+// release frees the slot.
+func (l *Limiter) release(slot *Slot) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	delete(l.held, slot)
+	held := l.clock.Since(slot.acquiredAt)
+	if l.avgHold == 0 {
+		l.avgHold = held
+	} else {
+		l.avgHold = (l.avgHold*7 + held) / 8
+	}
+	l.handOver()
+}
+
+// handOver passes a freed slot to the first waiting run, or returns it to the
+// pool, unless the limit has been lowered under the held slots; the caller must
+// hold the mutex.
+func (l *Limiter) handOver() {
+	// handing the slot over directly keeps the queue order strict
+	if l.waiters.Len() > 0 && (l.limit <= 0 || len(l.held)+l.reserved < l.limit) {
+		l.grant()
+		return
+	}
+	metrics.RunSlotsInUse.WithLabelValues(l.scope).Dec()
+}
+
+// grant hands a slot over to the first waiting run; the caller must hold the
+// mutex.
+func (l *Limiter) grant() {
+	w := l.waiters.Remove(l.waiters.Front()).(*waiter)
+	w.granted = true
+	l.reserved++
+	close(w.ready)
+	metrics.AdmissionQueueDepth.WithLabelValues(l.scope).Dec()
+}
@@ -0,0 +1,256 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/clock"
+)
+
+// newTestLimiter returns a new limiter of the global scope on a fake clock.
+func newTestLimiter(limit int, maxDepth int, maxWait time.Duration, preemptAfter time.Duration) (*Limiter, *clock.Fake) {
+	fake := clock.NewFake(time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC))
+	limiter := NewLimiter(GlobalScope, limit, maxDepth, maxWait, preemptAfter)
+	limiter.clock = fake
+	return limiter, fake
+}
+
+// acquisition is the outcome of a run waiting in the queue.
+type acquisition struct {
+	name string
+	slot *Slot
+	err  error
+}
+
+// acquireInQueue makes the named run of the given priority wait in the queue,
+// returning once it's queued, which is when the fake clock has the given number
+// of timers, the ones of the runs queued before included. The outcome is sent
+// to acquisitions.
+func acquireInQueue(
+	t *testing.T,
+	limiter *Limiter,
+	fake *clock.Fake,
+	timers int,
+	name string,
+	priority Priority,
+	acquisitions chan<- acquisition,
+) {
+	t.Helper()
+	depth := limiter.QueueDepth()
+	go func() {
+		slot, err := limiter.Acquire(context.Background(), priority, nil)
+		acquisitions <- acquisition{name: name, slot: slot, err: err}
+	}()
+	fake.AwaitTimers(timers)
+	if got := limiter.QueueDepth(); got != depth+1 {
+		t.Fatalf("QueueDepth() = %d once %s is queued, want %d", got, name, depth+1)
+	}
+}
+
+func TestLimiterAdmitsByPriorityThenArrival(t *testing.T) {
+	limiter, fake := newTestLimiter(1, 10, time.Minute, 0)
+	holder, err := limiter.Acquire(context.Background(), PriorityNormal, nil)
+	if err != nil {
+		t.Fatalf("Acquire() = %v", err)
+	}
+
+	queue := []struct {
+		name     string
+		priority Priority
+	}{
+		{"batch 1", PriorityBatch},
+		{"normal 1", PriorityNormal},
+		{"interactive 1", PriorityInteractive},
+		{"normal 2", PriorityNormal},
+		{"batch 2", PriorityBatch},
+		{"interactive 2", PriorityInteractive},
+	}
+	acquisitions := make(chan acquisition, len(queue))
+	for i, run := range queue {
+		// the timeout and the queue position ticker of every run
+		acquireInQueue(t, limiter, fake, 2*(i+1), run.name, run.priority, acquisitions)
+	}
+	// the queue position updates don't reorder the queue
+	fake.Advance(queueUpdateInterval)
+
+	want := []string{"interactive 1", "interactive 2", "normal 1", "normal 2", "batch 1", "batch 2"}
+	slot := holder
+	for _, name := range want {
+		slot.Release()
+		granted := <-acquisitions
+		if granted.err != nil || granted.name != name {
+			t.Fatalf("%s is admitted (err: %v), want %s", granted.name, granted.err, name)
+		}
+		slot = granted.slot
+	}
+	slot.Release()
+	if depth := limiter.QueueDepth(); depth != 0 {
+		t.Errorf("QueueDepth() = %d once all are admitted, want 0", depth)
+	}
+}
+
+func TestLimiterTellsTheQueuePositionAndTheWait(t *testing.T) {
+	limiter, fake := newTestLimiter(1, 10, time.Minute, 0)
+	// a slot held for 30s sets the average hold
+	slot, err := limiter.Acquire(context.Background(), PriorityNormal, nil)
+	if err != nil {
+		t.Fatalf("Acquire() = %v", err)
+	}
+	fake.Advance(30 * time.Second)
+	slot.Release()
+	if _, err := limiter.Acquire(context.Background(), PriorityNormal, nil); err != nil {
+		t.Fatalf("Acquire() = %v", err)
+	}
+
+	type position struct {
+		position int
+		wait     time.Duration
+	}
+	positions := make(chan position, 10)
+	go func() {
+		_, _ = limiter.Acquire(context.Background(), PriorityNormal, func(p int, wait time.Duration) {
+			positions <- position{p, wait}
+		})
+	}()
+	if got := <-positions; got != (position{1, 30 * time.Second}) {
+		t.Errorf("the first in line is told %+v, want the position 1 and 30s", got)
+	}
+
+	// a higher priority run goes ahead of it, which it's told on the next update
+	fake.AwaitTimers(2)
+	go func() { _, _ = limiter.Acquire(context.Background(), PriorityInteractive, nil) }()
+	fake.AwaitTimers(4)
+	fake.Advance(queueUpdateInterval)
+	if got := <-positions; got != (position{2, time.Minute}) {
+		t.Errorf("the second in line is told %+v, want the position 2 and 1m", got)
+	}
+}
+
+func TestLimiterPreemptsTheYoungestOfTheLowestPriority(t *testing.T) {
+	const preemptAfter = 10 * time.Second
+	limiter, fake := newTestLimiter(3, 10, time.Minute, preemptAfter)
+	preempted := make(chan string, 3)
+	slots := make(map[string]*Slot)
+	for _, run := range []struct {
+		name     string
+		priority Priority
+	}{
+		{"old batch", PriorityBatch},
+		{"young batch", PriorityBatch},
+		{"normal", PriorityNormal},
+	} {
+		slot, err := limiter.Acquire(context.Background(), run.priority, nil)
+		if err != nil {
+			t.Fatalf("Acquire() = %v", err)
+		}
+		slot.OnPreempt(func() { preempted <- run.name })
+		slots[run.name] = slot
+		fake.Advance(time.Second)
+	}
+
+	acquisitions := make(chan acquisition, 1)
+	// the timeout, the queue position ticker and the preemption timer
+	acquireInQueue(t, limiter, fake, 3, "interactive", PriorityInteractive, acquisitions)
+	fake.Advance(preemptAfter - time.Second)
+	if len(preempted) != 0 {
+		t.Fatalf("%s is preempted before the waiting run has waited for %s", <-preempted, preemptAfter)
+	}
+
+	fake.Advance(time.Second)
+	if victim := <-preempted; victim != "young batch" {
+		t.Fatalf("%s is preempted, want the young batch", victim)
+	}
+	slots["young batch"].Release()
+	if granted := <-acquisitions; granted.err != nil {
+		t.Fatalf("the waiting run isn't admitted once the victim stops: %v", granted.err)
+	}
+	if len(preempted) != 0 {
+		t.Errorf("%s is preempted too", <-preempted)
+	}
+}
+
+func TestLimiterNeverPreemptsTheEqualPriorities(t *testing.T) {
+	const preemptAfter = 10 * time.Second
+	limiter, fake := newTestLimiter(2, 10, 2*preemptAfter, preemptAfter)
+	preempted := make(chan string, 2)
+	normal, err := limiter.Acquire(context.Background(), PriorityNormal, nil)
+	if err != nil {
+		t.Fatalf("Acquire() = %v", err)
+	}
+	normal.OnPreempt(func() { preempted <- "normal" })
+	// a lower priority run not preemptible
+	if _, err := limiter.Acquire(context.Background(), PriorityBatch, nil); err != nil {
+		t.Fatalf("Acquire() = %v", err)
+	}
+
+	acquisitions := make(chan acquisition, 1)
+	acquireInQueue(t, limiter, fake, 3, "normal waiter", PriorityNormal, acquisitions)
+	fake.Advance(preemptAfter)
+	fake.Advance(preemptAfter)
+	if granted := <-acquisitions; !errors.Is(granted.err, ErrQueueTimeout) {
+		t.Errorf("the waiting run gets %v, want ErrQueueTimeout", granted.err)
+	}
+	if len(preempted) != 0 {
+		t.Errorf("%s is preempted by a run of the same priority", <-preempted)
+	}
+}
+
+func TestLimiterUnderConcurrentRuns(t *testing.T) {
+	const limit, runs = 3, 200
+	limiter, _ := newTestLimiter(limit, runs, time.Hour, 0)
+	priorities := []Priority{PriorityBatch, PriorityNormal, PriorityInteractive}
+
+	var inUse, peak atomic.Int32
+	var wg sync.WaitGroup
+	for i := range runs {
+		wg.Go(func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if i%5 == 0 {
+				// some of the runs give up while queued, racing with the hand-overs
+				go func() {
+					runtime.Gosched()
+					cancel()
+				}()
+			}
+			slot, err := limiter.Acquire(ctx, priorities[i%len(priorities)], nil)
+			if err != nil {
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("Acquire() = %v, want a slot or the cancellation", err)
+				}
+				return
+			}
+			current := inUse.Add(1)
+			for seen := peak.Load(); current > seen && !peak.CompareAndSwap(seen, current); seen = peak.Load() {
+			}
+			runtime.Gosched()
+			inUse.Add(-1)
+			slot.Release()
+			slot.Release() // releasing twice frees a single slot
+		})
+	}
+	wg.Wait()
+
+	if got := peak.Load(); got > limit {
+		t.Errorf("%d runs have held a slot at the same time, want at most %d", got, limit)
+	}
+	if depth := limiter.QueueDepth(); depth != 0 {
+		t.Errorf("QueueDepth() = %d once all runs are done, want 0", depth)
+	}
+	// every slot is back, none more
+	for i := range limit {
+		if _, err := limiter.Acquire(context.Background(), PriorityNormal, nil); err != nil {
+			t.Fatalf("Acquire() #%d after the runs = %v", i, err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if slot, err := limiter.Acquire(ctx, PriorityInteractive, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("Acquire() past the limit = %v, %v, want the wait cancelled", slot, err)
+	}
+}
@@ -0,0 +1,95 @@
+package admission
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/metrics"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// rejectionLogInterval is the minimum interval between the logged rejections,
+// so that a scanner can't flood the logs.
+const rejectionLogInterval = 10 * time.Second
+
+// PeerAllowlist rejects the RPCs of the peers outside the allowed networks.
+type PeerAllowlist struct {
+	prefixes []netip.Prefix
+	resolver *PeerResolver
+
+	mutex      sync.Mutex
+	lastLogged time.Time
+	suppressed int
+}
+
+// NewPeerAllowlist creates a new instance of PeerAllowlist from the CIDRs,
+// checking the addresses the resolver resolves; nil checks the connection peer.
+func NewPeerAllowlist(cidrs []string, resolver *PeerResolver) (*PeerAllowlist, error) {
+	prefixes, err := parsePrefixes(cidrs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowed CIDR: %w", err)
+	}
+	return &PeerAllowlist{prefixes: prefixes, resolver: resolver}, nil
+}
+
+// Allowed reports whether the address belongs to one of the allowed networks.
+// IPv4-mapped IPv6 addresses are matched as IPv4 ones.
+func (a *PeerAllowlist) Allowed(address string) bool {
+	return containsAddress(a.prefixes, address)
+}
+
+// Check returns the PERMISSION_DENIED status if the peer of the RPC isn't allowed.
+func (a *PeerAllowlist) Check(ctx context.Context, fullMethod string) error {
+	address := a.resolver.Address(ctx)
+	if a.Allowed(address) {
+		return nil
+	}
+	metrics.AdmissionRejections.WithLabelValues("peer_not_allowed").Inc()
+	a.logRejection(address, fullMethod)
+	return status.Error(codes.PermissionDenied, "address is not allowed")
+}
+
+// logRejection logs the rejected peer, unless another one has been logged
+// recently, in which case it's only counted.
+func (a *PeerAllowlist) logRejection(address string, fullMethod string) {
+	a.mutex.Lock()
+	now := time.Now()
+	if now.Sub(a.lastLogged) < rejectionLogInterval {
+		a.suppressed++
+		a.mutex.Unlock()
+		return
+	}
+	suppressed := a.suppressed
+	a.lastLogged = now
+	a.suppressed = 0
+	a.mutex.Unlock()
+
+	log.Warn().Str("peer", address).Str("method", fullMethod).Int("suppressed", suppressed).
+		Msg("rejected an RPC from a peer outside the allowed networks")
+}
+
+// UnaryInterceptor returns the interceptor rejecting the disallowed peers of unary RPCs.
+func (a *PeerAllowlist) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := a.Check(ctx, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamInterceptor returns the interceptor rejecting the disallowed peers of streaming RPCs.
+func (a *PeerAllowlist) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := a.Check(stream.Context(), info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, stream)
+	}
+}
@@ -0,0 +1,92 @@
+package admission
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// peerContext returns the context of an RPC from the peer address, forwarding
+// the given x-forwarded-for values.
+func peerContext(address string, forwarded ...string) context.Context {
+	ctx := peer.NewContext(context.Background(), &peer.Peer{
+		Addr: &net.TCPAddr{IP: net.ParseIP(address), Port: 40000},
+	})
+	md := metadata.MD{}
+	for _, value := range forwarded {
+		md.Append("x-forwarded-for", value)
+	}
+	return metadata.NewIncomingContext(ctx, md)
+}
+
+func TestPeerResolverBelievesTheTrustedProxiesOnly(t *testing.T) {
+	resolver, err := NewPeerResolver("X-Forwarded-For", []string{"10.0.0.0/8", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		peer      string
+		forwarded []string
+		want      string
+	}{
+		{name: "direct caller", peer: "192.0.2.1", want: "192.0.2.1"},
+		{name: "direct caller forging the header", peer: "192.0.2.1", forwarded: []string{"10.1.1.1"}, want: "192.0.2.1"},
+		{name: "trusted proxy", peer: "10.0.0.2", forwarded: []string{"192.0.2.7"}, want: "192.0.2.7"},
+		{name: "trusted IPv6 proxy", peer: "fd00::2", forwarded: []string{"2001:db8::7"}, want: "2001:db8::7"},
+		{name: "trusted proxy without the header", peer: "10.0.0.2", want: "10.0.0.2"},
+		{name: "caller prepending an address", peer: "10.0.0.2", forwarded: []string{"10.1.1.1, 192.0.2.7"}, want: "192.0.2.7"},
+		{name: "chain of trusted proxies", peer: "10.0.0.2", forwarded: []string{"192.0.2.7, 10.0.0.3"}, want: "192.0.2.7"},
+		{name: "last header value", peer: "10.0.0.2", forwarded: []string{"198.51.100.1", "192.0.2.7"}, want: "192.0.2.7"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := resolver.Address(peerContext(test.peer, test.forwarded...)); got != test.want {
+				t.Errorf("Address() = %q, want %q", got, test.want)
+			}
+		})
+	}
+
+	var untrusting *PeerResolver
+	if got := untrusting.Address(peerContext("10.0.0.2", "192.0.2.7")); got != "10.0.0.2" {
+		t.Errorf("Address() of the nil resolver = %q, want the connection peer", got)
+	}
+}
+
+func TestPeerAllowlistChecksTheResolvedAddress(t *testing.T) {
+	resolver, err := NewPeerResolver("x-forwarded-for", []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowlist, err := NewPeerAllowlist([]string{"192.0.2.0/24", "2001:db8::/32"}, resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		allowed bool
+	}{
+		{name: "allowed caller", ctx: peerContext("192.0.2.1"), allowed: true},
+		{name: "IPv4-mapped caller", ctx: peerContext("::ffff:192.0.2.1"), allowed: true},
+		{name: "IPv6 caller", ctx: peerContext("2001:db8::1"), allowed: true},
+		{name: "other caller", ctx: peerContext("198.51.100.1"), allowed: false},
+		{name: "other caller forging the header", ctx: peerContext("198.51.100.1", "192.0.2.1"), allowed: false},
+		{name: "allowed caller behind the proxy", ctx: peerContext("10.0.0.2", "192.0.2.1"), allowed: true},
+		{name: "other caller behind the proxy", ctx: peerContext("10.0.0.2", "198.51.100.1"), allowed: false},
+		{name: "no peer", ctx: context.Background(), allowed: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := allowlist.Check(test.ctx, "/runner.v1.RunnerService/Run")
+			if test.allowed && err != nil || !test.allowed && status.Code(err) != codes.PermissionDenied {
+				t.Errorf("Check() = %v, want allowed %t", err, test.allowed)
+			}
+		})
+	}
+}
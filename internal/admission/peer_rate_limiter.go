@@ -0,0 +1,163 @@
+package admission
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	v1 "github.com/Pelfox/codecell-runner/generated"
+	"github.com/Pelfox/codecell-runner/internal/clock"
+	"github.com/Pelfox/codecell-runner/internal/metrics"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// RateLimit is the refill rate (per second) and burst of a token bucket; a
+// zero rate disables the limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// tokenBucket is the token bucket of a single peer and method class.
+type tokenBucket struct {
+	tokens   float64
+	updated  time.Time
+	lastSeen time.Time
+}
+
+// take refills the bucket up to now and takes a token from it. If the bucket
+// is empty, it returns false and how long until the next token.
+func (b *tokenBucket) take(limit RateLimit, now time.Time) (bool, time.Duration) {
+	b.tokens = min(float64(limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*limit.Rate)
+	b.updated = now
+	b.lastSeen = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// bucketKey identifies the bucket of a peer for a method class.
+type bucketKey struct {
+	peer    string
+	control bool
+}
+
+// PeerRateLimiter limits the RPCs per source address with token buckets. Run
+// submissions and the control RPCs (Stop, status queries) use separate buckets,
+// so that a client can always stop its own runs.
+type PeerRateLimiter struct {
+	run      RateLimit
+	control  RateLimit
+	ttl      time.Duration
+	resolver *PeerResolver
+	clock    clock.Clock
+
+	mutex   sync.Mutex
+	buckets map[bucketKey]*tokenBucket
+}
+
+// NewPeerRateLimiter creates a new instance of PeerRateLimiter with the given
+// limits, forgetting the buckets of peers idle for longer than ttl, which must
+// be positive. The peers are told apart by the addresses the resolver
+// resolves, the same the allowlist checks; nil goes by the connection peer.
+func NewPeerRateLimiter(run RateLimit, control RateLimit, ttl time.Duration, resolver *PeerResolver) *PeerRateLimiter {
+	return &PeerRateLimiter{
+		run:      run,
+		control:  control,
+		ttl:      ttl,
+		resolver: resolver,
+		clock:    clock.Real,
+		buckets:  make(map[bucketKey]*tokenBucket),
+	}
+}
+
+// Run periodically removes the idle buckets until the context is cancelled.
+func (l *PeerRateLimiter) Run(ctx context.Context) {
+	ticker := l.clock.NewTicker(l.ttl)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			l.Cleanup()
+		}
+	}
+}
+
+// Cleanup removes the buckets of peers idle for longer than the TTL; an idle
+// bucket is full again, so forgetting it doesn't change the limit.
+func (l *PeerRateLimiter) Cleanup() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.clock.Now()
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.lastSeen) > l.ttl {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Allow takes a token of the peer for the given method. If the peer is over
+// the rate, it returns the RESOURCE_EXHAUSTED status with a retry hint.
+func (l *PeerRateLimiter) Allow(ctx context.Context, fullMethod string) error {
+	control := fullMethod != v1.RunnerService_Run_FullMethodName && fullMethod != v1.RunnerService_SubmitRun_FullMethodName
+	limit := l.run
+	if control {
+		limit = l.control
+	}
+	if limit.Rate <= 0 {
+		return nil
+	}
+
+	key := bucketKey{peer: l.resolver.Address(ctx), control: control}
+	now := l.clock.Now()
+
+	l.mutex.Lock()
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), updated: now}
+		l.buckets[key] = bucket
+	}
+	allowed, retryAfter := bucket.take(limit, now)
+	l.mutex.Unlock()
+
+	if allowed {
+		return nil
+	}
+	metrics.AdmissionRejections.WithLabelValues("rate_limit").Inc()
+	st := status.New(codes.ResourceExhausted, "too many requests from this address")
+	if detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter)}); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// UnaryInterceptor returns the interceptor applying the rate limits to unary RPCs.
+func (l *PeerRateLimiter) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := l.Allow(ctx, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamInterceptor returns the interceptor applying the rate limits to streaming RPCs.
+func (l *PeerRateLimiter) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := l.Allow(stream.Context(), info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, stream)
+	}
+}
@@ -0,0 +1,155 @@
+package admission
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	v1 "github.com/Pelfox/codecell-runner/generated"
+	"github.com/Pelfox/codecell-runner/internal/clock"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newTestPeerRateLimiter returns a new rate limiter on a fake clock, with the
+// buckets of the runs refilling a token per second up to 2, and a TTL of a minute.
+func newTestPeerRateLimiter(resolver *PeerResolver) (*PeerRateLimiter, *clock.Fake) {
+	fake := clock.NewFake(time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC))
+	limiter := NewPeerRateLimiter(RateLimit{Rate: 1, Burst: 2}, RateLimit{Rate: 10, Burst: 1}, time.Minute, resolver)
+	limiter.clock = fake
+	return limiter, fake
+}
+
+// bucketCount returns the number of buckets kept.
+func (l *PeerRateLimiter) bucketCount() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.buckets)
+}
+
+// retryDelay returns the retry hint of the RESOURCE_EXHAUSTED status.
+func retryDelay(t *testing.T, err error) time.Duration {
+	t.Helper()
+	st := status.Convert(err)
+	if st.Code() != codes.ResourceExhausted {
+		t.Fatalf("Allow() = %v, want RESOURCE_EXHAUSTED", err)
+	}
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			return info.RetryDelay.AsDuration()
+		}
+	}
+	t.Fatalf("Allow() = %v, without a retry hint", err)
+	return 0
+}
+
+func TestPeerRateLimiterRefillsTheBuckets(t *testing.T) {
+	limiter, fake := newTestPeerRateLimiter(nil)
+	ctx := peerContext("192.0.2.1")
+	run := v1.RunnerService_Run_FullMethodName
+
+	for i := range 2 {
+		if err := limiter.Allow(ctx, run); err != nil {
+			t.Fatalf("Allow() #%d within the burst = %v", i, err)
+		}
+	}
+	if delay := retryDelay(t, limiter.Allow(ctx, run)); delay != time.Second {
+		t.Errorf("the retry hint of the empty bucket = %s, want 1s", delay)
+	}
+	// the control RPCs have a bucket of their own
+	if err := limiter.Allow(ctx, v1.RunnerService_Stop_FullMethodName); err != nil {
+		t.Errorf("Allow() of Stop once the runs are limited = %v", err)
+	}
+	if err := limiter.Allow(peerContext("192.0.2.2"), run); err != nil {
+		t.Errorf("Allow() of another peer = %v", err)
+	}
+
+	fake.Advance(500 * time.Millisecond)
+	if delay := retryDelay(t, limiter.Allow(ctx, run)); delay != 500*time.Millisecond {
+		t.Errorf("the retry hint of the half refilled bucket = %s, want 500ms", delay)
+	}
+	fake.Advance(500 * time.Millisecond)
+	if err := limiter.Allow(ctx, run); err != nil {
+		t.Errorf("Allow() once a token is refilled = %v", err)
+	}
+	if err := limiter.Allow(ctx, run); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Allow() past the refilled token = %v, want RESOURCE_EXHAUSTED", err)
+	}
+
+	// the bucket refills up to the burst only
+	fake.Advance(time.Hour)
+	for i := range 2 {
+		if err := limiter.Allow(ctx, run); err != nil {
+			t.Fatalf("Allow() #%d after an hour = %v", i, err)
+		}
+	}
+	if err := limiter.Allow(ctx, run); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Allow() past the burst after an hour = %v, want RESOURCE_EXHAUSTED", err)
+	}
+}
+
+func TestPeerRateLimiterForgetsTheIdlePeers(t *testing.T) {
+	limiter, fake := newTestPeerRateLimiter(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		limiter.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	fake.AwaitTimers(1)
+
+	// a scanner going through the addresses leaves a bucket behind each
+	for i := range 1000 {
+		address := fmt.Sprintf("2001:db8::%x", i)
+		if err := limiter.Allow(peerContext(address), v1.RunnerService_Run_FullMethodName); err != nil {
+			t.Fatalf("Allow() of %s = %v", address, err)
+		}
+	}
+	active := peerContext("192.0.2.1")
+	for range 4 {
+		fake.Advance(30 * time.Second)
+		_ = limiter.Allow(active, v1.RunnerService_Run_FullMethodName)
+		fake.AwaitTicks()
+	}
+
+	// the cleanup of the last tick may still be running
+	deadline := time.Now().Add(5 * time.Second)
+	for buckets := limiter.bucketCount(); buckets != 1; buckets = limiter.bucketCount() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d buckets are kept past the TTL, want only the one of the active peer", buckets)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPeerRateLimiterGoesByTheResolvedAddress(t *testing.T) {
+	resolver, err := NewPeerResolver("x-forwarded-for", []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter, _ := newTestPeerRateLimiter(resolver)
+	run := v1.RunnerService_Run_FullMethodName
+
+	// the callers behind the same proxy have buckets of their own
+	for i := range 2 {
+		if err := limiter.Allow(peerContext("10.0.0.2", "192.0.2.1"), run); err != nil {
+			t.Fatalf("Allow() #%d = %v", i, err)
+		}
+	}
+	if err := limiter.Allow(peerContext("10.0.0.2", "192.0.2.1"), run); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Allow() past the burst = %v, want RESOURCE_EXHAUSTED", err)
+	}
+	if err := limiter.Allow(peerContext("10.0.0.2", "192.0.2.2"), run); err != nil {
+		t.Errorf("Allow() of another caller behind the proxy = %v", err)
+	}
+	// a direct caller can't escape its bucket by forging the header
+	if err := limiter.Allow(peerContext("192.0.2.1", "192.0.2.3"), run); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Allow() of the caller forging the header = %v, want RESOURCE_EXHAUSTED", err)
+	}
+}
@@ -0,0 +1,102 @@
+package admission
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// PeerResolver resolves the source address of the RPCs, which the allowlist
+// and the rate limits go by. The address forwarded in the proxy header is only
+// believed from the peers among the trusted proxies, anyone else could set it.
+type PeerResolver struct {
+	proxyHeader    string // empty if the forwarded addresses aren't trusted
+	trustedProxies []netip.Prefix
+}
+
+// NewPeerResolver creates a new instance of PeerResolver. If proxyHeader is
+// non-empty, the address forwarded in that metadata key is taken instead of
+// the connection peer, as long as the peer is in one of the trustedProxies
+// CIDRs.
+func NewPeerResolver(proxyHeader string, trustedProxies []string) (*PeerResolver, error) {
+	prefixes, err := parsePrefixes(trustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxy: %w", err)
+	}
+	return &PeerResolver{proxyHeader: strings.ToLower(proxyHeader), trustedProxies: prefixes}, nil
+}
+
+// Address returns the source address of the RPC. Behind trusted proxies, it's
+// the last forwarded address not of a trusted proxy itself, so that the
+// addresses prepended by the caller are ignored. A nil resolver returns the
+// connection peer.
+func (r *PeerResolver) Address(ctx context.Context) string {
+	address := peerHost(ctx)
+	if r == nil || r.proxyHeader == "" || !r.trusted(address) {
+		return address
+	}
+	values := metadata.ValueFromIncomingContext(ctx, r.proxyHeader)
+	if len(values) == 0 {
+		return address
+	}
+	forwarded := strings.Split(values[len(values)-1], ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		address = strings.TrimSpace(forwarded[i])
+		if !r.trusted(address) {
+			break
+		}
+	}
+	return address
+}
+
+// trusted reports whether the address is the one of a trusted proxy.
+func (r *PeerResolver) trusted(address string) bool {
+	return containsAddress(r.trustedProxies, address)
+}
+
+// parsePrefixes parses the CIDRs, masking their host bits.
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("CIDR %q: %w", cidr, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// containsAddress reports whether the address belongs to one of the networks.
+// IPv4-mapped IPv6 addresses are matched as IPv4 ones.
+func containsAddress(prefixes []netip.Prefix, address string) bool {
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap().WithZone("")
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerHost returns the source address of the RPC without the port.
+func peerHost(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String() // e.g. unix sockets
+	}
+	return host
+}
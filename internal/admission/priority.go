@@ -0,0 +1,77 @@
+package admission
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Priority orders the runs competing for slots; higher priorities go first.
+type Priority int
+
+const (
+	// PriorityBatch is the priority of background jobs.
+	PriorityBatch Priority = iota
+	// PriorityNormal is the default priority.
+	PriorityNormal
+	// PriorityInteractive is the priority of runs a user is waiting on.
+	PriorityInteractive
+)
+
+// priorityNames maps the configuration names to the priorities.
+var priorityNames = map[string]Priority{
+	"batch":       PriorityBatch,
+	"normal":      PriorityNormal,
+	"interactive": PriorityInteractive,
+}
+
+// ParsePriority parses the priority name: batch, normal or interactive.
+func ParsePriority(name string) (Priority, error) {
+	priority, ok := priorityNames[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return 0, fmt.Errorf("unknown priority %q", name)
+	}
+	return priority, nil
+}
+
+// PriorityPolicy caps the priority each identity may request.
+type PriorityPolicy struct {
+	max       Priority
+	overrides map[string]Priority
+}
+
+// NewPriorityPolicy creates a new instance of PriorityPolicy from the default
+// maximum priority name and the per-identity overrides in the
+// "identity=priority;identity=priority" format.
+func NewPriorityPolicy(max string, overrides string) (*PriorityPolicy, error) {
+	policy := &PriorityPolicy{overrides: make(map[string]Priority)}
+
+	var err error
+	if policy.max, err = ParsePriority(max); err != nil {
+		return nil, err
+	}
+	for _, entry := range strings.Split(overrides, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		identity, name, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(identity) == "" {
+			return nil, fmt.Errorf("invalid priority override %q", entry)
+		}
+		priority, err := ParsePriority(name)
+		if err != nil {
+			return nil, err
+		}
+		policy.overrides[strings.TrimSpace(identity)] = priority
+	}
+	return policy, nil
+}
+
+// Allowed reports whether the identity may request the given priority.
+func (p *PriorityPolicy) Allowed(identity string, priority Priority) bool {
+	max, ok := p.overrides[identity]
+	if !ok {
+		max = p.max
+	}
+	return priority <= max
+}
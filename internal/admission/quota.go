@@ -0,0 +1,155 @@
+package admission
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/clock"
+	"github.com/Pelfox/codecell-runner/internal/metrics"
+	"github.com/Pelfox/codecell-runner/pkg"
+)
+
+// QuotaError is returned when a client identity has exhausted one of its quotas.
+type QuotaError struct {
+	// Quota is the name of the exhausted quota: "concurrent" or "rate".
+	Quota string
+	// Limit is the value of the exhausted quota.
+	Limit int
+}
+
+func (e *QuotaError) Error() string {
+	if e.Quota == "rate" {
+		return fmt.Sprintf("quota of %d runs per minute exceeded", e.Limit)
+	}
+	return fmt.Sprintf("quota of %d concurrent runs exceeded", e.Limit)
+}
+
+// identityUsage is the quota usage of a single identity.
+type identityUsage struct {
+	identity string
+	hash     string
+	active   int
+	starts   []time.Time // start times within the last minute, oldest first
+}
+
+// QuotaTracker enforces the per-identity quotas. It tracks a bounded number of
+// identities, evicting the least recently seen idle ones, so that callers
+// can't exhaust the memory with unique identities. An evicted identity starts
+// over with an empty rate window: a caller cycling through more identities than
+// the bound gets past its rate quota, but not past its concurrency one.
+type QuotaTracker struct {
+	defaults      pkg.Quota
+	overrides     map[string]pkg.Quota
+	maxIdentities int
+	clock         clock.Clock
+
+	mutex      sync.Mutex
+	identities map[string]*list.Element // of *identityUsage
+	recent     *list.List               // most recently seen at the front
+}
+
+// NewQuotaTracker creates a new instance of QuotaTracker applying the default
+// quota to every identity without an override, and tracking up to
+// maxIdentities identities.
+func NewQuotaTracker(defaults pkg.Quota, overrides map[string]pkg.Quota, maxIdentities int) *QuotaTracker {
+	return &QuotaTracker{
+		defaults:      defaults,
+		overrides:     overrides,
+		maxIdentities: maxIdentities,
+		clock:         clock.Real,
+		identities:    make(map[string]*list.Element),
+		recent:        list.New(),
+	}
+}
+
+// Acquire counts a run of the identity against its quotas. On success, the
+// returned function must be called once the run is over.
+func (t *QuotaTracker) Acquire(identity string) (func(), error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	quota, ok := t.overrides[identity]
+	if !ok {
+		quota = t.defaults
+	}
+	if quota.MaxConcurrent == 0 && quota.RunsPerMinute == 0 {
+		return func() {}, nil
+	}
+
+	usage := t.touch(identity)
+	now := t.clock.Now()
+	for len(usage.starts) > 0 && now.Sub(usage.starts[0]) >= time.Minute {
+		usage.starts = usage.starts[1:]
+	}
+
+	if quota.MaxConcurrent > 0 && usage.active >= quota.MaxConcurrent {
+		metrics.QuotaRejections.WithLabelValues(usage.hash, "concurrent").Inc()
+		return nil, &QuotaError{Quota: "concurrent", Limit: quota.MaxConcurrent}
+	}
+	if quota.RunsPerMinute > 0 && len(usage.starts) >= quota.RunsPerMinute {
+		metrics.QuotaRejections.WithLabelValues(usage.hash, "rate").Inc()
+		return nil, &QuotaError{Quota: "rate", Limit: quota.RunsPerMinute}
+	}
+
+	usage.active++
+	if quota.RunsPerMinute > 0 {
+		usage.starts = append(usage.starts, now)
+	}
+	metrics.IdentityActiveRuns.WithLabelValues(usage.hash).Set(float64(usage.active))
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			usage.active--
+			metrics.IdentityActiveRuns.WithLabelValues(usage.hash).Set(float64(usage.active))
+		})
+	}, nil
+}
+
+// SetQuotas changes the quotas for the runs to come; the runs started while
+// unlimited aren't counted.
+func (t *QuotaTracker) SetQuotas(defaults pkg.Quota, overrides map[string]pkg.Quota) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.defaults = defaults
+	t.overrides = overrides
+}
+
+// touch returns the usage of the identity, marking it as the most recently
+// seen and evicting idle identities over the bound, which forgets their rate
+// windows. The caller must hold the mutex.
+func (t *QuotaTracker) touch(identity string) *identityUsage {
+	if element, ok := t.identities[identity]; ok {
+		t.recent.MoveToFront(element)
+		return element.Value.(*identityUsage)
+	}
+
+	// identities with active runs are kept, they are bounded by the concurrency limits anyway
+	for element := t.recent.Back(); element != nil && t.recent.Len() >= t.maxIdentities; {
+		previous := element.Prev()
+		if usage := element.Value.(*identityUsage); usage.active == 0 {
+			t.recent.Remove(element)
+			delete(t.identities, usage.identity)
+			metrics.IdentityActiveRuns.DeleteLabelValues(usage.hash)
+			metrics.QuotaRejections.DeletePartialMatch(map[string]string{"identity": usage.hash})
+		}
+		element = previous
+	}
+
+	usage := &identityUsage{identity: identity, hash: HashIdentity(identity)}
+	t.identities[identity] = t.recent.PushFront(usage)
+	return usage
+}
+
+// HashIdentity returns a short stable hash of the identity, safe to be used as
+// a metric label.
+func HashIdentity(identity string) string {
+	sum := sha256.Sum256([]byte(identity))
+	return hex.EncodeToString(sum[:6])
+}
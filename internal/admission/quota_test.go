@@ -0,0 +1,94 @@
+package admission
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/clock"
+	"github.com/Pelfox/codecell-runner/pkg"
+)
+
+// newTestQuotaTracker returns a new quota tracker on a fake clock.
+func newTestQuotaTracker(defaults pkg.Quota, overrides map[string]pkg.Quota, maxIdentities int) (*QuotaTracker, *clock.Fake) {
+	fake := clock.NewFake(time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC))
+	tracker := NewQuotaTracker(defaults, overrides, maxIdentities)
+	tracker.clock = fake
+	return tracker, fake
+}
+
+// checkQuotaError checks that Acquire has failed on the quota, or succeeded
+// with an empty quota.
+func checkQuotaError(t *testing.T, err error, quota string) {
+	t.Helper()
+	var quotaErr *QuotaError
+	switch {
+	case quota == "" && err != nil:
+		t.Errorf("Acquire() = %v, want a run", err)
+	case quota != "" && (!errors.As(err, &quotaErr) || quotaErr.Quota != quota):
+		t.Errorf("Acquire() = %v, want the %s quota exceeded", err, quota)
+	}
+}
+
+func TestQuotaTrackerCountsTheRunsOfTheIdentities(t *testing.T) {
+	tracker, fake := newTestQuotaTracker(pkg.Quota{MaxConcurrent: 2, RunsPerMinute: 3},
+		map[string]pkg.Quota{"unlimited": {}}, 100)
+
+	first, err := tracker.Acquire("tenant")
+	checkQuotaError(t, err, "")
+	second, err := tracker.Acquire("tenant")
+	checkQuotaError(t, err, "")
+	_, err = tracker.Acquire("tenant")
+	checkQuotaError(t, err, "concurrent")
+	_, err = tracker.Acquire("other")
+	checkQuotaError(t, err, "")
+
+	// a release frees one run, once
+	first()
+	first()
+	third, err := tracker.Acquire("tenant")
+	checkQuotaError(t, err, "")
+	second()
+	third()
+	_, err = tracker.Acquire("tenant")
+	checkQuotaError(t, err, "rate")
+
+	// the starts leave the window a minute later
+	fake.Advance(time.Minute)
+	release, err := tracker.Acquire("tenant")
+	checkQuotaError(t, err, "")
+	release()
+
+	for range 10 {
+		_, err := tracker.Acquire("unlimited")
+		checkQuotaError(t, err, "")
+	}
+}
+
+func TestQuotaTrackerEvictsTheLeastRecentlySeenIdleIdentities(t *testing.T) {
+	tracker, _ := newTestQuotaTracker(pkg.Quota{MaxConcurrent: 1, RunsPerMinute: 1}, nil, 2)
+
+	active, err := tracker.Acquire("active")
+	checkQuotaError(t, err, "")
+	idle, err := tracker.Acquire("idle")
+	checkQuotaError(t, err, "")
+	idle()
+	_, err = tracker.Acquire("idle")
+	checkQuotaError(t, err, "rate")
+
+	// the idle identity is evicted for the new one, forgetting its rate window
+	newcomer, err := tracker.Acquire("newcomer")
+	checkQuotaError(t, err, "")
+	newcomer()
+	if _, ok := tracker.identities["idle"]; ok {
+		t.Error("the idle identity is kept past the bound")
+	}
+	// the identity with an active run is kept over the bound, its runs counted
+	_, err = tracker.Acquire("active")
+	checkQuotaError(t, err, "concurrent")
+	active()
+
+	release, err := tracker.Acquire("idle")
+	checkQuotaError(t, err, "")
+	release()
+}
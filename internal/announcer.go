@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/discovery"
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/rs/zerolog/log"
+)
+
+// announceTimeout is the maximum duration of a single call to the discovery backend.
+const announceTimeout = 5 * time.Second
+
+// Announcer keeps the instance registered in the service discovery while it
+// accepts runs, updating the registration whenever the available languages
+// change, and deregistering it once the runner drains.
+type Announcer struct {
+	appConfig        *pkg.AppConfig
+	registrar        discovery.Registrar
+	capacityReporter *CapacityReporter
+
+	mutex      sync.Mutex
+	registered *discovery.Registration // nil while not registered
+	stopped    bool
+}
+
+// NewAnnouncer creates a new instance of Announcer.
+func NewAnnouncer(appConfig *pkg.AppConfig, registrar discovery.Registrar, capacityReporter *CapacityReporter) *Announcer {
+	return &Announcer{appConfig: appConfig, registrar: registrar, capacityReporter: capacityReporter}
+}
+
+// Run registers the instance and refreshes the registration three times per
+// TTL until the context is cancelled or the announcer is stopped.
+func (a *Announcer) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.appConfig.DiscoveryTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		a.announce()
+		select {
+		case <-ctx.Done():
+			a.Stop()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop deregisters the instance for good, so that no new runs are routed to it.
+func (a *Announcer) Stop() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.stopped {
+		return
+	}
+	a.stopped = true
+	a.deregister()
+}
+
+// announce registers, updates or refreshes the registration.
+func (a *Announcer) announce() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.stopped {
+		return
+	}
+	capacity := a.capacityReporter.Snapshot()
+	if capacity.Draining {
+		a.deregister()
+		return
+	}
+
+	registration := discovery.Registration{
+		InstanceAddr:      a.appConfig.InstanceAddr,
+		MaxConcurrentRuns: capacity.MaxConcurrentRuns,
+	}
+	for _, language := range capacity.Languages {
+		if language.Available {
+			registration.Languages = append(registration.Languages, language.Language)
+		}
+	}
+	slices.Sort(registration.Languages)
+
+	ctx, cancel := context.WithTimeout(context.Background(), announceTimeout)
+	defer cancel()
+	if a.registered != nil && a.registered.Equal(registration) {
+		err := a.registrar.Refresh(ctx)
+		if err == nil {
+			return
+		}
+		log.Warn().Err(err).Msg("failed to refresh the service registration, registering again")
+		a.registered = nil
+	}
+
+	if err := a.registrar.Register(ctx, registration, a.appConfig.DiscoveryTTL); err != nil {
+		a.registered = nil
+		log.Error().Err(err).Msg("failed to register the instance in the service discovery")
+		return
+	}
+	if a.registered == nil {
+		log.Info().Strs("languages", registration.Languages).Msg("instance registered in the service discovery")
+	} else {
+		log.Info().Strs("languages", registration.Languages).Msg("service registration updated")
+	}
+	a.registered = &registration
+}
+
+// deregister removes the registration, if any; the caller must hold the mutex.
+func (a *Announcer) deregister() {
+	if a.registered == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), announceTimeout)
+	defer cancel()
+	if err := a.registrar.Deregister(ctx); err != nil {
+		log.Error().Err(err).Msg("failed to deregister the instance from the service discovery")
+		return
+	}
+	a.registered = nil
+	log.Info().Msg("instance deregistered from the service discovery")
+}
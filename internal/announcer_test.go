@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/admission"
+	"github.com/Pelfox/codecell-runner/internal/discovery"
+	"github.com/Pelfox/codecell-runner/internal/registry"
+	"github.com/Pelfox/codecell-runner/internal/services"
+	"github.com/Pelfox/codecell-runner/pkg"
+)
+
+// fakeRegistrar records the calls to the discovery backend, failing those the
+// test sets an error for.
+type fakeRegistrar struct {
+	mutex      sync.Mutex
+	calls      []string
+	refreshErr error
+	called     chan struct{}
+}
+
+func newFakeRegistrar() *fakeRegistrar {
+	return &fakeRegistrar{called: make(chan struct{}, 1)}
+}
+
+func (r *fakeRegistrar) record(call string) {
+	r.mutex.Lock()
+	r.calls = append(r.calls, call)
+	r.mutex.Unlock()
+	select {
+	case r.called <- struct{}{}:
+	default:
+	}
+}
+
+func (r *fakeRegistrar) Register(_ context.Context, registration discovery.Registration, ttl time.Duration) error {
+	r.record(fmt.Sprintf("register %s [%s] %d for %s", registration.InstanceAddr,
+		strings.Join(registration.Languages, " "), registration.MaxConcurrentRuns, ttl))
+	return nil
+}
+
+func (r *fakeRegistrar) Refresh(context.Context) error {
+	r.record("refresh")
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.refreshErr
+}
+
+func (r *fakeRegistrar) Deregister(context.Context) error {
+	r.record("deregister")
+	return nil
+}
+
+func (r *fakeRegistrar) Close() error { return nil }
+
+// takeCalls returns the calls recorded since the last time.
+func (r *fakeRegistrar) takeCalls() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	calls := r.calls
+	r.calls = nil
+	return calls
+}
+
+// newTestAnnouncer returns the announcer of a runner of the test address, with
+// its languages and its capacity reporter.
+func newTestAnnouncer(t *testing.T) (*Announcer, *fakeRegistrar, *services.LanguagesService, *CapacityReporter) {
+	t.Helper()
+	config, _, err := pkg.LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.InstanceAddr = "10.0.0.7:50051"
+	config.DiscoveryTTL = 30 * time.Second
+	languagesService := services.NewLanguagesService(nil, config, nil)
+	limiter := admission.NewLimiter(admission.GlobalScope, 8, 0, 0, 0)
+	capacityReporter := NewCapacityReporter(config, registry.New(0, 0, time.Minute), limiter, nil,
+		languagesService, services.HostResources{})
+	registrar := newFakeRegistrar()
+	return NewAnnouncer(config, registrar, capacityReporter), registrar, languagesService, capacityReporter
+}
+
+func TestAnnouncerKeepsTheRegistrationUpToDate(t *testing.T) {
+	announcer, registrar, languagesService, capacityReporter := newTestAnnouncer(t)
+	all := languagesService.Languages()
+	registration := func(languages []string) string {
+		return fmt.Sprintf("register 10.0.0.7:50051 [%s] 8 for 30s", strings.Join(languages, " "))
+	}
+	withoutPerl := slices.DeleteFunc(slices.Clone(all), func(language string) bool { return language == "perl" })
+
+	steps := []struct {
+		name   string
+		change func()
+		calls  []string
+	}{
+		{name: "first announcement", calls: []string{registration(all)}},
+		{name: "unchanged registration", calls: []string{"refresh"}},
+		{name: "language failing its canary", change: func() {
+			languagesService.SetCanaryResult("perl", errors.New("canary failed"))
+		}, calls: []string{registration(withoutPerl)}},
+		{name: "failed refresh", change: func() {
+			registrar.refreshErr = errors.New("session expired")
+		}, calls: []string{"refresh", registration(withoutPerl)}},
+		{name: "draining runner", change: func() {
+			registrar.refreshErr = nil
+			capacityReporter.SetDraining(true)
+		}, calls: []string{"deregister"}},
+		{name: "still draining"},
+		{name: "runner accepting runs again", change: func() {
+			capacityReporter.SetDraining(false)
+			languagesService.SetCanaryResult("perl", nil)
+		}, calls: []string{registration(all)}},
+	}
+	for _, step := range steps {
+		if step.change != nil {
+			step.change()
+		}
+		announcer.announce()
+		if calls := registrar.takeCalls(); !slices.Equal(calls, step.calls) {
+			t.Errorf("%s: the announcer has called %q, want %q", step.name, calls, step.calls)
+		}
+	}
+
+	// once stopped, the instance is never registered again
+	announcer.Stop()
+	announcer.Stop()
+	announcer.announce()
+	if calls := registrar.takeCalls(); !slices.Equal(calls, []string{"deregister"}) {
+		t.Errorf("the stopped announcer has called %q, want a single deregistration", calls)
+	}
+}
+
+func TestAnnouncerDeregistersOnceCancelled(t *testing.T) {
+	announcer, registrar, _, _ := newTestAnnouncer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		announcer.Run(ctx)
+		close(done)
+	}()
+	<-registrar.called
+	cancel()
+	<-done
+
+	calls := registrar.takeCalls()
+	if len(calls) < 2 || !strings.HasPrefix(calls[0], "register ") || calls[len(calls)-1] != "deregister" {
+		t.Errorf("the announcer has called %q, want a registration then a deregistration", calls)
+	}
+}
@@ -0,0 +1,116 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/metrics"
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// uploadAttempts is the number of times an upload is tried before it's given up.
+	uploadAttempts = 5
+	// uploadInitialBackoff is the delay before the first retry, doubled after every attempt.
+	uploadInitialBackoff = 2 * time.Second
+	// uploadAttemptTimeout is the maximum duration of a single upload attempt.
+	uploadAttemptTimeout = 5 * time.Minute
+)
+
+// Archiver uploads the complete output of runs to an S3-compatible object
+// storage once they have ended.
+type Archiver struct {
+	appConfig *pkg.AppConfig
+	client    *minio.Client
+	baseURL   url.URL
+}
+
+// NewArchiver creates a new instance of Archiver for the configured endpoint
+// and bucket.
+func NewArchiver(appConfig *pkg.AppConfig) (*Archiver, error) {
+	client, err := minio.New(appConfig.ArchiveEndpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(appConfig.ArchiveAccessKey, appConfig.ArchiveSecretKey, ""),
+		Secure: appConfig.ArchiveSecure,
+		Region: appConfig.ArchiveRegion,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Archiver{appConfig: appConfig, client: client, baseURL: *client.EndpointURL()}, nil
+}
+
+// Spool creates the spool of the run with the given request ID.
+func (a *Archiver) Spool(requestID string) (*Spool, error) {
+	file, err := os.CreateTemp(a.appConfig.ArchiveSpoolDir, "codecell-archive-*.log")
+	if err != nil {
+		return nil, err
+	}
+
+	key := a.appConfig.ArchivePrefix + requestID + ".log"
+	objectURL := a.baseURL.JoinPath(a.appConfig.ArchiveBucket, key)
+	return &Spool{
+		Key:   key,
+		URL:   objectURL.String(),
+		limit: a.appConfig.ArchiveMaxBytes,
+		file:  file,
+	}, nil
+}
+
+// Upload uploads the spooled output in the background, deleting the spool
+// file afterwards. The upload outlives ctx, which only carries the logger of
+// the run.
+func (a *Archiver) Upload(ctx context.Context, spool *Spool) {
+	logger := zerolog.Ctx(ctx)
+	go func() {
+		defer spool.Discard()
+
+		spool.mutex.Lock()
+		err := spool.err
+		spool.mutex.Unlock()
+		if err == nil {
+			err = a.upload(logger, spool)
+		}
+		if err != nil {
+			metrics.ArchiveUploads.WithLabelValues("failed").Inc()
+			logger.Error().Err(err).
+				Str("key", spool.Key).
+				Msg("failed to archive the run output")
+			return
+		}
+		metrics.ArchiveUploads.WithLabelValues("uploaded").Inc()
+	}()
+}
+
+// upload puts the spool file into the bucket, retrying with a backoff.
+func (a *Archiver) upload(logger *zerolog.Logger, spool *Spool) error {
+	options := minio.PutObjectOptions{ContentType: "text/plain; charset=utf-8"}
+	if spool.Truncated() {
+		options.UserMetadata = map[string]string{"truncated": "true"}
+	}
+
+	backoff := uploadInitialBackoff
+	var err error
+	for attempt := 1; attempt <= uploadAttempts; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), uploadAttemptTimeout)
+		_, err = a.client.FPutObject(ctx, a.appConfig.ArchiveBucket, spool.Key, spool.file.Name(), options)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if attempt < uploadAttempts {
+			logger.Warn().Err(err).
+				Str("key", spool.Key).
+				Dur("backoff", backoff).
+				Msg("run output upload attempt failed, retrying")
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return fmt.Errorf("giving up after %d attempts: %w", uploadAttempts, err)
+}
@@ -0,0 +1,53 @@
+package archive
+
+import (
+	"os"
+	"sync"
+)
+
+// Spool tees the output of a run into a temporary file, up to its limit, until
+// it's uploaded.
+type Spool struct {
+	// Key is the object key the output is archived under.
+	Key string
+	// URL is the URL of the archived object.
+	URL string
+
+	limit int64
+
+	mutex     sync.Mutex
+	file      *os.File
+	written   int64
+	truncated bool
+	err       error // the first write error, the spool is abandoned after it
+}
+
+// WriteString appends the string, dropping everything past the limit.
+func (s *Spool) WriteString(output string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.err != nil || s.truncated {
+		return
+	}
+	if remaining := s.limit - s.written; int64(len(output)) > remaining {
+		output = output[:remaining]
+		s.truncated = true
+	}
+	n, err := s.file.WriteString(output)
+	s.written += int64(n)
+	s.err = err
+}
+
+// Truncated reports whether the output has exceeded the limit.
+func (s *Spool) Truncated() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.truncated
+}
+
+// Discard closes and deletes the spool file.
+func (s *Spool) Discard() {
+	_ = s.file.Close()
+	_ = os.Remove(s.file.Name())
+}
@@ -0,0 +1,286 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/metrics"
+	"github.com/Pelfox/codecell-runner/internal/registry"
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/rs/zerolog/log"
+)
+
+// Runner describes the build of the runner a run was executed by.
+type Runner struct {
+	Version     string `json:"version"`
+	Commit      string `json:"commit"`
+	Runtime     string `json:"runtime"`
+	ImageDigest string `json:"imageDigest,omitempty"`
+}
+
+// Limits are the resource limits a run was executed with.
+type Limits struct {
+	TimeoutSeconds int64 `json:"timeoutSeconds"`
+	MemoryBytes    int64 `json:"memoryBytes"`
+	CPUNanos       int64 `json:"cpuNanos"`
+}
+
+// Entry is a single line of the audit log, describing one completed run.
+type Entry struct {
+	Timestamp    time.Time         `json:"timestamp"`
+	RequestID    string            `json:"requestId"`
+	PeerAddress  string            `json:"peerAddress"`
+	Identity     string            `json:"identity"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	Language     string            `json:"language"`
+	Image        string            `json:"image,omitempty"`
+	SourceSHA256 string            `json:"sourceSha256"`
+	Limits       Limits            `json:"limits"`
+	Outcome      registry.Outcome  `json:"outcome"`
+	ExitCode     int64             `json:"exitCode"`
+	Runner       Runner            `json:"runner"`
+	// PrevHash is the SHA-256 of the previous line, chaining the lines together.
+	PrevHash string `json:"prevHash"`
+}
+
+// NewEntry creates the entry of the completed run, executed with the given
+// OCI runtime and image digest.
+func NewEntry(
+	completed registry.CompletedRun,
+	peerAddress string,
+	identity string,
+	image string,
+	source string,
+	runtime string,
+	imageDigest string,
+) Entry {
+	sourceHash := sha256.Sum256([]byte(source))
+	return Entry{
+		Timestamp:    completed.FinishedAt.UTC(),
+		RequestID:    completed.RequestID,
+		PeerAddress:  peerAddress,
+		Identity:     identity,
+		Labels:       completed.Labels,
+		Language:     completed.Language,
+		Image:        image,
+		SourceSHA256: hex.EncodeToString(sourceHash[:]),
+		Limits: Limits{
+			TimeoutSeconds: int64(completed.Timeout.Seconds()),
+			MemoryBytes:    completed.MemoryLimit,
+			CPUNanos:       completed.CPULimit,
+		},
+		Outcome:  completed.Outcome,
+		ExitCode: completed.ExitCode,
+		Runner: Runner{
+			Version:     pkg.Version,
+			Commit:      pkg.BuildCommit(),
+			Runtime:     runtime,
+			ImageDigest: imageDigest,
+		},
+	}
+}
+
+// Logger appends the audit entries to a JSON lines file, separately from the
+// application logs. Every line carries the SHA-256 of the previous one, so that
+// any edited, removed or reordered line breaks the chain. The file is rotated
+// once it exceeds the maximum size, the chain continuing into the next file.
+type Logger struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mutex    sync.Mutex
+	file     *os.File
+	writer   *bufio.Writer
+	size     int64
+	prevHash string
+}
+
+// NewLogger creates a new instance of Logger appending to the file at the
+// given path, resuming the chain from its last line. A nil logger is valid
+// and drops all entries silently.
+func NewLogger(path string, maxSize int64, maxFiles int) (*Logger, error) {
+	prevHash, err := lastLineHash(path)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := &Logger{path: path, maxSize: maxSize, maxFiles: maxFiles, prevHash: prevHash}
+	if err := logger.open(); err != nil {
+		return nil, err
+	}
+	return logger, nil
+}
+
+// Log appends the entry and flushes it to the file. Failures are logged and
+// counted, but never fail the run.
+func (l *Logger) Log(entry Entry) {
+	if l == nil {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if err := l.write(entry); err != nil {
+		metrics.AuditWriteFailures.Inc()
+		log.Error().Err(err).Str("requestID", entry.RequestID).Msg("failed to write the audit log entry")
+	}
+}
+
+// Close flushes the buffered entries and closes the file.
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if err := l.writer.Flush(); err != nil {
+		_ = l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// write appends the entry; the caller must hold the mutex.
+func (l *Logger) write(entry Entry) error {
+	entry.PrevHash = l.prevHash
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line))+1 > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err := l.writer.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := l.writer.Flush(); err != nil {
+		return err
+	}
+
+	l.size += int64(len(line)) + 1
+	l.prevHash = hashLine(line)
+	return nil
+}
+
+// open opens the current file for appending; the caller must hold the mutex.
+func (l *Logger) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	l.file = file
+	l.writer = bufio.NewWriter(file)
+	l.size = info.Size()
+	return nil
+}
+
+// rotate renames the current file after the current time and opens a new
+// one, deleting the oldest rotated files over the maximum; the caller must
+// hold the mutex.
+func (l *Logger) rotate() error {
+	if err := l.writer.Flush(); err != nil {
+		return err
+	}
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	rotated := l.path + "." + time.Now().UTC().Format("20060102T150405.000000000")
+	if err := os.Rename(l.path, rotated); err != nil {
+		return err
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+
+	if l.maxFiles > 0 {
+		// the timestamp suffixes sort chronologically
+		files, err := filepath.Glob(l.path + ".*")
+		if err != nil {
+			return err
+		}
+		slices.Sort(files)
+		for len(files) > l.maxFiles {
+			if err := os.Remove(files[0]); err != nil {
+				log.Error().Err(err).Str("file", files[0]).Msg("failed to delete the rotated audit log")
+			}
+			files = files[1:]
+		}
+	}
+	return nil
+}
+
+// hashLine returns the hex SHA-256 of the line, without its newline.
+func hashLine(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// lastLineHash returns the hash of the last line of the file, empty if it
+// doesn't exist or is empty.
+func lastLineHash(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	data = bytes.TrimRight(data, "\n")
+	if len(data) == 0 {
+		return "", nil
+	}
+	return hashLine(data[bytes.LastIndexByte(data, '\n')+1:]), nil
+}
+
+// Verify checks the chain of the lines read from the reader, starting from the
+// hash of the last line of the previous file. With a nil prevHash, the chain
+// is anchored at the first line, as the files before it may have been deleted.
+// It returns the hash of the last line, to be passed on to the next file.
+func Verify(reader io.Reader, prevHash *string) (string, error) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	number := 0
+	for scanner.Scan() {
+		number++
+		line := scanner.Bytes()
+
+		var entry Entry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return "", fmt.Errorf("line %d: %w", number, err)
+		}
+		if prevHash != nil && entry.PrevHash != *prevHash {
+			return "", fmt.Errorf("line %d: chain broken, expected previous hash %q, got %q", number, *prevHash, entry.PrevHash)
+		}
+		hash := hashLine(line)
+		prevHash = &hash
+	}
+	if prevHash == nil {
+		return "", scanner.Err()
+	}
+	return *prevHash, scanner.Err()
+}
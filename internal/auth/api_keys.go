@@ -0,0 +1,218 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// APIKeyMetadataKey is the metadata key carrying the API key of the caller.
+	APIKeyMetadataKey = "x-api-key"
+	// healthServicePrefix is the method prefix of the gRPC health service,
+	// which the load balancers probe without credentials.
+	healthServicePrefix = "/grpc.health.v1.Health/"
+)
+
+// apiKey is a single accepted API key, of which only the hash is known.
+type apiKey struct {
+	name string
+	role string
+	hash [sha256.Size]byte
+}
+
+// parseAPIKey parses the API key definition in the "name:sha256hex[:role]"
+// form, the hash being the hex-encoded SHA-256 of the key itself.
+func parseAPIKey(definition string) (apiKey, error) {
+	parts := strings.Split(strings.TrimSpace(definition), ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" {
+		// the definition isn't echoed, it may be a plaintext key by mistake
+		return apiKey{}, errors.New("invalid API key definition, expected name:sha256hex[:role]")
+	}
+	hash, err := hex.DecodeString(parts[1])
+	if err != nil || len(hash) != sha256.Size {
+		return apiKey{}, fmt.Errorf("invalid SHA-256 hash of the API key %q", parts[0])
+	}
+	key := apiKey{name: parts[0]}
+	copy(key.hash[:], hash)
+	if len(parts) == 3 {
+		key.role = parts[2]
+	}
+	return key, nil
+}
+
+// APIKeyStore holds the accepted API keys, combining the static ones with
+// those of a file, which is reloaded when it changes.
+type APIKeyStore struct {
+	static []apiKey
+	path   string
+
+	mutex   sync.RWMutex
+	keys    []apiKey
+	modTime time.Time
+}
+
+// NewAPIKeyStore creates a new instance of APIKeyStore from the static key
+// definitions and the file of definitions, one per line (empty if none).
+func NewAPIKeyStore(definitions []string, path string) (*APIKeyStore, error) {
+	store := &APIKeyStore{path: path}
+	for _, definition := range definitions {
+		key, err := parseAPIKey(definition)
+		if err != nil {
+			return nil, err
+		}
+		store.static = append(store.static, key)
+	}
+	if err := store.Reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Reload reads the keys file again, keeping the previous keys on failure.
+func (s *APIKeyStore) Reload() error {
+	keys := append([]apiKey(nil), s.static...)
+	var modTime time.Time
+	if s.path != "" {
+		info, err := os.Stat(s.path)
+		if err != nil {
+			return fmt.Errorf("failed to stat the API keys file %q: %w", s.path, err)
+		}
+		modTime = info.ModTime()
+		contents, err := os.ReadFile(s.path)
+		if err != nil {
+			return fmt.Errorf("failed to read the API keys file %q: %w", s.path, err)
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(contents))
+		for line := 1; scanner.Scan(); line++ {
+			definition := strings.TrimSpace(scanner.Text())
+			if definition == "" || strings.HasPrefix(definition, "#") {
+				continue
+			}
+			key, err := parseAPIKey(definition)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %w", s.path, line, err)
+			}
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return errors.New("no API keys are configured")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keys = keys
+	s.modTime = modTime
+	return nil
+}
+
+// Watch reloads the keys file every time it's modified, checking it at the
+// given interval until the context is cancelled.
+func (s *APIKeyStore) Watch(ctx context.Context, interval time.Duration) {
+	if s.path == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(s.path)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to check the API keys file")
+			continue
+		}
+		s.mutex.RLock()
+		changed := !info.ModTime().Equal(s.modTime)
+		s.mutex.RUnlock()
+		if !changed {
+			continue
+		}
+
+		if err := s.Reload(); err != nil {
+			log.Warn().Err(err).Msg("failed to reload the API keys")
+			continue
+		}
+		log.Info().Str("path", s.path).Msg("reloaded the API keys")
+	}
+}
+
+// Authenticate returns the principal of the given API key, or nil if the key
+// isn't accepted.
+func (s *APIKeyStore) Authenticate(key string) *RequestPrincipal {
+	hash := sha256.Sum256([]byte(key))
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	// comparing with every key, so that the timing reveals nothing
+	var principal *RequestPrincipal
+	for _, candidate := range s.keys {
+		if subtle.ConstantTimeCompare(hash[:], candidate.hash[:]) == 1 && principal == nil {
+			principal = &RequestPrincipal{Identity: candidate.name, Role: candidate.role, source: sourceAPIKey}
+		}
+	}
+	return principal
+}
+
+// authenticateAPIKey checks the API key of the RPC, attaching the principal
+// of the key: it takes precedence over the client certificate and the
+// forwarded identity of the caller, and yields to its JWT.
+func (s *APIKeyStore) authenticateAPIKey(ctx context.Context, method string) (context.Context, error) {
+	if strings.HasPrefix(method, healthServicePrefix) {
+		return ctx, nil
+	}
+	values := metadata.ValueFromIncomingContext(ctx, APIKeyMetadataKey)
+	if len(values) == 0 || values[0] == "" {
+		return nil, status.Errorf(codes.Unauthenticated, "missing %s metadata", APIKeyMetadataKey)
+	}
+	principal := s.Authenticate(values[0])
+	if principal == nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid API key")
+	}
+	return withAuthenticatedPrincipal(ctx, principal), nil
+}
+
+// UnaryInterceptor rejects the RPCs without an accepted API key.
+func (s *APIKeyStore) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := s.authenticateAPIKey(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamInterceptor is the streaming counterpart of UnaryInterceptor.
+func (s *APIKeyStore) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := s.authenticateAPIKey(stream.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &identityStream{ServerStream: stream, ctx: ctx})
+	}
+}
@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc/metadata"
+)
+
+const testIdentityMetadataKey = "x-user-id"
+
+// newTestAPIKeyStore returns a store accepting the key "secret" of the
+// platform, with the admin role.
+func newTestAPIKeyStore(t *testing.T) *APIKeyStore {
+	t.Helper()
+	hash := sha256.Sum256([]byte("secret"))
+	store, err := NewAPIKeyStore([]string{"platform-key:" + hex.EncodeToString(hash[:]) + ":" + RoleAdmin}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// permutations returns every ordering of the given elements.
+func permutations(elements []string) [][]string {
+	if len(elements) <= 1 {
+		return [][]string{elements}
+	}
+	var orderings [][]string
+	for i, first := range elements {
+		rest := append(append([]string(nil), elements[:i]...), elements[i+1:]...)
+		for _, ordering := range permutations(rest) {
+			orderings = append(orderings, append([]string{first}, ordering...))
+		}
+	}
+	return orderings
+}
+
+func TestPrincipalDoesNotDependOnTheOrderOfTheAuthenticators(t *testing.T) {
+	store := newTestAPIKeyStore(t)
+	jwtAuthenticator, sign := newTestJWTAuthenticator(t)
+	token := sign(jwt.MapClaims{"sub": "alice", maxTimeoutClaim: 30})
+
+	authenticators := map[string]func(ctx context.Context) (context.Context, error){
+		"certificate": func(ctx context.Context) (context.Context, error) {
+			return withClientCertificateIdentity(ctx), nil
+		},
+		"key": func(ctx context.Context) (context.Context, error) {
+			return store.authenticateAPIKey(ctx, testMethod)
+		},
+		"jwt": func(ctx context.Context) (context.Context, error) {
+			return jwtAuthenticator.authenticateJWT(ctx, testMethod)
+		},
+		"forwarded": func(ctx context.Context) (context.Context, error) {
+			return withMetadataIdentity(ctx, testIdentityMetadataKey), nil
+		},
+	}
+	tests := []struct {
+		name           string
+		authenticators []string
+		want           RequestPrincipal
+	}{
+		{
+			name:           "key over certificate",
+			authenticators: []string{"certificate", "key"},
+			want:           RequestPrincipal{Identity: "platform-key", Role: RoleAdmin, source: sourceAPIKey},
+		},
+		{
+			name:           "key over forwarded identity",
+			authenticators: []string{"key", "forwarded"},
+			want:           RequestPrincipal{Identity: "platform-key", Role: RoleAdmin, source: sourceAPIKey},
+		},
+		{
+			name:           "certificate over forwarded identity",
+			authenticators: []string{"certificate", "forwarded"},
+			want:           RequestPrincipal{Identity: "platform", source: sourceCertificate},
+		},
+		{
+			// the role of the key isn't granted to the identity of the token
+			name:           "jwt over key and certificate",
+			authenticators: []string{"certificate", "key", "jwt", "forwarded"},
+			want:           RequestPrincipal{Identity: "alice", MaxTimeout: 30 * time.Second, source: sourceJWT},
+		},
+	}
+	for _, test := range tests {
+		for _, ordering := range permutations(test.authenticators) {
+			t.Run(test.name+"/"+strings.Join(ordering, "-"), func(t *testing.T) {
+				md := metadata.Pairs(APIKeyMetadataKey, "secret", authorizationMetadataKey, "Bearer "+token,
+					testIdentityMetadataKey, "forwarded-user")
+				var logs bytes.Buffer
+				ctx := withClientCertificate(t, &logs, "platform", md)
+				for _, name := range ordering {
+					var err error
+					if ctx, err = authenticators[name](ctx); err != nil {
+						t.Fatalf("%s authenticator = %v", name, err)
+					}
+				}
+				if got := PrincipalFromContext(ctx); got == nil || *got != test.want {
+					t.Fatalf("PrincipalFromContext() = %+v, want %+v", got, test.want)
+				}
+				checkLoggedIdentity(t, ctx, &logs, test.want.Identity)
+			})
+		}
+	}
+}
+
+func TestTighterLimit(t *testing.T) {
+	tests := []struct{ a, b, want int64 }{
+		{a: 0, b: 0, want: 0},
+		{a: 0, b: 5, want: 5},
+		{a: 5, b: 0, want: 5},
+		{a: 3, b: 5, want: 3},
+		{a: 5, b: 3, want: 3},
+	}
+	for _, test := range tests {
+		if got := tighterLimit(test.a, test.b); got != test.want {
+			t.Errorf("tighterLimit(%d, %d) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// CertificateReloader serves the TLS certificate of the server, reloading it
+// from the disk when the files change, so that rotations need no restart.
+type CertificateReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	modTimes    [2]time.Time // of the certificate and the key files
+}
+
+// NewCertificateReloader creates a new instance of CertificateReloader,
+// loading the key pair from the given files.
+func NewCertificateReloader(certFile string, keyFile string) (*CertificateReloader, error) {
+	reloader := &CertificateReloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// currentModTimes returns the modification times of the certificate and key files.
+func (r *CertificateReloader) currentModTimes() ([2]time.Time, error) {
+	var modTimes [2]time.Time
+	for i, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return modTimes, fmt.Errorf("failed to stat the TLS file %q: %w", path, err)
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// Reload loads the key pair from the disk, keeping the previous one on failure.
+func (r *CertificateReloader) Reload() error {
+	modTimes, err := r.currentModTimes()
+	if err != nil {
+		return err
+	}
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load the TLS key pair from %q and %q: %w", r.certFile, r.keyFile, err)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.certificate = &certificate
+	r.modTimes = modTimes
+	return nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config.
+func (r *CertificateReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.certificate, nil
+}
+
+// Watch reloads the key pair every time the files are modified, checking
+// them at the given interval until the context is cancelled.
+func (r *CertificateReloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		modTimes, err := r.currentModTimes()
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to check the TLS files")
+			continue
+		}
+		r.mutex.RLock()
+		changed := modTimes != r.modTimes
+		r.mutex.RUnlock()
+		if !changed {
+			continue
+		}
+
+		// the files may be caught mid-rotation, the next tick retries then
+		if err := r.Reload(); err != nil {
+			log.Warn().Err(err).Msg("failed to reload the TLS certificate")
+			continue
+		}
+		log.Info().Str("certFile", r.certFile).Msg("reloaded the TLS certificate")
+	}
+}
+
+// NewPeerTLSConfig returns the TLS configuration of the connections to the
+// other instances, verifying their certificates with the CAs of the bundle
+// (the system roots if empty) and, with mutual TLS, presenting the current
+// certificate of the server as the client one.
+func NewPeerTLSConfig(certificates *CertificateReloader, caFile string, mutual bool) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		bundle, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the CA bundle %q: %w", caFile, err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("CA bundle %q contains no PEM certificates", caFile)
+		}
+	}
+	if mutual {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return certificates.GetCertificate(nil)
+		}
+	}
+	return config, nil
+}
@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// LoadClientCAs loads the PEM bundle of the CAs the client certificates must
+// be issued by.
+func LoadClientCAs(path string) (*x509.CertPool, error) {
+	bundle, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the client CA bundle %q: %w", path, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("client CA bundle %q contains no PEM certificates", path)
+	}
+	return pool, nil
+}
+
+// ServerTLSConfig returns the TLS configuration of the server presenting the
+// certificate of the reloader. With client CAs, the clients must present a
+// certificate they have issued, of an allowlisted identity if there are any,
+// or be rejected during the handshake.
+func ServerTLSConfig(certificates *CertificateReloader, clientCAs *x509.CertPool, allowedIdentities []string) *tls.Config {
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certificates.GetCertificate,
+	}
+	if clientCAs != nil {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.VerifyConnection = VerifyClientIdentity(allowedIdentities)
+	}
+	return tlsConfig
+}
+
+// CertificateIdentity returns the identity of the client certificate: its
+// common name, or the first URI or DNS subject alternative name without one.
+func CertificateIdentity(certificate *x509.Certificate) string {
+	switch {
+	case certificate.Subject.CommonName != "":
+		return certificate.Subject.CommonName
+	case len(certificate.URIs) > 0:
+		return certificate.URIs[0].String()
+	case len(certificate.DNSNames) > 0:
+		return certificate.DNSNames[0]
+	}
+	return ""
+}
+
+// VerifyClientIdentity returns the TLS connection check rejecting the verified
+// client certificates whose identity isn't allowlisted. An empty allowlist
+// accepts every certificate issued by the client CAs.
+func VerifyClientIdentity(allowed []string) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("client certificate is required")
+		}
+		identity := CertificateIdentity(state.PeerCertificates[0])
+		if identity == "" {
+			return errors.New("client certificate has no identity")
+		}
+		if len(allowed) > 0 && !slices.Contains(allowed, identity) {
+			return fmt.Errorf("client identity %q is not allowed", identity)
+		}
+		return nil
+	}
+}
+
+// withClientCertificateIdentity attaches the principal identified by the
+// verified client certificate of the connection, if there is one.
+func withClientCertificateIdentity(ctx context.Context) context.Context {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ctx
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 {
+		return ctx
+	}
+	identity := CertificateIdentity(info.State.VerifiedChains[0][0])
+	if identity == "" {
+		return ctx
+	}
+	return withAuthenticatedPrincipal(ctx, &RequestPrincipal{Identity: identity, source: sourceCertificate})
+}
+
+// ClientCertificateUnaryInterceptor identifies the callers by their verified
+// client certificates, taking precedence over the forwarded identities.
+func ClientCertificateUnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		return handler(withClientCertificateIdentity(ctx), req)
+	}
+}
+
+// ClientCertificateStreamInterceptor is the streaming counterpart of
+// ClientCertificateUnaryInterceptor.
+func ClientCertificateStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx := withClientCertificateIdentity(stream.Context())
+		return handler(srv, &identityStream{ServerStream: stream, ctx: ctx})
+	}
+}
@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/tlstest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// serveMutualTLS serves the health checks over the mutual TLS of the CA,
+// returning the address of the server and the channel of the identities its
+// handlers see.
+func serveMutualTLS(t *testing.T, ca *tlstest.CA, allowedIdentities []string) (string, <-chan string) {
+	t.Helper()
+	certFile, keyFile := tlstest.WriteKeyPair(t, t.TempDir(), ca.Server(t))
+	certificates, err := NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identities := make(chan string, 1)
+	server := grpc.NewServer(
+		grpc.Creds(credentials.NewTLS(ServerTLSConfig(certificates, ca.Pool(), allowedIdentities))),
+		grpc.ChainUnaryInterceptor(ClientCertificateUnaryInterceptor(),
+			func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+				identities <- PrincipalFromContext(ctx).Identity
+				return handler(ctx, req)
+			}),
+	)
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+	return listener.Addr().String(), identities
+}
+
+// checkHealth makes a health check with the client certificates over the TLS
+// trusting the CA.
+func checkHealth(t *testing.T, addr string, ca *tlstest.CA, certificates ...tls.Certificate) error {
+	t.Helper()
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+		RootCAs:      ca.Pool(),
+		Certificates: certificates,
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	return err
+}
+
+func TestMutualTLSChecksTheClientCertificates(t *testing.T) {
+	ca := tlstest.NewCA(t)
+	otherCA := tlstest.NewCA(t)
+	addr, identities := serveMutualTLS(t, ca, []string{"platform", "worker"})
+	valid := time.Now().Add(time.Hour)
+
+	if err := checkHealth(t, addr, ca, ca.Client(t, "platform", valid)); err != nil {
+		t.Fatalf("Check() with a valid client certificate = %v", err)
+	}
+	if identity := <-identities; identity != "platform" {
+		t.Errorf("the handler sees the identity %q, want the one of the client certificate", identity)
+	}
+
+	tests := []struct {
+		name         string
+		certificates []tls.Certificate
+	}{
+		{name: "no client certificate"},
+		{name: "expired client certificate", certificates: []tls.Certificate{ca.Client(t, "platform", time.Now().Add(-time.Minute))}},
+		{name: "client certificate of another CA", certificates: []tls.Certificate{otherCA.Client(t, "platform", valid)}},
+		{name: "identity not allowlisted", certificates: []tls.Certificate{ca.Client(t, "intruder", valid)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := checkHealth(t, addr, ca, test.certificates...); status.Code(err) != codes.Unavailable {
+				t.Errorf("Check() = %v, want the handshake failing", err)
+			}
+			select {
+			case identity := <-identities:
+				t.Errorf("the rejected client has reached the handler as %q", identity)
+			default:
+			}
+		})
+	}
+}
+
+func TestServerTLSWithoutClientCAsAcceptsAnyClient(t *testing.T) {
+	ca := tlstest.NewCA(t)
+	certFile, keyFile := tlstest.WriteKeyPair(t, t.TempDir(), ca.Server(t))
+	certificates, err := NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := ServerTLSConfig(certificates, nil, []string{"platform"})
+	if tlsConfig.ClientAuth != tls.NoClientCert || tlsConfig.VerifyConnection != nil {
+		t.Errorf("the TLS without client CAs checks the client certificates: %v", tlsConfig.ClientAuth)
+	}
+}
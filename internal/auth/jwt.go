@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/MicahParks/keyfunc/v3"
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// authorizationMetadataKey is the metadata key carrying the bearer token.
+	authorizationMetadataKey = "authorization"
+	// roleClaim is the claim holding the role of the caller.
+	roleClaim = "role"
+	// maxTimeoutClaim is the claim capping the run timeouts, in seconds.
+	maxTimeoutClaim = "max_timeout_seconds"
+	// maxMemoryClaim is the claim capping the container memory, in bytes.
+	maxMemoryClaim = "max_memory_bytes"
+)
+
+// jwtMethods are the accepted signing algorithms, all asymmetric, so that the
+// keys of the JWKS can never be abused as shared secrets.
+var jwtMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// JWTAuthenticator authenticates the callers by the JWTs issued by the
+// platform, verifying them with the keys of its JWKS.
+type JWTAuthenticator struct {
+	keyfunc jwt.Keyfunc
+	parser  *jwt.Parser
+}
+
+// NewJWTAuthenticator creates a new instance of JWTAuthenticator, refreshing
+// the JWKS in the background until the context is cancelled. Tokens signed by
+// unknown keys trigger a rate-limited refresh, so that rotations are picked
+// up before the next interval.
+func NewJWTAuthenticator(ctx context.Context, appConfig *pkg.AppConfig) (*JWTAuthenticator, error) {
+	if appConfig.JWTIssuer == "" || appConfig.JWTAudience == "" {
+		return nil, errors.New("both the JWT issuer and audience are required")
+	}
+	keys, err := keyfunc.NewDefaultOverrideCtx(ctx, []string{appConfig.JWTJWKSURL}, keyfunc.Override{
+		RefreshInterval: appConfig.JWTJWKSRefreshInterval,
+		RefreshErrorHandlerFunc: func(url string) func(context.Context, error) {
+			return func(_ context.Context, err error) {
+				log.Warn().Err(err).Str("url", url).Msg("failed to refresh the JWKS")
+			}
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the JWKS client: %w", err)
+	}
+	return &JWTAuthenticator{keyfunc: keys.Keyfunc, parser: newJWTParser(appConfig)}, nil
+}
+
+// newJWTParser returns the parser of the tokens issued by the platform.
+func newJWTParser(appConfig *pkg.AppConfig) *jwt.Parser {
+	return jwt.NewParser(
+		jwt.WithValidMethods(jwtMethods),
+		jwt.WithIssuer(appConfig.JWTIssuer),
+		jwt.WithAudience(appConfig.JWTAudience),
+		jwt.WithLeeway(appConfig.JWTClockSkew),
+		jwt.WithExpirationRequired(),
+	)
+}
+
+// Authenticate verifies the token and maps its claims into the principal.
+func (a *JWTAuthenticator) Authenticate(tokenString string) (*RequestPrincipal, error) {
+	claims := jwt.MapClaims{}
+	if _, err := a.parser.ParseWithClaims(tokenString, claims, a.keyfunc); err != nil {
+		return nil, err
+	}
+	subject, err := claims.GetSubject()
+	if err != nil || subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+
+	principal := &RequestPrincipal{Identity: subject, source: sourceJWT}
+	if role, ok := claims[roleClaim].(string); ok {
+		principal.Role = role
+	}
+	// JSON numbers are decoded as floats
+	if seconds, ok := claims[maxTimeoutClaim].(float64); ok && seconds > 0 {
+		principal.MaxTimeout = time.Duration(seconds * float64(time.Second))
+	}
+	if limit, ok := claims[maxMemoryClaim].(float64); ok && limit > 0 {
+		principal.MaxMemory = int64(limit)
+	}
+	return principal, nil
+}
+
+// authenticateJWT checks the bearer token of the RPC, attaching the principal
+// of the token: it takes precedence over the other credentials of the caller,
+// such as its client certificate, whose limits still apply.
+func (a *JWTAuthenticator) authenticateJWT(ctx context.Context, method string) (context.Context, error) {
+	if strings.HasPrefix(method, healthServicePrefix) {
+		return ctx, nil
+	}
+	values := metadata.ValueFromIncomingContext(ctx, authorizationMetadataKey)
+	if len(values) == 0 {
+		return nil, status.Errorf(codes.Unauthenticated, "missing %s metadata", authorizationMetadataKey)
+	}
+	scheme, token, ok := strings.Cut(values[0], " ")
+	if !ok || !strings.EqualFold(scheme, "bearer") || token == "" {
+		return nil, status.Error(codes.Unauthenticated, "expected a bearer token")
+	}
+	principal, err := a.Authenticate(token)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid token: %v", err)
+	}
+	return withAuthenticatedPrincipal(ctx, principal), nil
+}
+
+// UnaryInterceptor rejects the RPCs without a valid bearer token.
+func (a *JWTAuthenticator) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := a.authenticateJWT(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamInterceptor is the streaming counterpart of UnaryInterceptor.
+func (a *JWTAuthenticator) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := a.authenticateJWT(stream.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &identityStream{ServerStream: stream, ctx: ctx})
+	}
+}
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+const testMethod = "/codecell.v1.RunnerService/Run"
+
+// newTestJWTAuthenticator returns the authenticator of the tokens signed by a
+// new local key, and the function signing the claims of a token with it.
+func newTestJWTAuthenticator(t *testing.T) (*JWTAuthenticator, func(claims jwt.MapClaims) string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator := &JWTAuthenticator{
+		keyfunc: func(*jwt.Token) (any, error) { return &key.PublicKey, nil },
+		parser:  newJWTParser(&pkg.AppConfig{JWTIssuer: "platform", JWTAudience: "runner"}),
+	}
+	sign := func(claims jwt.MapClaims) string {
+		claims["iss"], claims["aud"] = "platform", "runner"
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+		token, err := jwt.NewWithClaims(jwt.SigningMethodES256, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	return authenticator, sign
+}
+
+// withClientCertificate returns a copy of the context of an RPC over the
+// connection verified with a client certificate of the given common name,
+// logging to logs.
+func withClientCertificate(t *testing.T, logs *bytes.Buffer, commonName string, md metadata.MD) context.Context {
+	t.Helper()
+	certificate := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: commonName}}
+	info := credentials.TLSInfo{State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{certificate}}}}
+	ctx := zerolog.New(logs).WithContext(context.Background())
+	ctx = peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{}, AuthInfo: info})
+	return metadata.NewIncomingContext(ctx, md)
+}
+
+// checkLoggedIdentity checks that the logger of the context records the given
+// identity, and only once.
+func checkLoggedIdentity(t *testing.T, ctx context.Context, logs *bytes.Buffer, identity string) {
+	t.Helper()
+	logs.Reset()
+	zerolog.Ctx(ctx).Info().Send()
+	if got := strings.Count(logs.String(), `"identity"`); got != 1 || !strings.Contains(logs.String(), `"identity":"`+identity+`"`) {
+		t.Errorf("the logger records the identity %d times, want %q once: %s", got, identity, logs.String())
+	}
+}
+
+func TestJWTTakesPrecedenceOverTheClientCertificate(t *testing.T) {
+	authenticator, sign := newTestJWTAuthenticator(t)
+	token := sign(jwt.MapClaims{"sub": "alice", roleClaim: RoleAdmin, maxTimeoutClaim: 30, maxMemoryClaim: 1 << 28})
+	md := metadata.Pairs(authorizationMetadataKey, "Bearer "+token)
+	want := RequestPrincipal{Identity: "alice", Role: RoleAdmin, MaxTimeout: 30 * time.Second, MaxMemory: 1 << 28, source: sourceJWT}
+
+	orderings := map[string]func(ctx context.Context) (context.Context, error){
+		"certificate then token": func(ctx context.Context) (context.Context, error) {
+			return authenticator.authenticateJWT(withClientCertificateIdentity(ctx), testMethod)
+		},
+		"token then certificate": func(ctx context.Context) (context.Context, error) {
+			ctx, err := authenticator.authenticateJWT(ctx, testMethod)
+			if err != nil {
+				return nil, err
+			}
+			return withClientCertificateIdentity(ctx), nil
+		},
+	}
+	for name, authenticate := range orderings {
+		t.Run(name, func(t *testing.T) {
+			var logs bytes.Buffer
+			ctx, err := authenticate(withClientCertificate(t, &logs, "platform", md))
+			if err != nil {
+				t.Fatalf("authenticate() = %v", err)
+			}
+			if got := PrincipalFromContext(ctx); got == nil || *got != want {
+				t.Fatalf("PrincipalFromContext() = %+v, want %+v", got, want)
+			}
+			checkLoggedIdentity(t, ctx, &logs, "alice")
+		})
+	}
+}
+
+func TestJWTIsRequiredAlongTheClientCertificate(t *testing.T) {
+	authenticator, _ := newTestJWTAuthenticator(t)
+	var logs bytes.Buffer
+	ctx := withClientCertificateIdentity(withClientCertificate(t, &logs, "platform", metadata.MD{}))
+	if _, err := authenticator.authenticateJWT(ctx, testMethod); err == nil {
+		t.Error("authenticateJWT() = nil, want the missing token rejected despite the certificate")
+	}
+}
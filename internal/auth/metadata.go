@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// identityStream overrides the context of the wrapped server stream.
+type identityStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *identityStream) Context() context.Context {
+	return s.ctx
+}
+
+// withMetadataIdentity attaches the principal identified by the given metadata
+// key; every authenticated principal of the caller takes precedence over it.
+func withMetadataIdentity(ctx context.Context, key string) context.Context {
+	values := metadata.ValueFromIncomingContext(ctx, key)
+	if len(values) == 0 || values[0] == "" {
+		return ctx
+	}
+	return withAuthenticatedPrincipal(ctx, &RequestPrincipal{Identity: values[0], source: sourceForwarded})
+}
+
+// MetadataIdentityUnaryInterceptor identifies the callers by the identity the
+// fronting platform forwards in the given metadata key.
+func MetadataIdentityUnaryInterceptor(key string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		return handler(withMetadataIdentity(ctx, key), req)
+	}
+}
+
+// MetadataIdentityStreamInterceptor is the streaming counterpart of
+// MetadataIdentityUnaryInterceptor.
+func MetadataIdentityStreamInterceptor(key string) grpc.StreamServerInterceptor {
+	return func(srv any, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx := withMetadataIdentity(stream.Context(), key)
+		return handler(srv, &identityStream{ServerStream: stream, ctx: ctx})
+	}
+}
+
+// ForwardCredentials returns a copy of the context whose outgoing metadata
+// carries the credentials of the incoming RPC: its bearer token, its API key
+// and the identity forwarded in the given metadata key, so that the instance
+// the call is proxied to authenticates the original caller.
+func ForwardCredentials(ctx context.Context, identityMetadataKey string) context.Context {
+	incoming, _ := metadata.FromIncomingContext(ctx)
+	outgoing := metadata.MD{}
+	for _, key := range []string{authorizationMetadataKey, APIKeyMetadataKey, identityMetadataKey} {
+		if values := incoming.Get(key); key != "" && len(values) > 0 {
+			outgoing.Set(key, values...)
+		}
+	}
+	return metadata.NewOutgoingContext(ctx, outgoing)
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"context"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/middleware"
+	"github.com/rs/zerolog"
+)
+
+// RoleAdmin is the role allowed to use privileged features, such as custom images.
+const RoleAdmin = "admin"
+
+// RequestPrincipal describes the authenticated caller of an RPC.
+type RequestPrincipal struct {
+	// Identity is the unique name of the caller, used for quotas and auditing.
+	Identity string
+	// Role is the role of the caller, e.g. RoleAdmin.
+	Role string
+	// MaxTimeout is the longest run timeout the caller may request, 0 if unlimited.
+	MaxTimeout time.Duration
+	// MaxMemory caps the memory limit of the containers of the caller, 0 if unlimited.
+	MaxMemory int64
+
+	// source is the credential the principal is authenticated by.
+	source credentialSource
+}
+
+// credentialSource is the credential a principal is authenticated by, in the
+// increasing order of precedence.
+type credentialSource int
+
+const (
+	// sourceForwarded is the identity forwarded by the fronting platform,
+	// authenticating nothing by itself.
+	sourceForwarded credentialSource = iota
+	// sourceCertificate is the verified client certificate of the connection.
+	sourceCertificate
+	// sourceAPIKey is an API key of the store.
+	sourceAPIKey
+	// sourceJWT is a bearer token issued by the platform.
+	sourceJWT
+)
+
+// IsAdmin reports whether the principal has the admin role.
+func (p *RequestPrincipal) IsAdmin() bool {
+	return p != nil && p.Role == RoleAdmin
+}
+
+// principalKey is the context key of the request principal.
+type principalKey struct{}
+
+// principalValue is the request principal, along with the logger of the
+// context it was attached to, before it got the identity.
+type principalValue struct {
+	principal *RequestPrincipal
+	logger    *zerolog.Logger
+}
+
+// WithPrincipal returns a copy of the context carrying the given principal,
+// also recording its identity in the annotations of the RPC and its logger.
+// The principal replaces the one the context already carries, if any.
+func WithPrincipal(ctx context.Context, principal *RequestPrincipal) context.Context {
+	middleware.AnnotationsFromContext(ctx).SetIdentity(principal.Identity)
+	// the identity of the replaced principal is left out of the logger
+	logger := zerolog.Ctx(ctx)
+	if value, ok := ctx.Value(principalKey{}).(principalValue); ok {
+		logger = value.logger
+	}
+	ctx = logger.With().Str("identity", principal.Identity).Logger().WithContext(ctx)
+	return context.WithValue(ctx, principalKey{}, principalValue{principal: principal, logger: logger})
+}
+
+// PrincipalFromContext returns the principal of the request, or nil if the
+// caller is not authenticated.
+func PrincipalFromContext(ctx context.Context) *RequestPrincipal {
+	value, _ := ctx.Value(principalKey{}).(principalValue)
+	return value.principal
+}
+
+// withAuthenticatedPrincipal returns a copy of the context carrying the given
+// principal merged into the one the context already carries, if any, so that
+// the outcome doesn't depend on the order of the authenticators: the identity
+// and the role are the ones of the credential taking precedence, and the
+// limits the tightest of both.
+func withAuthenticatedPrincipal(ctx context.Context, principal *RequestPrincipal) context.Context {
+	existing := PrincipalFromContext(ctx)
+	if existing == nil {
+		return WithPrincipal(ctx, principal)
+	}
+	merged := *principal
+	if existing.source > principal.source {
+		merged = *existing
+	}
+	merged.MaxTimeout = tighterLimit(existing.MaxTimeout, principal.MaxTimeout)
+	merged.MaxMemory = tighterLimit(existing.MaxMemory, principal.MaxMemory)
+	return WithPrincipal(ctx, &merged)
+}
+
+// tighterLimit returns the lower of both limits, 0 being unlimited.
+func tighterLimit[T time.Duration | int64](a T, b T) T {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
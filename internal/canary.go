@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	v1 "github.com/Pelfox/codecell-runner/generated"
+	"github.com/Pelfox/codecell-runner/internal/executor"
+	"github.com/Pelfox/codecell-runner/internal/middleware"
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/status"
+)
+
+// CanaryLabel is the label marking the startup canary run in its events and records.
+const CanaryLabel = "codecell.canary"
+
+// canaryKey is the context key marking the startup canary run, which is kept
+// out of the quotas, the arrival rate and the usage metrics.
+type canaryKey struct{}
+
+// isCanary reports whether the run of the context is the startup canary.
+func isCanary(ctx context.Context) bool {
+	return ctx.Value(canaryKey{}) != nil
+}
+
+// CanaryError is the failure of the startup canary, naming the stage that broke.
+type CanaryError struct {
+	// Stage is the stage of the run that broke.
+	Stage string
+	// RequestID is the request ID of the run, empty if it was rejected before being identified.
+	RequestID string
+	// Err describes the failure.
+	Err error
+}
+
+func (e *CanaryError) Error() string {
+	return fmt.Sprintf("startup canary failed at %s: %v", e.Stage, e.Err)
+}
+
+func (e *CanaryError) Unwrap() error {
+	return e.Err
+}
+
+// Canary checks the whole pipeline at the startup, by executing a hello-world
+// program through the Run handler, just as a client would.
+type Canary struct {
+	appConfig *pkg.AppConfig
+	server    *RunnerServer
+}
+
+// NewCanary creates a new instance of Canary executing through the given server.
+func NewCanary(appConfig *pkg.AppConfig, server *RunnerServer) *Canary {
+	return &Canary{appConfig: appConfig, server: server}
+}
+
+// Run executes the canary within the configured budget. It returns nil if the
+// program has printed the expected output and exited with 0, the CanaryError
+// naming the failed stage otherwise.
+func (c *Canary) Run(ctx context.Context) error {
+	language := c.appConfig.CanaryLanguage
+	technology, ok := c.server.languagesService.Technology(language)
+	if !ok || technology.GetHelloWorld() == "" {
+		return &CanaryError{Stage: "setup", Err: fmt.Errorf("language %q has no hello-world program", language)}
+	}
+	return c.check(ctx, language, executor.Probe{
+		SourceCode: technology.GetHelloWorld(),
+		Stdout:     executor.HelloWorldOutput,
+	})
+}
+
+// Conformance executes the probes of every available language, each within
+// the budget of the canary, returning the CanaryError of the first failed
+// probe of every language that has failed one, so that the technologies
+// remapping the exit codes or the output of the programs are caught.
+func (c *Canary) Conformance(ctx context.Context) map[string]error {
+	failures := make(map[string]error)
+	for _, language := range c.server.languagesService.Languages() {
+		technology, ok := c.server.languagesService.Technology(language)
+		if !ok || c.server.languagesService.Availability(language) != nil {
+			continue
+		}
+		for _, probe := range technology.GetProbes() {
+			if err := c.check(ctx, language, probe); err != nil {
+				failures[language] = err
+				break
+			}
+		}
+	}
+	return failures
+}
+
+// check executes the program of the probe through the Run handler, returning
+// the CanaryError naming the failed stage if the run hasn't reported the exit
+// code and the output of the probe.
+func (c *Canary) check(ctx context.Context, language string, probe executor.Probe) error {
+	ctx, cancel := context.WithTimeout(ctx, c.appConfig.CanaryTimeout)
+	defer cancel()
+	ctx = context.WithValue(ctx, canaryKey{}, true)
+	ctx = middleware.WithLogFields(ctx, "canary", "true")
+	ctx, annotations := middleware.WithAnnotations(ctx)
+	broadcast := &Broadcast{changed: make(chan struct{})}
+
+	request := &v1.RunRequest{
+		Language:   language,
+		SourceCode: probe.SourceCode,
+		Labels:     map[string]string{CanaryLabel: "true"},
+		SkipDedup:  true,
+	}
+	logger := zerolog.Ctx(ctx).Info().Str("language", language)
+	if probe.Name != "" {
+		logger.Str("probe", probe.Name).Msg("running the probe of the technology")
+	} else {
+		logger.Msg("running the startup canary")
+	}
+	runErr := c.server.Run(request, &detachedStream{ctx: ctx, broadcast: broadcast})
+	broadcast.finish(runErr)
+
+	failure := func(stage string, err error) error {
+		if probe.Name != "" {
+			stage = fmt.Sprintf("%s of the %q probe", stage, probe.Name)
+		}
+		return &CanaryError{Stage: stage, RequestID: annotations.RequestID(), Err: err}
+	}
+	var stdout strings.Builder
+	var stderr []string
+	var exitCode *int64
+	var terminal string
+	follower := broadcast.Follow()
+	for {
+		message, ok, _ := follower.Next(ctx)
+		if !ok {
+			break
+		}
+		switch message.Level {
+		case v1.MessageLevel_STDOUT:
+			stdout.WriteString(message.GetMessage())
+		case v1.MessageLevel_STDERR:
+			stderr = append(stderr, strings.TrimSpace(message.GetMessage()))
+		case v1.MessageLevel_EXIT_CODE:
+			code := message.GetExitCode()
+			exitCode = &code
+		}
+		if message.ErrorClass != v1.ErrorClass_ERROR_CLASS_UNSPECIFIED {
+			terminal = message.GetMessage()
+		}
+	}
+
+	switch {
+	case annotations.RequestID() == "":
+		return failure("admission", runErr)
+	case ctx.Err() != nil:
+		return failure("execution", fmt.Errorf("the run exceeded the budget of %s", c.appConfig.CanaryTimeout))
+	case exitCode == nil && terminal != "":
+		return failure("execution", fmt.Errorf("%s", terminal))
+	case exitCode == nil:
+		return failure("execution", fmt.Errorf("the run ended without an exit code: %s", status.Convert(runErr).Message()))
+	case *exitCode != probe.ExitCode:
+		return failure("exit code", fmt.Errorf("the program exited with %d instead of %d", *exitCode, probe.ExitCode))
+	case strings.TrimSpace(stdout.String()) != probe.Stdout:
+		return failure("output", fmt.Errorf("the program printed %q instead of %q", stdout.String(), probe.Stdout))
+	case probe.Stderr != "" && !slices.Contains(stderr, probe.Stderr):
+		return failure("output", fmt.Errorf("the program didn't print %q on stderr", probe.Stderr))
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"sync/atomic"
+
+	"github.com/Pelfox/codecell-runner/internal/admission"
+	"github.com/Pelfox/codecell-runner/internal/registry"
+	"github.com/Pelfox/codecell-runner/internal/services"
+	"github.com/Pelfox/codecell-runner/pkg"
+)
+
+// LanguageCapacity describes the load of a single language.
+type LanguageCapacity struct {
+	// Language is the name of the language.
+	Language string
+	// Available reports whether the language can currently be used for runs.
+	Available bool
+	// UnavailableReason is the reason the language is unavailable, if it is.
+	UnavailableReason string
+	// ActiveRuns is the number of active runs of the language.
+	ActiveRuns int
+	// MaxConcurrentRuns is the concurrency limit of the language, 0 if it has none of its own.
+	MaxConcurrentRuns int
+}
+
+// Capacity is a snapshot of the load of the runner.
+type Capacity struct {
+	// MaxConcurrentRuns is the global concurrency limit, 0 if unlimited.
+	MaxConcurrentRuns int
+	// ActiveRuns is the number of active runs.
+	ActiveRuns int
+	// QueueDepth is the number of runs waiting for a slot.
+	QueueDepth int
+	// Languages is the load of every supported language.
+	Languages []LanguageCapacity
+	// MemoryHeadroom is the memory in bytes still available to new runs.
+	MemoryHeadroom int64
+	// CPUHeadroom is the host CPU in nanos not yet promised to active runs.
+	CPUHeadroom int64
+	// Draining reports whether the runner accepts no new runs.
+	Draining bool
+}
+
+// CapacityReporter collects the load of the runner. The snapshots are built
+// from the in-memory state and the host resources read at startup only, so
+// that they are cheap enough to be polled every second.
+type CapacityReporter struct {
+	appConfig        *pkg.AppConfig
+	registry         *registry.Registry
+	limiter          *admission.Limiter
+	languageLimiters map[string]*admission.Limiter
+	languagesService *services.LanguagesService
+	hostResources    services.HostResources
+
+	draining atomic.Bool
+	arrivals atomic.Uint64
+}
+
+// NewCapacityReporter creates a new instance of CapacityReporter.
+func NewCapacityReporter(
+	appConfig *pkg.AppConfig,
+	runRegistry *registry.Registry,
+	limiter *admission.Limiter,
+	languageLimiters map[string]*admission.Limiter,
+	languagesService *services.LanguagesService,
+	hostResources services.HostResources,
+) *CapacityReporter {
+	return &CapacityReporter{
+		appConfig:        appConfig,
+		registry:         runRegistry,
+		limiter:          limiter,
+		languageLimiters: languageLimiters,
+		languagesService: languagesService,
+		hostResources:    hostResources,
+	}
+}
+
+// SetDraining marks whether the runner accepts no new runs.
+func (r *CapacityReporter) SetDraining(draining bool) {
+	r.draining.Store(draining)
+}
+
+// Draining reports whether the runner accepts no new runs.
+func (r *CapacityReporter) Draining() bool {
+	return r.draining.Load()
+}
+
+// RecordArrival counts a run submitted to the runner, accepted or not.
+func (r *CapacityReporter) RecordArrival() {
+	r.arrivals.Add(1)
+}
+
+// Arrivals returns the number of runs submitted since the start.
+func (r *CapacityReporter) Arrivals() uint64 {
+	return r.arrivals.Load()
+}
+
+// Snapshot returns the current load of the runner.
+func (r *CapacityReporter) Snapshot() Capacity {
+	activeRuns := r.registry.CountByLanguage()
+	capacity := Capacity{
+		MaxConcurrentRuns: r.limiter.Limit(),
+		ActiveRuns:        r.registry.Count(),
+		QueueDepth:        r.limiter.QueueDepth(),
+		Draining:          r.Draining(),
+	}
+
+	for _, language := range r.languagesService.Languages() {
+		languageStatus := r.languagesService.Status(language)
+		languageCapacity := LanguageCapacity{
+			Language:   language,
+			Available:  languageStatus.Err == nil,
+			ActiveRuns: activeRuns[language],
+		}
+		if languageStatus.Err != nil {
+			languageCapacity.UnavailableReason = languageStatus.Err.Error()
+		}
+		if limiter, ok := r.languageLimiters[language]; ok {
+			languageCapacity.MaxConcurrentRuns = limiter.Limit()
+			capacity.QueueDepth += limiter.QueueDepth()
+		}
+		capacity.Languages = append(capacity.Languages, languageCapacity)
+	}
+
+	memoryCapacity := r.registry.MemoryCapacity()
+	if memoryCapacity == 0 {
+		memoryCapacity = r.hostResources.Memory // the admission is disabled, the host is the limit
+	}
+	capacity.MemoryHeadroom = max(0, memoryCapacity-r.registry.CommittedMemory())
+	hostCPU := int64(r.hostResources.CPUs) * 1e9
+	capacity.CPUHeadroom = max(0, hostCPU-int64(capacity.ActiveRuns)*r.appConfig.CPULimit)
+	return capacity
+}
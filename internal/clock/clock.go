@@ -0,0 +1,62 @@
+// Package clock provides the time to the components scheduling on it, so that
+// their tests control it with Fake instead of waiting for it.
+package clock
+
+import (
+	"time"
+)
+
+// Clock tells the time and schedules on it.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// Since returns the time elapsed since t.
+	Since(t time.Time) time.Duration
+	// After returns the channel receiving the time once d has elapsed.
+	After(d time.Duration) <-chan time.Time
+	// NewTimer returns the timer firing once d has elapsed.
+	NewTimer(d time.Duration) Timer
+	// NewTicker returns the ticker firing every d.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a time.Timer of a Clock.
+type Timer interface {
+	// C returns the channel of the timer.
+	C() <-chan time.Time
+	// Stop stops the timer, reporting whether it was active.
+	Stop() bool
+}
+
+// Ticker is a time.Ticker of a Clock.
+type Ticker interface {
+	// C returns the channel of the ticks.
+	C() <-chan time.Time
+	// Stop stops the ticker.
+	Stop()
+}
+
+// Real is the clock of the system.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTimer(d time.Duration) Timer         { return realTimer{time.NewTimer(d)} }
+func (realClock) NewTicker(d time.Duration) Ticker       { return realTicker{time.NewTicker(d)} }
+
+type realTimer struct {
+	timer *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time { return t.timer.C }
+func (t realTimer) Stop() bool          { return t.timer.Stop() }
+
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.ticker.C }
+func (t realTicker) Stop()               { t.ticker.Stop() }
@@ -0,0 +1,156 @@
+package clock
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Fake is a Clock standing still until advanced, for the tests. Its timers
+// fire as the real ones do: the ticks nobody has received yet are dropped.
+type Fake struct {
+	mutex   sync.Mutex
+	now     time.Time
+	timers  []*fakeTimer
+	changed chan struct{} // closed once a timer is added
+}
+
+// NewFake creates a new instance of Fake telling the given time.
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now, changed: make(chan struct{})}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.now
+}
+
+func (f *Fake) Since(t time.Time) time.Duration {
+	return f.Now().Sub(t)
+}
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	return f.NewTimer(d).C()
+}
+
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	return f.add(d, 0)
+}
+
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	return fakeTicker{f.add(d, d)}
+}
+
+// add adds the timer firing after d, and then every period if it's positive.
+func (f *Fake) add(d time.Duration, period time.Duration) *fakeTimer {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	timer := &fakeTimer{fake: f, c: make(chan time.Time, 1), at: f.now.Add(d), period: period}
+	f.timers = append(f.timers, timer)
+	close(f.changed)
+	f.changed = make(chan struct{})
+	return timer
+}
+
+// Advance moves the time forward by d, firing the timers due meanwhile in
+// the order of their times.
+func (f *Fake) Advance(d time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	target := f.now.Add(d)
+	for {
+		var next *fakeTimer
+		for _, timer := range f.timers {
+			if !timer.at.After(target) && (next == nil || timer.at.Before(next.at)) {
+				next = timer
+			}
+		}
+		if next == nil {
+			break
+		}
+		f.now = next.at
+		select {
+		case next.c <- f.now:
+		default:
+		}
+		if next.period > 0 {
+			next.at = next.at.Add(next.period)
+		} else {
+			f.remove(next)
+		}
+	}
+	f.now = target
+}
+
+// AwaitTimers blocks until at least n timers and tickers are active, e.g.
+// until the component under test is waiting on them.
+func (f *Fake) AwaitTimers(n int) {
+	for {
+		f.mutex.Lock()
+		active, changed := len(f.timers), f.changed
+		f.mutex.Unlock()
+		if active >= n {
+			return
+		}
+		<-changed
+	}
+}
+
+// AwaitTicks blocks until the ticks fired have been received from all the
+// tickers, e.g. until the component under test has taken the tick of the last
+// Advance. It blocks for good on a ticker nobody receives from anymore.
+func (f *Fake) AwaitTicks() {
+	for {
+		f.mutex.Lock()
+		pending := slices.ContainsFunc(f.timers, func(timer *fakeTimer) bool {
+			return timer.period > 0 && len(timer.c) > 0
+		})
+		f.mutex.Unlock()
+		if !pending {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// remove removes the timer, reporting whether it was active; the caller must
+// hold the mutex.
+func (f *Fake) remove(timer *fakeTimer) bool {
+	index := slices.Index(f.timers, timer)
+	if index < 0 {
+		return false
+	}
+	f.timers = slices.Delete(f.timers, index, index+1)
+	return true
+}
+
+// fakeTimer is a timer or a ticker of a Fake.
+type fakeTimer struct {
+	fake   *Fake
+	c      chan time.Time
+	at     time.Time     // when it fires next
+	period time.Duration // 0 for the timers
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.fake.mutex.Lock()
+	defer t.fake.mutex.Unlock()
+	return t.fake.remove(t)
+}
+
+// fakeTicker is a ticker of a Fake.
+type fakeTicker struct {
+	*fakeTimer
+}
+
+func (t fakeTicker) Stop() {
+	t.fakeTimer.Stop()
+}
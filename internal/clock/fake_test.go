@@ -0,0 +1,55 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeFiresTheTimersDue(t *testing.T) {
+	start := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	fake := NewFake(start)
+	timer := fake.NewTimer(2 * time.Second)
+	stopped := fake.NewTimer(time.Second)
+	ticker := fake.NewTicker(time.Second)
+	if !stopped.Stop() || stopped.Stop() {
+		t.Error("Stop() of an active timer = false or Stop() of a stopped one = true")
+	}
+
+	fake.Advance(time.Second)
+	if got := <-ticker.C(); !got.Equal(start.Add(time.Second)) {
+		t.Errorf("the ticker ticks at %v, want %v", got, start.Add(time.Second))
+	}
+	if len(timer.C()) != 0 || len(stopped.C()) != 0 {
+		t.Error("a timer fires before its time or once stopped")
+	}
+
+	// the ticks nobody has received are dropped, as the real ones are
+	fake.Advance(3 * time.Second)
+	if got := <-timer.C(); !got.Equal(start.Add(2 * time.Second)) {
+		t.Errorf("the timer fires at %v, want %v", got, start.Add(2*time.Second))
+	}
+	if got := <-ticker.C(); !got.Equal(start.Add(2 * time.Second)) {
+		t.Errorf("the ticker ticks at %v, want the first tick missed at %v", got, start.Add(2*time.Second))
+	}
+	if len(ticker.C()) != 0 {
+		t.Error("the ticker keeps the ticks nobody has received")
+	}
+	if !fake.Now().Equal(start.Add(4 * time.Second)) {
+		t.Errorf("Now() = %v, want %v", fake.Now(), start.Add(4*time.Second))
+	}
+
+	ticker.Stop()
+	fake.Advance(time.Second)
+	if len(ticker.C()) != 0 {
+		t.Error("the ticker ticks once stopped")
+	}
+}
+
+func TestFakeAwaitsTheTimers(t *testing.T) {
+	fake := NewFake(time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC))
+	go func() {
+		fake.NewTicker(time.Second)
+		fake.After(time.Second)
+	}()
+	fake.AwaitTimers(2)
+}
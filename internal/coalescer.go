@@ -0,0 +1,277 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"slices"
+	"sync"
+
+	v1 "github.com/Pelfox/codecell-runner/generated"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// broadcastReplayBytes caps the size of the messages a broadcast keeps for
+// the followers to replay.
+const broadcastReplayBytes = 1 << 20
+
+// broadcastEntry is a message of a broadcast, numbered in the order of
+// publication.
+type broadcastEntry struct {
+	sequence int
+	message  *v1.RunResponseMessage
+	size     int
+}
+
+// Broadcast records the messages of a run, so that the identical runs
+// coalesced with it can follow its output from the start. It keeps the last
+// broadcastReplayBytes of them, evicting the oldest ones past that, and only
+// the last statistics: the followers falling that far behind, or joining that
+// late, miss the evicted messages.
+type Broadcast struct {
+	// RequestID is the request ID of the originating run.
+	RequestID string
+
+	mutex      sync.Mutex
+	entries    []broadcastEntry
+	size       int             // of the entries
+	statistics *broadcastEntry // the last statistics published, if any
+	published  int             // number of messages published
+	changed    chan struct{}   // closed on every new message and when done
+	done       bool
+	err        error
+}
+
+// publish records the message and wakes the watchers up.
+func (b *Broadcast) publish(message *v1.RunResponseMessage) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	entry := broadcastEntry{sequence: b.published, message: message, size: proto.Size(message)}
+	b.published++
+	if message.Level == v1.MessageLevel_STATISTICS {
+		b.statistics = &entry
+	} else {
+		b.entries = append(b.entries, entry)
+		b.size += entry.size
+		evicted := 0
+		for b.size > broadcastReplayBytes && evicted < len(b.entries)-1 {
+			b.size -= b.entries[evicted].size
+			evicted++
+		}
+		b.entries = slices.Delete(b.entries, 0, evicted)
+	}
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// finish marks the run as ended with the given error.
+func (b *Broadcast) finish(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.done = true
+	b.err = err
+	close(b.changed)
+}
+
+// Follow returns the follower of the messages of the run, from the oldest
+// one kept.
+func (b *Broadcast) Follow() *BroadcastFollower {
+	return &BroadcastFollower{broadcast: b}
+}
+
+// next returns the oldest message kept numbered from the given sequence on,
+// if any; the caller must hold the mutex.
+func (b *Broadcast) next(sequence int) (broadcastEntry, bool) {
+	index, _ := slices.BinarySearchFunc(b.entries, sequence, func(entry broadcastEntry, sequence int) int {
+		return entry.sequence - sequence
+	})
+	statistics := b.statistics != nil && b.statistics.sequence >= sequence
+	switch {
+	case index < len(b.entries) && (!statistics || b.entries[index].sequence < b.statistics.sequence):
+		return b.entries[index], true
+	case statistics:
+		return *b.statistics, true
+	}
+	return broadcastEntry{}, false
+}
+
+// BroadcastFollower reads the messages of a broadcast in order.
+type BroadcastFollower struct {
+	broadcast *Broadcast
+	sequence  int // of the next message to read
+}
+
+// Sequence returns the number of the last message read, the messages of the
+// run being numbered from 0 in their order of publication.
+func (f *BroadcastFollower) Sequence() int {
+	return f.sequence - 1
+}
+
+// Next returns the next message, waiting for it if needed. Once the run has
+// ended and every message has been read, it returns false with the final
+// error of the run.
+func (f *BroadcastFollower) Next(ctx context.Context) (*v1.RunResponseMessage, bool, error) {
+	b := f.broadcast
+	for {
+		b.mutex.Lock()
+		if entry, ok := b.next(f.sequence); ok {
+			b.mutex.Unlock()
+			f.sequence = entry.sequence + 1
+			return entry.message, true, nil
+		}
+		if b.done {
+			err := b.err
+			b.mutex.Unlock()
+			return nil, false, err
+		}
+		changed := b.changed
+		b.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// broadcastStream sends the messages of the originating run to its client
+// and records them for the watchers.
+type broadcastStream struct {
+	grpc.ServerStreamingServer[v1.RunResponseMessage]
+	broadcast *Broadcast
+}
+
+func (s broadcastStream) Send(message *v1.RunResponseMessage) error {
+	s.broadcast.publish(message)
+	return s.ServerStreamingServer.Send(message)
+}
+
+// Coalescer tracks the runs in flight by the hash of their inputs, so that
+// identical submissions of the same identity attach to the existing run
+// instead of executing again.
+type Coalescer struct {
+	mutex    sync.Mutex
+	inFlight map[string]*Broadcast // ID = hash of the run inputs
+	watchers map[string]watcher    // ID = request ID of the watcher
+}
+
+// watcher is a run following an identical one in flight.
+type watcher struct {
+	identity string
+	cancel   context.CancelFunc
+}
+
+// NewCoalescer creates a new, empty instance of Coalescer.
+func NewCoalescer() *Coalescer {
+	return &Coalescer{
+		inFlight: make(map[string]*Broadcast),
+		watchers: make(map[string]watcher),
+	}
+}
+
+// CoalescingKey hashes everything that determines the result of a run.
+func CoalescingKey(identity string, imageDigest string, request *v1.RunRequest) string {
+	hash := sha256.New()
+	// every part is length-prefixed, so that the boundaries can't be shifted
+	write := func(value string) {
+		_ = binary.Write(hash, binary.BigEndian, uint64(len(value)))
+		hash.Write([]byte(value))
+	}
+	write(identity)
+	write(request.Language)
+	write(imageDigest)
+	write(request.Image)
+	write(request.SourceCode)
+	write(request.NetworkPolicy.String())
+	_ = binary.Write(hash, binary.BigEndian, request.TimeoutSeconds)
+	_ = binary.Write(hash, binary.BigEndian, uint64(len(request.Stdin)))
+	for _, line := range request.Stdin {
+		write(line)
+	}
+	_ = binary.Write(hash, binary.BigEndian, uint64(len(request.Command)))
+	for _, argument := range request.Command {
+		write(argument)
+	}
+	_ = binary.Write(hash, binary.BigEndian, uint64(len(request.Args)))
+	for _, argument := range request.Args {
+		write(argument)
+	}
+	_ = binary.Write(hash, binary.BigEndian, uint64(len(request.Assets)))
+	for _, asset := range request.Assets {
+		write(asset)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Join returns the broadcast of the identical run in flight, or registers the
+// new run as the originator under the key, wrapping its stream. In the latter
+// case, the returned function must be called with the final error of the run.
+func (c *Coalescer) Join(
+	key string,
+	requestID string,
+	stream grpc.ServerStreamingServer[v1.RunResponseMessage],
+) (*Broadcast, grpc.ServerStreamingServer[v1.RunResponseMessage], func(error)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if broadcast, ok := c.inFlight[key]; ok {
+		return broadcast, nil, nil
+	}
+	broadcast := &Broadcast{RequestID: requestID, changed: make(chan struct{})}
+	c.inFlight[key] = broadcast
+	return nil, broadcastStream{stream, broadcast}, func(err error) {
+		c.mutex.Lock()
+		delete(c.inFlight, key)
+		c.mutex.Unlock()
+		broadcast.finish(err)
+	}
+}
+
+// Watch registers the watcher of the given identity, so that it can be
+// detached by its request ID. The returned function unregisters it.
+func (c *Coalescer) Watch(requestID string, identity string, cancel context.CancelFunc) func() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.watchers[requestID] = watcher{identity: identity, cancel: cancel}
+	return func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		delete(c.watchers, requestID)
+	}
+}
+
+// Owner returns the identity of the watcher with the given request ID, or
+// false for unknown watchers.
+func (c *Coalescer) Owner(requestID string) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	watcher, ok := c.watchers[requestID]
+	return watcher.identity, ok
+}
+
+// Detach stops the watcher with the given request ID from following the run,
+// without affecting the run itself. It returns false for unknown watchers.
+func (c *Coalescer) Detach(requestID string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	watcher, ok := c.watchers[requestID]
+	if ok {
+		watcher.cancel()
+	}
+	return ok
+}
+
+// Sizes returns the number of runs in flight and of the watchers following them.
+func (c *Coalescer) Sizes() (inFlight int, watchers int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.inFlight), len(c.watchers)
+}
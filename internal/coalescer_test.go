@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	v1 "github.com/Pelfox/codecell-runner/generated"
+	"google.golang.org/protobuf/proto"
+)
+
+// outputMessage returns a STDOUT message of the given text.
+func outputMessage(text string) *v1.RunResponseMessage {
+	return &v1.RunResponseMessage{Level: v1.MessageLevel_STDOUT, Payload: &v1.RunResponseMessage_Message{Message: text}}
+}
+
+// statisticsMessage returns a STATISTICS message of the given memory usage.
+func statisticsMessage(memory uint64) *v1.RunResponseMessage {
+	return &v1.RunResponseMessage{
+		Level:   v1.MessageLevel_STATISTICS,
+		Payload: &v1.RunResponseMessage_Statistics{Statistics: &v1.StatisticsMessage{MemoryUsed: memory}},
+	}
+}
+
+// follow reads the messages of the finished broadcast, returning them along
+// with their sequence numbers.
+func follow(t *testing.T, follower *BroadcastFollower) ([]*v1.RunResponseMessage, []int) {
+	t.Helper()
+	var messages []*v1.RunResponseMessage
+	var sequences []int
+	for {
+		message, ok, err := follower.Next(context.Background())
+		if !ok {
+			if err != nil {
+				t.Fatalf("Next() = %v", err)
+			}
+			return messages, sequences
+		}
+		messages = append(messages, message)
+		sequences = append(sequences, follower.Sequence())
+	}
+}
+
+func TestBroadcastCapsTheReplayedMessages(t *testing.T) {
+	broadcast := &Broadcast{changed: make(chan struct{})}
+	line := strings.Repeat("x", 1023)
+	size := proto.Size(outputMessage(line))
+	total := 2 * broadcastReplayBytes / size
+	for i := range total {
+		broadcast.publish(outputMessage(line))
+		broadcast.publish(statisticsMessage(uint64(i)))
+	}
+	broadcast.publish(outputMessage("last"))
+	broadcast.finish(nil)
+
+	messages, sequences := follow(t, broadcast.Follow())
+	kept := 0
+	for _, message := range messages[:len(messages)-2] {
+		if message.Level != v1.MessageLevel_STDOUT {
+			t.Fatalf("replayed %s before the last statistics", message.Level)
+		}
+		kept += size
+	}
+	if kept > broadcastReplayBytes || kept+2*size <= broadcastReplayBytes {
+		t.Errorf("replayed %d bytes of output, want the last ones up to %d", kept, broadcastReplayBytes)
+	}
+	// the last statistics come in the order they were published in
+	statistics := messages[len(messages)-2]
+	if statistics.GetStatistics().GetMemoryUsed() != uint64(total-1) {
+		t.Errorf("replayed the statistics %v, want the last ones only", statistics)
+	}
+	if messages[len(messages)-1].GetMessage() != "last" {
+		t.Errorf("replayed %v last, want the last output", messages[len(messages)-1])
+	}
+	if last := sequences[len(sequences)-1]; last != 2*total {
+		t.Errorf("the last message has the sequence %d, want %d", last, 2*total)
+	}
+}
+
+func TestBroadcastRelaysTheStatisticsToTheLiveFollowers(t *testing.T) {
+	broadcast := &Broadcast{changed: make(chan struct{})}
+	follower := broadcast.Follow()
+	for i := range 3 {
+		broadcast.publish(outputMessage("line"))
+		broadcast.publish(statisticsMessage(uint64(i)))
+		for _, want := range []v1.MessageLevel{v1.MessageLevel_STDOUT, v1.MessageLevel_STATISTICS} {
+			message, ok, err := follower.Next(context.Background())
+			if !ok || err != nil || message.Level != want {
+				t.Fatalf("Next() = %v, %t, %v, want the %s just published", message, ok, err, want)
+			}
+		}
+	}
+	broadcast.finish(nil)
+	if message, ok, _ := follower.Next(context.Background()); ok {
+		t.Errorf("Next() = %v after the end, want none", message)
+	}
+}
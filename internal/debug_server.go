@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/registry"
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/rs/zerolog/log"
+)
+
+// goroutineDumpBufferSize is the initial size of the goroutine dump buffer,
+// grown until the stacks of all goroutines fit.
+const goroutineDumpBufferSize = 1 << 20
+
+// DebugServer serves the runtime profiles and the internal counters of the
+// runner on its own listener, so that they are never exposed over gRPC.
+type DebugServer struct {
+	addr   string
+	server *http.Server
+}
+
+// debugSources are the registry and the coalescer of the expvar variables,
+// those of the last debug server created.
+type debugSources struct {
+	registry  *registry.Registry
+	coalescer *Coalescer
+}
+
+var (
+	currentDebugSources atomic.Pointer[debugSources]
+	publishDebugVars    sync.Once
+)
+
+// NewDebugServer creates a new instance of DebugServer, publishing the sizes
+// of the registry and of the coalescer (nil if disabled) as expvar variables.
+// The variables are process-wide, the last server created sets what they
+// read. It returns nil if the debug server is disabled, which serves nothing.
+func NewDebugServer(appConfig *pkg.AppConfig, runRegistry *registry.Registry, coalescer *Coalescer) *DebugServer {
+	if !appConfig.DebugEnabled {
+		return nil
+	}
+	currentDebugSources.Store(&debugSources{registry: runRegistry, coalescer: coalescer})
+	publishDebugVars.Do(func() {
+		expvar.Publish("registry", expvar.Func(func() any {
+			return currentDebugSources.Load().registry.Sizes()
+		}))
+		expvar.Publish("coalescer", expvar.Func(func() any {
+			coalescer := currentDebugSources.Load().coalescer
+			if coalescer == nil {
+				return nil
+			}
+			inFlight, watchers := coalescer.Sizes()
+			return map[string]int{"inFlight": inFlight, "watchers": watchers}
+		}))
+		expvar.Publish("goroutines", expvar.Func(func() any {
+			return runtime.NumGoroutine()
+		}))
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("POST /debug/goroutines/dump", dumpGoroutines)
+
+	addr := appConfig.DebugAddr
+	if appConfig.DebugLocalhostOnly {
+		// keeping the port, but never listening beyond the loopback interface
+		if _, port, err := net.SplitHostPort(addr); err == nil {
+			addr = net.JoinHostPort("127.0.0.1", port)
+		}
+	}
+	return &DebugServer{
+		addr: addr,
+		server: &http.Server{
+			Addr:              addr,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// Run serves the debug endpoints until the context is cancelled.
+func (s *DebugServer) Run(ctx context.Context) {
+	if s == nil {
+		return
+	}
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to listen for the debug endpoints")
+		return
+	}
+	s.serve(ctx, listener)
+}
+
+// serve serves the debug endpoints on the listener until the context is cancelled.
+func (s *DebugServer) serve(ctx context.Context, listener net.Listener) {
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = s.server.Shutdown(shutdownCtx)
+	}()
+
+	log.Warn().Str("addr", listener.Addr().String()).Msg("debug server listening, profiles are exposed")
+	if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Error().Err(err).Msg("failed to serve the debug endpoints")
+	}
+}
+
+// dumpGoroutines writes the stacks of all goroutines to the log and to the
+// response, for the moments a profile can't be fetched interactively.
+func dumpGoroutines(w http.ResponseWriter, _ *http.Request) {
+	buffer := make([]byte, goroutineDumpBufferSize)
+	for {
+		n := runtime.Stack(buffer, true)
+		if n < len(buffer) {
+			buffer = buffer[:n]
+			break
+		}
+		buffer = make([]byte, 2*len(buffer))
+	}
+
+	log.Warn().Int("goroutines", runtime.NumGoroutine()).Str("stacks", string(buffer)).Msg("goroutine dump")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write(buffer)
+}
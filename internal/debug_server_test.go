@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/registry"
+	"github.com/Pelfox/codecell-runner/pkg"
+)
+
+// debugConfig returns the configuration of the debug server on the address.
+func debugConfig(t *testing.T, enabled bool, addr string) *pkg.AppConfig {
+	t.Helper()
+	config, _, err := pkg.LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.DebugEnabled = enabled
+	config.DebugAddr = addr
+	config.DebugLocalhostOnly = true
+	return config
+}
+
+// debugGet returns the status code and the body of the response to the request.
+func debugGet(t *testing.T, method string, url string) (int, string) {
+	t.Helper()
+	request, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("%s %s = %v", method, url, err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response.StatusCode, string(body)
+}
+
+func TestDebugServerServesTheProfilesAndTheCounters(t *testing.T) {
+	// the host is replaced by the loopback one, the port kept
+	debugServer := NewDebugServer(debugConfig(t, true, "0.0.0.0:0"), registry.New(0, 10, time.Minute), NewCoalescer())
+	if debugServer.addr != "127.0.0.1:0" {
+		t.Fatalf("the debug server listens on %q, want the loopback interface", debugServer.addr)
+	}
+	listener, err := net.Listen("tcp", debugServer.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		debugServer.serve(ctx, listener)
+		close(done)
+	}()
+	base := "http://" + listener.Addr().String()
+
+	code, body := debugGet(t, http.MethodGet, base+"/debug/vars")
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(body), &vars); code != http.StatusOK || err != nil {
+		t.Fatalf("GET /debug/vars = %d %q", code, body)
+	}
+	for _, name := range []string{"registry", "coalescer", "goroutines"} {
+		if _, ok := vars[name]; !ok {
+			t.Errorf("/debug/vars has no %q variable", name)
+		}
+	}
+	if code, body := debugGet(t, http.MethodGet, base+"/debug/pprof/"); code != http.StatusOK || !strings.Contains(body, "goroutine") {
+		t.Errorf("GET /debug/pprof/ = %d, without the profiles", code)
+	}
+	if code, body := debugGet(t, http.MethodPost, base+"/debug/goroutines/dump"); code != http.StatusOK ||
+		!strings.Contains(body, "goroutine 1 [") {
+		t.Errorf("POST /debug/goroutines/dump = %d, without the stacks", code)
+	}
+	// the dump isn't triggered by a mere GET, e.g. of a crawler
+	if code, _ := debugGet(t, http.MethodGet, base+"/debug/goroutines/dump"); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /debug/goroutines/dump = %d, want %d", code, http.StatusMethodNotAllowed)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the debug server keeps serving once cancelled")
+	}
+}
+
+func TestDisabledDebugServerOpensNoPort(t *testing.T) {
+	// a port known to be free, closed again for the debug server to take it
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+
+	debugServer := NewDebugServer(debugConfig(t, false, addr), registry.New(0, 10, time.Minute), nil)
+	if debugServer != nil {
+		t.Fatal("NewDebugServer() of the disabled debug server isn't nil")
+	}
+	debugServer.Run(context.Background())
+	if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		_ = conn.Close()
+		t.Errorf("the disabled debug server accepts connections on %s", addr)
+	}
+}
@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	v1 "github.com/Pelfox/codecell-runner/generated"
+	"github.com/Pelfox/codecell-runner/internal/auth"
+	"github.com/Pelfox/codecell-runner/internal/middleware"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// detachedStream is the server stream of a detached run, recording the
+// messages instead of sending them anywhere.
+type detachedStream struct {
+	grpc.ServerStream // nil, the methods used by Run are overridden
+	ctx               context.Context
+	broadcast         *Broadcast
+}
+
+func (s *detachedStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *detachedStream) Send(message *v1.RunResponseMessage) error {
+	s.broadcast.publish(message)
+	return nil
+}
+
+func (s *detachedStream) SendMsg(m any) error {
+	message, ok := m.(*v1.RunResponseMessage)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", m)
+	}
+	return s.Send(message)
+}
+
+func (s *detachedStream) SetHeader(metadata.MD) error  { return nil }
+func (s *detachedStream) SendHeader(metadata.MD) error { return nil }
+func (s *detachedStream) SetTrailer(metadata.MD)       {}
+
+// detachedRun is a run executed in the background.
+type detachedRun struct {
+	broadcast *Broadcast
+	identity  string
+}
+
+// DetachedRuns executes the runs submitted without a stream of their own, by
+// the HTTP gateway and SubmitRun, keeping their messages for the followers
+// just like a coalesced run follows another.
+type DetachedRuns struct {
+	retention time.Duration
+
+	mutex sync.Mutex
+	runs  map[string]*detachedRun // ID = request ID
+}
+
+// NewDetachedRuns creates a new instance of DetachedRuns keeping the messages
+// of the finished runs for the given retention.
+func NewDetachedRuns(retention time.Duration) *DetachedRuns {
+	return &DetachedRuns{retention: retention, runs: make(map[string]*detachedRun)}
+}
+
+// Start executes the run in the background, on a context carrying the values
+// of the given one but outliving it, the run being bounded by its own timeout.
+// It returns the request ID of the run once it's known, or the error of the
+// run rejected before being identified.
+func (d *DetachedRuns) Start(
+	ctx context.Context,
+	run func(stream grpc.ServerStreamingServer[v1.RunResponseMessage]) error,
+) (string, error) {
+	var identity string
+	if principal := auth.PrincipalFromContext(ctx); principal != nil {
+		identity = principal.Identity
+	}
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	ctx, annotations := middleware.WithAnnotations(ctx)
+	broadcast := &Broadcast{changed: make(chan struct{})}
+
+	finished := make(chan error, 1)
+	go func() {
+		defer cancel()
+		// the run panicking ends with the status of our failures
+		err := status.Error(codes.Internal, "the runner failed to execute the run")
+		defer func() {
+			broadcast.finish(err)
+			finished <- err
+
+			// keeping the messages for the late followers for a while
+			requestID := annotations.RequestID()
+			time.AfterFunc(d.retention, func() {
+				d.mutex.Lock()
+				defer d.mutex.Unlock()
+				delete(d.runs, requestID)
+			})
+		}()
+		defer middleware.RecoverGoroutine(ctx, "detached run")
+		err = run(&detachedStream{ctx: ctx, broadcast: broadcast})
+	}()
+
+	select {
+	case err := <-finished:
+		if annotations.RequestID() == "" {
+			return "", err
+		}
+	case <-annotations.RequestIDSet():
+	}
+	requestID := annotations.RequestID()
+	d.mutex.Lock()
+	d.runs[requestID] = &detachedRun{broadcast: broadcast, identity: identity}
+	d.mutex.Unlock()
+	return requestID, nil
+}
+
+// Attach returns the broadcast of the run, if the caller is the one who has
+// submitted it or an admin.
+func (d *DetachedRuns) Attach(ctx context.Context, requestID string) (*Broadcast, error) {
+	d.mutex.Lock()
+	run, ok := d.runs[requestID]
+	d.mutex.Unlock()
+	if !ok {
+		return nil, status.Error(codes.NotFound, "run not found")
+	}
+
+	if err := authorizeRunOwner(ctx, run.identity); err != nil {
+		return nil, err
+	}
+	return run.broadcast, nil
+}
@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v1 "github.com/Pelfox/codecell-runner/generated"
+	"github.com/Pelfox/codecell-runner/internal/middleware"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDetachedRunPanickingEndsWithAnInternalError(t *testing.T) {
+	detached := NewDetachedRuns(time.Minute)
+
+	_, err := detached.Start(context.Background(), func(grpc.ServerStreamingServer[v1.RunResponseMessage]) error {
+		panic("before the request ID")
+	})
+	if status.Code(err) != codes.Internal {
+		t.Errorf("Start() of the run panicking before its request ID = %v, want INTERNAL", err)
+	}
+
+	requestID, err := detached.Start(context.Background(), func(stream grpc.ServerStreamingServer[v1.RunResponseMessage]) error {
+		middleware.AnnotationsFromContext(stream.Context()).SetRequestID("run")
+		_ = stream.Send(&v1.RunResponseMessage{RequestId: "run", Level: v1.MessageLevel_INFO})
+		panic("after the request ID")
+	})
+	if err != nil {
+		t.Fatalf("Start() = %v", err)
+	}
+	broadcast, err := detached.Attach(context.Background(), requestID)
+	if err != nil {
+		t.Fatalf("Attach() = %v", err)
+	}
+	follower := broadcast.Follow()
+	if message, ok, _ := follower.Next(context.Background()); !ok || message.Level != v1.MessageLevel_INFO {
+		t.Fatalf("Next() = %v, want the message sent before the panic", message)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, ok, err := follower.Next(ctx); ok || status.Code(err) != codes.Internal {
+		t.Errorf("Next() = %t, %v once the run has panicked, want INTERNAL", ok, err)
+	}
+}
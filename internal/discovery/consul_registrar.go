@@ -0,0 +1,84 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// ConsulRegistrar is the Registrar publishing the instance as a Consul
+// service with a TTL health check.
+type ConsulRegistrar struct {
+	client      *api.Client
+	serviceName string
+	serviceID   string
+}
+
+// NewConsulRegistrar creates a new instance of ConsulRegistrar talking to the
+// Consul agent at the given address.
+func NewConsulRegistrar(addr string, token string, serviceName string, instanceAddr string) (*ConsulRegistrar, error) {
+	config := api.DefaultConfig()
+	config.Address = addr
+	config.Token = token
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &ConsulRegistrar{
+		client:      client,
+		serviceName: serviceName,
+		serviceID:   serviceName + "-" + instanceAddr,
+	}, nil
+}
+
+// checkID returns the ID of the TTL check of the service.
+func (r *ConsulRegistrar) checkID() string {
+	return "service:" + r.serviceID
+}
+
+func (r *ConsulRegistrar) Register(ctx context.Context, registration Registration, ttl time.Duration) error {
+	host, portString, err := net.SplitHostPort(registration.InstanceAddr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return err
+	}
+
+	service := &api.AgentServiceRegistration{
+		ID:      r.serviceID,
+		Name:    r.serviceName,
+		Address: host,
+		Port:    port,
+		// the dispatcher filters the instances by the language tags
+		Tags: registration.Languages,
+		Meta: map[string]string{
+			"languages":           strings.Join(registration.Languages, ","),
+			"max_concurrent_runs": strconv.Itoa(registration.MaxConcurrentRuns),
+		},
+		Check: &api.AgentServiceCheck{
+			CheckID:                        r.checkID(),
+			TTL:                            ttl.String(),
+			Status:                         api.HealthPassing,
+			DeregisterCriticalServiceAfter: (ttl * 4).String(),
+		},
+	}
+	return r.client.Agent().ServiceRegisterOpts(service, api.ServiceRegisterOpts{}.WithContext(ctx))
+}
+
+func (r *ConsulRegistrar) Refresh(ctx context.Context) error {
+	return r.client.Agent().UpdateTTLOpts(r.checkID(), "", api.HealthPassing, (&api.QueryOptions{}).WithContext(ctx))
+}
+
+func (r *ConsulRegistrar) Deregister(ctx context.Context) error {
+	return r.client.Agent().ServiceDeregisterOpts(r.serviceID, (&api.QueryOptions{}).WithContext(ctx))
+}
+
+func (r *ConsulRegistrar) Close() error {
+	return nil
+}
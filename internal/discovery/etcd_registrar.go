@@ -0,0 +1,91 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// etcdDialTimeout is the maximum duration of connecting to the etcd cluster.
+const etcdDialTimeout = 5 * time.Second
+
+// EtcdRegistrar is the Registrar publishing the instance as an etcd key bound
+// to a lease.
+type EtcdRegistrar struct {
+	client *clientv3.Client
+	key    string
+
+	mutex   sync.Mutex
+	leaseID clientv3.LeaseID // 0 until registered
+	ttl     time.Duration
+}
+
+// NewEtcdRegistrar creates a new instance of EtcdRegistrar storing the
+// registration under the prefix, keyed by the instance address.
+func NewEtcdRegistrar(endpoints []string, prefix string, instanceAddr string) (*EtcdRegistrar, error) {
+	client, err := clientv3.New(clientv3.Config{Endpoints: endpoints, DialTimeout: etcdDialTimeout})
+	if err != nil {
+		return nil, err
+	}
+	return &EtcdRegistrar{client: client, key: prefix + "/" + instanceAddr}, nil
+}
+
+func (r *EtcdRegistrar) Register(ctx context.Context, registration Registration, ttl time.Duration) error {
+	value, err := json.Marshal(registration)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// the lease is kept across the updates, a new one only replaces a lost lease
+	if r.leaseID == 0 || r.ttl != ttl {
+		lease, err := r.client.Grant(ctx, int64(ttl.Seconds()))
+		if err != nil {
+			return err
+		}
+		r.leaseID = lease.ID
+		r.ttl = ttl
+	}
+	if _, err := r.client.Put(ctx, r.key, string(value), clientv3.WithLease(r.leaseID)); err != nil {
+		r.leaseID = 0
+		return err
+	}
+	return nil
+}
+
+func (r *EtcdRegistrar) Refresh(ctx context.Context) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.leaseID == 0 {
+		return errors.New("instance is not registered")
+	}
+	if _, err := r.client.KeepAliveOnce(ctx, r.leaseID); err != nil {
+		// the key is gone with the lease, it has to be registered again
+		r.leaseID = 0
+		return err
+	}
+	return nil
+}
+
+func (r *EtcdRegistrar) Deregister(ctx context.Context) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.leaseID == 0 {
+		return nil
+	}
+	_, err := r.client.Revoke(ctx, r.leaseID)
+	r.leaseID = 0
+	return err
+}
+
+func (r *EtcdRegistrar) Close() error {
+	return r.client.Close()
+}
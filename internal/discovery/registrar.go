@@ -0,0 +1,38 @@
+package discovery
+
+import (
+	"context"
+	"slices"
+	"time"
+)
+
+// Registration describes this runner instance to the dispatcher.
+type Registration struct {
+	// InstanceAddr is the gRPC address the instance is reached at.
+	InstanceAddr string `json:"instanceAddr"`
+	// Languages are the languages currently available for runs, sorted.
+	Languages []string `json:"languages"`
+	// MaxConcurrentRuns is the global concurrency limit, 0 if unlimited.
+	MaxConcurrentRuns int `json:"maxConcurrentRuns"`
+}
+
+// Equal reports whether the registrations are the same.
+func (r Registration) Equal(other Registration) bool {
+	return r.InstanceAddr == other.InstanceAddr &&
+		slices.Equal(r.Languages, other.Languages) &&
+		r.MaxConcurrentRuns == other.MaxConcurrentRuns
+}
+
+// Registrar publishes the instance in a service discovery backend. The
+// registration expires within the TTL unless refreshed, so that the instances
+// lost with their spot capacity disappear on their own.
+type Registrar interface {
+	// Register publishes the registration for the given TTL, or replaces it.
+	Register(ctx context.Context, registration Registration, ttl time.Duration) error
+	// Refresh extends the current registration by its TTL.
+	Refresh(ctx context.Context) error
+	// Deregister removes the registration.
+	Deregister(ctx context.Context) error
+	// Close releases the connections of the backend.
+	Close() error
+}
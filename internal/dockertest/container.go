@@ -0,0 +1,341 @@
+package dockertest
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moby/moby/api/types/container"
+)
+
+// killedExitCode is the exit code of the programs killed with SIGKILL.
+const killedExitCode = 128 + 9
+
+// State is the state of a container.
+type State struct {
+	// Running reports whether the program is running.
+	Running bool
+	// Exited reports whether the program has exited.
+	Exited bool
+	// Killed reports whether the program was killed through the API.
+	Killed bool
+	// OOMKilled reports whether the program was killed for exceeding its memory limit.
+	OOMKilled bool
+	// ExitCode is the exit code of the exited program.
+	ExitCode int64
+	// Memory is the memory usage last reported by the program.
+	Memory uint64
+}
+
+// status returns the status of the container in the state, as the daemon reports it.
+func (s State) status() container.ContainerState {
+	switch {
+	case s.Running:
+		return container.StateRunning
+	case s.Exited:
+		return container.StateExited
+	}
+	return container.StateCreated
+}
+
+// attachment is an attached connection of a container.
+type attachment struct {
+	conn   net.Conn
+	stdout bool
+	stderr bool
+}
+
+// outputEntry is a write of the output of the program.
+type outputEntry struct {
+	stream byte
+	data   []byte
+	at     time.Time
+}
+
+// Container is a container of the fake daemon.
+type Container struct {
+	// ID is the ID of the container.
+	ID string
+	// Config is the configuration the container was created with.
+	Config *container.Config
+	// HostConfig is the host configuration the container was created with.
+	HostConfig *container.HostConfig
+
+	index   int
+	created time.Time
+	stdin   *io.PipeReader
+	stdinW  *io.PipeWriter
+	killed  chan struct{}
+	exited  chan struct{}
+	started time.Time
+
+	mutex       sync.Mutex
+	files       map[string][]byte
+	attachments []*attachment
+	output      []outputEntry
+	current     State
+	oomKilled   bool // whether a process of the container was killed for its memory
+	stdinOnce   sync.Once
+	killOnce    sync.Once
+}
+
+// newContainer creates the container of the configuration, with the files of
+// the images.
+func newContainer(index int, config *container.Config, hostConfig *container.HostConfig) *Container {
+	stdin, stdinW := io.Pipe()
+	return &Container{
+		ID:         hashOf(fmt.Sprintf("container-%d", index)),
+		Config:     config,
+		HostConfig: hostConfig,
+		index:      index,
+		created:    time.Now(),
+		stdin:      stdin,
+		stdinW:     stdinW,
+		killed:     make(chan struct{}),
+		exited:     make(chan struct{}),
+		files:      map[string][]byte{"/etc/passwd": []byte(Passwd)},
+	}
+}
+
+// Files returns the files of the container by their absolute paths.
+func (c *Container) Files() map[string][]byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return maps.Clone(c.files)
+}
+
+// State returns the current state of the container.
+func (c *Container) State() State {
+	return c.state()
+}
+
+func (c *Container) state() State {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.current
+}
+
+func (c *Container) writeFile(name string, content []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.files[name] = content
+}
+
+// archive returns the archive of the file or the directory at the path, rooted
+// at its base name, as the daemon copies it out.
+func (c *Container) archive(source string) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var buffer bytes.Buffer
+	writer := tar.NewWriter(&buffer)
+	found := false
+	for _, name := range slices.Sorted(maps.Keys(c.files)) {
+		relative, ok := strings.CutPrefix(name, source)
+		if !ok || (relative != "" && !strings.HasPrefix(relative, "/")) {
+			continue
+		}
+		found = true
+		content := c.files[name]
+		_ = writer.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     path.Base(source) + relative,
+			Mode:     0o644,
+			Size:     int64(len(content)),
+		})
+		_, _ = writer.Write(content)
+	}
+	_ = writer.Close()
+	return buffer.Bytes(), found
+}
+
+// attach adds the connection to the outputs of the container, first replaying
+// the output so far if asked to.
+func (c *Container) attach(attach *attachment, logs bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if logs {
+		for _, entry := range c.output {
+			attach.write(entry.stream, entry.data)
+		}
+	}
+	if c.current.Exited {
+		_ = attach.conn.Close()
+		return
+	}
+	c.attachments = append(c.attachments, attach)
+}
+
+// write writes the data of the stream to the connection, if it's attached to it.
+func (a *attachment) write(stream byte, data []byte) {
+	if (stream == stdoutStream && a.stdout) || (stream == stderrStream && a.stderr) {
+		_, _ = a.conn.Write(frame(stream, data))
+	}
+}
+
+// readStdin copies the input of an attached connection into the stdin of the
+// program, ending it once the connection is closed for writing, as a single
+// stdin is closed by the daemon once its first attach ends.
+func (c *Container) readStdin(reader io.Reader) {
+	_, err := io.Copy(c.stdinW, reader)
+	if err != nil {
+		return // the program is gone, or the connection reset
+	}
+	c.stdinOnce.Do(func() { _ = c.stdinW.Close() })
+}
+
+// start runs the program in the background, unless it's started already.
+func (c *Container) start(program Program) bool {
+	c.mutex.Lock()
+	if c.current.Running || c.current.Exited {
+		c.mutex.Unlock()
+		return false
+	}
+	c.current.Running = true
+	c.started = time.Now()
+	c.mutex.Unlock()
+
+	process := &Process{Container: c, Stdin: c.stdin, Killed: c.killed}
+	go func() {
+		exit := program(process)
+		c.exit(exit, false)
+	}()
+	return true
+}
+
+// kill kills the running program, reporting whether it was running.
+func (c *Container) kill() bool {
+	if !c.state().Running {
+		return false
+	}
+	c.killOnce.Do(func() { close(c.killed) })
+	return c.exit(Exit{Code: killedExitCode}, true)
+}
+
+// exit records the exit of the program, unless it has exited already, ending
+// the attached connections and releasing the waits.
+func (c *Container) exit(exit Exit, killed bool) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.current.Exited || !c.current.Running {
+		return false
+	}
+	c.current.Running = false
+	c.current.Exited = true
+	c.current.Killed = killed
+	c.current.OOMKilled = exit.OOMKilled || c.oomKilled
+	c.current.ExitCode = exit.Code
+	for _, attach := range c.attachments {
+		_ = attach.conn.Close()
+	}
+	c.attachments = nil
+	_ = c.stdin.Close()
+	close(c.exited)
+	return true
+}
+
+// writeOutput writes the data to the stream of the output of the program.
+func (c *Container) writeOutput(stream byte, data []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.current.Running {
+		return // the output of the killed programs is lost
+	}
+	c.output = append(c.output, outputEntry{stream: stream, data: data, at: time.Now()})
+	attachments := slices.Clone(c.attachments)
+	c.mutex.Unlock()
+	// the writes block while the client doesn't read, holding the program but not the container
+	for _, attach := range attachments {
+		attach.write(stream, data)
+	}
+	c.mutex.Lock()
+}
+
+// history returns the output of the program written before the given time,
+// all of it if zero.
+func (c *Container) history(until time.Time) []outputEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var entries []outputEntry
+	for _, entry := range c.output {
+		if until.IsZero() || !entry.at.After(until) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// cpuStats returns the CPU statistics of the container, its CPU time being
+// the time it has run.
+func (c *Container) cpuStats() container.CPUStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var usage uint64
+	if !c.started.IsZero() {
+		usage = uint64(time.Since(c.started))
+	}
+	return container.CPUStats{
+		CPUUsage:    container.CPUUsage{TotalUsage: usage},
+		SystemUsage: uint64(time.Now().UnixNano()),
+		OnlineCPUs:  1,
+	}
+}
+
+// Process is the program running in a container.
+type Process struct {
+	// Container is the container of the program.
+	Container *Container
+	// Stdin is the standard input of the program, ending once it's closed by
+	// the client or the program has exited.
+	Stdin io.Reader
+	// Killed is closed once the program is killed through the API.
+	Killed <-chan struct{}
+}
+
+// Stdout writes the line to the stdout of the program.
+func (p *Process) Stdout(line string) {
+	p.Container.writeOutput(stdoutStream, []byte(line+"\n"))
+}
+
+// Stderr writes the line to the stderr of the program.
+func (p *Process) Stderr(line string) {
+	p.Container.writeOutput(stderrStream, []byte(line+"\n"))
+}
+
+// SetMemory sets the memory usage the statistics of the container report.
+func (p *Process) SetMemory(bytes uint64) {
+	p.Container.mutex.Lock()
+	defer p.Container.mutex.Unlock()
+	p.Container.current.Memory = bytes
+}
+
+// OOMKill records a process of the container killed by the kernel for
+// exceeding the memory limit, as the daemon reports of the container once it
+// has exited, whatever has ended it.
+func (p *Process) OOMKill() {
+	p.Container.mutex.Lock()
+	defer p.Container.mutex.Unlock()
+	p.Container.oomKilled = true
+}
+
+// File returns the content of the file at the absolute path in the container.
+func (p *Process) File(name string) ([]byte, bool) {
+	p.Container.mutex.Lock()
+	defer p.Container.mutex.Unlock()
+	content, ok := p.Container.files[name]
+	return content, ok
+}
+
+// Sleep blocks until the program is killed, returning how it has exited.
+func (p *Process) Sleep() Exit {
+	<-p.Killed
+	return Exit{Code: killedExitCode}
+}
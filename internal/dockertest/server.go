@@ -0,0 +1,905 @@
+// Package dockertest provides a fake Docker daemon for the tests, serving the
+// part of the Engine API the runner uses over a real HTTP connection, so that
+// the services are tested with the Docker client they run with. The programs
+// of the containers are Go functions, and every call can be made to fail.
+package dockertest
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moby/moby/api/types/common"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/api/types/events"
+	"github.com/moby/moby/api/types/image"
+	"github.com/moby/moby/api/types/network"
+	"github.com/moby/moby/api/types/system"
+	"github.com/moby/moby/client"
+)
+
+// Operations of the API the failures can be injected into with Fail.
+const (
+	OperationPing    = "ping"
+	OperationList    = "list"
+	OperationCreate  = "create"
+	OperationCopy    = "copy" // the copy of an archive into a container
+	OperationExtract = "extract"
+	OperationAttach  = "attach"
+	OperationStart   = "start"
+	OperationWait    = "wait"
+	OperationStats   = "stats"
+	OperationInspect = "inspect"
+	OperationLogs    = "logs"
+	OperationKill    = "kill"
+	OperationRemove  = "remove"
+	OperationPrune   = "prune" // the prune of the dangling images
+)
+
+// Passwd is the /etc/passwd of the images, with the runner user of the technologies.
+const Passwd = "root:x:0:0:root:/root:/bin/sh\nrunner:x:1000:1000::/home/runner:/bin/sh\n"
+
+// socketBuffer is the size of the buffers of the connections to the daemon,
+// about those of its unix socket, so that the writes nobody reads block as
+// early as on a real host instead of filling the autotuned TCP buffers.
+const socketBuffer = 64 << 10
+
+// statsInterval is the interval of the statistics of the running containers.
+const statsInterval = 50 * time.Millisecond
+
+// Exit is how the program of a container has exited.
+type Exit struct {
+	// Code is the exit code of the program.
+	Code int64
+	// OOMKilled marks the program killed by the kernel for exceeding its memory limit.
+	OOMKilled bool
+}
+
+// Program is the program a container executes once started, writing its
+// output through the process until it returns how it has exited. The program
+// killed through the API gets the exit code 137, whatever it returns.
+type Program func(process *Process) Exit
+
+// failure is an error injected into an operation.
+type failure struct {
+	statusCode int
+	message    string
+}
+
+// hold makes the calls of an operation wait.
+type hold struct {
+	reached  chan struct{} // closed once a call waits
+	released chan struct{}
+	once     sync.Once
+}
+
+// Server is the fake Docker daemon.
+type Server struct {
+	httpServer *httptest.Server
+	closed     chan struct{}
+	closeOnce  sync.Once
+
+	mutex      sync.Mutex
+	info       system.Info
+	images     map[string]string // reference = digest reference
+	digests    map[string]bool   // of every image added, kept when its tag moves
+	containers map[string]*Container
+	networks   map[string]network.Inspect // name = network
+	archives   map[string][]byte          // container path = archive served verbatim
+	failures   map[string]failure
+	holds      map[string]*hold
+	dropped    chan struct{} // closed once the pending waits are cut
+	program    Program
+	created    int
+	prunes     int
+	events     map[chan events.Message]struct{} // of the open event streams
+}
+
+// NewServer starts a new fake Docker daemon, which must be closed. Its
+// containers exit with 0 without printing anything, until SetProgram.
+func NewServer() *Server {
+	s := &Server{
+		closed:  make(chan struct{}),
+		dropped: make(chan struct{}),
+		info: system.Info{
+			ServerVersion: "28.0.0-fake",
+			Driver:        "overlay2",
+			DockerRootDir: "/var/lib/docker",
+			NCPU:          4,
+			MemTotal:      8 << 30,
+			CgroupDriver:  "systemd",
+			CgroupVersion: "2",
+		},
+		images:     make(map[string]string),
+		digests:    make(map[string]bool),
+		containers: make(map[string]*Container),
+		networks:   make(map[string]network.Inspect),
+		archives:   make(map[string][]byte),
+		failures:   make(map[string]failure),
+		holds:      make(map[string]*hold),
+		events:     make(map[chan events.Message]struct{}),
+		program:    func(*Process) Exit { return Exit{} },
+	}
+	s.httpServer = httptest.NewUnstartedServer(http.HandlerFunc(s.serveHTTP))
+	s.httpServer.Listener = bufferedListener{s.httpServer.Listener}
+	s.httpServer.Start()
+	return s
+}
+
+// Close stops the daemon, ending the streams still open. Closing it again
+// does nothing.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.httpServer.CloseClientConnections()
+		s.httpServer.Close()
+	})
+}
+
+// Host returns the address of the daemon, as DOCKER_HOST takes it.
+func (s *Server) Host() string {
+	return "tcp://" + s.httpServer.Listener.Addr().String()
+}
+
+// Client returns a new Docker client of the daemon.
+func (s *Server) Client(options ...client.Opt) (*client.Client, error) {
+	return client.New(append([]client.Opt{client.WithHost(s.Host()), client.WithDialContext(dial)}, options...)...)
+}
+
+// bufferedListener accepts the connections with the buffers of socketBuffer.
+type bufferedListener struct {
+	net.Listener
+}
+
+func (l bufferedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return bufferConn(conn)
+}
+
+// dial connects to the daemon with the buffers of socketBuffer.
+func dial(ctx context.Context, network string, address string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return bufferConn(conn)
+}
+
+// bufferConn bounds the buffers of the TCP connection to socketBuffer.
+func bufferConn(conn net.Conn) (net.Conn, error) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if err := errors.Join(tcpConn.SetReadBuffer(socketBuffer), tcpConn.SetWriteBuffer(socketBuffer)); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// halfOpenConn hides the CloseWrite of the connection it wraps.
+type halfOpenConn struct {
+	net.Conn
+}
+
+// WithoutHalfClose makes the connections of the client impossible to
+// half-close, as the TLS-wrapped ones of the remote daemons are.
+func WithoutHalfClose() client.Opt {
+	return client.WithDialContext(func(ctx context.Context, network string, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		return halfOpenConn{conn}, nil
+	})
+}
+
+// SetInfo replaces the system information the daemon reports.
+func (s *Server) SetInfo(info system.Info) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.info = info
+}
+
+// AddImage adds the image with the given reference, e.g. "codecell/perl",
+// pulled with the given digest reference, empty if it was built locally.
+// Adding another digest under the same reference moves the tag, the image
+// of the previous digest stays available by its digest reference.
+func (s *Server) AddImage(reference string, digest string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.images[reference] = digest
+	if digest != "" {
+		s.digests[digest] = true
+	}
+}
+
+// PublishEvent sends the event to the event streams open at the time, as the
+// daemon reports e.g. an image pulled. The filters of the streams aren't
+// applied.
+func (s *Server) PublishEvent(message events.Message) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for stream := range s.events {
+		stream <- message
+	}
+}
+
+// EventStreams returns the number of event streams open.
+func (s *Server) EventStreams() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.events)
+}
+
+// Prunes returns the number of prunes of the dangling images.
+func (s *Server) Prunes() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.prunes
+}
+
+// AddNetwork adds the network, e.g. one left by a previous start of the runner.
+func (s *Server) AddNetwork(inspect network.Inspect) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.networks[inspect.Name] = inspect
+}
+
+// Network returns the network of the name, if it exists.
+func (s *Server) Network(name string) (network.Inspect, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	inspect, ok := s.networks[name]
+	return inspect, ok
+}
+
+// SetProgram sets the program of the containers started from now on.
+func (s *Server) SetProgram(program Program) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.program = program
+}
+
+// ServeArchive makes the copies out of the path of every container return the
+// given archive as it is, for the tests of crafted archives.
+func (s *Server) ServeArchive(containerPath string, archive []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.archives[containerPath] = archive
+}
+
+// Fail makes every call of the operation fail from now on with the given HTTP
+// status and message, as the daemon reports its errors.
+func (s *Server) Fail(operation string, statusCode int, message string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failures[operation] = failure{statusCode: statusCode, message: message}
+}
+
+// Restore makes the calls of the operation succeed again, undoing Fail.
+func (s *Server) Restore(operation string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.failures, operation)
+}
+
+// Hold makes every call of the operation wait from now on until released, or
+// until the daemon is closed. It returns the channel closed once the first
+// call waits, and the function releasing them all, e.g. so that the test acts
+// while the runner waits on the daemon.
+func (s *Server) Hold(operation string) (<-chan struct{}, func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	held := &hold{reached: make(chan struct{}), released: make(chan struct{})}
+	s.holds[operation] = held
+	var releaseOnce sync.Once
+	return held.reached, func() {
+		releaseOnce.Do(func() {
+			s.mutex.Lock()
+			delete(s.holds, operation)
+			s.mutex.Unlock()
+			close(held.released)
+		})
+	}
+}
+
+// DropWaits cuts the connections of the pending waits, as a restart of the
+// daemon does, leaving their containers running.
+func (s *Server) DropWaits() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	close(s.dropped)
+	s.dropped = make(chan struct{})
+}
+
+// Containers returns the containers that haven't been removed, in the order
+// of their creation.
+func (s *Server) Containers() []*Container {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	containers := make([]*Container, 0, len(s.containers))
+	for _, c := range s.containers {
+		containers = append(containers, c)
+	}
+	slices.SortFunc(containers, func(a, b *Container) int { return a.index - b.index })
+	return containers
+}
+
+// writeError writes the error in the format of the daemon.
+func writeError(w http.ResponseWriter, statusCode int, format string, args ...any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(common.ErrorResponse{Message: fmt.Sprintf(format, args...)})
+}
+
+// writeJSON writes the value as the JSON response.
+func writeJSON(w http.ResponseWriter, statusCode int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+// failed writes the error injected into the operation, if any, once the call
+// is released if the operation is held.
+func (s *Server) failed(w http.ResponseWriter, operation string) bool {
+	s.mutex.Lock()
+	held := s.holds[operation]
+	s.mutex.Unlock()
+	if held != nil {
+		held.once.Do(func() { close(held.reached) })
+		select {
+		case <-held.released:
+		case <-s.closed:
+		}
+	}
+
+	s.mutex.Lock()
+	injected, ok := s.failures[operation]
+	s.mutex.Unlock()
+	if ok {
+		writeError(w, injected.statusCode, "%s", injected.message)
+	}
+	return ok
+}
+
+// container returns the container of the ID, writing the error of the daemon
+// if it doesn't exist.
+func (s *Server) container(w http.ResponseWriter, id string) (*Container, bool) {
+	s.mutex.Lock()
+	c, ok := s.containers[id]
+	s.mutex.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "No such container: %s", id)
+	}
+	return c, ok
+}
+
+// serveHTTP routes the calls of the API, with or without the version prefix.
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	route := r.URL.Path
+	if rest, ok := strings.CutPrefix(route, "/v"); ok {
+		if _, unversioned, ok := strings.Cut(rest, "/"); ok {
+			route = "/" + unversioned
+		}
+	}
+
+	switch {
+	case route == "/_ping":
+		if s.failed(w, OperationPing) {
+			return
+		}
+		w.Header().Set("Api-Version", client.MaxAPIVersion)
+		_, _ = io.WriteString(w, "OK")
+	case route == "/info":
+		s.mutex.Lock()
+		info := s.info
+		s.mutex.Unlock()
+		writeJSON(w, http.StatusOK, info)
+	case route == "/events":
+		s.streamEvents(w, r)
+	case route == "/images/prune" && r.Method == http.MethodPost:
+		s.pruneImages(w)
+	case strings.HasPrefix(route, "/images/") && strings.HasSuffix(route, "/json"):
+		s.inspectImage(w, strings.TrimSuffix(strings.TrimPrefix(route, "/images/"), "/json"))
+	case route == "/networks/create" && r.Method == http.MethodPost:
+		s.createNetwork(w, r)
+	case strings.HasPrefix(route, "/networks/") && r.Method == http.MethodGet:
+		s.inspectNetwork(w, strings.TrimPrefix(route, "/networks/"))
+	case route == "/containers/json":
+		s.listContainers(w, r)
+	case route == "/containers/create" && r.Method == http.MethodPost:
+		s.createContainer(w, r)
+	case strings.HasPrefix(route, "/containers/"):
+		id, action, _ := strings.Cut(strings.TrimPrefix(route, "/containers/"), "/")
+		s.serveContainer(w, r, id, action)
+	default:
+		writeError(w, http.StatusNotFound, "page not found")
+	}
+}
+
+// serveContainer routes the calls of the API on the container.
+func (s *Server) serveContainer(w http.ResponseWriter, r *http.Request, id string, action string) {
+	switch {
+	case action == "" && r.Method == http.MethodDelete:
+		s.removeContainer(w, id)
+	case action == "archive" && r.Method == http.MethodPut:
+		s.copyToContainer(w, r, id)
+	case action == "archive" && r.Method == http.MethodGet:
+		s.copyFromContainer(w, r, id)
+	case action == "attach":
+		s.attachContainer(w, r, id)
+	case action == "start":
+		s.startContainer(w, id)
+	case action == "wait":
+		s.waitContainer(w, r, id)
+	case action == "stats":
+		s.streamStats(w, r, id)
+	case action == "json":
+		s.inspectContainer(w, id)
+	case action == "logs":
+		s.readLogs(w, r, id)
+	case action == "kill":
+		s.killContainer(w, id)
+	default:
+		writeError(w, http.StatusNotFound, "page not found")
+	}
+}
+
+// streamEvents writes the events published while the stream is open, nothing
+// happening on the fake daemon but for the calls of the tests.
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request) {
+	stream := make(chan events.Message, 16)
+	s.mutex.Lock()
+	s.events[stream] = struct{}{}
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.events, stream)
+		s.mutex.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case message := <-stream:
+			if encoder.Encode(message) != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		case <-r.Context().Done():
+			return
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func (s *Server) inspectImage(w http.ResponseWriter, reference string) {
+	s.mutex.Lock()
+	digest, ok := s.images[reference]
+	s.mutex.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "No such image: %s", reference)
+		return
+	}
+	inspect := image.InspectResponse{ID: "sha256:" + hashOf(reference), RepoTags: []string{reference}}
+	if digest != "" {
+		inspect.RepoDigests = []string{digest}
+	}
+	writeJSON(w, http.StatusOK, inspect)
+}
+
+// pruneImages counts the prune, the fake daemon keeps no dangling images.
+func (s *Server) pruneImages(w http.ResponseWriter) {
+	if s.failed(w, OperationPrune) {
+		return
+	}
+	s.mutex.Lock()
+	s.prunes++
+	s.mutex.Unlock()
+	writeJSON(w, http.StatusOK, image.PruneReport{})
+}
+
+// hasImage reports whether the image of the reference, or of the digest
+// reference, has been added. The caller holds the mutex.
+func (s *Server) hasImage(reference string) bool {
+	_, ok := s.images[reference]
+	return ok || s.digests[reference]
+}
+
+func (s *Server) createNetwork(w http.ResponseWriter, r *http.Request) {
+	var request network.CreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid network create request: %s", err)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.networks[request.Name]; ok {
+		writeError(w, http.StatusConflict, "network with name %s already exists", request.Name)
+		return
+	}
+	inspect := network.Inspect{Network: network.Network{
+		Name:     request.Name,
+		ID:       hashOf("network-" + request.Name),
+		Driver:   request.Driver,
+		Internal: request.Internal,
+		// without the setting, the default of the daemon, taken as no IPv6
+		EnableIPv6: request.EnableIPv6 != nil && *request.EnableIPv6,
+		Options:    request.Options,
+		Labels:     request.Labels,
+	}}
+	s.networks[request.Name] = inspect
+	writeJSON(w, http.StatusCreated, network.CreateResponse{ID: inspect.ID})
+}
+
+func (s *Server) inspectNetwork(w http.ResponseWriter, name string) {
+	inspect, ok := s.Network(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, "network %s not found", name)
+		return
+	}
+	writeJSON(w, http.StatusOK, inspect)
+}
+
+// listContainers lists the containers of the label filters, all of them
+// whatever their state, as the runner lists them.
+func (s *Server) listContainers(w http.ResponseWriter, r *http.Request) {
+	if s.failed(w, OperationList) {
+		return
+	}
+	var filters map[string]map[string]bool
+	if encoded := r.URL.Query().Get("filters"); encoded != "" {
+		if err := json.Unmarshal([]byte(encoded), &filters); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid filters: %s", err)
+			return
+		}
+	}
+
+	summaries := []container.Summary{}
+	for _, c := range s.Containers() {
+		matches := true
+		for label := range filters["label"] {
+			key, value, hasValue := strings.Cut(label, "=")
+			actual, ok := c.Config.Labels[key]
+			matches = matches && ok && (!hasValue || actual == value)
+		}
+		if !matches {
+			continue
+		}
+		summaries = append(summaries, container.Summary{
+			ID:      c.ID,
+			Image:   c.Config.Image,
+			Labels:  c.Config.Labels,
+			Created: c.created.Unix(),
+			State:   c.state().status(),
+		})
+	}
+	writeJSON(w, http.StatusOK, summaries)
+}
+
+func (s *Server) createContainer(w http.ResponseWriter, r *http.Request) {
+	if s.failed(w, OperationCreate) {
+		return
+	}
+	var request container.CreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid create request: %s", err)
+		return
+	}
+	if request.Config == nil {
+		request.Config = &container.Config{}
+	}
+	if request.HostConfig == nil {
+		request.HostConfig = &container.HostConfig{}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.hasImage(request.Image) {
+		writeError(w, http.StatusNotFound, "No such image: %s", request.Image)
+		return
+	}
+	s.created++
+	c := newContainer(s.created, request.Config, request.HostConfig)
+	s.containers[c.ID] = c
+	writeJSON(w, http.StatusCreated, container.CreateResponse{ID: c.ID, Warnings: []string{}})
+}
+
+func (s *Server) removeContainer(w http.ResponseWriter, id string) {
+	if s.failed(w, OperationRemove) {
+		return
+	}
+	c, ok := s.container(w, id)
+	if !ok {
+		return
+	}
+	c.kill() // the removal is always forced by the runner
+	s.mutex.Lock()
+	delete(s.containers, id)
+	s.mutex.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) copyToContainer(w http.ResponseWriter, r *http.Request, id string) {
+	if s.failed(w, OperationCopy) {
+		return
+	}
+	c, ok := s.container(w, id)
+	if !ok {
+		return
+	}
+	destination := r.URL.Query().Get("path")
+	reader := tar.NewReader(r.Body)
+	for {
+		hdr, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid archive: %s", err)
+			return
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		content, err := io.ReadAll(reader)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid archive: %s", err)
+			return
+		}
+		c.writeFile(path.Join(destination, hdr.Name), content)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) copyFromContainer(w http.ResponseWriter, r *http.Request, id string) {
+	if s.failed(w, OperationExtract) {
+		return
+	}
+	c, ok := s.container(w, id)
+	if !ok {
+		return
+	}
+	source := path.Clean(r.URL.Query().Get("path"))
+	s.mutex.Lock()
+	archive, crafted := s.archives[source]
+	s.mutex.Unlock()
+	if !crafted {
+		var found bool
+		if archive, found = c.archive(source); !found {
+			writeError(w, http.StatusNotFound, "Could not find the file %s in container %s", source, id)
+			return
+		}
+	}
+
+	stat, _ := json.Marshal(container.PathStat{Name: path.Base(source), Size: int64(len(archive))})
+	w.Header().Set("X-Docker-Container-Path-Stat", base64.StdEncoding.EncodeToString(stat))
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(archive)
+}
+
+// attachContainer upgrades the connection into the raw stream of the
+// container, multiplexing its output and reading its input.
+func (s *Server) attachContainer(w http.ResponseWriter, r *http.Request, id string) {
+	if s.failed(w, OperationAttach) {
+		return
+	}
+	c, ok := s.container(w, id)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	conn, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to hijack the connection: %s", err)
+		return
+	}
+	_, _ = io.WriteString(conn, "HTTP/1.1 101 UPGRADED\r\n"+
+		"Content-Type: application/vnd.docker.multiplexed-stream\r\n"+
+		"Connection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+
+	attach := &attachment{
+		conn:   conn,
+		stdout: query.Get("stdout") == "1",
+		stderr: query.Get("stderr") == "1",
+	}
+	c.attach(attach, query.Get("logs") == "1")
+	if query.Get("stdin") == "1" {
+		go c.readStdin(buffered)
+	}
+}
+
+func (s *Server) startContainer(w http.ResponseWriter, id string) {
+	if s.failed(w, OperationStart) {
+		return
+	}
+	c, ok := s.container(w, id)
+	if !ok {
+		return
+	}
+	s.mutex.Lock()
+	program := s.program
+	s.mutex.Unlock()
+	if !c.start(program) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// waitContainer answers right away, as the daemon does, and delivers the
+// status once the container has exited.
+func (s *Server) waitContainer(w http.ResponseWriter, r *http.Request, id string) {
+	// the wait is cut by the drops from its call on, even while it's held
+	s.mutex.Lock()
+	dropped := s.dropped
+	s.mutex.Unlock()
+	if s.failed(w, OperationWait) {
+		return
+	}
+	c, ok := s.container(w, id)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	select {
+	case <-c.exited:
+		_ = json.NewEncoder(w).Encode(container.WaitResponse{StatusCode: c.state().ExitCode})
+	case <-dropped:
+		panic(http.ErrAbortHandler) // the connection is closed without ending the response
+	case <-r.Context().Done():
+	case <-s.closed:
+	}
+}
+
+// streamStats streams the statistics of the container until the client goes
+// away, as the daemon keeps the stream open past the exit.
+func (s *Server) streamStats(w http.ResponseWriter, r *http.Request, id string) {
+	if s.failed(w, OperationStats) {
+		return
+	}
+	c, ok := s.container(w, id)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	var previous container.CPUStats
+	for {
+		current := c.cpuStats()
+		_ = encoder.Encode(container.StatsResponse{
+			ID:          c.ID,
+			Read:        time.Now(),
+			CPUStats:    current,
+			PreCPUStats: previous,
+			MemoryStats: container.MemoryStats{Usage: c.state().Memory},
+		})
+		w.(http.Flusher).Flush()
+		previous = current
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			return
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func (s *Server) inspectContainer(w http.ResponseWriter, id string) {
+	if s.failed(w, OperationInspect) {
+		return
+	}
+	c, ok := s.container(w, id)
+	if !ok {
+		return
+	}
+	state := c.state()
+	writeJSON(w, http.StatusOK, container.InspectResponse{
+		ID:    c.ID,
+		Image: c.Config.Image,
+		State: &container.State{
+			Status:    state.status(),
+			Running:   state.Running,
+			OOMKilled: state.OOMKilled,
+			ExitCode:  int(state.ExitCode),
+		},
+		Config: c.Config,
+	})
+}
+
+// readLogs writes the output history of the container, until the given time
+// if any, without following it.
+func (s *Server) readLogs(w http.ResponseWriter, r *http.Request, id string) {
+	if s.failed(w, OperationLogs) {
+		return
+	}
+	c, ok := s.container(w, id)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	var until time.Time
+	if value := query.Get("until"); value != "" {
+		var err error
+		if until, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid until: %s", err)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/vnd.docker.multiplexed-stream")
+	w.WriteHeader(http.StatusOK)
+	for _, entry := range c.history(until) {
+		if (entry.stream == stdoutStream && query.Get("stdout") == "1") ||
+			(entry.stream == stderrStream && query.Get("stderr") == "1") {
+			_, _ = w.Write(frame(entry.stream, entry.data))
+		}
+	}
+}
+
+func (s *Server) killContainer(w http.ResponseWriter, id string) {
+	if s.failed(w, OperationKill) {
+		return
+	}
+	c, ok := s.container(w, id)
+	if !ok {
+		return
+	}
+	if !c.kill() {
+		writeError(w, http.StatusConflict, "Cannot kill container: %s: container %s is not running", id, id)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Stream identifiers of the multiplexed stream.
+const (
+	stdoutStream byte = 1
+	stderrStream byte = 2
+)
+
+// frame returns the frame of the multiplexed stream carrying the data.
+func frame(stream byte, data []byte) []byte {
+	var buffer bytes.Buffer
+	header := [8]byte{stream}
+	binary.BigEndian.PutUint32(header[4:], uint32(len(data)))
+	buffer.Write(header[:])
+	buffer.Write(data)
+	return buffer.Bytes()
+}
+
+// hashOf returns the hex-encoded SHA-256 of the value, for the fake IDs.
+func hashOf(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,39 @@
+//go:build conformance
+
+package executor_test
+
+import (
+	"context"
+	"testing"
+
+	v1 "github.com/Pelfox/codecell-runner/generated"
+	"github.com/Pelfox/codecell-runner/internal/runnertest"
+)
+
+// TestImagesConform runs the probes of every technology in its real image, on
+// the Docker daemon of the environment, e.g. once built by images/build.sh:
+//
+//	go test -tags conformance -run TestImagesConform ./internal/executor/
+//
+// The languages whose image is missing or unusable on the daemon are skipped.
+func TestImagesConform(t *testing.T) {
+	runner := runnertest.NewDocker(t, nil)
+	for _, language := range runner.Languages.Languages() {
+		t.Run(language, func(t *testing.T) {
+			if err := runner.Languages.Availability(language); err != nil {
+				t.Skipf("the image isn't usable: %v", err)
+			}
+			technology, _ := runner.Languages.Technology(language)
+			for _, probe := range technology.GetProbes() {
+				t.Run(probe.Name, func(t *testing.T) {
+					stream, err := runner.Run(context.Background(),
+						&v1.RunRequest{Language: language, SourceCode: probe.SourceCode})
+					if err != nil {
+						t.Fatalf("Run() = %v", err)
+					}
+					checkRun(t, stream, probe)
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package executor_test
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+
+	v1 "github.com/Pelfox/codecell-runner/generated"
+	"github.com/Pelfox/codecell-runner/internal"
+	"github.com/Pelfox/codecell-runner/internal/dockertest"
+	"github.com/Pelfox/codecell-runner/internal/executor"
+	"github.com/Pelfox/codecell-runner/internal/runnertest"
+	"github.com/Pelfox/codecell-runner/pkg"
+)
+
+// compilerWarning is a line the programs print on stderr before the output of
+// the probes, as the compilers and the runtimes do, which the probes allow.
+const compilerWarning = "warning: unused variable"
+
+// probeProgram returns the program of the fake daemon standing in for the
+// technologies by their images. It runs the containers of the command of the
+// technology only, whose workspace holds exactly the files the technology
+// writes for one of its probes, printing the ready line, if any, then the
+// output of that probe, and exiting with its code. The fake checks the
+// containers the runner creates for the technology, and the test the streams
+// and the exit code the runner relays; the programs themselves are run by the
+// real images, see conformance_docker_test.go.
+func probeProgram(t *testing.T, technologies map[string]executor.Technology) dockertest.Program {
+	return func(process *dockertest.Process) dockertest.Exit {
+		technology, ok := technologies[process.Container.Config.Image]
+		if !ok {
+			process.Stderr(fmt.Sprintf("no technology of the image %q", process.Container.Config.Image))
+			return dockertest.Exit{Code: 125}
+		}
+		if command := process.Container.Config.Cmd; !slices.Equal(command, technology.GetCommand()) ||
+			process.Container.Config.WorkingDir != "/workspace" {
+			process.Stderr(fmt.Sprintf("unexpected command %q in %q", command, process.Container.Config.WorkingDir))
+			return dockertest.Exit{Code: 127}
+		}
+
+		workspace := make(map[string]string)
+		for name, content := range process.Container.Files() {
+			if relative, ok := strings.CutPrefix(name, "/workspace/"); ok {
+				workspace[relative] = string(content)
+			}
+		}
+		var probe *executor.Probe
+		for _, candidate := range technology.GetProbes() {
+			if maps.Equal(workspace, sourceFiles(t, technology, candidate.SourceCode)) {
+				probe = &candidate
+			}
+		}
+		if probe == nil {
+			process.Stderr(fmt.Sprintf("the workspace %q holds no probe", slices.Sorted(maps.Keys(workspace))))
+			return dockertest.Exit{Code: 1}
+		}
+
+		if readyLine := technology.GetReadyLine(); readyLine != "" {
+			process.Stdout(readyLine)
+		}
+		process.Stderr(compilerWarning)
+		if probe.Stdout != "" {
+			process.Stdout(probe.Stdout)
+		}
+		if probe.Stderr != "" {
+			process.Stderr(probe.Stderr)
+		}
+		return dockertest.Exit{Code: probe.ExitCode}
+	}
+}
+
+// sourceFiles returns the contents of the files the technology writes for the
+// source code, by their workspace paths.
+func sourceFiles(t *testing.T, technology executor.Technology, sourceCode string) map[string]string {
+	t.Helper()
+	archive, err := technology.WriteSourceCode(sourceCode, pkg.FileOwner{})
+	if err != nil {
+		t.Errorf("WriteSourceCode() = %v", err)
+		return nil
+	}
+	defer archive.Close()
+
+	files := make(map[string]string)
+	reader := tar.NewReader(archive)
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return files
+		} else if err != nil {
+			t.Errorf("the archive of the source code is invalid: %v", err)
+			return nil
+		}
+		if header.Typeflag == tar.TypeReg {
+			content, err := io.ReadAll(reader)
+			if err != nil {
+				t.Errorf("the archive of the source code is invalid: %v", err)
+				return nil
+			}
+			files[path.Clean(header.Name)] = string(content)
+		}
+	}
+}
+
+// checkProbes checks that the probes of the technology are the ones of
+// NewProbes, each program printing and exiting the way its probe expects.
+func checkProbes(t *testing.T, probes []executor.Probe) {
+	t.Helper()
+	if len(probes) == 0 {
+		t.Fatal("the technology has no probes")
+	}
+	names := make(map[string]bool)
+	sources := make(map[string]bool)
+	exitCodes := make(map[int64]bool)
+	for _, probe := range probes {
+		switch {
+		case probe.Name == "" || names[probe.Name]:
+			t.Errorf("the probe name %q is empty or not distinct", probe.Name)
+		case probe.SourceCode == "" || sources[probe.SourceCode]:
+			t.Errorf("the source code of the %q probe is empty or not distinct", probe.Name)
+		case probe.Stdout != "" && !strings.Contains(probe.SourceCode, probe.Stdout):
+			t.Errorf("the source code of the %q probe doesn't print %q", probe.Name, probe.Stdout)
+		case probe.Stderr != "" && !strings.Contains(probe.SourceCode, probe.Stderr):
+			t.Errorf("the source code of the %q probe doesn't print %q on stderr", probe.Name, probe.Stderr)
+		case probe.ExitCode == executor.ProbeExitCode &&
+			!strings.Contains(probe.SourceCode, fmt.Sprint(executor.ProbeExitCode)):
+			t.Errorf("the source code of the %q probe doesn't exit with %d", probe.Name, probe.ExitCode)
+		case probe.ExitCode == executor.ProbeCrashExitCode && !strings.Contains(strings.ToLower(probe.SourceCode), "kill"):
+			t.Errorf("the source code of the %q probe doesn't kill itself", probe.Name)
+		}
+		names[probe.Name] = true
+		sources[probe.SourceCode] = true
+		exitCodes[probe.ExitCode] = true
+	}
+	want := []int64{0, executor.ProbeExitCode, executor.ProbeCrashExitCode}
+	if got := slices.Sorted(maps.Keys(exitCodes)); !slices.Equal(got, want) {
+		t.Errorf("the probes exit with %v, want %v", got, want)
+	}
+}
+
+// checkRun checks that the run of the probe has reported its exit code and
+// output.
+func checkRun(t *testing.T, stream *runnertest.Stream, probe executor.Probe) {
+	t.Helper()
+	if exitCode, ok := stream.ExitCode(); !ok || exitCode != probe.ExitCode {
+		t.Errorf("EXIT_CODE = %d (sent: %t), want %d", exitCode, ok, probe.ExitCode)
+	}
+	stdout := stream.Lines(v1.MessageLevel_STDOUT)
+	if got := strings.TrimSpace(strings.Join(stdout, "\n")); got != probe.Stdout {
+		t.Errorf("stdout = %q, want %q", stdout, probe.Stdout)
+	}
+	if stderr := stream.Lines(v1.MessageLevel_STDERR); probe.Stderr != "" && !slices.Contains(stderr, probe.Stderr) {
+		t.Errorf("stderr = %q, want it to have %q", stderr, probe.Stderr)
+	}
+}
+
+// TestTechnologiesConform runs the probes of every technology through the
+// whole Run path on a fake daemon, checking the exit code and the streams the
+// runner reports. Every new technology must pass it.
+func TestTechnologiesConform(t *testing.T) {
+	runner := runnertest.New(t, nil)
+	technologies := make(map[string]executor.Technology)
+	for _, language := range runner.Languages.Languages() {
+		technology, _ := runner.Languages.Technology(language)
+		// the containers are created from the digests verified at startup
+		technologies[runner.Languages.Status(language).Digest] = technology
+	}
+	runner.Daemon.SetProgram(probeProgram(t, technologies))
+
+	for _, language := range runner.Languages.Languages() {
+		t.Run(language, func(t *testing.T) {
+			technology, _ := runner.Languages.Technology(language)
+			if technology.GetHelloWorld() == "" {
+				t.Error("the technology has no hello-world program")
+			}
+			if command, err := technology.GetCommandWithArgs(nil); err != nil || !slices.Equal(command, technology.GetCommand()) {
+				t.Errorf("GetCommandWithArgs(nil) = %q, %v, want the command of the technology", command, err)
+			}
+			probes := technology.GetProbes()
+			checkProbes(t, probes)
+
+			for _, probe := range probes {
+				t.Run(probe.Name, func(t *testing.T) {
+					t.Parallel()
+					stream, err := runner.Run(context.Background(),
+						&v1.RunRequest{Language: language, SourceCode: probe.SourceCode})
+					if err != nil {
+						t.Fatalf("Run() = %v", err)
+					}
+					checkRun(t, stream, probe)
+					if stderr := stream.Lines(v1.MessageLevel_STDERR); !slices.Contains(stderr, compilerWarning) {
+						t.Errorf("stderr = %q, want it to have %q", stderr, compilerWarning)
+					}
+				})
+			}
+		})
+	}
+
+	// the runtime check of the probes agrees with the test
+	canary := internal.NewCanary(runner.Config, runner.Server)
+	if err := canary.Run(context.Background()); err != nil {
+		t.Errorf("canary Run() = %v", err)
+	}
+	if failures := canary.Conformance(context.Background()); len(failures) != 0 {
+		t.Errorf("Conformance() = %v", failures)
+	}
+}
@@ -0,0 +1,70 @@
+package executor
+
+import (
+	"io"
+
+	"github.com/Pelfox/codecell-runner/pkg"
+)
+
+// CustomTechnology runs the source code inside an arbitrary image with a
+// caller-supplied command. The source code is written as /workspace/source.
+// Custom images may lack a named user, so it declares none and the runner
+// user is referenced numerically.
+type CustomTechnology struct {
+	Image   string
+	Command []string
+}
+
+func (t CustomTechnology) GetCommand() []string {
+	return t.Command
+}
+
+func (t CustomTechnology) GetCommandWithArgs(args []string) ([]string, error) {
+	return commandWithoutArgs(t, args)
+}
+
+func (t CustomTechnology) GetImage() string {
+	return t.Image
+}
+
+func (t CustomTechnology) GetUser() string {
+	return ""
+}
+
+func (t CustomTechnology) GetEnvironment() map[string]string {
+	return nil
+}
+
+func (t CustomTechnology) GetConcurrencyLimit() int {
+	return 0
+}
+
+func (t CustomTechnology) GetMemoryHint() int64 {
+	return 0
+}
+
+func (t CustomTechnology) GetPidsHint() int64 {
+	return 0
+}
+
+func (t CustomTechnology) GetReadyLine() string {
+	return ""
+}
+
+func (t CustomTechnology) GetHelloWorld() string {
+	return ""
+}
+
+func (t CustomTechnology) GetProbes() []Probe {
+	return nil
+}
+
+func (t CustomTechnology) GetBuildOutputs() []string {
+	return nil
+}
+
+func (t CustomTechnology) WriteSourceCode(sourceCode string, owner pkg.FileOwner) (io.ReadCloser, error) {
+	return pkg.CreateOwnedTar(map[string][]byte{
+		"source": []byte(sourceCode),
+	}, owner)
+}
@@ -17,19 +17,87 @@ const projectConfigContents = `
 </Project>
 `
 
+// readyInitializerContents prints the ready line once the program is loaded,
+// before its top-level statements run.
+const readyInitializerContents = `
+internal static class CodecellReady
+{
+    [System.Runtime.CompilerServices.ModuleInitializer]
+    internal static void Signal() => System.Console.WriteLine("` + ReadyLine + `");
+}
+`
+
 type DotNetTechnology struct{}
 
 func (t DotNetTechnology) GetCommand() []string {
 	return []string{"dotnet", "run"}
 }
 
+func (t DotNetTechnology) GetCommandWithArgs(args []string) ([]string, error) {
+	return commandWithoutArgs(t, args)
+}
+
 func (t DotNetTechnology) GetImage() string {
 	return "codecell/dotnet"
 }
 
-func (t DotNetTechnology) WriteSourceCode(sourceCode string) (io.Reader, error) {
-	return pkg.CreateTar(map[string][]byte{
-		"Runner.csproj": []byte(projectConfigContents),
-		"Program.cs":    []byte(sourceCode),
-	})
+func (t DotNetTechnology) GetUser() string {
+	return "runner"
+}
+
+// GetEnvironment keeps the SDK from printing its banners into the output of
+// the program and from phoning home.
+func (t DotNetTechnology) GetEnvironment() map[string]string {
+	return map[string]string{
+		"DOTNET_CLI_TELEMETRY_OPTOUT":       "1",
+		"DOTNET_NOLOGO":                     "1",
+		"DOTNET_SKIP_FIRST_TIME_EXPERIENCE": "1",
+	}
+}
+
+// GetConcurrencyLimit keeps dotnet runs scarce, as the build spikes the CPU.
+func (t DotNetTechnology) GetConcurrencyLimit() int {
+	return 4
+}
+
+func (t DotNetTechnology) GetMemoryHint() int64 {
+	return 0
+}
+
+func (t DotNetTechnology) GetPidsHint() int64 {
+	return 0
+}
+
+// GetReadyLine tells the program started once the module initializer of the
+// project runs, after the build and the boot of the host.
+func (t DotNetTechnology) GetReadyLine() string {
+	return ReadyLine
+}
+
+func (t DotNetTechnology) GetHelloWorld() string {
+	return `Console.WriteLine("` + HelloWorldOutput + `");`
+}
+
+// Process.Kill sends SIGKILL on Linux.
+const (
+	dotnetExitProbe = `Console.WriteLine("` + HelloWorldOutput + `");
+Console.Error.WriteLine("` + ProbeStderrOutput + `");
+Environment.Exit(42);`
+	dotnetCrashProbe = `System.Diagnostics.Process.GetCurrentProcess().Kill();`
+)
+
+func (t DotNetTechnology) GetProbes() []Probe {
+	return NewProbes(t.GetHelloWorld(), dotnetExitProbe, dotnetCrashProbe)
+}
+
+func (t DotNetTechnology) GetBuildOutputs() []string {
+	return []string{"obj", "bin"}
+}
+
+func (t DotNetTechnology) WriteSourceCode(sourceCode string, owner pkg.FileOwner) (io.ReadCloser, error) {
+	return pkg.CreateOwnedTar(map[string][]byte{
+		"Runner.csproj":    []byte(projectConfigContents),
+		"Program.cs":       []byte(sourceCode),
+		"CodecellReady.cs": []byte(readyInitializerContents),
+	}, owner)
 }
@@ -0,0 +1,78 @@
+package executor
+
+import (
+	"io"
+
+	"github.com/Pelfox/codecell-runner/pkg"
+)
+
+// ElixirTechnology runs main.exs with the Elixir interpreter.
+type ElixirTechnology struct{}
+
+func (t ElixirTechnology) GetCommand() []string {
+	return []string{"elixir", "main.exs"}
+}
+
+func (t ElixirTechnology) GetCommandWithArgs(args []string) ([]string, error) {
+	return commandWithoutArgs(t, args)
+}
+
+func (t ElixirTechnology) GetImage() string {
+	return "codecell/elixir"
+}
+
+func (t ElixirTechnology) GetUser() string {
+	return "runner"
+}
+
+// GetEnvironment bounds the threads of the BEAM, which otherwise starts
+// schedulers for every CPU of the host whatever the limits of the container.
+func (t ElixirTechnology) GetEnvironment() map[string]string {
+	return map[string]string{
+		"ERL_FLAGS": "+S 2:2 +SDcpu 2:2 +SDio 4 +A 1",
+	}
+}
+
+func (t ElixirTechnology) GetConcurrencyLimit() int {
+	return 0
+}
+
+func (t ElixirTechnology) GetMemoryHint() int64 {
+	return 0
+}
+
+// GetPidsHint leaves room for the threads of the BEAM and the OS processes
+// it spawns, e.g. epmd and the ports.
+func (t ElixirTechnology) GetPidsHint() int64 {
+	return 128
+}
+
+func (t ElixirTechnology) GetReadyLine() string {
+	return ""
+}
+
+func (t ElixirTechnology) GetHelloWorld() string {
+	return `IO.puts("` + HelloWorldOutput + `")`
+}
+
+// The BEAM can't signal itself, a shell kills it.
+const (
+	elixirExitProbe = `IO.puts("` + HelloWorldOutput + `")
+IO.puts(:stderr, "` + ProbeStderrOutput + `")
+System.halt(42)`
+	elixirCrashProbe = `System.cmd("sh", ["-c", "kill -9 #{System.pid()}"])`
+)
+
+func (t ElixirTechnology) GetProbes() []Probe {
+	return NewProbes(t.GetHelloWorld(), elixirExitProbe, elixirCrashProbe)
+}
+
+func (t ElixirTechnology) GetBuildOutputs() []string {
+	return nil
+}
+
+func (t ElixirTechnology) WriteSourceCode(sourceCode string, owner pkg.FileOwner) (io.ReadCloser, error) {
+	return pkg.CreateOwnedTar(map[string][]byte{
+		"main.exs": []byte(sourceCode),
+	}, owner)
+}
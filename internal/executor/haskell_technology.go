@@ -0,0 +1,92 @@
+package executor
+
+import (
+	"io"
+
+	"github.com/Pelfox/codecell-runner/pkg"
+)
+
+// haskellBuildCommand compiles the program into the workspace, which unlike
+// /tmp allows executing what's written there, and runs it. The compiler is
+// silenced but for its diagnostics, printed on stderr.
+const haskellBuildCommand = "ghc -v0 -O0 -outputdir build -o build/Main Main.hs && exec ./build/Main"
+
+// HaskellTechnology compiles the Main module with GHC and runs it.
+type HaskellTechnology struct{}
+
+func (t HaskellTechnology) GetCommand() []string {
+	return []string{"sh", "-c", haskellBuildCommand}
+}
+
+func (t HaskellTechnology) GetCommandWithArgs(args []string) ([]string, error) {
+	return commandWithoutArgs(t, args)
+}
+
+func (t HaskellTechnology) GetImage() string {
+	return "codecell/haskell"
+}
+
+func (t HaskellTechnology) GetUser() string {
+	return "runner"
+}
+
+func (t HaskellTechnology) GetEnvironment() map[string]string {
+	return nil
+}
+
+// GetConcurrencyLimit keeps haskell runs scarce, as GHC is heavy on the
+// memory and the CPU while compiling.
+func (t HaskellTechnology) GetConcurrencyLimit() int {
+	return 2
+}
+
+// GetMemoryHint leaves GHC room to compile, as it needs far more memory than
+// most programs it compiles.
+func (t HaskellTechnology) GetMemoryHint() int64 {
+	return 1024 * 1024 * 1024
+}
+
+func (t HaskellTechnology) GetPidsHint() int64 {
+	return 0
+}
+
+func (t HaskellTechnology) GetReadyLine() string {
+	return ""
+}
+
+func (t HaskellTechnology) GetHelloWorld() string {
+	return `main :: IO ()
+main = putStrLn "` + HelloWorldOutput + `"
+`
+}
+
+const (
+	haskellExitProbe = `import System.Exit
+import System.IO
+
+main :: IO ()
+main = do
+  putStrLn "` + HelloWorldOutput + `"
+  hPutStrLn stderr "` + ProbeStderrOutput + `"
+  exitWith (ExitFailure 42)
+`
+	haskellCrashProbe = `import System.Posix.Signals
+
+main :: IO ()
+main = raiseSignal sigKILL
+`
+)
+
+func (t HaskellTechnology) GetProbes() []Probe {
+	return NewProbes(t.GetHelloWorld(), haskellExitProbe, haskellCrashProbe)
+}
+
+func (t HaskellTechnology) GetBuildOutputs() []string {
+	return []string{"build"}
+}
+
+func (t HaskellTechnology) WriteSourceCode(sourceCode string, owner pkg.FileOwner) (io.ReadCloser, error) {
+	return pkg.CreateOwnedTar(map[string][]byte{
+		"Main.hs": []byte(sourceCode),
+	}, owner)
+}
@@ -0,0 +1,81 @@
+package executor
+
+import (
+	"io"
+
+	"github.com/Pelfox/codecell-runner/pkg"
+)
+
+// juliaDepotPath puts the writable depot in the workspace, as the package
+// images compiled into it are shared libraries the noexec /tmp can't load,
+// ahead of the read-only depot of the image, which the trailing colon keeps.
+const juliaDepotPath = "/workspace/.julia-depot:"
+
+// JuliaTechnology runs main.jl with Julia.
+type JuliaTechnology struct{}
+
+func (t JuliaTechnology) GetCommand() []string {
+	return []string{"julia", "--startup-file=no", "main.jl"}
+}
+
+func (t JuliaTechnology) GetCommandWithArgs(args []string) ([]string, error) {
+	return commandWithoutArgs(t, args)
+}
+
+func (t JuliaTechnology) GetImage() string {
+	return "codecell/julia"
+}
+
+func (t JuliaTechnology) GetUser() string {
+	return "runner"
+}
+
+func (t JuliaTechnology) GetEnvironment() map[string]string {
+	return map[string]string{
+		"JULIA_DEPOT_PATH": juliaDepotPath,
+		"JULIA_HISTORY":    "/dev/null",
+	}
+}
+
+func (t JuliaTechnology) GetConcurrencyLimit() int {
+	return 0
+}
+
+// GetMemoryHint leaves room for the JIT compiler, which the default limit
+// barely does.
+func (t JuliaTechnology) GetMemoryHint() int64 {
+	return 1024 * 1024 * 1024
+}
+
+func (t JuliaTechnology) GetPidsHint() int64 {
+	return 0
+}
+
+func (t JuliaTechnology) GetReadyLine() string {
+	return ""
+}
+
+func (t JuliaTechnology) GetHelloWorld() string {
+	return `println("` + HelloWorldOutput + `")`
+}
+
+const (
+	juliaExitProbe = `println("` + HelloWorldOutput + `")
+println(stderr, "` + ProbeStderrOutput + `")
+exit(42)`
+	juliaCrashProbe = `ccall(:kill, Cint, (Cint, Cint), getpid(), 9)`
+)
+
+func (t JuliaTechnology) GetProbes() []Probe {
+	return NewProbes(t.GetHelloWorld(), juliaExitProbe, juliaCrashProbe)
+}
+
+func (t JuliaTechnology) GetBuildOutputs() []string {
+	return nil
+}
+
+func (t JuliaTechnology) WriteSourceCode(sourceCode string, owner pkg.FileOwner) (io.ReadCloser, error) {
+	return pkg.CreateOwnedTar(map[string][]byte{
+		"main.jl": []byte(sourceCode),
+	}, owner)
+}
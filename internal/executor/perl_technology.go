@@ -0,0 +1,84 @@
+package executor
+
+import (
+	"io"
+
+	"github.com/Pelfox/codecell-runner/pkg"
+)
+
+// perlAutoflushModule turns the buffering of stdout off, so that the prints
+// of the program stream live rather than when it exits. It's loaded through
+// PERL5OPT, which can't set $| itself.
+const perlAutoflushModule = `package Autoflush;
+use IO::Handle;
+STDOUT->autoflush(1);
+1;
+`
+
+// PerlTechnology runs main.pl with the Perl interpreter.
+type PerlTechnology struct{}
+
+func (t PerlTechnology) GetCommand() []string {
+	return []string{"perl", "main.pl"}
+}
+
+func (t PerlTechnology) GetCommandWithArgs(args []string) ([]string, error) {
+	return commandWithoutArgs(t, args)
+}
+
+func (t PerlTechnology) GetImage() string {
+	return "codecell/perl"
+}
+
+func (t PerlTechnology) GetUser() string {
+	return "runner"
+}
+
+func (t PerlTechnology) GetEnvironment() map[string]string {
+	return map[string]string{
+		"PERL5LIB": "/workspace/.codecell",
+		"PERL5OPT": "-MAutoflush",
+	}
+}
+
+func (t PerlTechnology) GetConcurrencyLimit() int {
+	return 0
+}
+
+func (t PerlTechnology) GetMemoryHint() int64 {
+	return 0
+}
+
+func (t PerlTechnology) GetPidsHint() int64 {
+	return 0
+}
+
+func (t PerlTechnology) GetReadyLine() string {
+	return ""
+}
+
+func (t PerlTechnology) GetHelloWorld() string {
+	return `print "` + HelloWorldOutput + `\n";`
+}
+
+const (
+	perlExitProbe = `print "` + HelloWorldOutput + `\n";
+print STDERR "` + ProbeStderrOutput + `\n";
+exit 42;`
+	perlCrashProbe = `kill 'KILL', $$;`
+)
+
+func (t PerlTechnology) GetProbes() []Probe {
+	return NewProbes(t.GetHelloWorld(), perlExitProbe, perlCrashProbe)
+}
+
+func (t PerlTechnology) GetBuildOutputs() []string {
+	return nil
+}
+
+func (t PerlTechnology) WriteSourceCode(sourceCode string, owner pkg.FileOwner) (io.ReadCloser, error) {
+	return pkg.CreateOwnedTar(map[string][]byte{
+		".codecell/Autoflush.pm": []byte(perlAutoflushModule),
+		"main.pl":                []byte(sourceCode),
+	}, owner)
+}
@@ -0,0 +1,92 @@
+package executor
+
+import (
+	"io"
+
+	"github.com/Pelfox/codecell-runner/pkg"
+)
+
+// scalaCoursierCache is the dependency cache baked into the image, as the
+// containers have no network to resolve the dependencies with.
+const scalaCoursierCache = "/opt/coursier-cache"
+
+// ScalaTechnology compiles and runs main.scala with scala-cli, offline and
+// without the compilation server, which would outlive the run.
+type ScalaTechnology struct{}
+
+func (t ScalaTechnology) GetCommand() []string {
+	return []string{"scala-cli", "run", "main.scala", "--server=false", "--offline", "--jvm", "system"}
+}
+
+func (t ScalaTechnology) GetCommandWithArgs(args []string) ([]string, error) {
+	return commandWithoutArgs(t, args)
+}
+
+func (t ScalaTechnology) GetImage() string {
+	return "codecell/scala"
+}
+
+func (t ScalaTechnology) GetUser() string {
+	return "runner"
+}
+
+// GetEnvironment points the tools at the baked dependency cache, and their
+// other caches at the writable /tmp.
+func (t ScalaTechnology) GetEnvironment() map[string]string {
+	return map[string]string{
+		"COURSIER_CACHE": scalaCoursierCache,
+		"COURSIER_MODE":  "offline",
+		"XDG_CACHE_HOME": "/tmp",
+	}
+}
+
+// GetConcurrencyLimit keeps scala runs scarce, as the compiler spikes the CPU.
+func (t ScalaTechnology) GetConcurrencyLimit() int {
+	return 4
+}
+
+// GetMemoryHint leaves the compiler room on the JVM, which the default limit
+// doesn't.
+func (t ScalaTechnology) GetMemoryHint() int64 {
+	return 1536 * 1024 * 1024
+}
+
+// GetPidsHint leaves room for the threads of the JVM.
+func (t ScalaTechnology) GetPidsHint() int64 {
+	return 128
+}
+
+func (t ScalaTechnology) GetReadyLine() string {
+	return ""
+}
+
+func (t ScalaTechnology) GetHelloWorld() string {
+	return `@main def hello(): Unit = println("` + HelloWorldOutput + `")
+`
+}
+
+// The JVM can't signal itself, a shell kills it.
+const (
+	scalaExitProbe = `@main def probe(): Unit =
+  println("` + HelloWorldOutput + `")
+  System.err.println("` + ProbeStderrOutput + `")
+  sys.exit(42)
+`
+	scalaCrashProbe = `@main def probe(): Unit =
+  new ProcessBuilder("sh", "-c", s"kill -9 ${ProcessHandle.current().pid()}").start().waitFor()
+`
+)
+
+func (t ScalaTechnology) GetProbes() []Probe {
+	return NewProbes(t.GetHelloWorld(), scalaExitProbe, scalaCrashProbe)
+}
+
+func (t ScalaTechnology) GetBuildOutputs() []string {
+	return []string{".scala-build"}
+}
+
+func (t ScalaTechnology) WriteSourceCode(sourceCode string, owner pkg.FileOwner) (io.ReadCloser, error) {
+	return pkg.CreateOwnedTar(map[string][]byte{
+		"main.scala": []byte(sourceCode),
+	}, owner)
+}
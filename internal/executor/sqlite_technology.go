@@ -0,0 +1,107 @@
+package executor
+
+import (
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/Pelfox/codecell-runner/pkg"
+)
+
+// sqliteRunCommand executes the script against a database on the writable
+// /tmp, seeded from the first database asset of the run, if any. The results
+// are printed with headers in the output mode its first argument sets, e.g.
+// "-markdown", which the script can change with ".mode", and the first failing
+// statement stops it with a non-zero exit.
+const sqliteRunCommand = `for asset in /workspace/assets/*.sqlite /workspace/assets/*.db; do
+  if [ -f "$asset" ]; then cp "$asset" /tmp/db.sqlite && break; fi
+done
+exec sqlite3 -batch -bail -header "$1" /tmp/db.sqlite < script.sql`
+
+// sqliteDefaultMode is the output mode of the runs without arguments.
+const sqliteDefaultMode = "column"
+
+// sqliteModes are the output modes of sqlite3 the runs can select.
+var sqliteModes = []string{"box", "column", "csv", "html", "json", "line", "list", "markdown", "table", "tabs"}
+
+// SqliteTechnology executes the SQL script with SQLite.
+type SqliteTechnology struct{}
+
+func (t SqliteTechnology) GetCommand() []string {
+	command, _ := t.GetCommandWithArgs([]string{sqliteDefaultMode})
+	return command
+}
+
+// GetCommandWithArgs takes the output mode as the single argument, e.g.
+// "markdown", "column" without arguments.
+func (t SqliteTechnology) GetCommandWithArgs(args []string) ([]string, error) {
+	if len(args) == 0 {
+		return t.GetCommand(), nil
+	}
+	if len(args) > 1 || !slices.Contains(sqliteModes, args[0]) {
+		return nil, fmt.Errorf("the arguments of sqlite are a single output mode, one of %v", sqliteModes)
+	}
+	// the arguments of sh -c start at $0
+	return []string{"sh", "-c", sqliteRunCommand, "sh", "-" + args[0]}, nil
+}
+
+func (t SqliteTechnology) GetImage() string {
+	return "codecell/sqlite"
+}
+
+func (t SqliteTechnology) GetUser() string {
+	return "runner"
+}
+
+func (t SqliteTechnology) GetEnvironment() map[string]string {
+	return nil
+}
+
+func (t SqliteTechnology) GetConcurrencyLimit() int {
+	return 0
+}
+
+func (t SqliteTechnology) GetMemoryHint() int64 {
+	return 0
+}
+
+func (t SqliteTechnology) GetPidsHint() int64 {
+	return 0
+}
+
+func (t SqliteTechnology) GetReadyLine() string {
+	return ""
+}
+
+func (t SqliteTechnology) GetHelloWorld() string {
+	return `.mode list
+.headers off
+SELECT '` + HelloWorldOutput + `';
+`
+}
+
+// The shell commands of sqlite3 write the stderr and kill it.
+const (
+	sqliteExitProbe = `.mode list
+.headers off
+SELECT '` + HelloWorldOutput + `';
+.shell echo '` + ProbeStderrOutput + `' >&2
+.exit 42
+`
+	sqliteCrashProbe = `.shell kill -9 $PPID
+`
+)
+
+func (t SqliteTechnology) GetProbes() []Probe {
+	return NewProbes(t.GetHelloWorld(), sqliteExitProbe, sqliteCrashProbe)
+}
+
+func (t SqliteTechnology) GetBuildOutputs() []string {
+	return nil
+}
+
+func (t SqliteTechnology) WriteSourceCode(sourceCode string, owner pkg.FileOwner) (io.ReadCloser, error) {
+	return pkg.CreateOwnedTar(map[string][]byte{
+		"script.sql": []byte(sourceCode),
+	}, owner)
+}
@@ -0,0 +1,88 @@
+package executor
+
+import (
+	"io"
+
+	"github.com/Pelfox/codecell-runner/pkg"
+)
+
+// swiftModuleCachePath is the module cache of the interpreter, which must be
+// writable; it's data only, so the noexec /tmp holds it.
+const swiftModuleCachePath = "/tmp/swift-module-cache"
+
+// SwiftTechnology runs main.swift with the Swift interpreter.
+type SwiftTechnology struct{}
+
+func (t SwiftTechnology) GetCommand() []string {
+	return []string{"swift", "-module-cache-path", swiftModuleCachePath, "main.swift"}
+}
+
+func (t SwiftTechnology) GetCommandWithArgs(args []string) ([]string, error) {
+	return commandWithoutArgs(t, args)
+}
+
+func (t SwiftTechnology) GetImage() string {
+	return "codecell/swift"
+}
+
+func (t SwiftTechnology) GetUser() string {
+	return "runner"
+}
+
+// GetEnvironment points the caches of the toolchain at the writable /tmp, the
+// home of the runner user being read-only on some images.
+func (t SwiftTechnology) GetEnvironment() map[string]string {
+	return map[string]string{
+		"CLANG_MODULE_CACHE_PATH": swiftModuleCachePath,
+		"XDG_CACHE_HOME":          "/tmp",
+	}
+}
+
+// GetConcurrencyLimit keeps swift runs scarce, as the interpreter compiles
+// the program at startup.
+func (t SwiftTechnology) GetConcurrencyLimit() int {
+	return 4
+}
+
+// GetMemoryHint leaves the interpreter room for its sizeable startup, which
+// the default limit doesn't.
+func (t SwiftTechnology) GetMemoryHint() int64 {
+	return 768 * 1024 * 1024
+}
+
+func (t SwiftTechnology) GetPidsHint() int64 {
+	return 0
+}
+
+func (t SwiftTechnology) GetReadyLine() string {
+	return ""
+}
+
+func (t SwiftTechnology) GetHelloWorld() string {
+	return `print("` + HelloWorldOutput + `")`
+}
+
+const (
+	swiftExitProbe = `import Foundation
+
+print("` + HelloWorldOutput + `")
+FileHandle.standardError.write("` + ProbeStderrOutput + `\n".data(using: .utf8)!)
+exit(42)`
+	swiftCrashProbe = `import Foundation
+
+kill(getpid(), SIGKILL)`
+)
+
+func (t SwiftTechnology) GetProbes() []Probe {
+	return NewProbes(t.GetHelloWorld(), swiftExitProbe, swiftCrashProbe)
+}
+
+func (t SwiftTechnology) GetBuildOutputs() []string {
+	return nil
+}
+
+func (t SwiftTechnology) WriteSourceCode(sourceCode string, owner pkg.FileOwner) (io.ReadCloser, error) {
+	return pkg.CreateOwnedTar(map[string][]byte{
+		"main.swift": []byte(sourceCode),
+	}, owner)
+}
@@ -1,9 +1,99 @@
 package executor
 
-import "io"
+import (
+	"errors"
+	"io"
+
+	"github.com/Pelfox/codecell-runner/pkg"
+)
+
+// HelloWorldOutput is the output of the hello-world programs of the technologies.
+const HelloWorldOutput = "Hello, World!"
+
+// ReadyLine is the line the technologies print right before the program starts
+// executing, if they tell.
+const ReadyLine = "__codecell_ready__"
+
+const (
+	// ProbeStderrOutput is the line the exit probes print on stderr.
+	ProbeStderrOutput = "codecell probe"
+	// ProbeExitCode is the code the exit probes exit with.
+	ProbeExitCode = 42
+	// ProbeCrashExitCode is the exit code of the crash probes, which kill
+	// themselves with SIGKILL, as reported for the kills by a signal.
+	ProbeCrashExitCode = 128 + 9
+)
+
+// Probe is a program checking that the technology reports the exit code and
+// the output of the program as they are, whatever wraps the program.
+type Probe struct {
+	// Name is the name of the probe.
+	Name string
+	// SourceCode is the source code of the program.
+	SourceCode string
+	// ExitCode is the exit code the run must report.
+	ExitCode int64
+	// Stdout is the output the program prints on stdout, trimmed.
+	Stdout string
+	// Stderr is the line the program prints on stderr, empty if none. The
+	// stderr may have other lines, e.g. the warnings of a compiler.
+	Stderr string
+}
+
+// NewProbes returns the probes of the programs that print HelloWorldOutput and
+// exit with 0, that print HelloWorldOutput on stdout and ProbeStderrOutput on
+// stderr and exit with ProbeExitCode, and that kill themselves with SIGKILL.
+func NewProbes(helloWorld string, exit string, crash string) []Probe {
+	return []Probe{
+		{Name: "exit 0", SourceCode: helloWorld, ExitCode: 0, Stdout: HelloWorldOutput},
+		{Name: "exit 42", SourceCode: exit, ExitCode: ProbeExitCode, Stdout: HelloWorldOutput, Stderr: ProbeStderrOutput},
+		{Name: "crash", SourceCode: crash, ExitCode: ProbeCrashExitCode},
+	}
+}
+
+// ErrNoArguments is returned for the arguments of the runs of the technologies
+// taking none.
+var ErrNoArguments = errors.New("the language takes no arguments")
 
 type Technology interface {
 	GetImage() string
 	GetCommand() []string
-	WriteSourceCode(sourceCode string) (io.Reader, error)
+	// GetCommandWithArgs returns the command running the program with the
+	// arguments of the run, GetCommand without arguments. The invalid ones
+	// fail, ErrNoArguments for the technologies taking none.
+	GetCommandWithArgs(args []string) ([]string, error)
+	GetUser() string
+	// GetEnvironment returns the environment variables the technology adds over the default ones.
+	GetEnvironment() map[string]string
+	// GetConcurrencyLimit returns the maximum number of simultaneous runs of the technology, 0 if unlimited.
+	GetConcurrencyLimit() int
+	// GetMemoryHint returns the memory limit the runs need at least in bytes,
+	// raising the defaults but never the configured limits; 0 if none.
+	GetMemoryHint() int64
+	// GetPidsHint returns the process limit the runs need at least, raising
+	// the defaults but never the configured limits; 0 if none.
+	GetPidsHint() int64
+	// GetReadyLine returns the line the technology prints on stdout right before
+	// the program starts executing, which isn't relayed; empty if it doesn't tell.
+	GetReadyLine() string
+	// GetHelloWorld returns the source code of a program printing HelloWorldOutput, empty if there is none.
+	GetHelloWorld() string
+	// GetProbes returns the programs checking the exit codes and the output
+	// of the technology, none if there are none.
+	GetProbes() []Probe
+	// GetBuildOutputs returns the workspace paths of the build outputs, to reuse
+	// for the identical runs; none if the technology doesn't build.
+	GetBuildOutputs() []string
+	// WriteSourceCode returns the workspace archive of the source code, which
+	// must be closed if it isn't read to the end.
+	WriteSourceCode(sourceCode string, owner pkg.FileOwner) (io.ReadCloser, error)
+}
+
+// commandWithoutArgs returns the command of the technology taking no
+// arguments, failing with ErrNoArguments if there are any.
+func commandWithoutArgs(technology Technology, args []string) ([]string, error) {
+	if len(args) > 0 {
+		return nil, ErrNoArguments
+	}
+	return technology.GetCommand(), nil
 }
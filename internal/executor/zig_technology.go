@@ -0,0 +1,98 @@
+package executor
+
+import (
+	"io"
+
+	"github.com/Pelfox/codecell-runner/pkg"
+)
+
+// The caches of the compiler, holding the built program too, are in the
+// workspace, which unlike /tmp allows executing what's written there.
+const (
+	zigLocalCacheDir  = ".zig-cache"
+	zigGlobalCacheDir = ".zig-global-cache"
+)
+
+// ZigTechnology compiles and runs main.zig with `zig run`.
+type ZigTechnology struct{}
+
+func (t ZigTechnology) GetCommand() []string {
+	return []string{"zig", "run", "main.zig"}
+}
+
+func (t ZigTechnology) GetCommandWithArgs(args []string) ([]string, error) {
+	return commandWithoutArgs(t, args)
+}
+
+func (t ZigTechnology) GetImage() string {
+	return "codecell/zig"
+}
+
+func (t ZigTechnology) GetUser() string {
+	return "runner"
+}
+
+func (t ZigTechnology) GetEnvironment() map[string]string {
+	return map[string]string{
+		"ZIG_LOCAL_CACHE_DIR":  "/workspace/" + zigLocalCacheDir,
+		"ZIG_GLOBAL_CACHE_DIR": "/workspace/" + zigGlobalCacheDir,
+	}
+}
+
+func (t ZigTechnology) GetConcurrencyLimit() int {
+	return 0
+}
+
+func (t ZigTechnology) GetMemoryHint() int64 {
+	return 0
+}
+
+func (t ZigTechnology) GetPidsHint() int64 {
+	return 0
+}
+
+func (t ZigTechnology) GetReadyLine() string {
+	return ""
+}
+
+func (t ZigTechnology) GetHelloWorld() string {
+	return `const std = @import("std");
+
+pub fn main() !void {
+    try std.io.getStdOut().writer().print("` + HelloWorldOutput + `\n", .{});
+}
+`
+}
+
+const (
+	zigExitProbe = `const std = @import("std");
+
+pub fn main() !void {
+    try std.io.getStdOut().writer().print("` + HelloWorldOutput + `\n", .{});
+    try std.io.getStdErr().writer().print("` + ProbeStderrOutput + `\n", .{});
+    std.process.exit(42);
+}
+`
+	zigCrashProbe = `const std = @import("std");
+
+pub fn main() !void {
+    try std.posix.kill(std.os.linux.getpid(), std.posix.SIG.KILL);
+}
+`
+)
+
+func (t ZigTechnology) GetProbes() []Probe {
+	return NewProbes(t.GetHelloWorld(), zigExitProbe, zigCrashProbe)
+}
+
+// GetBuildOutputs keeps both caches, the global one holding the compiled
+// standard library.
+func (t ZigTechnology) GetBuildOutputs() []string {
+	return []string{zigLocalCacheDir, zigGlobalCacheDir}
+}
+
+func (t ZigTechnology) WriteSourceCode(sourceCode string, owner pkg.FileOwner) (io.ReadCloser, error) {
+	return pkg.CreateOwnedTar(map[string][]byte{
+		"main.zig": []byte(sourceCode),
+	}, owner)
+}
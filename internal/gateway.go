@@ -0,0 +1,268 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "github.com/Pelfox/codecell-runner/generated"
+	"github.com/Pelfox/codecell-runner/internal/middleware"
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// gatewayHTTPStatuses maps the gRPC status codes to the HTTP ones.
+var gatewayHTTPStatuses = map[codes.Code]int{
+	codes.OK:                 http.StatusOK,
+	codes.Canceled:           499, // client closed request
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.FailedPrecondition: http.StatusPreconditionFailed,
+	codes.Aborted:            http.StatusConflict,
+	codes.OutOfRange:         http.StatusBadRequest,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+}
+
+// Gateway exposes the runs over HTTP for the browser clients, which can't use
+// the native gRPC streams: runs are submitted with a POST and followed as a
+// stream of server-sent events, like the SubmitRun ones are with Attach.
+type Gateway struct {
+	appConfig    *pkg.AppConfig
+	server       *RunnerServer
+	interceptors []grpc.UnaryServerInterceptor
+	httpServer   *http.Server
+}
+
+// NewGateway creates a new instance of Gateway adapting the given server. The
+// interceptors authenticate the HTTP requests just as they do the RPCs, from
+// the headers, the remote address and the client certificate. The gateway
+// serves TLS with the configuration of the gRPC server, if it has one, mutual
+// TLS included.
+func NewGateway(
+	appConfig *pkg.AppConfig,
+	server *RunnerServer,
+	interceptors []grpc.UnaryServerInterceptor,
+	tlsConfig *tls.Config,
+) *Gateway {
+	gateway := &Gateway{
+		appConfig:    appConfig,
+		server:       server,
+		interceptors: interceptors,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/runs", gateway.handleRun)
+	mux.HandleFunc("GET /v1/runs/{id}/events", gateway.handleEvents)
+	mux.HandleFunc("POST /v1/runs/{id}/stop", gateway.handleStop)
+	gateway.httpServer = &http.Server{
+		Addr:              appConfig.GatewayAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if tlsConfig != nil {
+		gateway.httpServer.TLSConfig = tlsConfig.Clone()
+	}
+	return gateway
+}
+
+// Run serves the gateway until the context is cancelled.
+func (g *Gateway) Run(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = g.httpServer.Shutdown(shutdownCtx)
+	}()
+
+	listener, err := net.Listen("tcp", g.appConfig.GatewayAddr)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to listen for the HTTP gateway")
+		return
+	}
+	log.Info().Str("addr", g.appConfig.GatewayAddr).Bool("tls", g.httpServer.TLSConfig != nil).Msg("HTTP gateway listening")
+	if err := g.serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Error().Err(err).Msg("failed to serve the HTTP gateway")
+	}
+}
+
+// serve serves the gateway on the listener, over TLS if it's configured.
+func (g *Gateway) serve(listener net.Listener) error {
+	if g.httpServer.TLSConfig != nil {
+		// the certificate comes from the configuration
+		return g.httpServer.ServeTLS(listener, "", "")
+	}
+	return g.httpServer.Serve(listener)
+}
+
+// authenticate runs the interceptors for the HTTP request as if it were the
+// given RPC, returning the context they have produced.
+func (g *Gateway) authenticate(r *http.Request, fullMethod string) (context.Context, error) {
+	md := metadata.MD{}
+	for key, values := range r.Header {
+		md.Append(strings.ToLower(key), values...)
+	}
+	ctx := metadata.NewIncomingContext(r.Context(), md)
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		p := &peer.Peer{Addr: addr}
+		// the verified client certificate identifies the caller as it does over gRPC
+		if r.TLS != nil {
+			p.AuthInfo = credentials.TLSInfo{
+				State:          *r.TLS,
+				CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.PrivacyAndIntegrity},
+			}
+		}
+		ctx = peer.NewContext(ctx, p)
+	}
+
+	var authenticated context.Context
+	info := &grpc.UnaryServerInfo{FullMethod: fullMethod}
+	handler := grpc.UnaryHandler(func(ctx context.Context, _ any) (any, error) {
+		authenticated = ctx
+		return nil, nil
+	})
+	for i := len(g.interceptors) - 1; i >= 0; i-- {
+		interceptor, next := g.interceptors[i], handler
+		handler = func(ctx context.Context, req any) (any, error) {
+			return interceptor(ctx, req, info, next)
+		}
+	}
+	if _, err := handler(ctx, nil); err != nil {
+		return nil, err
+	}
+	return authenticated, nil
+}
+
+// writeGatewayError writes the status as a JSON error with the matching HTTP status.
+func writeGatewayError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	httpStatus, ok := gatewayHTTPStatuses[st.Code()]
+	if !ok {
+		httpStatus = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	_ = json.NewEncoder(w).Encode(map[string]string{"code": st.Code().String(), "message": st.Message()})
+}
+
+// handleRun starts the run described by the JSON body, which mirrors
+// RunRequest, and responds with its request ID once it's known.
+func (g *Gateway) handleRun(w http.ResponseWriter, r *http.Request) {
+	authenticated, err := g.authenticate(r, v1.RunnerService_Run_FullMethodName)
+	if err != nil {
+		writeGatewayError(w, err)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(g.appConfig.MaxRecvMsgSize)))
+	if err != nil {
+		writeGatewayError(w, status.Errorf(codes.InvalidArgument, "failed to read the request: %v", err))
+		return
+	}
+	request := &v1.RunRequest{}
+	if err := protojson.Unmarshal(body, request); err != nil {
+		writeGatewayError(w, status.Errorf(codes.InvalidArgument, "invalid run request: %v", err))
+		return
+	}
+
+	// the run outlives the HTTP request
+	requestID, err := g.server.detached.Start(authenticated, func(stream grpc.ServerStreamingServer[v1.RunResponseMessage]) error {
+		return g.server.Run(request, stream)
+	})
+	if err != nil {
+		writeGatewayError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(map[string]string{"requestId": requestID})
+}
+
+// handleEvents streams the messages of the run from the start as server-sent
+// events, ending with an "end" event, or an "error" one if the run has failed.
+func (g *Gateway) handleEvents(w http.ResponseWriter, r *http.Request) {
+	ctx, err := g.authenticate(r, v1.RunnerService_Attach_FullMethodName)
+	if err != nil {
+		writeGatewayError(w, err)
+		return
+	}
+	ctx = middleware.WithLogFields(ctx, "requestID", r.PathValue("id"))
+	broadcast, err := g.server.detached.Attach(ctx, r.PathValue("id"))
+	if err != nil {
+		writeGatewayError(w, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeGatewayError(w, status.Error(codes.Internal, "streaming is not supported"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	follower := broadcast.Follow()
+	for {
+		message, ok, err := follower.Next(r.Context())
+		if !ok {
+			if r.Context().Err() != nil {
+				return // the client is gone
+			}
+			if err != nil {
+				st := status.Convert(err)
+				data, _ := json.Marshal(map[string]string{"code": st.Code().String(), "message": st.Message()})
+				_, _ = fmt.Fprintf(w, "event: error\ndata: %s\n\n", data)
+			} else {
+				_, _ = io.WriteString(w, "event: end\ndata: {}\n\n")
+			}
+			flusher.Flush()
+			return
+		}
+
+		data, err := protojson.Marshal(message)
+		if err != nil {
+			zerolog.Ctx(ctx).Error().Err(err).Msg("failed to encode a gateway event")
+			return
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: message\ndata: %s\n\n", follower.Sequence(), data); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// handleStop stops the run, forcefully if the force query parameter is true.
+func (g *Gateway) handleStop(w http.ResponseWriter, r *http.Request) {
+	ctx, err := g.authenticate(r, v1.RunnerService_Stop_FullMethodName)
+	if err != nil {
+		writeGatewayError(w, err)
+		return
+	}
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	if _, err := g.server.Stop(ctx, &v1.StopRequest{RequestId: r.PathValue("id"), Force: force}); err != nil {
+		writeGatewayError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
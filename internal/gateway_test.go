@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/auth"
+	"github.com/Pelfox/codecell-runner/internal/tlstest"
+	"github.com/Pelfox/codecell-runner/pkg"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGatewayServesTheMutualTLSOfTheServer(t *testing.T) {
+	ca := tlstest.NewCA(t)
+	tlsConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{ca.Server(t)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.Pool(),
+	}
+	// the identities the guards see, the runs being rejected before reaching the server
+	identities := make(chan string, 1)
+	guards := []grpc.UnaryServerInterceptor{
+		auth.ClientCertificateUnaryInterceptor(),
+		func(ctx context.Context, _ any, _ *grpc.UnaryServerInfo, _ grpc.UnaryHandler) (any, error) {
+			var identity string
+			if principal := auth.PrincipalFromContext(ctx); principal != nil {
+				identity = principal.Identity
+			}
+			identities <- identity
+			return nil, status.Error(codes.PermissionDenied, "rejected by the test")
+		},
+	}
+	gateway := NewGateway(&pkg.AppConfig{}, nil, guards, tlsConfig)
+	gateway.httpServer.ErrorLog = log.New(io.Discard, "", 0)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = gateway.serve(listener) }()
+	t.Cleanup(func() { _ = gateway.httpServer.Close() })
+	url := "https://" + listener.Addr().String() + "/v1/runs/run/stop"
+
+	post := func(certificates ...tls.Certificate) (*http.Response, error) {
+		client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: ca.Pool(), Certificates: certificates},
+		}}
+		defer client.CloseIdleConnections()
+		return client.Post(url, "", nil)
+	}
+
+	if response, err := post(); err == nil {
+		_ = response.Body.Close()
+		t.Fatalf("POST without a client certificate = %s, want the handshake failing", response.Status)
+	}
+	response, err := post(ca.Client(t, "platform", time.Now().Add(time.Hour)))
+	if err != nil {
+		t.Fatalf("POST with a client certificate = %v", err)
+	}
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusForbidden {
+		t.Errorf("POST with a client certificate = %s, want the status of the guards", response.Status)
+	}
+	if identity := <-identities; identity != "platform" {
+		t.Errorf("the guards see the identity %q, want the one of the client certificate", identity)
+	}
+}
@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	v1 "github.com/Pelfox/codecell-runner/generated"
+	"github.com/Pelfox/codecell-runner/internal/services"
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// healthPingTimeout is the maximum duration of the Docker daemon ping.
+const healthPingTimeout = 5 * time.Second
+
+// HealthMonitor reports the health of the runner through the standard gRPC
+// health service: serving only while the Docker daemon responds, at least
+// one language is usable, the startup canary has passed, if enabled, and the
+// runner isn't draining.
+type HealthMonitor struct {
+	appConfig        *pkg.AppConfig
+	systemService    *services.SystemService
+	languagesService *services.LanguagesService
+	capacityReporter *CapacityReporter
+	healthServer     *health.Server
+
+	lastErr error
+
+	canaryMutex sync.Mutex
+	canaryErr   error
+}
+
+// NewHealthMonitor creates a new instance of HealthMonitor, not serving until
+// the first check.
+func NewHealthMonitor(
+	appConfig *pkg.AppConfig,
+	systemService *services.SystemService,
+	languagesService *services.LanguagesService,
+	capacityReporter *CapacityReporter,
+) *HealthMonitor {
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthServer.SetServingStatus(v1.RunnerService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_NOT_SERVING)
+	monitor := &HealthMonitor{
+		appConfig:        appConfig,
+		systemService:    systemService,
+		languagesService: languagesService,
+		capacityReporter: capacityReporter,
+		healthServer:     healthServer,
+	}
+	if appConfig.CanaryEnabled {
+		monitor.canaryErr = errors.New("startup canary hasn't passed yet")
+	}
+	return monitor
+}
+
+// SetCanaryResult records the outcome of the startup canary, the runner not
+// serving unless it has passed.
+func (m *HealthMonitor) SetCanaryResult(err error) {
+	m.canaryMutex.Lock()
+	defer m.canaryMutex.Unlock()
+	m.canaryErr = err
+}
+
+// Server returns the health service to be registered on the gRPC server.
+func (m *HealthMonitor) Server() *health.Server {
+	return m.healthServer
+}
+
+// Run checks the health at the configured interval until the context is cancelled.
+func (m *HealthMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.appConfig.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		m.Check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check updates the serving status of the runner and its service.
+func (m *HealthMonitor) Check(ctx context.Context) {
+	err := m.unhealthyReason(ctx)
+	servingStatus := healthpb.HealthCheckResponse_SERVING
+	if err != nil {
+		servingStatus = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	m.healthServer.SetServingStatus("", servingStatus)
+	m.healthServer.SetServingStatus(v1.RunnerService_ServiceDesc.ServiceName, servingStatus)
+
+	// logging the transitions only
+	switch {
+	case err != nil && (m.lastErr == nil || err.Error() != m.lastErr.Error()):
+		log.Warn().Err(err).Msg("runner is not serving")
+	case err == nil && m.lastErr != nil:
+		log.Info().Msg("runner is serving again")
+	}
+	m.lastErr = err
+}
+
+// unhealthyReason returns the reason the runner can't serve runs, or nil.
+func (m *HealthMonitor) unhealthyReason(ctx context.Context) error {
+	if m.capacityReporter.Draining() {
+		return errors.New("runner is draining")
+	}
+	m.canaryMutex.Lock()
+	canaryErr := m.canaryErr
+	m.canaryMutex.Unlock()
+	if canaryErr != nil {
+		return canaryErr
+	}
+
+	pingCtx, cancel := context.WithTimeout(ctx, healthPingTimeout)
+	defer cancel()
+	if err := m.systemService.Ping(pingCtx); err != nil {
+		return err
+	}
+
+	for _, language := range m.languagesService.Languages() {
+		if m.languagesService.Status(language).Err == nil {
+			return nil
+		}
+	}
+	return errors.New("no language is available")
+}
+
+// Shutdown reports every service as not serving for good, once the runner
+// starts draining.
+func (m *HealthMonitor) Shutdown() {
+	m.healthServer.Shutdown()
+}
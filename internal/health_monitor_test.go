@@ -0,0 +1,76 @@
+package internal_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	v1 "github.com/Pelfox/codecell-runner/generated"
+	"github.com/Pelfox/codecell-runner/internal"
+	"github.com/Pelfox/codecell-runner/internal/dockertest"
+	"github.com/Pelfox/codecell-runner/internal/runnertest"
+	"github.com/Pelfox/codecell-runner/pkg"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestHealthFollowsTheBackend(t *testing.T) {
+	runner := runnertest.New(t, func(config *pkg.AppConfig) {
+		config.CanaryEnabled = true
+	})
+	monitor := internal.NewHealthMonitor(runner.Config, runner.System, runner.Languages, runner.Capacity)
+	setLanguagesAvailable := func(available bool) {
+		for _, language := range runner.Languages.Languages() {
+			var err error
+			if !available {
+				err = errors.New("canary failed")
+			}
+			runner.Languages.SetCanaryResult(language, err)
+		}
+	}
+
+	serving, notServing := healthpb.HealthCheckResponse_SERVING, healthpb.HealthCheckResponse_NOT_SERVING
+	steps := []struct {
+		name   string
+		change func()
+		status healthpb.HealthCheckResponse_ServingStatus
+	}{
+		{name: "startup canary pending", status: notServing},
+		{name: "startup canary failed", change: func() {
+			monitor.SetCanaryResult(errors.New("canary failed"))
+		}, status: notServing},
+		{name: "startup canary passed", change: func() { monitor.SetCanaryResult(nil) }, status: serving},
+		{name: "daemon down", change: func() {
+			runner.Daemon.Fail(dockertest.OperationPing, http.StatusInternalServerError, "daemon is down")
+		}, status: notServing},
+		{name: "daemon back", change: func() { runner.Daemon.Restore(dockertest.OperationPing) }, status: serving},
+		{name: "every language unavailable", change: func() { setLanguagesAvailable(false) }, status: notServing},
+		{name: "a single language available", change: func() {
+			runner.Languages.SetCanaryResult(testLanguage, nil)
+		}, status: serving},
+		{name: "draining", change: func() {
+			setLanguagesAvailable(true)
+			runner.Capacity.SetDraining(true)
+		}, status: notServing},
+		{name: "accepting runs again", change: func() { runner.Capacity.SetDraining(false) }, status: serving},
+	}
+	for _, step := range steps {
+		if step.change != nil {
+			step.change()
+		}
+		monitor.Check(context.Background())
+		for _, service := range []string{"", v1.RunnerService_ServiceDesc.ServiceName} {
+			response, err := monitor.Server().Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+			if err != nil || response.Status != step.status {
+				t.Errorf("%s: Check(%q) = %v, %v, want %s", step.name, service, response.GetStatus(), err, step.status)
+			}
+		}
+	}
+
+	// once shut down, the runner never serves again
+	monitor.Shutdown()
+	monitor.Check(context.Background())
+	if response, _ := monitor.Server().Check(context.Background(), &healthpb.HealthCheckRequest{}); response.Status != notServing {
+		t.Errorf("Check() once shut down = %s, want %s", response.Status, notServing)
+	}
+}
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/clock"
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// idleCheckInterval is how often the idle monitor looks at the load.
+	idleCheckInterval = time.Second
+	// idleWebhookTimeout is the maximum duration of the idle shutdown webhook call.
+	idleWebhookTimeout = 10 * time.Second
+)
+
+// IdleMonitor shuts the runner down once it has been idle for long enough,
+// for scale-to-zero deployments.
+type IdleMonitor struct {
+	appConfig        *pkg.AppConfig
+	capacityReporter *CapacityReporter
+	httpClient       *http.Client
+	clock            clock.Clock
+}
+
+// NewIdleMonitor creates a new instance of IdleMonitor.
+func NewIdleMonitor(appConfig *pkg.AppConfig, capacityReporter *CapacityReporter) *IdleMonitor {
+	return &IdleMonitor{
+		appConfig:        appConfig,
+		capacityReporter: capacityReporter,
+		httpClient:       &http.Client{Timeout: idleWebhookTimeout},
+		clock:            clock.Real,
+	}
+}
+
+// Run watches the load until the runner has been idle for the configured
+// duration and no run has arrived during the grace window after notifying
+// the webhook. It returns true if the runner must shut down, or false if the
+// context has been cancelled.
+func (m *IdleMonitor) Run(ctx context.Context) bool {
+	ticker := m.clock.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+
+	idleSince := m.clock.Now()
+	arrivals := m.capacityReporter.Arrivals()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C():
+		}
+
+		// a draining runner is shutting down already
+		if m.capacityReporter.Draining() {
+			return false
+		}
+		if !m.idle(&arrivals) {
+			idleSince = m.clock.Now()
+			continue
+		}
+		if m.clock.Since(idleSince) < m.appConfig.IdleShutdownAfter {
+			continue
+		}
+
+		log.Info().Dur("idleFor", m.clock.Since(idleSince)).Msg("runner is idle, shutting down")
+		if m.appConfig.IdleShutdownWebhook != "" {
+			if err := m.notify(ctx); err != nil {
+				log.Error().Err(err).Msg("failed to call the idle shutdown webhook")
+			}
+		}
+
+		// giving the requests routed before the deregistration a chance to arrive
+		select {
+		case <-ctx.Done():
+			return false
+		case <-m.clock.After(m.appConfig.IdleShutdownGrace):
+		}
+		if m.idle(&arrivals) {
+			return true
+		}
+		log.Info().Msg("run arrived during the idle shutdown grace window, shutdown cancelled")
+		idleSince = m.clock.Now()
+	}
+}
+
+// idle reports whether no run is active or queued, and none has arrived since
+// the given count of arrivals, which is updated.
+func (m *IdleMonitor) idle(arrivals *uint64) bool {
+	capacity := m.capacityReporter.Snapshot()
+	current := m.capacityReporter.Arrivals()
+	idle := capacity.ActiveRuns == 0 && capacity.QueueDepth == 0 && current == *arrivals
+	*arrivals = current
+	return idle
+}
+
+// notify calls the idle shutdown webhook, so that the orchestrator can
+// deregister the runner.
+func (m *IdleMonitor) notify(ctx context.Context) error {
+	payload, err := json.Marshal(map[string]string{
+		"event": "idle_shutdown",
+		"addr":  m.appConfig.Addr,
+	})
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, m.appConfig.IdleShutdownWebhook, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := m.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", response.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/admission"
+	"github.com/Pelfox/codecell-runner/internal/clock"
+	"github.com/Pelfox/codecell-runner/internal/registry"
+	"github.com/Pelfox/codecell-runner/internal/services"
+	"github.com/Pelfox/codecell-runner/pkg"
+)
+
+const (
+	testIdleShutdownAfter = 5 * time.Minute
+	testIdleShutdownGrace = 30 * time.Second
+)
+
+// newTestIdleMonitor returns the idle monitor of a runner without runs on a
+// fake clock, notifying the webhook, if any. The queue of the runner holds a
+// single run, letting the tests keep one waiting.
+func newTestIdleMonitor(t *testing.T, webhook string) (*IdleMonitor, *CapacityReporter, *admission.Limiter, *clock.Fake) {
+	t.Helper()
+	config, _, err := pkg.LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.IdleShutdownAfter = testIdleShutdownAfter
+	config.IdleShutdownGrace = testIdleShutdownGrace
+	config.IdleShutdownWebhook = webhook
+	limiter := admission.NewLimiter(admission.GlobalScope, 1, 1, time.Hour, 0)
+	capacityReporter := NewCapacityReporter(config, registry.New(0, 10, time.Minute), limiter, nil,
+		services.NewLanguagesService(nil, config, nil), services.HostResources{})
+	idleMonitor := NewIdleMonitor(config, capacityReporter)
+	fake := clock.NewFake(time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC))
+	idleMonitor.clock = fake
+	return idleMonitor, capacityReporter, limiter, fake
+}
+
+// runIdleMonitor runs the idle monitor until the end of the test, returning
+// the channel of its outcome once it's checking the load.
+func runIdleMonitor(t *testing.T, idleMonitor *IdleMonitor, fake *clock.Fake) <-chan bool {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	shutdown := make(chan bool, 1)
+	go func() { shutdown <- idleMonitor.Run(ctx) }()
+	fake.AwaitTimers(1)
+	return shutdown
+}
+
+// await fails the test if fn, waiting on the idle monitor, doesn't return in time.
+func await(t *testing.T, what string, fn func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the idle monitor %s", what)
+	}
+}
+
+// advanceChecking advances the fake clock by d, checking that the idle
+// monitor is still checking the load then: it takes the ticks of the last
+// two checks, the first one being done once it takes the second.
+func advanceChecking(t *testing.T, fake *clock.Fake, shutdown <-chan bool, d time.Duration, when string) {
+	t.Helper()
+	fake.Advance(d - idleCheckInterval)
+	await(t, "to check the load", fake.AwaitTicks)
+	fake.Advance(idleCheckInterval)
+	await(t, "to check the load", fake.AwaitTicks)
+	select {
+	case result := <-shutdown:
+		t.Fatalf("the idle monitor returns %t %s", result, when)
+	default:
+	}
+}
+
+// awaitGrace advances the fake clock by the last check of the idle duration,
+// returning once the idle monitor waits for the grace window, on its ticker
+// and its timer.
+func awaitGrace(t *testing.T, fake *clock.Fake) {
+	t.Helper()
+	fake.Advance(idleCheckInterval)
+	await(t, "to wait for the grace window", func() { fake.AwaitTimers(2) })
+}
+
+// awaitShutdown advances the fake clock through the grace window, checking
+// that the idle monitor shuts the runner down only at its end.
+func awaitShutdown(t *testing.T, fake *clock.Fake, shutdown <-chan bool) {
+	t.Helper()
+	fake.Advance(testIdleShutdownGrace - time.Second)
+	select {
+	case result := <-shutdown:
+		t.Fatalf("the idle monitor returns %t during the grace window", result)
+	default:
+	}
+	fake.Advance(time.Second)
+	await(t, "to shut the runner down", func() {
+		if !<-shutdown {
+			t.Error("the idle monitor doesn't shut the idle runner down")
+		}
+	})
+}
+
+func TestIdleMonitorShutsDownOnceIdleThroughTheGrace(t *testing.T) {
+	notified := make(chan struct{}, 2)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		notified <- struct{}{}
+	}))
+	defer webhook.Close()
+	idleMonitor, _, _, fake := newTestIdleMonitor(t, webhook.URL)
+	shutdown := runIdleMonitor(t, idleMonitor, fake)
+
+	advanceChecking(t, fake, shutdown, testIdleShutdownAfter-idleCheckInterval, "before the idle duration")
+	if len(notified) != 0 {
+		t.Fatal("the webhook is notified before the idle duration")
+	}
+	awaitGrace(t, fake)
+	if len(notified) != 1 {
+		t.Fatal("the webhook isn't notified before the grace window")
+	}
+	awaitShutdown(t, fake, shutdown)
+}
+
+func TestIdleMonitorCancelsTheShutdownOnAnArrivalInTheGrace(t *testing.T) {
+	idleMonitor, capacityReporter, _, fake := newTestIdleMonitor(t, "")
+	shutdown := runIdleMonitor(t, idleMonitor, fake)
+
+	fake.Advance(testIdleShutdownAfter - idleCheckInterval)
+	awaitGrace(t, fake)
+	capacityReporter.RecordArrival()
+	fake.Advance(testIdleShutdownGrace)
+	// the tick missed during the grace window is taken once it's over
+	await(t, "to check the load", fake.AwaitTicks)
+
+	// the idle duration starts over from the end of the grace window
+	advanceChecking(t, fake, shutdown, testIdleShutdownAfter-idleCheckInterval, "once a run arrives in the grace window")
+	awaitGrace(t, fake)
+	awaitShutdown(t, fake, shutdown)
+}
+
+func TestIdleMonitorWaitsForTheQueuedRuns(t *testing.T) {
+	idleMonitor, _, limiter, fake := newTestIdleMonitor(t, "")
+	if _, err := limiter.Acquire(context.Background(), admission.PriorityNormal, nil); err != nil {
+		t.Fatalf("Acquire() = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	queued := make(chan struct{})
+	go func() {
+		_, _ = limiter.Acquire(ctx, admission.PriorityNormal, nil)
+		close(queued)
+	}()
+	for limiter.QueueDepth() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	shutdown := runIdleMonitor(t, idleMonitor, fake)
+	advanceChecking(t, fake, shutdown, 2*testIdleShutdownAfter, "with a run waiting in the queue")
+
+	// the idle duration starts with the last check of the queued run
+	cancel()
+	<-queued
+	advanceChecking(t, fake, shutdown, testIdleShutdownAfter-idleCheckInterval, "once the queue is empty")
+	awaitGrace(t, fake)
+	awaitShutdown(t, fake, shutdown)
+}
+
+func TestIdleMonitorStopsWhenDraining(t *testing.T) {
+	idleMonitor, capacityReporter, _, fake := newTestIdleMonitor(t, "")
+	shutdown := runIdleMonitor(t, idleMonitor, fake)
+
+	capacityReporter.SetDraining(true)
+	fake.Advance(idleCheckInterval)
+	await(t, "to stop", func() {
+		if <-shutdown {
+			t.Error("the idle monitor shuts the draining runner down itself")
+		}
+	})
+}
@@ -0,0 +1,39 @@
+package internal
+
+import (
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/admission"
+	"github.com/Pelfox/codecell-runner/internal/services"
+	"github.com/Pelfox/codecell-runner/pkg"
+)
+
+// NewLanguageLimiters creates the concurrency limiters of the languages, queued
+// separately under the global limit. Every language gets one, the unlimited
+// ones included, so that a reload can limit any of them.
+func NewLanguageLimiters(
+	languagesService *services.LanguagesService,
+	config *pkg.AppConfig,
+	preemptAfter time.Duration,
+) map[string]*admission.Limiter {
+	limiters := make(map[string]*admission.Limiter)
+	for _, language := range languagesService.Languages() {
+		languageConfig, _ := languagesService.Config(language, &config.DynamicConfig)
+		limiters[language] = admission.NewLimiter(language, languageConfig.Concurrency, config.QueueMaxDepth,
+			config.QueueMaxWait, preemptAfter)
+	}
+	return limiters
+}
+
+// SetLanguageLimits applies the concurrency limits and the queueing settings of
+// the snapshot to the limiters of the languages.
+func SetLanguageLimits(
+	limiters map[string]*admission.Limiter,
+	languagesService *services.LanguagesService,
+	dynamic *pkg.DynamicConfig,
+) {
+	for language, limiter := range limiters {
+		languageConfig, _ := languagesService.Config(language, dynamic)
+		limiter.SetLimits(languageConfig.Concurrency, dynamic.QueueMaxDepth, dynamic.QueueMaxWait)
+	}
+}
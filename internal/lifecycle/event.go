@@ -0,0 +1,76 @@
+package lifecycle
+
+import (
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/registry"
+)
+
+// EventType is the kind of a run lifecycle event.
+type EventType string
+
+const (
+	// EventStarted is emitted once the program has been started.
+	EventStarted EventType = "run.started"
+	// EventFinished is emitted when the program has exited, on its own or killed by the OOM killer.
+	EventFinished EventType = "run.finished"
+	// EventStopped is emitted when the run was timed out, stopped, preempted or cancelled while queued.
+	EventStopped EventType = "run.stopped"
+	// EventFailed is emitted when the runner failed to execute the program.
+	EventFailed EventType = "run.failed"
+)
+
+// Event is a structured run lifecycle event, serialized as JSON.
+type Event struct {
+	Type       EventType         `json:"type"`
+	RequestID  string            `json:"requestId"`
+	Language   string            `json:"language"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Time       time.Time         `json:"time"`
+	Outcome    registry.Outcome  `json:"outcome,omitempty"`
+	ExitCode   *int64            `json:"exitCode,omitempty"`
+	DurationMs int64             `json:"durationMs,omitempty"`
+	PeakMemory uint64            `json:"peakMemory,omitempty"`
+}
+
+// NewStartedEvent creates the event of the started run.
+func NewStartedEvent(run registry.Run) Event {
+	return Event{
+		Type:      EventStarted,
+		RequestID: run.RequestID,
+		Language:  run.Language,
+		Labels:    run.Labels,
+		Time:      time.Now(),
+	}
+}
+
+// NewTerminalEvent creates the single terminal event of the completed run.
+func NewTerminalEvent(completed registry.CompletedRun) Event {
+	event := Event{
+		Type:       terminalType(completed.Outcome),
+		RequestID:  completed.RequestID,
+		Language:   completed.Language,
+		Labels:     completed.Labels,
+		Time:       completed.FinishedAt,
+		Outcome:    completed.Outcome,
+		DurationMs: completed.FinishedAt.Sub(completed.CreatedAt).Milliseconds(),
+		PeakMemory: completed.Usage.PeakMemory,
+	}
+	if completed.ExitCode >= 0 {
+		exitCode := completed.ExitCode
+		event.ExitCode = &exitCode
+	}
+	return event
+}
+
+// terminalType returns the terminal event type of the outcome.
+func terminalType(outcome registry.Outcome) EventType {
+	switch outcome {
+	case registry.OutcomeSucceeded, registry.OutcomeFailed, registry.OutcomeOOMKilled:
+		return EventFinished
+	case registry.OutcomeTimedOut, registry.OutcomeStopped, registry.OutcomePreempted, registry.OutcomeCancelled:
+		return EventStopped
+	default:
+		return EventFailed
+	}
+}
@@ -0,0 +1,64 @@
+package lifecycle
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/registry"
+	"github.com/Pelfox/codecell-runner/internal/services"
+)
+
+func TestTerminalEventSerialization(t *testing.T) {
+	createdAt := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	completed := registry.CompletedRun{
+		Run: registry.Run{
+			RequestID: "run-1",
+			Language:  "perl",
+			Labels:    map[string]string{"tenant": "a"},
+			CreatedAt: createdAt,
+		},
+		Result:     registry.Result{Outcome: registry.OutcomeFailed, ExitCode: 3, Usage: services.Usage{PeakMemory: 1 << 20}},
+		FinishedAt: createdAt.Add(1500 * time.Millisecond),
+	}
+	payload, err := json.Marshal(NewTerminalEvent(completed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"type":"run.finished","requestId":"run-1","language":"perl","labels":{"tenant":"a"},` +
+		`"time":"2026-01-01T00:00:01.5Z","outcome":"failed","exitCode":3,"durationMs":1500,"peakMemory":1048576}`
+	if string(payload) != want {
+		t.Errorf("the terminal event is serialized as\n%s\nwant\n%s", payload, want)
+	}
+
+	// the runs that haven't exited on their own have no exit code
+	completed.Result = registry.Result{Outcome: registry.OutcomeTimedOut, ExitCode: -1}
+	completed.Labels = nil
+	payload, err = json.Marshal(NewTerminalEvent(completed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `{"type":"run.stopped","requestId":"run-1","language":"perl",` +
+		`"time":"2026-01-01T00:00:01.5Z","outcome":"timed_out","durationMs":1500}`
+	if string(payload) != want {
+		t.Errorf("the terminal event is serialized as\n%s\nwant\n%s", payload, want)
+	}
+}
+
+func TestTerminalTypeOfEveryOutcome(t *testing.T) {
+	tests := map[registry.Outcome]EventType{
+		registry.OutcomeSucceeded:   EventFinished,
+		registry.OutcomeFailed:      EventFinished,
+		registry.OutcomeOOMKilled:   EventFinished,
+		registry.OutcomeTimedOut:    EventStopped,
+		registry.OutcomeStopped:     EventStopped,
+		registry.OutcomePreempted:   EventStopped,
+		registry.OutcomeCancelled:   EventStopped,
+		registry.OutcomeSystemError: EventFailed,
+	}
+	for outcome, want := range tests {
+		if got := terminalType(outcome); got != want {
+			t.Errorf("terminalType(%q) = %q, want %q", outcome, got, want)
+		}
+	}
+}
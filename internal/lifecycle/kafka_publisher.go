@@ -0,0 +1,35 @@
+package lifecycle
+
+import (
+	"context"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// KafkaPublisher publishes the events to a Kafka topic, keyed by the request
+// ID so that the events of a run stay ordered within a partition.
+type KafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+// NewKafkaPublisher creates a new instance of KafkaPublisher writing to the
+// topic on the given brokers.
+func NewKafkaPublisher(brokers []string, topic string) *KafkaPublisher {
+	return &KafkaPublisher{writer: &kafka.Writer{
+		Addr:     kafka.TCP(brokers...),
+		Topic:    topic,
+		Balancer: &kafka.Hash{},
+	}}
+}
+
+func (p *KafkaPublisher) Publish(ctx context.Context, eventType EventType, key string, payload []byte) error {
+	return p.writer.WriteMessages(ctx, kafka.Message{
+		Key:     []byte(key),
+		Value:   payload,
+		Headers: []kafka.Header{{Key: "type", Value: []byte(eventType)}},
+	})
+}
+
+func (p *KafkaPublisher) Close() error {
+	return p.writer.Close()
+}
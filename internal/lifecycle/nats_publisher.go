@@ -0,0 +1,34 @@
+package lifecycle
+
+import (
+	"context"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NATSPublisher publishes the events to NATS, on the "<prefix>.<type>" subjects
+// with the request ID in the Codecell-Request-Id header.
+type NATSPublisher struct {
+	connection *nats.Conn
+	prefix     string
+}
+
+// NewNATSPublisher creates a new instance of NATSPublisher connected to the given server.
+func NewNATSPublisher(url string, prefix string) (*NATSPublisher, error) {
+	connection, err := nats.Connect(url, nats.Name("codecell-runner"))
+	if err != nil {
+		return nil, err
+	}
+	return &NATSPublisher{connection, prefix}, nil
+}
+
+func (p *NATSPublisher) Publish(_ context.Context, eventType EventType, key string, payload []byte) error {
+	message := nats.NewMsg(p.prefix + "." + string(eventType))
+	message.Header.Set("Codecell-Request-Id", key)
+	message.Data = payload
+	return p.connection.PublishMsg(message)
+}
+
+func (p *NATSPublisher) Close() error {
+	return p.connection.Drain()
+}
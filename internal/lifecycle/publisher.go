@@ -0,0 +1,80 @@
+package lifecycle
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/metrics"
+	"github.com/rs/zerolog/log"
+)
+
+// publishTimeout is the maximum duration of publishing a single event.
+const publishTimeout = 5 * time.Second
+
+// Publisher delivers the serialized events to a message broker.
+type Publisher interface {
+	// Publish delivers the event payload of the given type, keyed by the request ID.
+	Publish(ctx context.Context, eventType EventType, key string, payload []byte) error
+	// Close flushes the pending events and releases the connections.
+	Close() error
+}
+
+// Dispatcher publishes the events in the background through a bounded
+// buffer, so that a slow broker can never stall the runs. Events that don't
+// fit into the buffer are dropped and counted.
+type Dispatcher struct {
+	publisher Publisher
+	events    chan Event
+}
+
+// NewDispatcher creates a new instance of Dispatcher buffering up to
+// bufferSize events. A nil dispatcher is valid and drops all events silently.
+func NewDispatcher(publisher Publisher, bufferSize int) *Dispatcher {
+	return &Dispatcher{publisher: publisher, events: make(chan Event, bufferSize)}
+}
+
+// Emit queues the event without blocking.
+func (d *Dispatcher) Emit(event Event) {
+	if d == nil {
+		return
+	}
+	select {
+	case d.events <- event:
+	default:
+		metrics.LifecycleEventsDropped.Inc()
+	}
+}
+
+// Run publishes the queued events until the context is cancelled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	defer d.publisher.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-d.events:
+			d.publish(ctx, event)
+		}
+	}
+}
+
+// publish serializes and delivers a single event.
+func (d *Dispatcher) publish(ctx context.Context, event Event) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Error().Err(err).Str("requestID", event.RequestID).Msg("failed to serialize the lifecycle event")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, publishTimeout)
+	defer cancel()
+	if err := d.publisher.Publish(ctx, event.Type, event.RequestID, payload); err != nil {
+		metrics.LifecycleEventsFailed.Inc()
+		log.Error().Err(err).
+			Str("requestID", event.RequestID).
+			Str("type", string(event.Type)).
+			Msg("failed to publish the lifecycle event")
+	}
+}
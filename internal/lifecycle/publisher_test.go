@@ -0,0 +1,113 @@
+package lifecycle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// published is an event delivered to the fake publisher.
+type published struct {
+	eventType EventType
+	key       string
+	event     Event
+}
+
+// fakePublisher sends the events it's given, failing those of failType.
+type fakePublisher struct {
+	failType  EventType
+	published chan published
+	closed    chan struct{}
+}
+
+func newFakePublisher(failType EventType) *fakePublisher {
+	return &fakePublisher{failType: failType, published: make(chan published, 16), closed: make(chan struct{})}
+}
+
+func (p *fakePublisher) Publish(_ context.Context, eventType EventType, key string, payload []byte) error {
+	if eventType == p.failType {
+		return errors.New("broker unavailable")
+	}
+	var event Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return err
+	}
+	p.published <- published{eventType: eventType, key: key, event: event}
+	return nil
+}
+
+func (p *fakePublisher) Close() error {
+	close(p.closed)
+	return nil
+}
+
+// awaitPublished returns the next event delivered to the publisher.
+func awaitPublished(t *testing.T, publisher *fakePublisher) published {
+	t.Helper()
+	select {
+	case delivered := <-publisher.published:
+		return delivered
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event is published")
+		return published{}
+	}
+}
+
+func TestDispatcherPublishesTheEventsInOrder(t *testing.T) {
+	publisher := newFakePublisher(EventFailed)
+	dispatcher := NewDispatcher(publisher, 8)
+	dispatcher.Emit(Event{Type: EventStarted, RequestID: "run-1", Language: "perl"})
+	// a failed delivery doesn't hold the next ones
+	dispatcher.Emit(Event{Type: EventFailed, RequestID: "run-2"})
+	dispatcher.Emit(Event{Type: EventFinished, RequestID: "run-1", Outcome: "succeeded"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		dispatcher.Run(ctx)
+		close(done)
+	}()
+	for _, want := range []Event{
+		{Type: EventStarted, RequestID: "run-1", Language: "perl"},
+		{Type: EventFinished, RequestID: "run-1", Outcome: "succeeded"},
+	} {
+		delivered := awaitPublished(t, publisher)
+		if delivered.eventType != want.Type || delivered.key != want.RequestID ||
+			delivered.event.Type != want.Type || delivered.event.Outcome != want.Outcome {
+			t.Errorf("published %s of %q with %+v, want %+v", delivered.eventType, delivered.key, delivered.event, want)
+		}
+	}
+
+	cancel()
+	<-done
+	select {
+	case <-publisher.closed:
+	default:
+		t.Error("the publisher isn't closed once the dispatcher stops")
+	}
+}
+
+func TestDispatcherDropsTheEventsOverTheBuffer(t *testing.T) {
+	publisher := newFakePublisher("")
+	dispatcher := NewDispatcher(publisher, 1)
+	dispatcher.Emit(Event{Type: EventStarted, RequestID: "kept"})
+	dispatcher.Emit(Event{Type: EventStarted, RequestID: "dropped"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go dispatcher.Run(ctx)
+	if delivered := awaitPublished(t, publisher); delivered.key != "kept" {
+		t.Errorf("published the event of %q first, want the buffered one", delivered.key)
+	}
+	select {
+	case delivered := <-publisher.published:
+		t.Errorf("published the event of %q over the buffer", delivered.key)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// a nil dispatcher drops the events
+	var disabled *Dispatcher
+	disabled.Emit(Event{Type: EventStarted})
+}
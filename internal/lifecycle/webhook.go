@@ -0,0 +1,170 @@
+package lifecycle
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/metrics"
+	"github.com/Pelfox/codecell-runner/internal/registry"
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// webhookAttemptTimeout is the maximum duration of a single delivery attempt.
+	webhookAttemptTimeout = 10 * time.Second
+	// webhookInitialBackoff is the delay before the first retry, doubled after every attempt.
+	webhookInitialBackoff = time.Second
+	// webhookSignatureHeader carries the HMAC-SHA256 signature of the body.
+	webhookSignatureHeader = "X-Codecell-Signature"
+)
+
+// ErrWebhookHostNotAllowed is returned for callback URLs outside the allowlist.
+var ErrWebhookHostNotAllowed = errors.New("callback host is not allowlisted")
+
+// Completion is the JSON body POSTed to the callback URL of a completed run.
+type Completion struct {
+	RequestID       string            `json:"requestId"`
+	Language        string            `json:"language"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Outcome         registry.Outcome  `json:"outcome"`
+	ExitCode        *int64            `json:"exitCode,omitempty"`
+	CreatedAt       time.Time         `json:"createdAt"`
+	FinishedAt      time.Time         `json:"finishedAt"`
+	DurationMs      int64             `json:"durationMs"`
+	CPUSeconds      float64           `json:"cpuSeconds"`
+	PeakMemory      uint64            `json:"peakMemory"`
+	OutputTail      string            `json:"outputTail"`
+	OutputTruncated bool              `json:"outputTruncated"`
+	ArchiveURL      string            `json:"archiveUrl,omitempty"`
+}
+
+// WebhookNotifier POSTs the signed completions of runs to their callback URLs.
+// Deliveries are retried with a backoff until the total deadline, and never
+// affect the result of the run.
+type WebhookNotifier struct {
+	appConfig  *pkg.AppConfig
+	httpClient *http.Client
+}
+
+// NewWebhookNotifier creates a new instance of WebhookNotifier.
+func NewWebhookNotifier(appConfig *pkg.AppConfig) *WebhookNotifier {
+	return &WebhookNotifier{
+		appConfig: appConfig,
+		httpClient: &http.Client{
+			Timeout: webhookAttemptTimeout,
+			// a redirect could lead anywhere, the allowlist applies to the final target
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+	}
+}
+
+// Validate checks that the callback URL can be delivered to.
+func (n *WebhookNotifier) Validate(callbackURL string) error {
+	parsed, err := url.Parse(callbackURL)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Hostname() == "" {
+		return fmt.Errorf("invalid callback URL %q", callbackURL)
+	}
+	if !slices.Contains(n.appConfig.WebhookAllowedHosts, strings.ToLower(parsed.Hostname())) {
+		return ErrWebhookHostNotAllowed
+	}
+	return nil
+}
+
+// Notify delivers the completion of the run in the background. The delivery
+// outlives ctx, which only carries the logger of the run.
+func (n *WebhookNotifier) Notify(ctx context.Context, callbackURL string, completed registry.CompletedRun, output *pkg.TailBuffer) {
+	logger := zerolog.Ctx(ctx)
+	completion := Completion{
+		RequestID:       completed.RequestID,
+		Language:        completed.Language,
+		Labels:          completed.Labels,
+		Outcome:         completed.Outcome,
+		CreatedAt:       completed.CreatedAt,
+		FinishedAt:      completed.FinishedAt,
+		DurationMs:      completed.FinishedAt.Sub(completed.CreatedAt).Milliseconds(),
+		CPUSeconds:      completed.Usage.CPUSeconds,
+		PeakMemory:      completed.Usage.PeakMemory,
+		OutputTail:      output.String(),
+		OutputTruncated: output.Truncated(),
+		ArchiveURL:      completed.ArchiveURL,
+	}
+	if completed.ExitCode >= 0 {
+		exitCode := completed.ExitCode
+		completion.ExitCode = &exitCode
+	}
+
+	go func() {
+		if err := n.deliver(logger, callbackURL, completion); err != nil {
+			metrics.WebhookDeliveries.WithLabelValues("failed").Inc()
+			logger.Error().Err(err).
+				Str("callbackURL", callbackURL).
+				Msg("failed to deliver the completion webhook")
+			return
+		}
+		metrics.WebhookDeliveries.WithLabelValues("delivered").Inc()
+	}()
+}
+
+// deliver POSTs the completion until it's accepted or the deadline passes.
+func (n *WebhookNotifier) deliver(logger *zerolog.Logger, callbackURL string, completion Completion) error {
+	body, err := json.Marshal(completion)
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, []byte(n.appConfig.WebhookSecret))
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.appConfig.WebhookDeadline)
+	defer cancel()
+
+	backoff := webhookInitialBackoff
+	for {
+		err = n.attempt(ctx, callbackURL, body, signature)
+		if err == nil {
+			return nil
+		}
+		logger.Warn().Err(err).
+			Dur("backoff", backoff).
+			Msg("completion webhook attempt failed, retrying")
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// attempt makes a single delivery attempt.
+func (n *WebhookNotifier) attempt(ctx context.Context, callbackURL string, body []byte, signature string) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(webhookSignatureHeader, signature)
+
+	response, err := n.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("callback responded with status %d", response.StatusCode)
+	}
+	return nil
+}
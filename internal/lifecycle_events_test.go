@@ -0,0 +1,105 @@
+package internal_test
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"testing"
+
+	v1 "github.com/Pelfox/codecell-runner/generated"
+	"github.com/Pelfox/codecell-runner/internal/dockertest"
+	"github.com/Pelfox/codecell-runner/internal/lifecycle"
+	"github.com/Pelfox/codecell-runner/internal/registry"
+	"github.com/Pelfox/codecell-runner/internal/runnertest"
+	"github.com/Pelfox/codecell-runner/pkg"
+)
+
+// checkEvents checks the types of the lifecycle events of the run, and the
+// outcome of the last one.
+func checkEvents(t *testing.T, runner *runnertest.Runner, stream *runnertest.Stream, outcome registry.Outcome, types ...lifecycle.EventType) {
+	t.Helper()
+	messages := stream.Messages()
+	if len(messages) == 0 {
+		t.Fatal("the run has sent no message")
+	}
+	events := runner.Events.Of(t, messages[0].RequestId)
+	var got []lifecycle.EventType
+	for _, event := range events {
+		got = append(got, event.Type)
+	}
+	if !slices.Equal(got, types) {
+		t.Fatalf("the run has published the events %q, want %q", got, types)
+	}
+	if last := events[len(events)-1]; last.Outcome != outcome {
+		t.Errorf("the terminal event has the outcome %q, want %q", last.Outcome, outcome)
+	}
+}
+
+func TestRunPublishesASingleTerminalEvent(t *testing.T) {
+	tests := []struct {
+		name      string
+		program   dockertest.Program
+		timeout   int32
+		operation string // failed, if any
+		outcome   registry.Outcome
+		types     []lifecycle.EventType
+	}{
+		{name: "exit 0", program: printing(0), outcome: registry.OutcomeSucceeded,
+			types: []lifecycle.EventType{lifecycle.EventStarted, lifecycle.EventFinished}},
+		{name: "exit 1", program: printing(1), outcome: registry.OutcomeFailed,
+			types: []lifecycle.EventType{lifecycle.EventStarted, lifecycle.EventFinished}},
+		{name: "oom killed", outcome: registry.OutcomeOOMKilled,
+			program: func(*dockertest.Process) dockertest.Exit {
+				return dockertest.Exit{Code: 137, OOMKilled: true}
+			},
+			types: []lifecycle.EventType{lifecycle.EventStarted, lifecycle.EventFinished}},
+		{name: "timeout", program: sleeping("sleeping"), timeout: 1, outcome: registry.OutcomeTimedOut,
+			types: []lifecycle.EventType{lifecycle.EventStarted, lifecycle.EventStopped}},
+		{name: "failed creation", program: printing(0), operation: dockertest.OperationCreate,
+			outcome: registry.OutcomeSystemError, types: []lifecycle.EventType{lifecycle.EventFailed}},
+		{name: "failed wait", program: sleeping("sleeping"), operation: dockertest.OperationWait,
+			outcome: registry.OutcomeSystemError, types: []lifecycle.EventType{lifecycle.EventStarted, lifecycle.EventFailed}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			runner := runnertest.New(t, nil)
+			runner.Daemon.SetProgram(test.program)
+			if test.operation != "" {
+				runner.Daemon.Fail(test.operation, http.StatusInternalServerError, "injected failure")
+			}
+			request := runRequest()
+			request.TimeoutSeconds = test.timeout
+
+			stream, _ := runner.Run(context.Background(), request)
+			checkEvents(t, runner, stream, test.outcome, test.types...)
+		})
+	}
+}
+
+func TestStoppedRunPublishesASingleTerminalEvent(t *testing.T) {
+	runner := runnertest.New(t, func(config *pkg.AppConfig) {
+		config.MaxConcurrentRuns = 1
+		config.QueueMaxDepth = 1
+	})
+	runner.Daemon.SetProgram(sleeping("sleeping"))
+	stream, runningDone := runner.Start(context.Background(), runRequest())
+	running := stream.Await(v1.MessageLevel_STDOUT)
+	if running == nil {
+		t.Fatal("the program hasn't started")
+	}
+	queued, queuedDone := startQueued(t, runner, 1)
+
+	// the queued run is cancelled without ever starting
+	if _, err := runner.Server.Stop(context.Background(), &v1.StopRequest{RequestId: queued[0].Messages()[0].RequestId}); err != nil {
+		t.Fatalf("Stop() of the queued run = %v", err)
+	}
+	<-queuedDone[0]
+	checkEvents(t, runner, queued[0], registry.OutcomeCancelled, lifecycle.EventStopped)
+
+	if _, err := runner.Server.Stop(context.Background(), &v1.StopRequest{RequestId: running.RequestId}); err != nil {
+		t.Fatalf("Stop() of the running run = %v", err)
+	}
+	<-runningDone
+	checkEvents(t, runner, stream, registry.OutcomeStopped, lifecycle.EventStarted, lifecycle.EventStopped)
+}
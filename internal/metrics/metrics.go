@@ -0,0 +1,214 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// AdmissionRejections counts the runs rejected before creating a container, by reason.
+var AdmissionRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "codecell",
+	Name:      "admission_rejections_total",
+	Help:      "Number of runs rejected by the admission control.",
+}, []string{"reason"})
+
+// DiskUsageRatio is the used fraction of the disk backing the Docker storage.
+var DiskUsageRatio = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "codecell",
+	Name:      "disk_usage_ratio",
+	Help:      "Used fraction of the disk backing the Docker storage.",
+})
+
+// RunCPUSeconds accumulates the CPU time consumed by runs, by language.
+var RunCPUSeconds = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "codecell",
+	Name:      "run_cpu_seconds_total",
+	Help:      "CPU time consumed by runs.",
+}, []string{"language"})
+
+// RunMemoryByteSeconds accumulates the memory working set of runs integrated over time, by language.
+var RunMemoryByteSeconds = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "codecell",
+	Name:      "run_memory_byte_seconds_total",
+	Help:      "Memory working set of runs integrated over time.",
+}, []string{"language"})
+
+// runStageBuckets are the buckets of the durations of the stages of the runs,
+// from the instant ones to the longest timeouts.
+var runStageBuckets = prometheus.ExponentialBuckets(0.01, 2.5, 12)
+
+// RunQueueWaitSeconds observes the time the runs have waited for the admission, by language.
+var RunQueueWaitSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "codecell",
+	Name:      "run_queue_wait_seconds",
+	Help:      "Time the runs have waited for the admission.",
+	Buckets:   runStageBuckets,
+}, []string{"language"})
+
+// RunSetupSeconds observes the time from the admission to the start of the
+// program of the runs, the boot of the runtime included, by language.
+var RunSetupSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "codecell",
+	Name:      "run_setup_seconds",
+	Help:      "Time from the admission of the runs to the start of their program.",
+	Buckets:   runStageBuckets,
+}, []string{"language"})
+
+// RunExecutionSeconds observes the time the programs of the runs have executed
+// until they exited, by language.
+var RunExecutionSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "codecell",
+	Name:      "run_execution_seconds",
+	Help:      "Time the programs of the runs have executed until they exited.",
+	Buckets:   runStageBuckets,
+}, []string{"language"})
+
+// RunSlotsInUse is the number of concurrency slots taken by executing runs, by
+// scope: "global" or the language.
+var RunSlotsInUse = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "codecell",
+	Name:      "run_slots_in_use",
+	Help:      "Number of concurrency slots taken by executing runs.",
+}, []string{"scope"})
+
+// AdmissionQueueDepth is the number of runs waiting for a concurrency slot, by scope.
+var AdmissionQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "codecell",
+	Name:      "admission_queue_depth",
+	Help:      "Number of runs waiting for a concurrency slot.",
+}, []string{"scope"})
+
+// QuotaRejections counts the runs rejected by the client quotas, by hashed identity and quota.
+var QuotaRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "codecell",
+	Name:      "quota_rejections_total",
+	Help:      "Number of runs rejected by the client quotas.",
+}, []string{"identity", "quota"})
+
+// IdentityActiveRuns is the number of active runs of a client, by hashed identity.
+var IdentityActiveRuns = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "codecell",
+	Name:      "identity_active_runs",
+	Help:      "Number of active runs of a client identity.",
+}, []string{"identity"})
+
+// Preemptions counts the runs preempted by higher priority runs, by scope.
+var Preemptions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "codecell",
+	Name:      "preemptions_total",
+	Help:      "Number of runs preempted by higher priority runs.",
+}, []string{"scope"})
+
+// WarmPoolHits counts the runs served by a warm pool container, by language.
+var WarmPoolHits = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "codecell",
+	Name:      "warm_pool_hits_total",
+	Help:      "Number of runs served by a warm pool container.",
+}, []string{"language"})
+
+// WarmPoolMisses counts the runs of pooled languages that found the pool empty, by language.
+var WarmPoolMisses = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "codecell",
+	Name:      "warm_pool_misses_total",
+	Help:      "Number of runs of pooled languages that found the pool empty.",
+}, []string{"language"})
+
+// WarmPoolSavedSeconds accumulates the container creation latency saved by the warm pool, by language.
+var WarmPoolSavedSeconds = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "codecell",
+	Name:      "warm_pool_saved_seconds_total",
+	Help:      "Container creation latency saved by the warm pool.",
+}, []string{"language"})
+
+// WarmPoolIdle is the number of idle warm pool containers, by language.
+var WarmPoolIdle = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "codecell",
+	Name:      "warm_pool_idle",
+	Help:      "Number of idle warm pool containers.",
+}, []string{"language"})
+
+// WarmPoolTargetSize is the warm pool size chosen by the autoscaler, by language.
+var WarmPoolTargetSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "codecell",
+	Name:      "warm_pool_target_size",
+	Help:      "Warm pool size chosen by the autoscaler.",
+}, []string{"language"})
+
+// LifecycleEventsDropped counts the lifecycle events dropped because the buffer was full.
+var LifecycleEventsDropped = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "codecell",
+	Name:      "lifecycle_events_dropped_total",
+	Help:      "Number of lifecycle events dropped because the buffer was full.",
+})
+
+// LifecycleEventsFailed counts the lifecycle events the broker failed to accept.
+var LifecycleEventsFailed = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "codecell",
+	Name:      "lifecycle_events_failed_total",
+	Help:      "Number of lifecycle events the broker failed to accept.",
+})
+
+// WebhookDeliveries counts the completion webhook deliveries, by result: delivered or failed.
+var WebhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "codecell",
+	Name:      "webhook_deliveries_total",
+	Help:      "Number of completion webhook deliveries.",
+}, []string{"result"})
+
+// RunStoreFailures counts the completed runs the store failed to persist.
+var RunStoreFailures = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "codecell",
+	Name:      "run_store_failures_total",
+	Help:      "Number of completed runs the store failed to persist.",
+})
+
+// ArchiveUploads counts the uploads of run outputs to the object storage, by result: uploaded or failed.
+var ArchiveUploads = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "codecell",
+	Name:      "archive_uploads_total",
+	Help:      "Number of run output uploads to the object storage.",
+}, []string{"result"})
+
+// AuditWriteFailures counts the audit log entries that failed to be written.
+var AuditWriteFailures = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "codecell",
+	Name:      "audit_write_failures_total",
+	Help:      "Number of audit log entries that failed to be written.",
+})
+
+// CoalescedRuns counts the runs attached to an identical run in flight instead of executing.
+var CoalescedRuns = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "codecell",
+	Name:      "coalesced_runs_total",
+	Help:      "Number of runs attached to an identical run in flight.",
+})
+
+// BuildCacheLookups counts the lookups of the build cache, by result: hit or miss.
+var BuildCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "codecell",
+	Name:      "build_cache_lookups_total",
+	Help:      "Number of lookups of the build outputs cache.",
+}, []string{"result"})
+
+// BuildCacheSizeBytes is the total size of the cached build outputs.
+var BuildCacheSizeBytes = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "codecell",
+	Name:      "build_cache_size_bytes",
+	Help:      "Total size of the cached build outputs.",
+})
+
+// Panics counts the panics recovered from the RPC handlers, by method.
+var Panics = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "codecell",
+	Name:      "panics_total",
+	Help:      "Number of panics recovered from the RPC handlers.",
+}, []string{"method"})
+
+// RejectedRequestSizes observes the sizes of the requests rejected for
+// exceeding the limit of their method, by method.
+var RejectedRequestSizes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "codecell",
+	Name:      "rejected_request_size_bytes",
+	Help:      "Serialized sizes of the requests rejected for exceeding the limit of their method.",
+	Buckets:   prometheus.ExponentialBuckets(64<<10, 4, 8),
+}, []string{"method"})
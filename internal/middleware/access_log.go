@@ -0,0 +1,136 @@
+package middleware
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// CorrelationMetadataKey is the metadata key carrying the correlation ID
+	// of the RPC, echoed back in the response headers.
+	CorrelationMetadataKey = "x-request-id"
+	// maxCorrelationIDLength is the maximum length of a supplied correlation ID.
+	maxCorrelationIDLength = 128
+)
+
+// correlationID returns the correlation ID supplied by the caller, if it's
+// safe to be logged, or a new one.
+func correlationID(ctx context.Context) string {
+	values := metadata.ValueFromIncomingContext(ctx, CorrelationMetadataKey)
+	if len(values) > 0 && values[0] != "" && len(values[0]) <= maxCorrelationIDLength {
+		valid := true
+		for _, r := range values[0] {
+			if r > unicode.MaxASCII || !unicode.IsPrint(r) {
+				valid = false
+				break
+			}
+		}
+		if valid {
+			return values[0]
+		}
+	}
+	return uuid.NewString()
+}
+
+// withCorrelation attaches the annotations and the logger carrying the
+// correlation ID to the context, as well as the ID of the trace continued from
+// the caller, so that every entry logged through zerolog.Ctx is correlated
+// with the RPC and the logs of the other services.
+func withCorrelation(ctx context.Context) (context.Context, string, *Annotations) {
+	id := correlationID(ctx)
+	ctx, annotations := WithAnnotations(ctx)
+	logContext := log.With().Str("correlationID", id)
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.HasTraceID() {
+		logContext = logContext.Str("traceID", spanContext.TraceID().String())
+	}
+	return logContext.Logger().WithContext(ctx), id, annotations
+}
+
+// WithLogFields returns a copy of the context carrying its logger with the
+// given key-value pairs added, for the entries logged through zerolog.Ctx from
+// then on, e.g. by the services the context is passed to.
+func WithLogFields(ctx context.Context, keyValues ...string) context.Context {
+	logContext := zerolog.Ctx(ctx).With()
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		logContext = logContext.Str(keyValues[i], keyValues[i+1])
+	}
+	return logContext.Logger().WithContext(ctx)
+}
+
+// logAccess writes the access log line of the finished RPC.
+func logAccess(ctx context.Context, method string, annotations *Annotations, startedAt time.Time, err error) *zerolog.Event {
+	var peerAddress string
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		peerAddress = p.Addr.String()
+	}
+	event := zerolog.Ctx(ctx).Info().
+		Str("method", method).
+		Str("peer", peerAddress).
+		Str("identity", annotations.Identity()).
+		Dur("duration", time.Since(startedAt)).
+		Str("code", status.Code(err).String())
+	if requestID := annotations.RequestID(); requestID != "" {
+		event = event.Str("requestID", requestID)
+	}
+	return event
+}
+
+// AccessLogUnaryInterceptor logs a line for every unary RPC.
+func AccessLogUnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		startedAt := time.Now()
+		ctx, id, annotations := withCorrelation(ctx)
+		_ = grpc.SetHeader(ctx, metadata.Pairs(CorrelationMetadataKey, id))
+
+		resp, err := handler(ctx, req)
+		logAccess(ctx, info.FullMethod, annotations, startedAt, err).Msg("rpc finished")
+		return resp, err
+	}
+}
+
+// countingStream counts the messages sent to the wrapped server stream.
+type countingStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	sent atomic.Int64
+}
+
+func (s *countingStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *countingStream) SendMsg(m any) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.sent.Add(1)
+	}
+	return err
+}
+
+// AccessLogStreamInterceptor logs a line for every streaming RPC, including
+// the number of messages sent.
+func AccessLogStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		startedAt := time.Now()
+		ctx, id, annotations := withCorrelation(stream.Context())
+		_ = stream.SetHeader(metadata.Pairs(CorrelationMetadataKey, id))
+
+		counted := &countingStream{ServerStream: stream, ctx: ctx}
+		err := handler(srv, counted)
+		logAccess(ctx, info.FullMethod, annotations, startedAt, err).
+			Int64("messages", counted.sent.Load()).
+			Msg("rpc finished")
+		return err
+	}
+}
@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc"
+)
+
+// Annotations are the details the handlers attach to their RPC for the
+// interceptors, such as the request ID of a run, known only once it starts.
+type Annotations struct {
+	mutex        sync.Mutex
+	requestID    string
+	requestIDSet chan struct{} // closed once the request ID is set
+	identity     string
+}
+
+// annotationsKey is the context key of the RPC annotations.
+type annotationsKey struct{}
+
+// WithAnnotations returns a copy of the context carrying empty annotations,
+// unless it carries some already.
+func WithAnnotations(ctx context.Context) (context.Context, *Annotations) {
+	if annotations := AnnotationsFromContext(ctx); annotations != nil {
+		return ctx, annotations
+	}
+	annotations := &Annotations{requestIDSet: make(chan struct{})}
+	return context.WithValue(ctx, annotationsKey{}, annotations), annotations
+}
+
+// AnnotationsFromContext returns the annotations of the RPC, or nil if the
+// context doesn't carry any; the methods of nil annotations do nothing.
+func AnnotationsFromContext(ctx context.Context) *Annotations {
+	annotations, _ := ctx.Value(annotationsKey{}).(*Annotations)
+	return annotations
+}
+
+// SetRequestID records the request ID of the run served by the RPC.
+func (a *Annotations) SetRequestID(requestID string) {
+	if a == nil || requestID == "" {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.requestID == "" {
+		close(a.requestIDSet)
+	}
+	a.requestID = requestID
+}
+
+// RequestIDSet returns the channel closed once the request ID is known.
+func (a *Annotations) RequestIDSet() <-chan struct{} {
+	return a.requestIDSet
+}
+
+// RequestID returns the request ID of the run, empty if it isn't known.
+func (a *Annotations) RequestID() string {
+	if a == nil {
+		return ""
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.requestID
+}
+
+// SetIdentity records the identity of the authenticated caller.
+func (a *Annotations) SetIdentity(identity string) {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.identity = identity
+}
+
+// Identity returns the identity of the caller, empty if it isn't identified.
+func (a *Annotations) Identity() string {
+	if a == nil {
+		return ""
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.identity
+}
+
+// annotatedStream overrides the context of the wrapped server stream.
+type annotatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *annotatedStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"context"
+	"runtime/debug"
+
+	"github.com/Pelfox/codecell-runner/internal/metrics"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// recoverPanic converts the panic of a handler, if any, into the INTERNAL
+// status of its RPC, so that the other RPCs keep being served. The deferred
+// functions of the handler, such as the container cleanup, have already run
+// by the time it's called.
+func recoverPanic(ctx context.Context, method string, annotations *Annotations, err *error) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+	metrics.Panics.WithLabelValues(method).Inc()
+	zerolog.Ctx(ctx).Error().Str("method", method).
+		Str("requestID", annotations.RequestID()).
+		Interface("panic", recovered).
+		Str("stack", string(debug.Stack())).
+		Msg("recovered from a panic in the handler")
+	*err = status.Error(codes.Internal, "internal server error")
+}
+
+// RecoverGoroutine recovers from the panic of a background goroutine of the
+// run, if any, so that it ends alone instead of taking the process down. It
+// must be deferred directly, ctx carrying the logger of the run.
+func RecoverGoroutine(ctx context.Context, name string) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+	metrics.Panics.WithLabelValues(name).Inc()
+	zerolog.Ctx(ctx).Error().Str("goroutine", name).
+		Interface("panic", recovered).
+		Str("stack", string(debug.Stack())).
+		Msg("recovered from a panic in a background goroutine")
+}
+
+// RecoveryUnaryInterceptor recovers from the panics of unary handlers.
+func RecoveryUnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+		ctx, annotations := WithAnnotations(ctx)
+		defer recoverPanic(ctx, info.FullMethod, annotations, &err)
+		return handler(ctx, req)
+	}
+}
+
+// RecoveryStreamInterceptor recovers from the panics of streaming handlers.
+func RecoveryStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		ctx, annotations := WithAnnotations(stream.Context())
+		defer recoverPanic(ctx, info.FullMethod, annotations, &err)
+		return handler(srv, &annotatedStream{ServerStream: stream, ctx: ctx})
+	}
+}
@@ -0,0 +1,149 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// panicService is the service of the health checks whose handlers panic.
+const panicService = "panic"
+
+// syncBuffer is a buffer the handlers of concurrent RPCs can log to.
+type syncBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+// serveRecovering serves the health checks behind the recovery interceptors,
+// logging to logs, the handlers of panicService panicking once they have set
+// the request ID of their RPC.
+func serveRecovering(t *testing.T, logs *syncBuffer) healthpb.HealthClient {
+	t.Helper()
+	logger := zerolog.New(logs)
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(
+			func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+				return handler(logger.WithContext(ctx), req)
+			},
+			RecoveryUnaryInterceptor(),
+			func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+				if req.(*healthpb.HealthCheckRequest).Service == panicService {
+					AnnotationsFromContext(ctx).SetRequestID("unary-run")
+					panic("unary handler bug")
+				}
+				return handler(ctx, req)
+			},
+		),
+		grpc.ChainStreamInterceptor(
+			func(srv any, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				return handler(srv, &annotatedStream{ServerStream: stream, ctx: logger.WithContext(stream.Context())})
+			},
+			RecoveryStreamInterceptor(),
+			func(srv any, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				var request healthpb.HealthCheckRequest
+				if err := stream.RecvMsg(&request); err != nil {
+					return err
+				}
+				if request.Service == panicService {
+					panic("stream handler bug")
+				}
+				return stream.SendMsg(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING})
+			},
+		),
+	)
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return healthpb.NewHealthClient(conn)
+}
+
+func TestRecoveryKeepsServingAfterAPanic(t *testing.T) {
+	var logs syncBuffer
+	client := serveRecovering(t, &logs)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for range 2 {
+		_, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: panicService})
+		if status.Code(err) != codes.Internal || strings.Contains(err.Error(), "bug") {
+			t.Errorf("Check() of the panicking handler = %v, want INTERNAL without the panic", err)
+		}
+		if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+			t.Errorf("Check() after the panic = %v", err)
+		}
+	}
+
+	for _, test := range []struct {
+		service string
+		code    codes.Code
+	}{
+		{service: panicService, code: codes.Internal},
+		{service: "", code: codes.OK},
+	} {
+		stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{Service: test.service})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := stream.Recv(); status.Code(err) != test.code {
+			t.Errorf("Watch() of %q = %v, want %s", test.service, err, test.code)
+		}
+	}
+
+	entries := logs.String()
+	if got := strings.Count(entries, "recovered from a panic in the handler"); got != 3 {
+		t.Errorf("%d panics logged, want 3:\n%s", got, entries)
+	}
+	if !strings.Contains(entries, `"requestID":"unary-run"`) || !strings.Contains(entries, `"panic":"unary handler bug"`) {
+		t.Errorf("the panic isn't logged with its run:\n%s", entries)
+	}
+}
+
+func TestRecoverGoroutineEndsTheGoroutineAlone(t *testing.T) {
+	var logs syncBuffer
+	ctx := zerolog.New(&logs).WithContext(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer RecoverGoroutine(ctx, "stats")
+		panic("goroutine bug")
+	}()
+	<-done
+	if entries := logs.String(); !strings.Contains(entries, `"goroutine":"stats"`) || !strings.Contains(entries, "goroutine bug") {
+		t.Errorf("the panic of the goroutine isn't logged:\n%s", entries)
+	}
+}
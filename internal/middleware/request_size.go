@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Pelfox/codecell-runner/internal/metrics"
+	"github.com/docker/go-units"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	grpcproto "google.golang.org/grpc/encoding/proto"
+	"google.golang.org/grpc/mem"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// oversizedRequest is a request left undecoded for exceeding its limit.
+type oversizedRequest struct {
+	size  int
+	limit int
+}
+
+// RequestSizeGuard caps the serialized size of the requests by their message
+// type, before they are decoded. The codec leaves the oversized requests
+// empty, the interceptors reject them with INVALID_ARGUMENT: the codec errors
+// would surface as INTERNAL, and the unary requests are decoded before any
+// interceptor runs.
+type RequestSizeGuard struct {
+	defaultLimit int
+	limits       map[string]int // ID = full name of the message
+
+	oversized sync.Map // ID = the decoded message, value = oversizedRequest
+}
+
+// NewRequestSizeGuard creates a new instance of RequestSizeGuard capping the
+// messages at their limits, keyed by their full names, and every other message
+// at defaultLimit.
+func NewRequestSizeGuard(defaultLimit int, limits map[string]int) *RequestSizeGuard {
+	return &RequestSizeGuard{defaultLimit: defaultLimit, limits: limits}
+}
+
+// Codec returns the proto codec of the server, checking the size of the
+// requests before decoding them.
+func (g *RequestSizeGuard) Codec() encoding.CodecV2 {
+	return &sizeGuardCodec{CodecV2: encoding.GetCodecV2(grpcproto.Name), guard: g}
+}
+
+// reject reports the RPC of the oversized request, if the request is one.
+func (g *RequestSizeGuard) reject(method string, request any) error {
+	value, ok := g.oversized.LoadAndDelete(request)
+	if !ok {
+		return nil
+	}
+	oversized := value.(oversizedRequest)
+	metrics.RejectedRequestSizes.WithLabelValues(method).Observe(float64(oversized.size))
+	return status.Errorf(codes.InvalidArgument, "request of %s exceeds the limit of %s",
+		units.BytesSize(float64(oversized.size)), units.BytesSize(float64(oversized.limit)))
+}
+
+// UnaryInterceptor rejects the oversized requests of the unary RPCs.
+func (g *RequestSizeGuard) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := g.reject(info.FullMethod, req); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamInterceptor rejects the oversized requests of the streaming RPCs,
+// when they are received.
+func (g *RequestSizeGuard) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &sizeGuardStream{ServerStream: stream, guard: g, method: info.FullMethod})
+	}
+}
+
+// sizeGuardCodec is the proto codec leaving the oversized requests undecoded.
+type sizeGuardCodec struct {
+	encoding.CodecV2
+	guard *RequestSizeGuard
+}
+
+func (c *sizeGuardCodec) Unmarshal(data mem.BufferSlice, v any) error {
+	if message, ok := v.(proto.Message); ok {
+		limit, ok := c.guard.limits[string(proto.MessageName(message))]
+		if !ok {
+			limit = c.guard.defaultLimit
+		}
+		if size := data.Len(); size > limit {
+			c.guard.oversized.Store(v, oversizedRequest{size: size, limit: limit})
+			return nil
+		}
+	}
+	return c.CodecV2.Unmarshal(data, v)
+}
+
+// sizeGuardStream is the server stream rejecting the oversized requests.
+type sizeGuardStream struct {
+	grpc.ServerStream
+	guard  *RequestSizeGuard
+	method string
+}
+
+func (s *sizeGuardStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return s.guard.reject(s.method, m)
+}
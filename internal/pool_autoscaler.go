@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"context"
+
+	"github.com/Pelfox/codecell-runner/internal/clock"
+	"github.com/Pelfox/codecell-runner/internal/metrics"
+	"github.com/Pelfox/codecell-runner/internal/registry"
+	"github.com/Pelfox/codecell-runner/internal/services"
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/rs/zerolog/log"
+)
+
+// PoolBounds are the minimum and maximum warm pool sizes of a language.
+type PoolBounds struct {
+	Min int
+	Max int
+}
+
+// PoolAutoscaler resizes the warm pool to the recent demand of every language:
+// the pool of a language is sized to its arrivals over the sliding window,
+// within the configured bounds.
+type PoolAutoscaler struct {
+	appConfig *pkg.AppConfig
+	registry  *registry.Registry
+	warmPool  *services.WarmPool
+	bounds    map[string]PoolBounds
+	clock     clock.Clock
+
+	buckets []map[string]int // arrivals per interval, the current one last
+}
+
+// NewPoolAutoscaler creates a new instance of PoolAutoscaler with the given
+// per-language bounds.
+func NewPoolAutoscaler(
+	appConfig *pkg.AppConfig,
+	runRegistry *registry.Registry,
+	warmPool *services.WarmPool,
+	bounds map[string]PoolBounds,
+) *PoolAutoscaler {
+	return &PoolAutoscaler{
+		appConfig: appConfig,
+		registry:  runRegistry,
+		warmPool:  warmPool,
+		bounds:    bounds,
+		clock:     clock.Real,
+	}
+}
+
+// Run rescales the pool on every interval until the context is cancelled.
+func (a *PoolAutoscaler) Run(ctx context.Context) {
+	ticker := a.clock.NewTicker(a.appConfig.WarmPoolScaleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			a.Scale(a.warmPool.TakeArrivals())
+		}
+	}
+}
+
+// Scale records the arrivals of the last interval and resizes the pool of
+// every language to the arrivals over the window.
+func (a *PoolAutoscaler) Scale(arrivals map[string]int) {
+	windowBuckets := max(1, int(a.appConfig.WarmPoolScaleWindow/a.appConfig.WarmPoolScaleInterval))
+	a.buckets = append(a.buckets, arrivals)
+	if len(a.buckets) > windowBuckets {
+		a.buckets = a.buckets[len(a.buckets)-windowBuckets:]
+	}
+
+	for language, bounds := range a.bounds {
+		demand := 0
+		for _, bucket := range a.buckets {
+			demand += bucket[language]
+		}
+		current := a.warmPool.Size(language)
+		target := min(max(demand, bounds.Min), bounds.Max)
+
+		// growing only if the warm containers fit into the memory left to real runs
+		if target > current && !a.fitsMemory(target-current) {
+			target = current
+		}
+		metrics.WarmPoolTargetSize.WithLabelValues(language).Set(float64(target))
+		if target == current {
+			continue
+		}
+
+		// shrinking right away, idle pools only waste the host memory
+		a.warmPool.SetSize(language, target)
+		log.Info().Str("language", language).
+			Int("demand", demand).
+			Int("previousSize", current).
+			Int("size", target).
+			Msg("warm pool resized")
+	}
+}
+
+// fitsMemory reports whether the given number of additional warm containers
+// fits into the memory not yet committed to runs, including the containers
+// already in the pool.
+func (a *PoolAutoscaler) fitsMemory(additional int) bool {
+	capacity := a.registry.MemoryCapacity()
+	if capacity == 0 {
+		return true // the admission is disabled
+	}
+
+	pooled := 0
+	for language := range a.bounds {
+		pooled += a.warmPool.Size(language)
+	}
+	required := int64(pooled+additional) * a.appConfig.MemoryLimit
+	return a.registry.CommittedMemory()+required <= capacity
+}
@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/clock"
+	"github.com/Pelfox/codecell-runner/internal/registry"
+	"github.com/Pelfox/codecell-runner/internal/services"
+	"github.com/Pelfox/codecell-runner/pkg"
+)
+
+// newTestAutoscaler returns the autoscaler of an empty warm pool of perl and
+// python on a fake clock, rescaling every 10s over a window of 30s.
+func newTestAutoscaler(t *testing.T, memoryCapacity int64) (*PoolAutoscaler, *services.WarmPool, *clock.Fake) {
+	t.Helper()
+	config, _, err := pkg.LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.WarmPoolScaleInterval = 10 * time.Second
+	config.WarmPoolScaleWindow = 30 * time.Second
+	// the warm pool isn't filled, its containers are never created nor removed
+	warmPool := services.NewWarmPool(nil, map[string]int{"perl": 1, "python": 0}, time.Minute)
+	autoscaler := NewPoolAutoscaler(config, registry.New(memoryCapacity, 10, time.Minute), warmPool,
+		map[string]PoolBounds{"perl": {Min: 1, Max: 8}, "python": {Min: 0, Max: 2}})
+	fake := clock.NewFake(time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC))
+	autoscaler.clock = fake
+	return autoscaler, warmPool, fake
+}
+
+// checkSizes checks the sizes of the pools of perl and python.
+func checkSizes(t *testing.T, warmPool *services.WarmPool, perl int, python int, when string) {
+	t.Helper()
+	if got := [2]int{warmPool.Size("perl"), warmPool.Size("python")}; got != [2]int{perl, python} {
+		t.Fatalf("the perl and python pools have the sizes %v %s, want [%d %d]", got, when, perl, python)
+	}
+}
+
+func TestPoolAutoscalerScalesToTheDemandOverTheWindow(t *testing.T) {
+	autoscaler, warmPool, fake := newTestAutoscaler(t, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go autoscaler.Run(ctx)
+	fake.AwaitTimers(1)
+
+	// tick ends an interval, returning once its tick is received, which is once
+	// the previous interval is rescaled
+	tick := func() {
+		fake.Advance(10 * time.Second)
+		fake.AwaitTicks()
+	}
+
+	for range 5 {
+		warmPool.Take("perl")
+	}
+	for range 3 {
+		warmPool.Take("python")
+	}
+	checkSizes(t, warmPool, 1, 0, "before the first interval ends")
+	tick()
+	tick()
+	checkSizes(t, warmPool, 5, 2, "on the arrivals, python being capped")
+
+	// the arrivals are counted until they leave the window of 3 intervals
+	tick()
+	checkSizes(t, warmPool, 5, 2, "with the arrivals in the window")
+	tick()
+	tick()
+	checkSizes(t, warmPool, 1, 0, "once the arrivals leave the window")
+}
+
+func TestPoolAutoscalerGrowsWithinTheMemoryLeft(t *testing.T) {
+	config, _, err := pkg.LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the perl container already in the pool and 2 more
+	autoscaler, warmPool, _ := newTestAutoscaler(t, 3*config.MemoryLimit)
+
+	autoscaler.Scale(map[string]int{"perl": 5})
+	checkSizes(t, warmPool, 1, 0, "past the memory left")
+	autoscaler.Scale(map[string]int{"python": 2})
+	checkSizes(t, warmPool, 1, 2, "within the memory left")
+	autoscaler.Scale(map[string]int{"perl": 1})
+	checkSizes(t, warmPool, 1, 2, "with the memory all pooled")
+}
@@ -0,0 +1,155 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// boltRunsBucket maps the request IDs to the records.
+	boltRunsBucket = []byte("runs")
+	// boltFinishedBucket indexes the request IDs by the finish time, so that
+	// listing and pruning don't decode every record.
+	boltFinishedBucket = []byte("finished")
+)
+
+// BoltStore is the RunStore keeping the records in an embedded bbolt database.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore creates a new instance of BoltStore, opening or creating the
+// database at the given path.
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltRunsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltFinishedBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &BoltStore{db}, nil
+}
+
+// finishedKey builds the index key ordering the runs by the finish time.
+func finishedKey(finishedAt time.Time, requestID string) []byte {
+	key := make([]byte, 8, 8+len(requestID))
+	binary.BigEndian.PutUint64(key, uint64(finishedAt.UnixNano()))
+	return append(key, requestID...)
+}
+
+func (s *BoltStore) Save(_ context.Context, record RunRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		runs := tx.Bucket(boltRunsBucket)
+		finished := tx.Bucket(boltFinishedBucket)
+
+		// the index entry of the replaced record would point at the new one
+		if previous := runs.Get([]byte(record.RequestID)); previous != nil {
+			var old RunRecord
+			if err := json.Unmarshal(previous, &old); err == nil {
+				if err := finished.Delete(finishedKey(old.FinishedAt, old.RequestID)); err != nil {
+					return err
+				}
+			}
+		}
+		if err := runs.Put([]byte(record.RequestID), value); err != nil {
+			return err
+		}
+		return finished.Put(finishedKey(record.FinishedAt, record.RequestID), []byte(record.RequestID))
+	})
+}
+
+func (s *BoltStore) Get(_ context.Context, requestID string) (RunRecord, bool, error) {
+	var record RunRecord
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(boltRunsBucket).Get([]byte(requestID))
+		if value == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(value, &record)
+	})
+	return record, found, err
+}
+
+func (s *BoltStore) List(ctx context.Context, filter RunFilter) ([]RunRecord, error) {
+	var records []RunRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		runs := tx.Bucket(boltRunsBucket)
+		cursor := tx.Bucket(boltFinishedBucket).Cursor()
+		var since []byte
+		if !filter.Since.IsZero() {
+			since = finishedKey(filter.Since, "")
+		}
+
+		for key, requestID := cursor.Last(); key != nil; key, requestID = cursor.Prev() {
+			if since != nil && bytes.Compare(key, since) < 0 {
+				return nil
+			}
+			if filter.Limit > 0 && len(records) >= filter.Limit {
+				return nil
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			value := runs.Get(requestID)
+			if value == nil {
+				continue
+			}
+			var record RunRecord
+			if err := json.Unmarshal(value, &record); err != nil {
+				return err
+			}
+			if filter.Matches(record) {
+				records = append(records, record)
+			}
+		}
+		return nil
+	})
+	return records, err
+}
+
+func (s *BoltStore) Prune(_ context.Context, before time.Time) (int, error) {
+	var pruned int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		runs := tx.Bucket(boltRunsBucket)
+		cursor := tx.Bucket(boltFinishedBucket).Cursor()
+		limit := finishedKey(before, "")
+
+		// starting over after every delete, the cursor position is undefined past it
+		for key, requestID := cursor.First(); key != nil && bytes.Compare(key, limit) < 0; key, requestID = cursor.First() {
+			if err := runs.Delete(requestID); err != nil {
+				return err
+			}
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+			pruned++
+		}
+		return nil
+	})
+	return pruned, err
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,61 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisKeyPrefix namespaces the keys of the runs in Redis.
+const redisKeyPrefix = "codecell:run:"
+
+// RedisBackend is the SharedBackend storing the owners of the runs in Redis.
+type RedisBackend struct {
+	client *redis.Client
+}
+
+// NewRedisBackend creates a new instance of RedisBackend connected to the
+// given Redis server and verifies the connection.
+func NewRedisBackend(ctx context.Context, addr string, password string, db int) (*RedisBackend, error) {
+	client := redis.NewClient(&redis.Options{Addr: addr, Password: password, DB: db})
+	if err := client.Ping(ctx).Err(); err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	return &RedisBackend{client}, nil
+}
+
+func (b *RedisBackend) Register(ctx context.Context, requestID string, owner Owner, ttl time.Duration) error {
+	value, err := json.Marshal(owner)
+	if err != nil {
+		return err
+	}
+	return b.client.Set(ctx, redisKeyPrefix+requestID, value, ttl).Err()
+}
+
+func (b *RedisBackend) Lookup(ctx context.Context, requestID string) (Owner, bool, error) {
+	value, err := b.client.Get(ctx, redisKeyPrefix+requestID).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return Owner{}, false, nil
+	}
+	if err != nil {
+		return Owner{}, false, err
+	}
+
+	var owner Owner
+	if err := json.Unmarshal(value, &owner); err != nil {
+		return Owner{}, false, err
+	}
+	return owner, true, nil
+}
+
+func (b *RedisBackend) Unregister(ctx context.Context, requestID string) error {
+	return b.client.Del(ctx, redisKeyPrefix+requestID).Err()
+}
+
+func (b *RedisBackend) Close() error {
+	return b.client.Close()
+}
@@ -0,0 +1,431 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/services"
+)
+
+// Outcome is the way a run has ended.
+type Outcome string
+
+const (
+	// OutcomeSucceeded means the program has exited with code 0.
+	OutcomeSucceeded Outcome = "succeeded"
+	// OutcomeFailed means the program has exited with a non-zero code.
+	OutcomeFailed Outcome = "failed"
+	// OutcomeOOMKilled means the program was killed for exceeding the memory limit.
+	OutcomeOOMKilled Outcome = "oom_killed"
+	// OutcomeTimedOut means the run has exceeded its timeout.
+	OutcomeTimedOut Outcome = "timed_out"
+	// OutcomeStopped means the run was stopped by the client.
+	OutcomeStopped Outcome = "stopped"
+	// OutcomePreempted means the run was preempted by a higher priority run.
+	OutcomePreempted Outcome = "preempted"
+	// OutcomeSystemError means the runner failed to execute the program.
+	OutcomeSystemError Outcome = "system_error"
+	// OutcomeCancelled means the run was cancelled before it started executing.
+	OutcomeCancelled Outcome = "cancelled"
+)
+
+// State is the stage an active run is at.
+type State string
+
+const (
+	// StatePending means the run has been accepted, but isn't waiting for a slot yet.
+	StatePending State = "pending"
+	// StateQueued means the run is waiting in the admission queue.
+	StateQueued State = "queued"
+	// StateRunning means the run has been admitted and owns its container.
+	StateRunning State = "running"
+	// StateCancelled means the run was cancelled before being admitted.
+	StateCancelled State = "cancelled"
+)
+
+var (
+	// ErrInsufficientMemory is returned when the memory limit of the run doesn't fit into the capacity.
+	ErrInsufficientMemory = errors.New("insufficient memory on execution host")
+	// ErrUnlimitedMemory is returned when the run has no memory limit to check against the capacity.
+	ErrUnlimitedMemory = errors.New("run has no memory limit")
+	// ErrRunCancelled is returned when the run was cancelled before being admitted.
+	ErrRunCancelled = errors.New("run was cancelled before being admitted")
+	// ErrRunNotFound is returned for runs the registry doesn't track.
+	ErrRunNotFound = errors.New("run not found")
+)
+
+// Run describes a single active run tracked by the registry.
+type Run struct {
+	// RequestID is the unique ID of the run request.
+	RequestID string
+	// ContainerID is the ID of the execution container, empty until it's created.
+	ContainerID string
+	// Language is the programming language of the run.
+	Language string
+	// Labels are the client-supplied labels of the run.
+	Labels map[string]string
+	// Identity is the identity of the caller who has submitted the run, empty
+	// if it's unidentified.
+	Identity string
+	// State is the stage the run is at.
+	State State
+	// MemoryLimit is the memory limit of the execution container in bytes.
+	MemoryLimit int64
+	// CPULimit is the CPU limit of the execution container in nano-CPUs.
+	CPULimit int64
+	// Environment are the environment variables of the execution container,
+	// the values of the secret-looking ones redacted.
+	Environment map[string]string
+	// ArchiveURL is the URL the output is archived at, empty if it isn't.
+	ArchiveURL string
+	// Cancel cancels the execution context of the run.
+	Cancel context.CancelFunc
+	// Timeout is the execution timeout of the run.
+	Timeout time.Duration
+	// CreatedAt is the time the run was submitted.
+	CreatedAt time.Time
+	// Deadline is the time the run must be over by, zero until it's admitted.
+	Deadline time.Time
+	// HardDeadline is the time the container must be gone by whatever the
+	// timeout of the run, under the server-wide cap on the run time; zero until
+	// the container is created.
+	HardDeadline time.Time
+	// Events receives the daemon events of the execution container.
+	Events chan services.ContainerEvent
+}
+
+// Result describes how a run has ended.
+type Result struct {
+	// Outcome is the way the run has ended.
+	Outcome Outcome
+	// ExitCode is the exit code of the program, -1 if it hasn't exited on its own.
+	ExitCode int64
+	// Usage is the resource consumption of the run.
+	Usage services.Usage
+	// StdoutBytes is the number of bytes the program has written to stdout.
+	StdoutBytes int64
+	// StderrBytes is the number of bytes the program has written to stderr.
+	StderrBytes int64
+}
+
+// CompletedRun describes a finished run, kept for later inspection.
+type CompletedRun struct {
+	Run
+	Result
+	// FinishedAt is the time the run was finished.
+	FinishedAt time.Time
+}
+
+// Registry keeps track of the active runs of the server and the host memory
+// committed to their containers, as well as the most recently completed runs.
+// The runs are tracked from their submission, but only the running ones count
+// towards the load and the committed memory.
+type Registry struct {
+	memoryCapacity     int64 // 0 means the memory isn't limited
+	completedRetention int
+	maxRunDuration     time.Duration // 0 means the run time isn't capped
+
+	mutex     sync.RWMutex
+	runs      map[string]*Run // ID = request ID
+	completed map[string]*CompletedRun
+	order     []string // request IDs of completed runs, oldest first
+}
+
+// New creates a new instance of Registry, admitting runs as long as the sum of
+// their memory limits stays within the given capacity (0 disables the check),
+// keeping up to completedRetention completed runs, and capping the run time
+// of every container at maxRunDuration from its creation (0 disables the cap).
+func New(memoryCapacity int64, completedRetention int, maxRunDuration time.Duration) *Registry {
+	return &Registry{
+		memoryCapacity:     memoryCapacity,
+		completedRetention: completedRetention,
+		maxRunDuration:     maxRunDuration,
+		mutex:              sync.RWMutex{},
+		runs:               make(map[string]*Run),
+		completed:          make(map[string]*CompletedRun),
+	}
+}
+
+// Track adds the submitted run to the registry in the pending state.
+func (r *Registry) Track(run *Run) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	run.State = StatePending
+	r.runs[run.RequestID] = run
+}
+
+// SetQueued marks the pending run as waiting in the admission queue.
+func (r *Registry) SetQueued(requestID string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if run, ok := r.runs[requestID]; ok && run.State == StatePending {
+		run.State = StateQueued
+	}
+}
+
+// Admit moves the tracked run into the running state with the given deadline,
+// if its memory limit fits into the remaining capacity. With the capacity
+// checked, the runs without a memory limit are rejected, as they could take
+// the whole host. A rejected run stays tracked until it's removed.
+func (r *Registry) Admit(requestID string, deadline time.Time) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	run, ok := r.runs[requestID]
+	if !ok {
+		return ErrRunNotFound
+	}
+	if run.State == StateCancelled {
+		return ErrRunCancelled
+	}
+	if r.memoryCapacity > 0 && run.MemoryLimit <= 0 {
+		return ErrUnlimitedMemory
+	}
+	if r.memoryCapacity > 0 && r.committedMemory()+run.MemoryLimit > r.memoryCapacity {
+		return ErrInsufficientMemory
+	}
+	run.State = StateRunning
+	run.Deadline = deadline
+	return nil
+}
+
+// CancelQueued cancels the run if it hasn't been admitted yet, so that it
+// never reaches the container runtime. It returns false if the run is unknown
+// or running already.
+func (r *Registry) CancelQueued(requestID string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	run, ok := r.runs[requestID]
+	if !ok || run.State == StateRunning {
+		return false
+	}
+	// deciding under the mutex, a concurrent admission sees the cancellation
+	run.State = StateCancelled
+	run.Cancel()
+	return true
+}
+
+// SetContainer records the execution container of the run, and the hard
+// deadline of the run time from the first call on, which it returns.
+func (r *Registry) SetContainer(requestID string, containerID string) time.Time {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	run, ok := r.runs[requestID]
+	if !ok {
+		return time.Time{}
+	}
+	run.ContainerID = containerID
+	if run.HardDeadline.IsZero() && r.maxRunDuration > 0 {
+		run.HardDeadline = time.Now().Add(r.maxRunDuration)
+	}
+	return run.HardDeadline
+}
+
+// Notify delivers the container event to the run owning the container. Events
+// of unknown runs, or ones the run isn't keeping up with, are dropped.
+func (r *Registry) Notify(event services.ContainerEvent) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	run, ok := r.runs[event.RequestID]
+	if event.RequestID == "" {
+		run, ok = r.byContainer(event.ContainerID) // warm pool containers aren't labeled with the run
+	}
+	if !ok || run.ContainerID != event.ContainerID || run.Events == nil {
+		return
+	}
+	select {
+	case run.Events <- event:
+	default:
+	}
+}
+
+// Get returns a copy of the run with the given request ID.
+func (r *Registry) Get(requestID string) (Run, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	run, ok := r.runs[requestID]
+	if !ok {
+		return Run{}, false
+	}
+	return *run, true
+}
+
+// GetByContainer returns a copy of the run owning the given container.
+func (r *Registry) GetByContainer(containerID string) (Run, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	run, ok := r.byContainer(containerID)
+	if !ok {
+		return Run{}, false
+	}
+	return *run, true
+}
+
+// byContainer finds the run owning the container; the caller must hold the mutex.
+func (r *Registry) byContainer(containerID string) (*Run, bool) {
+	for _, run := range r.runs {
+		if run.ContainerID == containerID {
+			return run, true
+		}
+	}
+	return nil, false
+}
+
+// Remove deletes the run with the given request ID, releasing its memory.
+func (r *Registry) Remove(requestID string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.runs, requestID)
+}
+
+// Finish moves the run with the given request ID into the completed runs,
+// releasing its memory and evicting the oldest completed runs over the retention.
+// It returns the record of the completed run.
+func (r *Registry) Finish(requestID string, result Result) (CompletedRun, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	run, ok := r.runs[requestID]
+	if !ok {
+		return CompletedRun{}, false
+	}
+	delete(r.runs, requestID)
+
+	completed := &CompletedRun{Run: *run, Result: result, FinishedAt: time.Now()}
+	if r.completedRetention <= 0 {
+		return *completed, true
+	}
+	r.completed[requestID] = completed
+	r.order = append(r.order, requestID)
+	for len(r.order) > r.completedRetention {
+		delete(r.completed, r.order[0])
+		r.order = r.order[1:]
+	}
+	return *completed, true
+}
+
+// GetCompleted returns a copy of the completed run with the given request ID.
+func (r *Registry) GetCompleted(requestID string) (CompletedRun, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	run, ok := r.completed[requestID]
+	if !ok {
+		return CompletedRun{}, false
+	}
+	return *run, true
+}
+
+// ListCompleted returns copies of the retained completed runs selected by the
+// filter, most recently finished first.
+func (r *Registry) ListCompleted(filter RunFilter) []CompletedRun {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	var completed []CompletedRun
+	for i := len(r.order) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(completed) >= filter.Limit {
+			break
+		}
+		run := r.completed[r.order[i]]
+		if filter.Matches(NewRunRecord(*run)) {
+			completed = append(completed, *run)
+		}
+	}
+	return completed
+}
+
+// Count returns the number of running runs.
+func (r *Registry) Count() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	var count int
+	for _, run := range r.runs {
+		if run.State == StateRunning {
+			count++
+		}
+	}
+	return count
+}
+
+// CountByLanguage returns the number of running runs of every language.
+func (r *Registry) CountByLanguage() map[string]int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	counts := make(map[string]int)
+	for _, run := range r.runs {
+		if run.State == StateRunning {
+			counts[run.Language]++
+		}
+	}
+	return counts
+}
+
+// MemoryCapacity returns the memory available to runs, 0 if it isn't limited.
+func (r *Registry) MemoryCapacity() int64 {
+	return r.memoryCapacity
+}
+
+// CommittedMemory returns the sum of memory limits of all running runs.
+func (r *Registry) CommittedMemory() int64 {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.committedMemory()
+}
+
+// committedMemory sums the memory limits; the caller must hold the mutex.
+func (r *Registry) committedMemory() int64 {
+	var committed int64
+	for _, run := range r.runs {
+		if run.State == StateRunning {
+			committed += run.MemoryLimit
+		}
+	}
+	return committed
+}
+
+// Sizes describes the bookkeeping of the registry, for debugging leaks.
+type Sizes struct {
+	// Tracked is the number of tracked runs, in any state.
+	Tracked int `json:"tracked"`
+	// Running is the number of running runs.
+	Running int `json:"running"`
+	// Queued is the number of runs waiting for an execution slot.
+	Queued int `json:"queued"`
+	// Completed is the number of retained completed runs.
+	Completed int `json:"completed"`
+	// CompletedOrder is the length of the retention order of completed runs.
+	CompletedOrder int `json:"completedOrder"`
+}
+
+// Sizes returns the current sizes of the registry maps.
+func (r *Registry) Sizes() Sizes {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	sizes := Sizes{
+		Tracked:        len(r.runs),
+		Completed:      len(r.completed),
+		CompletedOrder: len(r.order),
+	}
+	for _, run := range r.runs {
+		switch run.State {
+		case StateRunning:
+			sizes.Running++
+		case StateQueued:
+			sizes.Queued++
+		}
+	}
+	return sizes
+}
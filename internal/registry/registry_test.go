@@ -0,0 +1,71 @@
+package registry
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/services"
+)
+
+func TestAdmitChecksTheMemoryLimitsAgainstTheCapacity(t *testing.T) {
+	const gibibyte = 1 << 30
+	tests := []struct {
+		name        string
+		capacity    int64
+		memoryLimit int64
+		wantErr     error
+	}{
+		{name: "fits", capacity: 2 * gibibyte, memoryLimit: gibibyte},
+		{name: "doesn't fit", capacity: 2 * gibibyte, memoryLimit: 2 * gibibyte, wantErr: ErrInsufficientMemory},
+		{name: "unlimited", capacity: 2 * gibibyte, memoryLimit: 0, wantErr: ErrUnlimitedMemory},
+		{name: "unlimited without the admission", capacity: 0, memoryLimit: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registry := New(test.capacity, 0, time.Hour)
+			// another run holding a gibibyte
+			registry.Track(&Run{RequestID: "running", MemoryLimit: gibibyte})
+			if err := registry.Admit("running", time.Now().Add(time.Minute)); err != nil {
+				t.Fatalf("Admit() of the first run = %v", err)
+			}
+
+			registry.Track(&Run{RequestID: "run", MemoryLimit: test.memoryLimit})
+			err := registry.Admit("run", time.Now().Add(time.Minute))
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("Admit() = %v, want %v", err, test.wantErr)
+			}
+			if run, _ := registry.Get("run"); (run.State == StateRunning) != (test.wantErr == nil) {
+				t.Errorf("the run is %s after Admit() = %v", run.State, err)
+			}
+		})
+	}
+}
+
+func TestFinishKeepsTheUsageOfTheRecentRuns(t *testing.T) {
+	registry := New(0, 2, time.Hour)
+	for i, requestID := range []string{"first", "second", "third"} {
+		registry.Track(&Run{RequestID: requestID})
+		usage := services.Usage{CPUSeconds: float64(i + 1), MemoryByteSeconds: float64(i+1) * (1 << 20), PeakMemory: 1 << 20}
+		if _, ok := registry.Finish(requestID, Result{Usage: usage}); !ok {
+			t.Fatalf("Finish() of the %s run found no active run", requestID)
+		}
+	}
+
+	if _, ok := registry.GetCompleted("first"); ok {
+		t.Error("the oldest run is kept past the retention")
+	}
+	completed, ok := registry.GetCompleted("third")
+	if !ok {
+		t.Fatal("the last run isn't kept")
+	}
+	if want := (services.Usage{CPUSeconds: 3, MemoryByteSeconds: 3 << 20, PeakMemory: 1 << 20}); completed.Usage != want {
+		t.Errorf("the usage of the completed run = %+v, want %+v", completed.Usage, want)
+	}
+	if _, ok := registry.Get("third"); ok {
+		t.Error("the completed run is still active")
+	}
+	if _, ok := registry.Finish("third", Result{}); ok {
+		t.Error("Finish() of a completed run has found it active")
+	}
+}
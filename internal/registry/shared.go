@@ -0,0 +1,30 @@
+package registry
+
+import (
+	"context"
+	"time"
+)
+
+// Owner describes the runner instance executing a run.
+type Owner struct {
+	// InstanceAddr is the gRPC address of the owning instance.
+	InstanceAddr string `json:"instanceAddr"`
+	// ContainerID is the ID of the execution container.
+	ContainerID string `json:"containerId"`
+	// Identity is the identity of the caller who has submitted the run.
+	Identity string `json:"identity,omitempty"`
+}
+
+// SharedBackend maps the request IDs to the instances executing them, shared
+// between all the runner instances behind a load balancer. The entries expire
+// unless refreshed, so that crashed instances don't leave them behind.
+type SharedBackend interface {
+	// Register records the owner of the run for the given TTL, or refreshes it.
+	Register(ctx context.Context, requestID string, owner Owner, ttl time.Duration) error
+	// Lookup returns the owner of the run, if it's known.
+	Lookup(ctx context.Context, requestID string) (Owner, bool, error)
+	// Unregister removes the run.
+	Unregister(ctx context.Context, requestID string) error
+	// Close releases the connections of the backend.
+	Close() error
+}
@@ -0,0 +1,110 @@
+package registry
+
+import (
+	"context"
+	"time"
+)
+
+// RunRecord is the persisted record of a completed run.
+type RunRecord struct {
+	// RequestID is the unique ID of the run request.
+	RequestID string `json:"requestId"`
+	// Language is the programming language of the run.
+	Language string `json:"language"`
+	// Labels are the client-supplied labels of the run.
+	Labels map[string]string `json:"labels,omitempty"`
+	// CreatedAt is the time the run was admitted.
+	CreatedAt time.Time `json:"createdAt"`
+	// FinishedAt is the time the run was finished.
+	FinishedAt time.Time `json:"finishedAt"`
+	// Timeout is the execution timeout of the run.
+	Timeout time.Duration `json:"timeout"`
+	// MemoryLimit is the memory limit of the execution container in bytes.
+	MemoryLimit int64 `json:"memoryLimit"`
+	// CPULimit is the CPU limit of the execution container in nano-CPUs.
+	CPULimit int64 `json:"cpuLimit"`
+	// Environment are the environment variables of the execution container, redacted.
+	Environment map[string]string `json:"environment,omitempty"`
+	// Outcome is the way the run has ended.
+	Outcome Outcome `json:"outcome"`
+	// ExitCode is the exit code of the program, -1 if it hasn't exited on its own.
+	ExitCode int64 `json:"exitCode"`
+	// PeakMemory is the highest observed memory working set in bytes.
+	PeakMemory uint64 `json:"peakMemory"`
+	// CPUSeconds is the CPU time consumed by the container.
+	CPUSeconds float64 `json:"cpuSeconds"`
+	// StdoutBytes is the number of bytes the program has written to stdout.
+	StdoutBytes int64 `json:"stdoutBytes"`
+	// StderrBytes is the number of bytes the program has written to stderr.
+	StderrBytes int64 `json:"stderrBytes"`
+	// Output is the capped output of the program, empty unless it's stored.
+	Output string `json:"output,omitempty"`
+	// ArchiveURL is the URL the complete output is archived at, empty if it isn't.
+	ArchiveURL string `json:"archiveUrl,omitempty"`
+}
+
+// NewRunRecord creates the record of the completed run.
+func NewRunRecord(completed CompletedRun) RunRecord {
+	return RunRecord{
+		RequestID:   completed.RequestID,
+		Language:    completed.Language,
+		Labels:      completed.Labels,
+		CreatedAt:   completed.CreatedAt,
+		FinishedAt:  completed.FinishedAt,
+		Timeout:     completed.Timeout,
+		MemoryLimit: completed.MemoryLimit,
+		CPULimit:    completed.CPULimit,
+		Environment: completed.Environment,
+		Outcome:     completed.Outcome,
+		ExitCode:    completed.ExitCode,
+		PeakMemory:  completed.Usage.PeakMemory,
+		CPUSeconds:  completed.Usage.CPUSeconds,
+		StdoutBytes: completed.StdoutBytes,
+		StderrBytes: completed.StderrBytes,
+		ArchiveURL:  completed.ArchiveURL,
+	}
+}
+
+// RunFilter selects the records listed from a RunStore.
+type RunFilter struct {
+	// Language matches the runs of the language, any if empty.
+	Language string
+	// Labels match the runs having all of the labels.
+	Labels map[string]string
+	// Since matches the runs finished at or after the time, any if zero.
+	Since time.Time
+	// Limit is the maximum number of records.
+	Limit int
+}
+
+// Matches reports whether the record is selected by the filter.
+func (f RunFilter) Matches(record RunRecord) bool {
+	if f.Language != "" && record.Language != f.Language {
+		return false
+	}
+	if !f.Since.IsZero() && record.FinishedAt.Before(f.Since) {
+		return false
+	}
+	for key, value := range f.Labels {
+		if record.Labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// RunStore persists the records of completed runs, so that they survive the
+// restarts of the runner.
+type RunStore interface {
+	// Save stores the record, replacing the one with the same request ID.
+	Save(ctx context.Context, record RunRecord) error
+	// Get returns the record of the run, if it's stored.
+	Get(ctx context.Context, requestID string) (RunRecord, bool, error)
+	// List returns the records selected by the filter, most recently finished first.
+	List(ctx context.Context, filter RunFilter) ([]RunRecord, error)
+	// Prune deletes the records of the runs finished before the given time,
+	// returning the number of deleted records.
+	Prune(ctx context.Context, before time.Time) (int, error)
+	// Close releases the resources of the store.
+	Close() error
+}
@@ -0,0 +1,70 @@
+package internal
+
+import (
+	v1 "github.com/Pelfox/codecell-runner/generated"
+	"github.com/Pelfox/codecell-runner/internal/registry"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// defaultListRunsLimit is the number of records listed when the request doesn't limit it.
+const defaultListRunsLimit = 100
+
+// maxListRunsLimit is the maximum number of records listed at once.
+const maxListRunsLimit = 1000
+
+// runOutcomes maps the outcomes of the registry to the protocol ones.
+var runOutcomes = map[registry.Outcome]v1.RunOutcome{
+	registry.OutcomeSucceeded:   v1.RunOutcome_OUTCOME_SUCCEEDED,
+	registry.OutcomeFailed:      v1.RunOutcome_OUTCOME_FAILED,
+	registry.OutcomeOOMKilled:   v1.RunOutcome_OUTCOME_OOM_KILLED,
+	registry.OutcomeTimedOut:    v1.RunOutcome_OUTCOME_TIMED_OUT,
+	registry.OutcomeStopped:     v1.RunOutcome_OUTCOME_STOPPED,
+	registry.OutcomePreempted:   v1.RunOutcome_OUTCOME_PREEMPTED,
+	registry.OutcomeSystemError: v1.RunOutcome_OUTCOME_SYSTEM_ERROR,
+	registry.OutcomeCancelled:   v1.RunOutcome_OUTCOME_CANCELLED,
+}
+
+// activeRunMessage converts the active run into its protocol record.
+func activeRunMessage(run registry.Run) *v1.RunRecord {
+	return &v1.RunRecord{
+		RequestId:        run.RequestID,
+		Language:         run.Language,
+		Labels:           run.Labels,
+		Outcome:          v1.RunOutcome_OUTCOME_ACTIVE,
+		ExitCode:         -1,
+		CreatedAt:        timestamppb.New(run.CreatedAt),
+		TimeoutSeconds:   int32(run.Timeout.Seconds()),
+		MemoryLimitBytes: run.MemoryLimit,
+		CpuLimitNanos:    run.CPULimit,
+		Environment:      run.Environment,
+		ArchiveUrl:       run.ArchiveURL,
+		Queued:           run.State != registry.StateRunning,
+	}
+}
+
+// runRecordMessage converts the record of the finished run into its protocol record.
+func runRecordMessage(record registry.RunRecord) *v1.RunRecord {
+	outcome, ok := runOutcomes[record.Outcome]
+	if !ok {
+		outcome = v1.RunOutcome_OUTCOME_SYSTEM_ERROR
+	}
+	return &v1.RunRecord{
+		RequestId:        record.RequestID,
+		Language:         record.Language,
+		Labels:           record.Labels,
+		Outcome:          outcome,
+		ExitCode:         record.ExitCode,
+		CreatedAt:        timestamppb.New(record.CreatedAt),
+		FinishedAt:       timestamppb.New(record.FinishedAt),
+		TimeoutSeconds:   int32(record.Timeout.Seconds()),
+		MemoryLimitBytes: record.MemoryLimit,
+		CpuLimitNanos:    record.CPULimit,
+		Environment:      record.Environment,
+		PeakMemoryBytes:  record.PeakMemory,
+		CpuSeconds:       record.CPUSeconds,
+		StdoutBytes:      record.StdoutBytes,
+		StderrBytes:      record.StderrBytes,
+		Output:           record.Output,
+		ArchiveUrl:       record.ArchiveURL,
+	}
+}
@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"time"
+
+	v1 "github.com/Pelfox/codecell-runner/generated"
+	"github.com/Pelfox/codecell-runner/internal/metrics"
+	"github.com/Pelfox/codecell-runner/internal/registry"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/status"
+)
+
+// runSummary collects the figures of a run as it goes, for the single entry
+// logged once it's over. The request ID, the language and the identity are
+// the fields of the logger of the run already.
+type runSummary struct {
+	imageDigest string
+	coalesced   bool
+
+	submittedAt time.Time
+	admittedAt  time.Time // zero unless admitted
+	startedAt   time.Time // zero unless the container has started
+	runningAt   time.Time // zero unless the program has started executing
+	exitedAt    time.Time // zero unless the program has exited
+
+	result          *registry.Result // nil unless admitted
+	ioLimits        string           // the disk I/O limits of the container, if throttled
+	outputTruncated bool
+	stopReason      string // why the execution was cut short, if it was
+}
+
+// runTimings are the durations of the stages of a run, each zero unless the
+// run has reached it.
+type runTimings struct {
+	queueWait time.Duration // from the submission to the admission
+	setup     time.Duration // from the admission to the start of the program
+	boot      time.Duration // the part of the setup from the start of the container
+	execution time.Duration // from the start of the program to its exit
+}
+
+// timings returns the durations of the stages of the run, the unfinished one
+// lasting until now.
+func (r *runSummary) timings(now time.Time) runTimings {
+	until := func(at time.Time) time.Time {
+		if at.IsZero() {
+			return now
+		}
+		return at
+	}
+	timings := runTimings{queueWait: until(r.admittedAt).Sub(r.submittedAt)}
+	if !r.admittedAt.IsZero() {
+		timings.setup = until(r.runningAt).Sub(r.admittedAt)
+	}
+	if !r.startedAt.IsZero() {
+		timings.boot = until(r.runningAt).Sub(r.startedAt)
+	}
+	if !r.runningAt.IsZero() {
+		timings.execution = until(r.exitedAt).Sub(r.runningAt)
+	}
+	return timings
+}
+
+// observe records the durations of the finished stages of the run in the
+// metrics of the language.
+func (r *runSummary) observe(language string) {
+	timings := r.timings(time.Now())
+	if !r.admittedAt.IsZero() {
+		metrics.RunQueueWaitSeconds.WithLabelValues(language).Observe(timings.queueWait.Seconds())
+	}
+	if !r.runningAt.IsZero() {
+		metrics.RunSetupSeconds.WithLabelValues(language).Observe(timings.setup.Seconds())
+	}
+	if !r.exitedAt.IsZero() {
+		metrics.RunExecutionSeconds.WithLabelValues(language).Observe(timings.execution.Seconds())
+	}
+}
+
+// log writes the completion entry of the run, with the class of the outcome
+// the client gets and the final status of the RPC.
+func (r *runSummary) log(logger *zerolog.Logger, class v1.ErrorClass, err error) {
+	finishedAt := time.Now()
+	event := logger.Info().
+		Str("imageDigest", r.imageDigest).
+		Str("errorClass", class.String()).
+		Str("code", status.Code(err).String())
+	if r.coalesced {
+		event.Bool("coalesced", true)
+	}
+
+	timings := r.timings(finishedAt)
+	event.Dur("queueWait", timings.queueWait)
+	if !r.admittedAt.IsZero() {
+		event.Dur("setupTime", timings.setup)
+	}
+	if !r.startedAt.IsZero() {
+		event.Dur("bootTime", timings.boot)
+	}
+	if !r.runningAt.IsZero() {
+		event.Dur("executionTime", timings.execution)
+	}
+
+	if r.result != nil {
+		event.Str("outcome", string(r.result.Outcome)).
+			Int64("exitCode", r.result.ExitCode).
+			Uint64("peakMemory", r.result.Usage.PeakMemory).
+			Float64("cpuSeconds", r.result.Usage.CPUSeconds).
+			Int64("stdoutBytes", r.result.StdoutBytes).
+			Int64("stderrBytes", r.result.StderrBytes).
+			Bool("outputTruncated", r.outputTruncated)
+	}
+	if r.ioLimits != "" {
+		event.Str("ioLimits", r.ioLimits)
+	}
+	if r.stopReason != "" {
+		event.Str("stopReason", r.stopReason)
+	} else if err != nil {
+		event.Str("stopReason", status.Convert(err).Message())
+	}
+	event.Msg("run completed")
+}
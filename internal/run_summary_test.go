@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	v1 "github.com/Pelfox/codecell-runner/generated"
+	"github.com/Pelfox/codecell-runner/internal/registry"
+	"github.com/Pelfox/codecell-runner/internal/services"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// loggedSummary returns the fields of the completion entry the summary logs.
+func loggedSummary(t *testing.T, summary *runSummary, class v1.ErrorClass, err error) map[string]any {
+	t.Helper()
+	var logs bytes.Buffer
+	logger := zerolog.New(&logs)
+	summary.log(&logger, class, err)
+
+	var fields map[string]any
+	if err := json.Unmarshal(logs.Bytes(), &fields); err != nil {
+		t.Fatalf("the completion entry %q isn't a single JSON object: %v", logs.String(), err)
+	}
+	return fields
+}
+
+func TestRunSummaryLogsTheIOLimits(t *testing.T) {
+	fields := loggedSummary(t, &runSummary{ioLimits: "read 1MiB/s"}, v1.ErrorClass_ERROR_CLASS_NONE, nil)
+	if fields["ioLimits"] != "read 1MiB/s" {
+		t.Errorf("ioLimits = %v, want the limits of the container", fields["ioLimits"])
+	}
+	if fields = loggedSummary(t, &runSummary{}, v1.ErrorClass_ERROR_CLASS_NONE, nil); fields["ioLimits"] != nil {
+		t.Errorf("ioLimits = %v of the unthrottled run, want none", fields["ioLimits"])
+	}
+}
+
+func TestRunSummaryLogsTheOutcome(t *testing.T) {
+	submittedAt := time.Now().Add(-time.Minute)
+	at := func(offset time.Duration) time.Time { return submittedAt.Add(offset) }
+	tests := []struct {
+		name    string
+		summary *runSummary
+		class   v1.ErrorClass
+		err     error
+		fields  map[string]any
+	}{
+		{name: "success", summary: &runSummary{
+			imageDigest: "sha256:abc",
+			submittedAt: submittedAt, admittedAt: at(time.Second), startedAt: at(1500 * time.Millisecond),
+			runningAt: at(2 * time.Second), exitedAt: at(5 * time.Second),
+			result: &registry.Result{Outcome: registry.OutcomeSucceeded, StdoutBytes: 12,
+				Usage: services.Usage{PeakMemory: 1 << 20, CPUSeconds: 0.5}},
+		}, class: v1.ErrorClass_ERROR_CLASS_NONE, fields: map[string]any{
+			"imageDigest": "sha256:abc", "errorClass": "ERROR_CLASS_NONE", "code": "OK",
+			"queueWait": 1000.0, "setupTime": 1000.0, "bootTime": 500.0, "executionTime": 3000.0,
+			"outcome": "succeeded", "exitCode": 0.0, "peakMemory": float64(1 << 20), "cpuSeconds": 0.5,
+			"stdoutBytes": 12.0, "stderrBytes": 0.0, "outputTruncated": false,
+		}},
+		{name: "timeout", summary: &runSummary{
+			submittedAt: submittedAt, admittedAt: at(time.Second), startedAt: at(1500 * time.Millisecond),
+			runningAt: at(2 * time.Second), exitedAt: at(3 * time.Second),
+			result:     &registry.Result{Outcome: registry.OutcomeTimedOut, ExitCode: -1},
+			stopReason: "timeout",
+		}, class: v1.ErrorClass_ERROR_CLASS_TIMEOUT, err: status.Error(codes.DeadlineExceeded, "context deadline exceeded"),
+			fields: map[string]any{
+				"errorClass": "ERROR_CLASS_TIMEOUT", "code": "DeadlineExceeded", "executionTime": 1000.0,
+				"outcome": "timed_out", "exitCode": -1.0, "stopReason": "timeout",
+			}},
+		{name: "oom killed", summary: &runSummary{
+			submittedAt: submittedAt, admittedAt: at(time.Second), startedAt: at(1500 * time.Millisecond),
+			runningAt: at(2 * time.Second), exitedAt: at(2500 * time.Millisecond),
+			result: &registry.Result{Outcome: registry.OutcomeOOMKilled, ExitCode: 137,
+				Usage: services.Usage{PeakMemory: 512 << 20}},
+			outputTruncated: true,
+		}, class: v1.ErrorClass_ERROR_CLASS_OOM_KILLED, fields: map[string]any{
+			"errorClass": "ERROR_CLASS_OOM_KILLED", "code": "OK", "executionTime": 500.0,
+			"outcome": "oom_killed", "exitCode": 137.0, "peakMemory": float64(512 << 20), "outputTruncated": true,
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fields := loggedSummary(t, test.summary, test.class, test.err)
+			for key, want := range test.fields {
+				if fields[key] != want {
+					t.Errorf("%s = %v, want %v", key, fields[key], want)
+				}
+			}
+			if _, ok := test.fields["stopReason"]; !ok && fields["stopReason"] != nil {
+				t.Errorf("stopReason = %v of the run that hasn't been cut short", fields["stopReason"])
+			}
+			if fields["message"] != "run completed" || fields["level"] != "info" {
+				t.Errorf("the completion entry is %v %q", fields["level"], fields["message"])
+			}
+		})
+	}
+
+	// the runs rejected before the admission have nothing but the queue wait
+	fields := loggedSummary(t, &runSummary{submittedAt: submittedAt}, v1.ErrorClass_ERROR_CLASS_REJECTED,
+		status.Error(codes.InvalidArgument, "invalid label"))
+	for _, key := range []string{"setupTime", "bootTime", "executionTime", "outcome", "exitCode"} {
+		if fields[key] != nil {
+			t.Errorf("%s = %v of the rejected run, want none", key, fields[key])
+		}
+	}
+	if fields["stopReason"] != "invalid label" {
+		t.Errorf("stopReason = %v, want the message of the status", fields["stopReason"])
+	}
+}
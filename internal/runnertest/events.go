@@ -0,0 +1,94 @@
+package runnertest
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/lifecycle"
+)
+
+// flushEvent is the type of the events marking what the dispatcher has
+// published so far, which the runner never emits.
+const flushEvent lifecycle.EventType = "runnertest.flush"
+
+// Events is the publisher of the lifecycle events of the runner, recording
+// what it's given, as a broker would receive it.
+type Events struct {
+	dispatcher *lifecycle.Dispatcher
+
+	mutex   sync.Mutex
+	events  []lifecycle.Event
+	flushes int
+	changed chan struct{}
+}
+
+// newEvents returns the recorder of the events, dispatched until the test ends.
+func newEvents(t testing.TB) *Events {
+	events := &Events{changed: make(chan struct{})}
+	events.dispatcher = lifecycle.NewDispatcher(events, 64)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		events.dispatcher.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return events
+}
+
+func (e *Events) Publish(_ context.Context, eventType lifecycle.EventType, key string, payload []byte) error {
+	var event lifecycle.Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return err
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if eventType == flushEvent {
+		e.flushes++
+	} else {
+		e.events = append(e.events, event)
+	}
+	close(e.changed)
+	e.changed = make(chan struct{})
+	return nil
+}
+
+func (e *Events) Close() error { return nil }
+
+// Of returns the events of the run published once everything emitted before
+// the call is, in the order of their emission.
+func (e *Events) Of(t testing.TB, requestID string) []lifecycle.Event {
+	t.Helper()
+	e.mutex.Lock()
+	flushes := e.flushes
+	e.mutex.Unlock()
+	e.dispatcher.Emit(lifecycle.Event{Type: flushEvent})
+
+	timeout := time.After(waitTimeout)
+	for {
+		e.mutex.Lock()
+		changed := e.changed
+		if e.flushes > flushes {
+			var events []lifecycle.Event
+			for _, event := range e.events {
+				if event.RequestID == requestID {
+					events = append(events, event)
+				}
+			}
+			e.mutex.Unlock()
+			return events
+		}
+		e.mutex.Unlock()
+		select {
+		case <-changed:
+		case <-timeout:
+			t.Fatal("the dispatcher hasn't published the events in time")
+		}
+	}
+}
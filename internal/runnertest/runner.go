@@ -0,0 +1,355 @@
+// Package runnertest sets up a RunnerServer executing the runs on the fake
+// Docker daemon of dockertest, for the tests of the whole run pipeline, or on
+// the real daemon for the tests of the images.
+package runnertest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "github.com/Pelfox/codecell-runner/generated"
+	"github.com/Pelfox/codecell-runner/internal"
+	"github.com/Pelfox/codecell-runner/internal/admission"
+	"github.com/Pelfox/codecell-runner/internal/archive"
+	"github.com/Pelfox/codecell-runner/internal/dockertest"
+	"github.com/Pelfox/codecell-runner/internal/lifecycle"
+	"github.com/Pelfox/codecell-runner/internal/registry"
+	"github.com/Pelfox/codecell-runner/internal/services"
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/moby/moby/client"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// waitTimeout bounds the waits of the tests for the messages of a run.
+const waitTimeout = 10 * time.Second
+
+// Runner is a RunnerServer wired as the runner binary wires it, minus the
+// optional backends but the lifecycle events and the archiver, connected to a
+// fake Docker daemon, or to the real one.
+type Runner struct {
+	Daemon     *dockertest.Server // nil on the real daemon of NewDocker
+	Config     *pkg.AppConfig
+	Registry   *registry.Registry
+	Server     *internal.RunnerServer
+	Capacity   *internal.CapacityReporter
+	System     *services.SystemService
+	Languages  *services.LanguagesService
+	Containers *services.ContainersService
+	Logs       *services.LogsService
+	Events     *Events
+
+	configPath  string
+	configStore *pkg.ConfigStore
+}
+
+// New starts a fake daemon with the images of every technology and returns
+// the runner connected to it, with the default configuration changed by
+// configure, if not nil, and the client of the given options.
+func New(t testing.TB, configure func(config *pkg.AppConfig), clientOptions ...client.Opt) *Runner {
+	t.Helper()
+	daemon := dockertest.NewServer()
+	t.Cleanup(daemon.Close)
+	dockerClient, err := daemon.Client(clientOptions...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = dockerClient.Close() })
+
+	config := loadConfig(t, configure)
+	languages := services.NewLanguagesService(nil, config, nil)
+	for _, language := range languages.Languages() {
+		technology, _ := languages.Technology(language)
+		daemon.AddImage(technology.GetImage(), fmt.Sprintf("%s@sha256:%064x", technology.GetImage(), len(language)))
+	}
+	runner := newRunner(t, dockerClient, config, services.IsolationModeUserNamespace)
+	runner.Daemon = daemon
+	return runner
+}
+
+// NewDocker returns the runner connected to the Docker daemon of the
+// environment, with the images built or pulled there, for the tests of the
+// real images; they're behind build tags, the other tests don't need Docker.
+func NewDocker(t testing.TB, configure func(config *pkg.AppConfig)) *Runner {
+	t.Helper()
+	dockerClient, err := client.New(client.FromEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = dockerClient.Close() })
+	isolationMode, err := services.NewSystemService(dockerClient).DetectIsolationMode(context.Background())
+	if err != nil {
+		t.Fatalf("the Docker daemon of the environment isn't reachable: %v", err)
+	}
+	return newRunner(t, dockerClient, loadConfig(t, configure), isolationMode)
+}
+
+// loadConfig returns the default configuration changed by configure, if not nil.
+func loadConfig(t testing.TB, configure func(config *pkg.AppConfig)) *pkg.AppConfig {
+	t.Helper()
+	config, _, err := pkg.LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.LogStreamErrorBurst = 0
+	if configure != nil {
+		configure(config)
+	}
+	return config
+}
+
+// newRunner wires the runner of the Docker client, verifying the images.
+func newRunner(
+	t testing.TB,
+	dockerClient *client.Client,
+	config *pkg.AppConfig,
+	isolationMode services.IsolationMode,
+) *Runner {
+	t.Helper()
+	ctx := context.Background()
+	languagesService := services.NewLanguagesService(dockerClient, config, nil)
+	languagesService.VerifyImages(ctx)
+
+	systemService := services.NewSystemService(dockerClient)
+	hostResources, err := systemService.HostResources(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	containersService, err := services.NewContainersService(dockerClient, config, languagesService, isolationMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runRegistry := registry.New(config.MemoryCapacity(hostResources.Memory), config.CompletedRunsRetention,
+		config.AbsoluteMaxRunDuration())
+
+	var preemptAfter time.Duration
+	if config.PreemptionEnabled {
+		preemptAfter = config.PreemptionWaitThreshold
+	}
+	limiter := admission.NewLimiter(admission.GlobalScope, config.MaxConcurrentRuns, config.QueueMaxDepth,
+		config.QueueMaxWait, preemptAfter)
+	languageLimiters := internal.NewLanguageLimiters(languagesService, config, preemptAfter)
+	quotaTracker := admission.NewQuotaTracker(pkg.Quota{
+		MaxConcurrent: config.QuotaMaxConcurrent,
+		RunsPerMinute: config.QuotaRunsPerMinute,
+	}, nil, config.QuotaMaxIdentities)
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	configStore := pkg.NewConfigStore(configPath, config)
+	configStore.OnReload(func(dynamic *pkg.DynamicConfig) {
+		limiter.SetLimits(dynamic.MaxConcurrentRuns, dynamic.QueueMaxDepth, dynamic.QueueMaxWait)
+		internal.SetLanguageLimits(languageLimiters, languagesService, dynamic)
+		overrides, _ := pkg.ParseQuotaOverrides(dynamic.QuotaOverrides) // validated already
+		quotaTracker.SetQuotas(pkg.Quota{
+			MaxConcurrent: dynamic.QuotaMaxConcurrent,
+			RunsPerMinute: dynamic.QuotaRunsPerMinute,
+		}, overrides)
+	})
+	priorityPolicy, err := admission.NewPriorityPolicy(config.MaxPriority, config.MaxPriorityOverrides)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logsService := services.NewLogsService(dockerClient)
+	var coalescer *internal.Coalescer
+	if config.DedupEnabled {
+		coalescer = internal.NewCoalescer()
+	}
+	var archiver *archive.Archiver
+	if config.ArchiveEndpoint != "" {
+		if archiver, err = archive.NewArchiver(config); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	capacityReporter := internal.NewCapacityReporter(config, runRegistry, limiter, languageLimiters, languagesService,
+		hostResources)
+	events := newEvents(t)
+	server := internal.NewRunnerServer(
+		config,
+		configStore,
+		runRegistry,
+		limiter,
+		languageLimiters,
+		quotaTracker,
+		priorityPolicy,
+		capacityReporter,
+		nil,
+		nil,
+		nil,
+		events.dispatcher,
+		lifecycle.NewWebhookNotifier(config),
+		nil,
+		archiver,
+		nil,
+		coalescer,
+		nil,
+		nil,
+		services.NewDiskMonitor(dockerClient, config, services.StatfsUsageSource{Path: t.TempDir()}),
+		systemService,
+		languagesService,
+		containersService,
+		logsService,
+	)
+	return &Runner{
+		Config:      config,
+		configPath:  configPath,
+		configStore: configStore,
+		Registry:    runRegistry,
+		Server:      server,
+		Capacity:    capacityReporter,
+		System:      systemService,
+		Languages:   languagesService,
+		Containers:  containersService,
+		Logs:        logsService,
+		Events:      events,
+	}
+}
+
+// Reload writes the configuration file and reloads it, as on SIGHUP. The
+// settings the file omits are reloaded with their defaults.
+func (r *Runner) Reload(t testing.TB, contents string) {
+	t.Helper()
+	if err := os.WriteFile(r.configPath, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.configStore.Reload(); err != nil {
+		t.Fatalf("Reload() = %v", err)
+	}
+}
+
+// Run executes the run to its end, returning the stream of its messages and
+// the status it has ended with.
+func (r *Runner) Run(ctx context.Context, request *v1.RunRequest) (*Stream, error) {
+	stream := NewStream(ctx)
+	err := r.Server.Run(request, stream)
+	return stream, err
+}
+
+// Start executes the run in the background, returning the stream of its
+// messages and the channel of the status it ends with.
+func (r *Runner) Start(ctx context.Context, request *v1.RunRequest) (*Stream, <-chan error) {
+	stream := NewStream(ctx)
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Server.Run(request, stream)
+	}()
+	return stream, done
+}
+
+// Stream is a Run stream recording the messages sent to the client.
+type Stream struct {
+	grpc.ServerStream // nil, the methods used by Run are overridden
+	ctx               context.Context
+
+	mutex    sync.Mutex
+	messages []*v1.RunResponseMessage
+	changed  chan struct{}
+}
+
+// NewStream creates a new Stream of the client context.
+func NewStream(ctx context.Context) *Stream {
+	return &Stream{ctx: ctx, changed: make(chan struct{})}
+}
+
+func (s *Stream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *Stream) Send(message *v1.RunResponseMessage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.messages = append(s.messages, message)
+	close(s.changed)
+	s.changed = make(chan struct{})
+	return nil
+}
+
+func (s *Stream) SendMsg(m any) error {
+	message, ok := m.(*v1.RunResponseMessage)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", m)
+	}
+	return s.Send(message)
+}
+
+func (s *Stream) SetHeader(metadata.MD) error  { return nil }
+func (s *Stream) SendHeader(metadata.MD) error { return nil }
+func (s *Stream) SetTrailer(metadata.MD)       {}
+
+// Messages returns the messages sent so far.
+func (s *Stream) Messages() []*v1.RunResponseMessage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]*v1.RunResponseMessage(nil), s.messages...)
+}
+
+// Await waits for the first message of the level, returning nil if none is
+// sent in time.
+func (s *Stream) Await(level v1.MessageLevel) *v1.RunResponseMessage {
+	timeout := time.After(waitTimeout)
+	for {
+		s.mutex.Lock()
+		changed := s.changed
+		for _, message := range s.messages {
+			if message.Level == level {
+				s.mutex.Unlock()
+				return message
+			}
+		}
+		s.mutex.Unlock()
+		select {
+		case <-changed:
+		case <-timeout:
+			return nil
+		}
+	}
+}
+
+// Lines returns the text of the messages of the level, e.g. of STDOUT.
+func (s *Stream) Lines(level v1.MessageLevel) []string {
+	var lines []string
+	for _, message := range s.Messages() {
+		if message.Level == level {
+			lines = append(lines, message.GetMessage())
+		}
+	}
+	return lines
+}
+
+// ExitCode returns the exit code of the EXIT_CODE message, if any.
+func (s *Stream) ExitCode() (int64, bool) {
+	for _, message := range s.Messages() {
+		if message.Level == v1.MessageLevel_EXIT_CODE {
+			return message.GetExitCode(), true
+		}
+	}
+	return 0, false
+}
+
+// Terminal returns the terminal message of the run, the one carrying the
+// class of its outcome, nil if none was sent.
+func (s *Stream) Terminal() *v1.RunResponseMessage {
+	for _, message := range s.Messages() {
+		if message.ErrorClass != v1.ErrorClass_ERROR_CLASS_UNSPECIFIED {
+			return message
+		}
+	}
+	return nil
+}
+
+// StatusClass returns the class of the outcome the status of the run carries
+// in its ErrorInfo, ERROR_CLASS_UNSPECIFIED if none.
+func StatusClass(err error) v1.ErrorClass {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			return v1.ErrorClass(v1.ErrorClass_value[info.Reason])
+		}
+	}
+	return v1.ErrorClass_ERROR_CLASS_UNSPECIFIED
+}
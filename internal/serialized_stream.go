@@ -0,0 +1,28 @@
+package internal
+
+import (
+	"sync"
+
+	v1 "github.com/Pelfox/codecell-runner/generated"
+	"google.golang.org/grpc"
+)
+
+// serializedStream serializes the sends of the Run stream, which gRPC doesn't
+// allow concurrently, the statistics being sent from a goroutine of their own
+// while the run sends its output and exit messages.
+type serializedStream struct {
+	grpc.ServerStreamingServer[v1.RunResponseMessage]
+	mutex sync.Mutex
+}
+
+func (s *serializedStream) Send(message *v1.RunResponseMessage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.ServerStreamingServer.Send(message)
+}
+
+func (s *serializedStream) SendMsg(m any) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.ServerStreamingServer.SendMsg(m)
+}
@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v1 "github.com/Pelfox/codecell-runner/generated"
+	"google.golang.org/grpc"
+)
+
+// overlapStream records the most sends in progress at once.
+type overlapStream struct {
+	grpc.ServerStreamingServer[v1.RunResponseMessage]
+	inProgress atomic.Int32
+	maximum    atomic.Int32
+}
+
+func (s *overlapStream) Send(*v1.RunResponseMessage) error {
+	current := s.inProgress.Add(1)
+	defer s.inProgress.Add(-1)
+	for maximum := s.maximum.Load(); current > maximum && !s.maximum.CompareAndSwap(maximum, current); {
+		maximum = s.maximum.Load()
+	}
+	time.Sleep(100 * time.Microsecond)
+	return nil
+}
+
+func TestSerializedStreamSendsOneMessageAtATime(t *testing.T) {
+	inner := &overlapStream{}
+	stream := &serializedStream{ServerStreamingServer: inner}
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			for range 20 {
+				_ = stream.Send(&v1.RunResponseMessage{Level: v1.MessageLevel_STATISTICS})
+			}
+		})
+	}
+	wg.Wait()
+	if maximum := inner.maximum.Load(); maximum != 1 {
+		t.Errorf("%d messages were sent at once, want 1", maximum)
+	}
+}
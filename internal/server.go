@@ -2,154 +2,1002 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"sync"
+	"runtime"
+	"strings"
 	"time"
 
 	v1 "github.com/Pelfox/codecell-runner/generated"
+	"github.com/Pelfox/codecell-runner/internal/admission"
+	"github.com/Pelfox/codecell-runner/internal/archive"
+	"github.com/Pelfox/codecell-runner/internal/audit"
+	"github.com/Pelfox/codecell-runner/internal/auth"
+	"github.com/Pelfox/codecell-runner/internal/lifecycle"
+	"github.com/Pelfox/codecell-runner/internal/metrics"
+	"github.com/Pelfox/codecell-runner/internal/middleware"
+	"github.com/Pelfox/codecell-runner/internal/registry"
 	"github.com/Pelfox/codecell-runner/internal/services"
+	"github.com/Pelfox/codecell-runner/internal/tracing"
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/docker/go-units"
 	"github.com/google/uuid"
-	"github.com/rs/zerolog/log"
+	"github.com/moby/moby/api/types/events"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
+const (
+	// maxLabels is the maximum number of labels of a run.
+	maxLabels = 16
+	// maxLabelKeyLength is the maximum length of a label key.
+	maxLabelKeyLength = 63
+	// maxLabelValueLength is the maximum length of a label value.
+	maxLabelValueLength = 255
+)
+
+// unexpectedDeathGrace is how long the wait channel may lag behind a die event
+// before the run is failed with the exit code from the event.
+const unexpectedDeathGrace = 2 * time.Second
+
+// maxWaitRetries is the number of times the container is waited for again
+// after losing the connection to the daemon, e.g. on its restart, and
+// waitRetryDelay is the delay before each new wait.
+const (
+	maxWaitRetries = 5
+	waitRetryDelay = time.Second
+)
+
+var (
+	// errRunPreempted is the cause of the cancellation of the preempted runs.
+	errRunPreempted = errors.New("the run is preempted by a higher priority run")
+	// errRunCapped is the cause of the cancellation of the runs reaching the
+	// server-wide cap on the run time.
+	errRunCapped = errors.New("the run has reached the server-wide run time cap")
+	// errRunTimedOut is the cause of the cancellation of the runs reaching
+	// their timeout counted from the boot of their runtime.
+	errRunTimedOut = errors.New("the run has reached its timeout")
+)
+
+// buildCacheStoreTimeout bounds the copy of the build outputs out of the
+// exited container, which delays its removal.
+const buildCacheStoreTimeout = 30 * time.Second
+
+// errorInfoDomain is the domain of the ErrorInfo details of the run statuses.
+const errorInfoDomain = "codecell-runner"
+
 // RunnerServer implements the gRPC server for the runner service protocol definition.
 type RunnerServer struct {
 	v1.UnimplementedRunnerServiceServer
 
+	appConfig         *pkg.AppConfig
+	configStore       *pkg.ConfigStore
+	registry          *registry.Registry
+	limiter           *admission.Limiter
+	languageLimiters  map[string]*admission.Limiter
+	quotaTracker      *admission.QuotaTracker
+	priorityPolicy    *admission.PriorityPolicy
+	capacityReporter  *CapacityReporter
+	warmPool          *services.WarmPool
+	sharedBackend     registry.SharedBackend // nil unless the instances share the runs
+	peerCredentials   credentials.TransportCredentials
+	lifecycleEvents   *lifecycle.Dispatcher
+	webhookNotifier   *lifecycle.WebhookNotifier
+	runStore          registry.RunStore // nil unless the completed runs are persisted
+	archiver          *archive.Archiver // nil unless the outputs can be archived
+	auditLogger       *audit.Logger
+	coalescer         *Coalescer              // nil unless identical runs are coalesced
+	buildCache        *services.BuildCache    // nil unless the build outputs are cached
+	assetsService     *services.AssetsService // nil unless the runs can mount assets
+	diskMonitor       *services.DiskMonitor
+	systemService     *services.SystemService
+	languagesService  *services.LanguagesService
 	containersService *services.ContainersService
 	logsService       *services.LogsService
+	detached          *DetachedRuns
 
-	mutex    sync.Mutex
-	requests map[string]string // ID = request ID, Value = container ID
-	cancels  map[string]context.CancelFunc
+	streamErrorSampler zerolog.Sampler // nil logs all of the stream errors
 }
 
 // NewRunnerServer creates a new instance of RunnerServer with the given subservices.
-func NewRunnerServer(containersService *services.ContainersService, logsService *services.LogsService) *RunnerServer {
+func NewRunnerServer(
+	appConfig *pkg.AppConfig,
+	configStore *pkg.ConfigStore,
+	runRegistry *registry.Registry,
+	limiter *admission.Limiter,
+	languageLimiters map[string]*admission.Limiter,
+	quotaTracker *admission.QuotaTracker,
+	priorityPolicy *admission.PriorityPolicy,
+	capacityReporter *CapacityReporter,
+	warmPool *services.WarmPool,
+	sharedBackend registry.SharedBackend,
+	peerCredentials credentials.TransportCredentials,
+	lifecycleEvents *lifecycle.Dispatcher,
+	webhookNotifier *lifecycle.WebhookNotifier,
+	runStore registry.RunStore,
+	archiver *archive.Archiver,
+	auditLogger *audit.Logger,
+	coalescer *Coalescer,
+	buildCache *services.BuildCache,
+	assetsService *services.AssetsService,
+	diskMonitor *services.DiskMonitor,
+	systemService *services.SystemService,
+	languagesService *services.LanguagesService,
+	containersService *services.ContainersService,
+	logsService *services.LogsService,
+) *RunnerServer {
 	return &RunnerServer{
+		appConfig:         appConfig,
+		configStore:       configStore,
+		registry:          runRegistry,
+		limiter:           limiter,
+		languageLimiters:  languageLimiters,
+		quotaTracker:      quotaTracker,
+		priorityPolicy:    priorityPolicy,
+		capacityReporter:  capacityReporter,
+		warmPool:          warmPool,
+		sharedBackend:     sharedBackend,
+		peerCredentials:   peerCredentials,
+		lifecycleEvents:   lifecycleEvents,
+		webhookNotifier:   webhookNotifier,
+		runStore:          runStore,
+		archiver:          archiver,
+		auditLogger:       auditLogger,
+		coalescer:         coalescer,
+		buildCache:        buildCache,
+		assetsService:     assetsService,
+		diskMonitor:       diskMonitor,
+		systemService:     systemService,
+		languagesService:  languagesService,
 		containersService: containersService,
 		logsService:       logsService,
+		detached:          NewDetachedRuns(appConfig.DetachedRunRetention),
+
+		streamErrorSampler: newStreamErrorSampler(appConfig),
+	}
+}
+
+// newStreamErrorSampler returns the sampler bounding the errors of sending to
+// the Run streams, logged for every message otherwise, shared by all runs so
+// that no number of misbehaving clients floods the logs.
+func newStreamErrorSampler(config *pkg.AppConfig) zerolog.Sampler {
+	if config.LogStreamErrorBurst <= 0 {
+		return nil
+	}
+	return &zerolog.BurstSampler{
+		Burst:  uint32(config.LogStreamErrorBurst),
+		Period: config.LogStreamErrorPeriod,
+	}
+}
+
+// resourceExhausted builds the RESOURCE_EXHAUSTED status for rejected runs,
+// hinting the client when to retry.
+func (s *RunnerServer) resourceExhausted(message string) error {
+	st := status.New(codes.ResourceExhausted, message)
+	detailed, err := st.WithDetails(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(s.configStore.Load().AdmissionRetryAfter),
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// classifyStatus attaches the class of the outcome to the failed status of a
+// run, as the reason of its ErrorInfo detail, unless the status is classified
+// already, by the run it has followed.
+func classifyStatus(err error, class v1.ErrorClass) error {
+	if err == nil {
+		return nil
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		st = status.FromContextError(err)
+	}
+	for _, detail := range st.Details() {
+		if _, ok := detail.(*errdetails.ErrorInfo); ok {
+			return err
+		}
+	}
+	detailed, detailsErr := st.WithDetails(&errdetails.ErrorInfo{
+		Reason: class.String(),
+		Domain: errorInfoDomain,
+	})
+	if detailsErr != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// serviceStatus maps the error of the services to the status code, the
+// user-facing message and the class of the failed run. The errors of no known
+// kind are internal, their details are left to the logs.
+func serviceStatus(err error) (codes.Code, string, v1.ErrorClass) {
+	switch {
+	case errors.Is(err, services.ErrUnsupportedLanguage):
+		return codes.InvalidArgument, "the specified language is not supported", v1.ErrorClass_ERROR_CLASS_UNSUPPORTED_LANGUAGE
+	case errors.Is(err, services.ErrLanguageUnavailable):
+		return codes.FailedPrecondition, "the specified language is unavailable on this runner",
+			v1.ErrorClass_ERROR_CLASS_UNSUPPORTED_LANGUAGE
+	case errors.Is(err, services.ErrImageMissing):
+		return codes.FailedPrecondition, "the image of the run is not available on this runner",
+			v1.ErrorClass_ERROR_CLASS_SYSTEM_ERROR
+	case errors.Is(err, services.ErrBackendUnavailable):
+		return codes.Unavailable, "the container backend is unavailable", v1.ErrorClass_ERROR_CLASS_SYSTEM_ERROR
+	case errors.Is(err, services.ErrContainerNotFound):
+		return codes.NotFound, "the execution container no longer exists", v1.ErrorClass_ERROR_CLASS_SYSTEM_ERROR
+	case errors.Is(err, services.ErrResourceExceeded):
+		return codes.ResourceExhausted, "the runner lacks the resources for the execution", v1.ErrorClass_ERROR_CLASS_SYSTEM_ERROR
+	}
+	return codes.Internal, "the runner failed to execute the run", v1.ErrorClass_ERROR_CLASS_SYSTEM_ERROR
+}
+
+// cancellationClass tells the client going away from the run being stopped.
+func cancellationClass(streamCtx context.Context) v1.ErrorClass {
+	if streamCtx.Err() != nil {
+		return v1.ErrorClass_ERROR_CLASS_CANCELLED_BY_CLIENT
+	}
+	return v1.ErrorClass_ERROR_CLASS_STOPPED_BY_OPERATOR
+}
+
+// acquireSlot takes a slot of the limiter, converting the admission failures
+// into the gRPC statuses.
+func (s *RunnerServer) acquireSlot(
+	ctx context.Context,
+	limiter *admission.Limiter,
+	priority admission.Priority,
+	notify func(position int, estimatedWait time.Duration),
+) (*admission.Slot, error) {
+	slot, err := limiter.Acquire(ctx, priority, notify)
+	scope := limiter.Scope()
+	switch {
+	case errors.Is(err, admission.ErrLimitReached):
+		metrics.AdmissionRejections.WithLabelValues("concurrency").Inc()
+		if scope == admission.GlobalScope {
+			return nil, s.resourceExhausted(fmt.Sprintf("too many concurrent runs, the limit is %d", limiter.Limit()))
+		}
+		return nil, s.resourceExhausted(fmt.Sprintf("too many concurrent %s runs, the limit is %d", scope, limiter.Limit()))
+	case errors.Is(err, admission.ErrQueueFull):
+		metrics.AdmissionRejections.WithLabelValues("queue_full").Inc()
+		return nil, s.resourceExhausted("admission queue is full")
+	case errors.Is(err, admission.ErrQueueTimeout):
+		metrics.AdmissionRejections.WithLabelValues("queue_timeout").Inc()
+		return nil, status.Error(codes.DeadlineExceeded, "timed out waiting for a free execution slot")
+	case err != nil:
+		return nil, status.FromContextError(err).Err()
+	}
+	return slot, nil
+}
+
+// takePooled claims a warm pool container for the request, if it's eligible.
+// Pool containers have the configured memory limit, so a lowered one opts out.
+func (s *RunnerServer) takePooled(request services.ContainerRequest) (string, bool) {
+	// the pooled containers have the limits of the boot configuration
+	pooled, _ := s.languagesService.Config(request.Language, &s.appConfig.DynamicConfig)
+	// the pooled containers run the default command of the language
+	if request.Image != "" || request.NetworkEnabled || len(request.Assets) > 0 || len(request.Args) > 0 ||
+		request.MemoryLimit != pooled.MemoryLimit || request.CPULimit != pooled.CPULimit {
+		return "", false
+	}
+	return s.warmPool.Take(request.Language)
+}
+
+// validateLabels checks that the run labels stay small, they are copied into
+// every event and record of the run.
+func validateLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("at most %d labels are allowed", maxLabels)
+	}
+	for key, value := range labels {
+		if key == "" || len(key) > maxLabelKeyLength {
+			return fmt.Errorf("label key %q must be 1 to %d bytes long", key, maxLabelKeyLength)
+		}
+		if len(value) > maxLabelValueLength {
+			return fmt.Errorf("value of label %q must be at most %d bytes long", key, maxLabelValueLength)
+		}
+	}
+	return nil
+}
 
-		mutex:    sync.Mutex{},
-		requests: make(map[string]string),
-		cancels:  make(map[string]context.CancelFunc),
+// validateSubmissionSize checks the sizes of the source code and stdin, with
+// limits below the transport one, so that the clients get a clear message
+// instead of the opaque RESOURCE_EXHAUSTED of gRPC.
+func validateSubmissionSize(request *v1.RunRequest, config *pkg.DynamicConfig) error {
+	if size := len(request.SourceCode); size > config.MaxSourceSize {
+		return fmt.Errorf("source code is %s, the limit is %s",
+			units.BytesSize(float64(size)), units.BytesSize(float64(config.MaxSourceSize)))
+	}
+	var stdinSize int
+	for _, line := range request.Stdin {
+		stdinSize += len(line)
+	}
+	if stdinSize > config.MaxStdinSize {
+		return fmt.Errorf("stdin is %s, the limit is %s",
+			units.BytesSize(float64(stdinSize)), units.BytesSize(float64(config.MaxStdinSize)))
+	}
+	return nil
+}
+
+// runPriority converts the requested priority to the admission one.
+func runPriority(priority v1.RunPriority) admission.Priority {
+	switch priority {
+	case v1.RunPriority_PRIORITY_BATCH:
+		return admission.PriorityBatch
+	case v1.RunPriority_PRIORITY_INTERACTIVE:
+		return admission.PriorityInteractive
+	default:
+		return admission.PriorityNormal
 	}
 }
 
 func (s *RunnerServer) Run(request *v1.RunRequest, stream grpc.ServerStreamingServer[v1.RunResponseMessage]) error {
+	return s.execute(request, nil, stream)
+}
+
+// scopedStream overrides the context of the Run stream with the one carrying the
+// logger of the run.
+type scopedStream struct {
+	grpc.ServerStreamingServer[v1.RunResponseMessage]
+	ctx context.Context
+}
+
+func (s *scopedStream) Context() context.Context {
+	return s.ctx
+}
+
+// execute executes the run, writing the submitted files, if any, into the
+// workspace along the source code.
+func (s *RunnerServer) execute(
+	request *v1.RunRequest,
+	files *pkg.FileSpool,
+	stream grpc.ServerStreamingServer[v1.RunResponseMessage],
+) (runErr error) {
+	// every exit path sets the class of the outcome, anything before the
+	// admission is a rejection
+	errorClass := v1.ErrorClass_ERROR_CLASS_REJECTED
+	// every run ends with a single entry summing it up, the rejected ones too
+	summary := &runSummary{submittedAt: time.Now()}
+	// the aliases run as the language they stand for, with its settings
+	request.Language = s.languagesService.Resolve(request.Language)
+	stream = &scopedStream{
+		ServerStreamingServer: stream,
+		ctx:                   middleware.WithLogFields(stream.Context(), "language", request.Language),
+	}
+	defer func() {
+		runErr = classifyStatus(runErr, errorClass)
+		summary.log(zerolog.Ctx(stream.Context()), errorClass, runErr)
+	}()
+
+	// the startup canary isn't traffic, it's kept out of the quotas and the metrics
+	canary := isCanary(stream.Context())
+	if !canary {
+		s.capacityReporter.RecordArrival()
+	}
+	if s.capacityReporter.Draining() {
+		return status.Errorf(codes.Unavailable, "runner is draining")
+	}
+	// the run reads the dynamic settings once, a reload applies to the next ones
+	dynamicConfig := s.configStore.Load()
+	trace.SpanFromContext(stream.Context()).SetAttributes(
+		attribute.String("codecell.language", request.Language),
+		attribute.String("codecell.image", request.Image),
+	)
+
+	if err := validateLabels(request.Labels); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := validateSubmissionSize(request, dynamicConfig); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	// the runs of the unavailable languages are rejected right away, with the
+	// reason, rather than failing at the creation of the container
+	if request.Image == "" {
+		if err := s.languagesService.Availability(request.Language); err != nil {
+			code, _, class := serviceStatus(err)
+			errorClass = class
+			return status.Error(code, err.Error())
+		}
+		technology, _ := s.languagesService.Technology(request.Language)
+		if _, err := technology.GetCommandWithArgs(request.Args); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	// the callbacks of the clients are restricted to the allowlisted hosts, the
+	// server-wide one is trusted
+	callbackURL := s.appConfig.WebhookURL
+	if request.CallbackUrl != "" {
+		if err := s.webhookNotifier.Validate(request.CallbackUrl); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		callbackURL = request.CallbackUrl
+	}
+
+	// the unknown assets fail the run before anything is created for it
+	var assets []services.Asset
+	if len(request.Assets) > 0 {
+		if s.assetsService == nil {
+			return status.Errorf(codes.FailedPrecondition, "assets are not enabled on this server")
+		}
+		found, err := s.assetsService.Lookup(request.Assets)
+		if errors.Is(err, services.ErrAssetNotFound) {
+			return status.Error(codes.NotFound, err.Error())
+		}
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		assets = found
+	}
+
+	archiveOutput := request.ArchiveOutput ||
+		(s.appConfig.ArchiveLabel != "" && request.Labels[s.appConfig.ArchiveLabel] == "true")
+	if archiveOutput && s.archiver == nil {
+		return status.Errorf(codes.FailedPrecondition, "output archival is not enabled on this server")
+	}
+
+	// network access is opt-in per request, but only if the server allows it at all
+	networkEnabled := request.NetworkPolicy == v1.NetworkPolicy_NETWORK_ALLOWLISTED
+	if networkEnabled && !s.appConfig.NetworkEnabled {
+		return status.Errorf(codes.PermissionDenied, "network access is not allowed on this server")
+	}
+
+	// custom images are reserved for admins, and only from the allowlisted repositories
+	if request.Image != "" {
+		if !auth.PrincipalFromContext(stream.Context()).IsAdmin() {
+			return status.Errorf(codes.PermissionDenied, "custom images are allowed only for admins")
+		}
+		if !pkg.MatchImageAllowlist(request.Image, s.appConfig.CustomImageAllowlist) {
+			return status.Errorf(codes.PermissionDenied, "image %q is not allowlisted", request.Image)
+		}
+		if len(request.Command) == 0 {
+			return status.Errorf(codes.InvalidArgument, "command is required for custom images")
+		}
+		if len(request.Args) > 0 {
+			return status.Errorf(codes.InvalidArgument, "args are not supported for custom images, the command takes them")
+		}
+	}
+
+	// unidentified callers share the quota of the empty identity; the limits
+	// of the principal can only lower the server ones
+	var identity string
+	languageConfig, limitSource := s.languagesService.Config(request.Language, dynamicConfig)
+	timeout := time.Duration(request.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = languageConfig.DefaultTimeout
+	}
+	if languageConfig.MaxTimeout > 0 && timeout > languageConfig.MaxTimeout {
+		return status.Errorf(codes.InvalidArgument, "timeout of %s exceeds the limit of %s", timeout, languageConfig.MaxTimeout)
+	}
+	memoryLimit := languageConfig.MemoryLimit
+	// where the limit comes from is told along the OOM terminations
+	memoryLimitSource := "the server default"
+	switch limitSource {
+	case services.MemoryLimitLanguage:
+		memoryLimitSource = fmt.Sprintf("the %s language", request.Language)
+	case services.MemoryLimitTechnology:
+		memoryLimitSource = fmt.Sprintf("the %s runtime", request.Language)
+	}
+	if principal := auth.PrincipalFromContext(stream.Context()); principal != nil {
+		identity = principal.Identity
+		if principal.MaxTimeout > 0 && timeout > principal.MaxTimeout {
+			return status.Errorf(codes.PermissionDenied, "timeout of %s exceeds the limit of %s", timeout, principal.MaxTimeout)
+		}
+		if principal.MaxMemory > 0 && (memoryLimit == 0 || principal.MaxMemory < memoryLimit) {
+			memoryLimit = principal.MaxMemory
+			memoryLimitSource = "the caller"
+		}
+	}
+	// the client deadline bounds the execution too, minus the time to tear it
+	// down and report the outcome before the stream dies
+	budgetLimit, clientDeadline := stream.Context().Deadline()
+	budgetLimit = budgetLimit.Add(-dynamicConfig.DeadlineTeardownMargin)
+	if clientDeadline && time.Until(budgetLimit) <= 0 {
+		return status.Error(codes.DeadlineExceeded, "client deadline leaves no time for the execution")
+	}
+	var peerAddress string
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		peerAddress = p.Addr.String()
+	}
+	// an identical run of the same identity in flight is followed instead of
+	// being executed once more; coalesced runs hold no quota or slots, the
+	// submitted files aren't hashed, those runs are never coalesced
 	requestID := uuid.New()
+	middleware.AnnotationsFromContext(stream.Context()).SetRequestID(requestID.String())
+	// the entries of the run, logged by the services too, carry its request ID
+	stream = &scopedStream{
+		ServerStreamingServer: stream,
+		ctx:                   middleware.WithLogFields(stream.Context(), "requestID", requestID.String()),
+	}
+	logger := zerolog.Ctx(stream.Context())
+	trace.SpanFromContext(stream.Context()).SetAttributes(attribute.String("codecell.request_id", requestID.String()))
+	if request.Image == "" {
+		summary.imageDigest = s.languagesService.Status(request.Language).Digest
+	}
+	if s.coalescer != nil && !request.SkipDedup && files == nil {
+		key := CoalescingKey(identity, summary.imageDigest, request)
+		broadcast, originatorStream, finish := s.coalescer.Join(key, requestID.String(), stream)
+		if broadcast != nil {
+			summary.coalesced = true
+			return s.watchRun(requestID.String(), identity, broadcast, stream)
+		}
+		stream = originatorStream
+		defer func() { finish(classifyStatus(runErr, errorClass)) }()
+	}
+	stream = &serializedStream{ServerStreamingServer: stream}
+
+	releaseQuota := func() {}
+	var err error
+	if !canary {
+		if releaseQuota, err = s.quotaTracker.Acquire(identity); err != nil {
+			return s.resourceExhausted(err.Error())
+		}
+	}
+	defer releaseQuota()
+
+	priority := runPriority(request.Priority)
+	if !s.priorityPolicy.Allowed(identity, priority) {
+		return status.Errorf(codes.PermissionDenied, "priority %s is not allowed", request.Priority)
+	}
+
+	// the daemon fails at create or copy with opaque errors once its storage is full
+	if s.diskMonitor.Level() == services.DiskLevelHard {
+		metrics.AdmissionRejections.WithLabelValues("disk").Inc()
+		return s.resourceExhausted("insufficient disk space on execution host")
+	}
+
 	// top-level function for writing messages with the string (human-readable) payload
+	streamLogger := logger.Sample(s.streamErrorSampler)
+	sendMessage := func(message *v1.RunResponseMessage) error {
+		message.RequestId = requestID.String()
+		if err := stream.Send(message); err != nil {
+			streamLogger.Error().Err(err).
+				Msg("failed to send message to the stream")
+			if stream.Context().Err() != nil {
+				errorClass = v1.ErrorClass_ERROR_CLASS_CANCELLED_BY_CLIENT
+			}
+			return err
+		}
+		return nil
+	}
 	writeMessage := func(level v1.MessageLevel, message string) error {
-		err := stream.Send(&v1.RunResponseMessage{
+		return sendMessage(&v1.RunResponseMessage{
+			Level:   level,
+			Payload: &v1.RunResponseMessage_Message{Message: message},
+		})
+	}
+	// the terminal message of every exit path carries the class of the outcome
+	writeTerminal := func(level v1.MessageLevel, message string, class v1.ErrorClass) error {
+		errorClass = class
+		return sendMessage(&v1.RunResponseMessage{
+			Level:      level,
+			Payload:    &v1.RunResponseMessage_Message{Message: message},
+			ErrorClass: class,
+		})
+	}
+	// the non-fatal degradations are warnings, telling what has degraded
+	writeWarning := func(reason v1.WarningReason, message string) error {
+		return sendMessage(&v1.RunResponseMessage{
+			Level:         v1.MessageLevel_WARNING,
+			Payload:       &v1.RunResponseMessage_Message{Message: message},
+			WarningReason: reason,
+		})
+	}
+	// the failures of the services end the run with the terminal message and the
+	// status of their kind, the details are left to the logs
+	writeFailure := func(action string, err error) error {
+		code, message, class := serviceStatus(err)
+		if err := writeTerminal(v1.MessageLevel_ERROR, fmt.Sprintf("%s: %s.", action, message), class); err != nil {
+			return err
+		}
+		return status.Error(code, message)
+	}
+
+	// the run is tracked from now on, so that it can be cancelled while queued
+	// without ever reaching the container runtime
+	queueCtx, cancelQueue := context.WithCancel(stream.Context())
+	defer cancelQueue()
+	// the unsupported languages fail at the creation, with no environment to record
+	environment, _ := s.containersService.Environment(services.ContainerRequest{
+		RequestID:      requestID.String(),
+		Language:       request.Language,
+		NetworkEnabled: networkEnabled,
+		Image:          request.Image,
+		Command:        request.Command,
+		Args:           request.Args,
+	})
+	run := &registry.Run{
+		RequestID:   requestID.String(),
+		Language:    request.Language,
+		Labels:      request.Labels,
+		Identity:    identity,
+		MemoryLimit: memoryLimit,
+		CPULimit:    languageConfig.CPULimit,
+		Environment: pkg.RedactEnvironment(environment),
+		Timeout:     timeout,
+		Cancel:      cancelQueue,
+		CreatedAt:   time.Now(),
+		Events:      make(chan services.ContainerEvent, 4),
+	}
+
+	// the complete output is spooled to disk and uploaded once the run has ended
+	var spool *archive.Spool
+	if archiveOutput {
+		if spool, err = s.archiver.Spool(requestID.String()); err != nil {
+			logger.Error().Err(err).Msg("failed to create the output spool")
+			errorClass = v1.ErrorClass_ERROR_CLASS_SYSTEM_ERROR
+			return status.Errorf(codes.Internal, "failed to prepare the output archive")
+		}
+		run.ArchiveURL = spool.URL
+	}
+
+	s.registry.Track(run)
+	admitted := false
+	defer func() {
+		if admitted {
+			return
+		}
+		s.registry.Remove(requestID.String())
+		if spool != nil {
+			spool.Discard()
+		}
+	}()
+
+	// waiting for a free slot instead of piling up containers on the host; the
+	// language slot comes first, so that runs of a busy language don't hold
+	// global slots while waiting
+	notifyQueued := func(position int, estimatedWait time.Duration) {
+		s.registry.SetQueued(requestID.String())
+		_ = stream.Send(&v1.RunResponseMessage{
 			RequestId: requestID.String(),
-			Level:     level,
-			Payload:   &v1.RunResponseMessage_Message{Message: message},
+			Level:     v1.MessageLevel_QUEUED,
+			Payload: &v1.RunResponseMessage_QueueStatus{QueueStatus: &v1.QueueStatusMessage{
+				Position:             uint32(position),
+				EstimatedWaitSeconds: uint32(estimatedWait.Round(time.Second).Seconds()),
+			}},
 		})
+	}
+	var slots []*admission.Slot
+	if languageLimiter, ok := s.languageLimiters[request.Language]; ok {
+		languageSlot, err := s.acquireSlot(queueCtx, languageLimiter, priority, notifyQueued)
 		if err != nil {
-			log.Error().Str("requestID", requestID.String()).
-				Err(err).
-				Msg("failed to send message to the stream")
+			if queueCtx.Err() != nil {
+				return s.cancelQueued(queueCtx, requestID.String(), cancellationClass(stream.Context()), writeTerminal)
+			}
 			return err
 		}
-		return nil
+		defer languageSlot.Release()
+		slots = append(slots, languageSlot)
 	}
+	slot, err := s.acquireSlot(queueCtx, s.limiter, priority, notifyQueued)
+	if err != nil {
+		if queueCtx.Err() != nil {
+			return s.cancelQueued(queueCtx, requestID.String(), cancellationClass(stream.Context()), writeTerminal)
+		}
+		return err
+	}
+	defer slot.Release()
+	slots = append(slots, slot)
 
-	timeout := time.Duration(request.TimeoutSeconds) * time.Second
-	ctx, cancel := context.WithTimeout(stream.Context(), timeout)
-	defer cancel()
+	// the runtimes telling when the program starts boot on top of the timeout
+	var readyLine string
+	if technology, ok := s.languagesService.Technology(request.Language); ok && request.Image == "" {
+		readyLine = technology.GetReadyLine()
+	}
+	var bootTimeout time.Duration
+	if readyLine != "" {
+		bootTimeout = s.appConfig.BootTimeout
+	}
 
-	if err := writeMessage(v1.MessageLevel_INFO, "Starting up container..."); err != nil {
-		return err
+	// admitting the run only if the host has enough memory left for its container;
+	// a cancellation racing with the dequeue is decided by the registry
+	// the queue wait has used some of the client deadline already
+	deadline := time.Now().Add(timeout + bootTimeout)
+	deadlineBound := clientDeadline && budgetLimit.Before(deadline)
+	if deadlineBound {
+		deadline = budgetLimit
 	}
-	log.Info().Str("requestID", requestID.String()).Msg("starting up container for request")
+	if err := s.registry.Admit(requestID.String(), deadline); err != nil {
+		if errors.Is(err, registry.ErrRunCancelled) {
+			return s.cancelQueued(queueCtx, requestID.String(), cancellationClass(stream.Context()), writeTerminal)
+		}
+		metrics.AdmissionRejections.WithLabelValues("memory").Inc()
+		if errors.Is(err, registry.ErrUnlimitedMemory) {
+			logger.Error().Msg("run rejected for having no memory limit to admit it by")
+			return status.Error(codes.FailedPrecondition, "the run has no memory limit, which the memory admission requires")
+		}
+		logger.Warn().Int64("committedMemory", s.registry.CommittedMemory()).
+			Msg("run rejected due to insufficient host memory")
+		return s.resourceExhausted("insufficient memory on execution host")
+	}
+	admitted = true
+	errorClass = v1.ErrorClass_ERROR_CLASS_SYSTEM_ERROR
+	summary.admittedAt = time.Now()
 
-	defer func() {
-		s.mutex.Lock()
-		containerID, ok := s.requests[requestID.String()]
-		s.mutex.Unlock()
+	deadlineCtx, cancelDeadline := context.WithDeadline(queueCtx, deadline)
+	defer cancelDeadline()
+	// the cause of the cancellation tells why the runner has killed the container
+	ctx, cancel := context.WithCancelCause(deadlineCtx)
+	defer cancel(nil)
 
-		if ok {
-			_ = s.containersService.RemoveContainer(containerID)
-			log.Info().Str("requestID", requestID.String()).
-				Str("containerID", containerID).
-				Msg("container removed after request completion")
+	// a preempted run is cancelled just like a stopped one, but reported differently
+	for _, slot := range slots {
+		slot.OnPreempt(func() {
+			cancel(errRunPreempted)
+		})
+	}
+
+	// the outcome is updated by the terminal paths, anything else is our failure
+	result := registry.Result{Outcome: registry.OutcomeSystemError, ExitCode: -1}
+	summary.result = &result
+	// a run stopped during its setup fails on the cancellation, which isn't a
+	// failure of the services
+	writeSetupFailure := func(action string, err error) error {
+		if queueCtx.Err() == nil {
+			return writeFailure(action, err)
+		}
+		result.Outcome = registry.OutcomeStopped
+		summary.stopReason = "stopped"
+		if stream.Context().Err() != nil {
+			summary.stopReason = "client gone"
+		}
+		if err := writeTerminal(v1.MessageLevel_ERROR, "Execution was stopped.",
+			cancellationClass(stream.Context())); err != nil {
+			return err
 		}
+		return queueCtx.Err()
+	}
+	outputTail := pkg.NewTailBuffer(dynamicConfig.WebhookOutputTail)
+	var storedOutput *pkg.TailBuffer
+	if s.runStore != nil && s.appConfig.RunStoreOutput {
+		storedOutput = pkg.NewTailBuffer(s.appConfig.RunStoreOutputLimit)
+	}
+	// every relayed output is also kept for the callback, the store and the
+	// archive; the archive getting cut short is worth telling the client once
+	archiveTruncated := false
+	captureOutput := func(output string) error {
+		outputTail.WriteString(output)
+		if storedOutput != nil {
+			storedOutput.WriteString(output)
+		}
+		if spool != nil {
+			spool.WriteString(output)
+			if !archiveTruncated && spool.Truncated() {
+				archiveTruncated = true
+				summary.outputTruncated = true
+				return writeWarning(v1.WarningReason_WARNING_REASON_OUTPUT_TRUNCATED,
+					"Output exceeds the archive limit, the archived copy is cut short.")
+			}
+		}
+		return nil
+	}
+	// the build outputs of an identical earlier run are restored, so that the
+	// build is incremental; the submitted files aren't hashed, those runs are
+	// never cached
+	var buildCacheKey string
+	buildCacheHit := false
+	if s.buildCache != nil && !canary && request.Image == "" && files == nil {
+		if technology, ok := s.languagesService.Technology(request.Language); ok {
+			if buildCacheKey, err = s.buildCache.Key(identity, request.Language, technology, summary.imageDigest,
+				request.SourceCode); err != nil {
+				logger.Warn().Err(err).Msg("failed to compute the build cache key")
+			}
+		}
+	}
+	usageAccumulator := services.NewUsageAccumulator()
+	defer func() {
+		if run, ok := s.registry.Get(requestID.String()); ok && run.ContainerID != "" {
+			if buildCacheKey != "" {
+				s.updateBuildCache(stream.Context(), run.ContainerID, request.Language, buildCacheKey, buildCacheHit,
+					result.Outcome)
+			}
+			_, removeSpan := tracing.Start(stream.Context(), "RemoveContainer",
+				attribute.String("codecell.container_id", run.ContainerID))
+			tracing.End(removeSpan, s.containersService.RemoveContainer(run.ContainerID))
+			logger.Info().Msg("container removed after request completion")
+			trace.SpanFromContext(stream.Context()).SetAttributes(attribute.String("codecell.container_id", run.ContainerID))
+		}
+		trace.SpanFromContext(stream.Context()).SetAttributes(attribute.String("codecell.outcome", string(result.Outcome)))
 
-		s.mutex.Lock()
-		delete(s.requests, requestID.String())
-		delete(s.cancels, requestID.String())
-		s.mutex.Unlock()
+		result.Usage = usageAccumulator.Usage()
+		if !canary {
+			metrics.RunCPUSeconds.WithLabelValues(request.Language).Add(result.Usage.CPUSeconds)
+			metrics.RunMemoryByteSeconds.WithLabelValues(request.Language).Add(result.Usage.MemoryByteSeconds)
+			summary.observe(request.Language)
+		}
+		if completed, ok := s.registry.Finish(requestID.String(), result); ok {
+			s.lifecycleEvents.Emit(lifecycle.NewTerminalEvent(completed))
+			if callbackURL != "" {
+				s.webhookNotifier.Notify(stream.Context(), callbackURL, completed, outputTail)
+			}
+			s.persistRun(stream.Context(), completed, storedOutput)
+			s.auditLogger.Log(audit.NewEntry(completed, peerAddress, identity, request.Image, request.SourceCode,
+				s.appConfig.Runtime.OCIRuntime(), summary.imageDigest))
+		}
+		if spool != nil {
+			s.archiver.Upload(stream.Context(), spool)
+		}
 	}()
 
-	// creating the container for the request
-	containerID, err := s.containersService.CreateContainer(requestID.String(), request.Language, request.SourceCode)
+	budget := time.Until(deadline).Round(time.Second)
+	if !deadlineBound {
+		budget = timeout // the boot isn't part of the limit told to the client
+	}
+	// what the run executes on comes first, for the clients to show above the output
+	if err := sendMessage(&v1.RunResponseMessage{
+		Level: v1.MessageLevel_STARTED,
+		Payload: &v1.RunResponseMessage_Environment{
+			Environment: s.environmentMessage(request, run, languageConfig, budget, summary, networkEnabled),
+		},
+	}); err != nil {
+		return err
+	}
+	if err := writeMessage(v1.MessageLevel_INFO, fmt.Sprintf("Starting up container with a time limit of %s...", budget)); err != nil {
+		return err
+	}
+	if deadlineBound {
+		if err := writeWarning(v1.WarningReason_WARNING_REASON_LIMIT_CLAMPED,
+			fmt.Sprintf("Time limit is cut to %s by the client deadline.", budget)); err != nil {
+			return err
+		}
+	}
+	logger.Info().Msg("starting up container for request")
+
+	// creating the container for the request, or claiming a warm one; pool
+	// containers are offline and use the language images only
+	containerRequest := services.ContainerRequest{
+		RequestID:      requestID.String(),
+		Language:       request.Language,
+		SourceCode:     request.SourceCode,
+		NetworkEnabled: networkEnabled,
+		Image:          request.Image,
+		Command:        request.Command,
+		Args:           request.Args,
+		Deadline:       deadline,
+		MemoryLimit:    memoryLimit,
+		CPULimit:       languageConfig.CPULimit,
+		Files:          files,
+		Assets:         assets,
+	}
+	var containerID string
+	if pooledID, ok := s.takePooled(containerRequest); ok {
+		// registering right away, so that a failed copy still removes the container
+		containerID = pooledID
+		s.registry.SetContainer(requestID.String(), containerID)
+		err = s.containersService.CopyWorkspace(ctx, containerID, containerRequest)
+	} else {
+		containerID, err = s.containersService.CreateContainer(ctx, containerRequest)
+	}
+	if containerID != "" {
+		ctx = middleware.WithLogFields(ctx, "containerID", containerID)
+		logger = zerolog.Ctx(ctx)
+	}
 	if err != nil {
-		log.Error().Str("requestID", requestID.String()).
-			Err(err).
+		logger.Error().Err(err).
 			Msg("failed to create the container")
-		return writeMessage(v1.MessageLevel_ERROR, fmt.Sprintf("Failed to create container: %v", err))
+		if containerID != "" {
+			// the container is created but its workspace isn't, the deferred cleanup removes it
+			s.registry.SetContainer(requestID.String(), containerID)
+		}
+		return writeSetupFailure("Failed to create the container", err)
 	}
 
-	// storing the container ID, as well as cancel function for timeout handling
-	s.mutex.Lock()
-	s.requests[requestID.String()] = containerID
-	s.cancels[requestID.String()] = cancel
-	s.mutex.Unlock()
+	// storing the container ID, so that the run can be stopped and cleaned up;
+	// the server-wide cap on the run time holds whatever its timeout
+	if hardDeadline := s.registry.SetContainer(requestID.String(), containerID); !hardDeadline.IsZero() {
+		capTimer := time.AfterFunc(time.Until(hardDeadline), func() { cancel(errRunCapped) })
+		defer capTimer.Stop()
+	}
+	s.shareRun(ctx, requestID.String(), containerID, identity)
+	if buildCacheKey != "" {
+		// a failed restore leaves the run to build from scratch
+		if buildCacheHit, err = s.buildCache.Restore(ctx, containerID, buildCacheKey); err != nil {
+			logger.Warn().Err(err).Msg("failed to restore the cached build outputs")
+			s.buildCache.Invalidate(buildCacheKey)
+		} else if buildCacheHit {
+			logger.Debug().Msg("restored the cached build outputs")
+		}
+	}
 
 	if err := writeMessage(v1.MessageLevel_INFO, "Execution container is created."); err != nil {
 		return err
 	}
+	summary.ioLimits = s.containersService.DescribeIOLimits()
+	if networkEnabled && s.appConfig.EgressProxyURL != "" {
+		if err := writeWarning(v1.WarningReason_WARNING_REASON_NETWORK_PROXIED,
+			"Network calls are routed through a proxy and logged."); err != nil {
+			return err
+		}
+	}
 
 	// enabling the streaming of the logs for the container
+	_, attachSpan := tracing.Start(ctx, "Attach", attribute.String("codecell.container_id", containerID))
 	stdin, stdoutChannel, stderrChannel, err := s.logsService.AttachIO(ctx, containerID)
+	tracing.End(attachSpan, err)
 	if err != nil {
-		log.Error().Str("requestID", requestID.String()).
-			Err(err).
+		logger.Error().Err(err).
 			Msg("failed to attach to the container logs")
-		return writeMessage(v1.MessageLevel_ERROR, "Failed to attach to the container.")
+		return writeSetupFailure("Failed to attach to the container", err)
+	}
+	if !stdin.CanClose() {
+		if err := writeMessage(v1.MessageLevel_INFO,
+			"The end of stdin can't be signalled on this runner: programs reading it to the end wait until the time limit."); err != nil {
+			return err
+		}
 	}
 
 	// starting the container execution
-	if err := s.containersService.StartContainer(containerID); err != nil {
-		log.Error().Str("requestID", requestID.String()).
-			Err(err).
+	_, startSpan := tracing.Start(ctx, "Start", attribute.String("codecell.container_id", containerID))
+	err = s.containersService.StartContainer(containerID)
+	tracing.End(startSpan, err)
+	if err != nil {
+		logger.Error().Err(err).
 			Msg("failed to start the container")
-		return writeMessage(v1.MessageLevel_ERROR, "Failed to start the container.")
+		return writeFailure("Failed to start the container", err)
 	}
+	summary.startedAt = time.Now()
+	s.lifecycleEvents.Emit(lifecycle.NewStartedEvent(*run))
 
-	// writing all provided STDIN request lines to the container
-	for _, line := range request.Stdin {
-		if _, err = io.WriteString(stdin, line+"\n"); err != nil {
-			log.Error().Str("requestID", requestID.String()).
-				Err(err).
-				Msg("failed to write to the container stdin")
-			return writeMessage(v1.MessageLevel_ERROR, "Failed to write to the container stdin.")
+	// the program runs from the start of the container, unless the runtime
+	// tells when it does, the timeout counting from then
+	var timeoutTimer *time.Timer
+	defer func() {
+		if timeoutTimer != nil {
+			timeoutTimer.Stop()
+		}
+	}()
+	startRunning := func() error {
+		summary.runningAt = summary.startedAt
+		if readyLine != "" {
+			summary.runningAt = time.Now()
+			timeoutTimer = time.AfterFunc(timeout, func() { cancel(errRunTimedOut) })
 		}
+		timings := summary.timings(summary.runningAt)
+		return sendMessage(&v1.RunResponseMessage{
+			Level: v1.MessageLevel_RUNNING,
+			Payload: &v1.RunResponseMessage_Timings{
+				Timings: &v1.TimingsMessage{
+					QueueWaitMillis: timings.queueWait.Milliseconds(),
+					SetupMillis:     timings.setup.Milliseconds(),
+					BootMillis:      timings.boot.Milliseconds(),
+				},
+			},
+		})
 	}
-
-	// try to close the stdin; hack is to close only the write part of the connection
-	if closer, ok := stdin.(interface{ CloseWrite() error }); ok {
-		if err := closer.CloseWrite(); err != nil {
-			log.Error().Str("requestID", requestID.String()).
-				Err(err).
-				Msg("failed to close the container stdin")
+	if readyLine == "" {
+		if err := startRunning(); err != nil {
+			return err
 		}
 	}
 
+	// writing all provided STDIN request lines to the container alongside the
+	// relay of the output, so that the programs printing a lot before reading
+	// can't block on the full pipes while the writes block on them
+	stdinErrors := make(chan error, 1)
+	go func() {
+		defer middleware.RecoverGoroutine(ctx, "stdin")
+		stdinErrors <- writeStdin(ctx, stdin, request.Stdin)
+	}()
+
 	// getting container statistics stream
 	statisticsChannel, err := s.containersService.StreamContainerStatistics(ctx, containerID)
 	if err != nil {
-		log.Error().Str("requestID", requestID.String()).
-			Err(err).
+		logger.Error().Err(err).
 			Msg("failed to stream container statistics")
-		return writeMessage(v1.MessageLevel_ERROR, "Failed to stream container statistics.")
+		return writeFailure("Failed to stream container statistics", err)
 	}
 
 	go func() {
+		defer middleware.RecoverGoroutine(ctx, "statistics")
 		for {
 			select {
 			case <-ctx.Done():
@@ -159,6 +1007,7 @@ func (s *RunnerServer) Run(request *v1.RunRequest, stream grpc.ServerStreamingSe
 				if !ok {
 					return
 				}
+				usageAccumulator.Add(stats)
 
 				// calculate usage of the CPU
 				cpuDelta := float32(stats.CPUStats.CPUUsage.TotalUsage - stats.PreCPUStats.CPUUsage.TotalUsage)
@@ -175,8 +1024,7 @@ func (s *RunnerServer) Run(request *v1.RunRequest, stream grpc.ServerStreamingSe
 						},
 					},
 				}); err != nil {
-					log.Error().Str("requestID", requestID.String()).
-						Err(err).
+					streamLogger.Error().Err(err).
 						Msg("failed to send statistics to the stream")
 				}
 			}
@@ -186,21 +1034,136 @@ func (s *RunnerServer) Run(request *v1.RunRequest, stream grpc.ServerStreamingSe
 	// FIXME: allow only up to 100 KB of logs to be sent back to the client
 
 	// waiting for the container to finish execution
+	_, waitSpan := tracing.Start(ctx, "Wait", attribute.String("codecell.container_id", containerID))
+	defer waitSpan.End()
 	statusChannel, errorChannel := s.containersService.WaitForContainer(ctx, containerID)
+	var (
+		oomEventSeen bool
+		deathTimer   <-chan time.Time // fires if the wait doesn't follow a die event
+		deathCode    int64
+		waitRetries  int
+		waitRetry    <-chan time.Time // fires when the lost wait is made again
+	)
+	// endKilled ends the run the runner has cut short, killing its container: the
+	// exit code of a killed program, 137 alike for a SIGKILL of its own, doesn't
+	// tell why, the cause of the cancellation does
+	endKilled := func() error {
+		if err := s.containersService.KillContainer(containerID); err != nil &&
+			!errors.Is(err, services.ErrAlreadyStopped) {
+			logger.Error().
+				Err(err).
+				Msg("failed to kill the container ending the run")
+		}
+		if errors.Is(context.Cause(ctx), errRunPreempted) {
+			result.Outcome = registry.OutcomePreempted
+			summary.stopReason = "preempted"
+			logger.Info().Msg("run preempted by a higher priority run")
+			if err := writeTerminal(v1.MessageLevel_PREEMPTED, "Execution was preempted by a higher priority run.",
+				v1.ErrorClass_ERROR_CLASS_PREEMPTED); err != nil {
+				return err
+			}
+			return status.Error(codes.Aborted, "execution was preempted by a higher priority run")
+		}
+		if errors.Is(context.Cause(ctx), errRunCapped) {
+			result.Outcome = registry.OutcomeTimedOut
+			summary.stopReason = "run time cap"
+			logger.Warn().Int("absoluteMaxRunSeconds", s.appConfig.AbsoluteMaxRunSeconds).
+				Msg("run reached the server-wide run time cap")
+			if err := writeTerminal(v1.MessageLevel_ERROR,
+				fmt.Sprintf("Execution reached the server-wide limit of %s on the run time.", s.appConfig.AbsoluteMaxRunDuration()),
+				v1.ErrorClass_ERROR_CLASS_TIMEOUT); err != nil {
+				return err
+			}
+			return status.Error(codes.DeadlineExceeded, "execution reached the server-wide run time limit")
+		}
+		// the run is cancelled on Stop, the client going away is alike
+		timedOut := errors.Is(context.Cause(ctx), errRunTimedOut)
+		if !timedOut && !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			result.Outcome = registry.OutcomeStopped
+			summary.stopReason = "stopped"
+			if stream.Context().Err() != nil {
+				summary.stopReason = "client gone"
+			}
+			if err := writeTerminal(v1.MessageLevel_ERROR, "Execution was stopped.",
+				cancellationClass(stream.Context())); err != nil {
+				return err
+			}
+			return ctx.Err()
+		}
+		result.Outcome = registry.OutcomeTimedOut
+		summary.stopReason = "timeout"
+		if !timedOut && (deadlineBound || errors.Is(stream.Context().Err(), context.DeadlineExceeded)) {
+			summary.stopReason = "client deadline"
+			logger.Info().Msg("run reached the client deadline")
+			if err := writeTerminal(v1.MessageLevel_ERROR, "Execution reached the client deadline.",
+				v1.ErrorClass_ERROR_CLASS_TIMEOUT); err != nil {
+				return err
+			}
+			return status.Error(codes.DeadlineExceeded, "execution reached the client deadline")
+		}
+		if err := writeTerminal(v1.MessageLevel_ERROR, "Execution timed out.", v1.ErrorClass_ERROR_CLASS_TIMEOUT); err != nil {
+			return err
+		}
+		return ctx.Err()
+	}
 	for stdoutChannel != nil || stderrChannel != nil || statusChannel != nil {
 		select {
-		// if the container has timed out, kill it and notify the client
-		case <-ctx.Done():
-			if err := s.containersService.KillContainer(containerID); err != nil {
-				log.Error().Str("requestID", requestID.String()).
-					Str("containerID", containerID).
-					Err(err).
-					Msg("failed to kill the container on timeout")
+		// the daemon reports the container dying, possibly without the wait noticing
+		case event := <-run.Events:
+			switch event.Action {
+			case events.ActionOOM:
+				oomEventSeen = true
+			case events.ActionDie:
+				if summary.exitedAt.IsZero() {
+					summary.exitedAt = time.Now()
+				}
+				if statusChannel != nil && deathTimer == nil {
+					deathCode = event.ExitCode
+					deathTimer = time.After(unexpectedDeathGrace)
+				}
+			case events.ActionDestroy:
+				if statusChannel == nil {
+					continue // the exit status is already delivered
+				}
+				logger.Error().
+					Msg("container was removed unexpectedly")
+				if err := writeTerminal(v1.MessageLevel_ERROR, "Execution container was removed unexpectedly.",
+					v1.ErrorClass_ERROR_CLASS_SYSTEM_ERROR); err != nil {
+					return err
+				}
+				return status.Error(codes.Internal, "execution container was removed unexpectedly")
+			}
+
+		case <-deathTimer:
+			if statusChannel == nil {
+				continue
 			}
-			if err := writeMessage(v1.MessageLevel_ERROR, "Execution timed out."); err != nil {
+			logger.Error().
+				Int64("exitCode", deathCode).
+				Msg("container died without the wait reporting it")
+			if err := stream.Send(&v1.RunResponseMessage{
+				RequestId: requestID.String(),
+				Level:     v1.MessageLevel_EXIT_CODE,
+				Payload:   &v1.RunResponseMessage_ExitCode{ExitCode: deathCode},
+			}); err != nil {
 				return err
 			}
-			return ctx.Err()
+			message := "Execution container died unexpectedly."
+			class := v1.ErrorClass_ERROR_CLASS_SYSTEM_ERROR
+			result.ExitCode = deathCode
+			if oomEventSeen {
+				message = oomMessage(memoryLimit, memoryLimitSource, usageAccumulator.Usage().PeakMemory)
+				class = v1.ErrorClass_ERROR_CLASS_OOM_KILLED
+				result.Outcome = registry.OutcomeOOMKilled
+			}
+			if err := writeTerminal(v1.MessageLevel_ERROR, message, class); err != nil {
+				return err
+			}
+			return status.Error(codes.Internal, "execution container died unexpectedly")
+
+		// if the container has timed out, kill it and notify the client
+		case <-ctx.Done():
+			return endKilled()
 
 		// relay all logs from the stdout channel
 		case msg, ok := <-stdoutChannel:
@@ -208,6 +1171,16 @@ func (s *RunnerServer) Run(request *v1.RunRequest, stream grpc.ServerStreamingSe
 				stdoutChannel = nil
 				continue
 			}
+			if readyLine != "" && summary.runningAt.IsZero() && msg == readyLine {
+				if err := startRunning(); err != nil {
+					return err
+				}
+				continue
+			}
+			result.StdoutBytes += int64(len(msg))
+			if err := captureOutput(msg); err != nil {
+				return err
+			}
 			if err := writeMessage(v1.MessageLevel_STDOUT, msg); err != nil {
 				return err
 			}
@@ -218,31 +1191,121 @@ func (s *RunnerServer) Run(request *v1.RunRequest, stream grpc.ServerStreamingSe
 				stderrChannel = nil
 				continue
 			}
+			result.StderrBytes += int64(len(msg))
+			if err := captureOutput(msg); err != nil {
+				return err
+			}
 			if err := writeMessage(v1.MessageLevel_STDERR, msg); err != nil {
 				return err
 			}
 
+		// handle the failed writes of the STDIN lines
+		case err := <-stdinErrors:
+			stdinErrors = nil
+			if err != nil && ctx.Err() == nil {
+				logger.Error().Err(err).
+					Msg("failed to write to the container stdin")
+				return writeFailure("Failed to write to the container stdin", err)
+			}
+
 		// handle container execution errors
 		case err := <-errorChannel:
-			if err != nil {
-				if err := writeMessage(v1.MessageLevel_ERROR, err.Error()); err != nil {
-					return err
-				}
-				return err
+			if err == nil {
+				continue
+			}
+			if ctx.Err() != nil {
+				continue // the wait is cut short by the time limit or the cancellation, handled above
+			}
+			// the container may outlive the daemon connection, a new wait tells its true exit status
+			disconnected := services.IsDisconnected(err)
+			if disconnected && waitRetries < maxWaitRetries {
+				waitRetries++
+				logger.Warn().Err(err).Int("attempt", waitRetries).
+					Msg("lost the connection waiting for the container, waiting for it again")
+				errorChannel = nil
+				waitRetry = time.After(waitRetryDelay)
+				continue
 			}
+			logger.Error().Err(err).Msg("failed to wait for the container")
+			// the container is never left running unwatched, the deferred cleanup removes it
+			if err := s.containersService.KillContainer(containerID); err != nil &&
+				!errors.Is(err, services.ErrAlreadyStopped) {
+				logger.Error().Err(err).Msg("failed to kill the container after the failed wait")
+			}
+			if disconnected {
+				err = fmt.Errorf("%w: %w", services.ErrBackendUnavailable, err)
+			}
+			return writeFailure("Failed to wait for the container", err)
+
+		case <-waitRetry:
+			waitRetry = nil
+			statusChannel, errorChannel = s.containersService.WaitForContainer(ctx, containerID)
 
 		// handle container exit status
 		case exitStatus := <-statusChannel:
+			if ctx.Err() != nil {
+				return endKilled() // the program exits because the runner has killed it
+			}
 			if err := stream.Send(&v1.RunResponseMessage{
 				RequestId: requestID.String(),
 				Level:     v1.MessageLevel_EXIT_CODE,
 				Payload:   &v1.RunResponseMessage_ExitCode{ExitCode: exitStatus.StatusCode},
 			}); err != nil {
-				log.Error().Str("requestID", requestID.String()).
-					Err(err).
+				streamLogger.Error().Err(err).
 					Msg("failed to send exit code to the stream")
 				return err
 			}
+
+			// telling apart the kernel OOM killer from the program exiting on its own,
+			// the event stream usually tells already, the inspect covers a dropped event
+			oomKilled := oomEventSeen
+			if !oomKilled {
+				if oomKilled, err = s.containersService.WasOOMKilled(containerID); err != nil {
+					logger.Error().
+						Err(err).
+						Msg("failed to inspect the exited container")
+				}
+			}
+			if summary.exitedAt.IsZero() {
+				summary.exitedAt = time.Now() // the die event was dropped or is late
+			}
+			timings := summary.timings(summary.exitedAt)
+			message := fmt.Sprintf("Program exited on its own with code %d.", exitStatus.StatusCode)
+			if signal := exitStatus.StatusCode - 128; signal > 0 && signal <= 64 {
+				// neither the wait nor the inspect tells a program killed by a signal from
+				// one exiting with its code, only that the runner kills the runs it
+				// reports as stopped or timed out
+				message += fmt.Sprintf(" The code may indicate a kill by signal %d, which the runner didn't send.", signal)
+			}
+			level := v1.MessageLevel_INFO
+			class := v1.ErrorClass_ERROR_CLASS_NONE
+			result.ExitCode = exitStatus.StatusCode
+			result.Outcome = registry.OutcomeSucceeded
+			if exitStatus.StatusCode != 0 {
+				class = v1.ErrorClass_ERROR_CLASS_USER_CODE_ERROR
+				result.Outcome = registry.OutcomeFailed
+			}
+			if oomKilled {
+				message = oomMessage(memoryLimit, memoryLimitSource, usageAccumulator.Usage().PeakMemory)
+				level = v1.MessageLevel_ERROR
+				class = v1.ErrorClass_ERROR_CLASS_OOM_KILLED
+				result.Outcome = registry.OutcomeOOMKilled
+			}
+			usage := usageAccumulator.Usage()
+			message += fmt.Sprintf(" Used %.2f CPU-seconds and %s-seconds of memory.",
+				usage.CPUSeconds, units.BytesSize(usage.MemoryByteSeconds))
+			message += fmt.Sprintf(" Queued for %s, set up in %s and executed in %s.", timings.queueWait.Round(time.Millisecond),
+				timings.setup.Round(time.Millisecond), timings.execution.Round(time.Millisecond))
+			if spool != nil {
+				if archiveTruncated {
+					message += fmt.Sprintf(" Truncated output will be archived at %s.", spool.URL)
+				} else {
+					message += fmt.Sprintf(" Full output will be archived at %s.", spool.URL)
+				}
+			}
+			if err := writeTerminal(level, message, class); err != nil {
+				return err
+			}
 			statusChannel = nil
 			errorChannel = nil
 		}
@@ -251,38 +1314,503 @@ func (s *RunnerServer) Run(request *v1.RunRequest, stream grpc.ServerStreamingSe
 	return nil
 }
 
-func (s *RunnerServer) Stop(_ context.Context, request *v1.StopRequest) (*v1.StopResponse, error) {
-	s.mutex.Lock()
-	containerID, containerOk := s.requests[request.RequestId]
-	cancel, cancelOk := s.cancels[request.RequestId]
-	s.mutex.Unlock()
+// writeStdin writes the lines to the container stdin and signals the end of
+// the input, so that the programs reading it to the end exit. A failure to
+// signal it is only logged, the program reading on until the time limit.
+func writeStdin(ctx context.Context, stdin *services.Stdin, lines []string) error {
+	for _, line := range lines {
+		if _, err := io.WriteString(stdin, line+"\n"); err != nil {
+			return err
+		}
+	}
+	if stdin.CanClose() {
+		if err := stdin.Close(); err != nil {
+			zerolog.Ctx(ctx).Error().Err(err).
+				Msg("failed to close the container stdin")
+		}
+	}
+	return nil
+}
+
+// oomMessage tells the OOM-killed program the memory limit it has exceeded,
+// where the limit comes from, and the peak usage observed before the kill.
+func oomMessage(memoryLimit int64, source string, peakMemory uint64) string {
+	if memoryLimit <= 0 {
+		return "Program was killed for running out of memory."
+	}
+	message := fmt.Sprintf("Program was killed for exceeding the %s memory limit configured for %s.",
+		units.BytesSize(float64(memoryLimit)), source)
+	if peakMemory > 0 {
+		message += fmt.Sprintf(" Its usage peaked at %s as last observed.", units.BytesSize(float64(peakMemory)))
+	}
+	return message
+}
+
+// environmentMessage describes the execution environment of the admitted run,
+// with the limits it gets and the time limit left after the queue wait.
+func (s *RunnerServer) environmentMessage(
+	request *v1.RunRequest,
+	run *registry.Run,
+	languageConfig pkg.LanguageConfig,
+	timeout time.Duration,
+	summary *runSummary,
+	networkEnabled bool,
+) *v1.EnvironmentMessage {
+	image := request.Image
+	if technology, ok := s.languagesService.Technology(request.Language); ok && image == "" {
+		image = technology.GetImage()
+	}
+	return &v1.EnvironmentMessage{
+		Language:         request.Language,
+		LanguageVersion:  imageTag(image),
+		Image:            image,
+		ImageDigest:      summary.imageDigest,
+		Runtime:          s.appConfig.Runtime.OCIRuntime(),
+		MemoryLimitBytes: run.MemoryLimit,
+		CpuLimitNanos:    run.CPULimit,
+		PidsLimit:        languageConfig.PidsLimit,
+		TimeoutSeconds:   int32(timeout / time.Second),
+		Timezone:         run.Environment["TZ"],
+		NetworkEnabled:   networkEnabled,
+		QueueWaitMillis:  summary.timings(time.Now()).queueWait.Milliseconds(),
+	}
+}
+
+// imageTag returns the tag of the image reference, empty if it has none.
+func imageTag(image string) string {
+	name, _, _ := strings.Cut(image, "@")
+	if index := strings.LastIndex(name, ":"); index > strings.LastIndex(name, "/") {
+		return name[index+1:]
+	}
+	return ""
+}
+
+// cancelQueued ends the run cancelled before being admitted. Nothing has been
+// created for it yet, so there is nothing to clean up.
+func (s *RunnerServer) cancelQueued(
+	ctx context.Context,
+	requestID string,
+	class v1.ErrorClass,
+	writeTerminal func(v1.MessageLevel, string, v1.ErrorClass) error,
+) error {
+	completed, ok := s.registry.Finish(requestID, registry.Result{Outcome: registry.OutcomeCancelled, ExitCode: -1})
+	if ok {
+		s.lifecycleEvents.Emit(lifecycle.NewTerminalEvent(completed))
+		s.persistRun(ctx, completed, nil)
+	}
+	zerolog.Ctx(ctx).Info().Msg("run cancelled before being admitted")
+
+	// the client may be gone already, if it has cancelled the stream itself
+	_ = writeTerminal(v1.MessageLevel_CANCELLED, "Run was cancelled before it started.", class)
+	return status.Error(codes.Canceled, "run was cancelled before it started")
+}
+
+// watchRun relays the messages of the identical run in flight to the stream
+// of the coalesced run, from the start. Stopping the coalesced run only stops
+// following the execution, which belongs to the originating run.
+func (s *RunnerServer) watchRun(
+	requestID string,
+	identity string,
+	broadcast *Broadcast,
+	stream grpc.ServerStreamingServer[v1.RunResponseMessage],
+) error {
+	metrics.CoalescedRuns.Inc()
+	zerolog.Ctx(stream.Context()).Info().Str("originRequestID", broadcast.RequestID).
+		Msg("run coalesced with an identical run in flight")
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	defer s.coalescer.Watch(requestID, identity, cancel)()
+
+	// the request ID of the originating run isn't told, it's the handle to stop it
+	if err := stream.Send(&v1.RunResponseMessage{
+		RequestId: requestID,
+		Level:     v1.MessageLevel_COALESCED,
+		Payload:   &v1.RunResponseMessage_Message{Message: "Following an identical run in flight."},
+	}); err != nil {
+		return err
+	}
+	follower := broadcast.Follow()
+	for {
+		message, ok, err := follower.Next(ctx)
+		if !ok {
+			if ctx.Err() != nil && stream.Context().Err() == nil {
+				return classifyStatus(status.Error(codes.Canceled, "stopped following the execution"),
+					v1.ErrorClass_ERROR_CLASS_STOPPED_BY_OPERATOR)
+			}
+			return err
+		}
+
+		relayed := proto.Clone(message).(*v1.RunResponseMessage)
+		relayed.RequestId = requestID
+		if err := stream.Send(relayed); err != nil {
+			return err
+		}
+	}
+}
+
+// persistRun saves the record of the completed run into the store, if any.
+// Failing to do so doesn't fail the run.
+func (s *RunnerServer) persistRun(ctx context.Context, completed registry.CompletedRun, output *pkg.TailBuffer) {
+	if s.runStore == nil {
+		return
+	}
+
+	record := registry.NewRunRecord(completed)
+	if output != nil {
+		record.Output = output.String()
+	}
+	// saving even if the run has ended with the cancellation of its stream
+	saveCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	if err := s.runStore.Save(saveCtx, record); err != nil {
+		metrics.RunStoreFailures.Inc()
+		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to persist the completed run")
+	}
+}
+
+// updateBuildCache stores the build outputs of the successful run, unless they
+// were restored from the cache, and drops the cached ones the run has failed
+// with, as they may be what has broken it.
+func (s *RunnerServer) updateBuildCache(
+	ctx context.Context,
+	containerID string,
+	language string,
+	key string,
+	restored bool,
+	outcome registry.Outcome,
+) {
+	if outcome != registry.OutcomeSucceeded {
+		if restored {
+			s.buildCache.Invalidate(key)
+		}
+		return
+	}
+	if restored {
+		return
+	}
+
+	technology, ok := s.languagesService.Technology(language)
+	if !ok {
+		return
+	}
+	// storing even if the run has ended with the cancellation of its stream
+	storeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), buildCacheStoreTimeout)
+	defer cancel()
+	if err := s.buildCache.Store(storeCtx, containerID, key, technology.GetBuildOutputs()); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("failed to cache the build outputs")
+	}
+}
+
+// shareRun publishes this instance as the owner of the run in the shared
+// backend, refreshing the entry until the context is done.
+func (s *RunnerServer) shareRun(ctx context.Context, requestID string, containerID string, identity string) {
+	if s.sharedBackend == nil {
+		return
+	}
+
+	owner := registry.Owner{InstanceAddr: s.appConfig.InstanceAddr, ContainerID: containerID, Identity: identity}
+	ttl := s.appConfig.SharedRegistryTTL
+	register := func() {
+		if err := s.sharedBackend.Register(context.Background(), requestID, owner, ttl); err != nil {
+			zerolog.Ctx(ctx).Error().Err(err).Msg("failed to register the run in the shared registry")
+		}
+	}
+	register()
+
+	go func() {
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				if err := s.sharedBackend.Unregister(context.Background(), requestID); err != nil {
+					zerolog.Ctx(ctx).Error().Err(err).Msg("failed to unregister the run from the shared registry")
+				}
+				return
+			case <-ticker.C:
+				register()
+			}
+		}
+	}()
+}
+
+// stopRemote stops a run executed by another instance, either proxying the
+// call to it or telling the caller where to send it.
+func (s *RunnerServer) stopRemote(ctx context.Context, request *v1.StopRequest) (*v1.StopResponse, error) {
+	owner, ok, err := s.sharedBackend.Lookup(ctx, request.RequestId)
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to look up the run in the shared registry")
+		return nil, status.Errorf(codes.Unavailable, "failed to look up the run: %v", err)
+	}
+	if !ok || owner.InstanceAddr == s.appConfig.InstanceAddr {
+		return nil, status.Errorf(codes.NotFound, "container not found")
+	}
+	// the address of the owner is told to the owner of the run only
+	if err := authorizeRunOwner(ctx, owner.Identity); err != nil {
+		return nil, err
+	}
+
+	if !s.appConfig.SharedRegistryProxy {
+		st := status.Newf(codes.FailedPrecondition, "run is executed by the instance at %s", owner.InstanceAddr)
+		if detailed, err := st.WithDetails(&errdetails.ResourceInfo{
+			ResourceType: "run",
+			ResourceName: request.RequestId,
+			Owner:        owner.InstanceAddr,
+		}); err == nil {
+			st = detailed
+		}
+		return nil, st.Err()
+	}
+
+	connection, err := grpc.NewClient(owner.InstanceAddr, grpc.WithTransportCredentials(s.peerCredentials))
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to connect to the owning instance: %v", err)
+	}
+	defer connection.Close()
+
+	zerolog.Ctx(ctx).Info().Str("instanceAddr", owner.InstanceAddr).
+		Msg("proxying stop request to the owning instance")
+	// the owning instance authenticates the caller again
+	ctx = auth.ForwardCredentials(ctx, s.appConfig.IdentityMetadataKey)
+	return v1.NewRunnerServiceClient(connection).Stop(ctx, request)
+}
+
+// authorizeRunOwner checks that the caller is the one who has submitted the
+// run of the given identity, or an admin.
+func authorizeRunOwner(ctx context.Context, identity string) error {
+	principal := auth.PrincipalFromContext(ctx)
+	var caller string
+	if principal != nil {
+		caller = principal.Identity
+	}
+	if caller != identity && !principal.IsAdmin() {
+		return status.Error(codes.PermissionDenied, "run belongs to another caller")
+	}
+	return nil
+}
+
+func (s *RunnerServer) Stop(ctx context.Context, request *v1.StopRequest) (*v1.StopResponse, error) {
+	ctx = middleware.WithLogFields(ctx, "requestID", request.RequestId)
+	logger := zerolog.Ctx(ctx)
+	if s.coalescer != nil {
+		if identity, ok := s.coalescer.Owner(request.RequestId); ok {
+			if err := authorizeRunOwner(ctx, identity); err != nil {
+				return nil, err
+			}
+			if s.coalescer.Detach(request.RequestId) {
+				logger.Info().Msg("coalesced run detached on stop request")
+				return &v1.StopResponse{}, nil
+			}
+		}
+	}
 
-	if !containerOk {
+	run, ok := s.registry.Get(request.RequestId)
+	if ok {
+		if err := authorizeRunOwner(ctx, run.Identity); err != nil {
+			return nil, err
+		}
+	}
+	// the runs that haven't been admitted yet are just taken out of the queue
+	if s.registry.CancelQueued(request.RequestId) {
+		logger.Info().Msg("queued run cancelled on stop request")
+		return &v1.StopResponse{}, nil
+	}
+
+	if !ok {
+		if s.sharedBackend != nil {
+			return s.stopRemote(ctx, request)
+		}
 		return nil, status.Errorf(codes.NotFound, "container not found")
 	}
+	// the run admitted meanwhile is cancelled before its container is created,
+	// or while it is
+	if run.ContainerID == "" {
+		run.Cancel()
+		logger.Info().Msg("run cancelled before its container was created on stop request")
+		return &v1.StopResponse{}, nil
+	}
+	containerID := run.ContainerID
+	logger = zerolog.Ctx(middleware.WithLogFields(ctx, "containerID", containerID))
 
 	// killing the container if request requires force stop
 	if request.Force {
-		if err := s.containersService.KillContainer(containerID); err != nil {
-			log.Info().Str("requestID", request.RequestId).
-				Str("containerID", containerID).
-				Err(err).
-				Msg("failed to kill the container on force stop request")
-			return nil, status.Errorf(codes.Internal, "failed to kill the container: %v", err)
+		// cancelling first, so that the run reports the exit of the killed program
+		// as stopped; the container exiting meanwhile is as good as killed
+		run.Cancel()
+		if err := s.containersService.KillContainer(containerID); err != nil &&
+			!errors.Is(err, services.ErrAlreadyStopped) {
+			logger.Info().Err(err).Msg("failed to kill the container on force stop request")
+			code, message, _ := serviceStatus(err)
+			return nil, status.Errorf(code, "failed to kill the container: %s", message)
 		}
-		log.Info().Str("requestID", request.RequestId).
-			Str("containerID", containerID).
-			Msg("container killed on force stop request")
+		logger.Info().Msg("container killed on force stop request")
 		return &v1.StopResponse{}, nil
 	}
 
 	// cancelling the execution, `Run` function will handle this by itself
-	if cancelOk {
-		cancel()
-	}
+	run.Cancel()
 
-	log.Info().Str("requestID", request.RequestId).
-		Str("containerID", containerID).
-		Msg("container stopped on stop request")
+	logger.Info().Msg("container stopped on stop request")
 	return &v1.StopResponse{}, nil
 }
+
+func (s *RunnerServer) ListLanguages(_ context.Context, _ *v1.ListLanguagesRequest) (*v1.ListLanguagesResponse, error) {
+	response := &v1.ListLanguagesResponse{}
+	for _, language := range s.languagesService.Languages() {
+		technology, _ := s.languagesService.Technology(language)
+		languageStatus := s.languagesService.Status(language)
+		languageConfig, _ := s.languagesService.Config(language, s.configStore.Load())
+		tmpfsSize, _ := languageConfig.TmpfsBytes() // validated already
+
+		info := &v1.LanguageInfo{
+			Name:        language,
+			Image:       technology.GetImage(),
+			Available:   languageStatus.Err == nil,
+			ImageDigest: languageStatus.Digest,
+			Limits: &v1.LanguageLimits{
+				MemoryLimitBytes:      languageConfig.MemoryLimit,
+				CpuLimitNanos:         languageConfig.CPULimit,
+				PidsLimit:             languageConfig.PidsLimit,
+				DefaultTimeoutSeconds: int32(languageConfig.DefaultTimeout / time.Second),
+				MaxTimeoutSeconds:     int32(languageConfig.MaxTimeout / time.Second),
+				TmpfsSizeBytes:        tmpfsSize,
+			},
+		}
+		if languageStatus.Err != nil {
+			info.UnavailableReason = languageStatus.Err.Error()
+		}
+		switch languageStatus.Signature {
+		case services.SignatureVerified:
+			info.SignatureStatus = v1.SignatureStatus_SIGNATURE_VERIFIED
+		case services.SignatureInvalid:
+			info.SignatureStatus = v1.SignatureStatus_SIGNATURE_INVALID
+		}
+		response.Languages = append(response.Languages, info)
+	}
+	return response, nil
+}
+
+func (s *RunnerServer) ListAssets(ctx context.Context, _ *v1.ListAssetsRequest) (*v1.ListAssetsResponse, error) {
+	response := &v1.ListAssetsResponse{}
+	if s.assetsService == nil {
+		return response, nil
+	}
+	assets, err := s.assetsService.List()
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to list the assets")
+		return nil, status.Error(codes.Internal, "failed to list the assets")
+	}
+	for _, asset := range assets {
+		response.Assets = append(response.Assets, &v1.AssetInfo{Name: asset.Name, SizeBytes: asset.Size})
+	}
+	return response, nil
+}
+
+func (s *RunnerServer) GetCapacity(_ context.Context, _ *v1.GetCapacityRequest) (*v1.GetCapacityResponse, error) {
+	capacity := s.capacityReporter.Snapshot()
+	response := &v1.GetCapacityResponse{
+		MaxConcurrentRuns:   uint32(capacity.MaxConcurrentRuns),
+		ActiveRuns:          uint32(capacity.ActiveRuns),
+		QueueDepth:          uint32(capacity.QueueDepth),
+		MemoryHeadroomBytes: capacity.MemoryHeadroom,
+		CpuHeadroomNanos:    capacity.CPUHeadroom,
+		Draining:            capacity.Draining,
+	}
+	for _, language := range capacity.Languages {
+		response.Languages = append(response.Languages, &v1.LanguageCapacity{
+			Name:              language.Language,
+			Available:         language.Available,
+			ActiveRuns:        uint32(language.ActiveRuns),
+			MaxConcurrentRuns: uint32(language.MaxConcurrentRuns),
+			UnavailableReason: language.UnavailableReason,
+		})
+	}
+	return response, nil
+}
+
+func (s *RunnerServer) GetServerInfo(ctx context.Context, _ *v1.GetServerInfoRequest) (*v1.GetServerInfoResponse, error) {
+	return s.ServerInfo(ctx), nil
+}
+
+// ServerInfo describes the build of the runner and the environment it runs
+// in. The daemon fields are left empty if the daemon can't be reached, the
+// rest being still worth reporting.
+func (s *RunnerServer) ServerInfo(ctx context.Context) *v1.GetServerInfoResponse {
+	info := &v1.GetServerInfoResponse{
+		Version:   pkg.Version,
+		Commit:    pkg.BuildCommit(),
+		GoVersion: runtime.Version(),
+		Runtime:   s.appConfig.Runtime.OCIRuntime(),
+	}
+	if daemon, err := s.systemService.DaemonInfo(ctx); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("failed to get the docker daemon info")
+	} else {
+		info.DockerVersion = daemon.Version
+		info.StorageDriver = daemon.StorageDriver
+	}
+	for _, language := range s.languagesService.Languages() {
+		technology, _ := s.languagesService.Technology(language)
+		info.Images = append(info.Images, &v1.TechnologyImage{
+			Language: language,
+			Image:    technology.GetImage(),
+			Digest:   s.languagesService.Status(language).Digest,
+		})
+	}
+	return info
+}
+
+func (s *RunnerServer) GetRun(ctx context.Context, request *v1.GetRunRequest) (*v1.RunRecord, error) {
+	ctx = middleware.WithLogFields(ctx, "requestID", request.RequestId)
+	if run, ok := s.registry.Get(request.RequestId); ok {
+		return activeRunMessage(run), nil
+	}
+	if completed, ok := s.registry.GetCompleted(request.RequestId); ok {
+		return runRecordMessage(registry.NewRunRecord(completed)), nil
+	}
+
+	// the runs finished before a restart are only known to the store
+	if s.runStore != nil {
+		record, ok, err := s.runStore.Get(ctx, request.RequestId)
+		if err != nil {
+			zerolog.Ctx(ctx).Error().Err(err).Msg("failed to get the run from the store")
+			return nil, status.Errorf(codes.Internal, "failed to get the run: %v", err)
+		}
+		if ok {
+			return runRecordMessage(record), nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "run not found")
+}
+
+func (s *RunnerServer) ListRuns(ctx context.Context, request *v1.ListRunsRequest) (*v1.ListRunsResponse, error) {
+	filter := registry.RunFilter{
+		Language: request.Language,
+		Labels:   request.Labels,
+		Limit:    defaultListRunsLimit,
+	}
+	if request.Limit > 0 {
+		filter.Limit = min(int(request.Limit), maxListRunsLimit)
+	}
+	if request.Since != nil {
+		filter.Since = request.Since.AsTime()
+	}
+
+	response := &v1.ListRunsResponse{}
+	// the store has every run the registry retains, and the ones before a restart
+	if s.runStore != nil {
+		records, err := s.runStore.List(ctx, filter)
+		if err != nil {
+			zerolog.Ctx(ctx).Error().Err(err).Msg("failed to list the runs from the store")
+			return nil, status.Errorf(codes.Internal, "failed to list the runs: %v", err)
+		}
+		for _, record := range records {
+			response.Runs = append(response.Runs, runRecordMessage(record))
+		}
+		return response, nil
+	}
+	for _, completed := range s.registry.ListCompleted(filter) {
+		response.Runs = append(response.Runs, runRecordMessage(registry.NewRunRecord(completed)))
+	}
+	return response, nil
+}
@@ -0,0 +1,928 @@
+package internal_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/Pelfox/codecell-runner/generated"
+	"github.com/Pelfox/codecell-runner/internal/auth"
+	"github.com/Pelfox/codecell-runner/internal/dockertest"
+	"github.com/Pelfox/codecell-runner/internal/runnertest"
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/moby/moby/client"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// testLanguage is the language of the runs of the tests, which tells nothing
+// about its boot.
+const testLanguage = "perl"
+
+// printing returns the program printing the lines on stdout and exiting with the code.
+func printing(code int64, lines ...string) dockertest.Program {
+	return func(process *dockertest.Process) dockertest.Exit {
+		for _, line := range lines {
+			process.Stdout(line)
+		}
+		return dockertest.Exit{Code: code}
+	}
+}
+
+// sleeping returns the program printing the line and running until it's killed.
+func sleeping(line string) dockertest.Program {
+	return func(process *dockertest.Process) dockertest.Exit {
+		process.Stdout(line)
+		return process.Sleep()
+	}
+}
+
+// runRequest returns the request of a run of the test language.
+func runRequest() *v1.RunRequest {
+	return &v1.RunRequest{Language: testLanguage, SourceCode: `print "Hello, World!\n";`}
+}
+
+// checkOutcome checks the class of the terminal message and of the status of
+// the run, as well as the code of the status.
+func checkOutcome(t *testing.T, stream *runnertest.Stream, err error, class v1.ErrorClass, code codes.Code) {
+	t.Helper()
+	if got := status.Code(err); got != code {
+		t.Errorf("Run() = %v, want the status code %s", err, code)
+	}
+	if got := runnertest.StatusClass(err); err != nil && got != class {
+		t.Errorf("status class = %s, want %s", got, class)
+	}
+	terminal := stream.Terminal()
+	if terminal == nil {
+		t.Fatalf("no terminal message among %v", stream.Messages())
+	}
+	if terminal.ErrorClass != class {
+		t.Errorf("terminal message %q has class %s, want %s", terminal.GetMessage(), terminal.ErrorClass, class)
+	}
+}
+
+func TestRunEndsWithTheClassOfTheOutcome(t *testing.T) {
+	tests := []struct {
+		name    string
+		program dockertest.Program
+		timeout int32
+		class   v1.ErrorClass
+		code    codes.Code
+		message string
+		stdout  []string
+	}{
+		{name: "exit 0", program: printing(0, "Hello, World!"), class: v1.ErrorClass_ERROR_CLASS_NONE, code: codes.OK,
+			message: "Program exited on its own with code 0.", stdout: []string{"Hello, World!"}},
+		{name: "exit 1", program: printing(1), class: v1.ErrorClass_ERROR_CLASS_USER_CODE_ERROR, code: codes.OK,
+			message: "Program exited on its own with code 1."},
+		{name: "oom killed", class: v1.ErrorClass_ERROR_CLASS_OOM_KILLED, code: codes.OK,
+			program: func(*dockertest.Process) dockertest.Exit {
+				return dockertest.Exit{Code: 137, OOMKilled: true}
+			},
+			message: "Program was killed for exceeding the 512MiB memory limit"},
+		{name: "timeout", program: sleeping("sleeping"), timeout: 1, class: v1.ErrorClass_ERROR_CLASS_TIMEOUT,
+			code: codes.DeadlineExceeded, message: "Execution timed out.", stdout: []string{"sleeping"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			runner := runnertest.New(t, nil)
+			runner.Daemon.SetProgram(test.program)
+			request := runRequest()
+			request.TimeoutSeconds = test.timeout
+
+			stream, err := runner.Run(context.Background(), request)
+			checkOutcome(t, stream, err, test.class, test.code)
+			if terminal := stream.Terminal(); terminal != nil && !strings.HasPrefix(terminal.GetMessage(), test.message) {
+				t.Errorf("terminal message = %q, want it to start with %q", terminal.GetMessage(), test.message)
+			}
+			if stdout := stream.Lines(v1.MessageLevel_STDOUT); !slices.Equal(stdout, test.stdout) {
+				t.Errorf("stdout = %q, want %q", stdout, test.stdout)
+			}
+			if containers := runner.Daemon.Containers(); len(containers) != 0 {
+				t.Errorf("%d containers are left behind", len(containers))
+			}
+		})
+	}
+}
+
+func TestRunBoundedByTheClientDeadline(t *testing.T) {
+	tests := []struct {
+		name     string
+		deadline time.Duration
+		timeout  int32
+		limit    string
+		clamped  bool
+		message  string
+	}{
+		{name: "deadline before the timeout", deadline: 2 * time.Second, timeout: 30,
+			limit: "time limit of 1s", clamped: true, message: "Execution reached the client deadline."},
+		{name: "timeout before the deadline", deadline: time.Minute, timeout: 1,
+			limit: "time limit of 1s", message: "Execution timed out."},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			runner := runnertest.New(t, func(config *pkg.AppConfig) {
+				config.DeadlineTeardownMargin = time.Second
+			})
+			runner.Daemon.SetProgram(sleeping("sleeping"))
+			request := runRequest()
+			request.TimeoutSeconds = test.timeout
+			ctx, cancel := context.WithTimeout(context.Background(), test.deadline)
+			defer cancel()
+
+			stream, err := runner.Run(ctx, request)
+			// both end as timeouts, told apart by the terminal message only
+			checkOutcome(t, stream, err, v1.ErrorClass_ERROR_CLASS_TIMEOUT, codes.DeadlineExceeded)
+			if terminal := stream.Terminal(); terminal != nil && terminal.GetMessage() != test.message {
+				t.Errorf("terminal message = %q, want %q", terminal.GetMessage(), test.message)
+			}
+			if info := stream.Lines(v1.MessageLevel_INFO); !slices.ContainsFunc(info, func(line string) bool {
+				return strings.Contains(line, test.limit)
+			}) {
+				t.Errorf("the info messages %q don't tell the %s", info, test.limit)
+			}
+			clamped := slices.ContainsFunc(stream.Messages(), func(message *v1.RunResponseMessage) bool {
+				return message.WarningReason == v1.WarningReason_WARNING_REASON_LIMIT_CLAMPED
+			})
+			if clamped != test.clamped {
+				t.Errorf("the time limit is told cut by the deadline %t, want %t", clamped, test.clamped)
+			}
+		})
+	}
+
+	// a deadline within the teardown margin leaves nothing to execute
+	runner := runnertest.New(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	stream, err := runner.Run(ctx, runRequest())
+	if status.Code(err) != codes.DeadlineExceeded || len(stream.Messages()) != 0 {
+		t.Errorf("Run() within the teardown margin = %v after %d messages, want DEADLINE_EXCEEDED at once",
+			err, len(stream.Messages()))
+	}
+}
+
+func TestRunCutAtTheServerWideRunTimeCap(t *testing.T) {
+	runner := runnertest.New(t, func(config *pkg.AppConfig) {
+		config.AbsoluteMaxRunSeconds = 1
+	})
+	runner.Daemon.SetProgram(sleeping("sleeping"))
+	request := runRequest()
+	request.TimeoutSeconds = 30
+
+	started := time.Now()
+	stream, err := runner.Run(context.Background(), request)
+	checkOutcome(t, stream, err, v1.ErrorClass_ERROR_CLASS_TIMEOUT, codes.DeadlineExceeded)
+	if elapsed := time.Since(started); elapsed > 10*time.Second {
+		t.Errorf("the run has taken %v, past the cap of 1s", elapsed)
+	}
+	want := "Execution reached the server-wide limit of 1s on the run time."
+	if terminal := stream.Terminal(); terminal != nil && terminal.GetMessage() != want {
+		t.Errorf("terminal message = %q, want %q", terminal.GetMessage(), want)
+	}
+	if containers := runner.Daemon.Containers(); len(containers) != 0 {
+		t.Errorf("%d containers are left behind", len(containers))
+	}
+}
+
+func TestRunTellsTheKillsApart(t *testing.T) {
+	const signalled = "The code may indicate a kill by signal"
+	exiting := func(code int64, oomKilled bool) dockertest.Program {
+		return func(process *dockertest.Process) dockertest.Exit {
+			if oomKilled {
+				process.OOMKill()
+			}
+			return dockertest.Exit{Code: code}
+		}
+	}
+	killed := func(oomKilled bool) dockertest.Program {
+		return func(process *dockertest.Process) dockertest.Exit {
+			if oomKilled {
+				process.OOMKill()
+			}
+			return sleeping("sleeping")(process)
+		}
+	}
+	tests := []struct {
+		name    string
+		program dockertest.Program
+		killBy  string // how the runner kills the program, "timeout" or "stop", none if empty
+		class   v1.ErrorClass
+		message string
+		signal  int // the signal the message hedges about, none if zero
+	}{
+		{name: "exit 0", program: exiting(0, false), class: v1.ErrorClass_ERROR_CLASS_NONE,
+			message: "Program exited on its own with code 0."},
+		{name: "exit 1", program: exiting(1, false), class: v1.ErrorClass_ERROR_CLASS_USER_CODE_ERROR,
+			message: "Program exited on its own with code 1."},
+		{name: "exit 137", program: exiting(137, false), class: v1.ErrorClass_ERROR_CLASS_USER_CODE_ERROR,
+			message: "Program exited on its own with code 137. " + signalled + " 9, which the runner didn't send.", signal: 9},
+		{name: "exit 139", program: exiting(139, false), class: v1.ErrorClass_ERROR_CLASS_USER_CODE_ERROR,
+			message: "Program exited on its own with code 139. " + signalled + " 11, which the runner didn't send.", signal: 11},
+		{name: "exit 255", program: exiting(255, false), class: v1.ErrorClass_ERROR_CLASS_USER_CODE_ERROR,
+			message: "Program exited on its own with code 255."},
+		{name: "oom killed 137", program: exiting(137, true), class: v1.ErrorClass_ERROR_CLASS_OOM_KILLED,
+			message: "Program was killed for exceeding the 512MiB memory limit"},
+		{name: "oom killed child, exit 1", program: exiting(1, true), class: v1.ErrorClass_ERROR_CLASS_OOM_KILLED,
+			message: "Program was killed for exceeding the 512MiB memory limit"},
+		{name: "timed out", program: killed(false), killBy: "timeout", class: v1.ErrorClass_ERROR_CLASS_TIMEOUT,
+			message: "Execution timed out."},
+		{name: "timed out, oom killed", program: killed(true), killBy: "timeout", class: v1.ErrorClass_ERROR_CLASS_TIMEOUT,
+			message: "Execution timed out."},
+		{name: "stopped", program: killed(false), killBy: "stop", class: v1.ErrorClass_ERROR_CLASS_STOPPED_BY_OPERATOR,
+			message: "Execution was stopped."},
+		{name: "stopped, oom killed", program: killed(true), killBy: "stop",
+			class: v1.ErrorClass_ERROR_CLASS_STOPPED_BY_OPERATOR, message: "Execution was stopped."},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			runner := runnertest.New(t, nil)
+			runner.Daemon.SetProgram(test.program)
+			request := runRequest()
+			if test.killBy == "timeout" {
+				request.TimeoutSeconds = 1
+			}
+
+			stream, done := runner.Start(context.Background(), request)
+			if test.killBy == "stop" {
+				running := stream.Await(v1.MessageLevel_STDOUT)
+				if running == nil {
+					t.Fatal("the program hasn't started")
+				}
+				if _, err := runner.Server.Stop(context.Background(), &v1.StopRequest{RequestId: running.RequestId}); err != nil {
+					t.Fatalf("Stop() = %v", err)
+				}
+			}
+			<-done
+
+			terminal := stream.Terminal()
+			if terminal == nil {
+				t.Fatalf("no terminal message among %v", stream.Messages())
+			}
+			if terminal.ErrorClass != test.class {
+				t.Errorf("terminal message %q has class %s, want %s", terminal.GetMessage(), terminal.ErrorClass, test.class)
+			}
+			if !strings.HasPrefix(terminal.GetMessage(), test.message) {
+				t.Errorf("terminal message = %q, want it to start with %q", terminal.GetMessage(), test.message)
+			}
+			if test.signal == 0 && strings.Contains(terminal.GetMessage(), "signal") {
+				t.Errorf("terminal message %q tells of a signal", terminal.GetMessage())
+			}
+			_, exited := stream.ExitCode()
+			if killedByTheRunner := test.killBy != ""; exited == killedByTheRunner {
+				t.Errorf("EXIT_CODE sent: %t, want %t", exited, !killedByTheRunner)
+			}
+		})
+	}
+}
+
+func TestRunTellsWhereTheMemoryLimitComesFrom(t *testing.T) {
+	const mebibyte = 1 << 20
+	tests := []struct {
+		name      string
+		language  string
+		configure func(config *pkg.AppConfig)
+		maxMemory int64 // of the principal of the caller, none if zero
+		message   string
+	}{
+		{name: "server default", language: testLanguage,
+			message: "Program was killed for exceeding the 512MiB memory limit configured for the server default."},
+		{name: "language block", language: testLanguage, configure: func(config *pkg.AppConfig) {
+			config.Languages = map[string]pkg.LanguageConfig{testLanguage: {MemoryLimit: 1024 * mebibyte}}
+		}, message: "Program was killed for exceeding the 1GiB memory limit configured for the perl language."},
+		{name: "technology hint", language: "scala",
+			message: "Program was killed for exceeding the 1.5GiB memory limit configured for the scala runtime."},
+		{name: "principal", language: "scala", maxMemory: 128 * mebibyte,
+			message: "Program was killed for exceeding the 128MiB memory limit configured for the caller."},
+		{name: "principal above the limit", language: testLanguage, maxMemory: 1024 * mebibyte,
+			message: "Program was killed for exceeding the 512MiB memory limit configured for the server default."},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			runner := runnertest.New(t, test.configure)
+			runner.Daemon.SetProgram(func(*dockertest.Process) dockertest.Exit {
+				return dockertest.Exit{Code: 137, OOMKilled: true}
+			})
+			ctx := context.Background()
+			if test.maxMemory != 0 {
+				ctx = auth.WithPrincipal(ctx, &auth.RequestPrincipal{Identity: "tenant", MaxMemory: test.maxMemory})
+			}
+
+			stream, err := runner.Run(ctx, &v1.RunRequest{Language: test.language, SourceCode: "main"})
+			checkOutcome(t, stream, err, v1.ErrorClass_ERROR_CLASS_OOM_KILLED, codes.OK)
+			if terminal := stream.Terminal(); !strings.HasPrefix(terminal.GetMessage(), test.message) {
+				t.Errorf("terminal message = %q, want it to start with %q", terminal.GetMessage(), test.message)
+			}
+		})
+	}
+}
+
+func TestRunTellsThePeakMemoryOfTheOOMKilledProgram(t *testing.T) {
+	runner := runnertest.New(t, nil)
+	runner.Daemon.SetProgram(func(process *dockertest.Process) dockertest.Exit {
+		process.SetMemory(500 << 20)
+		// letting the statistics report the usage before the kill
+		time.Sleep(300 * time.Millisecond)
+		return dockertest.Exit{Code: 137, OOMKilled: true}
+	})
+
+	stream, err := runner.Run(context.Background(), runRequest())
+	checkOutcome(t, stream, err, v1.ErrorClass_ERROR_CLASS_OOM_KILLED, codes.OK)
+	want := "Program was killed for exceeding the 512MiB memory limit configured for the server default." +
+		" Its usage peaked at 500MiB as last observed."
+	if terminal := stream.Terminal(); !strings.HasPrefix(terminal.GetMessage(), want) {
+		t.Errorf("terminal message = %q, want it to start with %q", terminal.GetMessage(), want)
+	}
+}
+
+func TestRunStoppedByTheOperator(t *testing.T) {
+	runner := runnertest.New(t, nil)
+	runner.Daemon.SetProgram(sleeping("sleeping"))
+
+	stream, done := runner.Start(context.Background(), runRequest())
+	running := stream.Await(v1.MessageLevel_STDOUT)
+	if running == nil {
+		t.Fatal("the program hasn't started")
+	}
+	if _, err := runner.Server.Stop(context.Background(), &v1.StopRequest{RequestId: running.RequestId}); err != nil {
+		t.Fatalf("Stop() = %v", err)
+	}
+	checkOutcome(t, stream, <-done, v1.ErrorClass_ERROR_CLASS_STOPPED_BY_OPERATOR, codes.Canceled)
+}
+
+func TestRunCancelledByTheClient(t *testing.T) {
+	runner := runnertest.New(t, nil)
+	runner.Daemon.SetProgram(sleeping("sleeping"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, done := runner.Start(ctx, runRequest())
+	if stream.Await(v1.MessageLevel_STDOUT) == nil {
+		t.Fatal("the program hasn't started")
+	}
+	cancel()
+	checkOutcome(t, stream, <-done, v1.ErrorClass_ERROR_CLASS_CANCELLED_BY_CLIENT, codes.Canceled)
+}
+
+func TestRunPreemptedByAHigherPriorityRun(t *testing.T) {
+	runner := runnertest.New(t, func(config *pkg.AppConfig) {
+		config.MaxConcurrentRuns = 1
+		config.QueueMaxDepth = 1
+		config.PreemptionEnabled = true
+		config.PreemptionWaitThreshold = 100 * time.Millisecond
+	})
+	runner.Daemon.SetProgram(sleeping("sleeping"))
+
+	batch := runRequest()
+	batch.Priority = v1.RunPriority_PRIORITY_BATCH
+	batchStream, batchDone := runner.Start(context.Background(), batch)
+	if batchStream.Await(v1.MessageLevel_STDOUT) == nil {
+		t.Fatal("the batch program hasn't started")
+	}
+
+	runner.Daemon.SetProgram(printing(0, "Hello, World!"))
+	interactive := runRequest()
+	interactive.Priority = v1.RunPriority_PRIORITY_INTERACTIVE
+	interactiveStream, interactiveDone := runner.Start(context.Background(), interactive)
+
+	checkOutcome(t, batchStream, <-batchDone, v1.ErrorClass_ERROR_CLASS_PREEMPTED, codes.Aborted)
+	checkOutcome(t, interactiveStream, <-interactiveDone, v1.ErrorClass_ERROR_CLASS_NONE, codes.OK)
+}
+
+func TestRunFailsAtEachDockerOperation(t *testing.T) {
+	tests := []struct {
+		operation  string
+		statusCode int
+		message    string
+		code       codes.Code
+	}{
+		{operation: dockertest.OperationCreate, statusCode: http.StatusInternalServerError,
+			message: "Failed to create the container: the runner failed to execute the run.", code: codes.Internal},
+		{operation: dockertest.OperationCreate, statusCode: http.StatusNotFound,
+			message: "Failed to create the container: the image of the run is not available on this runner.",
+			code:    codes.FailedPrecondition},
+		{operation: dockertest.OperationCopy, statusCode: http.StatusInternalServerError,
+			message: "Failed to create the container: the runner failed to execute the run.", code: codes.Internal},
+		{operation: dockertest.OperationCopy, statusCode: http.StatusNotFound,
+			message: "Failed to create the container: the execution container no longer exists.", code: codes.NotFound},
+		{operation: dockertest.OperationAttach, statusCode: http.StatusInternalServerError,
+			message: "Failed to attach to the container: the runner failed to execute the run.", code: codes.Internal},
+		{operation: dockertest.OperationStart, statusCode: http.StatusInternalServerError,
+			message: "Failed to start the container: the runner failed to execute the run.", code: codes.Internal},
+		{operation: dockertest.OperationStart, statusCode: http.StatusNotFound,
+			message: "Failed to start the container: the execution container no longer exists.", code: codes.NotFound},
+		{operation: dockertest.OperationWait, statusCode: http.StatusInternalServerError,
+			message: "Failed to wait for the container: the runner failed to execute the run.", code: codes.Internal},
+		{operation: dockertest.OperationWait, statusCode: http.StatusServiceUnavailable,
+			message: "Failed to wait for the container: the container backend is unavailable.", code: codes.Unavailable},
+		{operation: dockertest.OperationStats, statusCode: http.StatusInternalServerError,
+			message: "Failed to stream container statistics: the runner failed to execute the run.", code: codes.Internal},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s %d", test.operation, test.statusCode), func(t *testing.T) {
+			t.Parallel()
+			runner := runnertest.New(t, nil)
+			runner.Daemon.SetProgram(sleeping("sleeping"))
+			runner.Daemon.Fail(test.operation, test.statusCode, "injected failure")
+
+			stream, err := runner.Run(context.Background(), runRequest())
+			checkOutcome(t, stream, err, v1.ErrorClass_ERROR_CLASS_SYSTEM_ERROR, test.code)
+			terminal := stream.Terminal()
+			if terminal.Level != v1.MessageLevel_ERROR || terminal.GetMessage() != test.message {
+				t.Errorf("terminal message = %s %q, want ERROR %q", terminal.Level, terminal.GetMessage(), test.message)
+			}
+			if containers := runner.Daemon.Containers(); len(containers) != 0 {
+				t.Errorf("%d containers are left behind", len(containers))
+			}
+		})
+	}
+}
+
+func TestRunWaitsAgainAfterLosingTheDaemonConnection(t *testing.T) {
+	runner := runnertest.New(t, nil)
+	exit := make(chan struct{})
+	runner.Daemon.SetProgram(func(process *dockertest.Process) dockertest.Exit {
+		select {
+		case <-exit:
+			process.Stdout("done")
+			return dockertest.Exit{Code: 3}
+		case <-process.Killed:
+			return dockertest.Exit{Code: 137}
+		}
+	})
+	waiting, release := runner.Daemon.Hold(dockertest.OperationWait)
+	stream, done := runner.Start(context.Background(), runRequest())
+	<-waiting
+	release()
+
+	// the daemon restarts while the program runs, which exits before the new wait
+	rewaiting, rerelease := runner.Daemon.Hold(dockertest.OperationWait)
+	runner.Daemon.DropWaits()
+	<-rewaiting
+	close(exit)
+	rerelease()
+	err := <-done
+	checkOutcome(t, stream, err, v1.ErrorClass_ERROR_CLASS_USER_CODE_ERROR, codes.OK)
+	if code, ok := stream.ExitCode(); !ok || code != 3 {
+		t.Errorf("the run has exited with %d, %t, want the exit code 3 of the program", code, ok)
+	}
+	if stdout := stream.Lines(v1.MessageLevel_STDOUT); !slices.Equal(stdout, []string{"done"}) {
+		t.Errorf("stdout = %q, want the output of the program", stdout)
+	}
+}
+
+func TestRunWritesTheStdinWhileRelayingTheOutput(t *testing.T) {
+	// a megabyte of lines each way, more than the pipes and the connection buffers hold
+	line := strings.Repeat("x", 1023)
+	lines := slices.Repeat([]string{line}, 1024)
+	tests := []struct {
+		name    string
+		options []client.Opt
+	}{
+		{name: "half-closed connection"},
+		{name: "connection that can't be half-closed", options: []client.Opt{dockertest.WithoutHalfClose()}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			runner := runnertest.New(t, nil, test.options...)
+			runner.Daemon.SetProgram(func(process *dockertest.Process) dockertest.Exit {
+				for _, line := range lines {
+					process.Stdout(line)
+				}
+				// reading the stdin to its end, which never comes unless it's signalled
+				read, err := io.Copy(io.Discard, process.Stdin)
+				if err != nil {
+					return dockertest.Exit{Code: 1}
+				}
+				process.Stderr(fmt.Sprintf("read %d bytes", read))
+				return dockertest.Exit{}
+			})
+			request := runRequest()
+			request.Stdin = lines
+			request.TimeoutSeconds = 5
+
+			stream, err := runner.Run(context.Background(), request)
+			checkOutcome(t, stream, err, v1.ErrorClass_ERROR_CLASS_NONE, codes.OK)
+			if stdout := stream.Lines(v1.MessageLevel_STDOUT); len(stdout) != len(lines) {
+				t.Errorf("got %d lines of stdout, want %d", len(stdout), len(lines))
+			}
+			want := fmt.Sprintf("read %d bytes", len(lines)*(len(line)+1))
+			if stderr := stream.Lines(v1.MessageLevel_STDERR); !slices.Equal(stderr, []string{want}) {
+				t.Errorf("stderr = %q, want %q", stderr, want)
+			}
+		})
+	}
+}
+
+func TestRunSignalsTheEndOfStdinOverAConnectionThatCantBeHalfClosed(t *testing.T) {
+	runner := runnertest.New(t, nil, dockertest.WithoutHalfClose())
+	// sorting the lines of the stdin, as sort does once it has read them all
+	runner.Daemon.SetProgram(func(process *dockertest.Process) dockertest.Exit {
+		input, err := io.ReadAll(process.Stdin)
+		if err != nil {
+			return dockertest.Exit{Code: 1}
+		}
+		lines := strings.Fields(string(input))
+		slices.Sort(lines)
+		for _, line := range lines {
+			process.Stdout(line)
+		}
+		return dockertest.Exit{}
+	})
+	request := runRequest()
+	request.Stdin = []string{"cherry", "apple", "banana"}
+	request.TimeoutSeconds = 30
+
+	started := time.Now()
+	stream, err := runner.Run(context.Background(), request)
+	checkOutcome(t, stream, err, v1.ErrorClass_ERROR_CLASS_NONE, codes.OK)
+	if elapsed := time.Since(started); elapsed > 10*time.Second {
+		t.Errorf("the run has taken %v, the program hasn't seen the end of its stdin", elapsed)
+	}
+	if stdout := stream.Lines(v1.MessageLevel_STDOUT); !slices.Equal(stdout, []string{"apple", "banana", "cherry"}) {
+		t.Errorf("stdout = %q, want the sorted stdin", stdout)
+	}
+	for _, info := range stream.Lines(v1.MessageLevel_INFO) {
+		if strings.HasPrefix(info, "The end of stdin can't be signalled") {
+			t.Errorf("the run has warned that the end of stdin can't be signalled: %q", info)
+		}
+	}
+}
+
+func TestRunRejectedBeforeTheAdmission(t *testing.T) {
+	tests := []struct {
+		name    string
+		request *v1.RunRequest
+		class   v1.ErrorClass
+		code    codes.Code
+	}{
+		{name: "unknown language", request: &v1.RunRequest{Language: "cobol"},
+			class: v1.ErrorClass_ERROR_CLASS_UNSUPPORTED_LANGUAGE, code: codes.InvalidArgument},
+		{name: "invalid label", request: &v1.RunRequest{Language: testLanguage, Labels: map[string]string{"": "value"}},
+			class: v1.ErrorClass_ERROR_CLASS_REJECTED, code: codes.InvalidArgument},
+		{name: "custom image", request: &v1.RunRequest{Image: "alpine", Command: []string{"true"}},
+			class: v1.ErrorClass_ERROR_CLASS_REJECTED, code: codes.PermissionDenied},
+		{name: "unknown output mode", request: &v1.RunRequest{Language: "sqlite", Args: []string{"xml"}},
+			class: v1.ErrorClass_ERROR_CLASS_REJECTED, code: codes.InvalidArgument},
+		{name: "arguments of a language taking none", request: &v1.RunRequest{Language: testLanguage, Args: []string{"-w"}},
+			class: v1.ErrorClass_ERROR_CLASS_REJECTED, code: codes.InvalidArgument},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runner := runnertest.New(t, nil)
+			stream, err := runner.Run(context.Background(), test.request)
+			if got := status.Code(err); got != test.code {
+				t.Errorf("Run() = %v, want the status code %s", err, test.code)
+			}
+			if got := runnertest.StatusClass(err); got != test.class {
+				t.Errorf("status class = %s, want %s", got, test.class)
+			}
+			if messages := stream.Messages(); len(messages) != 0 {
+				t.Errorf("the rejected run has sent %d messages", len(messages))
+			}
+			if containers := runner.Daemon.Containers(); slices.ContainsFunc(containers, func(c *dockertest.Container) bool {
+				return c.Config.Labels["codecell.requestId"] != ""
+			}) {
+				t.Error("the rejected run has created a container")
+			}
+		})
+	}
+}
+
+func TestRunOfASubmissionBetweenTheTransportLimits(t *testing.T) {
+	runner := runnertest.New(t, nil)
+	// above the 4MiB default of gRPC, below the limits of the configuration
+	request := runRequest()
+	request.SourceCode = "#" + strings.Repeat("x", 5<<20) + "\n" + request.SourceCode
+	stream, err := runner.Run(context.Background(), request)
+	checkOutcome(t, stream, err, v1.ErrorClass_ERROR_CLASS_NONE, codes.OK)
+
+	// the checks of the submissions hit before the transport limit
+	tests := []struct {
+		name    string
+		request *v1.RunRequest
+		message string
+	}{
+		{name: "source code", request: &v1.RunRequest{Language: testLanguage, SourceCode: strings.Repeat("x", 9<<20)},
+			message: "source code is 9MiB, the limit is 8MiB"},
+		{name: "stdin", request: &v1.RunRequest{Language: testLanguage,
+			Stdin: []string{strings.Repeat("x", 3<<20), strings.Repeat("x", 2<<20)}},
+			message: "stdin is 5MiB, the limit is 4MiB"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := runner.Run(context.Background(), test.request)
+			if status.Code(err) != codes.InvalidArgument || status.Convert(err).Message() != test.message {
+				t.Errorf("Run() = %v, want INVALID_ARGUMENT %q", err, test.message)
+			}
+			if proto.Size(test.request) >= runner.Config.MaxRecvMsgSize {
+				t.Errorf("the request takes %d bytes, over the transport limit", proto.Size(test.request))
+			}
+		})
+	}
+}
+
+func TestRunOfTheAliasTakesTheOutputModeFromTheArgs(t *testing.T) {
+	runner := runnertest.New(t, nil)
+	containers := make(chan *dockertest.Container, 1)
+	runner.Daemon.SetProgram(func(process *dockertest.Process) dockertest.Exit {
+		containers <- process.Container
+		return dockertest.Exit{}
+	})
+
+	stream, err := runner.Run(context.Background(), &v1.RunRequest{
+		Language:   "sql",
+		SourceCode: "SELECT 1;",
+		Args:       []string{"markdown"},
+	})
+	checkOutcome(t, stream, err, v1.ErrorClass_ERROR_CLASS_NONE, codes.OK)
+	container := <-containers
+	if language := container.Config.Labels["codecell.language"]; language != "sqlite" {
+		t.Errorf("the container of the alias has the language %q, want sqlite", language)
+	}
+	if command := container.Config.Cmd; len(command) == 0 || command[len(command)-1] != "-markdown" {
+		t.Errorf("the container runs %q, want the markdown output mode", command)
+	}
+}
+
+func TestRunCreatesTheContainerFromTheVerifiedDigest(t *testing.T) {
+	runner := runnertest.New(t, nil)
+	images := make(chan string, 1)
+	runner.Daemon.SetProgram(func(process *dockertest.Process) dockertest.Exit {
+		images <- process.Container.Config.Image
+		return dockertest.Exit{}
+	})
+	technology, _ := runner.Languages.Technology(testLanguage)
+	verified := runner.Languages.Status(testLanguage).Digest
+	// moving the tag to another image after the startup verification
+	runner.Daemon.AddImage(technology.GetImage(), technology.GetImage()+"@sha256:"+strings.Repeat("f", 64))
+
+	stream, err := runner.Run(context.Background(), runRequest())
+	checkOutcome(t, stream, err, v1.ErrorClass_ERROR_CLASS_NONE, codes.OK)
+	if got := <-images; got != verified {
+		t.Errorf("the container is created from %q, want the verified %q", got, verified)
+	}
+}
+
+func TestRunIsLimitedByTheConcurrencyOfItsLanguage(t *testing.T) {
+	runner := runnertest.New(t, func(config *pkg.AppConfig) {
+		config.Languages = map[string]pkg.LanguageConfig{testLanguage: {Concurrency: 1}}
+	})
+	runner.Daemon.SetProgram(sleeping("sleeping"))
+	stream, runningDone := runner.Start(context.Background(), runRequest())
+	running := stream.Await(v1.MessageLevel_STDOUT)
+	if running == nil {
+		t.Fatal("the program hasn't started")
+	}
+
+	if _, err := runner.Run(context.Background(), runRequest()); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Run() over the concurrency of the language = %v, want RESOURCE_EXHAUSTED", err)
+	}
+	if _, err := runner.Server.Stop(context.Background(), &v1.StopRequest{RequestId: running.RequestId}); err != nil {
+		t.Fatalf("Stop() = %v", err)
+	}
+	<-runningDone
+}
+
+func TestReloadAppliesTheLanguageLimitsToTheNewRunsOnly(t *testing.T) {
+	const mebibyte = 1 << 20
+	runner := runnertest.New(t, func(config *pkg.AppConfig) {
+		config.Languages = map[string]pkg.LanguageConfig{testLanguage: {Concurrency: 1}}
+	})
+	runner.Daemon.SetProgram(sleeping("sleeping"))
+	first, firstDone := runner.Start(context.Background(), runRequest())
+	if first.Await(v1.MessageLevel_STDOUT) == nil {
+		t.Fatal("the program of the first run hasn't started")
+	}
+	if _, err := runner.Run(context.Background(), runRequest()); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Run() over the concurrency of the language = %v, want RESOURCE_EXHAUSTED", err)
+	}
+
+	// raising the concurrency and the memory limit of the language mid-run
+	runner.Reload(t, fmt.Sprintf("languages:\n  %s:\n    concurrency: 2\n    memory_limit: %d\n", testLanguage, 1024*mebibyte))
+	second, secondDone := runner.Start(context.Background(), runRequest())
+	if second.Await(v1.MessageLevel_STDOUT) == nil {
+		t.Fatal("the program of the run admitted after the reload hasn't started")
+	}
+	if got := second.Await(v1.MessageLevel_STARTED).GetEnvironment().GetMemoryLimitBytes(); got != 1024*mebibyte {
+		t.Errorf("the run admitted after the reload has the memory limit %d, want the reloaded %d", got, 1024*mebibyte)
+	}
+	if got := first.Await(v1.MessageLevel_STARTED).GetEnvironment().GetMemoryLimitBytes(); got != 512*mebibyte {
+		t.Errorf("the run in flight has the memory limit %d, want the one it started with", got)
+	}
+	if run, ok := runner.Registry.Get(first.Messages()[0].RequestId); !ok || run.MemoryLimit != 512*mebibyte {
+		t.Errorf("the run in flight is registered with the memory limit %d after the reload", run.MemoryLimit)
+	}
+
+	// lowering it again lets both runs in flight finish
+	runner.Reload(t, fmt.Sprintf("languages:\n  %s:\n    concurrency: 1\n", testLanguage))
+	if _, err := runner.Run(context.Background(), runRequest()); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Run() over the lowered concurrency = %v, want RESOURCE_EXHAUSTED", err)
+	}
+	for _, stream := range []*runnertest.Stream{first, second} {
+		if _, err := runner.Server.Stop(context.Background(), &v1.StopRequest{RequestId: stream.Messages()[0].RequestId}); err != nil {
+			t.Fatalf("Stop() = %v", err)
+		}
+	}
+	checkOutcome(t, first, <-firstDone, v1.ErrorClass_ERROR_CLASS_STOPPED_BY_OPERATOR, codes.Canceled)
+	checkOutcome(t, second, <-secondDone, v1.ErrorClass_ERROR_CLASS_STOPPED_BY_OPERATOR, codes.Canceled)
+}
+
+func TestStopIsReservedToTheSubmitterOrAnAdmin(t *testing.T) {
+	runner := runnertest.New(t, func(config *pkg.AppConfig) {
+		config.DedupEnabled = true
+		config.MaxConcurrentRuns = 1
+		config.QueueMaxDepth = 1
+	})
+	runner.Daemon.SetProgram(sleeping("sleeping"))
+	alice := auth.WithPrincipal(context.Background(), &auth.RequestPrincipal{Identity: "alice"})
+	bob := auth.WithPrincipal(context.Background(), &auth.RequestPrincipal{Identity: "bob"})
+	admin := auth.WithPrincipal(context.Background(), &auth.RequestPrincipal{Identity: "ops", Role: auth.RoleAdmin})
+
+	origin, originDone := runner.Start(alice, runRequest())
+	running := origin.Await(v1.MessageLevel_STDOUT)
+	if running == nil {
+		t.Fatal("the program hasn't started")
+	}
+	follower, followerDone := runner.Start(alice, runRequest())
+	coalesced := follower.Await(v1.MessageLevel_COALESCED)
+	if coalesced == nil {
+		t.Fatal("the identical run isn't coalesced")
+	}
+	if strings.Contains(coalesced.GetMessage(), running.RequestId) {
+		t.Errorf("COALESCED message %q tells the request ID of the originating run", coalesced.GetMessage())
+	}
+	queuedRequest := runRequest()
+	queuedRequest.SkipDedup = true
+	queue, queuedDone := runner.Start(alice, queuedRequest)
+	queued := queue.Await(v1.MessageLevel_QUEUED)
+	if queued == nil {
+		t.Fatal("the run isn't queued")
+	}
+
+	runs := []struct {
+		name      string
+		requestID string
+		stopper   context.Context
+		done      <-chan error
+	}{
+		{name: "queued", requestID: queued.RequestId, stopper: admin, done: queuedDone},
+		{name: "coalesced", requestID: coalesced.RequestId, stopper: alice, done: followerDone},
+		{name: "running", requestID: running.RequestId, stopper: alice, done: originDone},
+	}
+	for _, run := range runs {
+		_, err := runner.Server.Stop(bob, &v1.StopRequest{RequestId: run.requestID})
+		if status.Code(err) != codes.PermissionDenied {
+			t.Errorf("Stop() of the %s run of another caller = %v, want PERMISSION_DENIED", run.name, err)
+		}
+	}
+	for _, run := range runs {
+		if _, err := runner.Server.Stop(run.stopper, &v1.StopRequest{RequestId: run.requestID}); err != nil {
+			t.Fatalf("Stop() of the %s run = %v", run.name, err)
+		}
+		if err := <-run.done; status.Code(err) != codes.Canceled {
+			t.Errorf("the stopped %s run ends with %v, want CANCELED", run.name, err)
+		}
+	}
+}
+
+// startQueued starts the runs queued behind the sleeping one holding the
+// single slot of the runner, returning them in the order of the queue.
+func startQueued(t *testing.T, runner *runnertest.Runner, count int) ([]*runnertest.Stream, []<-chan error) {
+	t.Helper()
+	var streams []*runnertest.Stream
+	var done []<-chan error
+	for i := range count {
+		request := runRequest()
+		request.SourceCode = fmt.Sprintf("queued %d", i)
+		stream, runDone := runner.Start(context.Background(), request)
+		if stream.Await(v1.MessageLevel_QUEUED) == nil {
+			t.Fatalf("run %d isn't queued", i)
+		}
+		streams = append(streams, stream)
+		done = append(done, runDone)
+	}
+	return streams, done
+}
+
+func TestStopTakesTheRunOutOfTheQueue(t *testing.T) {
+	for position, name := range []string{"head", "middle", "tail"} {
+		t.Run(name, func(t *testing.T) {
+			runner := runnertest.New(t, func(config *pkg.AppConfig) {
+				config.MaxConcurrentRuns = 1
+				config.QueueMaxDepth = 3
+			})
+			runner.Daemon.SetProgram(sleeping("sleeping"))
+			stream, runningDone := runner.Start(context.Background(), runRequest())
+			running := stream.Await(v1.MessageLevel_STDOUT)
+			if running == nil {
+				t.Fatal("the program hasn't started")
+			}
+			streams, done := startQueued(t, runner, 3)
+
+			stopped := streams[position].Messages()[0].RequestId
+			if _, err := runner.Server.Stop(context.Background(), &v1.StopRequest{RequestId: stopped}); err != nil {
+				t.Fatalf("Stop() of the queued run = %v", err)
+			}
+			checkOutcome(t, streams[position], <-done[position], v1.ErrorClass_ERROR_CLASS_STOPPED_BY_OPERATOR, codes.Canceled)
+			if stream := streams[position]; stream.Await(v1.MessageLevel_CANCELLED) == nil {
+				t.Errorf("the stopped run has no CANCELLED message among %v", stream.Messages())
+			}
+
+			// the others are admitted in their order, once the one ahead is stopped
+			requestID := running.RequestId
+			for i := range streams {
+				if i == position {
+					continue
+				}
+				if _, err := runner.Server.Stop(context.Background(), &v1.StopRequest{RequestId: requestID}); err != nil {
+					t.Fatalf("Stop() = %v", err)
+				}
+				<-runningDone
+				next := streams[i].Await(v1.MessageLevel_STDOUT)
+				if next == nil {
+					t.Fatalf("queued run %d isn't admitted once the one ahead is stopped", i)
+				}
+				for j := i + 1; j < len(streams); j++ {
+					if j != position && slices.ContainsFunc(streams[j].Messages(), func(message *v1.RunResponseMessage) bool {
+						return message.Level == v1.MessageLevel_STDOUT
+					}) {
+						t.Fatalf("queued run %d is admitted before run %d", j, i)
+					}
+				}
+				requestID, runningDone = next.RequestId, done[i]
+			}
+			if _, err := runner.Server.Stop(context.Background(), &v1.StopRequest{RequestId: requestID}); err != nil {
+				t.Fatalf("Stop() = %v", err)
+			}
+			<-runningDone
+		})
+	}
+}
+
+func TestStopCancelsTheRunCreatingItsContainer(t *testing.T) {
+	runner := runnertest.New(t, nil)
+	created, release := runner.Daemon.Hold(dockertest.OperationCreate)
+	defer release()
+
+	stream, done := runner.Start(context.Background(), runRequest())
+	<-created
+	// the run is admitted, its container isn't known yet
+	requestID := stream.Messages()[0].RequestId
+	if _, err := runner.Server.Stop(context.Background(), &v1.StopRequest{RequestId: requestID}); err != nil {
+		t.Fatalf("Stop() of the run creating its container = %v", err)
+	}
+	release()
+	checkOutcome(t, stream, <-done, v1.ErrorClass_ERROR_CLASS_STOPPED_BY_OPERATOR, codes.Canceled)
+}
+
+func TestStopRacingWithTheDequeue(t *testing.T) {
+	runner := runnertest.New(t, func(config *pkg.AppConfig) {
+		config.MaxConcurrentRuns = 1
+		config.QueueMaxDepth = 1
+	})
+	runner.Daemon.SetProgram(sleeping("sleeping"))
+	for i := range 20 {
+		request := runRequest()
+		request.SourceCode = fmt.Sprintf("running %d", i)
+		stream, runningDone := runner.Start(context.Background(), request)
+		running := stream.Await(v1.MessageLevel_STDOUT)
+		if running == nil {
+			t.Fatal("the program hasn't started")
+		}
+		streams, done := startQueued(t, runner, 1)
+		queued := streams[0].Messages()[0].RequestId
+
+		// the queued run is taken out of the queue, or stopped on its way out of it
+		stops := make(chan error, 2)
+		for _, requestID := range []string{running.RequestId, queued} {
+			go func() {
+				_, err := runner.Server.Stop(context.Background(), &v1.StopRequest{RequestId: requestID})
+				stops <- err
+			}()
+		}
+		for range 2 {
+			if err := <-stops; err != nil {
+				t.Fatalf("Stop() = %v, want both runs stopped", err)
+			}
+		}
+		<-runningDone
+		if err := <-done[0]; status.Code(err) != codes.Canceled {
+			t.Fatalf("the queued run ends with %v, want CANCELED", err)
+		}
+	}
+	for _, container := range runner.Daemon.Containers() {
+		if container.State().Running {
+			t.Errorf("container %s is left running", container.ID)
+		}
+	}
+}
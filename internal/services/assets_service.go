@@ -0,0 +1,110 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/Pelfox/codecell-runner/pkg"
+)
+
+// AssetsMountPath is the directory of the containers the assets are mounted in.
+const AssetsMountPath = "/workspace/assets"
+
+// assetNamePattern matches the valid asset names, which are file names too.
+var assetNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// Asset is a file of the runner host mounted read-only into the containers of
+// the runs listing it.
+type Asset struct {
+	// Name is the ID of the asset, its file name in the assets directory.
+	Name string
+	// Path is the host path of the asset.
+	Path string
+	// Size is the size of the asset in bytes.
+	Size int64
+}
+
+// AssetsService looks up the assets staged in the configured directory.
+// Every regular file of the directory is an asset, read from the disk on
+// each lookup, so that the assets can be added and replaced at any time.
+type AssetsService struct {
+	dir          string
+	maxAssets    int
+	maxTotalSize int64
+}
+
+// NewAssetsService creates a new instance of AssetsService for the configured
+// assets directory.
+func NewAssetsService(appConfig *pkg.AppConfig) *AssetsService {
+	return &AssetsService{
+		dir:          appConfig.AssetsDir,
+		maxAssets:    appConfig.AssetsMaxPerRun,
+		maxTotalSize: appConfig.AssetsMaxRunSize,
+	}
+}
+
+// List returns the assets of the directory, sorted by name. The files that
+// can't be mounted are left out.
+func (s *AssetsService) List() ([]Asset, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	assets := make([]Asset, 0, len(entries))
+	for _, entry := range entries {
+		if asset, err := s.stat(entry.Name()); err == nil {
+			assets = append(assets, asset)
+		}
+	}
+	return assets, nil
+}
+
+// Lookup returns the assets of the given names, checking them against the
+// limits of a run. The names of no asset fail with ErrAssetNotFound.
+func (s *AssetsService) Lookup(names []string) ([]Asset, error) {
+	if len(names) > s.maxAssets {
+		return nil, fmt.Errorf("%d assets are listed, the limit is %d", len(names), s.maxAssets)
+	}
+	assets := make([]Asset, 0, len(names))
+	seen := make(map[string]bool, len(names))
+	var totalSize int64
+	for _, name := range names {
+		if seen[name] {
+			return nil, fmt.Errorf("asset %q is listed more than once", name)
+		}
+		seen[name] = true
+		asset, err := s.stat(name)
+		if err != nil {
+			return nil, err
+		}
+		if totalSize += asset.Size; totalSize > s.maxTotalSize {
+			return nil, fmt.Errorf("the assets exceed the limit of %d bytes per run", s.maxTotalSize)
+		}
+		assets = append(assets, asset)
+	}
+	return assets, nil
+}
+
+// stat returns the asset of the name, which must be a regular file with no
+// setuid or setgid bit, the symlinks are never followed out of the directory.
+func (s *AssetsService) stat(name string) (Asset, error) {
+	if !assetNamePattern.MatchString(name) {
+		return Asset{}, fmt.Errorf("%w: %q", ErrAssetNotFound, name)
+	}
+	path := filepath.Join(s.dir, name)
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return Asset{}, fmt.Errorf("%w: %q", ErrAssetNotFound, name)
+	}
+	if err != nil {
+		return Asset{}, err
+	}
+	if !info.Mode().IsRegular() || info.Mode()&(fs.ModeSetuid|fs.ModeSetgid) != 0 {
+		return Asset{}, fmt.Errorf("%w: %q is not a plain file", ErrAssetNotFound, name)
+	}
+	return Asset{Name: name, Path: path, Size: info.Size()}, nil
+}
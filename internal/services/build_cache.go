@@ -0,0 +1,288 @@
+package services
+
+import (
+	"archive/tar"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/executor"
+	"github.com/Pelfox/codecell-runner/internal/metrics"
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/moby/moby/client"
+)
+
+const (
+	// buildCacheSuffix is the suffix of the archives of the cached build outputs.
+	buildCacheSuffix = ".tar"
+	// buildCacheMaxFiles is the maximum number of files of the build outputs of a run.
+	buildCacheMaxFiles = 10000
+)
+
+// errBuildOutputsTooLarge is returned for the build outputs over the size of the whole cache.
+var errBuildOutputsTooLarge = errors.New("the build outputs exceed the size of the cache")
+
+// BuildCache keeps the build outputs of the successful runs on the host, as
+// archives keyed by everything the build depends on, so that the identical
+// runs start with them in their workspace and build incrementally. The least
+// recently used archives are evicted over the size limit.
+type BuildCache struct {
+	dockerClient      *client.Client
+	containersService *ContainersService
+	dir               string
+	maxSize           int64
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element // ID = cache key
+	lru     *list.List               // of *buildCacheEntry, the most recently used first
+	size    int64
+}
+
+// buildCacheEntry is an archive of the cache.
+type buildCacheEntry struct {
+	key  string
+	size int64
+}
+
+// NewBuildCache creates a new instance of BuildCache in the configured
+// directory, keeping the archives of the previous runs of the runner.
+func NewBuildCache(
+	dockerClient *client.Client,
+	containersService *ContainersService,
+	appConfig *pkg.AppConfig,
+) (*BuildCache, error) {
+	if err := os.MkdirAll(appConfig.BuildCacheDir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create the build cache directory: %w", err)
+	}
+	files, err := os.ReadDir(appConfig.BuildCacheDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the build cache directory: %w", err)
+	}
+
+	cache := &BuildCache{
+		dockerClient:      dockerClient,
+		containersService: containersService,
+		dir:               appConfig.BuildCacheDir,
+		maxSize:           appConfig.BuildCacheMaxSize,
+		entries:           make(map[string]*list.Element),
+		lru:               list.New(),
+	}
+	// the modification time of an archive is the time it was last used
+	type archive struct {
+		entry  *buildCacheEntry
+		usedAt time.Time
+	}
+	var archives []archive
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, buildCacheSuffix) {
+			_ = os.RemoveAll(filepath.Join(cache.dir, name)) // the leftovers of an interrupted store
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		entry := &buildCacheEntry{key: strings.TrimSuffix(name, buildCacheSuffix), size: info.Size()}
+		archives = append(archives, archive{entry: entry, usedAt: info.ModTime()})
+	}
+	slices.SortFunc(archives, func(a, b archive) int { return a.usedAt.Compare(b.usedAt) })
+	for _, archive := range archives {
+		cache.entries[archive.entry.key] = cache.lru.PushFront(archive.entry)
+		cache.size += archive.entry.size
+	}
+	cache.mutex.Lock()
+	cache.evict()
+	cache.mutex.Unlock()
+	return cache, nil
+}
+
+// Key returns the cache key of the run of the identity, hashing the language,
+// the digest of its image and the canonical workspace archive of the source
+// code. It's empty if the technology doesn't build or the image is unknown.
+func (c *BuildCache) Key(
+	identity string,
+	language string,
+	technology executor.Technology,
+	imageDigest string,
+	sourceCode string,
+) (string, error) {
+	if len(technology.GetBuildOutputs()) == 0 || imageDigest == "" {
+		return "", nil
+	}
+	workspace, err := technology.WriteSourceCode(sourceCode, pkg.FileOwner{})
+	if err != nil {
+		return "", err
+	}
+	defer workspace.Close()
+
+	hash := sha256.New()
+	// every part is length-prefixed, so that the boundaries can't be shifted
+	for _, value := range []string{identity, language, imageDigest} {
+		_ = binary.Write(hash, binary.BigEndian, uint64(len(value)))
+		hash.Write([]byte(value))
+	}
+	if _, err := io.Copy(hash, workspace); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Restore copies the cached build outputs of the key into the workspace of the
+// created container, reporting whether there were any.
+func (c *BuildCache) Restore(ctx context.Context, containerID string, key string) (bool, error) {
+	c.mutex.Lock()
+	element, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(element)
+	}
+	c.mutex.Unlock()
+	if !ok {
+		metrics.BuildCacheLookups.WithLabelValues("miss").Inc()
+		return false, nil
+	}
+	metrics.BuildCacheLookups.WithLabelValues("hit").Inc()
+
+	// an archive evicted meanwhile stays readable once opened
+	file, err := os.Open(c.path(key))
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	now := time.Now()
+	_ = os.Chtimes(file.Name(), now, now) // the order of use survives restarts
+
+	_, err = c.dockerClient.CopyToContainer(ctx, containerID, client.CopyToContainerOptions{
+		DestinationPath: "/workspace",
+		Content:         file,
+	})
+	if err != nil {
+		return false, dockerError(err, ErrContainerNotFound)
+	}
+	return true, nil
+}
+
+// Store caches the build outputs in the workspace of the exited container
+// under the key, evicting the least recently used archives over the size
+// limit. The outputs the build hasn't produced are skipped.
+func (c *BuildCache) Store(ctx context.Context, containerID string, key string, outputs []string) error {
+	temp, err := os.CreateTemp(c.dir, "store-*")
+	if err != nil {
+		return err
+	}
+	stored := false
+	defer func() {
+		if !stored {
+			_ = temp.Close()
+			_ = os.Remove(temp.Name())
+		}
+	}()
+
+	limited := &limitedWriter{writer: temp, remaining: c.maxSize}
+	tarWriter := tar.NewWriter(limited)
+	copied := false
+	for _, output := range outputs {
+		artifacts, err := c.containersService.ExtractPath(ctx, containerID, path.Join("/workspace", output),
+			ExtractLimits{MaxSize: c.maxSize, MaxFiles: buildCacheMaxFiles})
+		if errors.Is(err, ErrPathNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = pkg.CopyTarArchive(tarWriter, artifacts)
+		_ = artifacts.Close()
+		if err != nil {
+			return err
+		}
+		copied = true
+	}
+	if !copied {
+		return nil
+	}
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(temp.Name(), c.path(key)); err != nil {
+		return err
+	}
+	stored = true
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.remove(key)
+	c.entries[key] = c.lru.PushFront(&buildCacheEntry{key: key, size: c.maxSize - limited.remaining})
+	c.size += c.maxSize - limited.remaining
+	c.evict()
+	return nil
+}
+
+// Invalidate drops the cached build outputs of the key, e.g. once a run
+// restored from them has failed.
+func (c *BuildCache) Invalidate(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.remove(key) {
+		_ = os.Remove(c.path(key))
+	}
+	metrics.BuildCacheSizeBytes.Set(float64(c.size))
+}
+
+// remove forgets the entry of the key, reporting whether there was one. The
+// mutex must be held.
+func (c *BuildCache) remove(key string) bool {
+	element, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+	c.lru.Remove(element)
+	delete(c.entries, key)
+	c.size -= element.Value.(*buildCacheEntry).size
+	return true
+}
+
+// evict removes the least recently used archives until the cache fits its
+// size limit. The mutex must be held.
+func (c *BuildCache) evict() {
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		entry := c.lru.Back().Value.(*buildCacheEntry)
+		c.remove(entry.key)
+		_ = os.Remove(c.path(entry.key))
+	}
+	metrics.BuildCacheSizeBytes.Set(float64(c.size))
+}
+
+// path returns the path of the archive of the key.
+func (c *BuildCache) path(key string) string {
+	return filepath.Join(c.dir, key+buildCacheSuffix)
+}
+
+// limitedWriter fails the writes past its remaining size.
+type limitedWriter struct {
+	writer    io.Writer
+	remaining int64
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > w.remaining {
+		return 0, errBuildOutputsTooLarge
+	}
+	n, err := w.writer.Write(p)
+	w.remaining -= int64(n)
+	return n, err
+}
@@ -1,80 +1,490 @@
 package services
 
 import (
+	"archive/tar"
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Pelfox/codecell-runner/internal/executor"
+	"github.com/Pelfox/codecell-runner/internal/tracing"
 	"github.com/Pelfox/codecell-runner/pkg"
 	"github.com/docker/go-units"
+	"github.com/moby/moby/api/types/blkiodev"
 	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/api/types/mount"
 	"github.com/moby/moby/client"
-	"github.com/rs/zerolog/log"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-// imagesMapping maps supported programming languages to their corresponding executor technologies.
-var imagesMapping = map[string]executor.Technology{
-	"dotnet": executor.DotNetTechnology{},
-}
-
 // ContainersService provides methods to manage Docker containers for code execution.
 type ContainersService struct {
-	dockerClient *client.Client
-	appConfig    *pkg.AppConfig
+	dockerClient     *client.Client
+	appConfig        *pkg.AppConfig
+	languagesService *LanguagesService
+	isolationMode    IsolationMode
+	cpusetOverrides  map[string]string
+	defaultEnv       map[string]string
 }
 
 // NewContainersService creates a new instance of ContainersService with the given Docker client.
-func NewContainersService(dockerClient *client.Client, appConfig *pkg.AppConfig) *ContainersService {
-	return &ContainersService{dockerClient, appConfig}
+func NewContainersService(
+	dockerClient *client.Client,
+	appConfig *pkg.AppConfig,
+	languagesService *LanguagesService,
+	isolationMode IsolationMode,
+) (*ContainersService, error) {
+	cpusetOverrides, err := pkg.ParseCPUSetOverrides(appConfig.CPUSetOverrides)
+	if err != nil {
+		return nil, err
+	}
+	defaultEnv, err := pkg.ParseEnvironment(appConfig.DefaultEnv)
+	if err != nil {
+		return nil, err
+	}
+	return &ContainersService{dockerClient, appConfig, languagesService, isolationMode, cpusetOverrides, defaultEnv}, nil
+}
+
+// cpusetFor returns the CPUs the containers of the given language are pinned to.
+func (s *ContainersService) cpusetFor(language string) string {
+	if cpus, ok := s.cpusetOverrides[language]; ok {
+		return cpus
+	}
+	return s.appConfig.CPUSetCPUs
+}
+
+// containerUser returns the user the container process runs as, as well as
+// the owner of the workspace files. On a root daemon the technology user is
+// resolved by name and files stay owned by root (readable by all); with
+// remapped users (or technologies without a named user) the numeric IDs are
+// used, so that the files copied in are owned by the same unprivileged user
+// that executes them.
+func (s *ContainersService) containerUser(language string, technology executor.Technology) (string, pkg.FileOwner) {
+	if technology.GetUser() != "" && !s.isolationMode.IsRemapped() {
+		return technology.GetUser(), pkg.FileOwner{}
+	}
+
+	owner := pkg.FileOwner{UID: s.appConfig.RunnerUID, GID: s.appConfig.RunnerGID}
+	// preferring the IDs found in the image itself during verification
+	if status := s.languagesService.Status(language); technology.GetUser() != "" && status.UID != 0 {
+		owner = pkg.FileOwner{UID: status.UID, GID: status.GID}
+	}
+	return fmt.Sprintf("%d:%d", owner.UID, owner.GID), owner
+}
+
+// ValidateBlkioDevice checks that the configured throttling device is a block
+// device. The device of a remote daemon is on its host, it's left to it then.
+func (s *ContainersService) ValidateBlkioDevice(ctx context.Context) error {
+	if s.appConfig.BlkioDevice == "" {
+		if s.hasBlkioLimits() {
+			return errors.New("block I/O limits require blkio_device to be set")
+		}
+		return nil
+	}
+	if !isLocalDaemon(s.dockerClient) {
+		zerolog.Ctx(ctx).Warn().Str("blkioDevice", s.appConfig.BlkioDevice).Str("daemonHost", s.dockerClient.DaemonHost()).
+			Msg("docker daemon is remote, the block I/O throttling device must be on its host")
+		return nil
+	}
+
+	info, err := os.Stat(s.appConfig.BlkioDevice)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeDevice == 0 || info.Mode()&os.ModeCharDevice != 0 {
+		return fmt.Errorf("%s is not a block device", s.appConfig.BlkioDevice)
+	}
+	return nil
+}
+
+// hasBlkioLimits reports whether any block I/O limit is configured.
+func (s *ContainersService) hasBlkioLimits() bool {
+	return s.appConfig.BlkioReadBps > 0 || s.appConfig.BlkioWriteBps > 0 ||
+		s.appConfig.BlkioReadIOps > 0 || s.appConfig.BlkioWriteIOps > 0
+}
+
+// throttleDevice returns the throttling rule for the configured device, or
+// nothing if the given rate is disabled.
+func (s *ContainersService) throttleDevice(rate uint64) []*blkiodev.ThrottleDevice {
+	if rate == 0 || s.appConfig.BlkioDevice == "" {
+		return nil
+	}
+	return []*blkiodev.ThrottleDevice{{Path: s.appConfig.BlkioDevice, Rate: rate}}
+}
+
+// DescribeIOLimits returns a description of the effective disk I/O limits,
+// e.g. "read 1MiB/s, 100 write ops/s", or an empty string if the I/O is not
+// throttled.
+func (s *ContainersService) DescribeIOLimits() string {
+	if s.appConfig.BlkioDevice == "" || !s.hasBlkioLimits() {
+		return ""
+	}
+
+	var limits []string
+	if rate := s.appConfig.BlkioReadBps; rate > 0 {
+		limits = append(limits, "read "+units.BytesSize(float64(rate))+"/s")
+	}
+	if rate := s.appConfig.BlkioWriteBps; rate > 0 {
+		limits = append(limits, "write "+units.BytesSize(float64(rate))+"/s")
+	}
+	if rate := s.appConfig.BlkioReadIOps; rate > 0 {
+		limits = append(limits, fmt.Sprintf("%d read ops/s", rate))
+	}
+	if rate := s.appConfig.BlkioWriteIOps; rate > 0 {
+		limits = append(limits, fmt.Sprintf("%d write ops/s", rate))
+	}
+	return strings.Join(limits, ", ")
+}
+
+// ContainerRequest describes the container to be created for a single run.
+type ContainerRequest struct {
+	// RequestID is the ID of the run the container belongs to.
+	RequestID string
+	// Language is the programming language of the source code.
+	Language string
+	// SourceCode is the code to be written into the workspace.
+	SourceCode string
+	// NetworkEnabled attaches the container to the managed egress network.
+	NetworkEnabled bool
+	// Image is the custom image to use instead of the language image.
+	Image string
+	// Command is the command to execute in the custom image.
+	Command []string
+	// Args are the arguments of the language program, e.g. the output mode of
+	// sqlite.
+	Args []string
+	// Deadline is the time after which the watchdog removes the container.
+	Deadline time.Time
+	// MemoryLimit overrides the configured memory limit in bytes, if non-zero.
+	MemoryLimit int64
+	// CPULimit overrides the configured CPU limit in nanos, if non-zero.
+	CPULimit int64
+	// Files are the submitted files written into the workspace along the
+	// source code, nil if none.
+	Files *pkg.FileSpool
+	// Assets are the assets mounted read-only into AssetsMountPath.
+	Assets []Asset
+	// Pooled marks a warm pool container, created before its run is known.
+	Pooled bool
+}
+
+// ManagedContainer describes a container created by the runner.
+type ManagedContainer struct {
+	// ID is the ID of the container.
+	ID string
+	// RequestID is the ID of the run the container belongs to, if any.
+	RequestID string
+	// Deadline is the time after which the container must be gone, if known.
+	Deadline time.Time
+	// CreatedAt is the time the container was created.
+	CreatedAt time.Time
+	// Pooled reports whether it's a warm pool container.
+	Pooled bool
 }
 
 // CreateContainer creates a new container for the given request ID, language and source code.
 // It returns the container ID or an error if the operation fails.
-func (s *ContainersService) CreateContainer(
-	requestId string,
-	language string,
-	sourceCode string,
-) (string, error) {
-	technology, ok := imagesMapping[language]
-	if !ok {
-		return "", errors.New("the specified language is not supported")
+func (s *ContainersService) CreateContainer(ctx context.Context, request ContainerRequest) (containerID string, err error) {
+	ctx, span := tracing.Start(ctx, "CreateContainer",
+		attribute.String("codecell.language", request.Language),
+		attribute.String("codecell.image", request.Image),
+	)
+	defer func() {
+		span.SetAttributes(attribute.String("codecell.container_id", containerID))
+		tracing.End(span, err)
+	}()
+
+	containerID, err = s.createContainer(request)
+	if err != nil {
+		return "", err
+	}
+	return containerID, s.CopyWorkspace(ctx, containerID, request)
+}
+
+// CreatePooledContainer creates a warm pool container for the given language,
+// without any workspace. It's removed by the watchdog after expiresAt, unless
+// a run claims it.
+func (s *ContainersService) CreatePooledContainer(language string, expiresAt time.Time) (string, error) {
+	return s.createContainer(ContainerRequest{Language: language, Deadline: expiresAt, Pooled: true})
+}
+
+// CopyWorkspace writes the source code of the request into the workspace of
+// the created container.
+func (s *ContainersService) CopyWorkspace(ctx context.Context, containerID string, request ContainerRequest) (err error) {
+	_, span := tracing.Start(ctx, "CopyToContainer", attribute.String("codecell.container_id", containerID))
+	defer func() { tracing.End(span, err) }()
+
+	technology, err := s.technologyFor(request)
+	if err != nil {
+		return err
+	}
+	_, owner := s.containerUser(request.Language, technology)
+
+	workspaceReader, err := technology.WriteSourceCode(request.SourceCode, owner)
+	if err != nil {
+		return err
+	}
+	defer workspaceReader.Close() // unblocking the writer if the copy fails midway
+	if request.Files != nil {
+		spooled := pkg.AppendSpoolToTar(workspaceReader, request.Files, owner)
+		defer spooled.Close()
+		workspaceReader = spooled
+	}
+
+	copyOptions := client.CopyToContainerOptions{
+		DestinationPath: "/workspace",
+		Content:         workspaceReader,
+	}
+	// the cancellation of the run aborts the copy, and with it the writing of the archive
+	_, err = s.dockerClient.CopyToContainer(ctx, containerID, copyOptions)
+	return dockerError(err, ErrContainerNotFound)
+}
+
+// ExtractLimits bounds the artifacts extracted from a container.
+type ExtractLimits struct {
+	// MaxSize is the maximum total size of the extracted files in bytes.
+	MaxSize int64
+	// MaxFiles is the maximum number of the extracted files.
+	MaxFiles int
+}
+
+// ExtractPath returns the tar archive of the path of the container, rooted at
+// its base name, as it's read from the daemon. Only the regular files and the
+// directories under the path are kept, and the extraction fails with
+// ErrArtifactTooLarge past the limits, counting the bytes actually read rather
+// than the sizes of the headers. The archive must be closed if it isn't read
+// to the end.
+func (s *ContainersService) ExtractPath(
+	ctx context.Context,
+	containerID string,
+	sourcePath string,
+	limits ExtractLimits,
+) (io.ReadCloser, error) {
+	result, err := s.dockerClient.CopyFromContainer(ctx, containerID, client.CopyFromContainerOptions{
+		SourcePath: sourcePath,
+	})
+	if err != nil {
+		return nil, dockerError(err, ErrPathNotFound)
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		defer result.Content.Close()
+		tarWriter := tar.NewWriter(writer)
+		err := extractEntries(tarWriter, tar.NewReader(result.Content), path.Base(sourcePath), limits)
+		if err == nil {
+			err = tarWriter.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+	return reader, nil
+}
+
+// extractEntries copies the regular files and the directories of the archive
+// under the prefix, dropping every other entry, within the limits.
+func extractEntries(tarWriter *tar.Writer, tarReader *tar.Reader, prefix string, limits ExtractLimits) error {
+	remaining := limits.MaxSize
+	files := 0
+	for {
+		hdr, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name, err := pkg.SanitizePath(hdr.Name)
+		if err != nil || (name != prefix && !strings.HasPrefix(name, prefix+"/")) {
+			continue
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := tarWriter.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     name + "/",
+				Mode:     hdr.Mode & 0o777,
+				Uid:      hdr.Uid,
+				Gid:      hdr.Gid,
+				ModTime:  hdr.ModTime,
+			}); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if files++; files > limits.MaxFiles {
+				return fmt.Errorf("%w of %d files", ErrArtifactTooLarge, limits.MaxFiles)
+			}
+			if hdr.Size > remaining {
+				return fmt.Errorf("%w of %d bytes", ErrArtifactTooLarge, limits.MaxSize)
+			}
+			if err := tarWriter.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     name,
+				Mode:     hdr.Mode & 0o777,
+				Size:     hdr.Size,
+				Uid:      hdr.Uid,
+				Gid:      hdr.Gid,
+				ModTime:  hdr.ModTime,
+			}); err != nil {
+				return err
+			}
+			// the writer refuses the content past the size of the header as well
+			written, err := io.CopyN(tarWriter, tarReader, hdr.Size)
+			remaining -= written
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// technologyFor returns the executor technology of the request.
+func (s *ContainersService) technologyFor(request ContainerRequest) (executor.Technology, error) {
+	if request.Image != "" {
+		// custom images bypass the executor lookup, the caller supplies the command
+		return executor.CustomTechnology{Image: request.Image, Command: request.Command}, nil
+	}
+	if err := s.languagesService.Availability(request.Language); err != nil {
+		return nil, err
+	}
+	technology, _ := s.languagesService.Technology(request.Language)
+	return technology, nil
+}
+
+// imageFor returns the image reference to create the container of the request
+// from. The language runs are pinned to the digest verified at startup, so that
+// a tag moved since then can't swap the unverified image in.
+func (s *ContainersService) imageFor(request ContainerRequest, technology executor.Technology) string {
+	if request.Image == "" {
+		if digest := s.languagesService.Status(request.Language).Digest; digest != "" {
+			return digest
+		}
+	}
+	return technology.GetImage()
+}
+
+// Environment returns the environment variables of the container of the request.
+func (s *ContainersService) Environment(request ContainerRequest) ([]string, error) {
+	technology, err := s.technologyFor(request)
+	if err != nil {
+		return nil, err
+	}
+	return s.environmentFor(request, technology), nil
+}
+
+// environmentFor merges the environment variables of the container, every
+// layer overriding the previous ones: the default timezone, the default
+// environment, the technology and the egress proxy of the network-enabled
+// runs, which the code must not be able to bypass.
+func (s *ContainersService) environmentFor(request ContainerRequest, technology executor.Technology) []string {
+	var proxy map[string]string
+	if request.NetworkEnabled {
+		proxy = ProxyEnvironment(s.appConfig, request.RequestID)
+	}
+	return pkg.MergeEnvironment(
+		map[string]string{"TZ": s.appConfig.DefaultTimezone},
+		s.defaultEnv,
+		technology.GetEnvironment(),
+		proxy,
+	)
+}
+
+// assetMounts returns the read-only bind mounts of the assets. The binds can't
+// be nosuid, the assets are plain files and the containers have
+// no-new-privileges, so that no setuid bit can ever take effect.
+func assetMounts(assets []Asset) []mount.Mount {
+	mounts := make([]mount.Mount, 0, len(assets))
+	for _, asset := range assets {
+		mounts = append(mounts, mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   asset.Path,
+			Target:   path.Join(AssetsMountPath, asset.Name),
+			ReadOnly: true,
+		})
+	}
+	return mounts
+}
+
+// createContainer creates the container of the request with an empty workspace.
+func (s *ContainersService) createContainer(request ContainerRequest) (string, error) {
+	technology, err := s.technologyFor(request)
+	if err != nil {
+		return "", err
 	}
 
 	// selecting the runtime based on the application configuration
-	var runtime string
-	switch s.appConfig.Runtime {
-	case pkg.RuntimeTypeDocker:
-		runtime = "runc"
-	case pkg.RuntimeTypeGvisor:
-		runtime = "runsc"
-	default:
+	runtime := s.appConfig.Runtime.OCIRuntime()
+	if runtime == "" {
 		return "", errors.New("the specified runtime is not supported")
 	}
 
-	initValue := true      // enabling init process in the container
-	pidsLimit := int64(64) // limiting the number of processes to 64
+	// the pooled containers have the settings of the boot configuration
+	languageConfig, _ := s.languagesService.Config(request.Language, &s.appConfig.DynamicConfig)
+	user, owner := s.containerUser(request.Language, technology)
+	tmpfsOptions := "rw,noexec,nosuid,size=" + languageConfig.TmpfsSize
+	if s.isolationMode.IsRemapped() {
+		// making the home directory owned by the remapped user
+		tmpfsOptions += fmt.Sprintf(",uid=%d,gid=%d", owner.UID, owner.GID)
+	}
+
+	// keeping the container fully offline, unless it has opted into the managed network
+	networkMode := container.NetworkMode("none")
+	if request.NetworkEnabled {
+		networkMode = container.NetworkMode(s.appConfig.NetworkName)
+	}
+
+	environment := s.environmentFor(request, technology)
+	command, err := technology.GetCommandWithArgs(request.Args)
+	if err != nil {
+		return "", err
+	}
+
+	memoryLimit := languageConfig.MemoryLimit
+	if request.MemoryLimit > 0 {
+		memoryLimit = request.MemoryLimit
+	}
+	cpuLimit := languageConfig.CPULimit
+	if request.CPULimit > 0 {
+		cpuLimit = request.CPULimit
+	}
+	memorySwap := s.appConfig.MemorySwapLimit
+	if memorySwap == 0 {
+		memorySwap = memoryLimit // disable swap
+	}
+	var memorySwappiness *int64
+	if s.appConfig.MemorySwappiness >= 0 {
+		memorySwappiness = &s.appConfig.MemorySwappiness
+	}
+
+	initValue := true                     // enabling init process in the container
+	pidsLimit := languageConfig.PidsLimit // limiting the number of processes
 	containerOptions := client.ContainerCreateOptions{
 		Config: &container.Config{
 			Labels: map[string]string{
 				"codecell.runner":    "true",
-				"codecell.language":  language,
-				"codecell.requestId": requestId,
+				"codecell.language":  request.Language,
+				"codecell.requestId": request.RequestID,
+				"codecell.deadline":  strconv.FormatInt(request.Deadline.Unix(), 10),
+				"codecell.pool":      strconv.FormatBool(request.Pooled),
 			},
-			User:         "runner", // running as non-root
+			User:         user, // running as non-root
 			AttachStdout: true,
 			AttachStderr: true,
-			Env: []string{
-				"HOME=/tmp",
-				// TODO: pass more environment variables from the settings
-			},
-			Cmd:        technology.GetCommand(),
-			WorkingDir: "/workspace",
+			Env:          environment,
+			Cmd:          command,
+			WorkingDir:   "/workspace",
 			Volumes: map[string]struct{}{
 				"/workspace": {},
 			},
-			NetworkDisabled: true,
+			NetworkDisabled: !request.NetworkEnabled,
 			// opening and attaching STDIN, to write input from the user
 			OpenStdin:   true,
 			StdinOnce:   true,
@@ -83,14 +493,16 @@ func (s *ContainersService) CreateContainer(
 		HostConfig: &container.HostConfig{
 			Runtime:        runtime,
 			IpcMode:        "none",
+			CgroupnsMode:   container.CgroupnsModePrivate, // hiding the host cgroup structure
 			Init:           &initValue,
 			ReadonlyRootfs: true, // making root filesystem read-only
 			Tmpfs: map[string]string{
-				"/tmp": "rw,noexec,nosuid,size=64m",
+				"/tmp": tmpfsOptions,
 			},
-			NetworkMode: "none",
-			AutoRemove:  true,
-			CapDrop:     []string{"ALL"}, // dropping all capabilities for security
+			Mounts:      assetMounts(request.Assets),
+			NetworkMode: networkMode,
+			OomScoreAdj: s.appConfig.OOMScoreAdj, // preferring sandboxes as OOM victims
+			CapDrop:     []string{"ALL"},         // dropping all capabilities for security
 			SecurityOpt: []string{
 				"no-new-privileges", // preventing privilege escalation
 			},
@@ -116,17 +528,40 @@ func (s *ContainersService) CreateContainer(
 				"/proc/sysrq-trigger",
 			},
 			Resources: container.Resources{
-				Memory:     s.appConfig.MemoryLimit, // limit memory to config value
-				MemorySwap: s.appConfig.MemoryLimit, // disable swap
-				NanoCPUs:   s.appConfig.CPULimit,    // limit amount of available CPUs
-				PidsLimit:  &pidsLimit,
+				CgroupParent:     s.appConfig.CgroupParent, // nesting under the shared sandbox cgroup
+				Memory:           memoryLimit,              // limit memory to config or request value
+				MemorySwap:       memorySwap,
+				MemorySwappiness: memorySwappiness,
+				NanoCPUs:         cpuLimit, // limit amount of available CPUs
+				CpusetCpus:       s.cpusetFor(request.Language),
+				CpusetMems:       s.appConfig.CPUSetMems,
+				// throttling disk access, so that a single run can't saturate the host storage
+				BlkioDeviceReadBps:   s.throttleDevice(s.appConfig.BlkioReadBps),
+				BlkioDeviceWriteBps:  s.throttleDevice(s.appConfig.BlkioWriteBps),
+				BlkioDeviceReadIOps:  s.throttleDevice(s.appConfig.BlkioReadIOps),
+				BlkioDeviceWriteIOps: s.throttleDevice(s.appConfig.BlkioWriteIOps),
+				PidsLimit:            &pidsLimit,
 				Ulimits: []*units.Ulimit{
-					{Name: "nofile", Soft: 1024, Hard: 1024},
-					{Name: "fsize", Soft: 100 * 1024 * 1024, Hard: 100 * 1024 * 1024}, // Limit file size to 100MB
+					{Name: "nofile", Soft: s.appConfig.UlimitNofile, Hard: s.appConfig.UlimitNofile},
+					{Name: "fsize", Soft: s.appConfig.UlimitFsize, Hard: s.appConfig.UlimitFsize},
+					// crash traces still go to stderr, only the core file itself is suppressed
+					{Name: "core", Soft: s.appConfig.UlimitCore, Hard: s.appConfig.UlimitCore},
+					{Name: "stack", Soft: s.appConfig.UlimitStack, Hard: s.appConfig.UlimitStack},
 				},
 			},
 		},
-		Image: technology.GetImage(),
+		Image: s.imageFor(request, technology),
+	}
+
+	// pointing network-enabled runs at the filtering resolver, offline runs get nothing
+	if request.NetworkEnabled {
+		dnsServers, err := ParseDNSServers(s.appConfig.DNSServers)
+		if err != nil {
+			return "", err
+		}
+		containerOptions.HostConfig.DNS = dnsServers
+		containerOptions.HostConfig.DNSSearch = s.appConfig.DNSSearch
+		containerOptions.HostConfig.ExtraHosts = s.appConfig.ExtraHosts
 	}
 
 	// enabling storage optimizations if configured
@@ -138,28 +573,16 @@ func (s *ContainersService) CreateContainer(
 
 	result, err := s.dockerClient.ContainerCreate(context.Background(), containerOptions)
 	if err != nil {
-		return "", err
-	}
-
-	workspaceReader, err := technology.WriteSourceCode(sourceCode)
-	if err != nil {
-		return "", err
+		return "", dockerError(err, ErrImageMissing)
 	}
-
-	copyOptions := client.CopyToContainerOptions{
-		DestinationPath: "/workspace",
-		Content:         workspaceReader,
-	}
-	_, err = s.dockerClient.CopyToContainer(context.Background(), result.ID, copyOptions)
-
-	return result.ID, err
+	return result.ID, nil
 }
 
 // StartContainer start the container with the given ID. It must be run after
 // the container is created, and after LogsService is attached to it.
 func (s *ContainersService) StartContainer(containerID string) error {
 	_, err := s.dockerClient.ContainerStart(context.Background(), containerID, client.ContainerStartOptions{})
-	return err
+	return dockerError(err, ErrContainerNotFound)
 }
 
 // WaitForContainer waits for the container with the given ID to stop running.
@@ -177,18 +600,65 @@ func (s *ContainersService) WaitForContainer(
 }
 
 // KillContainer forcefully kills the container with the given ID using SIGKILL signal.
+// The containers that have exited or been removed already fail with
+// ErrAlreadyStopped, so that killing a container twice is harmless.
 func (s *ContainersService) KillContainer(containerID string) error {
 	options := client.ContainerKillOptions{
 		Signal: "SIGKILL",
 	}
 	_, err := s.dockerClient.ContainerKill(context.Background(), containerID, options)
-	return err
+	if err != nil && !client.IsErrConnectionFailed(err) && isNotRunning(err) {
+		return fmt.Errorf("%w: %w", ErrAlreadyStopped, err)
+	}
+	return dockerError(err, ErrContainerNotFound)
 }
 
-// RemoveContainer removes the container with the given ID from the Docker host.
+// RemoveContainer removes the container with the given ID from the Docker host,
+// killing it first if it's still running.
 func (s *ContainersService) RemoveContainer(containerID string) error {
-	_, err := s.dockerClient.ContainerRemove(context.Background(), containerID, client.ContainerRemoveOptions{})
-	return err
+	options := client.ContainerRemoveOptions{
+		Force: true,
+	}
+	_, err := s.dockerClient.ContainerRemove(context.Background(), containerID, options)
+	return dockerError(err, ErrContainerNotFound)
+}
+
+// ListManagedContainers returns all containers created by the runner,
+// including the stopped ones.
+func (s *ContainersService) ListManagedContainers(ctx context.Context) ([]ManagedContainer, error) {
+	options := client.ContainerListOptions{
+		All:     true,
+		Filters: make(client.Filters).Add("label", "codecell.runner=true"),
+	}
+	result, err := s.dockerClient.ContainerList(ctx, options)
+	if err != nil {
+		return nil, dockerError(err, nil)
+	}
+
+	containers := make([]ManagedContainer, 0, len(result.Items))
+	for _, item := range result.Items {
+		managed := ManagedContainer{
+			ID:        item.ID,
+			RequestID: item.Labels["codecell.requestId"],
+			CreatedAt: time.Unix(item.Created, 0),
+			Pooled:    item.Labels["codecell.pool"] == "true",
+		}
+		if deadline, err := strconv.ParseInt(item.Labels["codecell.deadline"], 10, 64); err == nil {
+			managed.Deadline = time.Unix(deadline, 0)
+		}
+		containers = append(containers, managed)
+	}
+	return containers, nil
+}
+
+// WasOOMKilled reports whether the kernel killed the container with the given
+// ID for exceeding its memory limit. The container must not be removed yet.
+func (s *ContainersService) WasOOMKilled(containerID string) (bool, error) {
+	result, err := s.dockerClient.ContainerInspect(context.Background(), containerID, client.ContainerInspectOptions{})
+	if err != nil {
+		return false, dockerError(err, ErrContainerNotFound)
+	}
+	return result.Container.State != nil && result.Container.State.OOMKilled, nil
 }
 
 // StreamContainerStatistics opens the new stream with statistics of the
@@ -204,7 +674,7 @@ func (s *ContainersService) StreamContainerStatistics(
 
 	result, err := s.dockerClient.ContainerStats(ctx, containerID, statsOptions)
 	if err != nil {
-		return nil, err
+		return nil, dockerError(err, ErrContainerNotFound)
 	}
 
 	decoder := json.NewDecoder(result.Body)
@@ -218,7 +688,7 @@ func (s *ContainersService) StreamContainerStatistics(
 			var stats container.StatsResponse
 			// we don't care about EOF errors, since they are basically OK for us
 			if err := decoder.Decode(&stats); err != nil && !errors.Is(err, io.EOF) {
-				log.Error().Err(err).Msg("failed to decode stats")
+				zerolog.Ctx(ctx).Error().Err(err).Msg("failed to decode stats")
 				return
 			}
 			statsChannel <- stats
@@ -0,0 +1,339 @@
+package services
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Pelfox/codecell-runner/internal/dockertest"
+	"github.com/Pelfox/codecell-runner/internal/executor"
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/client"
+	"github.com/rs/zerolog"
+)
+
+// testImage is the image of the containers of the tests.
+const testImage = "codecell/test"
+
+// newTestContainersService returns the ContainersService of a new fake daemon,
+// with the image of the tests.
+func newTestContainersService(t *testing.T) (*dockertest.Server, *client.Client, *ContainersService) {
+	t.Helper()
+	daemon := dockertest.NewServer()
+	t.Cleanup(daemon.Close)
+	daemon.AddImage(testImage, "")
+	dockerClient, err := daemon.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = dockerClient.Close() })
+	config, _, err := pkg.LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	containersService, err := NewContainersService(dockerClient, config, nil, IsolationModeUserNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return daemon, dockerClient, containersService
+}
+
+// entry is an entry of a crafted archive.
+type entry struct {
+	header  tar.Header
+	content string
+}
+
+// file returns the entry of the regular file.
+func file(name string, content string) entry {
+	return entry{header: tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0o644, Size: int64(len(content))},
+		content: content}
+}
+
+// craftArchive writes the archive of the entries, followed by the raw bytes
+// of trailer, if any, in place of the end of the archive.
+func craftArchive(t *testing.T, trailer []byte, entries ...entry) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	writer := tar.NewWriter(&buffer)
+	for _, entry := range entries {
+		if err := writer.WriteHeader(&entry.header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(writer, entry.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if trailer != nil {
+		if err := writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		return append(buffer.Bytes(), trailer...)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// headerBlock returns the raw header block of the entry, whatever its content.
+func headerBlock(t *testing.T, hdr *tar.Header) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	if err := tar.NewWriter(&buffer).WriteHeader(hdr); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// readArchive returns the contents of the entries of the archive by their
+// names, stopping at the first error.
+func readArchive(reader io.Reader) (map[string]string, error) {
+	entries := make(map[string]string)
+	tarReader := tar.NewReader(reader)
+	for {
+		hdr, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		}
+		if err != nil {
+			return entries, err
+		}
+		content, err := io.ReadAll(tarReader)
+		entries[hdr.Name] = string(content)
+		if err != nil {
+			return entries, err
+		}
+	}
+}
+
+func TestExtractPathKeepsTheFilesUnderThePath(t *testing.T) {
+	daemon, dockerClient, containersService := newTestContainersService(t)
+	daemon.ServeArchive("/workspace/out", craftArchive(t, nil,
+		entry{header: tar.Header{Typeflag: tar.TypeDir, Name: "out/", Mode: 0o755}},
+		file("out/result.txt", "result"),
+		file("out/./nested/../data.txt", "data"),
+		entry{header: tar.Header{Typeflag: tar.TypeSymlink, Name: "out/passwd", Linkname: "/etc/passwd"}},
+		entry{header: tar.Header{Typeflag: tar.TypeLink, Name: "out/shadow", Linkname: "/etc/shadow"}},
+		entry{header: tar.Header{Typeflag: tar.TypeChar, Name: "out/null", Devmajor: 1, Devminor: 3}},
+		entry{header: tar.Header{Typeflag: tar.TypeFifo, Name: "out/fifo"}},
+		file("../etc/cron.d/job", "escaped"),
+		file("out/../../etc/profile", "escaped"),
+		file("/etc/hosts", "absolute"),
+		file("output/other.txt", "outside"),
+		file("out\\windows.txt", "backslash"),
+	))
+	created, err := dockerClient.ContainerCreate(context.Background(), client.ContainerCreateOptions{
+		Config: &container.Config{Image: testImage},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := containersService.ExtractPath(context.Background(), created.ID, "/workspace/out",
+		ExtractLimits{MaxSize: 1 << 20, MaxFiles: 10})
+	if err != nil {
+		t.Fatalf("ExtractPath() = %v", err)
+	}
+	defer archive.Close()
+	entries, err := readArchive(archive)
+	if err != nil {
+		t.Fatalf("reading the extracted archive: %v", err)
+	}
+	want := map[string]string{"out/": "", "out/result.txt": "result", "out/data.txt": "data"}
+	if !maps.Equal(entries, want) {
+		t.Errorf("extracted entries %v, want %v", slices.Sorted(maps.Keys(entries)), slices.Sorted(maps.Keys(want)))
+	}
+}
+
+func TestExtractPathFailsPastTheLimits(t *testing.T) {
+	daemon, dockerClient, containersService := newTestContainersService(t)
+	daemon.ServeArchive("/workspace/out", craftArchive(t, nil,
+		file("out/small.txt", "small"),
+		file("out/large.bin", strings.Repeat("x", 4096)),
+	))
+	created, err := dockerClient.ContainerCreate(context.Background(), client.ContainerCreateOptions{
+		Config: &container.Config{Image: testImage},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := containersService.ExtractPath(context.Background(), created.ID, "/workspace/out",
+		ExtractLimits{MaxSize: 1024, MaxFiles: 10})
+	if err != nil {
+		t.Fatalf("ExtractPath() = %v", err)
+	}
+	defer archive.Close()
+	entries, err := readArchive(archive)
+	if !errors.Is(err, ErrArtifactTooLarge) {
+		t.Errorf("reading the extracted archive = %v, want ErrArtifactTooLarge", err)
+	}
+	if _, ok := entries["out/large.bin"]; ok {
+		t.Error("the file past the limit is extracted")
+	}
+}
+
+func TestExtractPathOfAMissingPath(t *testing.T) {
+	_, dockerClient, containersService := newTestContainersService(t)
+	created, err := dockerClient.ContainerCreate(context.Background(), client.ContainerCreateOptions{
+		Config: &container.Config{Image: testImage},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := containersService.ExtractPath(context.Background(), created.ID, "/workspace/out",
+		ExtractLimits{MaxSize: 1024, MaxFiles: 10}); !errors.Is(err, ErrPathNotFound) {
+		t.Errorf("ExtractPath() = %v, want ErrPathNotFound", err)
+	}
+}
+
+func TestExtractEntriesWithinTheLimits(t *testing.T) {
+	limits := ExtractLimits{MaxSize: 16, MaxFiles: 2}
+	// a body longer than its header, the bytes past the header being read as the next one
+	oversized := append([]byte(strings.Repeat("x", 4096)), make([]byte, 1024)...)
+	tests := []struct {
+		name    string
+		archive func(t *testing.T) []byte
+		wantErr error
+		want    map[string]string // the entries written before the end or the failure
+	}{
+		{name: "within the limits", archive: func(t *testing.T) []byte {
+			return craftArchive(t, nil, file("out/a", "12345678"), file("out/b", "12345678"))
+		}, want: map[string]string{"out/a": "12345678", "out/b": "12345678"}},
+		{name: "too many files", archive: func(t *testing.T) []byte {
+			return craftArchive(t, nil, file("out/a", "1"), file("out/b", "2"), file("out/c", "3"))
+		}, wantErr: ErrArtifactTooLarge, want: map[string]string{"out/a": "1", "out/b": "2"}},
+		{name: "the dropped entries aren't counted", archive: func(t *testing.T) []byte {
+			return craftArchive(t, nil, file("../a", "1"), file("other/b", "2"), file("out/c", "3"), file("out/d", "4"))
+		}, want: map[string]string{"out/c": "3", "out/d": "4"}},
+		{name: "too large in total", archive: func(t *testing.T) []byte {
+			return craftArchive(t, nil, file("out/a", "12345678"), file("out/b", "123456789"))
+		}, wantErr: ErrArtifactTooLarge, want: map[string]string{"out/a": "12345678"}},
+		{name: "header larger than the limit", archive: func(t *testing.T) []byte {
+			return headerBlock(t, &tar.Header{Typeflag: tar.TypeReg, Name: "out/a", Mode: 0o644, Size: 1 << 40})
+		}, wantErr: ErrArtifactTooLarge, want: map[string]string{}},
+		{name: "body larger than its header", archive: func(t *testing.T) []byte {
+			return craftArchive(t, oversized, file("out/a", "1234"))
+		}, wantErr: tar.ErrHeader, want: map[string]string{"out/a": "1234"}},
+		{name: "body shorter than its header", archive: func(t *testing.T) []byte {
+			archive := craftArchive(t, nil, file("out/a", "12345678"))
+			return archive[:512+4]
+		}, wantErr: io.ErrUnexpectedEOF},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			tarWriter := tar.NewWriter(&buffer)
+			err := extractEntries(tarWriter, tar.NewReader(bytes.NewReader(test.archive(t))), "out", limits)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("extractEntries() = %v, want %v", err, test.wantErr)
+			}
+			if test.want == nil {
+				return // the entry cut short is left unfinished in the written archive
+			}
+			_ = tarWriter.Flush()
+			entries, err := readArchive(&buffer)
+			if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("reading the extracted archive: %v", err)
+			}
+			if !maps.Equal(entries, test.want) {
+				t.Errorf("extracted entries %v, want %v", entries, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateBlkioDeviceOfARemoteDaemon(t *testing.T) {
+	_, _, containersService := newTestContainersService(t)
+	containersService.appConfig.BlkioWriteBps = 1 << 20
+	if err := containersService.ValidateBlkioDevice(context.Background()); err == nil {
+		t.Error("ValidateBlkioDevice() of the limits without a device = nil, want an error")
+	}
+
+	// the device is on the host of the daemon, which the runner can't see
+	containersService.appConfig.BlkioDevice = "/dev/codecell-missing"
+	var logs bytes.Buffer
+	ctx := zerolog.New(&logs).WithContext(context.Background())
+	if err := containersService.ValidateBlkioDevice(ctx); err != nil {
+		t.Errorf("ValidateBlkioDevice() = %v, want the device left to the host of the daemon", err)
+	}
+	if !strings.Contains(logs.String(), "docker daemon is remote") {
+		t.Errorf("ValidateBlkioDevice() doesn't warn of the unchecked device, logs: %s", logs.String())
+	}
+	if got, want := containersService.DescribeIOLimits(), "write 1MiB/s"; got != want {
+		t.Errorf("DescribeIOLimits() = %q, want %q", got, want)
+	}
+}
+
+// environmentTechnology is a technology adding the environment variables.
+type environmentTechnology struct {
+	executor.CustomTechnology
+	environment map[string]string
+}
+
+func (t environmentTechnology) GetEnvironment() map[string]string {
+	return t.environment
+}
+
+func TestEnvironmentIsMergedLayerByLayer(t *testing.T) {
+	tests := []struct {
+		name        string
+		defaultEnv  []string
+		technology  map[string]string
+		network     bool
+		environment []string
+	}{
+		{name: "defaults", environment: []string{"HOME=/tmp", "TZ=UTC"}},
+		{name: "default environment over the timezone", defaultEnv: []string{"TZ=Asia/Tokyo", "LANG=C.UTF-8"},
+			environment: []string{"LANG=C.UTF-8", "TZ=Asia/Tokyo"}},
+		{name: "technology over the default environment", defaultEnv: []string{"LANG=C.UTF-8", "HOME=/tmp"},
+			technology:  map[string]string{"HOME": "/home/runner", "NOLOGO": "1"},
+			environment: []string{"HOME=/home/runner", "LANG=C.UTF-8", "NOLOGO=1", "TZ=UTC"}},
+		{name: "proxy over the technology", technology: map[string]string{"HTTP_PROXY": "http://elsewhere:8080"},
+			network: true, environment: []string{
+				"HOME=/tmp",
+				"HTTPS_PROXY=http://run-1@proxy.internal:3128",
+				"HTTP_PROXY=http://run-1@proxy.internal:3128",
+				"NO_PROXY=localhost,127.0.0.1",
+				"TZ=UTC",
+				"http_proxy=http://run-1@proxy.internal:3128",
+				"https_proxy=http://run-1@proxy.internal:3128",
+				"no_proxy=localhost,127.0.0.1",
+			}},
+		{name: "offline run without the proxy", technology: map[string]string{"HTTP_PROXY": "http://elsewhere:8080"},
+			environment: []string{"HOME=/tmp", "HTTP_PROXY=http://elsewhere:8080", "TZ=UTC"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, _, err := pkg.LoadConfig("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.defaultEnv != nil {
+				config.DefaultEnv = test.defaultEnv
+			}
+			config.EgressProxyURL = "http://proxy.internal:3128"
+			containersService, err := NewContainersService(nil, config, nil, IsolationModeUserNamespace)
+			if err != nil {
+				t.Fatal(err)
+			}
+			request := ContainerRequest{RequestID: "run-1", NetworkEnabled: test.network}
+			technology := environmentTechnology{environment: test.technology}
+			// the same layers always give the same environment
+			for range 3 {
+				if environment := containersService.environmentFor(request, technology); !slices.Equal(environment, test.environment) {
+					t.Fatalf("environmentFor() = %q, want %q", environment, test.environment)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+//go:build docker
+
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/moby/moby/client"
+)
+
+// crashImage is the image of the segfaulting program, built by the test.
+const crashImage = "codecell-test/crash"
+
+// crashDockerfile builds the segfaulting program on the GCC image, with the
+// unprivileged user the containers run as.
+const crashDockerfile = `FROM gcc:14
+RUN useradd --uid 1000 --create-home runner
+COPY crash.c /crash.c
+RUN gcc -g -rdynamic -o /usr/local/bin/crash /crash.c
+`
+
+// crashProgram dereferences a null pointer, printing its backtrace to stderr
+// from the signal handler before crashing with the default action.
+const crashProgram = `#include <execinfo.h>
+#include <signal.h>
+#include <stddef.h>
+#include <unistd.h>
+
+static void crashed(int sig) {
+	static const char message[] = "caught SIGSEGV\n";
+	void *frames[32];
+	write(STDERR_FILENO, message, sizeof(message) - 1);
+	backtrace_symbols_fd(frames, backtrace(frames, 32), STDERR_FILENO);
+	signal(sig, SIG_DFL);
+	raise(sig);
+}
+
+int main(void) {
+	volatile int *null = NULL;
+	signal(SIGSEGV, crashed);
+	return *null;
+}
+`
+
+// crashCommand runs the segfaulting program, telling the limits of its shell
+// first and its exit code last.
+var crashCommand = []string{"sh", "-c", `echo "core $(ulimit -c)"; echo "stack $(ulimit -s)"; crash; echo "exit $?"`}
+
+// buildCrashImage builds the image of the segfaulting program on the daemon.
+func buildCrashImage(t *testing.T, dockerClient *client.Client) {
+	t.Helper()
+	buildContext, err := pkg.CreateTar(map[string][]byte{
+		"Dockerfile": []byte(crashDockerfile),
+		"crash.c":    []byte(crashProgram),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := dockerClient.ImageBuild(context.Background(), buildContext, client.ImageBuildOptions{
+		Tags:   []string{crashImage},
+		Remove: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to build %s: %v", crashImage, err)
+	}
+	defer result.Body.Close()
+	// the build fails in the stream of its progress, not in the response
+	progress, err := io.ReadAll(result.Body)
+	if err != nil || bytes.Contains(progress, []byte(`"errorDetail"`)) {
+		t.Fatalf("failed to build %s: %v\n%s", crashImage, err, progress)
+	}
+	t.Cleanup(func() {
+		_, _ = dockerClient.ImageRemove(context.Background(), crashImage, client.ImageRemoveOptions{Force: true})
+	})
+}
+
+// TestCrashOutputWithoutCoreDumps runs a segfaulting C program under the
+// ulimits of the runs, on the Docker daemon of the environment:
+//
+//	go test -tags docker -run TestCrashOutputWithoutCoreDumps ./internal/services/
+//
+// The core dumps are disabled, yet the program still prints its backtrace to
+// stderr and its shell still sees it killed by SIGSEGV.
+func TestCrashOutputWithoutCoreDumps(t *testing.T) {
+	dockerClient, err := client.New(client.FromEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dockerClient.Close()
+	if _, err := dockerClient.Ping(context.Background(), client.PingOptions{}); err != nil {
+		t.Skipf("the Docker daemon of the environment isn't reachable: %v", err)
+	}
+	buildCrashImage(t, dockerClient)
+
+	config, _, err := pkg.LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.UlimitCore = 0
+	config.UlimitStack = 8 * 1024 * 1024
+	isolationMode, err := NewSystemService(dockerClient).DetectIsolationMode(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	containersService, err := NewContainersService(dockerClient, config,
+		NewLanguagesService(dockerClient, config, nil), isolationMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	containerID, err := containersService.CreateContainer(ctx,
+		ContainerRequest{RequestID: "crash-test", Image: crashImage, Command: crashCommand})
+	if err != nil {
+		t.Fatalf("CreateContainer() = %v", err)
+	}
+	defer func() { _ = containersService.RemoveContainer(containerID) }()
+	_, stdoutChannel, stderrChannel, err := NewLogsService(dockerClient).AttachIO(ctx, containerID)
+	if err != nil {
+		t.Fatalf("AttachIO() = %v", err)
+	}
+	// waiting for the container before its start, the program exits at once
+	statusChannel, errorChannel := containersService.WaitForContainer(ctx, containerID)
+	if err := containersService.StartContainer(containerID); err != nil {
+		t.Fatalf("StartContainer() = %v", err)
+	}
+
+	var stdout, stderr []string
+	for stdoutChannel != nil || stderrChannel != nil {
+		select {
+		case line, ok := <-stdoutChannel:
+			if !ok {
+				stdoutChannel = nil
+				continue
+			}
+			stdout = append(stdout, line)
+		case line, ok := <-stderrChannel:
+			if !ok {
+				stderrChannel = nil
+				continue
+			}
+			stderr = append(stderr, line)
+		case <-ctx.Done():
+			t.Fatalf("the program hasn't ended: stdout %q, stderr %q", stdout, stderr)
+		}
+	}
+	select {
+	case status := <-statusChannel:
+		if status.StatusCode != 0 {
+			t.Errorf("the shell has exited with %d, want 0", status.StatusCode)
+		}
+	case err := <-errorChannel:
+		t.Fatalf("WaitForContainer() = %v", err)
+	}
+
+	want := []string{"core 0", fmt.Sprintf("stack %d", config.UlimitStack/1024), "exit 139"}
+	if !slices.Equal(stdout, want) {
+		t.Errorf("stdout = %q, want %q", stdout, want)
+	}
+	output := strings.Join(stderr, "\n")
+	if !strings.Contains(output, "caught SIGSEGV") || !strings.Contains(output, "crash(main+") {
+		t.Errorf("stderr = %q, want the backtrace of the crash", output)
+	}
+}
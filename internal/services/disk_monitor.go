@@ -0,0 +1,137 @@
+package services
+
+import (
+	"context"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/metrics"
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/moby/moby/client"
+	"github.com/rs/zerolog/log"
+)
+
+// DiskLevel describes how full the disk backing the Docker storage is.
+type DiskLevel int32
+
+const (
+	// DiskLevelOK means the usage is below the soft threshold.
+	DiskLevelOK DiskLevel = iota
+	// DiskLevelSoft means the usage is above the soft threshold, runs are still accepted.
+	DiskLevelSoft
+	// DiskLevelHard means the usage is above the hard threshold, new runs are rejected.
+	DiskLevelHard
+)
+
+// String returns the human-readable name of the level.
+func (l DiskLevel) String() string {
+	switch l {
+	case DiskLevelSoft:
+		return "soft"
+	case DiskLevelHard:
+		return "hard"
+	default:
+		return "ok"
+	}
+}
+
+// DiskUsageSource reports the used fraction (0..1) of the disk backing the Docker storage.
+type DiskUsageSource interface {
+	UsageRatio() (float64, error)
+}
+
+// StatfsUsageSource reports the disk usage of the filesystem containing the given path.
+type StatfsUsageSource struct {
+	Path string
+}
+
+// UsageRatio returns the used fraction of the filesystem, as seen by unprivileged users.
+func (s StatfsUsageSource) UsageRatio() (float64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(s.Path, &stat); err != nil {
+		return 0, err
+	}
+	if stat.Blocks == 0 {
+		return 0, nil
+	}
+	return 1 - float64(stat.Bavail)/float64(stat.Blocks), nil
+}
+
+// DiskMonitor periodically checks the disk usage and keeps the current level
+// for the admission control.
+type DiskMonitor struct {
+	dockerClient *client.Client
+	appConfig    *pkg.AppConfig
+	source       DiskUsageSource
+
+	level atomic.Int32
+}
+
+// NewDiskMonitor creates a new instance of DiskMonitor reading the usage from the given source.
+func NewDiskMonitor(dockerClient *client.Client, appConfig *pkg.AppConfig, source DiskUsageSource) *DiskMonitor {
+	return &DiskMonitor{dockerClient: dockerClient, appConfig: appConfig, source: source}
+}
+
+// Level returns the disk level observed by the last check.
+func (m *DiskMonitor) Level() DiskLevel {
+	return DiskLevel(m.level.Load())
+}
+
+// Run checks the disk usage on every interval until the context is cancelled.
+func (m *DiskMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.appConfig.DiskCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		m.Check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check reads the current disk usage and updates the level. In-flight runs are
+// never affected, only the admission of the new ones.
+func (m *DiskMonitor) Check(ctx context.Context) {
+	ratio, err := m.source.UsageRatio()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to check the disk usage")
+		return
+	}
+	metrics.DiskUsageRatio.Set(ratio)
+
+	level := DiskLevelOK
+	switch {
+	case ratio >= m.appConfig.DiskHardThreshold:
+		level = DiskLevelHard
+	case ratio >= m.appConfig.DiskSoftThreshold:
+		level = DiskLevelSoft
+	}
+
+	previous := DiskLevel(m.level.Swap(int32(level)))
+	if level != DiskLevelOK {
+		log.Warn().Float64("usage", ratio).Str("level", level.String()).Msg("disk usage is above the threshold")
+	} else if previous != DiskLevelOK {
+		log.Info().Float64("usage", ratio).Msg("disk usage is back below the thresholds")
+	}
+
+	if level == DiskLevelHard && m.appConfig.DiskPruneImages {
+		m.pruneImages(ctx)
+	}
+}
+
+// pruneImages removes dangling images to free up some space.
+func (m *DiskMonitor) pruneImages(ctx context.Context) {
+	options := client.ImagePruneOptions{
+		Filters: make(client.Filters).Add("dangling", "true"),
+	}
+	result, err := m.dockerClient.ImagePrune(ctx, options)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to prune dangling images")
+		return
+	}
+	log.Info().Uint64("spaceReclaimed", result.Report.SpaceReclaimed).Msg("pruned dangling images")
+}
@@ -0,0 +1,77 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Pelfox/codecell-runner/internal/dockertest"
+	"github.com/Pelfox/codecell-runner/pkg"
+)
+
+// fakeUsage is the disk usage source returning the set ratio, or the error.
+type fakeUsage struct {
+	ratio float64
+	err   error
+}
+
+func (u *fakeUsage) UsageRatio() (float64, error) {
+	return u.ratio, u.err
+}
+
+// newTestDiskMonitor returns the disk monitor of a new fake daemon, reading
+// the usage from the returned source, with the thresholds at 80% and 90%.
+func newTestDiskMonitor(t *testing.T, pruneImages bool) (*DiskMonitor, *fakeUsage, *dockertest.Server) {
+	t.Helper()
+	daemon := dockertest.NewServer()
+	t.Cleanup(daemon.Close)
+	dockerClient, err := daemon.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = dockerClient.Close() })
+	config := &pkg.AppConfig{DiskSoftThreshold: 0.8, DiskHardThreshold: 0.9, DiskPruneImages: pruneImages}
+	usage := &fakeUsage{}
+	return NewDiskMonitor(dockerClient, config, usage), usage, daemon
+}
+
+func TestDiskMonitorChecksTheUsageAgainstTheThresholds(t *testing.T) {
+	monitor, usage, daemon := newTestDiskMonitor(t, true)
+	steps := []struct {
+		name   string
+		ratio  float64
+		err    error
+		level  DiskLevel
+		prunes int
+	}{
+		{name: "below the soft threshold", ratio: 0.5, level: DiskLevelOK},
+		{name: "at the soft threshold", ratio: 0.8, level: DiskLevelSoft},
+		{name: "at the hard threshold", ratio: 0.9, level: DiskLevelHard, prunes: 1},
+		{name: "still above the hard threshold", ratio: 0.97, level: DiskLevelHard, prunes: 2},
+		// a failed check keeps the level of the last one
+		{name: "failed check", err: errors.New("statfs failed"), level: DiskLevelHard, prunes: 2},
+		{name: "back below the thresholds", ratio: 0.3, level: DiskLevelOK, prunes: 2},
+	}
+	for _, step := range steps {
+		usage.ratio, usage.err = step.ratio, step.err
+		monitor.Check(context.Background())
+		if level := monitor.Level(); level != step.level {
+			t.Errorf("%s: Level() = %s, want %s", step.name, level, step.level)
+		}
+		if prunes := daemon.Prunes(); prunes != step.prunes {
+			t.Errorf("%s: %d prunes of the dangling images, want %d", step.name, prunes, step.prunes)
+		}
+	}
+}
+
+func TestDiskMonitorPrunesTheImagesOnlyIfConfigured(t *testing.T) {
+	monitor, usage, daemon := newTestDiskMonitor(t, false)
+	usage.ratio = 0.95
+	monitor.Check(context.Background())
+	if level := monitor.Level(); level != DiskLevelHard {
+		t.Errorf("Level() = %s, want hard", level)
+	}
+	if prunes := daemon.Prunes(); prunes != 0 {
+		t.Errorf("%d prunes of the dangling images, want none", prunes)
+	}
+}
@@ -0,0 +1,89 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"syscall"
+
+	"github.com/containerd/errdefs"
+	"github.com/moby/moby/client"
+)
+
+var (
+	// ErrUnsupportedLanguage is returned for the runs of the unknown languages.
+	ErrUnsupportedLanguage = errors.New("the specified language is not supported")
+	// ErrLanguageUnavailable is returned for the runs of the languages whose
+	// images have failed to be prepared.
+	ErrLanguageUnavailable = errors.New("the specified language is unavailable")
+	// ErrImageMissing is returned when the image of a run isn't on the host.
+	ErrImageMissing = errors.New("the image is not available on the host")
+	// ErrBackendUnavailable is returned when the Docker daemon can't be reached.
+	ErrBackendUnavailable = errors.New("the container backend is unavailable")
+	// ErrContainerNotFound is returned for the containers that no longer exist.
+	ErrContainerNotFound = errors.New("the container doesn't exist")
+	// ErrAlreadyStopped is returned by KillContainer for the containers that
+	// have exited or been removed already, which the callers can treat as killed.
+	ErrAlreadyStopped = errors.New("the container is already stopped")
+	// ErrAssetNotFound is returned for the assets the runner doesn't stage.
+	ErrAssetNotFound = errors.New("the asset doesn't exist")
+	// ErrPathNotFound is returned for the paths that don't exist in the container.
+	ErrPathNotFound = errors.New("the path doesn't exist in the container")
+	// ErrArtifactTooLarge is returned when the artifacts extracted from a
+	// container exceed the limits of the extraction.
+	ErrArtifactTooLarge = errors.New("the artifacts exceed the extraction limits")
+	// ErrResourceExceeded is returned when the host lacks the resources to run
+	// the container.
+	ErrResourceExceeded = errors.New("the host resources are exhausted")
+)
+
+// IsDisconnected reports whether the error is the loss of the connection to
+// the daemon, e.g. on its restart, rather than a failure of the call itself,
+// so that the call is worth making again once the daemon is back.
+func IsDisconnected(err error) bool {
+	return errors.Is(err, ErrBackendUnavailable) ||
+		client.IsErrConnectionFailed(err) ||
+		errdefs.IsUnavailable(err) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// isNotRunning reports whether the error of the daemon tells that the
+// container isn't running or doesn't exist. The recent API versions answer
+// with a conflict or a not found error, the older ones with server errors,
+// worded differently across the versions.
+func isNotRunning(err error) bool {
+	if errdefs.IsNotFound(err) || errdefs.IsConflict(err) {
+		return true
+	}
+	message := strings.ToLower(err.Error())
+	return strings.Contains(message, "is not running") ||
+		strings.Contains(message, "container not running") ||
+		strings.Contains(message, "no such container")
+}
+
+// dockerError wraps the error of the Docker daemon into the sentinel of its
+// kind, notFound being the one of the missing objects of the call, if any, so
+// that the callers can tell the failures apart with errors.Is, whatever the
+// wording of the daemon version. The errors of no known kind are returned as is.
+func dockerError(err error, notFound error) error {
+	var kind error
+	switch {
+	case err == nil:
+		return nil
+	case errdefs.IsNotFound(err):
+		kind = notFound
+	case client.IsErrConnectionFailed(err), errdefs.IsUnavailable(err):
+		kind = ErrBackendUnavailable
+	case errdefs.IsResourceExhausted(err):
+		kind = ErrResourceExceeded
+	}
+	if kind == nil {
+		return err
+	}
+	return fmt.Errorf("%w: %w", kind, err)
+}
@@ -0,0 +1,150 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/Pelfox/codecell-runner/internal/dockertest"
+	"github.com/containerd/errdefs"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/client"
+)
+
+func TestIsNotRunning(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "not found", err: fmt.Errorf("kill: %w", errdefs.ErrNotFound), want: true},
+		{name: "conflict", err: fmt.Errorf("kill: %w", errdefs.ErrConflict), want: true},
+		{name: "is not running", err: errors.New("Cannot kill container: abc: Container abc is not running"), want: true},
+		{name: "container not running", err: errors.New("Cannot kill container abc: Container not running"), want: true},
+		{name: "no such container", err: errors.New("Error response from daemon: No such container: abc"), want: true},
+		{name: "other server error", err: fmt.Errorf("kill: %w", errdefs.ErrInternal), want: false},
+		{name: "unavailable", err: fmt.Errorf("kill: %w", errdefs.ErrUnavailable), want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isNotRunning(test.err); got != test.want {
+				t.Errorf("isNotRunning(%q) = %t, want %t", test.err, got, test.want)
+			}
+		})
+	}
+}
+
+// killedContainer creates the container of the daemon and brings it to the
+// state of the test, returning its ID.
+type killedContainer func(t *testing.T, daemon *dockertest.Server, dockerClient *client.Client) string
+
+// createdContainer creates a container of the program, started if asked to.
+func createdContainer(program dockertest.Program, started bool) killedContainer {
+	return func(t *testing.T, daemon *dockertest.Server, dockerClient *client.Client) string {
+		t.Helper()
+		daemon.SetProgram(program)
+		ctx := context.Background()
+		result, err := dockerClient.ContainerCreate(ctx, client.ContainerCreateOptions{
+			Config: &container.Config{Image: testImage},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !started {
+			return result.ID
+		}
+		if _, err := dockerClient.ContainerStart(ctx, result.ID, client.ContainerStartOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		return result.ID
+	}
+}
+
+// runningContainer creates a container running until it's killed.
+var runningContainer = createdContainer(func(process *dockertest.Process) dockertest.Exit {
+	return process.Sleep()
+}, true)
+
+// exitedContainer starts a container and waits for its program to exit.
+func exitedContainer(t *testing.T, daemon *dockertest.Server, dockerClient *client.Client) string {
+	t.Helper()
+	containerID := createdContainer(func(*dockertest.Process) dockertest.Exit {
+		return dockertest.Exit{}
+	}, true)(t, daemon, dockerClient)
+	wait := dockerClient.ContainerWait(context.Background(), containerID, client.ContainerWaitOptions{
+		Condition: container.WaitConditionNotRunning,
+	})
+	select {
+	case <-wait.Result:
+	case err := <-wait.Error:
+		t.Fatal(err)
+	}
+	return containerID
+}
+
+func TestKillContainer(t *testing.T) {
+	missingContainer := func(*testing.T, *dockertest.Server, *client.Client) string { return "missing" }
+	tests := []struct {
+		name       string
+		container  killedContainer
+		statusCode int    // of the injected failure of the kill, none if zero
+		message    string // of the injected failure
+		stopped    bool   // whether ErrAlreadyStopped is returned
+		wantErr    error  // the sentinel of the error, if any
+	}{
+		{name: "running", container: runningContainer},
+		{name: "exited", container: exitedContainer, stopped: true},
+		{name: "never started", container: createdContainer(nil, false), stopped: true},
+		{name: "removed", container: missingContainer, stopped: true},
+		{name: "is not running", container: runningContainer, statusCode: http.StatusInternalServerError,
+			message: "Cannot kill container: abc: Container abc is not running", stopped: true},
+		{name: "container not running", container: runningContainer, statusCode: http.StatusInternalServerError,
+			message: "Cannot kill container abc: Container not running", stopped: true},
+		{name: "no such container", container: runningContainer, statusCode: http.StatusInternalServerError,
+			message: "No such container: abc", stopped: true},
+		{name: "server error", container: runningContainer, statusCode: http.StatusInternalServerError,
+			message: "failed to signal the task"},
+		{name: "unavailable", container: runningContainer, statusCode: http.StatusServiceUnavailable,
+			message: "the daemon is shutting down", wantErr: ErrBackendUnavailable},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			daemon, dockerClient, containersService := newTestContainersService(t)
+			containerID := test.container(t, daemon, dockerClient)
+			if test.statusCode != 0 {
+				daemon.Fail(dockertest.OperationKill, test.statusCode, test.message)
+			}
+			err := containersService.KillContainer(containerID)
+			switch {
+			case test.stopped:
+				if !errors.Is(err, ErrAlreadyStopped) {
+					t.Errorf("KillContainer() = %v, want ErrAlreadyStopped", err)
+				}
+			case test.statusCode == 0:
+				if err != nil {
+					t.Errorf("KillContainer() = %v, want nil", err)
+				}
+			default:
+				if err == nil || errors.Is(err, ErrAlreadyStopped) {
+					t.Errorf("KillContainer() = %v, want a failure", err)
+				}
+				if test.wantErr != nil && !errors.Is(err, test.wantErr) {
+					t.Errorf("KillContainer() = %v, want %v", err, test.wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestKillContainerWithTheDaemonGone(t *testing.T) {
+	daemon, _, containersService := newTestContainersService(t)
+	daemon.Close()
+
+	// the unreachable daemon tells nothing of the container, which mustn't be taken for stopped
+	err := containersService.KillContainer("abc")
+	if errors.Is(err, ErrAlreadyStopped) || !errors.Is(err, ErrBackendUnavailable) {
+		t.Errorf("KillContainer() = %v, want ErrBackendUnavailable", err)
+	}
+}
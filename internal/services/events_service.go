@@ -0,0 +1,101 @@
+package services
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/moby/moby/api/types/events"
+	"github.com/moby/moby/client"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// minEventsBackoff is the initial delay before reconnecting to the event stream.
+	minEventsBackoff = time.Second
+	// maxEventsBackoff is the maximum delay before reconnecting to the event stream.
+	maxEventsBackoff = 30 * time.Second
+)
+
+// ContainerEvent is a lifecycle event of a container managed by the runner.
+type ContainerEvent struct {
+	// ContainerID is the ID of the container the event is about.
+	ContainerID string
+	// RequestID is the ID of the run the container belongs to.
+	RequestID string
+	// Action is the kind of the event: die, oom or destroy.
+	Action events.Action
+	// ExitCode is the exit code of the container, set for die events.
+	ExitCode int64
+}
+
+// EventsService subscribes to the daemon event stream to learn about managed
+// containers dying without the runner asking for it.
+type EventsService struct {
+	dockerClient *client.Client
+}
+
+// NewEventsService creates a new instance of EventsService with the given Docker client.
+func NewEventsService(dockerClient *client.Client) *EventsService {
+	return &EventsService{dockerClient}
+}
+
+// Listen passes every die, oom and destroy event of the managed containers to
+// the handler until the context is cancelled. When the daemon drops the
+// stream, it reconnects with an exponential backoff.
+func (s *EventsService) Listen(ctx context.Context, handler func(ContainerEvent)) {
+	backoff := minEventsBackoff
+	for {
+		received := s.listenOnce(ctx, handler)
+		if ctx.Err() != nil {
+			return
+		}
+		if received {
+			backoff = minEventsBackoff // the connection was healthy for a while
+		}
+
+		log.Warn().Dur("backoff", backoff).Msg("docker event stream dropped, reconnecting")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxEventsBackoff)
+	}
+}
+
+// listenOnce consumes the event stream until it fails. It reports whether any
+// event has been received.
+func (s *EventsService) listenOnce(ctx context.Context, handler func(ContainerEvent)) bool {
+	options := client.EventsListOptions{
+		Filters: make(client.Filters).
+			Add("type", string(events.ContainerEventType)).
+			Add("label", "codecell.runner=true").
+			Add("event", string(events.ActionDie), string(events.ActionOOM), string(events.ActionDestroy)),
+	}
+	result := s.dockerClient.Events(ctx, options)
+
+	received := false
+	for {
+		select {
+		case message := <-result.Messages:
+			received = true
+			event := ContainerEvent{
+				ContainerID: message.Actor.ID,
+				RequestID:   message.Actor.Attributes["codecell.requestId"],
+				Action:      message.Action,
+			}
+			// die events carry the exit code along with the container labels
+			if exitCode, err := strconv.ParseInt(message.Actor.Attributes["exitCode"], 10, 64); err == nil {
+				event.ExitCode = exitCode
+			}
+			handler(event)
+
+		case err := <-result.Err:
+			if err != nil && ctx.Err() == nil {
+				log.Error().Err(err).Msg("docker event stream failed")
+			}
+			return received
+		}
+	}
+}
@@ -0,0 +1,485 @@
+package services
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/executor"
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/containerd/errdefs"
+	"github.com/distribution/reference"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/api/types/events"
+	"github.com/moby/moby/client"
+	"github.com/rs/zerolog/log"
+)
+
+// imagesMapping maps supported programming languages to their corresponding executor technologies.
+// The technologies added here must pass TestTechnologiesConform of the executor package.
+var imagesMapping = map[string]executor.Technology{
+	"dotnet":  executor.DotNetTechnology{},
+	"elixir":  executor.ElixirTechnology{},
+	"haskell": executor.HaskellTechnology{},
+	"julia":   executor.JuliaTechnology{},
+	"perl":    executor.PerlTechnology{},
+	"scala":   executor.ScalaTechnology{},
+	"sqlite":  executor.SqliteTechnology{},
+	"swift":   executor.SwiftTechnology{},
+	"zig":     executor.ZigTechnology{},
+}
+
+// languageAliases maps the other names of the languages to the ones of
+// imagesMapping, which the runs, the limits and the metrics go by.
+var languageAliases = map[string]string{
+	"sql": "sqlite",
+}
+
+// errLanguageDisabled is the reason of the languages disabled in the configuration.
+var errLanguageDisabled = errors.New("language is disabled by the configuration")
+
+// imageOverride is the technology of a language whose image is replaced in
+// the configuration.
+type imageOverride struct {
+	executor.Technology
+	image string
+}
+
+func (t imageOverride) GetImage() string {
+	return t.image
+}
+
+// SignatureState describes the outcome of the image signature verification.
+type SignatureState int
+
+const (
+	// SignatureNotChecked means no verification policy is configured.
+	SignatureNotChecked SignatureState = iota
+	// SignatureVerified means the image signature matches the policy.
+	SignatureVerified
+	// SignatureInvalid means the image is unsigned or its signature doesn't match the policy.
+	SignatureInvalid
+)
+
+// LanguageStatus describes whether a language can currently be used for runs.
+type LanguageStatus struct {
+	// Err is the reason the language is unavailable, or nil if it's usable.
+	Err error
+	// Digest is the digest reference of the verified image.
+	Digest string
+	// Signature is the result of the image signature verification.
+	Signature SignatureState
+	// UID is the numeric ID of the technology user inside the image.
+	UID int
+	// GID is the numeric group ID of the technology user inside the image.
+	GID int
+
+	imageID string // of the verified image, which the events of its removal name
+}
+
+// LanguagesService keeps track of the supported languages and their availability.
+type LanguagesService struct {
+	dockerClient      *client.Client
+	appConfig         *pkg.AppConfig
+	signatureVerifier *SignatureVerifier // nil if signatures aren't verified
+
+	mutex      sync.RWMutex
+	statuses   map[string]LanguageStatus
+	canaryErrs map[string]error
+}
+
+// NewLanguagesService creates a new instance of LanguagesService with the given
+// Docker client and an optional signature verifier, the languages being set up
+// according to their blocks of the configuration.
+func NewLanguagesService(
+	dockerClient *client.Client,
+	appConfig *pkg.AppConfig,
+	signatureVerifier *SignatureVerifier,
+) *LanguagesService {
+	return &LanguagesService{
+		dockerClient:      dockerClient,
+		appConfig:         appConfig,
+		signatureVerifier: signatureVerifier,
+		mutex:             sync.RWMutex{},
+		statuses:          make(map[string]LanguageStatus),
+		canaryErrs:        make(map[string]error),
+	}
+}
+
+// Resolve returns the name of the language the given name is an alias of, or
+// the name as it is.
+func (s *LanguagesService) Resolve(language string) string {
+	if resolved, ok := languageAliases[language]; ok {
+		return resolved
+	}
+	return language
+}
+
+// Languages returns the sorted names of all supported languages.
+func (s *LanguagesService) Languages() []string {
+	languages := make([]string, 0, len(imagesMapping))
+	for language := range imagesMapping {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+	return languages
+}
+
+// Technology returns the executor technology of the given language, with the
+// image of the configuration, if any.
+func (s *LanguagesService) Technology(language string) (executor.Technology, bool) {
+	technology, ok := imagesMapping[language]
+	if image := s.appConfig.Languages[language].Image; ok && image != "" {
+		technology = imageOverride{Technology: technology, image: image}
+	}
+	return technology, ok
+}
+
+// MemoryLimitSource tells where the memory limit of the runs of a language
+// comes from.
+type MemoryLimitSource string
+
+const (
+	// MemoryLimitDefault is the global memory limit of the server.
+	MemoryLimitDefault MemoryLimitSource = "default"
+	// MemoryLimitLanguage is the limit of the block of the language.
+	MemoryLimitLanguage MemoryLimitSource = "language"
+	// MemoryLimitTechnology is the global limit raised to the memory hint of
+	// the technology of the language.
+	MemoryLimitTechnology MemoryLimitSource = "technology"
+)
+
+// Config returns the effective settings of the runs of the given language,
+// its block of the configuration merged over the global settings, the dynamic
+// ones taken from the given snapshot, as well as where its memory limit comes
+// from. The memory and process hints of the technology raise the global
+// limits, up to their maxima, unless the block sets its own, and the
+// concurrency limit of the technology applies unless the block sets one.
+func (s *LanguagesService) Config(language string, dynamic *pkg.DynamicConfig) (pkg.LanguageConfig, MemoryLimitSource) {
+	config := s.appConfig.LanguageConfig(language, dynamic)
+	block := dynamic.Languages[language]
+	source := MemoryLimitDefault
+	if block.MemoryLimit != 0 {
+		source = MemoryLimitLanguage
+	}
+	technology, ok := imagesMapping[language]
+	if !ok {
+		return config, source
+	}
+	if block.MemoryLimit == 0 {
+		limit := raiseLimit(config.MemoryLimit, technology.GetMemoryHint(), s.appConfig.MaxMemoryLimit)
+		if limit != config.MemoryLimit {
+			config.MemoryLimit = limit
+			source = MemoryLimitTechnology
+		}
+	}
+	if block.PidsLimit == 0 {
+		config.PidsLimit = raiseLimit(config.PidsLimit, technology.GetPidsHint(), s.appConfig.MaxPidsLimit)
+	}
+	if block.Concurrency == 0 {
+		config.Concurrency = technology.GetConcurrencyLimit()
+	}
+	return config, source
+}
+
+// raiseLimit raises the limit to the hint, up to the maximum (0 if none). The
+// unlimited limit of 0 stays unlimited.
+func raiseLimit(limit int64, hint int64, maximum int64) int64 {
+	if limit == 0 {
+		return 0
+	}
+	if maximum > 0 {
+		hint = min(hint, maximum)
+	}
+	return max(limit, hint)
+}
+
+// Status returns the last known status of the given language. Languages that
+// weren't verified yet are reported as available, those that have failed the
+// startup canary as unavailable.
+func (s *LanguagesService) Status(language string) LanguageStatus {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	status := s.statuses[language]
+	if status.Err == nil {
+		status.Err = s.canaryErrs[language]
+	}
+	return status
+}
+
+// Availability returns nil if the given language can be used for runs,
+// ErrUnsupportedLanguage for the unknown ones and ErrLanguageUnavailable
+// wrapping the reason for the unavailable ones.
+func (s *LanguagesService) Availability(language string) error {
+	if _, ok := imagesMapping[language]; !ok {
+		return ErrUnsupportedLanguage
+	}
+	if status := s.Status(language); status.Err != nil {
+		return fmt.Errorf("%w: %w", ErrLanguageUnavailable, status.Err)
+	}
+	return nil
+}
+
+// SetCanaryResult records the outcome of the startup canary of the given
+// language, which is unavailable if it has failed.
+func (s *LanguagesService) SetCanaryResult(language string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.canaryErrs[language] = err
+}
+
+// Watch keeps the statuses of the languages up to date until the context is
+// cancelled, verifying the image of a language again whenever the daemon
+// reports it pulled, tagged or removed, and all of them at the given interval,
+// in case the event stream has missed one. The interval of 0 disables the periodic checks.
+func (s *LanguagesService) Watch(ctx context.Context, interval time.Duration) {
+	var ticks <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	for {
+		options := client.EventsListOptions{
+			Filters: make(client.Filters).
+				Add("type", string(events.ImageEventType)).
+				Add("event", string(events.ActionPull), string(events.ActionTag), string(events.ActionUnTag),
+					string(events.ActionDelete), string(events.ActionLoad), string(events.ActionImport)),
+		}
+		result := s.dockerClient.Events(ctx, options)
+
+	listen:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case message := <-result.Messages:
+				for _, language := range s.affectedLanguages(message) {
+					s.verifyLanguage(ctx, language)
+				}
+			case <-ticks:
+				s.VerifyImages(ctx)
+			case err := <-result.Err:
+				if err != nil && ctx.Err() == nil {
+					log.Warn().Err(err).Msg("docker image event stream failed, reconnecting")
+				}
+				break listen
+			}
+		}
+
+		// resubscribing after a while, the daemon may be down, the images are
+		// checked again in case an event has been missed meanwhile
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(maxEventsBackoff):
+			s.VerifyImages(ctx)
+		}
+	}
+}
+
+// VerifyImages checks the images of all technologies and updates the status of
+// their languages. It's run at startup and kept running by Watch, the changes
+// of the availability being logged. It returns the number of languages that
+// failed the signature verification.
+func (s *LanguagesService) VerifyImages(ctx context.Context) int {
+	unverified := 0
+	for language := range imagesMapping {
+		if s.verifyLanguage(ctx, language).Signature == SignatureInvalid {
+			unverified++
+		}
+	}
+	return unverified
+}
+
+// verifyLanguage checks the image of the language and updates its status,
+// logging the changes of its availability.
+func (s *LanguagesService) verifyLanguage(ctx context.Context, language string) LanguageStatus {
+	if s.appConfig.Languages[language].Disabled {
+		status := LanguageStatus{Err: errLanguageDisabled}
+		s.mutex.Lock()
+		s.statuses[language] = status
+		s.mutex.Unlock()
+		return status
+	}
+
+	technology, _ := s.Technology(language)
+	status := s.verifyImage(ctx, technology)
+
+	s.mutex.Lock()
+	previous, verified := s.statuses[language]
+	s.statuses[language] = status
+	s.mutex.Unlock()
+
+	// logging the transitions only, the languages are checked periodically
+	switch {
+	case status.Err != nil && (previous.Err == nil || status.Err.Error() != previous.Err.Error()):
+		log.Error().Str("language", language).
+			Str("image", technology.GetImage()).
+			Err(status.Err).
+			Msg("language is unavailable")
+	case status.Err == nil && verified && previous.Err != nil:
+		log.Info().Str("language", language).
+			Str("image", technology.GetImage()).
+			Msg("language is available again")
+	}
+	return status
+}
+
+// affectedLanguages returns the languages whose image the event is about, by
+// the reference it names, or by the ID of the verified image for the removals
+// the daemon reports by ID only. The events of the other images are ignored.
+func (s *LanguagesService) affectedLanguages(message events.Message) []string {
+	names := []string{message.Actor.ID, message.Actor.Attributes["name"]}
+	var affected []string
+	for _, language := range s.Languages() {
+		technology, _ := s.Technology(language)
+		image := normalizedImage(technology.GetImage())
+		s.mutex.RLock()
+		status := s.statuses[language]
+		s.mutex.RUnlock()
+
+		for _, name := range names {
+			if name == "" {
+				continue
+			}
+			if normalized := normalizedImage(name); normalized == image ||
+				status.Digest != "" && normalized == normalizedImage(status.Digest) ||
+				status.imageID != "" && name == status.imageID {
+				affected = append(affected, language)
+				break
+			}
+		}
+	}
+	return affected
+}
+
+// normalizedImage returns the fully qualified reference of the image, with
+// the default tag if it has none, or the image as it is if it isn't one.
+func normalizedImage(image string) string {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return image
+	}
+	return reference.TagNameOnly(named).String()
+}
+
+// verifyImage makes sure the technology image exists, is signed according to
+// the policy (if any), and contains the technology user, which is not root.
+func (s *LanguagesService) verifyImage(ctx context.Context, technology executor.Technology) LanguageStatus {
+	image := technology.GetImage()
+	inspect, err := s.dockerClient.ImageInspect(ctx, image)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return LanguageStatus{Err: fmt.Errorf("%w: %s", ErrImageMissing, image)}
+		}
+		return LanguageStatus{Err: err}
+	}
+
+	status := LanguageStatus{imageID: inspect.ID}
+	if len(inspect.RepoDigests) > 0 {
+		status.Digest = inspect.RepoDigests[0]
+	}
+	if s.signatureVerifier != nil {
+		// signatures are attached to digests in the registry, so locally built images can't pass
+		if status.Digest == "" {
+			status.Signature = SignatureInvalid
+			status.Err = fmt.Errorf("image %s has no registry digest to verify the signature of", image)
+			return status
+		}
+		if err := s.signatureVerifier.Verify(ctx, status.Digest); err != nil {
+			status.Signature = SignatureInvalid
+			status.Err = fmt.Errorf("image %s: %w", status.Digest, err)
+			return status
+		}
+		status.Signature = SignatureVerified
+	}
+
+	passwd, err := s.readImageFile(ctx, image, "/etc/passwd")
+	if err != nil {
+		status.Err = fmt.Errorf("failed to read /etc/passwd of image %s: %w", image, err)
+		return status
+	}
+
+	status.UID, status.GID, err = lookupUser(passwd, technology.GetUser())
+	if err != nil {
+		status.Err = fmt.Errorf("image %s: %w", image, err)
+		return status
+	}
+	if status.UID == 0 {
+		status.Err = fmt.Errorf("image %s: user %q is root", image, technology.GetUser())
+	}
+	return status
+}
+
+// readImageFile reads a single file from the image by copying it out of a
+// throwaway container, which is never started.
+func (s *LanguagesService) readImageFile(ctx context.Context, image string, path string) ([]byte, error) {
+	options := client.ContainerCreateOptions{
+		Config: &container.Config{
+			Labels: map[string]string{
+				"codecell.runner": "true",
+				"codecell.probe":  "true",
+			},
+			NetworkDisabled: true,
+		},
+		HostConfig: &container.HostConfig{
+			NetworkMode: "none",
+		},
+		Image: image,
+	}
+	result, err := s.dockerClient.ContainerCreate(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_, _ = s.dockerClient.ContainerRemove(context.Background(), result.ID, client.ContainerRemoveOptions{Force: true})
+	}()
+
+	content, err := s.dockerClient.CopyFromContainer(ctx, result.ID, client.CopyFromContainerOptions{SourcePath: path})
+	if err != nil {
+		return nil, err
+	}
+	defer content.Content.Close()
+
+	tarReader := tar.NewReader(content.Content)
+	if _, err := tarReader.Next(); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(io.LimitReader(tarReader, 1024*1024))
+}
+
+// lookupUser finds the numeric user and group IDs of the given user in the
+// contents of a passwd file.
+func lookupUser(passwd []byte, user string) (int, int, error) {
+	if user == "" {
+		return 0, 0, errors.New("technology doesn't declare a user")
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(string(passwd)))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 4 || fields[0] != user {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid uid of user %q", user)
+		}
+		gid, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid gid of user %q", user)
+		}
+		return uid, gid, nil
+	}
+	return 0, 0, fmt.Errorf("user %q doesn't exist", user)
+}
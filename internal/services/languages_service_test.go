@@ -0,0 +1,148 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/dockertest"
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/moby/moby/api/types/events"
+)
+
+func TestLanguagesServiceConfigTellsTheSourceOfTheMemoryLimit(t *testing.T) {
+	const mebibyte = 1 << 20
+	tests := []struct {
+		name      string
+		language  string
+		configure func(config *pkg.AppConfig)
+		limit     int64
+		source    MemoryLimitSource
+	}{
+		{name: "default", language: "perl", limit: 512 * mebibyte, source: MemoryLimitDefault},
+		{name: "technology hint", language: "scala", limit: 1536 * mebibyte, source: MemoryLimitTechnology},
+		{name: "language block", language: "perl", configure: func(config *pkg.AppConfig) {
+			config.Languages = map[string]pkg.LanguageConfig{"perl": {MemoryLimit: 1024 * mebibyte}}
+		}, limit: 1024 * mebibyte, source: MemoryLimitLanguage},
+		{name: "language block under the hint", language: "scala", configure: func(config *pkg.AppConfig) {
+			config.Languages = map[string]pkg.LanguageConfig{"scala": {MemoryLimit: 256 * mebibyte}}
+		}, limit: 256 * mebibyte, source: MemoryLimitLanguage},
+		{name: "language block equal to the default", language: "perl", configure: func(config *pkg.AppConfig) {
+			config.Languages = map[string]pkg.LanguageConfig{"perl": {MemoryLimit: 512 * mebibyte}}
+		}, limit: 512 * mebibyte, source: MemoryLimitLanguage},
+		{name: "hint capped to the default", language: "scala", configure: func(config *pkg.AppConfig) {
+			config.MaxMemoryLimit = 512 * mebibyte
+		}, limit: 512 * mebibyte, source: MemoryLimitDefault},
+		{name: "hint capped above the default", language: "scala", configure: func(config *pkg.AppConfig) {
+			config.MaxMemoryLimit = 1024 * mebibyte
+		}, limit: 1024 * mebibyte, source: MemoryLimitTechnology},
+		{name: "unlimited", language: "scala", configure: func(config *pkg.AppConfig) {
+			config.MemoryLimit = 0
+		}, limit: 0, source: MemoryLimitDefault},
+		{name: "unknown language", language: "cobol", limit: 512 * mebibyte, source: MemoryLimitDefault},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, _, err := pkg.LoadConfig("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.configure != nil {
+				test.configure(config)
+			}
+			languagesService := NewLanguagesService(nil, config, nil)
+
+			languageConfig, source := languagesService.Config(test.language, &config.DynamicConfig)
+			if languageConfig.MemoryLimit != test.limit || source != test.source {
+				t.Errorf("Config(%q) has the memory limit %d of the %s, want %d of the %s",
+					test.language, languageConfig.MemoryLimit, source, test.limit, test.source)
+			}
+		})
+	}
+}
+
+func TestLanguagesServiceConfigOverridesTheConcurrencyOfTheTechnology(t *testing.T) {
+	config, _, err := pkg.LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Languages = map[string]pkg.LanguageConfig{"perl": {Concurrency: 3}, "dotnet": {Concurrency: 1}}
+	languagesService := NewLanguagesService(nil, config, nil)
+
+	for language, want := range map[string]int{"perl": 3, "dotnet": 1, "scala": 4, "zig": 0} {
+		if languageConfig, _ := languagesService.Config(language, &config.DynamicConfig); languageConfig.Concurrency != want {
+			t.Errorf("Config(%q) has the concurrency %d, want %d", language, languageConfig.Concurrency, want)
+		}
+	}
+}
+
+// awaitDigest waits until the language has the verified image of the digest.
+func awaitDigest(t *testing.T, languagesService *LanguagesService, language string, digest string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for languagesService.Status(language).Digest != digest {
+		if time.Now().After(deadline) {
+			t.Fatalf("the digest of %s is %s, want %s", language, languagesService.Status(language).Digest, digest)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWatchVerifiesTheImagesOfTheEventsOnly(t *testing.T) {
+	daemon := dockertest.NewServer()
+	t.Cleanup(daemon.Close)
+	digest := func(image string, n int) string {
+		return image + "@sha256:" + strings.Repeat(string(rune('0'+n)), 64)
+	}
+	daemon.AddImage("codecell/perl", digest("codecell/perl", 1))
+	daemon.AddImage("codecell/zig", digest("codecell/zig", 1))
+	dockerClient, err := daemon.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = dockerClient.Close() })
+	config, _, err := pkg.LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	languagesService := NewLanguagesService(dockerClient, config, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	languagesService.VerifyImages(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		languagesService.Watch(ctx, 0)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for daemon.EventStreams() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Watch() hasn't subscribed to the events")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// both tags move, but the daemon reports the one of perl only
+	daemon.AddImage("codecell/perl", digest("codecell/perl", 2))
+	daemon.AddImage("codecell/zig", digest("codecell/zig", 2))
+	daemon.PublishEvent(events.Message{Type: events.ImageEventType, Action: events.ActionTag,
+		Actor: events.Actor{ID: "sha256:" + strings.Repeat("a", 64), Attributes: map[string]string{"name": "codecell/perl:latest"}}})
+	daemon.PublishEvent(events.Message{Type: events.ImageEventType, Action: events.ActionPull,
+		Actor: events.Actor{ID: "postgres:16", Attributes: map[string]string{"name": "postgres:16"}}})
+	awaitDigest(t, languagesService, "perl", digest("codecell/perl", 2))
+	// the removals are reported by the image ID
+	daemon.AddImage("codecell/perl", digest("codecell/perl", 3))
+	daemon.PublishEvent(events.Message{Type: events.ImageEventType, Action: events.ActionDelete,
+		Actor: events.Actor{ID: languagesService.Status("perl").imageID}})
+
+	// the events are handled in order, the previous ones are done once perl has the last digest
+	awaitDigest(t, languagesService, "perl", digest("codecell/perl", 3))
+	if got := languagesService.Status("zig").Digest; got != digest("codecell/zig", 1) {
+		t.Errorf("the digest of zig is %s, want it unchanged by the events of perl", got)
+	}
+}
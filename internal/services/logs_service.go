@@ -2,24 +2,114 @@ package services
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"errors"
+	"hash/fnv"
 	"io"
 	"sync"
+	"time"
 
 	"github.com/moby/moby/api/pkg/stdcopy"
 	"github.com/moby/moby/client"
+	"github.com/rs/zerolog"
 )
 
-// scanLines reads lines from the given reader and sends them to the output channel.
-func scanLines(r io.Reader, out chan<- string) {
+const (
+	// maxReattachAttempts is the number of times the output is attached to
+	// again after its stream has dropped while the container runs.
+	maxReattachAttempts = 3
+	// maxBackfillBytes bounds the container logs read to fill the gaps of the
+	// output, the larger logs are left as they are.
+	maxBackfillBytes = 16 << 20
+	// maxLineSize is the size of the longest line of the output.
+	maxLineSize = 1024 * 1024
+)
+
+// errLogsTooLarge is returned for the container logs over maxBackfillBytes.
+var errLogsTooLarge = errors.New("the container logs are too large to be read back")
+
+// newLineScanner returns the scanner of the lines of the output.
+func newLineScanner(r io.Reader) *bufio.Scanner {
 	scanner := bufio.NewScanner(r)
-	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024) // setting buffer size to 1MB
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize) // setting buffer size to 1MB
+	return scanner
+}
 
+// scanLines reads lines from the given reader and sends them to the output
+// channel, recording them in the tracker.
+func scanLines(r io.Reader, out chan<- string, tracker *lineTracker) {
+	scanner := newLineScanner(r)
 	for scanner.Scan() {
+		tracker.add(scanner.Text())
 		out <- scanner.Text()
 	}
 }
 
+// lineTracker remembers the hashes of the lines delivered from a stream of the
+// output, in order, so that only the missing ones are delivered from the logs.
+type lineTracker struct {
+	hashes []uint64
+}
+
+// hashLine returns the hash of the line.
+func hashLine(line string) uint64 {
+	hash := fnv.New64a()
+	_, _ = io.WriteString(hash, line)
+	return hash.Sum64()
+}
+
+func (t *lineTracker) add(line string) {
+	t.hashes = append(t.hashes, hashLine(line))
+}
+
+// backfill returns the lines of the history the stream hasn't delivered, in
+// order, remembering them as delivered. The delivered lines must appear in the
+// history in the same order, the attach only ever missing some; otherwise the
+// history doesn't tell the missing lines, and none are returned.
+func (t *lineTracker) backfill(history []string) []string {
+	hashes := make([]uint64, len(history))
+	var missing []string
+	delivered := 0
+	for index, line := range history {
+		hashes[index] = hashLine(line)
+		if delivered < len(t.hashes) && t.hashes[delivered] == hashes[index] {
+			delivered++
+			continue
+		}
+		missing = append(missing, line)
+	}
+	if delivered < len(t.hashes) {
+		return nil
+	}
+	t.hashes = hashes
+	return missing
+}
+
+// errStdinNotClosable is returned when the end of the input can't be signalled.
+var errStdinNotClosable = errors.New("the container stdin can't be closed on this connection")
+
+// Stdin writes the standard input of an attached container. Closing it signals
+// the end of the input to the program, if the connection to the daemon allows.
+type Stdin struct {
+	io.Writer
+	close func() error // nil if the end of the input can't be signalled
+}
+
+// Close signals the end of the input to the program.
+func (s *Stdin) Close() error {
+	if s.close == nil {
+		return errStdinNotClosable
+	}
+	return s.close()
+}
+
+// CanClose reports whether Close signals the end of the input, so that the
+// programs reading it to the end don't wait until the time limit.
+func (s *Stdin) CanClose() bool {
+	return s.close != nil
+}
+
 // LogsService provides methods to stream logs from Docker containers.
 type LogsService struct {
 	dockerClient *client.Client
@@ -32,11 +122,23 @@ func NewLogsService(dockerClient *client.Client) *LogsService {
 
 // AttachIO streams the stdout and stderr logs of the specified container, as well
 // as opens the STDIN writer.
+//
+// The end of the input is signalled by closing the write side of the attach
+// connection. The connections that can't be half-closed, e.g. TLS-wrapped ones
+// of the remote daemons, get a dedicated attach of the input only, ending the
+// input once closed, as the containers close their stdin once an attach does.
+// If even that fails, the STDIN writer can't be closed.
+//
+// The attach may miss lines: those printed before it's fully set up, by the
+// fast programs on a loaded daemon, and those printed while its stream is
+// attached again after dropping. The gaps are filled from the container logs,
+// once the stream is attached again and once it has ended, delivering only the
+// lines the channels haven't.
 func (s *LogsService) AttachIO(
 	ctx context.Context,
 	containerID string,
 ) (
-	stdin io.WriteCloser,
+	stdin *Stdin,
 	stdout <-chan string,
 	stderr <-chan string,
 	err error,
@@ -56,44 +158,168 @@ func (s *LogsService) AttachIO(
 		},
 	)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, dockerError(err, ErrContainerNotFound)
 	}
 
 	// reading STDIN from the hijacked connection to the container
-	stdin = resp.Conn
+	stdin = s.attachStdin(ctx, containerID, resp)
 
 	go func() {
 		defer close(outCh)
 		defer close(errCh)
-		defer resp.Close()
-
-		stdoutR, stdoutW := io.Pipe()
-		stderrR, stderrW := io.Pipe()
-
-		var wg sync.WaitGroup
-		wg.Add(2)
-
-		// STDOUT scanner
-		go func() {
-			defer wg.Done()
-			scanLines(stdoutR, outCh)
-		}()
-
-		// STDERR scanner
-		go func() {
-			defer wg.Done()
-			scanLines(stderrR, errCh)
-		}()
-
-		// Demultiplex Docker stream
-		go func() {
-			defer stdoutW.Close()
-			defer stderrW.Close()
-			_, _ = stdcopy.StdCopy(stdoutW, stderrW, resp.Reader)
-		}()
-
-		wg.Wait()
+
+		logger := zerolog.Ctx(ctx)
+		var stdoutLines, stderrLines lineTracker
+		backfill := func(until time.Time) {
+			if ctx.Err() != nil {
+				return // the run is over, nobody reads the lines any more
+			}
+			stdoutHistory, stderrHistory, err := s.ReadLogs(ctx, containerID, until)
+			if err != nil {
+				logger.Warn().Err(err).Msg("failed to read the container logs to fill the gaps of the output")
+				return
+			}
+			missingStdout, missingStderr := stdoutLines.backfill(stdoutHistory), stderrLines.backfill(stderrHistory)
+			if len(missingStdout)+len(missingStderr) > 0 {
+				logger.Warn().Int("stdoutLines", len(missingStdout)).Int("stderrLines", len(missingStderr)).
+					Msg("delivered the output lines the attach has missed from the container logs")
+			}
+			for _, line := range missingStdout {
+				outCh <- line
+			}
+			for _, line := range missingStderr {
+				errCh <- line
+			}
+		}
+
+		relayOutput(resp, outCh, errCh, &stdoutLines, &stderrLines)
+		for attempt := 0; attempt < maxReattachAttempts && ctx.Err() == nil && s.isRunning(ctx, containerID); attempt++ {
+			// the logs until the new stream starts cover the lines printed meanwhile
+			reattachedAt := time.Now()
+			resp, err := s.dockerClient.ContainerAttach(ctx, containerID, client.ContainerAttachOptions{
+				Stream: true,
+				Stdout: true,
+				Stderr: true,
+			})
+			if err != nil {
+				logger.Warn().Err(err).Msg("failed to attach to the container output again")
+				break
+			}
+			logger.Warn().Int("attempt", attempt+1).Msg("attached to the container output again after its stream dropped")
+			backfill(reattachedAt)
+			relayOutput(resp, outCh, errCh, &stdoutLines, &stderrLines)
+		}
+		backfill(time.Time{})
 	}()
 
 	return stdin, outCh, errCh, nil
 }
+
+// attachStdin returns the STDIN writer of the attach, closing the write side
+// of its connection, or of a dedicated attach if it can't be half-closed.
+func (s *LogsService) attachStdin(ctx context.Context, containerID string, resp client.ContainerAttachResult) *Stdin {
+	if closer, ok := resp.Conn.(client.CloseWriter); ok {
+		return &Stdin{Writer: resp.Conn, close: closer.CloseWrite}
+	}
+
+	logger := zerolog.Ctx(ctx)
+	dedicated, err := s.dockerClient.ContainerAttach(ctx, containerID, client.ContainerAttachOptions{
+		Stream: true,
+		Stdin:  true,
+	})
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to attach to the container stdin, its end can't be signalled")
+		return &Stdin{Writer: resp.Conn}
+	}
+	logger.Debug().Msg("the attach connection can't be half-closed, writing the stdin on a dedicated one")
+	// the input isn't read once the run is over
+	stop := context.AfterFunc(ctx, func() { _ = dedicated.Conn.Close() })
+	return &Stdin{
+		Writer: dedicated.Conn,
+		close: func() error {
+			stop()
+			return dedicated.Conn.Close()
+		},
+	}
+}
+
+// relayOutput sends the lines of the attached stream to the channels until it
+// ends, closing it.
+func relayOutput(
+	resp client.ContainerAttachResult,
+	outCh chan<- string,
+	errCh chan<- string,
+	stdoutLines *lineTracker,
+	stderrLines *lineTracker,
+) {
+	defer resp.Close()
+
+	stdoutR, stdoutW := io.Pipe()
+	stderrR, stderrW := io.Pipe()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	// STDOUT scanner
+	go func() {
+		defer wg.Done()
+		scanLines(stdoutR, outCh, stdoutLines)
+	}()
+
+	// STDERR scanner
+	go func() {
+		defer wg.Done()
+		scanLines(stderrR, errCh, stderrLines)
+	}()
+
+	// Demultiplex Docker stream
+	go func() {
+		defer stdoutW.Close()
+		defer stderrW.Close()
+		_, _ = stdcopy.StdCopy(stdoutW, stderrW, resp.Reader)
+	}()
+
+	wg.Wait()
+}
+
+// isRunning reports whether the container is still running.
+func (s *LogsService) isRunning(ctx context.Context, containerID string) bool {
+	result, err := s.dockerClient.ContainerInspect(ctx, containerID, client.ContainerInspectOptions{})
+	return err == nil && result.Container.State != nil && result.Container.State.Running
+}
+
+// ReadLogs returns the lines the container has printed on stdout and stderr
+// from its start, until the given time if it isn't zero, as recorded by its
+// log driver. It's the history of the output of a run, e.g. for the watchers
+// that missed it.
+func (s *LogsService) ReadLogs(ctx context.Context, containerID string, until time.Time) ([]string, []string, error) {
+	options := client.ContainerLogsOptions{ShowStdout: true, ShowStderr: true}
+	if !until.IsZero() {
+		options.Until = until.UTC().Format(time.RFC3339Nano)
+	}
+	logs, err := s.dockerClient.ContainerLogs(ctx, containerID, options)
+	if err != nil {
+		return nil, nil, dockerError(err, ErrContainerNotFound)
+	}
+	defer logs.Close()
+
+	var stdoutBuffer, stderrBuffer bytes.Buffer
+	limited := &io.LimitedReader{R: logs, N: maxBackfillBytes + 1}
+	if _, err := stdcopy.StdCopy(&stdoutBuffer, &stderrBuffer, limited); err != nil {
+		return nil, nil, err
+	}
+	if limited.N <= 0 {
+		return nil, nil, errLogsTooLarge
+	}
+	return splitLines(&stdoutBuffer), splitLines(&stderrBuffer), nil
+}
+
+// splitLines returns the lines of the reader, as they're scanned from the stream.
+func splitLines(r io.Reader) []string {
+	var lines []string
+	scanner := newLineScanner(r)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
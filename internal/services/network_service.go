@@ -0,0 +1,296 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"net/url"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/containerd/errdefs"
+	"github.com/moby/moby/client"
+	"github.com/rs/zerolog/log"
+)
+
+// egressChain is the iptables chain holding the egress allowlist of the managed network.
+const egressChain = "CODECELL-EGRESS"
+
+// NetworkService manages the dedicated bridge network used by network-enabled runs.
+type NetworkService struct {
+	dockerClient *client.Client
+	appConfig    *pkg.AppConfig
+	lookupIP     func(ctx context.Context, host string) ([]net.IP, error)
+
+	// the destinations of the rules installed, set up by EnsureNetwork and
+	// updated by Watch from then on
+	allowed map[string]bool
+}
+
+// NewNetworkService creates a new instance of NetworkService with the given Docker client.
+func NewNetworkService(dockerClient *client.Client, appConfig *pkg.AppConfig) *NetworkService {
+	return &NetworkService{
+		dockerClient: dockerClient,
+		appConfig:    appConfig,
+		lookupIP: func(ctx context.Context, host string) ([]net.IP, error) {
+			return net.DefaultResolver.LookupIP(ctx, "ip", host)
+		},
+		allowed: make(map[string]bool),
+	}
+}
+
+// EnsureNetwork creates the managed bridge network if it doesn't exist yet and
+// (re)installs the iptables rules restricting its egress to the allowlist. When
+// an egress proxy is configured, the network is internal-only instead, so the
+// proxy (attached to the same network) is the only way out. The network has no
+// IPv6, which the rules don't filter.
+func (s *NetworkService) EnsureNetwork(ctx context.Context) error {
+	if _, err := ParseDNSServers(s.appConfig.DNSServers); err != nil {
+		return err
+	}
+
+	proxied := s.appConfig.EgressProxyURL != ""
+	if proxied {
+		if _, err := url.Parse(s.appConfig.EgressProxyURL); err != nil {
+			return fmt.Errorf("invalid egress proxy url: %w", err)
+		}
+	}
+
+	result, err := s.dockerClient.NetworkInspect(ctx, s.appConfig.NetworkName, client.NetworkInspectOptions{})
+	if err != nil && !errdefs.IsNotFound(err) {
+		return err
+	}
+	if err == nil && result.Network.Internal != proxied {
+		return errors.New("managed network exists with a different internal setting, remove it to let the runner recreate it")
+	}
+	if err == nil && result.Network.EnableIPv6 {
+		return errors.New("managed network exists with IPv6, whose egress isn't filtered, remove it to let the runner recreate it")
+	}
+
+	if errdefs.IsNotFound(err) {
+		enableIPv6 := false
+		options := client.NetworkCreateOptions{
+			Driver:     "bridge",
+			Internal:   proxied,
+			EnableIPv6: &enableIPv6, // whatever the default of the daemon
+			Labels: map[string]string{
+				"codecell.runner": "true",
+			},
+			Options: map[string]string{
+				"com.docker.network.bridge.name":       s.appConfig.NetworkBridge,
+				"com.docker.network.bridge.enable_icc": "false", // runs must not reach each other
+			},
+		}
+		if _, err := s.dockerClient.NetworkCreate(ctx, s.appConfig.NetworkName, options); err != nil {
+			return err
+		}
+		log.Info().Str("network", s.appConfig.NetworkName).Msg("created managed egress network")
+	}
+
+	// internal networks have no route outside, so there is nothing to filter
+	if proxied {
+		return nil
+	}
+
+	destinations, err := s.resolveAllowlist(ctx)
+	if err != nil {
+		return err
+	}
+	return s.installEgressRules(ctx, destinations)
+}
+
+// Watch resolves the hostnames of the allowlist again at the given interval
+// until the context is cancelled, following the addresses they move to. The
+// interval of 0 disables it, as does the egress proxy, whose network has no
+// rules.
+func (s *NetworkService) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 || s.appConfig.EgressProxyURL != "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.refreshEgressRules(ctx); err != nil && ctx.Err() == nil {
+				log.Warn().Err(err).Msg("failed to refresh the egress allowlist, keeping the previous rules")
+			}
+		}
+	}
+}
+
+// refreshEgressRules resolves the allowlist again and updates the chain in
+// place. The new destinations are allowed before the stale ones are removed,
+// so that the destinations that have stayed are never cut, and the chain is
+// never flushed, which would let everything through meanwhile.
+func (s *NetworkService) refreshEgressRules(ctx context.Context) error {
+	destinations, err := s.resolveAllowlist(ctx)
+	if err != nil {
+		return err
+	}
+	var added, removed []string
+	for _, destination := range destinations {
+		if s.allowed[destination] {
+			continue
+		}
+		// right after the rule of the established connections
+		if err := iptables(ctx, "-I", egressChain, "2", "-d", destination, "-j", "RETURN"); err != nil {
+			return err
+		}
+		s.allowed[destination] = true
+		added = append(added, destination)
+	}
+	for _, destination := range slices.Sorted(maps.Keys(s.allowed)) {
+		if slices.Contains(destinations, destination) {
+			continue
+		}
+		if err := iptables(ctx, "-D", egressChain, "-d", destination, "-j", "RETURN"); err != nil {
+			return err
+		}
+		delete(s.allowed, destination)
+		removed = append(removed, destination)
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		log.Info().Strs("added", added).Strs("removed", removed).Msg("egress allowlist has changed")
+	}
+	return nil
+}
+
+// ProxyEnvironment returns the environment variables pointing the HTTP clients
+// of the given run at the egress proxy. The request ID is passed as the proxy
+// username, so that clients send it in Proxy-Authorization and the proxy can
+// log the destinations per run.
+func ProxyEnvironment(appConfig *pkg.AppConfig, requestID string) map[string]string {
+	if appConfig.EgressProxyURL == "" {
+		return nil
+	}
+	proxyURL, err := url.Parse(appConfig.EgressProxyURL)
+	if err != nil {
+		return nil // validated by EnsureNetwork at startup
+	}
+	proxyURL.User = url.User(requestID)
+
+	// both spellings are set, since tools disagree on which one they read
+	return map[string]string{
+		"HTTP_PROXY":  proxyURL.String(),
+		"HTTPS_PROXY": proxyURL.String(),
+		"NO_PROXY":    appConfig.EgressNoProxy,
+		"http_proxy":  proxyURL.String(),
+		"https_proxy": proxyURL.String(),
+		"no_proxy":    appConfig.EgressNoProxy,
+	}
+}
+
+// ParseDNSServers parses the configured DNS server addresses.
+func ParseDNSServers(servers []string) ([]netip.Addr, error) {
+	var addresses []netip.Addr
+	for _, server := range servers {
+		server = strings.TrimSpace(server)
+		if server == "" {
+			continue
+		}
+		address, err := netip.ParseAddr(server)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dns server %q: %w", server, err)
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
+
+// installEgressRules rebuilds the egress chain, so that traffic leaving the
+// managed bridge is accepted only towards the allowlisted destinations.
+func (s *NetworkService) installEgressRules(ctx context.Context, destinations []string) error {
+	// the chain may already exist from a previous start, so the error is ignored
+	_ = iptables(ctx, "-N", egressChain)
+	if err := iptables(ctx, "-F", egressChain); err != nil {
+		return err
+	}
+
+	rules := [][]string{
+		{"-A", egressChain, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "RETURN"},
+	}
+	for _, destination := range destinations {
+		rules = append(rules, []string{"-A", egressChain, "-d", destination, "-j", "RETURN"})
+	}
+	rules = append(rules, []string{"-A", egressChain, "-j", "REJECT"})
+
+	for _, rule := range rules {
+		if err := iptables(ctx, rule...); err != nil {
+			return err
+		}
+	}
+	clear(s.allowed)
+	for _, destination := range destinations {
+		s.allowed[destination] = true
+	}
+
+	// forwarded traffic goes through DOCKER-USER, traffic to the host itself through INPUT
+	for _, parent := range []string{"DOCKER-USER", "INPUT"} {
+		jump := []string{parent, "-i", s.appConfig.NetworkBridge, "-j", egressChain}
+		if err := iptables(ctx, append([]string{"-C"}, jump...)...); err == nil {
+			continue // the jump is already installed
+		}
+		if err := iptables(ctx, append([]string{"-I"}, jump...)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveAllowlist converts the allowlist entries into IPv4 CIDRs and
+// addresses, resolving the hostnames into the addresses they point to at the
+// time of the call. The destinations are sorted, without duplicates.
+func (s *NetworkService) resolveAllowlist(ctx context.Context) ([]string, error) {
+	var destinations []string
+	for _, entry := range s.appConfig.NetworkAllowlist {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			if !prefix.Addr().Is4() {
+				return nil, fmt.Errorf("allowlisted network %q is IPv6, which the managed network doesn't have", entry)
+			}
+			destinations = append(destinations, prefix.Masked().String())
+			continue
+		}
+		if address, err := netip.ParseAddr(entry); err == nil {
+			if !address.Unmap().Is4() {
+				return nil, fmt.Errorf("allowlisted address %q is IPv6, which the managed network doesn't have", entry)
+			}
+			destinations = append(destinations, address.Unmap().String())
+			continue
+		}
+
+		addresses, err := s.lookupIP(ctx, entry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve allowlisted host %q: %w", entry, err)
+		}
+		for _, address := range addresses {
+			// the managed network has no IPv6, its addresses are unreachable anyway
+			if address.To4() != nil {
+				destinations = append(destinations, address.To4().String())
+			}
+		}
+	}
+	slices.Sort(destinations)
+	return slices.Compact(destinations), nil
+}
+
+// iptables executes the iptables binary with the given arguments.
+func iptables(ctx context.Context, args ...string) error {
+	output, err := exec.CommandContext(ctx, "iptables", append([]string{"-w"}, args...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("iptables %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Pelfox/codecell-runner/internal/dockertest"
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/moby/moby/api/types/network"
+)
+
+// fakeIPTables installs an iptables script recording its arguments, and
+// returns the function returning the calls made so far.
+func fakeIPTables(t *testing.T) func() []string {
+	t.Helper()
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	script := "#!/bin/sh\necho \"$*\" >> " + calls + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "iptables"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+	return func() []string {
+		contents, err := os.ReadFile(calls)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Split(strings.TrimSpace(string(contents)), "\n")
+	}
+}
+
+// newTestNetworkService returns a new network service resolving the hostnames
+// with the hosts map.
+func newTestNetworkService(t *testing.T, allowlist []string, hosts map[string][]string) (*NetworkService, *dockertest.Server) {
+	t.Helper()
+	daemon := dockertest.NewServer()
+	t.Cleanup(daemon.Close)
+	dockerClient, err := daemon.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = dockerClient.Close() })
+	config, _, err := pkg.LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.NetworkAllowlist = allowlist
+
+	networkService := NewNetworkService(dockerClient, config)
+	networkService.lookupIP = func(_ context.Context, host string) ([]net.IP, error) {
+		addresses, ok := hosts[host]
+		if !ok {
+			return nil, errors.New("no such host")
+		}
+		var ips []net.IP
+		for _, address := range addresses {
+			ips = append(ips, net.ParseIP(address))
+		}
+		return ips, nil
+	}
+	return networkService, daemon
+}
+
+func TestResolveAllowlistKeepsTheIPv4Destinations(t *testing.T) {
+	hosts := map[string][]string{"api.example.com": {"192.0.2.2", "2001:db8::2", "192.0.2.1", "::ffff:192.0.2.3"}}
+	tests := []struct {
+		name      string
+		allowlist []string
+		want      []string
+		wantErr   string
+	}{
+		{name: "CIDRs and addresses", allowlist: []string{" 198.51.100.7/24", "203.0.113.9", ""},
+			want: []string{"198.51.100.0/24", "203.0.113.9"}},
+		{name: "hostname", allowlist: []string{"api.example.com", "192.0.2.1"},
+			want: []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}},
+		{name: "IPv6 network", allowlist: []string{"2001:db8::/32"}, wantErr: "is IPv6"},
+		{name: "IPv6 address", allowlist: []string{"2001:db8::1"}, wantErr: "is IPv6"},
+		{name: "unresolvable host", allowlist: []string{"gone.example.com"}, wantErr: "failed to resolve"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			networkService, _ := newTestNetworkService(t, test.allowlist, hosts)
+			destinations, err := networkService.resolveAllowlist(context.Background())
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("resolveAllowlist() = %v, want the error %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil || !slices.Equal(destinations, test.want) {
+				t.Errorf("resolveAllowlist() = %v, %v, want %v", destinations, err, test.want)
+			}
+		})
+	}
+}
+
+func TestRefreshEgressRulesFollowsTheAddressesOfTheHosts(t *testing.T) {
+	calls := fakeIPTables(t)
+	hosts := map[string][]string{"api.example.com": {"192.0.2.1", "192.0.2.2"}}
+	networkService, _ := newTestNetworkService(t, []string{"api.example.com", "198.51.100.0/24"}, hosts)
+	if err := networkService.installEgressRules(context.Background(), []string{"192.0.2.1", "192.0.2.2", "198.51.100.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	installed := len(calls())
+
+	// the new address is allowed before the stale one goes, and the chain is never flushed
+	hosts["api.example.com"] = []string{"192.0.2.2", "192.0.2.3"}
+	if err := networkService.refreshEgressRules(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"-w -I CODECELL-EGRESS 2 -d 192.0.2.3 -j RETURN",
+		"-w -D CODECELL-EGRESS -d 192.0.2.1 -j RETURN",
+	}
+	if got := calls()[installed:]; !slices.Equal(got, want) {
+		t.Errorf("the refresh has run iptables %q, want %q", got, want)
+	}
+
+	// nothing changes while the host can't be resolved
+	delete(hosts, "api.example.com")
+	if err := networkService.refreshEgressRules(context.Background()); err == nil {
+		t.Error("refreshEgressRules() of the unresolvable host = nil, want an error")
+	}
+	if got := calls()[installed:]; len(got) != len(want) {
+		t.Errorf("the failed refresh has run iptables %q, want nothing", got[len(want):])
+	}
+}
+
+func TestEnsureNetworkCreatesTheNetworkWithoutIPv6(t *testing.T) {
+	fakeIPTables(t)
+	networkService, daemon := newTestNetworkService(t, nil, nil)
+	if err := networkService.EnsureNetwork(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	created, ok := daemon.Network(networkService.appConfig.NetworkName)
+	if !ok || created.EnableIPv6 {
+		t.Fatalf("the managed network is %+v, want it created without IPv6", created)
+	}
+
+	// a network of IPv6 left by someone else isn't used
+	networkService, daemon = newTestNetworkService(t, nil, nil)
+	daemon.AddNetwork(network.Inspect{Network: network.Network{Name: networkService.appConfig.NetworkName, EnableIPv6: true}})
+	if err := networkService.EnsureNetwork(context.Background()); err == nil || !strings.Contains(err.Error(), "IPv6") {
+		t.Errorf("EnsureNetwork() of the existing IPv6 network = %v, want an error", err)
+	}
+}
@@ -0,0 +1,100 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/Pelfox/codecell-runner/pkg"
+)
+
+// ErrNoMatchingSignature is returned for the images with no signature matching
+// the configured policy, as opposed to the verifications that couldn't complete.
+var ErrNoMatchingSignature = errors.New("no matching signature")
+
+// rejectionMarkers are the cosign errors telling that the image is signed by
+// no one the policy trusts, or isn't signed at all.
+var rejectionMarkers = []string{"no matching signatures", "no signatures found"}
+
+// SignatureVerifier verifies cosign signatures of the runtime images against
+// the configured policy, caching the verdict on the image per digest.
+type SignatureVerifier struct {
+	appConfig *pkg.AppConfig
+
+	mutex sync.Mutex
+	cache map[string]error // ID = image digest reference, Value = nil or ErrNoMatchingSignature
+}
+
+// NewSignatureVerifier creates a new instance of SignatureVerifier. It returns
+// nil if no verification policy is configured.
+func NewSignatureVerifier(appConfig *pkg.AppConfig) *SignatureVerifier {
+	if appConfig.CosignPublicKey == "" && appConfig.CosignIdentity == "" {
+		return nil
+	}
+	return &SignatureVerifier{
+		appConfig: appConfig,
+		mutex:     sync.Mutex{},
+		cache:     make(map[string]error),
+	}
+}
+
+// Verify checks the signature of the image identified by the given digest
+// reference (e.g. "codecell/dotnet@sha256:...").
+func (v *SignatureVerifier) Verify(ctx context.Context, digestReference string) error {
+	v.mutex.Lock()
+	err, ok := v.cache[digestReference]
+	v.mutex.Unlock()
+	if ok {
+		return err
+	}
+
+	err = v.runCosign(ctx, digestReference)
+	// only the verdicts are cached, an unreachable registry or a cancelled
+	// verification being retried on the next verification of the image
+	if err == nil || errors.Is(err, ErrNoMatchingSignature) {
+		v.mutex.Lock()
+		v.cache[digestReference] = err
+		v.mutex.Unlock()
+	}
+	return err
+}
+
+// runCosign executes the cosign binary to verify the image signature stored
+// in the registry, either with a public key or keyless identity constraints.
+func (v *SignatureVerifier) runCosign(ctx context.Context, digestReference string) error {
+	args := []string{"verify", "--output", "json"}
+	if v.appConfig.CosignPublicKey != "" {
+		args = append(args, "--key", v.appConfig.CosignPublicKey)
+	} else {
+		args = append(args,
+			"--certificate-identity", v.appConfig.CosignIdentity,
+			"--certificate-oidc-issuer", v.appConfig.CosignIssuer,
+		)
+	}
+	args = append(args, digestReference)
+
+	output, err := exec.CommandContext(ctx, "cosign", args...).CombinedOutput()
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		reason := lastLine(string(output))
+		for _, marker := range rejectionMarkers {
+			if strings.Contains(reason, marker) {
+				return fmt.Errorf("signature verification failed: %w: %s", ErrNoMatchingSignature, reason)
+			}
+		}
+		return fmt.Errorf("signature verification failed: %w: %s", err, reason)
+	}
+	return nil
+}
+
+// lastLine returns the last non-empty line of the output, which is where
+// cosign reports the reason of a failure.
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
@@ -0,0 +1,100 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Pelfox/codecell-runner/pkg"
+)
+
+// fakeCosign installs a cosign script printing the given output and exiting
+// with the given code, and returns the file counting its invocations.
+func fakeCosign(t *testing.T, output string, exitCode int) string {
+	t.Helper()
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	script := "#!/bin/sh\necho call >> " + calls + "\necho '" + output + "'\nexit " + strconv.Itoa(exitCode) + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "cosign"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+	return calls
+}
+
+func countCalls(t *testing.T, calls string) int {
+	t.Helper()
+	contents, err := os.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(contents), "call")
+}
+
+func TestSignatureVerifierCachesVerdicts(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		exitCode int
+		want     error
+		cached   bool
+	}{
+		{name: "verified", output: "[]", exitCode: 0, want: nil, cached: true},
+		{name: "no matching signatures", output: "Error: no matching signatures: key mismatch",
+			exitCode: 1, want: ErrNoMatchingSignature, cached: true},
+		{name: "unsigned", output: "Error: no signatures found", exitCode: 1, want: ErrNoMatchingSignature, cached: true},
+		{name: "registry unreachable", output: "Error: GET https://registry/v2/: dial tcp: i/o timeout",
+			exitCode: 1, cached: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := fakeCosign(t, test.output, test.exitCode)
+			verifier := NewSignatureVerifier(&pkg.AppConfig{CosignPublicKey: "cosign.pub"})
+
+			for range 2 {
+				err := verifier.Verify(context.Background(), "codecell/python@sha256:abc")
+				if test.exitCode == 0 && err != nil {
+					t.Fatalf("Verify() = %v, want nil", err)
+				}
+				if test.exitCode != 0 && err == nil {
+					t.Fatal("Verify() = nil, want an error")
+				}
+				if test.want != nil && !errors.Is(err, test.want) {
+					t.Fatalf("Verify() = %v, want %v", err, test.want)
+				}
+				if test.want == nil && errors.Is(err, ErrNoMatchingSignature) {
+					t.Fatalf("Verify() = %v, want a transient error", err)
+				}
+			}
+
+			want := 2
+			if test.cached {
+				want = 1
+			}
+			if got := countCalls(t, calls); got != want {
+				t.Errorf("cosign ran %d times, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestSignatureVerifierDoesNotCacheCancellation(t *testing.T) {
+	calls := fakeCosign(t, "[]", 0)
+	verifier := NewSignatureVerifier(&pkg.AppConfig{CosignPublicKey: "cosign.pub"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := verifier.Verify(ctx, "codecell/python@sha256:abc"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Verify() = %v, want %v", err, context.Canceled)
+	}
+	if err := verifier.Verify(context.Background(), "codecell/python@sha256:abc"); err != nil {
+		t.Fatalf("Verify() = %v, want nil", err)
+	}
+	if got := countCalls(t, calls); got != 1 {
+		t.Errorf("cosign ran %d times, want 1", got)
+	}
+}
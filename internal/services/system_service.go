@@ -0,0 +1,278 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/moby/moby/client"
+	"github.com/rs/zerolog"
+)
+
+// IsolationMode describes how the Docker daemon maps container users onto the host.
+type IsolationMode string
+
+const (
+	// IsolationModeRoot means the daemon runs as root without user namespace remapping.
+	IsolationModeRoot IsolationMode = "root"
+	// IsolationModeUserNamespace means the daemon remaps container users via userns-remap.
+	IsolationModeUserNamespace IsolationMode = "userns"
+	// IsolationModeRootless means the daemon itself runs as an unprivileged user.
+	IsolationModeRootless IsolationMode = "rootless"
+)
+
+// IsRemapped reports whether container users are mapped to unprivileged host users.
+func (m IsolationMode) IsRemapped() bool {
+	return m == IsolationModeUserNamespace || m == IsolationModeRootless
+}
+
+// cgroupRoot is the mount point of the cgroup v2 unified hierarchy.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// onlineCPUsPath is the kernel file listing the CPUs currently online.
+const onlineCPUsPath = "/sys/devices/system/cpu/online"
+
+const (
+	// minDaemonBackoff is the initial delay before pinging the daemon again at startup.
+	minDaemonBackoff = 500 * time.Millisecond
+	// maxDaemonBackoff is the maximum delay before pinging the daemon again at startup.
+	maxDaemonBackoff = 10 * time.Second
+	// daemonPingTimeout bounds a single ping of the daemon at startup.
+	daemonPingTimeout = 5 * time.Second
+)
+
+// SystemService provides methods to inspect the Docker daemon the runner is connected to.
+type SystemService struct {
+	dockerClient *client.Client
+}
+
+// NewSystemService creates a new instance of SystemService with the given Docker client.
+func NewSystemService(dockerClient *client.Client) *SystemService {
+	return &SystemService{dockerClient}
+}
+
+// DaemonInfo describes the Docker daemon the runner is connected to.
+type DaemonInfo struct {
+	// Version is the version of the daemon.
+	Version string
+	// StorageDriver is the storage driver of the daemon, e.g. overlay2.
+	StorageDriver string
+}
+
+// DaemonInfo returns the version and the storage driver of the daemon.
+func (s *SystemService) DaemonInfo(ctx context.Context) (DaemonInfo, error) {
+	result, err := s.dockerClient.Info(ctx, client.InfoOptions{})
+	if err != nil {
+		return DaemonInfo{}, err
+	}
+	return DaemonInfo{Version: result.Info.ServerVersion, StorageDriver: result.Info.Driver}, nil
+}
+
+// DetectIsolationMode inspects the daemon security options to find out whether
+// it runs rootless, with user namespace remapping, or as plain root.
+func (s *SystemService) DetectIsolationMode(ctx context.Context) (IsolationMode, error) {
+	result, err := s.dockerClient.Info(ctx, client.InfoOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	mode := IsolationModeRoot
+	// security options are reported as comma-separated key-value pairs,
+	// e.g. "name=seccomp,profile=builtin" or "name=rootless"
+	for _, option := range result.Info.SecurityOptions {
+		for _, field := range strings.Split(option, ",") {
+			switch field {
+			case "name=rootless":
+				return IsolationModeRootless, nil
+			case "name=userns":
+				mode = IsolationModeUserNamespace
+			}
+		}
+	}
+	return mode, nil
+}
+
+// EnsureCgroupParent verifies that the given cgroup parent exists on the host.
+// On the cgroupfs driver the cgroup is created when missing, while systemd
+// slices must be provisioned by the host configuration. The cgroups of a
+// remote daemon are out of reach: only its cgroup setup is checked then.
+func (s *SystemService) EnsureCgroupParent(ctx context.Context, parent string) error {
+	result, err := s.dockerClient.Info(ctx, client.InfoOptions{})
+	if err != nil {
+		return err
+	}
+	if result.Info.CgroupVersion != "2" {
+		return errors.New("cgroup parent is supported only on cgroup v2 hosts")
+	}
+
+	var path string
+	switch result.Info.CgroupDriver {
+	case "systemd":
+		if path, err = systemdSlicePath(parent); err != nil {
+			return err
+		}
+	case "cgroupfs":
+		path = filepath.Join(cgroupRoot, filepath.Clean("/"+parent))
+	default:
+		return fmt.Errorf("unsupported cgroup driver %q", result.Info.CgroupDriver)
+	}
+	if !s.isLocalDaemon() {
+		zerolog.Ctx(ctx).Warn().Str("cgroupParent", parent).Str("daemonHost", s.dockerClient.DaemonHost()).
+			Msg("docker daemon is remote, the cgroup parent must be provisioned on its host")
+		return nil
+	}
+
+	if result.Info.CgroupDriver == "systemd" {
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("systemd slice %q is not available: %w", parent, err)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return fmt.Errorf("failed to create cgroup %q: %w", parent, err)
+	}
+	return nil
+}
+
+// isLocalDaemon reports whether the daemon listens on a local socket, the host
+// of the runner being its host, whose /sys is the one the runner sees.
+func (s *SystemService) isLocalDaemon() bool {
+	return isLocalDaemon(s.dockerClient)
+}
+
+// isLocalDaemon reports whether the daemon of the client listens on a local socket.
+func isLocalDaemon(dockerClient *client.Client) bool {
+	host, err := client.ParseHostURL(dockerClient.DaemonHost())
+	return err == nil && (host.Scheme == "unix" || host.Scheme == "npipe")
+}
+
+// systemdSlicePath converts a slice name into its cgroupfs path, following
+// the systemd nesting convention ("a-b.slice" lives in "a.slice/a-b.slice").
+func systemdSlicePath(slice string) (string, error) {
+	if !strings.HasSuffix(slice, ".slice") || strings.Contains(slice, "/") {
+		return "", fmt.Errorf("invalid systemd slice name %q", slice)
+	}
+
+	name := strings.TrimSuffix(slice, ".slice")
+	path := cgroupRoot
+	parts := strings.Split(name, "-")
+	for i := range parts {
+		path = filepath.Join(path, strings.Join(parts[:i+1], "-")+".slice")
+	}
+	return path, nil
+}
+
+// ValidateCPUSet checks that every CPU of the given list is online on the
+// host of the daemon and that the CPU quota fits into the set.
+func (s *SystemService) ValidateCPUSet(ctx context.Context, cpus string, nanoCPUs int64) error {
+	online, err := s.onlineCPUs(ctx)
+	if err != nil {
+		return err
+	}
+	requested, err := pkg.ParseCPUList(cpus)
+	if err != nil {
+		return err
+	}
+
+	onlineSet := make(map[int]struct{}, len(online))
+	for _, cpu := range online {
+		onlineSet[cpu] = struct{}{}
+	}
+	for _, cpu := range requested {
+		if _, ok := onlineSet[cpu]; !ok {
+			return fmt.Errorf("cpu %d of set %q is not online", cpu, cpus)
+		}
+	}
+
+	// a quota larger than the pinned set can never be used, which is most likely a mistake
+	if nanoCPUs > int64(len(requested))*1_000_000_000 {
+		return fmt.Errorf("cpu limit exceeds the %d cpus of set %q", len(requested), cpus)
+	}
+	return nil
+}
+
+// onlineCPUs returns the CPUs online on the host of the daemon. The host of a
+// remote daemon only tells their count, the CPUs being numbered from 0 then.
+func (s *SystemService) onlineCPUs(ctx context.Context) ([]int, error) {
+	if s.isLocalDaemon() {
+		contents, err := os.ReadFile(onlineCPUsPath)
+		if err != nil {
+			return nil, err
+		}
+		return pkg.ParseCPUList(string(contents))
+	}
+
+	result, err := s.dockerClient.Info(ctx, client.InfoOptions{})
+	if err != nil {
+		return nil, err
+	}
+	online := make([]int, result.Info.NCPU)
+	for cpu := range online {
+		online[cpu] = cpu
+	}
+	return online, nil
+}
+
+// HostResources describes the resources of the Docker host.
+type HostResources struct {
+	// Memory is the total memory in bytes.
+	Memory int64
+	// CPUs is the number of CPUs.
+	CPUs int
+}
+
+// HostResources returns the resources of the Docker host.
+func (s *SystemService) HostResources(ctx context.Context) (HostResources, error) {
+	result, err := s.dockerClient.Info(ctx, client.InfoOptions{})
+	if err != nil {
+		return HostResources{}, err
+	}
+	return HostResources{Memory: result.Info.MemTotal, CPUs: result.Info.NCPU}, nil
+}
+
+// DockerRootDir returns the root directory of the Docker storage.
+func (s *SystemService) DockerRootDir(ctx context.Context) (string, error) {
+	result, err := s.dockerClient.Info(ctx, client.InfoOptions{})
+	if err != nil {
+		return "", err
+	}
+	return result.Info.DockerRootDir, nil
+}
+
+// WaitForDaemon pings the Docker daemon until it responds, with an exponential
+// backoff, for the runner started before it. It gives up with the last error
+// once the timeout has passed, the zero timeout pinging only once.
+func (s *SystemService) WaitForDaemon(ctx context.Context, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	backoff := minDaemonBackoff
+	for attempt := 1; ; attempt++ {
+		pingCtx, cancelPing := context.WithTimeout(ctx, daemonPingTimeout)
+		err := s.Ping(pingCtx)
+		cancelPing()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+		zerolog.Ctx(ctx).Warn().Err(err).Int("attempt", attempt).Dur("backoff", backoff).
+			Msg("docker daemon isn't responding yet, retrying")
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxDaemonBackoff)
+	}
+}
+
+// Ping checks that the Docker daemon is reachable and responding.
+func (s *SystemService) Ping(ctx context.Context) error {
+	_, err := s.dockerClient.Ping(ctx, client.PingOptions{})
+	return err
+}
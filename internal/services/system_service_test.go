@@ -0,0 +1,212 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/dockertest"
+	"github.com/moby/moby/api/types/system"
+	"github.com/moby/moby/client"
+	"github.com/rs/zerolog"
+)
+
+// newTestSystemService returns the SystemService of a new fake daemon, which
+// is remote unless local is set: the client then connects to the fake daemon
+// as if it were to the local socket of the default daemon.
+func newTestSystemService(t *testing.T, local bool) (*dockertest.Server, *SystemService) {
+	t.Helper()
+	daemon := dockertest.NewServer()
+	t.Cleanup(daemon.Close)
+	var options []client.Opt
+	if local {
+		address := strings.TrimPrefix(daemon.Host(), "tcp://")
+		options = append(options, client.WithHost("unix:///var/run/docker.sock"),
+			client.WithDialContext(func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "tcp", address)
+			}))
+	}
+	dockerClient, err := daemon.Client(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = dockerClient.Close() })
+	return daemon, NewSystemService(dockerClient)
+}
+
+// cgroupInfo returns the information of a daemon with the given cgroup setup.
+func cgroupInfo(driver string, version string) system.Info {
+	return system.Info{NCPU: 4, CgroupDriver: driver, CgroupVersion: version}
+}
+
+func TestEnsureCgroupParentOfARemoteDaemon(t *testing.T) {
+	tests := []struct {
+		name    string
+		info    system.Info
+		parent  string
+		wantErr string // empty if the parent is left to the host of the daemon
+	}{
+		{name: "systemd slice", info: cgroupInfo("systemd", "2"), parent: "codecell-runs.slice"},
+		{name: "cgroupfs cgroup", info: cgroupInfo("cgroupfs", "2"), parent: "codecell/runs"},
+		{name: "invalid systemd slice", info: cgroupInfo("systemd", "2"), parent: "codecell/runs",
+			wantErr: `invalid systemd slice name "codecell/runs"`},
+		{name: "cgroup v1", info: cgroupInfo("cgroupfs", "1"), parent: "codecell",
+			wantErr: "cgroup parent is supported only on cgroup v2 hosts"},
+		{name: "unsupported driver", info: cgroupInfo("none", "2"), parent: "codecell",
+			wantErr: `unsupported cgroup driver "none"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			daemon, systemService := newTestSystemService(t, false)
+			daemon.SetInfo(test.info)
+			var logs bytes.Buffer
+			ctx := zerolog.New(&logs).WithContext(context.Background())
+
+			err := systemService.EnsureCgroupParent(ctx, test.parent)
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Errorf("EnsureCgroupParent(%q) = %v, want %q", test.parent, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("EnsureCgroupParent(%q) = %v, want it left to the host of the daemon", test.parent, err)
+			}
+			if !strings.Contains(logs.String(), "docker daemon is remote") {
+				t.Errorf("EnsureCgroupParent(%q) doesn't warn of the unchecked parent, logs: %s", test.parent, logs.String())
+			}
+		})
+	}
+}
+
+func TestEnsureCgroupParentOfALocalDaemon(t *testing.T) {
+	_, systemService := newTestSystemService(t, true)
+	// the slice the host doesn't have, as the runner sees its /sys
+	err := systemService.EnsureCgroupParent(context.Background(), "codecell-missing.slice")
+	if err == nil || !strings.Contains(err.Error(), `systemd slice "codecell-missing.slice" is not available`) {
+		t.Errorf("EnsureCgroupParent() = %v, want the missing slice", err)
+	}
+}
+
+func TestValidateCPUSetOfARemoteDaemon(t *testing.T) {
+	tests := []struct {
+		cpus     string
+		nanoCPUs int64
+		wantErr  string // empty if the set is valid
+	}{
+		{cpus: "0-3", nanoCPUs: 4e9},
+		{cpus: "2,3", nanoCPUs: 1e9},
+		{cpus: "3-4", nanoCPUs: 1e9, wantErr: `cpu 4 of set "3-4" is not online`},
+		{cpus: "0-1", nanoCPUs: 3e9, wantErr: `cpu limit exceeds the 2 cpus of set "0-1"`},
+	}
+	// the fake daemon has 4 CPUs
+	_, systemService := newTestSystemService(t, false)
+	for _, test := range tests {
+		err := systemService.ValidateCPUSet(context.Background(), test.cpus, test.nanoCPUs)
+		if test.wantErr == "" && err != nil || test.wantErr != "" && (err == nil || err.Error() != test.wantErr) {
+			t.Errorf("ValidateCPUSet(%q, %d) = %v, want %q", test.cpus, test.nanoCPUs, err, test.wantErr)
+		}
+	}
+	if err := systemService.ValidateCPUSet(context.Background(), "x", 1e9); err == nil {
+		t.Error(`ValidateCPUSet("x") = nil, want the invalid list`)
+	}
+}
+
+func TestValidateCPUSetOfALocalDaemon(t *testing.T) {
+	daemon, systemService := newTestSystemService(t, true)
+	// the CPUs online on the host, as the runner sees its /sys, not the ones the daemon tells
+	daemon.SetInfo(system.Info{NCPU: 1 << 16})
+	if err := systemService.ValidateCPUSet(context.Background(), "0", 1e9); err != nil {
+		t.Errorf(`ValidateCPUSet("0") = %v, want the first CPU online`, err)
+	}
+	if err := systemService.ValidateCPUSet(context.Background(), "65535", 1e9); err == nil || !strings.Contains(err.Error(), "is not online") {
+		t.Errorf(`ValidateCPUSet("65535") = %v, want it not online on the host`, err)
+	}
+}
+
+// delayedSocket returns the path of the Unix socket of the daemon, only
+// listening once the delay has passed, as when the runner starts before it.
+func delayedSocket(t *testing.T, daemon *dockertest.Server, delay time.Duration) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "codecell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	path := filepath.Join(dir, "docker.sock")
+	address := strings.TrimPrefix(daemon.Host(), "tcp://")
+	timer := time.AfterFunc(delay, func() {
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		t.Cleanup(func() { _ = listener.Close() })
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			// relaying the connection to the daemon
+			go func() {
+				defer conn.Close()
+				upstream, err := net.Dial("tcp", address)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go func() { _, _ = io.Copy(upstream, conn) }()
+				_, _ = io.Copy(conn, upstream)
+			}()
+		}
+	})
+	t.Cleanup(func() { timer.Stop() })
+	return path
+}
+
+func TestWaitForDaemonStartedAfterTheRunner(t *testing.T) {
+	tests := []struct {
+		name    string
+		delay   time.Duration
+		timeout time.Duration
+		wantErr bool
+	}{
+		{name: "socket appearing before the timeout", delay: time.Second, timeout: 30 * time.Second},
+		{name: "socket appearing after the timeout", delay: time.Minute, timeout: time.Second, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			daemon := dockertest.NewServer()
+			t.Cleanup(daemon.Close)
+			path := delayedSocket(t, daemon, test.delay)
+			dockerClient, err := daemon.Client(client.WithHost("unix://"+path),
+				client.WithDialContext(func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", path)
+				}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = dockerClient.Close() })
+
+			started := time.Now()
+			err = NewSystemService(dockerClient).WaitForDaemon(context.Background(), test.timeout)
+			elapsed := time.Since(started)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("WaitForDaemon() = %v, want an error %t", err, test.wantErr)
+			}
+			if !test.wantErr && elapsed < test.delay {
+				t.Errorf("WaitForDaemon() has returned after %v, before the socket appeared", elapsed)
+			}
+			if test.wantErr && elapsed > test.timeout+daemonPingTimeout {
+				t.Errorf("WaitForDaemon() has given up after %v, long past the %v timeout", elapsed, test.timeout)
+			}
+		})
+	}
+}
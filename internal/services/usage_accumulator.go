@@ -0,0 +1,90 @@
+package services
+
+import (
+	"sync"
+	"time"
+
+	"github.com/moby/moby/api/types/container"
+)
+
+// Usage is the resource consumption of a single run.
+type Usage struct {
+	// CPUSeconds is the CPU time consumed by the container.
+	CPUSeconds float64
+	// MemoryByteSeconds is the integral of the memory working set over time.
+	MemoryByteSeconds float64
+	// PeakMemory is the highest observed memory working set in bytes.
+	PeakMemory uint64
+}
+
+// UsageAccumulator integrates the stats stream of a container into its total
+// resource consumption. With the daemon's 1-second sampling the totals are
+// approximate, but they never decrease.
+type UsageAccumulator struct {
+	mutex sync.Mutex
+
+	initialCPU uint64 // CPU usage at the first sample
+	lastCPU    uint64
+	lastRead   time.Time
+	lastMemory uint64
+	usage      Usage
+}
+
+// NewUsageAccumulator creates a new, empty instance of UsageAccumulator.
+func NewUsageAccumulator() *UsageAccumulator {
+	return &UsageAccumulator{}
+}
+
+// WorkingSet returns the memory actively used by the container, excluding the
+// reclaimable page cache, the same way `docker stats` does.
+func WorkingSet(stats container.StatsResponse) uint64 {
+	usage := stats.MemoryStats.Usage
+	if inactive, ok := stats.MemoryStats.Stats["inactive_file"]; ok && inactive < usage {
+		return usage - inactive
+	}
+	return usage
+}
+
+// Add accounts the given stats sample. Empty samples and samples older than
+// the last one are ignored.
+func (a *UsageAccumulator) Add(stats container.StatsResponse) {
+	if stats.Read.IsZero() {
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if !a.lastRead.IsZero() && !stats.Read.After(a.lastRead) {
+		return
+	}
+
+	cpu := stats.CPUStats.CPUUsage.TotalUsage
+	memory := WorkingSet(stats)
+	if a.lastRead.IsZero() {
+		// the previous sample (if any) marks the moment the counting starts
+		a.initialCPU = stats.PreCPUStats.CPUUsage.TotalUsage
+		if a.initialCPU == 0 || a.initialCPU > cpu {
+			a.initialCPU = cpu
+		}
+	} else {
+		// trapezoidal integration of the working set between the two samples
+		elapsed := stats.Read.Sub(a.lastRead).Seconds()
+		a.usage.MemoryByteSeconds += (float64(a.lastMemory) + float64(memory)) / 2 * elapsed
+	}
+
+	if cpu > a.lastCPU {
+		a.lastCPU = cpu
+	}
+	a.lastRead = stats.Read
+	a.lastMemory = memory
+	a.usage.CPUSeconds = float64(a.lastCPU-a.initialCPU) / float64(time.Second)
+	a.usage.PeakMemory = max(a.usage.PeakMemory, memory)
+}
+
+// Usage returns the totals accumulated so far.
+func (a *UsageAccumulator) Usage() Usage {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.usage
+}
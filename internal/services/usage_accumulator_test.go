@@ -0,0 +1,77 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/moby/moby/api/types/container"
+)
+
+// statsSample returns the stats of a container read at the time, with the
+// total CPU usages of the sample and of the previous one, and the memory
+// usage along its inactive page cache.
+func statsSample(read time.Time, preCPU time.Duration, cpu time.Duration, memory uint64, inactive uint64) container.StatsResponse {
+	return container.StatsResponse{
+		Read:        read,
+		PreCPUStats: container.CPUStats{CPUUsage: container.CPUUsage{TotalUsage: uint64(preCPU)}},
+		CPUStats:    container.CPUStats{CPUUsage: container.CPUUsage{TotalUsage: uint64(cpu)}},
+		MemoryStats: container.MemoryStats{Usage: memory, Stats: map[string]uint64{"inactive_file": inactive}},
+	}
+}
+
+func TestUsageAccumulatorIntegratesTheStats(t *testing.T) {
+	start := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	accumulator := NewUsageAccumulator()
+	steps := []struct {
+		name   string
+		sample container.StatsResponse
+		want   Usage
+	}{
+		// the CPU time is counted from the previous sample of the first one
+		{name: "first sample", sample: statsSample(start, time.Second, 1500*time.Millisecond, 100<<20, 20<<20),
+			want: Usage{CPUSeconds: 0.5, PeakMemory: 80 << 20}},
+		{name: "second sample", sample: statsSample(start.Add(time.Second), 0, 2500*time.Millisecond, 130<<20, 10<<20),
+			want: Usage{CPUSeconds: 1.5, MemoryByteSeconds: 100 << 20, PeakMemory: 120 << 20}},
+		{name: "stale sample", sample: statsSample(start.Add(time.Second), 0, 9*time.Second, 900<<20, 0),
+			want: Usage{CPUSeconds: 1.5, MemoryByteSeconds: 100 << 20, PeakMemory: 120 << 20}},
+		{name: "empty sample", sample: container.StatsResponse{},
+			want: Usage{CPUSeconds: 1.5, MemoryByteSeconds: 100 << 20, PeakMemory: 120 << 20}},
+		// the totals never decrease, whatever the counters of the daemon say
+		{name: "decreasing counter", sample: statsSample(start.Add(3*time.Second), 0, 2*time.Second, 40<<20, 0),
+			want: Usage{CPUSeconds: 1.5, MemoryByteSeconds: 260 << 20, PeakMemory: 120 << 20}},
+	}
+	for _, step := range steps {
+		accumulator.Add(step.sample)
+		if usage := accumulator.Usage(); usage != step.want {
+			t.Errorf("%s: Usage() = %+v, want %+v", step.name, usage, step.want)
+		}
+	}
+}
+
+func TestUsageAccumulatorStartsAtTheFirstSampleWithoutAPreviousOne(t *testing.T) {
+	accumulator := NewUsageAccumulator()
+	accumulator.Add(statsSample(time.Now(), 0, 3*time.Second, 50<<20, 0))
+	if usage := accumulator.Usage(); usage != (Usage{PeakMemory: 50 << 20}) {
+		t.Errorf("Usage() = %+v, want no CPU time before the first sample", usage)
+	}
+}
+
+func TestWorkingSetExcludesTheInactivePageCache(t *testing.T) {
+	tests := []struct {
+		name  string
+		stats container.MemoryStats
+		want  uint64
+	}{
+		{name: "page cache", stats: container.MemoryStats{Usage: 100, Stats: map[string]uint64{"inactive_file": 30}}, want: 70},
+		{name: "no statistics", stats: container.MemoryStats{Usage: 100}, want: 100},
+		{name: "page cache above the usage", stats: container.MemoryStats{Usage: 100, Stats: map[string]uint64{"inactive_file": 300}},
+			want: 100},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := WorkingSet(container.StatsResponse{MemoryStats: test.stats}); got != test.want {
+				t.Errorf("WorkingSet() = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/metrics"
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// warmPoolRetryDelay is how long the filler waits after failing to create a container.
+	warmPoolRetryDelay = 10 * time.Second
+)
+
+// pooledContainer is an idle container of the warm pool.
+type pooledContainer struct {
+	id        string
+	expiresAt time.Time
+}
+
+// WarmPool keeps pre-created containers per language, so that runs skip the
+// container creation. Pool containers are created without a workspace and
+// network, the run copies its source code in once it claims one.
+type WarmPool struct {
+	containersService *ContainersService
+	ttl               time.Duration
+
+	mutex       sync.Mutex
+	sizes       map[string]int               // target number of idle containers
+	idle        map[string][]pooledContainer // oldest first
+	createTimes map[string]time.Duration     // moving average of the creation latency
+	arrivals    map[string]int               // takes since the last TakeArrivals
+	refill      chan struct{}
+}
+
+// NewWarmPool creates a new instance of WarmPool keeping the given number of
+// idle containers per language, each living for at most ttl. A nil pool is
+// valid and always empty.
+func NewWarmPool(containersService *ContainersService, sizes map[string]int, ttl time.Duration) *WarmPool {
+	return &WarmPool{
+		containersService: containersService,
+		ttl:               ttl,
+		sizes:             sizes,
+		idle:              make(map[string][]pooledContainer),
+		createTimes:       make(map[string]time.Duration),
+		arrivals:          make(map[string]int),
+		refill:            make(chan struct{}, 1),
+	}
+}
+
+// Run removes the pool containers of previous runner instances and keeps the
+// pool filled until the context is cancelled, when the idle containers are removed.
+func (p *WarmPool) Run(ctx context.Context) {
+	p.removeStale(ctx)
+	defer p.drain()
+
+	ticker := time.NewTicker(max(p.ttl/4, time.Second))
+	defer ticker.Stop()
+
+	for {
+		p.expire()
+		if !p.fill(ctx) {
+			// retrying later, the daemon or the image is having issues
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(warmPoolRetryDelay):
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-p.refill:
+		}
+	}
+}
+
+// Take claims an idle container of the language. The caller owns the returned
+// container and must remove it once the run is over.
+func (p *WarmPool) Take(language string) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if _, ok := p.sizes[language]; !ok {
+		return "", false
+	}
+	p.arrivals[language]++
+	defer p.requestRefill()
+
+	// taking the youngest container, it has the most lifetime left; if even it
+	// is about to expire, the whole pool is left for the expiry sweep
+	idle := p.idle[language]
+	if count := len(idle); count > 0 && time.Until(idle[count-1].expiresAt) >= pkg.WarmPoolTakeMargin {
+		container := idle[count-1]
+		p.idle[language] = idle[:count-1]
+		metrics.WarmPoolHits.WithLabelValues(language).Inc()
+		metrics.WarmPoolSavedSeconds.WithLabelValues(language).Add(p.createTimes[language].Seconds())
+		metrics.WarmPoolIdle.WithLabelValues(language).Set(float64(count - 1))
+		return container.id, true
+	}
+	metrics.WarmPoolMisses.WithLabelValues(language).Inc()
+	return "", false
+}
+
+// Size returns the target number of idle containers of the language.
+func (p *WarmPool) Size(language string) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.sizes[language]
+}
+
+// SetSize changes the target number of idle containers of the language. The
+// containers over a smaller size are removed right away.
+func (p *WarmPool) SetSize(language string, size int) {
+	p.mutex.Lock()
+	p.sizes[language] = size
+	var excess []pooledContainer
+	if idle := p.idle[language]; len(idle) > size {
+		// dropping the oldest ones, they have the least lifetime left
+		excess = append(excess, idle[:len(idle)-size]...)
+		p.idle[language] = idle[len(idle)-size:]
+	}
+	metrics.WarmPoolIdle.WithLabelValues(language).Set(float64(len(p.idle[language])))
+	p.mutex.Unlock()
+
+	for _, container := range excess {
+		_ = p.containersService.RemoveContainer(container.id)
+	}
+	p.requestRefill()
+}
+
+// TakeArrivals returns the number of claim attempts per language since the
+// previous call.
+func (p *WarmPool) TakeArrivals() map[string]int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	arrivals := p.arrivals
+	p.arrivals = make(map[string]int)
+	return arrivals
+}
+
+// requestRefill wakes the filler up without blocking.
+func (p *WarmPool) requestRefill() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// fill creates the missing idle containers of every language. It returns
+// false if any of them failed to be created.
+func (p *WarmPool) fill(ctx context.Context) bool {
+	p.mutex.Lock()
+	missing := make(map[string]int)
+	for language, size := range p.sizes {
+		missing[language] = size - len(p.idle[language])
+	}
+	p.mutex.Unlock()
+
+	for language, count := range missing {
+		for range count {
+			if ctx.Err() != nil {
+				return true
+			}
+
+			startedAt := time.Now()
+			expiresAt := startedAt.Add(p.ttl)
+			containerID, err := p.containersService.CreatePooledContainer(language, expiresAt)
+			if err != nil {
+				log.Error().Err(err).Str("language", language).Msg("failed to create a warm pool container")
+				return false
+			}
+			p.add(language, pooledContainer{id: containerID, expiresAt: expiresAt}, time.Since(startedAt))
+		}
+	}
+	return true
+}
+
+// add puts the created container into the idle ones.
+func (p *WarmPool) add(language string, container pooledContainer, createTime time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if average := p.createTimes[language]; average == 0 {
+		p.createTimes[language] = createTime
+	} else {
+		p.createTimes[language] = (average*7 + createTime) / 8
+	}
+	p.idle[language] = append(p.idle[language], container)
+	metrics.WarmPoolIdle.WithLabelValues(language).Set(float64(len(p.idle[language])))
+}
+
+// expire removes the idle containers close to the end of their lifetime.
+func (p *WarmPool) expire() {
+	p.mutex.Lock()
+	var expired []string
+	for language, idle := range p.idle {
+		kept := idle[:0]
+		for _, container := range idle {
+			if time.Until(container.expiresAt) < pkg.WarmPoolTakeMargin {
+				expired = append(expired, container.id)
+			} else {
+				kept = append(kept, container)
+			}
+		}
+		p.idle[language] = kept
+		metrics.WarmPoolIdle.WithLabelValues(language).Set(float64(len(kept)))
+	}
+	p.mutex.Unlock()
+
+	for _, containerID := range expired {
+		if err := p.containersService.RemoveContainer(containerID); err != nil {
+			log.Error().Err(err).Str("containerID", containerID).Msg("failed to remove an expired warm pool container")
+		}
+	}
+}
+
+// drain removes all idle containers.
+func (p *WarmPool) drain() {
+	p.mutex.Lock()
+	idle := p.idle
+	p.idle = make(map[string][]pooledContainer)
+	p.mutex.Unlock()
+
+	for language, containers := range idle {
+		for _, container := range containers {
+			_ = p.containersService.RemoveContainer(container.id)
+		}
+		metrics.WarmPoolIdle.WithLabelValues(language).Set(0)
+	}
+}
+
+// removeStale removes the unclaimed pool containers left by previous runner
+// instances; the ones claimed by our runs can't exist yet.
+func (p *WarmPool) removeStale(ctx context.Context) {
+	containers, err := p.containersService.ListManagedContainers(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list the stale warm pool containers")
+		return
+	}
+	for _, managed := range containers {
+		if managed.Pooled {
+			_ = p.containersService.RemoveContainer(managed.ID)
+		}
+	}
+}
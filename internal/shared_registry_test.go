@@ -0,0 +1,154 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "github.com/Pelfox/codecell-runner/generated"
+	"github.com/Pelfox/codecell-runner/internal/auth"
+	"github.com/Pelfox/codecell-runner/internal/registry"
+	"github.com/Pelfox/codecell-runner/internal/tlstest"
+	"github.com/Pelfox/codecell-runner/pkg"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// fakeSharedBackend is a SharedBackend in memory, whose entries never expire.
+type fakeSharedBackend struct {
+	mutex  sync.Mutex
+	owners map[string]registry.Owner
+}
+
+func (b *fakeSharedBackend) Register(_ context.Context, requestID string, owner registry.Owner, _ time.Duration) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.owners[requestID] = owner
+	return nil
+}
+
+func (b *fakeSharedBackend) Lookup(_ context.Context, requestID string) (registry.Owner, bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	owner, ok := b.owners[requestID]
+	return owner, ok, nil
+}
+
+func (b *fakeSharedBackend) Unregister(_ context.Context, requestID string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.owners, requestID)
+	return nil
+}
+
+func (b *fakeSharedBackend) Close() error {
+	return nil
+}
+
+// stopRecorder is the owning instance, recording the Stop calls it gets.
+type stopRecorder struct {
+	v1.UnimplementedRunnerServiceServer
+	calls chan stopCall
+}
+
+// stopCall is a Stop call of the owning instance.
+type stopCall struct {
+	md       metadata.MD
+	identity string // of the client certificate
+}
+
+func (r *stopRecorder) Stop(ctx context.Context, _ *v1.StopRequest) (*v1.StopResponse, error) {
+	call := stopCall{}
+	call.md, _ = metadata.FromIncomingContext(ctx)
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+			call.identity = auth.CertificateIdentity(info.State.VerifiedChains[0][0])
+		}
+	}
+	r.calls <- call
+	return &v1.StopResponse{}, nil
+}
+
+func TestStopIsProxiedWithTheCredentialsOfTheCaller(t *testing.T) {
+	ca := tlstest.NewCA(t)
+	certFile, keyFile := tlstest.WriteKeyPair(t, t.TempDir(), ca.Server(t))
+	certificates, err := auth.NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the owning instance requires the client certificates, as the runner does with mutual TLS
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certificates.GetCertificate,
+		ClientAuth:     tls.RequireAndVerifyClientCert,
+		ClientCAs:      ca.Pool(),
+	})))
+	recorder := &stopRecorder{calls: make(chan stopCall, 1)}
+	v1.RegisterRunnerServiceServer(owner, recorder)
+	go func() { _ = owner.Serve(listener) }()
+	t.Cleanup(owner.Stop)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, ca.PEM(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	peerTLSConfig, err := auth.NewPeerTLSConfig(certificates, caFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &fakeSharedBackend{owners: map[string]registry.Owner{
+		"run": {InstanceAddr: listener.Addr().String(), ContainerID: "container", Identity: "alice"},
+	}}
+	server := &RunnerServer{
+		appConfig: &pkg.AppConfig{
+			InstanceAddr:        "127.0.0.1:1",
+			SharedRegistryProxy: true,
+			IdentityMetadataKey: "x-user-id",
+		},
+		sharedBackend:   backend,
+		peerCredentials: credentials.NewTLS(peerTLSConfig),
+	}
+
+	incoming := func(identity string) context.Context {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+			"authorization", "Bearer token", "x-user-id", identity, "user-agent", "the caller"))
+		return auth.WithPrincipal(ctx, &auth.RequestPrincipal{Identity: identity})
+	}
+	if _, err := server.stopRemote(incoming("bob"), &v1.StopRequest{RequestId: "run"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("stopRemote() of the run of another caller = %v, want PERMISSION_DENIED", err)
+	}
+	if len(recorder.calls) != 0 {
+		t.Error("the Stop call of another caller is proxied")
+	}
+
+	if _, err := server.stopRemote(incoming("alice"), &v1.StopRequest{RequestId: "run"}); err != nil {
+		t.Fatalf("stopRemote() = %v", err)
+	}
+	call := <-recorder.calls
+	if got := call.md.Get("authorization"); len(got) != 1 || got[0] != "Bearer token" {
+		t.Errorf("the proxied call has the authorization %q, want the one of the caller", got)
+	}
+	if got := call.md.Get("x-user-id"); len(got) != 1 || got[0] != "alice" {
+		t.Errorf("the proxied call has the forwarded identity %q, want the one of the caller", got)
+	}
+	if got := call.md.Get("user-agent"); len(got) == 1 && got[0] == "the caller" {
+		t.Error("the proxied call has the other metadata of the caller")
+	}
+	if call.identity != "localhost" {
+		t.Errorf("the proxied call comes with the client certificate of %q, want the one of the instance", call.identity)
+	}
+}
@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/registry"
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/rs/zerolog/log"
+)
+
+// StorePruner periodically deletes the persisted run records older than the
+// retention period.
+type StorePruner struct {
+	appConfig *pkg.AppConfig
+	store     registry.RunStore
+}
+
+// NewStorePruner creates a new instance of StorePruner for the given store.
+func NewStorePruner(appConfig *pkg.AppConfig, store registry.RunStore) *StorePruner {
+	return &StorePruner{appConfig, store}
+}
+
+// Run prunes the store right away and then on every interval until the
+// context is cancelled.
+func (p *StorePruner) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.appConfig.RunStorePruneInterval)
+	defer ticker.Stop()
+
+	for {
+		p.Prune(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Prune deletes the records of the runs finished before the retention period.
+func (p *StorePruner) Prune(ctx context.Context) {
+	pruned, err := p.store.Prune(ctx, time.Now().Add(-p.appConfig.RunStoreRetention))
+	if err != nil {
+		log.Error().Err(err).Msg("failed to prune the run store")
+		return
+	}
+	if pruned > 0 {
+		log.Info().Int("pruned", pruned).Msg("pruned expired run records")
+	}
+}
@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"errors"
+	"io"
+
+	v1 "github.com/Pelfox/codecell-runner/generated"
+	"github.com/Pelfox/codecell-runner/internal/middleware"
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// SubmitRun starts the run of the first message with the files of the next
+// ones. The chunks are spooled to disk as they come and the workspace archive
+// is streamed from there, so that the memory use doesn't depend on the size of
+// the submission. The run is detached, its output is followed with Attach.
+func (s *RunnerServer) SubmitRun(stream grpc.ClientStreamingServer[v1.SubmitRunRequest, v1.SubmitRunResponse]) error {
+	first, err := stream.Recv()
+	if errors.Is(err, io.EOF) {
+		return status.Error(codes.InvalidArgument, "submission carries no run")
+	}
+	if err != nil {
+		return err
+	}
+	request := first.GetRun()
+	if request == nil {
+		return status.Error(codes.InvalidArgument, "first message of the submission must carry the run")
+	}
+
+	dynamicConfig := s.configStore.Load()
+	files, err := pkg.NewFileSpool(dynamicConfig.SubmissionMaxSize, dynamicConfig.SubmissionMaxChunks,
+		dynamicConfig.SubmissionMaxFileSize, dynamicConfig.SubmissionMaxFiles)
+	if err != nil {
+		zerolog.Ctx(stream.Context()).Error().Err(err).Msg("failed to create the submission spool")
+		return status.Error(codes.Internal, "failed to spool the submission")
+	}
+	started := false
+	defer func() {
+		if !started {
+			_ = files.Close()
+		}
+	}()
+	for {
+		message, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		chunk := message.GetChunk()
+		if chunk == nil {
+			return status.Error(codes.InvalidArgument, "only the first message of the submission may carry the run")
+		}
+		if err := files.WriteChunk(chunk.Path, chunk.Offset, chunk.Data); err != nil {
+			if errors.Is(err, pkg.ErrSpoolLimit) {
+				return status.Error(codes.ResourceExhausted, err.Error())
+			}
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	// the spool belongs to the run from now on
+	started = true
+	requestID, err := s.detached.Start(stream.Context(), func(runStream grpc.ServerStreamingServer[v1.RunResponseMessage]) error {
+		defer files.Close()
+		return s.execute(request, files, runStream)
+	})
+	if err != nil {
+		return err
+	}
+	middleware.AnnotationsFromContext(stream.Context()).SetRequestID(requestID)
+	zerolog.Ctx(middleware.WithLogFields(stream.Context(), "requestID", requestID)).Info().
+		Int64("size", files.Size()).
+		Msg("submitted a run with streamed files")
+	return stream.SendAndClose(&v1.SubmitRunResponse{RequestId: requestID})
+}
+
+// Attach streams the messages of a detached run from its start, ending with its
+// status once it's over.
+func (s *RunnerServer) Attach(request *v1.AttachRequest, stream grpc.ServerStreamingServer[v1.RunResponseMessage]) error {
+	broadcast, err := s.detached.Attach(stream.Context(), request.RequestId)
+	if err != nil {
+		return err
+	}
+	follower := broadcast.Follow()
+	for {
+		message, ok, err := follower.Next(stream.Context())
+		if !ok {
+			return err
+		}
+		if err := stream.Send(message); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// Listener returns the socket passed by systemd socket activation, the one
+// with the given name if it isn't empty, or nil if the runner wasn't started
+// by a socket unit. The environment variables are unset, so that the child
+// processes don't inherit them.
+func Listener(name string) (net.Listener, error) {
+	defer func() {
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	for i := range count {
+		fd := listenFDsStart + i
+		syscall.CloseOnExec(fd)
+		if name != "" && (i >= len(names) || names[i] != name) {
+			continue
+		}
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		listener, err := net.FileListener(file)
+		// the listener holds a duplicate of the descriptor
+		_ = file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to use the passed socket %d: %w", fd, err)
+		}
+		return listener, nil
+	}
+	return nil, fmt.Errorf("no socket named %q was passed by systemd", name)
+}
+
+// Notify sends the state to the service manager, e.g. "READY=1". It does
+// nothing unless the runner is supervised by systemd with a notify service.
+func Notify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	// the abstract namespace sockets are prefixed with @
+	if strings.HasPrefix(path, "@") {
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
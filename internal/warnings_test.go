@@ -0,0 +1,142 @@
+package internal_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "github.com/Pelfox/codecell-runner/generated"
+	"github.com/Pelfox/codecell-runner/internal/runnertest"
+	"github.com/Pelfox/codecell-runner/pkg"
+	"google.golang.org/grpc/codes"
+)
+
+// warnings returns the messages of the warnings of the run by their reason.
+func warnings(stream *runnertest.Stream) map[v1.WarningReason][]string {
+	found := make(map[v1.WarningReason][]string)
+	for _, message := range stream.Messages() {
+		if message.Level == v1.MessageLevel_WARNING {
+			found[message.WarningReason] = append(found[message.WarningReason], message.GetMessage())
+		}
+	}
+	return found
+}
+
+// checkWarning checks that the only warning of the run is the one of the
+// reason, with the message.
+func checkWarning(t *testing.T, stream *runnertest.Stream, reason v1.WarningReason, message string) {
+	t.Helper()
+	found := warnings(stream)
+	if len(found) != 1 || len(found[reason]) != 1 || !strings.HasPrefix(found[reason][0], message) {
+		t.Errorf("the run has warned of %q, want a single %s warning %q", found, reason, message)
+	}
+}
+
+// objectStorage is an S3-compatible object storage accepting every upload.
+type objectStorage struct {
+	mutex   sync.Mutex
+	objects map[string]string
+}
+
+// newObjectStorage starts the object storage, returning its endpoint.
+func newObjectStorage(t *testing.T) (*objectStorage, string) {
+	t.Helper()
+	storage := &objectStorage{objects: make(map[string]string)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "only uploads are supported", http.StatusNotImplemented)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		storage.mutex.Lock()
+		storage.objects[r.URL.Path] = string(body)
+		storage.mutex.Unlock()
+		w.Header().Set("ETag", `"etag"`)
+	}))
+	t.Cleanup(server.Close)
+	return storage, strings.TrimPrefix(server.URL, "http://")
+}
+
+// object returns the uploaded object of the path, waiting for the upload in
+// the background.
+func (s *objectStorage) object(t *testing.T, path string) string {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		s.mutex.Lock()
+		object, ok := s.objects[path]
+		s.mutex.Unlock()
+		if ok {
+			return object
+		}
+	}
+	t.Fatalf("%s hasn't been uploaded", path)
+	return ""
+}
+
+func TestRunWarnsOfTheTruncatedArchive(t *testing.T) {
+	storage, endpoint := newObjectStorage(t)
+	runner := runnertest.New(t, func(config *pkg.AppConfig) {
+		config.ArchiveEndpoint = endpoint
+		config.ArchiveSecure = false
+		config.ArchiveRegion = "us-east-1"
+		config.ArchiveBucket = "runs"
+		config.ArchiveMaxBytes = 16
+		config.ArchiveSpoolDir = t.TempDir()
+	})
+	runner.Daemon.SetProgram(printing(0, "first line", "second line", "third line"))
+	request := runRequest()
+	request.ArchiveOutput = true
+
+	stream, err := runner.Run(context.Background(), request)
+	checkOutcome(t, stream, err, v1.ErrorClass_ERROR_CLASS_NONE, codes.OK)
+	checkWarning(t, stream, v1.WarningReason_WARNING_REASON_OUTPUT_TRUNCATED,
+		"Output exceeds the archive limit, the archived copy is cut short.")
+	// the client still gets the whole output
+	if stdout := stream.Lines(v1.MessageLevel_STDOUT); len(stdout) != 3 {
+		t.Errorf("stdout = %q, want every line", stdout)
+	}
+	key := runner.Config.ArchivePrefix + stream.Messages()[0].RequestId + ".log"
+	if object := storage.object(t, "/runs/"+key); len(object) != 16 {
+		t.Errorf("the archived output %q isn't cut at the limit", object)
+	}
+}
+
+func TestRunWarnsOfTheClampedTimeLimit(t *testing.T) {
+	runner := runnertest.New(t, func(config *pkg.AppConfig) {
+		config.DeadlineTeardownMargin = time.Second
+	})
+	runner.Daemon.SetProgram(printing(0))
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stream, err := runner.Run(ctx, runRequest())
+	checkOutcome(t, stream, err, v1.ErrorClass_ERROR_CLASS_NONE, codes.OK)
+	checkWarning(t, stream, v1.WarningReason_WARNING_REASON_LIMIT_CLAMPED, "Time limit is cut to 2s by the client deadline.")
+}
+
+func TestRunWarnsOfTheProxiedNetwork(t *testing.T) {
+	runner := runnertest.New(t, func(config *pkg.AppConfig) {
+		config.NetworkEnabled = true
+		config.EgressProxyURL = "http://proxy.internal:3128"
+	})
+	runner.Daemon.SetProgram(printing(0))
+	request := runRequest()
+	request.NetworkPolicy = v1.NetworkPolicy_NETWORK_ALLOWLISTED
+
+	stream, err := runner.Run(context.Background(), request)
+	checkOutcome(t, stream, err, v1.ErrorClass_ERROR_CLASS_NONE, codes.OK)
+	checkWarning(t, stream, v1.WarningReason_WARNING_REASON_NETWORK_PROXIED,
+		"Network calls are routed through a proxy and logged.")
+
+	// the offline runs aren't proxied
+	stream, err = runner.Run(context.Background(), runRequest())
+	checkOutcome(t, stream, err, v1.ErrorClass_ERROR_CLASS_NONE, codes.OK)
+	if found := warnings(stream); len(found) != 0 {
+		t.Errorf("the offline run has warned of %q", found)
+	}
+}
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/middleware"
+	"github.com/Pelfox/codecell-runner/internal/registry"
+	"github.com/Pelfox/codecell-runner/internal/services"
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Watchdog periodically removes managed containers that outlived their run,
+// independently of the context timeouts of the Run RPC.
+type Watchdog struct {
+	appConfig         *pkg.AppConfig
+	registry          *registry.Registry
+	containersService *services.ContainersService
+}
+
+// NewWatchdog creates a new instance of Watchdog with the given registry and subservices.
+func NewWatchdog(
+	appConfig *pkg.AppConfig,
+	runRegistry *registry.Registry,
+	containersService *services.ContainersService,
+) *Watchdog {
+	return &Watchdog{appConfig, runRegistry, containersService}
+}
+
+// Run sweeps the managed containers on every interval until the context is cancelled.
+func (w *Watchdog) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.appConfig.WatchdogInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.Sweep(ctx)
+		}
+	}
+}
+
+// Sweep force-removes every managed container that has exceeded its deadline
+// plus the grace margin, or that doesn't belong to any active run anymore.
+func (w *Watchdog) Sweep(ctx context.Context) {
+	containers, err := w.containersService.ListManagedContainers(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("watchdog failed to list managed containers")
+		return
+	}
+
+	now := time.Now()
+	for _, managed := range containers {
+		reason := w.reapReason(managed, now)
+		if reason == "" {
+			continue
+		}
+
+		logger := zerolog.Ctx(middleware.WithLogFields(ctx, "requestID", managed.RequestID, "containerID", managed.ID))
+		if err := w.containersService.RemoveContainer(managed.ID); err != nil {
+			logger.Error().Err(err).
+				Msg("watchdog failed to remove the container")
+			continue
+		}
+		logger.Warn().Str("reason", reason).
+			Msg("watchdog removed the container")
+	}
+}
+
+// reapReason returns why the container must be removed, or an empty string if
+// it must be kept.
+func (w *Watchdog) reapReason(managed services.ManagedContainer, now time.Time) string {
+	grace := w.appConfig.WatchdogGrace
+	if managed.Pooled {
+		// a claimed pool container lives by the deadline of its run, not of the pool
+		run, ok := w.registry.GetByContainer(managed.ID)
+		if !ok {
+			if now.After(managed.Deadline.Add(grace)) {
+				return "warm pool container expired"
+			}
+			return ""
+		}
+		managed.Deadline = run.Deadline
+		managed.RequestID = run.RequestID
+	}
+	if !managed.Deadline.IsZero() && now.After(managed.Deadline.Add(grace)) {
+		return "deadline exceeded"
+	}
+	// the cap holds whatever the deadline, the registry recording it for the
+	// runs; the idle pool containers live by the pool expiry instead
+	var hardDeadline time.Time
+	if run, ok := w.registry.GetByContainer(managed.ID); ok && !run.HardDeadline.IsZero() {
+		hardDeadline = run.HardDeadline
+	} else if !managed.Pooled {
+		hardDeadline = managed.CreatedAt.Add(w.appConfig.AbsoluteMaxRunDuration())
+	}
+	if !hardDeadline.IsZero() && now.After(hardDeadline.Add(grace)) {
+		return "server-wide run time cap exceeded"
+	}
+
+	// young containers may belong to runs and probes that are still being set up
+	if now.Before(managed.CreatedAt.Add(grace)) {
+		return ""
+	}
+	if managed.RequestID == "" {
+		return "no owning run"
+	}
+	if _, ok := w.registry.Get(managed.RequestID); !ok {
+		return "run is no longer active"
+	}
+	return ""
+}
@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"maps"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Pelfox/codecell-runner/internal/dockertest"
+	"github.com/Pelfox/codecell-runner/internal/registry"
+	"github.com/Pelfox/codecell-runner/internal/services"
+	"github.com/Pelfox/codecell-runner/pkg"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/client"
+	"github.com/rs/zerolog"
+)
+
+// newTestWatchdog returns a new watchdog of the fake daemon, without a grace
+// period, and the client of the daemon.
+func newTestWatchdog(t *testing.T) (*Watchdog, *dockertest.Server, *client.Client) {
+	t.Helper()
+	daemon := dockertest.NewServer()
+	t.Cleanup(daemon.Close)
+	daemon.AddImage("codecell/perl", "")
+	dockerClient, err := daemon.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = dockerClient.Close() })
+	config, _, err := pkg.LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.WatchdogGrace = 0
+	containersService, err := services.NewContainersService(dockerClient, config, nil, services.IsolationModeUserNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewWatchdog(config, registry.New(0, 0, time.Hour), containersService), daemon, dockerClient
+}
+
+// createManaged creates a container of the runner with the labels.
+func createManaged(t *testing.T, dockerClient *client.Client, labels map[string]string) string {
+	t.Helper()
+	labels["codecell.runner"] = "true"
+	result, err := dockerClient.ContainerCreate(context.Background(), client.ContainerCreateOptions{
+		Config: &container.Config{Labels: labels},
+		Image:  "codecell/perl",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result.ID
+}
+
+// sweepLogs sweeps the containers, returning the entries logged.
+func sweepLogs(t *testing.T, watchdog *Watchdog) []map[string]any {
+	t.Helper()
+	var logs bytes.Buffer
+	watchdog.Sweep(zerolog.New(&logs).WithContext(context.Background()))
+
+	var entries []map[string]any
+	for scanner := bufio.NewScanner(&logs); scanner.Scan(); {
+		var entry map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("the entry %q isn't a JSON object: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestWatchdogLogsTheRunOfTheRemovedContainer(t *testing.T) {
+	watchdog, daemon, dockerClient := newTestWatchdog(t)
+	containerID := createManaged(t, dockerClient, map[string]string{"codecell.requestId": "finished-run"})
+
+	entries := sweepLogs(t, watchdog)
+	if len(entries) != 1 {
+		t.Fatalf("the sweep has logged %v, want a single entry", entries)
+	}
+	if entries[0]["requestID"] != "finished-run" || entries[0]["containerID"] != containerID ||
+		entries[0]["reason"] != "run is no longer active" {
+		t.Errorf("the sweep has logged %v, want the removal with the run and the container", entries[0])
+	}
+	if containers := daemon.Containers(); len(containers) != 0 {
+		t.Errorf("%d containers are left, want the one of the finished run removed", len(containers))
+	}
+}
+
+func TestWatchdogReapsTheOrphanedContainers(t *testing.T) {
+	watchdog, daemon, dockerClient := newTestWatchdog(t)
+	orphanID := createManaged(t, dockerClient, map[string]string{})
+	expiredID := createManaged(t, dockerClient, map[string]string{
+		"codecell.requestId": "expired-run",
+		"codecell.deadline":  strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10),
+	})
+	// the container of an active run within its deadline is kept
+	watchdog.registry.Track(&registry.Run{RequestID: "active-run"})
+	activeID := createManaged(t, dockerClient, map[string]string{
+		"codecell.requestId": "active-run",
+		"codecell.deadline":  strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10),
+	})
+	watchdog.registry.Track(&registry.Run{RequestID: "expired-run"})
+
+	reasons := make(map[string]any)
+	for _, entry := range sweepLogs(t, watchdog) {
+		reasons[entry["containerID"].(string)] = entry["reason"]
+	}
+	want := map[string]any{orphanID: "no owning run", expiredID: "deadline exceeded"}
+	if !maps.Equal(reasons, want) {
+		t.Errorf("the sweep has removed %v, want %v", reasons, want)
+	}
+	if containers := daemon.Containers(); len(containers) != 1 || containers[0].ID != activeID {
+		t.Errorf("the containers %v are left, want only the one of the active run", containers)
+	}
+}
+
+func TestWatchdogReapsTheRunsPastTheRunTimeCap(t *testing.T) {
+	watchdog, daemon, dockerClient := newTestWatchdog(t)
+	// the deadline of the run is far away, its timeout longer than the cap
+	deadline := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	cappedID := createManaged(t, dockerClient, map[string]string{"codecell.requestId": "capped-run", "codecell.deadline": deadline})
+	watchdog.registry.Track(&registry.Run{RequestID: "capped-run", ContainerID: cappedID,
+		HardDeadline: time.Now().Add(-time.Minute)})
+	activeID := createManaged(t, dockerClient, map[string]string{"codecell.requestId": "active-run", "codecell.deadline": deadline})
+	watchdog.registry.Track(&registry.Run{RequestID: "active-run", ContainerID: activeID,
+		HardDeadline: time.Now().Add(time.Minute)})
+
+	entries := sweepLogs(t, watchdog)
+	if len(entries) != 1 || entries[0]["containerID"] != cappedID ||
+		entries[0]["reason"] != "server-wide run time cap exceeded" {
+		t.Errorf("the sweep has logged %v, want the removal of the capped run only", entries)
+	}
+	if containers := daemon.Containers(); len(containers) != 1 || containers[0].ID != activeID {
+		t.Errorf("the containers %v are left, want only the one of the run within the cap", containers)
+	}
+}
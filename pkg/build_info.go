@@ -0,0 +1,26 @@
+package pkg
+
+import "runtime/debug"
+
+// Version and Commit are the version and the commit the runner is built from,
+// injected with -ldflags "-X github.com/Pelfox/codecell-runner/pkg.Version=...".
+var (
+	Version = "dev"
+	Commit  = ""
+)
+
+// BuildCommit returns the commit the runner is built from, taken from the VCS
+// information go build embeds when it isn't injected.
+func BuildCommit() string {
+	if Commit != "" {
+		return Commit
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+	return "unknown"
+}
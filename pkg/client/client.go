@@ -0,0 +1,238 @@
+// Package client is the Go client of the runner service. It hides the
+// streaming of the Run RPC behind an Execution, whose output and statistics
+// are delivered on channels:
+//
+//	c, err := client.New("localhost:8080", client.Options{})
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//
+//	execution, err := c.Run(ctx, client.RunSpec{Language: "dotnet", SourceCode: source})
+//	if err != nil {
+//		return err
+//	}
+//	go func() {
+//		for line := range execution.Stderr {
+//			log.Println(line)
+//		}
+//	}()
+//	for line := range execution.Stdout {
+//		fmt.Println(line)
+//	}
+//	result, err := execution.Wait()
+package client
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	v1 "github.com/Pelfox/codecell-runner/generated"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// defaultMaxRetries is how many times a run is retried by default.
+	defaultMaxRetries = 3
+	// defaultRetryBackoff is the default delay before the first retry.
+	defaultRetryBackoff = 200 * time.Millisecond
+	// maxRetryBackoff caps the doubling delay between the retries.
+	maxRetryBackoff = 5 * time.Second
+)
+
+// Options are the settings of the client, the zero value being the defaults.
+type Options struct {
+	// DialOptions are applied after the defaults, plaintext transport and
+	// keepalive pings every 30s, overriding them.
+	DialOptions []grpc.DialOption
+	// MaxRetries is how many times a run rejected as UNAVAILABLE before its
+	// stream has started is retried, 3 if zero; negative disables the retries.
+	MaxRetries int
+	// RetryBackoff is the delay before the first retry, doubled on every next
+	// one, 200ms if zero.
+	RetryBackoff time.Duration
+}
+
+// Client calls the runner service over a single connection.
+type Client struct {
+	conn         *grpc.ClientConn // nil if the connection is the caller's
+	runner       v1.RunnerServiceClient
+	maxRetries   int
+	retryBackoff time.Duration
+}
+
+// New creates a new instance of Client connected to the target.
+func New(target string, options Options) (*Client, error) {
+	dialOptions := append([]grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		// above the 10s minimum interval the runner enforces by default
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{Time: 30 * time.Second, PermitWithoutStream: true}),
+	}, options.DialOptions...)
+	conn, err := grpc.NewClient(target, dialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	client := NewWithConn(conn, options)
+	client.conn = conn
+	return client, nil
+}
+
+// NewWithConn creates a new instance of Client using the given connection,
+// which is left for the caller to close.
+func NewWithConn(conn grpc.ClientConnInterface, options Options) *Client {
+	client := &Client{
+		runner:       v1.NewRunnerServiceClient(conn),
+		maxRetries:   options.MaxRetries,
+		retryBackoff: options.RetryBackoff,
+	}
+	if client.maxRetries == 0 {
+		client.maxRetries = defaultMaxRetries
+	}
+	if client.retryBackoff <= 0 {
+		client.retryBackoff = defaultRetryBackoff
+	}
+	return client
+}
+
+// Close closes the connection of the client, unless it's the caller's.
+func (c *Client) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// RunService returns the generated client of the service, for the RPCs the
+// client doesn't wrap.
+func (c *Client) RunService() v1.RunnerServiceClient {
+	return c.runner
+}
+
+// RunSpec describes a run, mirroring RunRequest.
+type RunSpec struct {
+	// Language is the language of the source code, for the runtime images.
+	Language string
+	// SourceCode is the program to run.
+	SourceCode string
+	// Image is the custom image to run the Command in, instead of a language.
+	Image string
+	// Command is the command to run in the custom Image.
+	Command []string
+	// Timeout is the time limit of the run, rounded up to seconds; the
+	// default of the runner if zero.
+	Timeout time.Duration
+	// Stdin are the lines written to the standard input of the program.
+	Stdin []string
+	// Network is the network policy of the container.
+	Network v1.NetworkPolicy
+	// Priority is the scheduling priority of the run.
+	Priority v1.RunPriority
+	// Labels are the labels recorded with the run.
+	Labels map[string]string
+	// CallbackURL is the webhook notified of the outcome of the run.
+	CallbackURL string
+	// ArchiveOutput archives the full output of the run.
+	ArchiveOutput bool
+	// SkipDedup runs the program even if an identical run is in flight.
+	SkipDedup bool
+	// Assets are the names of the assets of the runner mounted into the workspace.
+	Assets []string
+}
+
+// request converts the spec into the RunRequest.
+func (s RunSpec) request() *v1.RunRequest {
+	return &v1.RunRequest{
+		SourceCode:     s.SourceCode,
+		Language:       s.Language,
+		TimeoutSeconds: int32(min(math.Ceil(s.Timeout.Seconds()), math.MaxInt32)),
+		Stdin:          s.Stdin,
+		NetworkPolicy:  s.Network,
+		Image:          s.Image,
+		Command:        s.Command,
+		Priority:       s.Priority,
+		Labels:         s.Labels,
+		CallbackUrl:    s.CallbackURL,
+		ArchiveOutput:  s.ArchiveOutput,
+		SkipDedup:      s.SkipDedup,
+		Assets:         s.Assets,
+	}
+}
+
+// Run starts the run, returning once its first message, carrying the request
+// ID, has been received. The runs rejected as UNAVAILABLE before that, when
+// the runner is restarting or a balancer has no instance to route to, are
+// retried with a backoff. Cancelling the context cancels the run.
+func (c *Client) Run(ctx context.Context, spec RunSpec) (*Execution, error) {
+	request := spec.request()
+	backoff := c.retryBackoff
+	for attempt := 0; ; attempt++ {
+		stream, err := c.runner.Run(ctx, request)
+		if err == nil {
+			var first *v1.RunResponseMessage
+			if first, err = stream.Recv(); err == nil {
+				return newExecution(ctx, c.runner, stream, first), nil
+			}
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return nil, err
+		}
+		// nothing has been received yet, so the run hasn't started
+		if status.Code(err) != codes.Unavailable || c.maxRetries < 0 || attempt >= c.maxRetries {
+			return nil, err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		backoff = min(2*backoff, maxRetryBackoff)
+	}
+}
+
+// Stop stops the run with the given request ID, forcefully if force is true.
+func (c *Client) Stop(ctx context.Context, requestID string, force bool) error {
+	_, err := c.runner.Stop(ctx, &v1.StopRequest{RequestId: requestID, Force: force})
+	return err
+}
+
+// ListLanguages returns the languages of the runner and their availability.
+func (c *Client) ListLanguages(ctx context.Context) ([]*v1.LanguageInfo, error) {
+	response, err := c.runner.ListLanguages(ctx, &v1.ListLanguagesRequest{})
+	if err != nil {
+		return nil, err
+	}
+	return response.GetLanguages(), nil
+}
+
+// ListAssets returns the assets staged on the runner.
+func (c *Client) ListAssets(ctx context.Context) ([]*v1.AssetInfo, error) {
+	response, err := c.runner.ListAssets(ctx, &v1.ListAssetsRequest{})
+	if err != nil {
+		return nil, err
+	}
+	return response.GetAssets(), nil
+}
+
+// GetCapacity returns the capacity and the load of the runner.
+func (c *Client) GetCapacity(ctx context.Context) (*v1.GetCapacityResponse, error) {
+	return c.runner.GetCapacity(ctx, &v1.GetCapacityRequest{})
+}
+
+// GetServerInfo returns the build of the runner and the environment it runs in.
+func (c *Client) GetServerInfo(ctx context.Context) (*v1.GetServerInfoResponse, error) {
+	return c.runner.GetServerInfo(ctx, &v1.GetServerInfoRequest{})
+}
+
+// GetRun returns the record of an active or finished run.
+func (c *Client) GetRun(ctx context.Context, requestID string) (*v1.RunRecord, error) {
+	return c.runner.GetRun(ctx, &v1.GetRunRequest{RequestId: requestID})
+}
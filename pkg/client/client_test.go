@@ -0,0 +1,180 @@
+package client_test
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v1 "github.com/Pelfox/codecell-runner/generated"
+	"github.com/Pelfox/codecell-runner/internal/dockertest"
+	"github.com/Pelfox/codecell-runner/internal/runnertest"
+	"github.com/Pelfox/codecell-runner/pkg/client"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// flakyRunner is a runner rejecting its next runs as UNAVAILABLE, as while it
+// restarts.
+type flakyRunner struct {
+	v1.RunnerServiceServer
+	unavailable atomic.Int32
+	attempts    atomic.Int32
+}
+
+func (r *flakyRunner) Run(request *v1.RunRequest, stream grpc.ServerStreamingServer[v1.RunResponseMessage]) error {
+	r.attempts.Add(1)
+	if r.unavailable.Add(-1) >= 0 {
+		return status.Error(codes.Unavailable, "runner is restarting")
+	}
+	return r.RunnerServiceServer.Run(request, stream)
+}
+
+// newTestClient serves the runner on the fake daemon over an in-memory
+// connection, returning the client of the options connected to it.
+func newTestClient(t *testing.T, options client.Options) (*client.Client, *runnertest.Runner, *flakyRunner) {
+	t.Helper()
+	runner := runnertest.New(t, nil)
+	flaky := &flakyRunner{RunnerServiceServer: runner.Server}
+	server := grpc.NewServer()
+	v1.RegisterRunnerServiceServer(server, flaky)
+	listener := bufconn.Listen(1 << 20)
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+
+	options.DialOptions = append(options.DialOptions,
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	c, err := client.New("passthrough:///bufconn", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c, runner, flaky
+}
+
+// collect returns the values of the channel until it's closed.
+func collect[T any](t *testing.T, values <-chan T) []T {
+	t.Helper()
+	var collected []T
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case value, ok := <-values:
+			if !ok {
+				return collected
+			}
+			collected = append(collected, value)
+		case <-timeout:
+			t.Fatal("the channel isn't closed once the run has ended")
+		}
+	}
+}
+
+func TestRunDemuxesTheMessagesOfTheRun(t *testing.T) {
+	c, runner, _ := newTestClient(t, client.Options{})
+	runner.Daemon.SetProgram(func(process *dockertest.Process) dockertest.Exit {
+		process.Stdout("first")
+		process.Stderr("warning: deprecated")
+		process.Stdout("second")
+		return dockertest.Exit{Code: 3}
+	})
+
+	execution, err := c.Run(context.Background(), client.RunSpec{Language: "perl", SourceCode: "exit 3;"})
+	if err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	if stdout := collect(t, execution.Stdout); !slices.Equal(stdout, []string{"first", "second"}) {
+		t.Errorf("stdout = %q, want the lines of the program", stdout)
+	}
+	if stderr := collect(t, execution.Stderr); !slices.Equal(stderr, []string{"warning: deprecated"}) {
+		t.Errorf("stderr = %q, want the line of the program", stderr)
+	}
+	result, err := execution.Wait()
+	if err != nil {
+		t.Fatalf("Wait() = %v", err)
+	}
+	if execution.RequestID == "" || result.RequestID != execution.RequestID {
+		t.Errorf("the result has the request ID %q, the execution %q", result.RequestID, execution.RequestID)
+	}
+	if !result.Exited || result.ExitCode != 3 || result.ErrorClass != v1.ErrorClass_ERROR_CLASS_USER_CODE_ERROR {
+		t.Errorf("Wait() = %+v, want the exit code 3 of the program", result)
+	}
+	if !result.Running || result.Environment == nil {
+		t.Errorf("the result doesn't record the start of the run: %+v", result)
+	}
+}
+
+func TestRunRetriesTheUnavailableRuns(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxRetries  int
+		unavailable int32
+		attempts    int32
+		code        codes.Code
+	}{
+		{name: "retried until the runner is back", maxRetries: 3, unavailable: 2, attempts: 3, code: codes.OK},
+		{name: "retries exhausted", maxRetries: 1, unavailable: 5, attempts: 2, code: codes.Unavailable},
+		{name: "retries disabled", maxRetries: -1, unavailable: 1, attempts: 1, code: codes.Unavailable},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _, flaky := newTestClient(t, client.Options{MaxRetries: test.maxRetries, RetryBackoff: time.Millisecond})
+			flaky.unavailable.Store(test.unavailable)
+			execution, err := c.Run(context.Background(), client.RunSpec{Language: "perl", SourceCode: "1;"})
+			if status.Code(err) != test.code {
+				t.Fatalf("Run() = %v, want %s", err, test.code)
+			}
+			if attempts := flaky.attempts.Load(); attempts != test.attempts {
+				t.Errorf("the run has been attempted %d times, want %d", attempts, test.attempts)
+			}
+			if execution != nil {
+				if _, err := execution.Wait(); err != nil {
+					t.Errorf("Wait() = %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestRunRejectedByTheRunnerIsNotRetried(t *testing.T) {
+	c, _, flaky := newTestClient(t, client.Options{RetryBackoff: time.Millisecond})
+	_, err := c.Run(context.Background(), client.RunSpec{Language: "cobol"})
+	if status.Code(err) != codes.InvalidArgument || client.ErrorClassOf(err) != v1.ErrorClass_ERROR_CLASS_UNSUPPORTED_LANGUAGE {
+		t.Errorf("Run() of an unknown language = %v, class %s", err, client.ErrorClassOf(err))
+	}
+	if attempts := flaky.attempts.Load(); attempts != 1 {
+		t.Errorf("the rejected run has been attempted %d times, want 1", attempts)
+	}
+}
+
+func TestStopStopsTheExecution(t *testing.T) {
+	c, runner, _ := newTestClient(t, client.Options{})
+	runner.Daemon.SetProgram(func(process *dockertest.Process) dockertest.Exit {
+		process.Stdout("sleeping")
+		return process.Sleep()
+	})
+
+	execution, err := c.Run(context.Background(), client.RunSpec{Language: "perl", SourceCode: "sleep;"})
+	if err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	if line := <-execution.Stdout; line != "sleeping" {
+		t.Fatalf("stdout = %q, want the program running", line)
+	}
+	if err := execution.Stop(context.Background(), false); err != nil {
+		t.Fatalf("Stop() = %v", err)
+	}
+	result, _ := execution.Wait()
+	if result.ErrorClass != v1.ErrorClass_ERROR_CLASS_STOPPED_BY_OPERATOR {
+		t.Errorf("the stopped run has the class %s", result.ErrorClass)
+	}
+}
@@ -0,0 +1,225 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	v1 "github.com/Pelfox/codecell-runner/generated"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Result is the outcome of a finished run.
+type Result struct {
+	// RequestID is the request ID of the run.
+	RequestID string
+	// Coalesced reports whether the run has followed an identical run in
+	// flight instead of being executed on its own.
+	Coalesced bool
+	// Exited is true if the program has exited, with ExitCode. It's false if
+	// the run has timed out, been stopped or failed before it.
+	Exited bool
+	// ExitCode is the exit code of the program.
+	ExitCode int64
+	// Preempted is true if the run has been preempted by a higher priority one.
+	Preempted bool
+	// Cancelled is true if the run has been cancelled while queued.
+	Cancelled bool
+	// Environment is what the run has executed on, nil if it hasn't started.
+	Environment *v1.EnvironmentMessage
+	// Running is true if the program has started executing.
+	Running bool
+	// Timings tells where the time went before the program started executing,
+	// nil if it hasn't.
+	Timings *v1.TimingsMessage
+	// ErrorClass is the class of the outcome, from the terminal message or the
+	// status of the failed stream.
+	ErrorClass v1.ErrorClass
+	// Info, Warnings and Errors are the informational, warning and error
+	// messages of the runner, in order.
+	Info, Warnings, Errors []string
+}
+
+// Execution is a started run. Its channels are closed when the run ends, each
+// buffering all of its values, so that the unread ones never hold the others
+// up; what remains unread is dropped once the context of the run is done.
+type Execution struct {
+	// RequestID is the request ID of the run, to stop or look it up by.
+	RequestID string
+	// Stdout are the lines of the standard output of the program.
+	Stdout <-chan string
+	// Stderr are the lines of the standard error of the program.
+	Stderr <-chan string
+	// Stats are the resource usage samples of the container.
+	Stats <-chan *v1.StatisticsMessage
+	// Events are the other messages of the runner as they come, the first
+	// one included: queue positions, the execution environment, informational
+	// messages, warnings, errors and the exit code. They are recorded in the Result too.
+	Events <-chan *v1.RunResponseMessage
+
+	runner v1.RunnerServiceClient
+	done   chan struct{}
+	result Result
+	err    error
+}
+
+// newExecution creates a new instance of Execution relaying the messages of
+// the stream, starting with the already received first one.
+func newExecution(
+	ctx context.Context,
+	runner v1.RunnerServiceClient,
+	stream grpc.ServerStreamingClient[v1.RunResponseMessage],
+	first *v1.RunResponseMessage,
+) *Execution {
+	stdoutIn, stdout := unbounded[string](ctx)
+	stderrIn, stderr := unbounded[string](ctx)
+	statsIn, stats := unbounded[*v1.StatisticsMessage](ctx)
+	eventsIn, events := unbounded[*v1.RunResponseMessage](ctx)
+	execution := &Execution{
+		RequestID: first.GetRequestId(),
+		Stdout:    stdout,
+		Stderr:    stderr,
+		Stats:     stats,
+		Events:    events,
+		runner:    runner,
+		done:      make(chan struct{}),
+		result:    Result{RequestID: first.GetRequestId()},
+	}
+
+	go func() {
+		defer close(execution.done)
+		defer close(stdoutIn)
+		defer close(stderrIn)
+		defer close(statsIn)
+		defer close(eventsIn)
+
+		message := first
+		for {
+			switch message.GetLevel() {
+			case v1.MessageLevel_STDOUT:
+				stdoutIn <- message.GetMessage()
+			case v1.MessageLevel_STDERR:
+				stderrIn <- message.GetMessage()
+			case v1.MessageLevel_STATISTICS:
+				statsIn <- message.GetStatistics()
+			default:
+				execution.record(message)
+				eventsIn <- message
+			}
+
+			var err error
+			if message, err = stream.Recv(); err != nil {
+				if !errors.Is(err, io.EOF) {
+					execution.err = err
+					if execution.result.ErrorClass == v1.ErrorClass_ERROR_CLASS_UNSPECIFIED {
+						execution.result.ErrorClass = ErrorClassOf(err)
+					}
+				}
+				return
+			}
+		}
+	}()
+	return execution
+}
+
+// record records the message in the result of the run.
+func (e *Execution) record(message *v1.RunResponseMessage) {
+	if class := message.GetErrorClass(); class != v1.ErrorClass_ERROR_CLASS_UNSPECIFIED {
+		e.result.ErrorClass = class
+	}
+	switch message.GetLevel() {
+	case v1.MessageLevel_EXIT_CODE:
+		e.result.Exited = true
+		e.result.ExitCode = message.GetExitCode()
+	case v1.MessageLevel_COALESCED:
+		e.result.Coalesced = true
+	case v1.MessageLevel_PREEMPTED:
+		e.result.Preempted = true
+	case v1.MessageLevel_CANCELLED:
+		e.result.Cancelled = true
+	case v1.MessageLevel_STARTED:
+		e.result.Environment = message.GetEnvironment()
+	case v1.MessageLevel_RUNNING:
+		e.result.Running = true
+		e.result.Timings = message.GetTimings()
+	case v1.MessageLevel_INFO:
+		e.result.Info = append(e.result.Info, message.GetMessage())
+	case v1.MessageLevel_WARNING:
+		e.result.Warnings = append(e.result.Warnings, message.GetMessage())
+	case v1.MessageLevel_ERROR:
+		e.result.Errors = append(e.result.Errors, message.GetMessage())
+	}
+}
+
+// ErrorClassOf returns the class of the outcome reported in the status of the
+// failed run, or the unspecified one if it isn't a classified status.
+func ErrorClassOf(err error) v1.ErrorClass {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			if class, ok := v1.ErrorClass_value[info.GetReason()]; ok {
+				return v1.ErrorClass(class)
+			}
+		}
+	}
+	return v1.ErrorClass_ERROR_CLASS_UNSPECIFIED
+}
+
+// Done returns a channel closed when the run ends.
+func (e *Execution) Done() <-chan struct{} {
+	return e.done
+}
+
+// Wait waits for the run to end, returning its result and the status of the
+// stream if it has failed. The channels don't need to be drained first.
+func (e *Execution) Wait() (Result, error) {
+	<-e.done
+	return e.result, e.err
+}
+
+// Stop stops the run, forcefully if force is true. For a coalesced run, it
+// only stops following the identical one.
+func (e *Execution) Stop(ctx context.Context, force bool) error {
+	_, err := e.runner.Stop(ctx, &v1.StopRequest{RequestId: e.RequestID, Force: force})
+	return err
+}
+
+// unbounded returns a channel whose sends never block, queueing the values
+// until they are received. The receiving end is closed once the sending one
+// is, and every queued value is received, or the context is done.
+func unbounded[T any](ctx context.Context) (chan<- T, <-chan T) {
+	in, out := make(chan T), make(chan T)
+	go func() {
+		defer close(out)
+
+		var queue []T
+		receiving := in
+		for receiving != nil || len(queue) > 0 {
+			// sending only while there is something to send
+			var sending chan T
+			var next T
+			if len(queue) > 0 {
+				sending, next = out, queue[0]
+			}
+			select {
+			case value, ok := <-receiving:
+				if !ok {
+					receiving = nil
+					continue
+				}
+				queue = append(queue, value)
+			case sending <- next:
+				queue = queue[1:]
+			case <-ctx.Done():
+				// the relay must never block on a send nobody receives
+				if receiving != nil {
+					for range receiving {
+					}
+				}
+				return
+			}
+		}
+	}()
+	return in, out
+}
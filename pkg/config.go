@@ -1,7 +1,10 @@
 package pkg
 
 import (
+	"fmt"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -16,38 +19,729 @@ const (
 	RuntimeTypeGvisor RuntimeType = "gvisor"
 )
 
-// AppConfig holds the configuration settings for the application.
+// WarmPoolTakeMargin is the minimum remaining lifetime of a warm pool container
+// to be handed to a run, so that the watchdog doesn't reap it mid-claim. The
+// containers living less than that would never be claimed.
+const WarmPoolTakeMargin = 30 * time.Second
+
+// OCIRuntime returns the name of the OCI runtime of the Docker daemon the
+// runtime type maps to, empty for the unsupported ones.
+func (t RuntimeType) OCIRuntime() string {
+	switch t {
+	case RuntimeTypeDocker:
+		return "runc"
+	case RuntimeTypeGvisor:
+		return "runsc"
+	}
+	return ""
+}
+
+// DynamicConfig holds the settings reloaded on SIGHUP or a change of the
+// configuration file, applying to the runs admitted after the reload.
+type DynamicConfig struct {
+	// DefaultTimeout is the execution time limit of the runs without TimeoutSeconds.
+	DefaultTimeout time.Duration `mapstructure:"default_timeout"`
+	// DeadlineTeardownMargin is the part of the client deadline kept for the
+	// teardown and the terminal messages, the execution ending before it.
+	DeadlineTeardownMargin time.Duration `mapstructure:"deadline_teardown_margin"`
+	// MemoryLimit is the memory limit for containers in bytes.
+	MemoryLimit int64 `mapstructure:"memory_limit"`
+	// CPULimit is the CPU limit for containers in nanos.
+	CPULimit int64 `mapstructure:"cpu_limit"`
+	// MaxSourceSize is the maximum size of the submitted source code in bytes.
+	MaxSourceSize int `mapstructure:"max_source_size"`
+	// MaxStdinSize is the maximum total size of the submitted stdin lines in bytes.
+	MaxStdinSize int `mapstructure:"max_stdin_size"`
+	// SubmissionMaxSize is the maximum total size of the files streamed with SubmitRun, in bytes.
+	SubmissionMaxSize int64 `mapstructure:"submission_max_size"`
+	// SubmissionMaxChunks is the maximum number of file chunks streamed with SubmitRun.
+	SubmissionMaxChunks int `mapstructure:"submission_max_chunks"`
+	// SubmissionMaxFileSize is the maximum size of a single file streamed with SubmitRun, in bytes.
+	SubmissionMaxFileSize int64 `mapstructure:"submission_max_file_size"`
+	// SubmissionMaxFiles is the maximum number of files streamed with SubmitRun.
+	SubmissionMaxFiles int `mapstructure:"submission_max_files"`
+	// MaxConcurrentRuns is the maximum number of runs executing at the same time; 0 means unlimited.
+	MaxConcurrentRuns int `mapstructure:"max_concurrent_runs"`
+	// QueueMaxDepth is the maximum number of runs waiting for a free slot; 0 rejects runs over the limit.
+	QueueMaxDepth int `mapstructure:"queue_max_depth"`
+	// QueueMaxWait is how long a run may wait for a free slot before being rejected.
+	QueueMaxWait time.Duration `mapstructure:"queue_max_wait"`
+	// QuotaMaxConcurrent is the default maximum number of simultaneous runs per identity; 0 means unlimited.
+	QuotaMaxConcurrent int `mapstructure:"quota_max_concurrent"`
+	// QuotaRunsPerMinute is the default maximum number of runs per identity per minute; 0 means unlimited.
+	QuotaRunsPerMinute int `mapstructure:"quota_runs_per_minute"`
+	// QuotaOverrides overrides the quotas per identity, e.g. "tenant-a=8/120;bot=1/10".
+	QuotaOverrides string `mapstructure:"quota_overrides"`
+	// AdmissionRetryAfter is the retry delay hinted to clients of rejected runs.
+	AdmissionRetryAfter time.Duration `mapstructure:"admission_retry_after"`
+	// WebhookOutputTail is the number of trailing output bytes included in the callbacks.
+	WebhookOutputTail int `mapstructure:"webhook_output_tail"`
+	// LogLevel is the minimum level of the logged entries: trace, debug, info, warn, error or disabled.
+	LogLevel string `mapstructure:"log_level"`
+	// Languages are the per-language settings, merged over the global ones, see
+	// LanguageConfig. Their image and disabled apply after a restart only, the
+	// images being verified at the startup.
+	Languages map[string]LanguageConfig `mapstructure:"languages"`
+}
+
+// AppConfig holds the configuration settings for the application, the dynamic
+// ones being read from the ConfigStore rather than here once it's set up.
 type AppConfig struct {
-	// Addr is the address to start the gRPC server on.
+	// DynamicConfig are the settings reloaded at runtime, see ConfigStore.
+	DynamicConfig `mapstructure:",squash"`
+
+	// ConfigWatchInterval is how often the configuration file is checked for changes, 0 reloads it on SIGHUP only.
+	ConfigWatchInterval time.Duration `mapstructure:"config_watch_interval"`
+	// LogFormat is the format of the logs, "json" or "console"; empty picks console when stderr is a terminal.
+	LogFormat string `mapstructure:"log_format"`
+	// LogFile is the file the logs are appended to instead of stderr, empty keeps stderr.
+	LogFile string `mapstructure:"log_file"`
+	// LogFileMaxSize is the size in bytes the log file is rotated at, 0 disables rotation.
+	LogFileMaxSize int64 `mapstructure:"log_file_max_size"`
+	// LogFileMaxFiles is the number of rotated log files kept, 0 keeps all of them.
+	LogFileMaxFiles int `mapstructure:"log_file_max_files"`
+	// LogStreamErrorBurst is the number of the errors of sending to the Run streams logged per
+	// LogStreamErrorPeriod across all runs, the rest being dropped; 0 logs all of them.
+	LogStreamErrorBurst int `mapstructure:"log_stream_error_burst"`
+	// LogStreamErrorPeriod is the period of LogStreamErrorBurst.
+	LogStreamErrorPeriod time.Duration `mapstructure:"log_stream_error_period"`
+	// Addr is the address to start the gRPC server on, host:port or unix:///path/to/socket.
 	Addr string `mapstructure:"addr"`
+	// SystemdSocketName selects the socket passed by systemd by its FileDescriptorName, the first one if empty.
+	SystemdSocketName string `mapstructure:"systemd_socket_name"`
+	// UnixSocketMode is the octal file mode of the Unix domain socket.
+	UnixSocketMode string `mapstructure:"unix_socket_mode"`
+	// UnixSocketUID is the owner of the Unix domain socket, -1 to keep the one of the runner.
+	UnixSocketUID int `mapstructure:"unix_socket_uid"`
+	// UnixSocketGID is the group of the Unix domain socket, -1 to keep the one of the runner.
+	UnixSocketGID int `mapstructure:"unix_socket_gid"`
+	// GRPCKeepaliveTime is the idle time after which the server pings the client, below the idle timeouts of the load balancers.
+	GRPCKeepaliveTime time.Duration `mapstructure:"grpc_keepalive_time"`
+	// GRPCKeepaliveTimeout is how long the server waits for the ping acknowledgement before closing the connection.
+	GRPCKeepaliveTimeout time.Duration `mapstructure:"grpc_keepalive_timeout"`
+	// GRPCKeepaliveMinTime is the minimum interval between the client pings, more frequent ones close the connection.
+	GRPCKeepaliveMinTime time.Duration `mapstructure:"grpc_keepalive_min_time"`
+	// GRPCKeepalivePermitWithoutStream allows the client pings on connections without active streams.
+	GRPCKeepalivePermitWithoutStream bool `mapstructure:"grpc_keepalive_permit_without_stream"`
+	// GRPCWebEnabled serves grpc-web alongside native gRPC on Addr, for the browser clients.
+	GRPCWebEnabled bool `mapstructure:"grpc_web_enabled"`
+	// GRPCWebAllowedOrigins are the browser origins allowed to call the server over grpc-web, "*" allowing all.
+	GRPCWebAllowedOrigins []string `mapstructure:"grpc_web_allowed_origins"`
+	// GRPCWebAllowedHeaders are the request headers allowed from the browser origins, on top of the grpc-web ones.
+	GRPCWebAllowedHeaders []string `mapstructure:"grpc_web_allowed_headers"`
+	// GRPCMaxConcurrentStreams is the maximum number of concurrent streams per connection, 0 if unlimited.
+	GRPCMaxConcurrentStreams uint32 `mapstructure:"grpc_max_concurrent_streams"`
+	// GRPCMaxConnectionIdle closes the connections idle for longer, 0 if never.
+	GRPCMaxConnectionIdle time.Duration `mapstructure:"grpc_max_connection_idle"`
+	// GRPCMaxConnectionAge gracefully closes the connections older than this, 0 if never.
+	GRPCMaxConnectionAge time.Duration `mapstructure:"grpc_max_connection_age"`
+	// GRPCMaxConnectionAgeGrace is how long the streams of an aged connection may still run, 0 if unlimited.
+	GRPCMaxConnectionAgeGrace time.Duration `mapstructure:"grpc_max_connection_age_grace"`
+	// MaxRecvMsgSize is the maximum size of a received gRPC message in bytes.
+	MaxRecvMsgSize int `mapstructure:"max_recv_msg_size"`
+	// MaxSendMsgSize is the maximum size of a sent gRPC message in bytes.
+	MaxSendMsgSize int `mapstructure:"max_send_msg_size"`
+	// MaxRequestSize is the maximum serialized size of the requests of the RPCs other than Run
+	// and SubmitRun, which are bounded by MaxRecvMsgSize.
+	MaxRequestSize int `mapstructure:"max_request_size"`
+	// TLSCertFile is the PEM certificate chain of the gRPC server; empty serves plaintext.
+	TLSCertFile string `mapstructure:"tls_cert_file"`
+	// TLSKeyFile is the PEM private key of the TLS certificate.
+	TLSKeyFile string `mapstructure:"tls_key_file"`
+	// TLSReloadInterval is how often the TLS files are checked for changes, 0 reloads them on SIGHUP only.
+	TLSReloadInterval time.Duration `mapstructure:"tls_reload_interval"`
+	// TLSClientCAFile is the PEM bundle of the CAs issuing the client certificates; set, it enables mutual TLS.
+	TLSClientCAFile string `mapstructure:"tls_client_ca_file"`
+	// TLSClientAllowedIdentities are the client certificate identities accepted with mutual TLS, any if empty.
+	TLSClientAllowedIdentities []string `mapstructure:"tls_client_allowed_identities"`
+	// APIKeys are the accepted API keys as "name:sha256hex[:role]"; set, with APIKeysFile, they enable the API key authentication.
+	APIKeys []string `mapstructure:"api_keys"`
+	// APIKeysFile is the file of additional API keys, one definition per line.
+	APIKeysFile string `mapstructure:"api_keys_file"`
+	// APIKeysReloadInterval is how often the API keys file is checked for changes.
+	APIKeysReloadInterval time.Duration `mapstructure:"api_keys_reload_interval"`
+	// JWTJWKSURL is the JWKS the bearer tokens are verified with; set, it enables the JWT authentication.
+	JWTJWKSURL string `mapstructure:"jwt_jwks_url"`
+	// JWTIssuer is the required issuer of the tokens.
+	JWTIssuer string `mapstructure:"jwt_issuer"`
+	// JWTAudience is the required audience of the tokens.
+	JWTAudience string `mapstructure:"jwt_audience"`
+	// JWTJWKSRefreshInterval is how often the JWKS is fetched again.
+	JWTJWKSRefreshInterval time.Duration `mapstructure:"jwt_jwks_refresh_interval"`
+	// JWTClockSkew is the tolerated clock difference when checking the token times.
+	JWTClockSkew time.Duration `mapstructure:"jwt_clock_skew"`
 	// Runtime is the container runtime to use.
 	Runtime RuntimeType `mapstructure:"runtime"`
+	// MaxTimeout is the longest execution time limit the runs may request, 0 if unlimited.
+	MaxTimeout time.Duration `mapstructure:"max_timeout"`
+	// PidsLimit is the maximum number of processes in containers.
+	PidsLimit int64 `mapstructure:"pids_limit"`
+	// TmpfsSize is the size of the /tmp of containers, e.g. "64m".
+	TmpfsSize string `mapstructure:"tmpfs_size"`
+	// DefaultEnv are the "KEY=value" environment variables of containers, under the ones of the technologies.
+	DefaultEnv []string `mapstructure:"default_env"`
+	// DefaultTimezone is the TZ of containers, unless DefaultEnv or the technology sets its own.
+	DefaultTimezone string `mapstructure:"default_timezone"`
+	// MaxMemoryLimit is the highest memory limit any language may be configured with in bytes, 0 if unlimited.
+	MaxMemoryLimit int64 `mapstructure:"max_memory_limit"`
+	// MaxCPULimit is the highest CPU limit any language may be configured with in nanos, 0 if unlimited.
+	MaxCPULimit int64 `mapstructure:"max_cpu_limit"`
+	// MaxPidsLimit is the highest process limit any language may be configured with, 0 if unlimited.
+	MaxPidsLimit int64 `mapstructure:"max_pids_limit"`
 	// EnableStorageOpt indicates whether to enable storage optimizations.
 	EnableStorageOpt bool `mapstructure:"enable_storage_opt"`
-	// MemoryLimit is the memory limit for containers in bytes.
-	MemoryLimit int64 `mapstructure:"memory_limit"`
-	// CPULimit is the CPU limit for containers in nanos.
-	CPULimit int64 `mapstructure:"cpu_limit"`
+	// MemorySwapLimit is the memory plus swap limit for containers in bytes. It
+	// defaults to MemoryLimit, which disables swap entirely.
+	MemorySwapLimit int64 `mapstructure:"memory_swap_limit"`
+	// MemorySwappiness tunes how eagerly container memory is swapped out (0-100,
+	// -1 keeps the host default). Set to 0 to forbid any swap usage explicitly.
+	MemorySwappiness int64 `mapstructure:"memory_swappiness"`
+	// OOMScoreAdj makes containers the preferred victims of the kernel OOM killer.
+	OOMScoreAdj int `mapstructure:"oom_score_adj"`
+	// MemoryReserve is the host memory in bytes kept aside for the daemon and the runner.
+	MemoryReserve int64 `mapstructure:"memory_reserve"`
+	// MemoryOvercommit is the factor the remaining host memory may be oversubscribed by
+	// with the memory limits of active runs; 0 disables the admission check.
+	MemoryOvercommit float64 `mapstructure:"memory_overcommit"`
+	// DiskCheckPath is the path on the disk backing the Docker storage; defaults to the daemon root dir.
+	DiskCheckPath string `mapstructure:"disk_check_path"`
+	// DiskCheckInterval is how often the disk usage is checked.
+	DiskCheckInterval time.Duration `mapstructure:"disk_check_interval"`
+	// DiskSoftThreshold is the used disk fraction above which warnings are logged.
+	DiskSoftThreshold float64 `mapstructure:"disk_soft_threshold"`
+	// DiskHardThreshold is the used disk fraction above which new runs are rejected.
+	DiskHardThreshold float64 `mapstructure:"disk_hard_threshold"`
+	// DiskPruneImages prunes dangling images when the hard threshold is reached.
+	DiskPruneImages bool `mapstructure:"disk_prune_images"`
+	// CompletedRunsRetention is the number of completed runs kept in memory for inspection.
+	CompletedRunsRetention int `mapstructure:"completed_runs_retention"`
+	// WarmPoolSizes is the number of pre-created containers kept per language, e.g. "dotnet=2".
+	WarmPoolSizes string `mapstructure:"warm_pool_sizes"`
+	// WarmPoolTTL is how long a pre-created container is kept before being replaced.
+	WarmPoolTTL time.Duration `mapstructure:"warm_pool_ttl"`
+	// WarmPoolAutoscale resizes the warm pools to the recent demand, with WarmPoolSizes as the maximums.
+	WarmPoolAutoscale bool `mapstructure:"warm_pool_autoscale"`
+	// WarmPoolMinSizes is the minimum number of pre-created containers per language when autoscaling.
+	WarmPoolMinSizes string `mapstructure:"warm_pool_min_sizes"`
+	// WarmPoolScaleWindow is the sliding window the run arrivals are counted over.
+	WarmPoolScaleWindow time.Duration `mapstructure:"warm_pool_scale_window"`
+	// WarmPoolScaleInterval is how often the warm pools are resized.
+	WarmPoolScaleInterval time.Duration `mapstructure:"warm_pool_scale_interval"`
+	// WatchdogInterval is how often the watchdog sweeps the managed containers.
+	WatchdogInterval time.Duration `mapstructure:"watchdog_interval"`
+	// WatchdogGrace is how long past its deadline a container may live before being removed.
+	WatchdogGrace time.Duration `mapstructure:"watchdog_grace"`
+	// AbsoluteMaxRunSeconds is the server-wide cap on the run time of every
+	// container from its creation, whatever the timeout of its run.
+	AbsoluteMaxRunSeconds int `mapstructure:"absolute_max_run_seconds"`
+	// BootTimeout is how long the runtimes telling when the program starts
+	// may boot, on top of the timeout, which counts from the start then.
+	BootTimeout time.Duration `mapstructure:"boot_timeout"`
+	// RunRateLimit is the rate of Run submissions per source address per second; 0 disables the limit.
+	RunRateLimit float64 `mapstructure:"run_rate_limit"`
+	// RunRateBurst is the burst of Run submissions per source address.
+	RunRateBurst int `mapstructure:"run_rate_burst"`
+	// ControlRateLimit is the rate of the other RPCs per source address per second; 0 disables the limit.
+	ControlRateLimit float64 `mapstructure:"control_rate_limit"`
+	// ControlRateBurst is the burst of the other RPCs per source address.
+	ControlRateBurst int `mapstructure:"control_rate_burst"`
+	// RateLimitTTL is how long the rate limits of an idle source address are remembered.
+	RateLimitTTL time.Duration `mapstructure:"rate_limit_ttl"`
+	// AllowedCIDRs are the networks the callers must belong to, any if empty.
+	AllowedCIDRs []string `mapstructure:"allowed_cidrs"`
+	// TrustProxy checks the address forwarded in TrustedProxyHeader instead of the connection peer.
+	TrustProxy bool `mapstructure:"trust_proxy"`
+	// TrustedProxyHeader is the metadata key the trusted proxy forwards the caller address in.
+	TrustedProxyHeader string `mapstructure:"trusted_proxy_header"`
+	// TrustedProxies are the networks of the proxies TrustedProxyHeader is believed from.
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+	// MaxPriority is the highest run priority clients may request: batch, normal or interactive.
+	MaxPriority string `mapstructure:"max_priority"`
+	// MaxPriorityOverrides overrides MaxPriority per identity, e.g. "bot=batch;notebooks=interactive".
+	MaxPriorityOverrides string `mapstructure:"max_priority_overrides"`
+	// PreemptionEnabled allows queued runs to preempt running ones of a lower priority.
+	PreemptionEnabled bool `mapstructure:"preemption_enabled"`
+	// PreemptionWaitThreshold is how long a run waits in the queue before preempting another one.
+	PreemptionWaitThreshold time.Duration `mapstructure:"preemption_wait_threshold"`
+	// IdentityMetadataKey is the gRPC metadata key the fronting platform forwards the client identity in.
+	IdentityMetadataKey string `mapstructure:"identity_metadata_key"`
+	// QuotaMaxIdentities is the maximum number of identities tracked for the quotas.
+	QuotaMaxIdentities int `mapstructure:"quota_max_identities"`
+	// IdleShutdownAfter shuts the runner down after being idle for this long; 0 disables it.
+	IdleShutdownAfter time.Duration `mapstructure:"idle_shutdown_after"`
+	// IdleShutdownWebhook is the URL POSTed to before an idle shutdown, e.g. to deregister the runner.
+	IdleShutdownWebhook string `mapstructure:"idle_shutdown_webhook"`
+	// IdleShutdownGrace is how long a new run may still arrive and cancel an idle shutdown.
+	IdleShutdownGrace time.Duration `mapstructure:"idle_shutdown_grace"`
+	// SharedRegistry is the backend shared by the instances to route Stop calls: empty (disabled) or "redis".
+	SharedRegistry string `mapstructure:"shared_registry"`
+	// SharedRegistryTTL is how long a run entry lives in the shared registry unless refreshed.
+	SharedRegistryTTL time.Duration `mapstructure:"shared_registry_ttl"`
+	// SharedRegistryProxy proxies Stop calls to the owning instance instead of returning its address.
+	SharedRegistryProxy bool `mapstructure:"shared_registry_proxy"`
+	// SharedRegistryCAFile is the CA bundle the certificates of the other instances are verified with,
+	// when serving TLS; empty for the system roots.
+	SharedRegistryCAFile string `mapstructure:"shared_registry_ca_file"`
+	// InstanceAddr is the gRPC address other instances reach this one at.
+	InstanceAddr string `mapstructure:"instance_addr"`
+	// RedisAddr is the address of the Redis server of the shared registry.
+	RedisAddr string `mapstructure:"redis_addr"`
+	// RedisPassword is the password of the Redis server.
+	RedisPassword string `mapstructure:"redis_password"`
+	// RedisDB is the Redis database number.
+	RedisDB int `mapstructure:"redis_db"`
+	// EventsBackend is the broker the run lifecycle events are published to: empty (disabled), "nats" or "kafka".
+	EventsBackend string `mapstructure:"events_backend"`
+	// EventsBufferSize is the number of events buffered for publishing before they are dropped.
+	EventsBufferSize int `mapstructure:"events_buffer_size"`
+	// EventsNATSURL is the URL of the NATS server.
+	EventsNATSURL string `mapstructure:"events_nats_url"`
+	// EventsNATSSubject is the subject prefix of the events, followed by the event type.
+	EventsNATSSubject string `mapstructure:"events_nats_subject"`
+	// EventsKafkaBrokers are the addresses of the Kafka brokers.
+	EventsKafkaBrokers []string `mapstructure:"events_kafka_brokers"`
+	// EventsKafkaTopic is the Kafka topic of the events.
+	EventsKafkaTopic string `mapstructure:"events_kafka_topic"`
+	// RunStore is the embedded store the completed runs are persisted to: empty (disabled) or "bolt".
+	RunStore string `mapstructure:"run_store"`
+	// RunStorePath is the path of the run store database file.
+	RunStorePath string `mapstructure:"run_store_path"`
+	// RunStoreRetention is how long the completed runs are kept in the store.
+	RunStoreRetention time.Duration `mapstructure:"run_store_retention"`
+	// RunStorePruneInterval is how often the expired runs are deleted from the store.
+	RunStorePruneInterval time.Duration `mapstructure:"run_store_prune_interval"`
+	// RunStoreOutput enables storing the capped output of the runs.
+	RunStoreOutput bool `mapstructure:"run_store_output"`
+	// RunStoreOutputLimit is the number of trailing output bytes stored per run.
+	RunStoreOutputLimit int `mapstructure:"run_store_output_limit"`
+	// ArchiveEndpoint is the S3-compatible object storage endpoint the run outputs are archived to, empty disables archival.
+	ArchiveEndpoint string `mapstructure:"archive_endpoint"`
+	// ArchiveBucket is the bucket of the archived outputs.
+	ArchiveBucket string `mapstructure:"archive_bucket"`
+	// ArchiveAccessKey is the access key of the object storage.
+	ArchiveAccessKey string `mapstructure:"archive_access_key"`
+	// ArchiveSecretKey is the secret key of the object storage.
+	ArchiveSecretKey string `mapstructure:"archive_secret_key"`
+	// ArchiveRegion is the region of the bucket, empty to detect it.
+	ArchiveRegion string `mapstructure:"archive_region"`
+	// ArchiveSecure enables TLS for the object storage connections.
+	ArchiveSecure bool `mapstructure:"archive_secure"`
+	// ArchivePrefix is prepended to the object keys, which are the request IDs.
+	ArchivePrefix string `mapstructure:"archive_prefix"`
+	// ArchiveMaxBytes is the maximum number of output bytes archived per run.
+	ArchiveMaxBytes int64 `mapstructure:"archive_max_bytes"`
+	// ArchiveLabel is the run label enabling archival when set to "true", empty disables it.
+	ArchiveLabel string `mapstructure:"archive_label"`
+	// ArchiveSpoolDir is the directory the outputs are spooled to before the upload, the system temp dir if empty.
+	ArchiveSpoolDir string `mapstructure:"archive_spool_dir"`
+	// AuditLogPath is the file the audit log of all runs is appended to, empty disables it.
+	AuditLogPath string `mapstructure:"audit_log_path"`
+	// AuditLogMaxSize is the size in bytes the audit log is rotated at, 0 disables rotation.
+	AuditLogMaxSize int64 `mapstructure:"audit_log_max_size"`
+	// AuditLogMaxFiles is the number of rotated audit log files kept, 0 keeps all of them.
+	AuditLogMaxFiles int `mapstructure:"audit_log_max_files"`
+	// DiscoveryBackend is the service discovery the instance registers itself in: empty (disabled), "consul" or "etcd".
+	DiscoveryBackend string `mapstructure:"discovery_backend"`
+	// DiscoveryTTL is how long the registration lives unless refreshed.
+	DiscoveryTTL time.Duration `mapstructure:"discovery_ttl"`
+	// DiscoveryServiceName is the name of the service the instances are registered as.
+	DiscoveryServiceName string `mapstructure:"discovery_service_name"`
+	// ConsulAddr is the address of the Consul agent.
+	ConsulAddr string `mapstructure:"consul_addr"`
+	// ConsulToken is the ACL token of the Consul agent.
+	ConsulToken string `mapstructure:"consul_token"`
+	// EtcdEndpoints are the endpoints of the etcd cluster.
+	EtcdEndpoints []string `mapstructure:"etcd_endpoints"`
+	// EtcdPrefix is the key prefix of the registrations, followed by the instance address.
+	EtcdPrefix string `mapstructure:"etcd_prefix"`
+	// DedupEnabled enables attaching identical concurrent runs of the same identity to the one in flight.
+	DedupEnabled bool `mapstructure:"dedup_enabled"`
+	// AssetsDir is the directory of the assets the runs can mount, empty disables the assets.
+	AssetsDir string `mapstructure:"assets_dir"`
+	// AssetsMaxPerRun is the maximum number of assets a run can mount.
+	AssetsMaxPerRun int `mapstructure:"assets_max_per_run"`
+	// AssetsMaxRunSize is the maximum total size of the assets a run can mount, in bytes.
+	AssetsMaxRunSize int64 `mapstructure:"assets_max_run_size"`
+	// BuildCacheEnabled enables keeping the build outputs of the successful runs for the identical ones.
+	BuildCacheEnabled bool `mapstructure:"build_cache_enabled"`
+	// BuildCacheDir is the directory the build outputs are kept in.
+	BuildCacheDir string `mapstructure:"build_cache_dir"`
+	// BuildCacheMaxSize is the total size of the kept build outputs in bytes, the least recently used evicted over it.
+	BuildCacheMaxSize int64 `mapstructure:"build_cache_max_size"`
+	// WebhookURL is the callback URL notified of every completed run, unless the request has its own.
+	WebhookURL string `mapstructure:"webhook_url"`
+	// WebhookSecret is the shared secret of the HMAC-SHA256 signature of the callbacks.
+	WebhookSecret string `mapstructure:"webhook_secret"`
+	// WebhookAllowedHosts are the hosts the callback URLs of the requests may point at.
+	WebhookAllowedHosts []string `mapstructure:"webhook_allowed_hosts"`
+	// WebhookDeadline is the total time a callback is retried for.
+	WebhookDeadline time.Duration `mapstructure:"webhook_deadline"`
+	// TracingEndpoint is the OTLP gRPC endpoint the spans are exported to, empty disables tracing.
+	TracingEndpoint string `mapstructure:"tracing_endpoint"`
+	// TracingInsecure disables TLS for the OTLP endpoint.
+	TracingInsecure bool `mapstructure:"tracing_insecure"`
+	// TracingSampleRatio is the fraction of the traces started by the runner that are sampled.
+	TracingSampleRatio float64 `mapstructure:"tracing_sample_ratio"`
+	// EnableReflection registers the gRPC server reflection service, for grpcurl and the like.
+	EnableReflection bool `mapstructure:"enable_reflection"`
+	// EnableChannelz registers the channelz service exposing the connection and stream state.
+	EnableChannelz bool `mapstructure:"enable_channelz"`
+	// HealthCheckInterval is how often the health of the Docker daemon and the languages is checked.
+	HealthCheckInterval time.Duration `mapstructure:"health_check_interval"`
+	// CanaryEnabled runs a hello-world program at the startup, the runner not serving until it passes.
+	CanaryEnabled bool `mapstructure:"canary_enabled"`
+	// CanaryLanguage is the language of the startup canary.
+	CanaryLanguage string `mapstructure:"canary_language"`
+	// CanaryTimeout is the time budget of the startup canary as a whole.
+	CanaryTimeout time.Duration `mapstructure:"canary_timeout"`
+	// CanaryExitOnFailure makes a failed startup canary stop the runner instead of keeping it not serving.
+	CanaryExitOnFailure bool `mapstructure:"canary_exit_on_failure"`
+	// CanaryConformance runs the probes of every available language once the
+	// startup canary has passed, the languages failing one being unavailable.
+	// The technologies are held to their probes by the conformance test, this
+	// checks the images of the host as well.
+	CanaryConformance bool `mapstructure:"canary_conformance"`
+	// MetricsAddr is the address to serve Prometheus metrics on; empty disables it.
+	MetricsAddr string `mapstructure:"metrics_addr"`
+	// GatewayAddr is the address of the REST/SSE gateway for the browser clients; empty disables it.
+	GatewayAddr string `mapstructure:"gateway_addr"`
+	// DetachedRunRetention is how long the messages of a finished gateway or SubmitRun run stay available to Attach.
+	DetachedRunRetention time.Duration `mapstructure:"detached_run_retention"`
+	// DebugEnabled serves pprof, expvar and the goroutine dump on DebugAddr.
+	DebugEnabled bool `mapstructure:"debug_enabled"`
+	// DebugAddr is the address of the debug server, never shared with gRPC.
+	DebugAddr string `mapstructure:"debug_addr"`
+	// DebugLocalhostOnly binds the debug server to the loopback interface, whatever the host of DebugAddr.
+	DebugLocalhostOnly bool `mapstructure:"debug_localhost_only"`
+	// DockerConnectTimeout is how long the runner waits at startup for the Docker
+	// daemon to respond, e.g. when started before it, before giving up.
+	DockerConnectTimeout time.Duration `mapstructure:"docker_connect_timeout"`
+	// RequireUserNamespace refuses to start on a daemon without userns-remap or rootless mode.
+	RequireUserNamespace bool `mapstructure:"require_userns"`
+	// RunnerUID is the numeric ID of the unprivileged user inside runtime images.
+	RunnerUID int `mapstructure:"runner_uid"`
+	// RunnerGID is the numeric ID of the unprivileged group inside runtime images.
+	RunnerGID int `mapstructure:"runner_gid"`
+	// NetworkEnabled allows requests to opt into the allowlisted network.
+	NetworkEnabled bool `mapstructure:"network_enabled"`
+	// NetworkName is the name of the managed bridge network for network-enabled runs.
+	NetworkName string `mapstructure:"network_name"`
+	// NetworkBridge is the host interface name of the managed bridge network.
+	NetworkBridge string `mapstructure:"network_bridge"`
+	// NetworkAllowlist is the list of CIDRs and hostnames reachable from network-enabled runs.
+	NetworkAllowlist []string `mapstructure:"network_allowlist"`
+	// NetworkAllowlistRefreshInterval is how often the hostnames of the allowlist are resolved again.
+	NetworkAllowlistRefreshInterval time.Duration `mapstructure:"network_allowlist_refresh_interval"`
+	// EgressProxyURL is the HTTP(S) proxy network-enabled runs must go through.
+	// When set, the managed network is internal-only, and the allowlist can't be set.
+	EgressProxyURL string `mapstructure:"egress_proxy_url"`
+	// EgressNoProxy is the list of hosts that bypass the egress proxy.
+	EgressNoProxy string `mapstructure:"egress_no_proxy"`
+	// DNSServers are the resolvers used by network-enabled runs instead of the daemon's.
+	DNSServers []string `mapstructure:"dns_servers"`
+	// DNSSearch are the DNS search domains used by network-enabled runs.
+	DNSSearch []string `mapstructure:"dns_search"`
+	// ExtraHosts are "host:ip" entries added to /etc/hosts of network-enabled runs.
+	ExtraHosts []string `mapstructure:"extra_hosts"`
+	// CgroupParent is the cgroup (a slice on the systemd driver) all containers are placed
+	// under. Its own limits cap the aggregate usage of all runs, while MemoryLimit and
+	// CPULimit still apply to every container individually, whichever is hit first.
+	CgroupParent string `mapstructure:"cgroup_parent"`
+	// CPUSetCPUs pins containers to the given host CPUs (e.g. "2-5"). CPULimit stays a
+	// quota, so a container may use up to CPULimit worth of time spread within the set.
+	CPUSetCPUs string `mapstructure:"cpuset_cpus"`
+	// CPUSetMems pins containers to the given NUMA memory nodes.
+	CPUSetMems string `mapstructure:"cpuset_mems"`
+	// CPUSetOverrides overrides CPUSetCPUs per language, e.g. "dotnet=2-3;java=2-3".
+	CPUSetOverrides string `mapstructure:"cpuset_overrides"`
+	// BlkioDevice is the block device backing the Docker storage, used for I/O throttling.
+	BlkioDevice string `mapstructure:"blkio_device"`
+	// BlkioReadBps is the read rate limit in bytes per second (0 disables it).
+	BlkioReadBps uint64 `mapstructure:"blkio_read_bps"`
+	// BlkioWriteBps is the write rate limit in bytes per second (0 disables it).
+	BlkioWriteBps uint64 `mapstructure:"blkio_write_bps"`
+	// BlkioReadIOps is the read rate limit in operations per second (0 disables it).
+	BlkioReadIOps uint64 `mapstructure:"blkio_read_iops"`
+	// BlkioWriteIOps is the write rate limit in operations per second (0 disables it).
+	BlkioWriteIOps uint64 `mapstructure:"blkio_write_iops"`
+	// CustomImageAllowlist is the list of repositories, repository prefixes and
+	// digests admins may run custom images from.
+	CustomImageAllowlist []string `mapstructure:"custom_image_allowlist"`
+	// CosignPublicKey is the path (or KMS URI) of the key runtime images must be signed with.
+	CosignPublicKey string `mapstructure:"cosign_public_key"`
+	// CosignIdentity is the certificate identity required for keyless signatures.
+	CosignIdentity string `mapstructure:"cosign_identity"`
+	// CosignIssuer is the OIDC issuer required for keyless signatures.
+	CosignIssuer string `mapstructure:"cosign_issuer"`
+	// CosignStrict refuses to start the server if any runtime image fails verification.
+	CosignStrict bool `mapstructure:"cosign_strict"`
+	// ImageCheckInterval is how often the runtime images are verified again, besides the image events; 0 disables it.
+	ImageCheckInterval time.Duration `mapstructure:"image_check_interval"`
+	// UlimitNofile is the maximum number of open files in containers.
+	UlimitNofile int64 `mapstructure:"ulimit_nofile"`
+	// UlimitFsize is the maximum size of a file written in containers in bytes.
+	UlimitFsize int64 `mapstructure:"ulimit_fsize"`
+	// UlimitStack is the maximum stack size of container processes in bytes.
+	UlimitStack int64 `mapstructure:"ulimit_stack"`
+	// UlimitCore is the maximum core dump size in bytes; 0 disables core dumps.
+	UlimitCore int64 `mapstructure:"ulimit_core"`
 }
 
-// LoadConfig loads the application configuration from environment variables
-// and sets default values for missing settings.
-func LoadConfig() (*AppConfig, error) {
+// MemoryCapacity returns the total memory limits of active runs the host with
+// the given memory can admit, or 0 if the admission check is disabled.
+func (c *AppConfig) MemoryCapacity(hostMemory int64) int64 {
+	if c.MemoryOvercommit <= 0 || hostMemory <= 0 {
+		return 0
+	}
+	available := max(hostMemory-c.MemoryReserve, 0)
+	return max(int64(float64(available)*c.MemoryOvercommit), 1) // 1 byte still rejects everything
+}
+
+// AbsoluteMaxRunDuration returns the server-wide cap on the run time of every
+// container, from its creation.
+func (c *AppConfig) AbsoluteMaxRunDuration() time.Duration {
+	return time.Duration(c.AbsoluteMaxRunSeconds) * time.Second
+}
+
+// LoadConfig loads the application configuration from the YAML, TOML or JSON
+// file at the given path, if any, and the environment variables overriding it,
+// and sets default values for missing settings. The keys of the file unknown
+// to the configuration are returned as warnings, catching the typos.
+func LoadConfig(path string) (*AppConfig, []string, error) {
 	v := viper.New()
 
 	v.AutomaticEnv()
 	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 
 	// setting default values
+	v.SetDefault("config_watch_interval", 0)
+	v.SetDefault("log_level", "info")
+	v.SetDefault("log_format", "")
+	v.SetDefault("log_file", "")
+	v.SetDefault("log_file_max_size", 100*1024*1024)
+	v.SetDefault("log_file_max_files", 10)
+	v.SetDefault("log_stream_error_burst", 20)
+	v.SetDefault("log_stream_error_period", time.Minute)
 	v.SetDefault("addr", ":50051")
+	v.SetDefault("systemd_socket_name", "")
+	v.SetDefault("unix_socket_mode", "0660")
+	v.SetDefault("unix_socket_uid", -1)
+	v.SetDefault("unix_socket_gid", -1)
+	v.SetDefault("grpc_keepalive_time", 30*time.Second)
+	v.SetDefault("grpc_keepalive_timeout", 10*time.Second)
+	v.SetDefault("grpc_keepalive_min_time", 10*time.Second)
+	v.SetDefault("grpc_keepalive_permit_without_stream", true)
+	v.SetDefault("grpc_max_concurrent_streams", 1000)
+	v.SetDefault("grpc_max_connection_idle", 0)
+	v.SetDefault("grpc_max_connection_age", 0)
+	v.SetDefault("grpc_max_connection_age_grace", 0)
+	v.SetDefault("grpc_web_enabled", false)
+	v.SetDefault("grpc_web_allowed_origins", []string{})
+	v.SetDefault("grpc_web_allowed_headers", []string{"authorization", "x-api-key", "x-request-id"})
+	v.SetDefault("max_recv_msg_size", 16<<20)
+	v.SetDefault("max_send_msg_size", 16<<20)
+	v.SetDefault("max_request_size", 64<<10)
+	v.SetDefault("max_source_size", 8<<20)
+	v.SetDefault("max_stdin_size", 4<<20)
+	v.SetDefault("submission_max_size", 256<<20)
+	v.SetDefault("submission_max_chunks", 65536)
+	v.SetDefault("submission_max_file_size", 64<<20)
+	v.SetDefault("submission_max_files", 1024)
+	v.SetDefault("tls_cert_file", "")
+	v.SetDefault("tls_key_file", "")
+	v.SetDefault("tls_reload_interval", time.Minute)
+	v.SetDefault("tls_client_ca_file", "")
+	v.SetDefault("tls_client_allowed_identities", []string{})
+	v.SetDefault("api_keys", []string{})
+	v.SetDefault("api_keys_file", "")
+	v.SetDefault("api_keys_reload_interval", 30*time.Second)
+	v.SetDefault("jwt_jwks_url", "")
+	v.SetDefault("jwt_issuer", "")
+	v.SetDefault("jwt_audience", "")
+	v.SetDefault("jwt_jwks_refresh_interval", time.Hour)
+	v.SetDefault("jwt_clock_skew", 30*time.Second)
 	v.SetDefault("runtime", RuntimeTypeDocker)
+	v.SetDefault("max_timeout", 0)
+	v.SetDefault("pids_limit", 64)
+	v.SetDefault("tmpfs_size", "64m")
+	v.SetDefault("default_env", []string{"HOME=/tmp"})
+	v.SetDefault("default_timezone", "UTC")
+	v.SetDefault("max_memory_limit", 0)
+	v.SetDefault("max_cpu_limit", 0)
+	v.SetDefault("max_pids_limit", 0)
 	v.SetDefault("enable_storage_opt", false)
+	v.SetDefault("default_timeout", 30*time.Second)
+	v.SetDefault("deadline_teardown_margin", 2*time.Second)
 	v.SetDefault("memory_limit", 512*1024*1024)
+	v.SetDefault("memory_swap_limit", 0)
+	v.SetDefault("memory_swappiness", -1)
+	v.SetDefault("oom_score_adj", 1000)
+	v.SetDefault("memory_reserve", 1024*1024*1024)
+	v.SetDefault("memory_overcommit", 1.0)
+	v.SetDefault("admission_retry_after", 5*time.Second)
+	v.SetDefault("completed_runs_retention", 1000)
+	v.SetDefault("warm_pool_sizes", "")
+	v.SetDefault("warm_pool_ttl", 10*time.Minute)
+	v.SetDefault("warm_pool_autoscale", false)
+	v.SetDefault("warm_pool_min_sizes", "")
+	v.SetDefault("warm_pool_scale_window", 5*time.Minute)
+	v.SetDefault("warm_pool_scale_interval", 30*time.Second)
+	v.SetDefault("watchdog_interval", 30*time.Second)
+	v.SetDefault("watchdog_grace", 30*time.Second)
+	v.SetDefault("absolute_max_run_seconds", 3600)
+	v.SetDefault("boot_timeout", 30*time.Second)
+	v.SetDefault("max_concurrent_runs", 16)
+	v.SetDefault("queue_max_depth", 0)
+	v.SetDefault("queue_max_wait", 30*time.Second)
+	v.SetDefault("run_rate_limit", 1.0)
+	v.SetDefault("run_rate_burst", 10)
+	v.SetDefault("control_rate_limit", 10.0)
+	v.SetDefault("control_rate_burst", 50)
+	v.SetDefault("rate_limit_ttl", 10*time.Minute)
+	v.SetDefault("allowed_cidrs", []string{})
+	v.SetDefault("trust_proxy", false)
+	v.SetDefault("trusted_proxy_header", "x-forwarded-for")
+	v.SetDefault("trusted_proxies", []string{})
+	v.SetDefault("max_priority", "interactive")
+	v.SetDefault("max_priority_overrides", "")
+	v.SetDefault("preemption_enabled", false)
+	v.SetDefault("preemption_wait_threshold", 10*time.Second)
+	v.SetDefault("identity_metadata_key", "x-codecell-identity")
+	v.SetDefault("quota_max_concurrent", 0)
+	v.SetDefault("quota_runs_per_minute", 0)
+	v.SetDefault("quota_overrides", "")
+	v.SetDefault("quota_max_identities", 10000)
+	v.SetDefault("idle_shutdown_after", 0)
+	v.SetDefault("idle_shutdown_webhook", "")
+	v.SetDefault("idle_shutdown_grace", 10*time.Second)
+	v.SetDefault("shared_registry", "")
+	v.SetDefault("shared_registry_ttl", 30*time.Second)
+	v.SetDefault("shared_registry_proxy", true)
+	v.SetDefault("shared_registry_ca_file", "")
+	v.SetDefault("instance_addr", "")
+	v.SetDefault("redis_addr", "localhost:6379")
+	v.SetDefault("redis_password", "")
+	v.SetDefault("redis_db", 0)
+	v.SetDefault("events_backend", "")
+	v.SetDefault("events_buffer_size", 1024)
+	v.SetDefault("events_nats_url", "nats://localhost:4222")
+	v.SetDefault("events_nats_subject", "codecell.runs")
+	v.SetDefault("events_kafka_brokers", []string{"localhost:9092"})
+	v.SetDefault("events_kafka_topic", "codecell.runs")
+	v.SetDefault("run_store", "")
+	v.SetDefault("run_store_path", "codecell-runs.db")
+	v.SetDefault("run_store_retention", 30*24*time.Hour)
+	v.SetDefault("run_store_prune_interval", time.Hour)
+	v.SetDefault("run_store_output", false)
+	v.SetDefault("run_store_output_limit", 102400)
+	v.SetDefault("archive_endpoint", "")
+	v.SetDefault("archive_bucket", "codecell-runs")
+	v.SetDefault("archive_access_key", "")
+	v.SetDefault("archive_secret_key", "")
+	v.SetDefault("archive_region", "")
+	v.SetDefault("archive_secure", true)
+	v.SetDefault("archive_prefix", "runs/")
+	v.SetDefault("archive_max_bytes", 10*1024*1024)
+	v.SetDefault("archive_label", "archive")
+	v.SetDefault("archive_spool_dir", "")
+	v.SetDefault("audit_log_path", "")
+	v.SetDefault("audit_log_max_size", 100*1024*1024)
+	v.SetDefault("audit_log_max_files", 10)
+	v.SetDefault("discovery_backend", "")
+	v.SetDefault("discovery_ttl", 15*time.Second)
+	v.SetDefault("discovery_service_name", "codecell-runner")
+	v.SetDefault("consul_addr", "localhost:8500")
+	v.SetDefault("consul_token", "")
+	v.SetDefault("etcd_endpoints", []string{"localhost:2379"})
+	v.SetDefault("etcd_prefix", "/codecell/runners")
+	v.SetDefault("dedup_enabled", false)
+	v.SetDefault("assets_dir", "")
+	v.SetDefault("assets_max_per_run", 8)
+	v.SetDefault("assets_max_run_size", 1<<30)
+	v.SetDefault("build_cache_enabled", false)
+	v.SetDefault("build_cache_dir", "/var/cache/codecell/builds")
+	v.SetDefault("build_cache_max_size", 1<<30)
+	v.SetDefault("webhook_url", "")
+	v.SetDefault("webhook_secret", "")
+	v.SetDefault("webhook_allowed_hosts", []string{})
+	v.SetDefault("webhook_deadline", 5*time.Minute)
+	v.SetDefault("webhook_output_tail", 4096)
+	v.SetDefault("tracing_endpoint", "")
+	v.SetDefault("tracing_insecure", false)
+	v.SetDefault("tracing_sample_ratio", 1.0)
+	v.SetDefault("enable_reflection", false)
+	v.SetDefault("enable_channelz", false)
+	v.SetDefault("health_check_interval", 5*time.Second)
+	v.SetDefault("canary_enabled", false)
+	v.SetDefault("canary_language", "dotnet")
+	v.SetDefault("canary_timeout", 2*time.Minute)
+	v.SetDefault("canary_exit_on_failure", false)
+	v.SetDefault("canary_conformance", false)
+	v.SetDefault("metrics_addr", ":9090")
+	v.SetDefault("gateway_addr", "")
+	v.SetDefault("detached_run_retention", 5*time.Minute)
+	v.SetDefault("debug_enabled", false)
+	v.SetDefault("debug_addr", ":6060")
+	v.SetDefault("debug_localhost_only", true)
+	v.SetDefault("disk_check_path", "")
+	v.SetDefault("disk_check_interval", 30*time.Second)
+	v.SetDefault("disk_soft_threshold", 0.8)
+	v.SetDefault("disk_hard_threshold", 0.95)
+	v.SetDefault("disk_prune_images", false)
 	v.SetDefault("cpu_limit", 1_000_000_000)
+	v.SetDefault("docker_connect_timeout", 2*time.Minute)
+	v.SetDefault("require_userns", false)
+	v.SetDefault("runner_uid", 1000)
+	v.SetDefault("runner_gid", 1000)
+	v.SetDefault("network_enabled", false)
+	v.SetDefault("network_name", "codecell-egress")
+	v.SetDefault("network_bridge", "codecell0")
+	v.SetDefault("network_allowlist", []string{})
+	v.SetDefault("network_allowlist_refresh_interval", time.Minute)
+	v.SetDefault("egress_proxy_url", "")
+	v.SetDefault("egress_no_proxy", "localhost,127.0.0.1")
+	v.SetDefault("dns_servers", []string{})
+	v.SetDefault("dns_search", []string{})
+	v.SetDefault("extra_hosts", []string{})
+	v.SetDefault("cgroup_parent", "")
+	v.SetDefault("cpuset_cpus", "")
+	v.SetDefault("cpuset_mems", "")
+	v.SetDefault("cpuset_overrides", "")
+	v.SetDefault("blkio_device", "")
+	v.SetDefault("blkio_read_bps", 0)
+	v.SetDefault("blkio_write_bps", 0)
+	v.SetDefault("blkio_read_iops", 0)
+	v.SetDefault("blkio_write_iops", 0)
+	v.SetDefault("custom_image_allowlist", []string{})
+	v.SetDefault("cosign_public_key", "")
+	v.SetDefault("cosign_identity", "")
+	v.SetDefault("cosign_issuer", "")
+	v.SetDefault("cosign_strict", false)
+	v.SetDefault("image_check_interval", time.Minute)
+	v.SetDefault("ulimit_nofile", 1024)
+	v.SetDefault("ulimit_fsize", 100*1024*1024)
+	v.SetDefault("ulimit_stack", 8*1024*1024)
+	v.SetDefault("ulimit_core", 0)
+
+	// every key has a default, so the ones without are unknown, but for the
+	// blocks of the languages, which are checked field by field
+	var warnings []string
+	if path != "" {
+		knownKeys := v.AllKeys()
+		v.SetConfigFile(path)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, nil, fmt.Errorf("failed to read the configuration file: %w", err)
+		}
+		for _, key := range v.AllKeys() {
+			if !slices.Contains(knownKeys, key) && !isLanguageKey(key) {
+				warnings = append(warnings, fmt.Sprintf("unknown key %q in the configuration file", key))
+			}
+		}
+	}
 
 	var config AppConfig
 	if err := v.Unmarshal(&config); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return &config, nil
+	return &config, warnings, nil
 }
@@ -0,0 +1,72 @@
+package pkg
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// ConfigStore holds the snapshot of the dynamic settings, replaced as a whole
+// on reload, so that every run reads a consistent one once, when it arrives.
+type ConfigStore struct {
+	path string
+	boot AppConfig
+
+	current   atomic.Pointer[DynamicConfig]
+	mutex     sync.Mutex // serializes the reloads
+	listeners []func(*DynamicConfig)
+}
+
+// NewConfigStore creates a new instance of ConfigStore starting with the
+// dynamic settings of the boot configuration, loaded from the file at path.
+func NewConfigStore(path string, config *AppConfig) *ConfigStore {
+	store := &ConfigStore{path: path, boot: *config}
+	dynamic := config.DynamicConfig
+	store.current.Store(&dynamic)
+	return store
+}
+
+// Load returns the current snapshot, which must not be modified.
+func (s *ConfigStore) Load() *DynamicConfig {
+	return s.current.Load()
+}
+
+// OnReload registers fn to be called with every new snapshot, for the
+// components holding the settings on their own, e.g. the limiters.
+func (s *ConfigStore) OnReload(fn func(*DynamicConfig)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.listeners = append(s.listeners, fn)
+}
+
+// Reload loads and validates the configuration again, replacing the snapshot
+// only if it's valid. The returned warnings include the boot settings that
+// have changed, which need a restart to apply.
+func (s *ConfigStore) Reload() ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	config, warnings, err := LoadConfig(s.path)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return warnings, err
+	}
+
+	reloaded, boot := *config, s.boot
+	reloaded.DynamicConfig, boot.DynamicConfig = DynamicConfig{}, DynamicConfig{}
+	if !reflect.DeepEqual(reloaded, boot) {
+		warnings = append(warnings, "settings other than the dynamic ones have changed, they apply after a restart")
+	}
+	if !languageBootSettingsEqual(config.Languages, s.boot.Languages) {
+		warnings = append(warnings, "the image or disabled settings of the languages have changed, they apply after a restart")
+	}
+
+	dynamic := config.DynamicConfig
+	s.current.Store(&dynamic)
+	for _, listener := range s.listeners {
+		listener(&dynamic)
+	}
+	return warnings, nil
+}
@@ -0,0 +1,49 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestConfigStoreReloadsTheLanguageLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(contents string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("languages:\n  dotnet:\n    concurrency: 2\n")
+	boot, _, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewConfigStore(path, boot)
+
+	write("languages:\n  dotnet:\n    concurrency: 1\n    memory_limit: 1073741824\n")
+	warnings, err := store.Reload()
+	if err != nil {
+		t.Fatalf("Reload() = %v", err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("Reload() of the language limits warns %q, want them applied", warnings)
+	}
+	if got := boot.LanguageConfig("dotnet", store.Load()); got.Concurrency != 1 || got.MemoryLimit != 1<<30 {
+		t.Errorf("LanguageConfig() after the reload = %+v, want the reloaded limits", got)
+	}
+
+	write("languages:\n  dotnet:\n    image: registry.example/dotnet:9\n    disabled: true\n")
+	warnings, err = store.Reload()
+	if err != nil {
+		t.Fatalf("Reload() = %v", err)
+	}
+	if !slices.ContainsFunc(warnings, func(warning string) bool { return strings.Contains(warning, "apply after a restart") }) {
+		t.Errorf("Reload() of the image of a language warns %q, want it left to the restart", warnings)
+	}
+	if got := boot.LanguageConfig("dotnet", store.Load()); got.Image != "" || got.Disabled {
+		t.Errorf("LanguageConfig() after the reload = %+v, want the image and the availability of the boot", got)
+	}
+}
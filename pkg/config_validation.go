@@ -0,0 +1,221 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// minKeepaliveTime is the shortest keepalive interval gRPC honors.
+const minKeepaliveTime = time.Second
+
+// configValidator collects the problems of the configuration.
+type configValidator struct {
+	errs []error
+}
+
+// check records the problem if the condition doesn't hold.
+func (v *configValidator) check(ok bool, format string, args ...any) {
+	if !ok {
+		v.errs = append(v.errs, fmt.Errorf(format, args...))
+	}
+}
+
+// oneOf checks that the value is one of the allowed choices.
+func (v *configValidator) oneOf(key string, value string, choices ...string) {
+	for _, choice := range choices {
+		if value == choice {
+			return
+		}
+	}
+	v.check(false, "%s must be one of %q, got %q", key, choices, value)
+}
+
+// file checks that the file exists, unless the path is empty.
+func (v *configValidator) file(key string, path string) {
+	if path == "" {
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		v.errs = append(v.errs, fmt.Errorf("%s: %w", key, err))
+	}
+}
+
+// cidrs checks that the values are CIDRs.
+func (v *configValidator) cidrs(key string, values []string) {
+	for _, value := range values {
+		if _, err := netip.ParsePrefix(strings.TrimSpace(value)); err != nil {
+			v.errs = append(v.errs, fmt.Errorf("%s: %w", key, err))
+		}
+	}
+}
+
+// Validate checks the configuration as a whole, returning all of its problems
+// at once rather than the first one.
+func (c *AppConfig) Validate() error {
+	v := &configValidator{}
+
+	v.check(c.ConfigWatchInterval >= 0, "config_watch_interval can't be negative")
+
+	// logging
+	if _, err := zerolog.ParseLevel(c.LogLevel); err != nil {
+		v.errs = append(v.errs, fmt.Errorf("log_level: %w", err))
+	}
+	v.oneOf("log_format", c.LogFormat, "", "json", "console")
+	v.check(c.LogFileMaxSize >= 0 && c.LogFileMaxFiles >= 0, "log_file_max_size and log_file_max_files can't be negative")
+	v.check(c.LogStreamErrorBurst >= 0, "log_stream_error_burst can't be negative")
+	v.check(c.LogStreamErrorBurst == 0 || c.LogStreamErrorPeriod > 0, "log_stream_error_period must be positive")
+
+	// transport
+	v.check(c.GRPCKeepaliveTime >= minKeepaliveTime, "grpc_keepalive_time must be at least %s", minKeepaliveTime)
+	v.check(c.GRPCKeepaliveTimeout > 0, "grpc_keepalive_timeout must be positive")
+	v.check(c.GRPCKeepaliveMinTime > 0, "grpc_keepalive_min_time must be positive")
+	v.check(c.GRPCMaxConnectionIdle >= 0 && c.GRPCMaxConnectionAge >= 0 && c.GRPCMaxConnectionAgeGrace >= 0,
+		"grpc connection age limits can't be negative")
+	v.check(c.MaxRecvMsgSize > 0 && c.MaxSendMsgSize > 0, "max_recv_msg_size and max_send_msg_size must be positive")
+	v.check(c.MaxRequestSize > 0 && c.MaxRequestSize <= c.MaxRecvMsgSize,
+		"max_request_size must be positive and at most max_recv_msg_size (%d)", c.MaxRecvMsgSize)
+	// the submissions must hit the friendlier checks of Run before the transport limit
+	v.check(c.MaxSourceSize > 0 && c.MaxStdinSize > 0 && c.MaxSourceSize+c.MaxStdinSize < c.MaxRecvMsgSize,
+		"max_source_size and max_stdin_size must be positive and sum to less than max_recv_msg_size (%d)", c.MaxRecvMsgSize)
+	v.check(c.SubmissionMaxSize > 0 && c.SubmissionMaxChunks > 0, "submission_max_size and submission_max_chunks must be positive")
+	v.check(c.SubmissionMaxFileSize > 0 && c.SubmissionMaxFiles > 0, "submission_max_file_size and submission_max_files must be positive")
+
+	// TLS and authentication
+	v.check((c.TLSCertFile == "") == (c.TLSKeyFile == ""), "tls_cert_file and tls_key_file must be set together")
+	v.check(c.TLSClientCAFile == "" || c.TLSCertFile != "", "tls_client_ca_file requires tls_cert_file")
+	v.check(c.TLSReloadInterval >= 0, "tls_reload_interval can't be negative")
+	v.file("tls_cert_file", c.TLSCertFile)
+	v.file("tls_key_file", c.TLSKeyFile)
+	v.file("tls_client_ca_file", c.TLSClientCAFile)
+	v.file("api_keys_file", c.APIKeysFile)
+	v.check(c.APIKeysFile == "" || c.APIKeysReloadInterval > 0, "api_keys_reload_interval must be positive")
+	v.check(c.JWTJWKSURL == "" || c.JWTJWKSRefreshInterval > 0, "jwt_jwks_refresh_interval must be positive")
+	if !strings.Contains(c.CosignPublicKey, "://") {
+		v.file("cosign_public_key", c.CosignPublicKey) // KMS URIs aren't files
+	}
+
+	// execution
+	v.oneOf("runtime", string(c.Runtime), string(RuntimeTypeDocker), string(RuntimeTypeGvisor))
+	v.check(c.DefaultTimeout > 0, "default_timeout must be positive")
+	v.check(c.DeadlineTeardownMargin >= 0, "deadline_teardown_margin can't be negative")
+	v.check(c.MemoryLimit >= 0 && c.MemoryReserve >= 0 && c.CPULimit >= 0,
+		"memory_limit, memory_reserve and cpu_limit can't be negative")
+	v.check(c.MemorySwapLimit >= -1, "memory_swap_limit can't be below -1 (unlimited)")
+	v.check(c.MemorySwappiness >= -1 && c.MemorySwappiness <= 100, "memory_swappiness must be between -1 and 100")
+	v.check(c.MemoryOvercommit >= 0, "memory_overcommit can't be negative")
+	v.check(c.UlimitNofile >= 0 && c.UlimitFsize >= 0 && c.UlimitStack >= 0 && c.UlimitCore >= 0,
+		"ulimits can't be negative")
+	v.check(c.DiskSoftThreshold > 0 && c.DiskSoftThreshold <= c.DiskHardThreshold && c.DiskHardThreshold <= 1,
+		"disk thresholds must satisfy 0 < disk_soft_threshold <= disk_hard_threshold <= 1")
+	v.check(c.DiskCheckInterval > 0, "disk_check_interval must be positive")
+	v.check(c.WatchdogInterval > 0 && c.WatchdogGrace >= 0, "watchdog_interval must be positive and watchdog_grace not negative")
+	v.check(c.AbsoluteMaxRunSeconds > 0, "absolute_max_run_seconds must be positive")
+	v.check(c.BootTimeout >= 0, "boot_timeout can't be negative")
+	v.check(c.HealthCheckInterval > 0, "health_check_interval must be positive")
+	v.check(c.DockerConnectTimeout >= 0, "docker_connect_timeout can't be negative")
+	v.check(c.ImageCheckInterval >= 0, "image_check_interval can't be negative")
+	v.check(!c.CanaryEnabled || (c.CanaryLanguage != "" && c.CanaryTimeout > 0),
+		"canary_language and canary_timeout must be set for the startup canary")
+	v.check(c.MaxTimeout >= 0 && c.MaxMemoryLimit >= 0 && c.MaxCPULimit >= 0 && c.MaxPidsLimit >= 0,
+		"max_timeout, max_memory_limit, max_cpu_limit and max_pids_limit can't be negative")
+	v.check(c.PidsLimit > 0, "pids_limit must be positive")
+	if _, err := ParseEnvironment(c.DefaultEnv); err != nil {
+		v.errs = append(v.errs, fmt.Errorf("default_env: %w", err))
+	}
+	v.check(c.DefaultTimezone != "", "default_timezone can't be empty")
+	c.validateLanguage(v, "", c.LanguageConfig("", &c.DynamicConfig))
+	for _, language := range slices.Sorted(maps.Keys(c.Languages)) {
+		override := c.Languages[language]
+		v.check(override.MemoryLimit >= 0 && override.CPULimit >= 0 && override.PidsLimit >= 0 &&
+			override.DefaultTimeout >= 0 && override.MaxTimeout >= 0 && override.Concurrency >= 0,
+			"languages.%s: the limits can't be negative", language)
+		c.validateLanguage(v, "languages."+language+".", c.LanguageConfig(language, &c.DynamicConfig))
+	}
+	v.check(c.WarmPoolTTL > WarmPoolTakeMargin,
+		"warm_pool_ttl must be longer than %s, the lifetime a pool container needs left to be claimed", WarmPoolTakeMargin)
+	v.check(!c.WarmPoolAutoscale || (c.WarmPoolScaleWindow > 0 && c.WarmPoolScaleInterval > 0),
+		"warm_pool_scale_window and warm_pool_scale_interval must be positive")
+
+	// network
+	v.check(c.NetworkAllowlistRefreshInterval >= 0, "network_allowlist_refresh_interval can't be negative")
+	if c.EgressProxyURL != "" {
+		proxyURL, err := url.Parse(c.EgressProxyURL)
+		v.check(err == nil && (proxyURL.Scheme == "http" || proxyURL.Scheme == "https") && proxyURL.Host != "",
+			"egress_proxy_url must be an http or https URL")
+	}
+	// the proxied network has no route but the proxy, whose destinations the
+	// runner can't restrict, so an allowlist would be a false promise
+	v.check(c.EgressProxyURL == "" || len(c.NetworkAllowlist) == 0,
+		"network_allowlist can't be set with egress_proxy_url, the proxy decides the reachable destinations")
+
+	// admission
+	v.check(c.MaxConcurrentRuns >= 0 && c.QueueMaxDepth >= 0 && c.QueueMaxWait >= 0,
+		"max_concurrent_runs, queue_max_depth and queue_max_wait can't be negative")
+	v.check(c.RunRateLimit >= 0 && c.RunRateBurst >= 0 && c.ControlRateLimit >= 0 && c.ControlRateBurst >= 0,
+		"rate limits can't be negative")
+	v.check(c.RateLimitTTL > 0, "rate_limit_ttl must be positive")
+	v.cidrs("allowed_cidrs", c.AllowedCIDRs)
+	v.cidrs("trusted_proxies", c.TrustedProxies)
+	// the forwarded addresses are only believed from the trusted proxies
+	v.check(!c.TrustProxy || len(c.TrustedProxies) > 0, "trusted_proxies must be set with trust_proxy")
+	v.check(c.QuotaMaxConcurrent >= 0 && c.QuotaRunsPerMinute >= 0 && c.QuotaMaxIdentities >= 0,
+		"quotas can't be negative")
+	v.check(c.CompletedRunsRetention >= 0, "completed_runs_retention can't be negative")
+	if _, err := ParseQuotaOverrides(c.QuotaOverrides); err != nil {
+		v.errs = append(v.errs, fmt.Errorf("quota_overrides: %w", err))
+	}
+
+	// backends
+	v.oneOf("shared_registry", c.SharedRegistry, "", "redis")
+	// the entries are refreshed every third of their lifetime
+	v.check(c.SharedRegistry == "" || c.SharedRegistryTTL >= time.Second, "shared_registry_ttl must be at least 1s")
+	v.file("shared_registry_ca_file", c.SharedRegistryCAFile)
+	v.oneOf("events_backend", c.EventsBackend, "", "nats", "kafka")
+	v.check(c.EventsBufferSize >= 0, "events_buffer_size can't be negative")
+	v.oneOf("run_store", c.RunStore, "", "bolt")
+	v.check(c.RunStore == "" || c.RunStorePruneInterval > 0, "run_store_prune_interval must be positive")
+	v.check(c.RunStoreOutputLimit >= 0, "run_store_output_limit can't be negative")
+	v.oneOf("discovery_backend", c.DiscoveryBackend, "", "consul", "etcd")
+	v.check(c.DiscoveryBackend == "" || c.DiscoveryTTL > 0, "discovery_ttl must be positive")
+	v.check(c.AssetsDir == "" || (c.AssetsMaxPerRun > 0 && c.AssetsMaxRunSize > 0),
+		"assets_max_per_run and assets_max_run_size must be positive")
+	v.check(!c.BuildCacheEnabled || (c.BuildCacheDir != "" && c.BuildCacheMaxSize > 0),
+		"build_cache_dir and build_cache_max_size must be set for the build cache")
+	v.check(c.ArchiveMaxBytes >= 0, "archive_max_bytes can't be negative")
+	v.check(c.AuditLogMaxSize >= 0 && c.AuditLogMaxFiles >= 0, "audit_log_max_size and audit_log_max_files can't be negative")
+	v.check(c.WebhookOutputTail >= 0, "webhook_output_tail can't be negative")
+	v.check(c.TracingSampleRatio >= 0 && c.TracingSampleRatio <= 1, "tracing_sample_ratio must be between 0 and 1")
+
+	return errors.Join(v.errs...)
+}
+
+// validateLanguage checks the effective settings of a language against the
+// hard maxima, prefix being the one of its keys.
+func (c *AppConfig) validateLanguage(v *configValidator, prefix string, effective LanguageConfig) {
+	// the limits of 0 are unlimited, which exceeds any maximum
+	v.check(c.MaxMemoryLimit == 0 || (effective.MemoryLimit > 0 && effective.MemoryLimit <= c.MaxMemoryLimit),
+		"%smemory_limit must be positive and at most max_memory_limit (%d)", prefix, c.MaxMemoryLimit)
+	// the memory admission can't bound the runs without a memory limit
+	v.check(c.MemoryOvercommit <= 0 || effective.MemoryLimit > 0,
+		"%smemory_limit must be positive with memory_overcommit", prefix)
+	v.check(c.MaxCPULimit == 0 || (effective.CPULimit > 0 && effective.CPULimit <= c.MaxCPULimit),
+		"%scpu_limit must be positive and at most max_cpu_limit (%d)", prefix, c.MaxCPULimit)
+	v.check(c.MaxPidsLimit == 0 || effective.PidsLimit <= c.MaxPidsLimit,
+		"%spids_limit must be at most max_pids_limit (%d)", prefix, c.MaxPidsLimit)
+	v.check(c.MaxTimeout == 0 || (effective.MaxTimeout <= c.MaxTimeout && effective.DefaultTimeout <= c.MaxTimeout),
+		"%sdefault_timeout and max_timeout must be at most max_timeout (%s)", prefix, c.MaxTimeout)
+	v.check(effective.MaxTimeout == 0 || effective.DefaultTimeout <= effective.MaxTimeout,
+		"%sdefault_timeout must be at most %smax_timeout (%s)", prefix, prefix, effective.MaxTimeout)
+	if size, err := effective.TmpfsBytes(); err != nil || size <= 0 {
+		v.check(false, "%stmpfs_size must be a positive size, got %q", prefix, effective.TmpfsSize)
+	}
+}
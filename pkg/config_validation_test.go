@@ -0,0 +1,175 @@
+package pkg
+
+import (
+	"cmp"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateRejectsTheInvalidSettings(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(config *AppConfig)
+		wantErr   string // empty if the configuration is valid
+	}{
+		{name: "defaults", configure: func(*AppConfig) {}},
+		{name: "unknown runtime", configure: func(config *AppConfig) {
+			config.Runtime = "lxc"
+		}, wantErr: `runtime must be one of ["docker" "gvisor"], got "lxc"`},
+		{name: "negative concurrency", configure: func(config *AppConfig) {
+			config.MaxConcurrentRuns = -1
+		}, wantErr: "max_concurrent_runs, queue_max_depth and queue_max_wait can't be negative"},
+		{name: "keepalive under 1s", configure: func(config *AppConfig) {
+			config.GRPCKeepaliveTime = time.Millisecond
+		}, wantErr: "grpc_keepalive_time must be at least 1s"},
+		{name: "TLS certificate without its key", configure: func(config *AppConfig) {
+			config.TLSCertFile = "/nonexistent/cert.pem"
+		}, wantErr: "tls_cert_file and tls_key_file must be set together"},
+		{name: "shared registry", configure: func(config *AppConfig) {
+			config.SharedRegistry = "redis"
+		}},
+		{name: "shared registry TTL under 1s", configure: func(config *AppConfig) {
+			config.SharedRegistry, config.SharedRegistryTTL = "redis", 2*time.Nanosecond
+		}, wantErr: "shared_registry_ttl must be at least 1s"},
+		{name: "missing shared registry CA", configure: func(config *AppConfig) {
+			config.SharedRegistryCAFile = "/nonexistent/ca.pem"
+		}, wantErr: "shared_registry_ca_file: "},
+		{name: "negative language concurrency", configure: func(config *AppConfig) {
+			config.Languages = map[string]LanguageConfig{"dotnet": {Concurrency: -1}}
+		}, wantErr: "languages.dotnet: the limits can't be negative"},
+		{name: "unlimited memory with the memory admission", configure: func(config *AppConfig) {
+			config.MemoryLimit = 0
+		}, wantErr: "memory_limit must be positive with memory_overcommit"},
+		{name: "unlimited memory of a language", configure: func(config *AppConfig) {
+			config.MemoryLimit, config.Languages = 0, map[string]LanguageConfig{"dotnet": {MemoryLimit: 1 << 30}}
+		}, wantErr: "memory_limit must be positive with memory_overcommit"},
+		{name: "unlimited memory without the memory admission", configure: func(config *AppConfig) {
+			config.MemoryLimit, config.MemoryOvercommit = 0, 0
+		}},
+		{name: "warm pool TTL within the take margin", configure: func(config *AppConfig) {
+			config.WarmPoolTTL = WarmPoolTakeMargin
+		}, wantErr: "warm_pool_ttl must be longer than 30s"},
+		{name: "warm pool TTL past the take margin", configure: func(config *AppConfig) {
+			config.WarmPoolTTL = WarmPoolTakeMargin + time.Second
+		}},
+		{name: "egress proxy", configure: func(config *AppConfig) {
+			config.EgressProxyURL = "http://proxy.internal:3128"
+		}},
+		{name: "egress proxy without a scheme", configure: func(config *AppConfig) {
+			config.EgressProxyURL = "proxy.internal:3128"
+		}, wantErr: "egress_proxy_url must be an http or https URL"},
+		{name: "egress proxy with the allowlist", configure: func(config *AppConfig) {
+			config.EgressProxyURL, config.NetworkAllowlist = "http://proxy.internal:3128", []string{"192.0.2.0/24"}
+		}, wantErr: "network_allowlist can't be set with egress_proxy_url"},
+		{name: "no rate limit TTL", configure: func(config *AppConfig) {
+			config.RateLimitTTL = 0
+		}, wantErr: "rate_limit_ttl must be positive"},
+		{name: "trusted proxies", configure: func(config *AppConfig) {
+			config.TrustProxy, config.TrustedProxies = true, []string{"10.0.0.0/8", "fd00::/8"}
+		}},
+		{name: "trust proxy without trusted proxies", configure: func(config *AppConfig) {
+			config.TrustProxy = true
+		}, wantErr: "trusted_proxies must be set with trust_proxy"},
+		{name: "invalid trusted proxy", configure: func(config *AppConfig) {
+			config.TrustProxy, config.TrustedProxies = true, []string{"10.0.0.1"}
+		}, wantErr: "trusted_proxies: "},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, _, err := LoadConfig("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.configure(config)
+			err = config.Validate()
+			if test.wantErr == "" && err != nil || test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Errorf("Validate() = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfigTakesTheEnvironmentOverTheFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string // the YAML configuration file, none if empty
+		ext      string // the extension of the file, .yaml if empty
+		env      map[string]string
+		runs     int
+		timeout  time.Duration
+		level    string
+		warnings []string
+	}{
+		{name: "defaults", runs: 16, timeout: 30 * time.Second, level: "info"},
+		{name: "file over the defaults", file: "max_concurrent_runs: 4\ndefault_timeout: 1m\n",
+			runs: 4, timeout: time.Minute, level: "info"},
+		{name: "TOML file", file: "max_concurrent_runs = 4\ndefault_timeout = \"1m\"\n", ext: ".toml",
+			runs: 4, timeout: time.Minute, level: "info"},
+		{name: "environment over the defaults", env: map[string]string{"LOG_LEVEL": "debug"},
+			runs: 16, timeout: 30 * time.Second, level: "debug"},
+		{name: "environment over the file", file: "max_concurrent_runs: 4\nlog_level: warn\n",
+			env:  map[string]string{"MAX_CONCURRENT_RUNS": "8"},
+			runs: 8, timeout: 30 * time.Second, level: "warn"},
+		{name: "unknown keys", file: "max_concurent_runs: 4\nlanguages:\n  dotnet:\n    concurrency: 2\n",
+			runs: 16, timeout: 30 * time.Second, level: "info",
+			warnings: []string{`unknown key "max_concurent_runs" in the configuration file`}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+			var path string
+			if test.file != "" {
+				path = filepath.Join(t.TempDir(), "config"+cmp.Or(test.ext, ".yaml"))
+				if err := os.WriteFile(path, []byte(test.file), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			config, warnings, err := LoadConfig(path)
+			if err != nil {
+				t.Fatalf("LoadConfig() = %v", err)
+			}
+			if config.MaxConcurrentRuns != test.runs || config.DefaultTimeout != test.timeout || config.LogLevel != test.level {
+				t.Errorf("LoadConfig() = %d runs, timeout %s, level %q, want %d, %s, %q", config.MaxConcurrentRuns,
+					config.DefaultTimeout, config.LogLevel, test.runs, test.timeout, test.level)
+			}
+			if !slices.Equal(warnings, test.warnings) {
+				t.Errorf("LoadConfig() warns %q, want %q", warnings, test.warnings)
+			}
+		})
+	}
+}
+
+func TestLoadConfigRejectsTheMalformedValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("default_timeout: soon\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), "default_timeout") {
+		t.Errorf("LoadConfig() of a malformed duration = %v, want an error naming the key", err)
+	}
+	if _, _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("LoadConfig() of a missing file succeeds")
+	}
+}
+
+func TestValidateReportsEveryProblemAtOnce(t *testing.T) {
+	config, _, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.LogLevel = "loud"
+	config.RateLimitTTL = 0
+	config.TLSCertFile = "/nonexistent/cert.pem"
+	err = config.Validate()
+	for _, want := range []string{"log_level: ", "rate_limit_ttl must be positive", "tls_cert_file: "} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() = %v, want it to report %q", err, want)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package pkg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseCPUList parses a Linux CPU list (e.g. "0-2,5") into the sorted set of CPU numbers.
+func ParseCPUList(list string) ([]int, error) {
+	seen := make(map[int]struct{})
+	var cpus []int
+
+	for _, part := range strings.Split(strings.TrimSpace(list), ",") {
+		if part == "" {
+			continue
+		}
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid cpu %q in list %q", first, list)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(last); err != nil || end < start {
+				return nil, fmt.Errorf("invalid cpu range %q in list %q", part, list)
+			}
+		}
+		for cpu := start; cpu <= end; cpu++ {
+			if _, ok := seen[cpu]; !ok {
+				seen[cpu] = struct{}{}
+				cpus = append(cpus, cpu)
+			}
+		}
+	}
+
+	if len(cpus) == 0 {
+		return nil, fmt.Errorf("empty cpu list %q", list)
+	}
+	return cpus, nil
+}
+
+// ParseCPUSetOverrides parses per-language cpuset overrides in the
+// "language=cpus;language=cpus" format, e.g. "dotnet=2-3;java=2,3".
+func ParseCPUSetOverrides(overrides string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, entry := range strings.Split(overrides, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		language, cpus, ok := strings.Cut(entry, "=")
+		if !ok || language == "" || cpus == "" {
+			return nil, fmt.Errorf("invalid cpuset override %q", entry)
+		}
+		result[strings.TrimSpace(language)] = strings.TrimSpace(cpus)
+	}
+	return result, nil
+}
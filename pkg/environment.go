@@ -0,0 +1,62 @@
+package pkg
+
+import (
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// redactedValue replaces the values of the secret-looking variables.
+const redactedValue = "<redacted>"
+
+// secretMarkers are the parts of the names of the secret-looking variables.
+var secretMarkers = []string{"SECRET", "TOKEN", "PASSWORD", "PASSWD", "CREDENTIAL", "API_KEY", "PRIVATE_KEY", "AUTH"}
+
+// ParseEnvironment parses the "KEY=value" environment variables.
+func ParseEnvironment(variables []string) (map[string]string, error) {
+	environment := make(map[string]string, len(variables))
+	for _, variable := range variables {
+		key, value, ok := strings.Cut(variable, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid environment variable %q, expected KEY=value", variable)
+		}
+		environment[key] = value
+	}
+	return environment, nil
+}
+
+// MergeEnvironment merges the layers of environment variables, the later ones
+// overriding the earlier ones, into the "KEY=value" list sorted by key, so that
+// the same layers always give the same environment.
+func MergeEnvironment(layers ...map[string]string) []string {
+	merged := make(map[string]string)
+	for _, layer := range layers {
+		maps.Copy(merged, layer)
+	}
+
+	environment := make([]string, 0, len(merged))
+	for _, key := range slices.Sorted(maps.Keys(merged)) {
+		environment = append(environment, key+"="+merged[key])
+	}
+	return environment
+}
+
+// RedactEnvironment returns the "KEY=value" environment variables as a map,
+// the values of the secret-looking ones replaced, as well as the passwords of
+// the URLs, so that the environment can be shown for debugging.
+func RedactEnvironment(environment []string) map[string]string {
+	redacted := make(map[string]string, len(environment))
+	for _, variable := range environment {
+		key, value, _ := strings.Cut(variable, "=")
+		upper := strings.ToUpper(key)
+		if slices.ContainsFunc(secretMarkers, func(marker string) bool { return strings.Contains(upper, marker) }) {
+			value = redactedValue
+		} else if parsed, err := url.Parse(value); err == nil && parsed.User != nil {
+			value = parsed.Redacted()
+		}
+		redacted[key] = value
+	}
+	return redacted
+}
@@ -0,0 +1,194 @@
+package pkg
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// ErrSpoolLimit is returned for the chunks over the limits of the spool.
+var ErrSpoolLimit = errors.New("submission exceeds the limit")
+
+// FileSpool holds the files of a streamed submission in a temporary directory,
+// so that the large submissions never sit in memory.
+type FileSpool struct {
+	dir         string
+	maxSize     int64
+	maxChunks   int
+	maxFileSize int64
+	maxFiles    int
+
+	sizes  map[string]int64 // ID = path in the workspace
+	size   int64
+	chunks int
+}
+
+// NewFileSpool creates a new instance of FileSpool accepting up to maxSize
+// bytes in up to maxChunks chunks, and up to maxFiles files of up to
+// maxFileSize bytes each.
+func NewFileSpool(maxSize int64, maxChunks int, maxFileSize int64, maxFiles int) (*FileSpool, error) {
+	dir, err := os.MkdirTemp("", "codecell-submission-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the submission spool: %w", err)
+	}
+	return &FileSpool{
+		dir:         dir,
+		maxSize:     maxSize,
+		maxChunks:   maxChunks,
+		maxFileSize: maxFileSize,
+		maxFiles:    maxFiles,
+		sizes:       make(map[string]int64),
+	}, nil
+}
+
+// WriteChunk writes the data at the offset of the file, rejecting the chunks
+// over the limits. Rewriting a part of a file doesn't count towards the size.
+func (s *FileSpool) WriteChunk(name string, offset int64, data []byte) error {
+	name, err := SanitizePath(name)
+	if err != nil {
+		return err
+	}
+	if offset < 0 {
+		return fmt.Errorf("invalid offset %d of %q", offset, name)
+	}
+	if s.chunks++; s.chunks > s.maxChunks {
+		return fmt.Errorf("%w of %d chunks", ErrSpoolLimit, s.maxChunks)
+	}
+	current, exists := s.sizes[name]
+	if !exists && len(s.sizes) >= s.maxFiles {
+		return fmt.Errorf("%w of %d files", ErrSpoolLimit, s.maxFiles)
+	}
+	end := offset + int64(len(data))
+	if end > s.maxFileSize {
+		return fmt.Errorf("%w of %d bytes per file, for %q", ErrSpoolLimit, s.maxFileSize, name)
+	}
+	size := s.size
+	if end > current {
+		size += end - current
+	}
+	if size > s.maxSize {
+		return fmt.Errorf("%w of %d bytes", ErrSpoolLimit, s.maxSize)
+	}
+
+	target := filepath.Join(s.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(target), 0o700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteAt(data, offset); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	s.sizes[name] = max(s.sizes[name], end)
+	s.size = size
+	return nil
+}
+
+// Size returns the total size of the spooled files.
+func (s *FileSpool) Size() int64 {
+	return s.size
+}
+
+// WriteTar writes the spooled files into the tar archive, streaming them from
+// the disk.
+func (s *FileSpool) WriteTar(tarWriter *tar.Writer, owner FileOwner) error {
+	return s.writeTar(newTarBuilder(tarWriter, owner))
+}
+
+// writeTar writes the spooled files, sorted by path, with the builder.
+func (s *FileSpool) writeTar(builder *tarBuilder) error {
+	names := make([]string, 0, len(s.sizes))
+	for name := range s.sizes {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		if err := s.writeTarFile(builder, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTarFile writes a single spooled file into the tar archive.
+func (s *FileSpool) writeTarFile(builder *tarBuilder, name string) error {
+	file, err := os.Open(filepath.Join(s.dir, filepath.FromSlash(name)))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := builder.writeHeader(name, s.sizes[name], 0, nil); err != nil {
+		return err
+	}
+	_, err = io.Copy(builder.writer, file)
+	return err
+}
+
+// Close removes the spooled files.
+func (s *FileSpool) Close() error {
+	return os.RemoveAll(s.dir)
+}
+
+// AppendSpoolToTar returns the tar archive of the base entries followed by the
+// spooled files, written as it's read, so that its size never matters. It must
+// be closed if it isn't read to the end.
+func AppendSpoolToTar(base io.Reader, spool *FileSpool, owner FileOwner) io.ReadCloser {
+	reader, writer := io.Pipe()
+	go func() {
+		builder := newTarBuilder(tar.NewWriter(writer), owner)
+		err := copyTarEntries(builder.writer, tar.NewReader(base), builder.record)
+		if err == nil {
+			err = spool.writeTar(builder)
+		}
+		if err == nil {
+			err = builder.writer.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+	return reader
+}
+
+// CopyTarArchive copies the entries of the archive into the writer, so that an
+// archive of unknown origin can be passed on: the entries other than regular
+// files and directories are rejected, as well as the escaping paths.
+func CopyTarArchive(tarWriter *tar.Writer, archive io.Reader) error {
+	return copyTarEntries(tarWriter, tar.NewReader(archive), nil)
+}
+
+// copyTarEntries copies the checked entries of the archive into the writer,
+// passing their headers to record, if any.
+func copyTarEntries(tarWriter *tar.Writer, tarReader *tar.Reader, record func(*tar.Header)) error {
+	for {
+		hdr, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := checkTarEntry(hdr); err != nil {
+			return err
+		}
+		if record != nil {
+			record(hdr)
+		}
+		if err := tarWriter.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tarWriter, tarReader); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package pkg
+
+import (
+	"strings"
+
+	"github.com/distribution/reference"
+)
+
+// MatchImageAllowlist reports whether the given image reference is permitted
+// by the allowlist. Entries are either repositories ("registry/team/image"),
+// allowing any tag or digest of it, repository prefixes ending with "/"
+// ("registry/team/"), or pinned digests ("registry/team/image@sha256:...").
+func MatchImageAllowlist(image string, allowlist []string) bool {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return false
+	}
+	repository := named.Name()
+	digested, isDigested := named.(reference.Digested)
+
+	for _, entry := range allowlist {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if strings.HasSuffix(entry, "/") {
+			if strings.HasPrefix(repository, entry) {
+				return true
+			}
+			continue
+		}
+
+		allowed, err := reference.ParseNormalizedNamed(entry)
+		if err != nil || allowed.Name() != repository {
+			continue
+		}
+		if allowedDigest, ok := allowed.(reference.Digested); ok {
+			// pinned entries require the very same digest
+			if isDigested && digested.Digest() == allowedDigest.Digest() {
+				return true
+			}
+			continue
+		}
+		return true
+	}
+	return false
+}
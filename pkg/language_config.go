@@ -0,0 +1,118 @@
+package pkg
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+// languageConfigKeys are the keys of a language block, under "languages.<name>".
+var languageConfigKeys = []string{
+	"disabled",
+	"image",
+	"memory_limit",
+	"cpu_limit",
+	"pids_limit",
+	"default_timeout",
+	"max_timeout",
+	"tmpfs_size",
+	"concurrency",
+}
+
+// LanguageConfig holds the settings of the runs of a single language, merged
+// over the global ones, the zero values keeping the global ones.
+type LanguageConfig struct {
+	// Disabled makes the language unavailable for runs.
+	Disabled bool `mapstructure:"disabled"`
+	// Image replaces the runtime image of the language.
+	Image string `mapstructure:"image"`
+	// MemoryLimit is the memory limit for containers in bytes.
+	MemoryLimit int64 `mapstructure:"memory_limit"`
+	// CPULimit is the CPU limit for containers in nanos.
+	CPULimit int64 `mapstructure:"cpu_limit"`
+	// PidsLimit is the maximum number of processes in containers.
+	PidsLimit int64 `mapstructure:"pids_limit"`
+	// DefaultTimeout is the execution time limit of the runs without TimeoutSeconds.
+	DefaultTimeout time.Duration `mapstructure:"default_timeout"`
+	// MaxTimeout is the longest execution time limit the runs may request, 0 if unlimited.
+	MaxTimeout time.Duration `mapstructure:"max_timeout"`
+	// TmpfsSize is the size of the /tmp of containers, e.g. "64m".
+	TmpfsSize string `mapstructure:"tmpfs_size"`
+	// Concurrency is the maximum number of simultaneous runs of the language,
+	// under the global limit; 0 keeps the default of its technology.
+	Concurrency int `mapstructure:"concurrency"`
+}
+
+// Merge returns the settings with the zero values taken from the defaults.
+func (c LanguageConfig) Merge(defaults LanguageConfig) LanguageConfig {
+	merged := c
+	if merged.Image == "" {
+		merged.Image = defaults.Image
+	}
+	if merged.MemoryLimit == 0 {
+		merged.MemoryLimit = defaults.MemoryLimit
+	}
+	if merged.CPULimit == 0 {
+		merged.CPULimit = defaults.CPULimit
+	}
+	if merged.PidsLimit == 0 {
+		merged.PidsLimit = defaults.PidsLimit
+	}
+	if merged.DefaultTimeout == 0 {
+		merged.DefaultTimeout = defaults.DefaultTimeout
+	}
+	if merged.MaxTimeout == 0 {
+		merged.MaxTimeout = defaults.MaxTimeout
+	}
+	if merged.TmpfsSize == "" {
+		merged.TmpfsSize = defaults.TmpfsSize
+	}
+	return merged
+}
+
+// TmpfsBytes returns the size of the /tmp of containers in bytes.
+func (c LanguageConfig) TmpfsBytes() (int64, error) {
+	return units.RAMInBytes(c.TmpfsSize)
+}
+
+// LanguageConfig returns the effective settings of the runs of the language,
+// its block merged over the global settings, the dynamic ones and the block
+// taken from the given snapshot, but for the image and the availability of the
+// boot configuration. The unknown languages, e.g. of the custom images, get
+// the global settings.
+func (c *AppConfig) LanguageConfig(language string, dynamic *DynamicConfig) LanguageConfig {
+	block := dynamic.Languages[language]
+	block.Image, block.Disabled = c.Languages[language].Image, c.Languages[language].Disabled
+	return block.Merge(LanguageConfig{
+		MemoryLimit:    dynamic.MemoryLimit,
+		CPULimit:       dynamic.CPULimit,
+		PidsLimit:      c.PidsLimit,
+		DefaultTimeout: dynamic.DefaultTimeout,
+		MaxTimeout:     c.MaxTimeout,
+		TmpfsSize:      c.TmpfsSize,
+	})
+}
+
+// languageBootSettingsEqual reports whether the blocks have the same image and
+// availability settings, which apply after a restart only.
+func languageBootSettingsEqual(blocks map[string]LanguageConfig, other map[string]LanguageConfig) bool {
+	for _, language := range slices.Concat(slices.Collect(maps.Keys(blocks)), slices.Collect(maps.Keys(other))) {
+		if blocks[language].Image != other[language].Image || blocks[language].Disabled != other[language].Disabled {
+			return false
+		}
+	}
+	return true
+}
+
+// isLanguageKey reports whether the key is a setting of a language block.
+func isLanguageKey(key string) bool {
+	block, ok := strings.CutPrefix(key, "languages.")
+	if !ok {
+		return false
+	}
+	_, field, ok := strings.Cut(block, ".")
+	return ok && slices.Contains(languageConfigKeys, field)
+}
@@ -0,0 +1,26 @@
+package pkg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParsePoolSizes parses per-language warm pool sizes in the
+// "language=size;language=size" format, e.g. "dotnet=2;python=4".
+func ParsePoolSizes(sizes string) (map[string]int, error) {
+	result := make(map[string]int)
+	for _, entry := range strings.Split(sizes, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		language, value, ok := strings.Cut(entry, "=")
+		size, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || language == "" || err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid warm pool size %q", entry)
+		}
+		result[strings.TrimSpace(language)] = size
+	}
+	return result, nil
+}
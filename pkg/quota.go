@@ -0,0 +1,43 @@
+package pkg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Quota limits the runs of a single client identity; zero fields are unlimited.
+type Quota struct {
+	// MaxConcurrent is the maximum number of simultaneous runs.
+	MaxConcurrent int
+	// RunsPerMinute is the maximum number of runs started within a minute.
+	RunsPerMinute int
+}
+
+// ParseQuotaOverrides parses per-identity quotas in the
+// "identity=concurrent/per-minute;..." format, e.g. "tenant-a=8/120;bot=1/10".
+func ParseQuotaOverrides(overrides string) (map[string]Quota, error) {
+	result := make(map[string]Quota)
+	for _, entry := range strings.Split(overrides, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		identity, limits, ok := strings.Cut(entry, "=")
+		concurrent, perMinute, hasRate := strings.Cut(limits, "/")
+		if !ok || !hasRate || strings.TrimSpace(identity) == "" {
+			return nil, fmt.Errorf("invalid quota override %q", entry)
+		}
+
+		var quota Quota
+		var err error
+		if quota.MaxConcurrent, err = strconv.Atoi(strings.TrimSpace(concurrent)); err != nil || quota.MaxConcurrent < 0 {
+			return nil, fmt.Errorf("invalid concurrent runs quota in override %q", entry)
+		}
+		if quota.RunsPerMinute, err = strconv.Atoi(strings.TrimSpace(perMinute)); err != nil || quota.RunsPerMinute < 0 {
+			return nil, fmt.Errorf("invalid runs per minute quota in override %q", entry)
+		}
+		result[strings.TrimSpace(identity)] = quota
+	}
+	return result, nil
+}
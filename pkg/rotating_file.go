@@ -0,0 +1,118 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// RotatingFile is a file appended to, rotated once a write would grow it over
+// the maximum size, e.g. for the application logs.
+type RotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+// NewRotatingFile creates a new instance of RotatingFile appending to the file
+// at the given path, rotated at maxSize bytes unless it's 0, keeping up to
+// maxFiles rotated files unless it's 0.
+func NewRotatingFile(path string, maxSize int64, maxFiles int) (*RotatingFile, error) {
+	file := &RotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := file.open(); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Write appends the data, rotating the file first if it would grow over the
+// maximum size. The data is never split across the files.
+func (f *RotatingFile) Write(data []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(data)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			// writing to a closed file fails, reporting the rotation error is more useful
+			if f.file == nil {
+				return 0, err
+			}
+			fmt.Fprintf(os.Stderr, "failed to rotate the log file: %v\n", err)
+		}
+	}
+	n, err := f.file.Write(data)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close closes the file.
+func (f *RotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// open opens the current file for appending; the caller must hold the mutex.
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// rotate renames the current file after the current time and opens a new
+// one, deleting the oldest rotated files over the maximum; the caller must
+// hold the mutex.
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	rotated := f.path + "." + time.Now().UTC().Format("20060102T150405.000000000")
+	renameErr := os.Rename(f.path, rotated)
+	// reopening even if the rename has failed, so that the logs keep flowing
+	if err := f.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+
+	if f.maxFiles > 0 {
+		// the timestamp suffixes sort chronologically
+		files, err := filepath.Glob(f.path + ".*")
+		if err != nil {
+			return err
+		}
+		slices.Sort(files)
+		for len(files) > f.maxFiles {
+			if err := os.Remove(files[0]); err != nil {
+				return err
+			}
+			files = files[1:]
+		}
+	}
+	return nil
+}
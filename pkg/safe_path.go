@@ -0,0 +1,65 @@
+package pkg
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	// maxPathLength is the maximum length of a workspace path.
+	maxPathLength = 4096
+	// maxNameLength is the maximum length of a single element of a workspace path.
+	maxNameLength = 255
+)
+
+// ErrInvalidPath is returned for the workspace paths of the files that could
+// land outside of the workspace, or that the container filesystem can't hold.
+var ErrInvalidPath = errors.New("invalid file path")
+
+// SanitizePath normalizes the slash-separated workspace path of a file named by
+// the user, rejecting the empty, the absolute and the escaping ones, as well as
+// those with backslashes or NUL bytes, before they ever reach an archive.
+func SanitizePath(name string) (string, error) {
+	invalid := func(reason string) (string, error) {
+		return "", fmt.Errorf("%w %q: %s", ErrInvalidPath, name, reason)
+	}
+	switch {
+	case name == "":
+		return invalid("it's empty")
+	case strings.ContainsRune(name, 0):
+		return invalid("it contains a NUL byte")
+	case strings.ContainsRune(name, '\\'):
+		return invalid("it contains a backslash, the paths are slash-separated")
+	case path.IsAbs(name):
+		return invalid("it's absolute, the paths are relative to the workspace")
+	}
+
+	cleaned := path.Clean(name)
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return invalid("it escapes the workspace")
+	}
+	if len(cleaned) > maxPathLength {
+		return invalid(fmt.Sprintf("it's longer than %d bytes", maxPathLength))
+	}
+	for element := range strings.SplitSeq(cleaned, "/") {
+		if len(element) > maxNameLength {
+			return invalid(fmt.Sprintf("it has an element longer than %d bytes", maxNameLength))
+		}
+	}
+	return cleaned, nil
+}
+
+// checkTarEntry checks that the entry is a regular file or a directory with a
+// path within the root of the archive, so that no link ever reaches the
+// container filesystem.
+func checkTarEntry(hdr *tar.Header) error {
+	if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeDir {
+		return fmt.Errorf("%w %q: entries of type %q aren't allowed, only regular files and directories",
+			ErrInvalidPath, hdr.Name, hdr.Typeflag)
+	}
+	_, err := SanitizePath(hdr.Name)
+	return err
+}
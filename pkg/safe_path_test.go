@@ -0,0 +1,80 @@
+package pkg
+
+import (
+	"errors"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestSanitizePath(t *testing.T) {
+	tests := []struct {
+		name string
+		want string // empty if the path is rejected
+	}{
+		{name: "main.py", want: "main.py"},
+		{name: "src/./lib//util.py", want: "src/lib/util.py"},
+		{name: "src/../main.py", want: "main.py"},
+		{name: "dir/", want: "dir"},
+		{name: "..data", want: "..data"},
+		{name: ""},
+		{name: "."},
+		{name: ".."},
+		{name: "../etc/passwd"},
+		{name: "src/../../etc/passwd"},
+		{name: "/etc/passwd"},
+		{name: "src\\main.py"},
+		{name: "main\x00.py"},
+		{name: strings.Repeat("a", maxNameLength+1)},
+		{name: strings.Repeat("a/", maxPathLength/2) + "a"},
+	}
+	for _, test := range tests {
+		got, err := SanitizePath(test.name)
+		if test.want == "" {
+			if !errors.Is(err, ErrInvalidPath) {
+				t.Errorf("SanitizePath(%q) = %q, %v, want %v", test.name, got, err, ErrInvalidPath)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("SanitizePath(%q) = %q, %v, want %q", test.name, got, err, test.want)
+		}
+	}
+}
+
+func FuzzSanitizePath(f *testing.F) {
+	for _, seed := range []string{
+		"main.py", "src/lib/util.py", "./a/../b", "..", "../a", "a/../../b", "/a", "//a",
+		"a\\b", "a\x00b", "a//b/", "...", "a/..", strings.Repeat("a", maxNameLength+1),
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, name string) {
+		cleaned, err := SanitizePath(name)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidPath) {
+				t.Fatalf("SanitizePath(%q) = %v, want %v", name, err, ErrInvalidPath)
+			}
+			return
+		}
+		switch {
+		case cleaned == "" || cleaned == "." || cleaned == "..":
+			t.Fatalf("SanitizePath(%q) = %q, want a file path", name, cleaned)
+		case strings.HasPrefix(cleaned, "../"):
+			t.Fatalf("SanitizePath(%q) = %q, escapes the workspace", name, cleaned)
+		case path.IsAbs(cleaned):
+			t.Fatalf("SanitizePath(%q) = %q, is absolute", name, cleaned)
+		case strings.ContainsAny(cleaned, "\x00\\"):
+			t.Fatalf("SanitizePath(%q) = %q, contains a NUL byte or a backslash", name, cleaned)
+		case path.Clean(cleaned) != cleaned:
+			t.Fatalf("SanitizePath(%q) = %q, isn't clean", name, cleaned)
+		}
+		// the workspace joined with the path stays within the workspace
+		if joined := path.Join("/workspace", cleaned); !strings.HasPrefix(joined, "/workspace/") {
+			t.Fatalf("SanitizePath(%q) = %q, lands at %q", name, cleaned, joined)
+		}
+		if again, err := SanitizePath(cleaned); err != nil || again != cleaned {
+			t.Fatalf("SanitizePath(%q) = %q, %v, want it unchanged", cleaned, again, err)
+		}
+	})
+}
@@ -0,0 +1,43 @@
+package pkg
+
+import "sync"
+
+// TailBuffer keeps the last bytes written to it, up to its limit.
+type TailBuffer struct {
+	limit int
+
+	mutex     sync.Mutex
+	data      []byte
+	truncated bool
+}
+
+// NewTailBuffer creates a new instance of TailBuffer keeping up to limit bytes.
+func NewTailBuffer(limit int) *TailBuffer {
+	return &TailBuffer{limit: limit}
+}
+
+// WriteString appends the string, dropping the oldest bytes over the limit.
+func (b *TailBuffer) WriteString(s string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.data = append(b.data, s...)
+	if excess := len(b.data) - b.limit; excess > 0 {
+		b.data = append(b.data[:0], b.data[excess:]...)
+		b.truncated = true
+	}
+}
+
+// String returns the kept bytes.
+func (b *TailBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return string(b.data)
+}
+
+// Truncated reports whether any bytes have been dropped.
+func (b *TailBuffer) Truncated() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.truncated
+}
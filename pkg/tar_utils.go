@@ -2,29 +2,203 @@ package pkg
 
 import (
 	"archive/tar"
-	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+	"time"
 )
 
+const (
+	// defaultFileMode is the mode of the files that don't set one.
+	defaultFileMode = 0o644
+	// dirMode is the mode of the directories created for the files.
+	dirMode = 0o755
+)
+
+// tarModTime is the modification time of every entry, so that the same files
+// always give the same archive bytes, whenever they're written.
+var tarModTime = time.Unix(0, 0)
+
+// FileOwner describes the numeric owner of the files written into a tar archive.
+type FileOwner struct {
+	UID int
+	GID int
+}
+
+// TarFile describes a file written into a tar archive.
+type TarFile struct {
+	// Path is the slash-separated path of the file, relative to the root of the archive.
+	Path string
+	// Content is the content of the file.
+	Content []byte
+	// Mode is the permission bits of the file, 0644 if zero.
+	Mode int64
+	// Owner is the owner of the file, the one of the archive if nil.
+	Owner *FileOwner
+}
+
 // CreateTar creates a new tar archive for submitted files and their byte representation.
-func CreateTar(files map[string][]byte) (io.Reader, error) {
-	buffer := new(bytes.Buffer)
-	tarWriter := tar.NewWriter(buffer)
-	defer tarWriter.Close()
-
-	for name, content := range files {
-		hdr := &tar.Header{
-			Name: name,
-			Mode: 0644,
-			Size: int64(len(content)),
-		}
-		if err := tarWriter.WriteHeader(hdr); err != nil {
+func CreateTar(files map[string][]byte) (io.ReadCloser, error) {
+	return CreateOwnedTar(files, FileOwner{})
+}
+
+// CreateOwnedTar creates a new tar archive for submitted files, marking every
+// entry as owned by the given user and group.
+func CreateOwnedTar(files map[string][]byte, owner FileOwner) (io.ReadCloser, error) {
+	tarFiles := make([]TarFile, 0, len(files))
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		tarFiles = append(tarFiles, TarFile{Path: name, Content: files[name]})
+	}
+	return CreateTarFiles(tarFiles, owner)
+}
+
+// CreateTarFiles creates a new tar archive of the files, sorted by path, every
+// one preceded by the directories it's in, owned by the given user and group
+// unless the file sets its own. The archive is canonical: the entries share a
+// fixed modification time and carry no other metadata, so that the same files
+// give the same bytes whatever their order. The paths escaping the root of the
+// archive are rejected.
+//
+// The archive is written as it's read, so that it's never held in memory next
+// to the files, a failure of the writing being returned by the reads. It must
+// be closed if it isn't read to the end.
+func CreateTarFiles(files []TarFile, owner FileOwner) (io.ReadCloser, error) {
+	cleaned := make([]TarFile, len(files))
+	for index, file := range files {
+		name, err := SanitizePath(file.Path)
+		if err != nil {
 			return nil, err
 		}
-		if _, err := tarWriter.Write(content); err != nil {
-			return nil, err
+		if file.Mode&^0o7777 != 0 {
+			return nil, fmt.Errorf("invalid mode %o of %q", file.Mode, name)
+		}
+		file.Path = name
+		cleaned[index] = file
+	}
+	slices.SortStableFunc(cleaned, func(a, b TarFile) int { return strings.Compare(a.Path, b.Path) })
+	for index := 1; index < len(cleaned); index++ {
+		if cleaned[index-1].Path == cleaned[index].Path {
+			return nil, fmt.Errorf("duplicate file path %q", cleaned[index].Path)
 		}
 	}
 
-	return buffer, nil
+	reader, writer := io.Pipe()
+	go func() {
+		builder := newTarBuilder(tar.NewWriter(writer), owner)
+		writer.CloseWithError(writeTarFiles(builder, cleaned))
+	}()
+	return reader, nil
+}
+
+// TarSHA256 returns the hex-encoded SHA-256 of the canonical archive of the
+// files, as written by CreateTarFiles, for hashing a workspace as a whole.
+func TarSHA256(files []TarFile, owner FileOwner) (string, error) {
+	reader, err := CreateTarFiles(files, owner)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// writeTarFiles writes the files with the builder and closes the archive.
+func writeTarFiles(builder *tarBuilder, files []TarFile) error {
+	for _, file := range files {
+		if err := builder.writeHeader(file.Path, int64(len(file.Content)), file.Mode, file.Owner); err != nil {
+			return err
+		}
+		if _, err := builder.writer.Write(file.Content); err != nil {
+			return err
+		}
+	}
+	return builder.writer.Close()
+}
+
+// tarBuilder writes the files into a tar archive, each one preceded by the
+// headers of its directories not written yet.
+type tarBuilder struct {
+	writer  *tar.Writer
+	owner   FileOwner
+	entries map[string]byte // cleaned path = type flag of the written entry
+}
+
+// newTarBuilder creates a new instance of tarBuilder writing the entries owned
+// by the owner into the writer.
+func newTarBuilder(writer *tar.Writer, owner FileOwner) *tarBuilder {
+	return &tarBuilder{
+		writer:  writer,
+		owner:   owner,
+		entries: make(map[string]byte),
+	}
+}
+
+// record marks the entry as written, e.g. when copied from another archive.
+func (b *tarBuilder) record(hdr *tar.Header) {
+	b.entries[path.Clean(hdr.Name)] = hdr.Typeflag
+}
+
+// writeHeader writes the header of the file at the cleaned path, its content
+// being written next by the caller. A file written again replaces the previous
+// one on extraction, as the submitted files do the generated ones.
+func (b *tarBuilder) writeHeader(name string, size int64, mode int64, owner *FileOwner) error {
+	if b.entries[name] == tar.TypeDir {
+		return fmt.Errorf("file path %q is a directory", name)
+	}
+	if err := b.writeDir(path.Dir(name)); err != nil {
+		return err
+	}
+	if owner == nil {
+		owner = &b.owner
+	}
+	if mode == 0 {
+		mode = defaultFileMode
+	}
+	b.entries[name] = tar.TypeReg
+	return b.writer.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     mode,
+		Size:     size,
+		Uid:      owner.UID,
+		Gid:      owner.GID,
+		ModTime:  tarModTime,
+		Format:   tar.FormatPAX,
+	})
+}
+
+// writeDir writes the headers of the directory and of its parents, unless
+// they're written already.
+func (b *tarBuilder) writeDir(name string) error {
+	if name == "." {
+		return nil
+	}
+	if typeflag, ok := b.entries[name]; ok {
+		if typeflag != tar.TypeDir {
+			return fmt.Errorf("file path %q is also a directory", name)
+		}
+		return nil
+	}
+	if err := b.writeDir(path.Dir(name)); err != nil {
+		return err
+	}
+	b.entries[name] = tar.TypeDir
+	return b.writer.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name + "/",
+		Mode:     dirMode,
+		Uid:      b.owner.UID,
+		Gid:      b.owner.GID,
+		ModTime:  tarModTime,
+		Format:   tar.FormatPAX,
+	})
 }
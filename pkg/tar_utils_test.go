@@ -0,0 +1,287 @@
+package pkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func readAllTar(t *testing.T, files []TarFile, owner FileOwner) ([]byte, error) {
+	t.Helper()
+	reader, err := CreateTarFiles(files, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+func TestCreateTarFilesIsDeterministic(t *testing.T) {
+	files := []TarFile{
+		{Path: "main.py", Content: []byte("print('hello')\n")},
+		{Path: "lib/util.py", Content: []byte("def util(): pass\n"), Mode: 0o600},
+		{Path: "lib/nested/data.txt", Content: []byte("data"), Owner: &FileOwner{UID: 0, GID: 0}},
+		{Path: "./README", Content: nil},
+	}
+	reversed := make([]TarFile, len(files))
+	for index, file := range files {
+		reversed[len(files)-1-index] = file
+	}
+	owner := FileOwner{UID: 1000, GID: 1000}
+
+	first, err := readAllTar(t, files, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := readAllTar(t, reversed, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Error("the same files in a different order give different archives")
+	}
+
+	firstHash, err := TarSHA256(files, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondHash, err := TarSHA256(reversed, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if firstHash != secondHash {
+		t.Errorf("TarSHA256() = %s and %s, want the same hash", firstHash, secondHash)
+	}
+	if otherHash, err := TarSHA256(files, FileOwner{}); err != nil || otherHash == firstHash {
+		t.Errorf("TarSHA256() = %s, %v, want a hash depending on the owner", otherHash, err)
+	}
+
+	// directories come before their files, every entry with the fixed time
+	var names []string
+	reader := tar.NewReader(bytes.NewReader(first))
+	for {
+		hdr, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !hdr.ModTime.Equal(tarModTime) {
+			t.Errorf("entry %q has modification time %s, want %s", hdr.Name, hdr.ModTime, tarModTime)
+		}
+		names = append(names, hdr.Name)
+	}
+	want := "README,lib/,lib/nested/,lib/nested/data.txt,lib/util.py,main.py"
+	if got := strings.Join(names, ","); got != want {
+		t.Errorf("entries = %s, want %s", got, want)
+	}
+}
+
+func TestCreateTarFilesRejectsConflicts(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []TarFile
+	}{
+		{name: "duplicate path", files: []TarFile{{Path: "main.py"}, {Path: "main.py"}}},
+		{name: "duplicate cleaned path", files: []TarFile{{Path: "src/main.py"}, {Path: "src/./lib/../main.py"}}},
+		{name: "file then directory", files: []TarFile{{Path: "src"}, {Path: "src/main.py"}}},
+		{name: "directory then file", files: []TarFile{{Path: "src/lib/util.py"}, {Path: "src/lib"}}},
+		{name: "escaping path", files: []TarFile{{Path: "../main.py"}}},
+		{name: "invalid mode", files: []TarFile{{Path: "main.py", Mode: 0o100644}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := readAllTar(t, test.files, FileOwner{}); err == nil {
+				t.Error("CreateTarFiles() succeeded, want an error")
+			}
+			if _, err := TarSHA256(test.files, FileOwner{}); err == nil {
+				t.Error("TarSHA256() succeeded, want an error")
+			}
+		})
+	}
+}
+
+// tarEntry is an entry read back from an archive.
+type tarEntry struct {
+	typeflag byte
+	name     string
+	mode     int64
+	uid, gid int
+	content  string
+}
+
+// readBackTar reads every entry of the archive, checking the fixed
+// modification time of each.
+func readBackTar(t *testing.T, archive io.ReadCloser) []tarEntry {
+	t.Helper()
+	defer archive.Close()
+	var entries []tarEntry
+	reader := tar.NewReader(archive)
+	for {
+		hdr, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !hdr.ModTime.Equal(tarModTime) {
+			t.Errorf("entry %q has modification time %s, want %s", hdr.Name, hdr.ModTime, tarModTime)
+		}
+		if hdr.Size != int64(len(content)) {
+			t.Errorf("entry %q has size %d, but %d bytes", hdr.Name, hdr.Size, len(content))
+		}
+		entries = append(entries, tarEntry{typeflag: hdr.Typeflag, name: hdr.Name, mode: hdr.Mode,
+			uid: hdr.Uid, gid: hdr.Gid, content: string(content)})
+	}
+}
+
+func TestCreateTarFilesReadsBack(t *testing.T) {
+	root := &FileOwner{}
+	tests := []struct {
+		name    string
+		files   []TarFile
+		owner   FileOwner
+		entries []tarEntry
+	}{
+		{name: "no file", entries: nil},
+		{name: "flat file", files: []TarFile{{Path: "main.py", Content: []byte("print(1)\n")}},
+			owner: FileOwner{UID: 1000, GID: 1000},
+			entries: []tarEntry{
+				{typeflag: tar.TypeReg, name: "main.py", mode: 0o644, uid: 1000, gid: 1000, content: "print(1)\n"},
+			}},
+		{name: "empty file", files: []TarFile{{Path: "empty"}},
+			entries: []tarEntry{{typeflag: tar.TypeReg, name: "empty", mode: 0o644}}},
+		{name: "executable script", files: []TarFile{{Path: "run.sh", Content: []byte("#!/bin/sh\n"), Mode: 0o755}},
+			entries: []tarEntry{{typeflag: tar.TypeReg, name: "run.sh", mode: 0o755, content: "#!/bin/sh\n"}}},
+		{name: "special mode bits", files: []TarFile{{Path: "tool", Mode: 0o4750}},
+			entries: []tarEntry{{typeflag: tar.TypeReg, name: "tool", mode: 0o4750}}},
+		{name: "nested layout", owner: FileOwner{UID: 1000, GID: 100}, files: []TarFile{
+			{Path: "src/main.rs", Content: []byte("fn main() {}\n")},
+			{Path: "Cargo.toml", Content: []byte("[package]\n")},
+			{Path: "src/bin/tool/main.rs", Content: []byte("fn main() {}\n"), Mode: 0o600},
+		}, entries: []tarEntry{
+			{typeflag: tar.TypeReg, name: "Cargo.toml", mode: 0o644, uid: 1000, gid: 100, content: "[package]\n"},
+			{typeflag: tar.TypeDir, name: "src/", mode: 0o755, uid: 1000, gid: 100},
+			{typeflag: tar.TypeDir, name: "src/bin/", mode: 0o755, uid: 1000, gid: 100},
+			{typeflag: tar.TypeDir, name: "src/bin/tool/", mode: 0o755, uid: 1000, gid: 100},
+			{typeflag: tar.TypeReg, name: "src/bin/tool/main.rs", mode: 0o600, uid: 1000, gid: 100, content: "fn main() {}\n"},
+			{typeflag: tar.TypeReg, name: "src/main.rs", mode: 0o644, uid: 1000, gid: 100, content: "fn main() {}\n"},
+		}},
+		{name: "owner of a file", owner: FileOwner{UID: 1000, GID: 1000}, files: []TarFile{
+			{Path: "etc/config", Content: []byte("x"), Owner: root},
+			{Path: "etc/user", Content: []byte("y")},
+		}, entries: []tarEntry{
+			// the directories are the archive owner's, whoever owns their files
+			{typeflag: tar.TypeDir, name: "etc/", mode: 0o755, uid: 1000, gid: 1000},
+			{typeflag: tar.TypeReg, name: "etc/config", mode: 0o644, content: "x"},
+			{typeflag: tar.TypeReg, name: "etc/user", mode: 0o644, uid: 1000, gid: 1000, content: "y"},
+		}},
+		{name: "uncleaned paths", files: []TarFile{
+			{Path: "./src//lib/../main.go", Content: []byte("package main\n")},
+			{Path: "dir/", Content: []byte("a file")},
+		}, entries: []tarEntry{
+			{typeflag: tar.TypeReg, name: "dir", mode: 0o644, content: "a file"},
+			{typeflag: tar.TypeDir, name: "src/", mode: 0o755},
+			{typeflag: tar.TypeReg, name: "src/main.go", mode: 0o644, content: "package main\n"},
+		}},
+		{name: "binary content", files: []TarFile{{Path: "data.bin", Content: []byte{0, 0xff, '\n', 0}}},
+			entries: []tarEntry{{typeflag: tar.TypeReg, name: "data.bin", mode: 0o644, content: "\x00\xff\n\x00"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			archive, err := CreateTarFiles(test.files, test.owner)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entries := readBackTar(t, archive); !slices.Equal(entries, test.entries) {
+				t.Errorf("entries = %+v, want %+v", entries, test.entries)
+			}
+		})
+	}
+}
+
+func TestCreateTarKeepsTheMapOfFiles(t *testing.T) {
+	files := map[string][]byte{"main.py": []byte("import lib\n"), "lib/__init__.py": nil}
+	want := []tarEntry{
+		{typeflag: tar.TypeDir, name: "lib/", mode: 0o755},
+		{typeflag: tar.TypeReg, name: "lib/__init__.py", mode: 0o644},
+		{typeflag: tar.TypeReg, name: "main.py", mode: 0o644, content: "import lib\n"},
+	}
+	archive, err := CreateTar(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries := readBackTar(t, archive); !slices.Equal(entries, want) {
+		t.Errorf("CreateTar() entries = %+v, want %+v", entries, want)
+	}
+
+	for index := range want {
+		want[index].uid, want[index].gid = 1000, 1000
+	}
+	if archive, err = CreateOwnedTar(files, FileOwner{UID: 1000, GID: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	if entries := readBackTar(t, archive); !slices.Equal(entries, want) {
+		t.Errorf("CreateOwnedTar() entries = %+v, want %+v", entries, want)
+	}
+
+	for _, name := range []string{"/etc/passwd", "../main.py", "src/../../main.py", `src\main.py`} {
+		if _, err := CreateTar(map[string][]byte{name: nil}); !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("CreateTar() of %q = %v, want %v", name, err, ErrInvalidPath)
+		}
+	}
+}
+
+// streamTar reads the archive of a single file of the size to the end.
+func streamTar(tb testing.TB, content []byte) {
+	tb.Helper()
+	reader, err := CreateTarFiles([]TarFile{{Path: "src/data.bin", Content: content}}, FileOwner{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer reader.Close()
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func BenchmarkCreateTarFiles(b *testing.B) {
+	for _, size := range []int{64 << 10, 1 << 20, 8 << 20} {
+		content := bytes.Repeat([]byte("x"), size)
+		b.Run(fmt.Sprintf("%dKiB", size>>10), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			for b.Loop() {
+				streamTar(b, content)
+			}
+		})
+	}
+}
+
+func TestCreateTarFilesAllocatesIndependentlyOfTheContent(t *testing.T) {
+	allocated := func(size int) uint64 {
+		content := bytes.Repeat([]byte("x"), size)
+		result := testing.Benchmark(func(b *testing.B) {
+			for b.Loop() {
+				streamTar(b, content)
+			}
+		})
+		return uint64(result.AllocedBytesPerOp())
+	}
+	small, large := allocated(64<<10), allocated(8<<20)
+	// the archive is streamed, never held in memory next to the content
+	if large > small+(64<<10) {
+		t.Errorf("the archive of 8MiB allocates %d bytes, of 64KiB %d, want no more than the tar buffers", large, small)
+	}
+}